@@ -2,11 +2,13 @@ package api
 
 import (
 	"encoding/json"
+	"errors"
 	"fmt"
 	"net/http"
 	"strings"
 	"time"
 
+	"github.com/capsali/virtumancer/internal/libvirt"
 	log "github.com/capsali/virtumancer/internal/logging"
 	"github.com/go-chi/chi/v5"
 )
@@ -86,9 +88,19 @@ func (h *APIHandler) HandleError(w http.ResponseWriter, err error, operation str
 
 	var apiErr *APIError
 	var statusCode int
+	var keyMismatch *libvirt.HostKeyMismatchError
+	var agentUnavailable *libvirt.GuestAgentUnavailableError
 
 	// Convert different error types to structured API errors
 	switch {
+	case errors.As(err, &keyMismatch):
+		apiErr = NewAPIError(ErrorCodeConflict, "SSH host key mismatch", err.Error())
+		statusCode = http.StatusConflict
+
+	case errors.As(err, &agentUnavailable):
+		apiErr = NewAPIError(ErrorCodeVMStateError, "Guest agent unavailable", err.Error())
+		statusCode = http.StatusConflict
+
 	case strings.Contains(strings.ToLower(err.Error()), "not found"):
 		if strings.Contains(strings.ToLower(err.Error()), "host") {
 			apiErr = NewAPIError(ErrorCodeHostNotFound, "Host not found", err.Error())
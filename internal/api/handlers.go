@@ -1,10 +1,15 @@
 package api
 
 import (
+	"crypto/sha256"
+	"encoding/hex"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
 	"net/http"
 	"strconv"
+	"strings"
 	"time"
 
 	log "github.com/capsali/virtumancer/internal/logging"
@@ -23,10 +28,10 @@ type APIHandler struct {
 	HostService services.HostServiceProvider
 	Hub         *ws.Hub
 	DB          *gorm.DB
-	Connector   *libvirt.Connector
+	Connector   libvirt.Hypervisor
 }
 
-func NewAPIHandler(hostService services.HostServiceProvider, hub *ws.Hub, db *gorm.DB, connector *libvirt.Connector) *APIHandler {
+func NewAPIHandler(hostService services.HostServiceProvider, hub *ws.Hub, db *gorm.DB, connector libvirt.Hypervisor) *APIHandler {
 	return &APIHandler{
 		HostService: hostService,
 		Hub:         hub,
@@ -54,12 +59,51 @@ func (h *APIHandler) HealthCheck(w http.ResponseWriter, r *http.Request) {
 }
 
 func (h *APIHandler) CreateHost(w http.ResponseWriter, r *http.Request) {
-	var host storage.Host
-	if err := json.NewDecoder(r.Body).Decode(&host); err != nil {
+	// Private keys are accepted in plaintext on create and encrypted before
+	// they are stored; storage.Host never serializes them.
+	var req struct {
+		storage.Host
+		SSHPrivateKey string `json:"ssh_private_key"`
+		TLSClientKey  string `json:"tls_client_key"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
 		apiErr := NewAPIError(ErrorCodeValidation, "Invalid request body", "Failed to parse JSON request")
 		WriteError(w, apiErr, http.StatusBadRequest)
 		return
 	}
+	host := req.Host
+
+	if req.SSHPrivateKey != "" {
+		encrypted, err := services.EncryptSSHPrivateKey(req.SSHPrivateKey)
+		if err != nil {
+			WriteError(w, NewAPIError(ErrorCodeValidation, "Invalid SSH private key", err.Error()), http.StatusBadRequest)
+			return
+		}
+		host.SSHPrivateKey = encrypted
+	}
+	if host.SSHHostKeys != "" {
+		if _, err := libvirt.ParsePinnedHostKeys(host.SSHHostKeys); err != nil {
+			WriteError(w, NewAPIError(ErrorCodeValidation, "Invalid SSH host keys", err.Error()), http.StatusBadRequest)
+			return
+		}
+	}
+	if req.TLSClientKey != "" {
+		encrypted, err := services.EncryptTLSClientKey(req.TLSClientKey)
+		if err != nil {
+			WriteError(w, NewAPIError(ErrorCodeValidation, "Invalid TLS client key", err.Error()), http.StatusBadRequest)
+			return
+		}
+		host.TLSClientKey = encrypted
+	}
+	for _, cert := range []struct{ name, pem string }{{"CA certificate", host.TLSCACert}, {"client certificate", host.TLSClientCert}} {
+		if cert.pem == "" {
+			continue
+		}
+		if err := libvirt.ParseTLSCertificates(cert.pem); err != nil {
+			WriteError(w, NewAPIError(ErrorCodeValidation, "Invalid TLS "+cert.name, err.Error()), http.StatusBadRequest)
+			return
+		}
+	}
 
 	// Validate required fields - only URI is required, ID will be generated if not provided
 	if host.URI == "" {
@@ -68,6 +112,11 @@ func (h *APIHandler) CreateHost(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	if err := libvirt.ValidateURI(host.URI); err != nil {
+		WriteError(w, NewAPIError(ErrorCodeValidation, "Invalid host URI", err.Error()), http.StatusBadRequest)
+		return
+	}
+
 	// Generate ID if not provided
 	if host.ID == "" {
 		host.ID = uuid.New().String()
@@ -100,10 +149,7 @@ func (h *APIHandler) GetHosts(w http.ResponseWriter, r *http.Request) {
 	out := make([]hostWithStatus, 0, len(hosts))
 	for _, host := range hosts {
 		// Consider the host connected if the connector has an active connection.
-		connected := true
-		if _, err := h.Connector.GetConnection(host.ID); err != nil {
-			connected = false
-		}
+		connected := h.Connector.IsConnected(host.ID)
 		out = append(out, hostWithStatus{Host: host, Connected: connected})
 	}
 
@@ -115,10 +161,7 @@ func (h *APIHandler) GetHostInfo(w http.ResponseWriter, r *http.Request) {
 	hostID := chi.URLParam(r, "hostID")
 	// Return host info when connected and include a connected flag so the UI
 	// can always show connection state without treating missing info as an error.
-	connected := true
-	if _, err := h.Connector.GetConnection(hostID); err != nil {
-		connected = false
-	}
+	connected := h.Connector.IsConnected(hostID)
 
 	var info *libvirt.HostInfo
 	if connected {
@@ -169,6 +212,18 @@ func (h *APIHandler) UpdateHost(w http.ResponseWriter, r *http.Request) {
 	var updateData struct {
 		Name                  *string `json:"name,omitempty"`
 		AutoReconnectDisabled *bool   `json:"auto_reconnect_disabled,omitempty"`
+		SSHHostKeys           *string `json:"ssh_host_keys,omitempty"`
+		SSHKnownHostsFile     *string `json:"ssh_known_hosts_file,omitempty"`
+		SSHUseAgent           *bool   `json:"ssh_use_agent,omitempty"`
+		SSHJumpHosts          *string `json:"ssh_jump_hosts,omitempty"`
+		// An empty string removes the stored key.
+		SSHPrivateKey     *string `json:"ssh_private_key,omitempty"`
+		TLSCACert         *string `json:"tls_ca_cert,omitempty"`
+		TLSClientCert     *string `json:"tls_client_cert,omitempty"`
+		TLSClientKey      *string `json:"tls_client_key,omitempty"`
+		TLSCACertPath     *string `json:"tls_ca_cert_path,omitempty"`
+		TLSClientCertPath *string `json:"tls_client_cert_path,omitempty"`
+		TLSClientKeyPath  *string `json:"tls_client_key_path,omitempty"`
 	}
 
 	if err := json.NewDecoder(r.Body).Decode(&updateData); err != nil {
@@ -191,6 +246,67 @@ func (h *APIHandler) UpdateHost(w http.ResponseWriter, r *http.Request) {
 	if updateData.AutoReconnectDisabled != nil {
 		updates["auto_reconnect_disabled"] = *updateData.AutoReconnectDisabled
 	}
+	if updateData.SSHHostKeys != nil {
+		if _, err := libvirt.ParsePinnedHostKeys(*updateData.SSHHostKeys); err != nil {
+			WriteError(w, NewAPIError(ErrorCodeValidation, "Invalid SSH host keys", err.Error()), http.StatusBadRequest)
+			return
+		}
+		updates["ssh_host_keys"] = *updateData.SSHHostKeys
+	}
+	if updateData.SSHKnownHostsFile != nil {
+		updates["ssh_known_hosts_file"] = *updateData.SSHKnownHostsFile
+	}
+	if updateData.SSHUseAgent != nil {
+		updates["ssh_use_agent"] = *updateData.SSHUseAgent
+	}
+	if updateData.SSHJumpHosts != nil {
+		updates["ssh_jump_hosts"] = *updateData.SSHJumpHosts
+	}
+	if updateData.SSHPrivateKey != nil {
+		encrypted := ""
+		if *updateData.SSHPrivateKey != "" {
+			var err error
+			encrypted, err = services.EncryptSSHPrivateKey(*updateData.SSHPrivateKey)
+			if err != nil {
+				WriteError(w, NewAPIError(ErrorCodeValidation, "Invalid SSH private key", err.Error()), http.StatusBadRequest)
+				return
+			}
+		}
+		updates["ssh_private_key"] = encrypted
+	}
+	for column, cert := range map[string]*string{"tls_ca_cert": updateData.TLSCACert, "tls_client_cert": updateData.TLSClientCert} {
+		if cert == nil {
+			continue
+		}
+		if *cert != "" {
+			if err := libvirt.ParseTLSCertificates(*cert); err != nil {
+				WriteError(w, NewAPIError(ErrorCodeValidation, "Invalid TLS certificate", fmt.Sprintf("%s: %v", column, err)), http.StatusBadRequest)
+				return
+			}
+		}
+		updates[column] = *cert
+	}
+	if updateData.TLSClientKey != nil {
+		encrypted := ""
+		if *updateData.TLSClientKey != "" {
+			var err error
+			encrypted, err = services.EncryptTLSClientKey(*updateData.TLSClientKey)
+			if err != nil {
+				WriteError(w, NewAPIError(ErrorCodeValidation, "Invalid TLS client key", err.Error()), http.StatusBadRequest)
+				return
+			}
+		}
+		updates["tls_client_key"] = encrypted
+	}
+	if updateData.TLSCACertPath != nil {
+		updates["tls_ca_cert_path"] = *updateData.TLSCACertPath
+	}
+	if updateData.TLSClientCertPath != nil {
+		updates["tls_client_cert_path"] = *updateData.TLSClientCertPath
+	}
+	if updateData.TLSClientKeyPath != nil {
+		updates["tls_client_key_path"] = *updateData.TLSClientKeyPath
+	}
 
 	// Apply updates
 	if len(updates) > 0 {
@@ -199,6 +315,11 @@ func (h *APIHandler) UpdateHost(w http.ResponseWriter, r *http.Request) {
 			h.HandleError(w, err, "update_host")
 			return
 		}
+		// Updates with a map do not refresh every field on the struct
+		if err := h.DB.Where("id = ?", hostID).First(&host).Error; err != nil {
+			h.HandleError(w, err, "update_host")
+			return
+		}
 	}
 
 	// Return updated host
@@ -206,6 +327,30 @@ func (h *APIHandler) UpdateHost(w http.ResponseWriter, r *http.Request) {
 	json.NewEncoder(w).Encode(host)
 }
 
+// RetrustHostKeys clears the pinned SSH host keys for a host and reconnects,
+// pinning the keys it presents now. The response includes their fingerprints
+// so they can be checked against the host out of band.
+func (h *APIHandler) RetrustHostKeys(w http.ResponseWriter, r *http.Request) {
+	hostID := chi.URLParam(r, "hostID")
+	if !h.ValidateRequest(w, r, "hostID") {
+		return
+	}
+
+	host, err := h.HostService.RetrustHostKeys(hostID)
+	if err != nil {
+		h.HandleError(w, err, "retrust_host_keys")
+		return
+	}
+	fingerprints, err := libvirt.PinnedHostKeyFingerprints(host.SSHHostKeys)
+	if err != nil {
+		h.HandleError(w, err, "retrust_host_keys")
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{"host": host, "fingerprints": fingerprints})
+}
+
 func (h *APIHandler) DeleteHost(w http.ResponseWriter, r *http.Request) {
 	hostID := chi.URLParam(r, "hostID")
 	if !h.ValidateRequest(w, r, "hostID") {
@@ -253,13 +398,14 @@ func (h *APIHandler) CreateVM(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	if vmData.VCPUCount <= 0 {
+	// A flavor fills in the vCPUs and memory left out.
+	if vmData.VCPUCount <= 0 && vmData.ResourceClass == "" {
 		apiErr := NewAPIError(ErrorCodeValidation, "Invalid VCPU count", "VCPU count must be greater than 0")
 		WriteError(w, apiErr, http.StatusBadRequest)
 		return
 	}
 
-	if vmData.MemoryBytes <= 0 {
+	if vmData.MemoryBytes <= 0 && vmData.ResourceClass == "" {
 		apiErr := NewAPIError(ErrorCodeValidation, "Invalid memory size", "Memory must be greater than 0")
 		WriteError(w, apiErr, http.StatusBadRequest)
 		return
@@ -288,7 +434,7 @@ func (h *APIHandler) ListDiscoveredVMs(w http.ResponseWriter, r *http.Request) {
 	hostID := chi.URLParam(r, "hostID")
 	// If we don't have an active libvirt connection for this host, return an empty list.
 	// Discovered-VMs is a lightweight UI-only fetch; a disconnected host shouldn't produce a 500.
-	if _, err := h.Connector.GetConnection(hostID); err != nil {
+	if !h.Connector.IsConnected(hostID) {
 		w.Header().Set("Content-Type", "application/json")
 		json.NewEncoder(w).Encode([]interface{}{})
 		return
@@ -734,204 +880,746 @@ func (h *APIHandler) ForceResetVM(w http.ResponseWriter, r *http.Request) {
 	w.WriteHeader(http.StatusNoContent)
 }
 
-func (h *APIHandler) SyncVMLive(w http.ResponseWriter, r *http.Request) {
+// PauseVM pauses a running VM.
+func (h *APIHandler) PauseVM(w http.ResponseWriter, r *http.Request) {
 	hostID := chi.URLParam(r, "hostID")
 	vmName := chi.URLParam(r, "vmName")
-	if err := h.HostService.SyncVMFromLibvirt(hostID, vmName); err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+	if err := h.HostService.PauseVM(hostID, vmName); err != nil {
+		h.HandleError(w, err, fmt.Sprintf("pause_vm_%s", vmName))
 		return
 	}
 	w.WriteHeader(http.StatusNoContent)
 }
 
-func (h *APIHandler) RebuildVM(w http.ResponseWriter, r *http.Request) {
+// ResumeVM resumes a paused VM.
+func (h *APIHandler) ResumeVM(w http.ResponseWriter, r *http.Request) {
 	hostID := chi.URLParam(r, "hostID")
 	vmName := chi.URLParam(r, "vmName")
-	if err := h.HostService.RebuildVMFromDB(hostID, vmName); err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+	if err := h.HostService.ResumeVM(hostID, vmName); err != nil {
+		h.HandleError(w, err, fmt.Sprintf("resume_vm_%s", vmName))
 		return
 	}
 	w.WriteHeader(http.StatusNoContent)
 }
 
-// UpdateVMState updates the intended state of a VM in the database to match the provided state
-func (h *APIHandler) UpdateVMState(w http.ResponseWriter, r *http.Request) {
+// ManagedSaveVM saves a running VM to disk and stops it.
+func (h *APIHandler) ManagedSaveVM(w http.ResponseWriter, r *http.Request) {
 	hostID := chi.URLParam(r, "hostID")
 	vmName := chi.URLParam(r, "vmName")
-
-	var req struct {
-		State string `json:"state"`
-	}
-	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
-		http.Error(w, "Invalid JSON", http.StatusBadRequest)
+	if err := h.HostService.ManagedSaveVM(hostID, vmName); err != nil {
+		h.HandleError(w, err, fmt.Sprintf("managed_save_vm_%s", vmName))
 		return
 	}
+	w.WriteHeader(http.StatusNoContent)
+}
 
-	if err := h.HostService.UpdateVMState(hostID, vmName, req.State); err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+// RestoreVM starts a VM from its managed save image.
+func (h *APIHandler) RestoreVM(w http.ResponseWriter, r *http.Request) {
+	hostID := chi.URLParam(r, "hostID")
+	vmName := chi.URLParam(r, "vmName")
+	if err := h.HostService.RestoreVM(hostID, vmName); err != nil {
+		h.HandleError(w, err, fmt.Sprintf("restore_vm_%s", vmName))
 		return
 	}
-
 	w.WriteHeader(http.StatusNoContent)
 }
 
-// GetHostStats returns statistics for a specific host
-func (h *APIHandler) GetHostStats(w http.ResponseWriter, r *http.Request) {
+// DeleteVM deletes a VM. The optional body says whether to destroy it if it
+// is running and what to do with its disks.
+func (h *APIHandler) DeleteVM(w http.ResponseWriter, r *http.Request) {
 	hostID := chi.URLParam(r, "hostID")
+	vmName := chi.URLParam(r, "vmName")
 
-	// Get real-time host statistics
-	hostStats, err := h.HostService.GetHostStats(hostID)
-	if err != nil {
-		h.HandleError(w, err, fmt.Sprintf("get_host_stats_%s", hostID))
+	var req services.VMDeleteRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil && !errors.Is(err, io.EOF) {
+		WriteError(w, NewAPIError(ErrorCodeValidation, "Invalid request body", "Failed to parse JSON request"), http.StatusBadRequest)
 		return
 	}
 
-	// Get basic host info
-	hostInfo, err := h.HostService.GetHostInfo(hostID)
-	if err != nil {
-		h.HandleError(w, err, fmt.Sprintf("get_host_info_%s", hostID))
+	if err := h.HostService.DeleteVM(hostID, vmName, req); err != nil {
+		h.HandleError(w, err, fmt.Sprintf("delete_vm_%s", vmName))
 		return
 	}
+	w.WriteHeader(http.StatusNoContent)
+}
 
-	// Get VMs for this host to calculate VM statistics
-	vms, err := h.HostService.GetVMsForHostFromDB(hostID)
-	if err != nil {
-		log.Printf("Warning: failed to get VMs for host %s: %v", hostID, err)
-		vms = []services.VMView{} // Continue with empty VMs if this fails
-	}
+// ResizeVM changes a VM's vCPUs and memory.
+func (h *APIHandler) ResizeVM(w http.ResponseWriter, r *http.Request) {
+	hostID := chi.URLParam(r, "hostID")
+	vmName := chi.URLParam(r, "vmName")
 
-	// Calculate VM state counts
-	vmCounts := map[string]int{
-		"ACTIVE":  0,
-		"STOPPED": 0,
-		"PAUSED":  0,
-		"ERROR":   0,
-		"UNKNOWN": 0,
+	var req services.VMResizeRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		WriteError(w, NewAPIError(ErrorCodeValidation, "Invalid request body", "Failed to parse JSON request"), http.StatusBadRequest)
+		return
 	}
 
-	for _, vm := range vms {
-		vmCounts[string(vm.State)]++
+	vm, err := h.HostService.ResizeVM(hostID, vmName, req)
+	if err != nil {
+		h.HandleError(w, err, fmt.Sprintf("resize_vm_%s", vmName))
+		return
 	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(vm)
+}
 
-	// Calculate disk totals from storage pools
-	var totalDiskBytes uint64 = 0
-	var freeDiskBytes uint64 = 0
-	var storagePools []storage.StoragePool
-	if err := h.DB.Where("host_id = ?", hostID).Find(&storagePools).Error; err != nil {
-		log.Printf("Warning: failed to get storage pools for host %s: %v", hostID, err)
-	} else {
-		for _, pool := range storagePools {
-			totalDiskBytes += pool.CapacityBytes
-			freeDiskBytes += pool.CapacityBytes - pool.AllocationBytes
-		}
+func (h *APIHandler) SyncVMLive(w http.ResponseWriter, r *http.Request) {
+	hostID := chi.URLParam(r, "hostID")
+	vmName := chi.URLParam(r, "vmName")
+	if err := h.HostService.SyncVMFromLibvirt(hostID, vmName); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
 	}
+	w.WriteHeader(http.StatusNoContent)
+}
 
-	// Build response with real-time stats and VM statistics
-	stats := map[string]interface{}{
-		"cpu_percent":      hostStats.CPUUtilization * 100, // Convert to percentage
-		"memory_total":     hostInfo.Memory,
-		"memory_available": hostInfo.Memory - hostStats.MemoryUsed,
-		"disk_total":       totalDiskBytes,
-		"disk_free":        freeDiskBytes,
-		"uptime":           0, // TODO: implement uptime
-		"vm_count":         len(vms),
-		"host_info":        hostInfo,
-		"vm_counts":        vmCounts,
-		"total_vms":        len(vms),
-		"resources": map[string]interface{}{
-			"memory_bytes": hostInfo.Memory,
-			"cpu_count":    hostInfo.CPU,
-			"hostname":     hostInfo.Hostname,
-		},
+func (h *APIHandler) RebuildVM(w http.ResponseWriter, r *http.Request) {
+	hostID := chi.URLParam(r, "hostID")
+	vmName := chi.URLParam(r, "vmName")
+	if err := h.HostService.RebuildVMFromDB(hostID, vmName); err != nil {
+		h.HandleError(w, err, "rebuild_vm")
+		return
 	}
-
-	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(stats)
+	w.WriteHeader(http.StatusNoContent)
 }
 
-// GetHostCapabilities returns discovered capabilities for a host
-func (h *APIHandler) GetHostCapabilities(w http.ResponseWriter, r *http.Request) {
-	hostID := chi.URLParam(r, "hostID")
+// --- Snapshot Handlers ---
 
-	capabilities, err := h.HostService.GetHostCapabilities(hostID)
+func (h *APIHandler) ListVMSnapshots(w http.ResponseWriter, r *http.Request) {
+	hostID := chi.URLParam(r, "hostID")
+	vmName := chi.URLParam(r, "vmName")
+	snapshots, err := h.HostService.ListVMSnapshots(hostID, vmName)
 	if err != nil {
-		h.HandleError(w, err, fmt.Sprintf("get_host_capabilities_%s", hostID))
+		h.HandleError(w, err, "list_vm_snapshots")
 		return
 	}
-
 	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(capabilities)
+	json.NewEncoder(w).Encode(snapshots)
 }
 
-// RefreshHostCapabilities manually triggers host capability discovery
-func (h *APIHandler) RefreshHostCapabilities(w http.ResponseWriter, r *http.Request) {
+func (h *APIHandler) CreateVMSnapshot(w http.ResponseWriter, r *http.Request) {
 	hostID := chi.URLParam(r, "hostID")
+	vmName := chi.URLParam(r, "vmName")
 
-	if err := h.HostService.RefreshHostCapabilities(hostID); err != nil {
-		h.HandleError(w, err, fmt.Sprintf("refresh_host_capabilities_%s", hostID))
+	var spec libvirt.SnapshotSpec
+	if err := json.NewDecoder(r.Body).Decode(&spec); err != nil {
+		WriteError(w, NewAPIError(ErrorCodeValidation, "Invalid request body", "Failed to parse JSON request"), http.StatusBadRequest)
+		return
+	}
+	if spec.Name == "" {
+		WriteError(w, NewAPIError(ErrorCodeValidation, "Missing required fields", "Snapshot name is required"), http.StatusBadRequest)
+		return
+	}
+	if spec.DiskOnly && !spec.External {
+		WriteError(w, NewAPIError(ErrorCodeValidation, "Invalid snapshot type", "Disk-only snapshots must be external"), http.StatusBadRequest)
 		return
 	}
 
+	snapshot, err := h.HostService.CreateVMSnapshot(hostID, vmName, spec)
+	if err != nil {
+		h.HandleError(w, err, "create_vm_snapshot")
+		return
+	}
 	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(map[string]interface{}{
-		"success": true,
-		"message": "Host capabilities refreshed successfully",
-	})
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(snapshot)
 }
 
-// --- Dashboard Endpoints ---
-
-// GetDashboardStats returns aggregated system-wide statistics.
-func (h *APIHandler) GetDashboardStats(w http.ResponseWriter, r *http.Request) {
-	stats, err := h.HostService.GetDashboardStats()
-	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+func (h *APIHandler) RevertVMSnapshot(w http.ResponseWriter, r *http.Request) {
+	hostID := chi.URLParam(r, "hostID")
+	vmName := chi.URLParam(r, "vmName")
+	snapshotName := chi.URLParam(r, "snapshotName")
+	if err := h.HostService.RevertVMSnapshot(hostID, vmName, snapshotName); err != nil {
+		h.HandleError(w, err, "revert_vm_snapshot")
 		return
 	}
+	w.WriteHeader(http.StatusNoContent)
+}
 
-	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(stats)
+func (h *APIHandler) DeleteVMSnapshot(w http.ResponseWriter, r *http.Request) {
+	hostID := chi.URLParam(r, "hostID")
+	vmName := chi.URLParam(r, "vmName")
+	snapshotName := chi.URLParam(r, "snapshotName")
+	if err := h.HostService.DeleteVMSnapshot(hostID, vmName, snapshotName); err != nil {
+		h.HandleError(w, err, "delete_vm_snapshot")
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
 }
 
-// GetDashboardActivity returns recent system activity events.
-func (h *APIHandler) GetDashboardActivity(w http.ResponseWriter, r *http.Request) {
-	// Get limit from query parameters, default to 10
-	limitStr := r.URL.Query().Get("limit")
-	limit := 10
-	if limitStr != "" {
-		if parsedLimit, err := strconv.Atoi(limitStr); err == nil && parsedLimit > 0 {
-			limit = parsedLimit
-		}
+func (h *APIHandler) MigrateVM(w http.ResponseWriter, r *http.Request) {
+	hostID := chi.URLParam(r, "hostID")
+	vmName := chi.URLParam(r, "vmName")
+
+	var req services.MigrationRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		WriteError(w, NewAPIError(ErrorCodeValidation, "Invalid request body", "Failed to parse JSON request"), http.StatusBadRequest)
+		return
+	}
+	if req.TargetHostID == "" {
+		WriteError(w, NewAPIError(ErrorCodeValidation, "Missing required fields", "Target host ID is required"), http.StatusBadRequest)
+		return
+	}
+	if req.TargetHostID == hostID {
+		WriteError(w, NewAPIError(ErrorCodeValidation, "Invalid target host", "The VM is already on the target host"), http.StatusBadRequest)
+		return
 	}
 
-	activities, err := h.HostService.GetDashboardActivity(limit)
+	result, err := h.HostService.MigrateVM(hostID, vmName, req)
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		h.HandleError(w, err, "migrate_vm")
 		return
 	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(result)
+}
 
-	response := map[string]interface{}{
-		"activities": activities,
-		"pagination": map[string]interface{}{
-			"total": len(activities),
-			"page":  1,
-			"limit": limit,
-		},
+// CloneVM copies a shut-off VM under a new name, optionally to another host or pool.
+func (h *APIHandler) CloneVM(w http.ResponseWriter, r *http.Request) {
+	hostID := chi.URLParam(r, "hostID")
+	vmName := chi.URLParam(r, "vmName")
+
+	var req services.CloneRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		WriteError(w, NewAPIError(ErrorCodeValidation, "Invalid request body", "Failed to parse JSON request"), http.StatusBadRequest)
+		return
+	}
+	if req.Name == "" {
+		WriteError(w, NewAPIError(ErrorCodeValidation, "Missing required fields", "Clone name is required"), http.StatusBadRequest)
+		return
 	}
 
+	clone, err := h.HostService.CloneVM(hostID, vmName, req)
+	if err != nil {
+		h.HandleError(w, err, "clone_vm")
+		return
+	}
 	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(response)
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(clone)
 }
 
-// GetDashboardOverview returns combined dashboard data for initial page load.
-func (h *APIHandler) GetDashboardOverview(w http.ResponseWriter, r *http.Request) {
-	stats, err := h.HostService.GetDashboardStats()
+// ListTemplates lists the templates of every host.
+func (h *APIHandler) ListTemplates(w http.ResponseWriter, r *http.Request) {
+	templates, err := h.HostService.ListTemplates()
 	if err != nil {
-		http.Error(w, fmt.Sprintf("failed to get stats: %v", err), http.StatusInternalServerError)
+		h.HandleError(w, err, "list_templates")
 		return
 	}
-
-	activities, err := h.HostService.GetDashboardActivity(5)
+	if templates == nil {
+		templates = []storage.VirtualMachine{}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(templates)
+}
+
+// ConvertVMToTemplate turns a shut-off VM into a template.
+func (h *APIHandler) ConvertVMToTemplate(w http.ResponseWriter, r *http.Request) {
+	hostID := chi.URLParam(r, "hostID")
+	vmName := chi.URLParam(r, "vmName")
+
+	vm, err := h.HostService.ConvertVMToTemplate(hostID, vmName)
+	if err != nil {
+		h.HandleError(w, err, "convert_vm_to_template")
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(vm)
+}
+
+// ConvertTemplateToVM turns a template back into a VM.
+func (h *APIHandler) ConvertTemplateToVM(w http.ResponseWriter, r *http.Request) {
+	hostID := chi.URLParam(r, "hostID")
+	vmName := chi.URLParam(r, "vmName")
+
+	vm, err := h.HostService.ConvertTemplateToVM(hostID, vmName)
+	if err != nil {
+		h.HandleError(w, err, "convert_template_to_vm")
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(vm)
+}
+
+// InstantiateTemplate creates VMs from a template.
+func (h *APIHandler) InstantiateTemplate(w http.ResponseWriter, r *http.Request) {
+	hostID := chi.URLParam(r, "hostID")
+	vmName := chi.URLParam(r, "vmName")
+
+	var req services.TemplateInstantiateRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		WriteError(w, NewAPIError(ErrorCodeValidation, "Invalid request body", "Failed to parse JSON request"), http.StatusBadRequest)
+		return
+	}
+
+	instances, err := h.HostService.InstantiateTemplate(hostID, vmName, req)
+	if err != nil {
+		h.HandleError(w, err, "instantiate_template")
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(instances)
+}
+
+// CopyTemplate copies a template to another host's pool.
+func (h *APIHandler) CopyTemplate(w http.ResponseWriter, r *http.Request) {
+	hostID := chi.URLParam(r, "hostID")
+	vmName := chi.URLParam(r, "vmName")
+
+	var req services.TemplateCopyRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		WriteError(w, NewAPIError(ErrorCodeValidation, "Invalid request body", "Failed to parse JSON request"), http.StatusBadRequest)
+		return
+	}
+	if req.TargetHostID == "" {
+		WriteError(w, NewAPIError(ErrorCodeValidation, "Missing required fields", "Target host ID is required"), http.StatusBadRequest)
+		return
+	}
+
+	copied, err := h.HostService.CopyTemplate(hostID, vmName, req)
+	if err != nil {
+		h.HandleError(w, err, "copy_template")
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(copied)
+}
+
+// ListFlavors lists every flavor.
+func (h *APIHandler) ListFlavors(w http.ResponseWriter, r *http.Request) {
+	flavors, err := h.HostService.ListFlavors()
+	if err != nil {
+		h.HandleError(w, err, "list_flavors")
+		return
+	}
+	if flavors == nil {
+		flavors = []storage.ResourceClass{}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(flavors)
+}
+
+// CreateFlavor creates a flavor.
+func (h *APIHandler) CreateFlavor(w http.ResponseWriter, r *http.Request) {
+	var req services.FlavorRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		WriteError(w, NewAPIError(ErrorCodeValidation, "Invalid request body", "Failed to parse JSON request"), http.StatusBadRequest)
+		return
+	}
+
+	flavor, err := h.HostService.CreateFlavor(req)
+	if err != nil {
+		h.HandleError(w, err, "create_flavor")
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(flavor)
+}
+
+// GetFlavor returns a flavor.
+func (h *APIHandler) GetFlavor(w http.ResponseWriter, r *http.Request) {
+	id := chi.URLParam(r, "id")
+	flavor, err := h.HostService.GetFlavor(id)
+	if err != nil {
+		h.HandleError(w, err, "get_flavor")
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(flavor)
+}
+
+// UpdateFlavor replaces the settings of a flavor.
+func (h *APIHandler) UpdateFlavor(w http.ResponseWriter, r *http.Request) {
+	id := chi.URLParam(r, "id")
+
+	var req services.FlavorRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		WriteError(w, NewAPIError(ErrorCodeValidation, "Invalid request body", "Failed to parse JSON request"), http.StatusBadRequest)
+		return
+	}
+
+	flavor, err := h.HostService.UpdateFlavor(id, req)
+	if err != nil {
+		h.HandleError(w, err, "update_flavor")
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(flavor)
+}
+
+// DeleteFlavor deletes a flavor no VM is built from.
+func (h *APIHandler) DeleteFlavor(w http.ResponseWriter, r *http.Request) {
+	id := chi.URLParam(r, "id")
+	if err := h.HostService.DeleteFlavor(id); err != nil {
+		h.HandleError(w, err, "delete_flavor")
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// ResizeVMToFlavor brings a VM to the sizes and extra specs of a flavor.
+func (h *APIHandler) ResizeVMToFlavor(w http.ResponseWriter, r *http.Request) {
+	hostID := chi.URLParam(r, "hostID")
+	vmName := chi.URLParam(r, "vmName")
+
+	var req services.VMFlavorResizeRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		WriteError(w, NewAPIError(ErrorCodeValidation, "Invalid request body", "Failed to parse JSON request"), http.StatusBadRequest)
+		return
+	}
+	if req.ResourceClass == "" {
+		WriteError(w, NewAPIError(ErrorCodeValidation, "Missing required fields", "Resource class is required"), http.StatusBadRequest)
+		return
+	}
+
+	vm, err := h.HostService.ResizeVMToFlavor(hostID, vmName, req)
+	if err != nil {
+		h.HandleError(w, err, "resize_vm_to_flavor")
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(vm)
+}
+
+// AttachVMDisk attaches an existing or new volume to a VM.
+func (h *APIHandler) AttachVMDisk(w http.ResponseWriter, r *http.Request) {
+	hostID := chi.URLParam(r, "hostID")
+	vmName := chi.URLParam(r, "vmName")
+
+	var req services.DiskAttachRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		WriteError(w, NewAPIError(ErrorCodeValidation, "Invalid request body", "Failed to parse JSON request"), http.StatusBadRequest)
+		return
+	}
+	if (req.VolumeID == "") == (req.SizeBytes == 0) {
+		WriteError(w, NewAPIError(ErrorCodeValidation, "Missing required fields", "Set either volume_id or size_bytes"), http.StatusBadRequest)
+		return
+	}
+
+	att, err := h.HostService.AttachVMDisk(hostID, vmName, req)
+	if err != nil {
+		h.HandleError(w, err, "attach_vm_disk")
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(att)
+}
+
+// UpdateVMDisk changes the cache mode or sharing flags of an attached disk.
+func (h *APIHandler) UpdateVMDisk(w http.ResponseWriter, r *http.Request) {
+	hostID := chi.URLParam(r, "hostID")
+	vmName := chi.URLParam(r, "vmName")
+	device := chi.URLParam(r, "device")
+
+	var req services.DiskUpdateRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		WriteError(w, NewAPIError(ErrorCodeValidation, "Invalid request body", "Failed to parse JSON request"), http.StatusBadRequest)
+		return
+	}
+
+	att, err := h.HostService.UpdateVMDisk(hostID, vmName, device, req)
+	if err != nil {
+		h.HandleError(w, err, "update_vm_disk")
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(att)
+}
+
+// DetachVMDisk detaches a disk from a VM, keeping its volume.
+func (h *APIHandler) DetachVMDisk(w http.ResponseWriter, r *http.Request) {
+	hostID := chi.URLParam(r, "hostID")
+	vmName := chi.URLParam(r, "vmName")
+	device := chi.URLParam(r, "device")
+
+	if err := h.HostService.DetachVMDisk(hostID, vmName, device); err != nil {
+		h.HandleError(w, err, "detach_vm_disk")
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// InsertVMMedia puts an ISO library image in a VM's CD-ROM drive.
+func (h *APIHandler) InsertVMMedia(w http.ResponseWriter, r *http.Request) {
+	hostID := chi.URLParam(r, "hostID")
+	vmName := chi.URLParam(r, "vmName")
+	device := chi.URLParam(r, "device")
+
+	var req services.CDROMMediaRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		WriteError(w, NewAPIError(ErrorCodeValidation, "Invalid request body", "Failed to parse JSON request"), http.StatusBadRequest)
+		return
+	}
+	if req.VolumeID == "" {
+		WriteError(w, NewAPIError(ErrorCodeValidation, "Missing required fields", "volume_id is required"), http.StatusBadRequest)
+		return
+	}
+
+	att, err := h.HostService.InsertVMMedia(hostID, vmName, device, req)
+	if err != nil {
+		h.HandleError(w, err, "insert_vm_media")
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(att)
+}
+
+// EjectVMMedia empties a VM's CD-ROM drive.
+func (h *APIHandler) EjectVMMedia(w http.ResponseWriter, r *http.Request) {
+	hostID := chi.URLParam(r, "hostID")
+	vmName := chi.URLParam(r, "vmName")
+	device := chi.URLParam(r, "device")
+
+	att, err := h.HostService.EjectVMMedia(hostID, vmName, device)
+	if err != nil {
+		h.HandleError(w, err, "eject_vm_media")
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(att)
+}
+
+// AttachVMNIC adds a NIC to a VM.
+func (h *APIHandler) AttachVMNIC(w http.ResponseWriter, r *http.Request) {
+	hostID := chi.URLParam(r, "hostID")
+	vmName := chi.URLParam(r, "vmName")
+
+	var req services.NICAttachRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		WriteError(w, NewAPIError(ErrorCodeValidation, "Invalid request body", "Failed to parse JSON request"), http.StatusBadRequest)
+		return
+	}
+	if req.Type == "" || req.Source == "" {
+		WriteError(w, NewAPIError(ErrorCodeValidation, "Missing required fields", "type and source are required"), http.StatusBadRequest)
+		return
+	}
+
+	att, err := h.HostService.AttachVMNIC(hostID, vmName, req)
+	if err != nil {
+		h.HandleError(w, err, "attach_vm_nic")
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(att)
+}
+
+// UpdateVMNIC changes the link state, source or VLANs of an attached NIC.
+func (h *APIHandler) UpdateVMNIC(w http.ResponseWriter, r *http.Request) {
+	hostID := chi.URLParam(r, "hostID")
+	vmName := chi.URLParam(r, "vmName")
+	mac := chi.URLParam(r, "mac")
+
+	var req services.NICUpdateRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		WriteError(w, NewAPIError(ErrorCodeValidation, "Invalid request body", "Failed to parse JSON request"), http.StatusBadRequest)
+		return
+	}
+
+	att, err := h.HostService.UpdateVMNIC(hostID, vmName, mac, req)
+	if err != nil {
+		h.HandleError(w, err, "update_vm_nic")
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(att)
+}
+
+// DetachVMNIC removes a NIC from a VM.
+func (h *APIHandler) DetachVMNIC(w http.ResponseWriter, r *http.Request) {
+	hostID := chi.URLParam(r, "hostID")
+	vmName := chi.URLParam(r, "vmName")
+	mac := chi.URLParam(r, "mac")
+
+	if err := h.HostService.DetachVMNIC(hostID, vmName, mac); err != nil {
+		h.HandleError(w, err, "detach_vm_nic")
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// UpdateVMState updates the intended state of a VM in the database to match the provided state
+func (h *APIHandler) UpdateVMState(w http.ResponseWriter, r *http.Request) {
+	hostID := chi.URLParam(r, "hostID")
+	vmName := chi.URLParam(r, "vmName")
+
+	var req struct {
+		State string `json:"state"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid JSON", http.StatusBadRequest)
+		return
+	}
+
+	if err := h.HostService.UpdateVMState(hostID, vmName, req.State); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// GetHostStats returns statistics for a specific host
+func (h *APIHandler) GetHostStats(w http.ResponseWriter, r *http.Request) {
+	hostID := chi.URLParam(r, "hostID")
+
+	// Get real-time host statistics
+	hostStats, err := h.HostService.GetHostStats(hostID)
+	if err != nil {
+		h.HandleError(w, err, fmt.Sprintf("get_host_stats_%s", hostID))
+		return
+	}
+
+	// Get basic host info
+	hostInfo, err := h.HostService.GetHostInfo(hostID)
+	if err != nil {
+		h.HandleError(w, err, fmt.Sprintf("get_host_info_%s", hostID))
+		return
+	}
+
+	// Get VMs for this host to calculate VM statistics
+	vms, err := h.HostService.GetVMsForHostFromDB(hostID)
+	if err != nil {
+		log.Printf("Warning: failed to get VMs for host %s: %v", hostID, err)
+		vms = []services.VMView{} // Continue with empty VMs if this fails
+	}
+
+	// Calculate VM state counts
+	vmCounts := map[string]int{
+		"ACTIVE":  0,
+		"STOPPED": 0,
+		"PAUSED":  0,
+		"ERROR":   0,
+		"UNKNOWN": 0,
+	}
+
+	for _, vm := range vms {
+		vmCounts[string(vm.State)]++
+	}
+
+	// Calculate disk totals from storage pools
+	var totalDiskBytes uint64 = 0
+	var freeDiskBytes uint64 = 0
+	var storagePools []storage.StoragePool
+	if err := h.DB.Where("host_id = ?", hostID).Find(&storagePools).Error; err != nil {
+		log.Printf("Warning: failed to get storage pools for host %s: %v", hostID, err)
+	} else {
+		for _, pool := range storagePools {
+			totalDiskBytes += pool.CapacityBytes
+			freeDiskBytes += pool.CapacityBytes - pool.AllocationBytes
+		}
+	}
+
+	// Build response with real-time stats and VM statistics
+	stats := map[string]interface{}{
+		"cpu_percent":      hostStats.CPUUtilization * 100, // Convert to percentage
+		"memory_total":     hostInfo.Memory,
+		"memory_available": hostInfo.Memory - hostStats.MemoryUsed,
+		"disk_total":       totalDiskBytes,
+		"disk_free":        freeDiskBytes,
+		"uptime":           0, // TODO: implement uptime
+		"vm_count":         len(vms),
+		"host_info":        hostInfo,
+		"vm_counts":        vmCounts,
+		"total_vms":        len(vms),
+		"resources": map[string]interface{}{
+			"memory_bytes": hostInfo.Memory,
+			"cpu_count":    hostInfo.CPU,
+			"hostname":     hostInfo.Hostname,
+		},
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(stats)
+}
+
+// GetHostCapabilities returns discovered capabilities for a host
+func (h *APIHandler) GetHostCapabilities(w http.ResponseWriter, r *http.Request) {
+	hostID := chi.URLParam(r, "hostID")
+
+	capabilities, err := h.HostService.GetHostCapabilities(hostID)
+	if err != nil {
+		h.HandleError(w, err, fmt.Sprintf("get_host_capabilities_%s", hostID))
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(capabilities)
+}
+
+// RefreshHostCapabilities manually triggers host capability discovery
+func (h *APIHandler) RefreshHostCapabilities(w http.ResponseWriter, r *http.Request) {
+	hostID := chi.URLParam(r, "hostID")
+
+	if err := h.HostService.RefreshHostCapabilities(hostID); err != nil {
+		h.HandleError(w, err, fmt.Sprintf("refresh_host_capabilities_%s", hostID))
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"success": true,
+		"message": "Host capabilities refreshed successfully",
+	})
+}
+
+// --- Dashboard Endpoints ---
+
+// GetDashboardStats returns aggregated system-wide statistics.
+func (h *APIHandler) GetDashboardStats(w http.ResponseWriter, r *http.Request) {
+	stats, err := h.HostService.GetDashboardStats()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(stats)
+}
+
+// GetDashboardActivity returns recent system activity events.
+func (h *APIHandler) GetDashboardActivity(w http.ResponseWriter, r *http.Request) {
+	// Get limit from query parameters, default to 10
+	limitStr := r.URL.Query().Get("limit")
+	limit := 10
+	if limitStr != "" {
+		if parsedLimit, err := strconv.Atoi(limitStr); err == nil && parsedLimit > 0 {
+			limit = parsedLimit
+		}
+	}
+
+	activities, err := h.HostService.GetDashboardActivity(limit)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	response := map[string]interface{}{
+		"activities": activities,
+		"pagination": map[string]interface{}{
+			"total": len(activities),
+			"page":  1,
+			"limit": limit,
+		},
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(response)
+}
+
+// GetDashboardOverview returns combined dashboard data for initial page load.
+func (h *APIHandler) GetDashboardOverview(w http.ResponseWriter, r *http.Request) {
+	stats, err := h.HostService.GetDashboardStats()
+	if err != nil {
+		http.Error(w, fmt.Sprintf("failed to get stats: %v", err), http.StatusInternalServerError)
+		return
+	}
+
+	activities, err := h.HostService.GetDashboardActivity(5)
 	if err != nil {
 		// Don't fail the whole request for activities, just log and continue
 		log.Printf("Warning: failed to get activities: %v", err)
@@ -1326,8 +2014,97 @@ func (h *APIHandler) ListHostStoragePools(w http.ResponseWriter, r *http.Request
 		pools = []storage.StoragePool{}
 	}
 
-	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(pools)
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(pools)
+}
+
+// CreateStoragePool defines a storage pool on a host.
+func (h *APIHandler) CreateStoragePool(w http.ResponseWriter, r *http.Request) {
+	hostID := chi.URLParam(r, "hostID")
+
+	var req services.StoragePoolCreateRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		WriteError(w, NewAPIError(ErrorCodeValidation, "Invalid request body", "Failed to parse JSON request"), http.StatusBadRequest)
+		return
+	}
+	if req.Name == "" || req.Type == "" {
+		WriteError(w, NewAPIError(ErrorCodeValidation, "Missing required fields", "name and type are required"), http.StatusBadRequest)
+		return
+	}
+
+	pool, err := h.HostService.CreateStoragePool(hostID, req)
+	if err != nil {
+		h.HandleError(w, err, "create_storage_pool")
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(pool)
+}
+
+// storagePoolAction runs a lifecycle operation on the pool named by the
+// URL and writes the updated pool.
+func (h *APIHandler) storagePoolAction(w http.ResponseWriter, r *http.Request, op string, action func(string) (*storage.StoragePool, error)) {
+	pool, err := action(chi.URLParam(r, "id"))
+	if err != nil {
+		h.HandleError(w, err, op)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(pool)
+}
+
+// BuildStoragePool creates a pool's directory, filesystem or volume group.
+func (h *APIHandler) BuildStoragePool(w http.ResponseWriter, r *http.Request) {
+	h.storagePoolAction(w, r, "build_storage_pool", h.HostService.BuildStoragePool)
+}
+
+// StartStoragePool activates a storage pool.
+func (h *APIHandler) StartStoragePool(w http.ResponseWriter, r *http.Request) {
+	h.storagePoolAction(w, r, "start_storage_pool", h.HostService.StartStoragePool)
+}
+
+// StopStoragePool deactivates a storage pool.
+func (h *APIHandler) StopStoragePool(w http.ResponseWriter, r *http.Request) {
+	h.storagePoolAction(w, r, "stop_storage_pool", h.HostService.StopStoragePool)
+}
+
+// RefreshStoragePool rescans a storage pool for volumes.
+func (h *APIHandler) RefreshStoragePool(w http.ResponseWriter, r *http.Request) {
+	h.storagePoolAction(w, r, "refresh_storage_pool", h.HostService.RefreshStoragePool)
+}
+
+// SetStoragePoolAutostart sets whether a storage pool starts with libvirt.
+func (h *APIHandler) SetStoragePoolAutostart(w http.ResponseWriter, r *http.Request) {
+	var req services.StoragePoolAutostartRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		WriteError(w, NewAPIError(ErrorCodeValidation, "Invalid request body", "Failed to parse JSON request"), http.StatusBadRequest)
+		return
+	}
+	h.storagePoolAction(w, r, "set_storage_pool_autostart", func(id string) (*storage.StoragePool, error) {
+		return h.HostService.SetStoragePoolAutostart(id, req)
+	})
+}
+
+// DeleteStoragePool stops and undefines a storage pool. With
+// ?delete_storage=true its directory or volume group is deleted too.
+func (h *APIHandler) DeleteStoragePool(w http.ResponseWriter, r *http.Request) {
+	id := chi.URLParam(r, "id")
+	deleteStorage := false
+	if v := r.URL.Query().Get("delete_storage"); v != "" {
+		parsed, err := strconv.ParseBool(v)
+		if err != nil {
+			WriteError(w, NewAPIError(ErrorCodeValidation, "Invalid query parameter", "delete_storage must be true or false"), http.StatusBadRequest)
+			return
+		}
+		deleteStorage = parsed
+	}
+
+	if err := h.HostService.DeleteStoragePool(id, deleteStorage); err != nil {
+		h.HandleError(w, err, "delete_storage_pool")
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
 }
 
 // ListHostStorageVolumes returns storage volumes for a specific host.
@@ -1369,6 +2146,18 @@ func (h *APIHandler) ListHostStorageVolumes(w http.ResponseWriter, r *http.Reque
 	json.NewEncoder(w).Encode(response)
 }
 
+// ListISOs returns the ISO library, optionally filtered by host_id and
+// pool_id query parameters.
+func (h *APIHandler) ListISOs(w http.ResponseWriter, r *http.Request) {
+	images, err := h.HostService.ListISOs(r.URL.Query().Get("host_id"), r.URL.Query().Get("pool_id"))
+	if err != nil {
+		h.HandleError(w, err, "list_isos")
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(images)
+}
+
 // DeleteStorageVolume removes a storage volume by its database ID. It will
 // attempt to delete the backing libvirt storage volume and remove the DB row.
 func (h *APIHandler) DeleteStorageVolume(w http.ResponseWriter, r *http.Request) {
@@ -1393,6 +2182,306 @@ func (h *APIHandler) DeleteStorageVolume(w http.ResponseWriter, r *http.Request)
 	w.WriteHeader(http.StatusNoContent)
 }
 
+// ResizeStorageVolume grows a storage volume.
+func (h *APIHandler) ResizeStorageVolume(w http.ResponseWriter, r *http.Request) {
+	id := chi.URLParam(r, "id")
+
+	var req services.VolumeResizeRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		WriteError(w, NewAPIError(ErrorCodeValidation, "Invalid request body", "Failed to parse JSON request"), http.StatusBadRequest)
+		return
+	}
+	if req.SizeBytes == 0 {
+		WriteError(w, NewAPIError(ErrorCodeValidation, "Missing required fields", "size_bytes is required"), http.StatusBadRequest)
+		return
+	}
+
+	vol, err := h.HostService.ResizeVolume(id, req)
+	if err != nil {
+		h.HandleError(w, err, "resize_storage_volume")
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(vol)
+}
+
+// CreateVolumeUpload creates an empty volume to upload an image into.
+func (h *APIHandler) CreateVolumeUpload(w http.ResponseWriter, r *http.Request) {
+	hostID := chi.URLParam(r, "hostID")
+
+	var req services.VolumeUploadRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		WriteError(w, NewAPIError(ErrorCodeValidation, "Invalid request body", "Failed to parse JSON request"), http.StatusBadRequest)
+		return
+	}
+	if req.Name == "" || req.SizeBytes == 0 {
+		WriteError(w, NewAPIError(ErrorCodeValidation, "Missing required fields", "name and size_bytes are required"), http.StatusBadRequest)
+		return
+	}
+
+	vol, err := h.HostService.CreateVolumeUpload(hostID, req)
+	if err != nil {
+		h.HandleError(w, err, "create_volume_upload")
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(vol)
+}
+
+// GetVolumeUploadStatus reports where an interrupted upload resumes.
+func (h *APIHandler) GetVolumeUploadStatus(w http.ResponseWriter, r *http.Request) {
+	status, err := h.HostService.GetVolumeUploadStatus(chi.URLParam(r, "id"))
+	if err != nil {
+		h.HandleError(w, err, "get_volume_upload_status")
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(status)
+}
+
+// UploadVolumeContent writes a chunk of an upload. The chunk's position comes
+// from a Content-Range header; without one the body starts at offset 0.
+func (h *APIHandler) UploadVolumeContent(w http.ResponseWriter, r *http.Request) {
+	id := chi.URLParam(r, "id")
+
+	var offset uint64
+	if header := r.Header.Get("Content-Range"); header != "" {
+		start, ok := parseContentRangeStart(header)
+		if !ok {
+			WriteError(w, NewAPIError(ErrorCodeValidation, "Invalid Content-Range", "Expected bytes <start>-<end>/<total>"), http.StatusBadRequest)
+			return
+		}
+		offset = start
+	}
+
+	status, err := h.HostService.UploadVolumeData(id, offset, r.Body)
+	var offsetErr *services.UploadOffsetError
+	if errors.As(err, &offsetErr) {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusConflict)
+		json.NewEncoder(w).Encode(offsetErr.Status)
+		return
+	}
+	if err != nil {
+		h.HandleError(w, err, "upload_volume_content")
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(status)
+}
+
+// parseContentRangeStart returns the first byte of a "bytes a-b/total"
+// Content-Range header.
+func parseContentRangeStart(header string) (uint64, bool) {
+	spec, ok := strings.CutPrefix(header, "bytes ")
+	if !ok {
+		return 0, false
+	}
+	startStr, _, ok := strings.Cut(spec, "-")
+	if !ok {
+		return 0, false
+	}
+	start, err := strconv.ParseUint(startStr, 10, 64)
+	return start, err == nil
+}
+
+// parseRange resolves a single-range "bytes=" Range header against a size
+// and returns the offset and length it selects.
+func parseRange(header string, size uint64) (uint64, uint64, bool) {
+	spec, ok := strings.CutPrefix(header, "bytes=")
+	if !ok || strings.Contains(spec, ",") {
+		return 0, 0, false
+	}
+	startStr, endStr, ok := strings.Cut(spec, "-")
+	if !ok {
+		return 0, 0, false
+	}
+	if startStr == "" {
+		// A suffix range: the last n bytes.
+		n, err := strconv.ParseUint(endStr, 10, 64)
+		if err != nil || n == 0 {
+			return 0, 0, false
+		}
+		if n > size {
+			n = size
+		}
+		return size - n, n, true
+	}
+	start, err := strconv.ParseUint(startStr, 10, 64)
+	if err != nil || start >= size {
+		return 0, 0, false
+	}
+	end := size - 1
+	if endStr != "" {
+		if end, err = strconv.ParseUint(endStr, 10, 64); err != nil || end < start {
+			return 0, 0, false
+		}
+		if end >= size {
+			end = size - 1
+		}
+	}
+	return start, end - start + 1, true
+}
+
+// DownloadVolumeContent streams a volume. A Range header fetches part of it,
+// so interrupted downloads can resume; a full download is chunked and ends
+// with an X-Checksum-Sha256 trailer for the client to verify.
+func (h *APIHandler) DownloadVolumeContent(w http.ResponseWriter, r *http.Request) {
+	dl, err := h.HostService.StatVolumeDownload(chi.URLParam(r, "id"))
+	if err != nil {
+		h.HandleError(w, err, "download_volume_content")
+		return
+	}
+
+	offset, length := uint64(0), dl.SizeBytes
+	ranged := false
+	if header := r.Header.Get("Range"); header != "" {
+		var ok bool
+		if offset, length, ok = parseRange(header, dl.SizeBytes); !ok {
+			w.Header().Set("Content-Range", fmt.Sprintf("bytes */%d", dl.SizeBytes))
+			WriteError(w, NewAPIError(ErrorCodeValidation, "Invalid Range", "Range is not satisfiable"), http.StatusRequestedRangeNotSatisfiable)
+			return
+		}
+		ranged = true
+	}
+
+	w.Header().Set("Content-Type", "application/octet-stream")
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", dl.Name))
+	w.Header().Set("Accept-Ranges", "bytes")
+	out := io.Writer(w)
+	digest := sha256.New()
+	if ranged {
+		w.Header().Set("Content-Length", strconv.FormatUint(length, 10))
+		w.Header().Set("Content-Range", fmt.Sprintf("bytes %d-%d/%d", offset, offset+length-1, dl.SizeBytes))
+		w.WriteHeader(http.StatusPartialContent)
+	} else {
+		// No Content-Length: HTTP/1.1 only delivers trailers on a chunked
+		// body.
+		w.Header().Set("Trailer", "X-Checksum-Sha256")
+		w.WriteHeader(http.StatusOK)
+		out = io.MultiWriter(w, digest)
+	}
+	if length == 0 {
+		return
+	}
+	if err := h.HostService.DownloadVolume(dl, out, offset, length); err != nil {
+		// The status is already sent; cutting the body short tells the
+		// client the download failed.
+		log.Warnf("Download of volume %s failed: %v", dl.VolumeID, err)
+		return
+	}
+	if !ranged {
+		w.Header().Set("X-Checksum-Sha256", hex.EncodeToString(digest.Sum(nil)))
+	}
+}
+
+// ExecInGuest runs a command inside a VM through its guest agent.
+func (h *APIHandler) ExecInGuest(w http.ResponseWriter, r *http.Request) {
+	hostID := chi.URLParam(r, "hostID")
+	vmName := chi.URLParam(r, "vmName")
+
+	var req services.GuestExecRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		WriteError(w, NewAPIError(ErrorCodeValidation, "Invalid request body", "Failed to parse JSON request"), http.StatusBadRequest)
+		return
+	}
+
+	result, err := h.HostService.ExecInGuest(hostID, vmName, req)
+	if err != nil {
+		h.HandleError(w, err, "guest_exec")
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(result)
+}
+
+// SetGuestPassword sets the password of an account inside a VM.
+func (h *APIHandler) SetGuestPassword(w http.ResponseWriter, r *http.Request) {
+	hostID := chi.URLParam(r, "hostID")
+	vmName := chi.URLParam(r, "vmName")
+
+	var req services.GuestPasswordRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		WriteError(w, NewAPIError(ErrorCodeValidation, "Invalid request body", "Failed to parse JSON request"), http.StatusBadRequest)
+		return
+	}
+
+	if err := h.HostService.SetGuestPassword(hostID, vmName, req); err != nil {
+		h.HandleError(w, err, "guest_set_password")
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// decodeGuestFilesystemsRequest reads the optional mountpoint list of a
+// freeze or thaw request.
+func decodeGuestFilesystemsRequest(w http.ResponseWriter, r *http.Request) (services.GuestFilesystemsRequest, bool) {
+	var req services.GuestFilesystemsRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil && !errors.Is(err, io.EOF) {
+		WriteError(w, NewAPIError(ErrorCodeValidation, "Invalid request body", "Failed to parse JSON request"), http.StatusBadRequest)
+		return req, false
+	}
+	return req, true
+}
+
+// FreezeGuestFilesystems freezes a VM's filesystems through its guest agent.
+func (h *APIHandler) FreezeGuestFilesystems(w http.ResponseWriter, r *http.Request) {
+	req, ok := decodeGuestFilesystemsRequest(w, r)
+	if !ok {
+		return
+	}
+	n, err := h.HostService.FreezeGuestFilesystems(chi.URLParam(r, "hostID"), chi.URLParam(r, "vmName"), req)
+	if err != nil {
+		h.HandleError(w, err, "guest_fsfreeze")
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]int{"frozen": n})
+}
+
+// ThawGuestFilesystems thaws a VM's frozen filesystems.
+func (h *APIHandler) ThawGuestFilesystems(w http.ResponseWriter, r *http.Request) {
+	req, ok := decodeGuestFilesystemsRequest(w, r)
+	if !ok {
+		return
+	}
+	n, err := h.HostService.ThawGuestFilesystems(chi.URLParam(r, "hostID"), chi.URLParam(r, "vmName"), req)
+	if err != nil {
+		h.HandleError(w, err, "guest_fsthaw")
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]int{"thawed": n})
+}
+
+// ShutdownVMViaAgent shuts a VM down through its guest agent.
+func (h *APIHandler) ShutdownVMViaAgent(w http.ResponseWriter, r *http.Request) {
+	if err := h.HostService.ShutdownVMViaAgent(chi.URLParam(r, "hostID"), chi.URLParam(r, "vmName")); err != nil {
+		h.HandleError(w, err, "guest_shutdown")
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// RebootVMViaAgent reboots a VM through its guest agent.
+func (h *APIHandler) RebootVMViaAgent(w http.ResponseWriter, r *http.Request) {
+	if err := h.HostService.RebootVMViaAgent(chi.URLParam(r, "hostID"), chi.URLParam(r, "vmName")); err != nil {
+		h.HandleError(w, err, "guest_reboot")
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// SyncGuestTime resets a VM's clock from the host.
+func (h *APIHandler) SyncGuestTime(w http.ResponseWriter, r *http.Request) {
+	if err := h.HostService.SyncGuestTime(chi.URLParam(r, "hostID"), chi.URLParam(r, "vmName")); err != nil {
+		h.HandleError(w, err, "guest_time_sync")
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
 // --- Network Endpoints ---
 
 // ListNetworks returns all networks across all hosts.
@@ -1524,6 +2613,213 @@ func (h *APIHandler) ListHostNetworks(w http.ResponseWriter, r *http.Request) {
 	json.NewEncoder(w).Encode(networks)
 }
 
+// CreateNetwork defines a virtual network on a host.
+func (h *APIHandler) CreateNetwork(w http.ResponseWriter, r *http.Request) {
+	hostID := chi.URLParam(r, "hostID")
+
+	var req services.NetworkCreateRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		WriteError(w, NewAPIError(ErrorCodeValidation, "Invalid request body", "Failed to parse JSON request"), http.StatusBadRequest)
+		return
+	}
+	if req.Name == "" || req.Mode == "" {
+		WriteError(w, NewAPIError(ErrorCodeValidation, "Missing required fields", "name and mode are required"), http.StatusBadRequest)
+		return
+	}
+
+	network, err := h.HostService.CreateNetwork(hostID, req)
+	if err != nil {
+		h.HandleError(w, err, "create_network")
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(network)
+}
+
+// networkAction runs an operation on the network named by the URL and
+// writes the updated network.
+func (h *APIHandler) networkAction(w http.ResponseWriter, r *http.Request, op string, action func(string) (*services.NetworkDetail, error)) {
+	network, err := action(chi.URLParam(r, "id"))
+	if err != nil {
+		h.HandleError(w, err, op)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(network)
+}
+
+// GetNetwork returns a virtual network with its definition.
+func (h *APIHandler) GetNetwork(w http.ResponseWriter, r *http.Request) {
+	h.networkAction(w, r, "get_network", h.HostService.GetNetwork)
+}
+
+// UpdateNetwork replaces a virtual network's definition.
+func (h *APIHandler) UpdateNetwork(w http.ResponseWriter, r *http.Request) {
+	var spec libvirt.NetworkSpec
+	if err := json.NewDecoder(r.Body).Decode(&spec); err != nil {
+		WriteError(w, NewAPIError(ErrorCodeValidation, "Invalid request body", "Failed to parse JSON request"), http.StatusBadRequest)
+		return
+	}
+	if spec.Mode == "" {
+		WriteError(w, NewAPIError(ErrorCodeValidation, "Missing required fields", "mode is required"), http.StatusBadRequest)
+		return
+	}
+	h.networkAction(w, r, "update_network", func(id string) (*services.NetworkDetail, error) {
+		return h.HostService.UpdateNetwork(id, spec)
+	})
+}
+
+// StartNetwork activates a virtual network.
+func (h *APIHandler) StartNetwork(w http.ResponseWriter, r *http.Request) {
+	h.networkAction(w, r, "start_network", h.HostService.StartNetwork)
+}
+
+// StopNetwork deactivates a virtual network.
+func (h *APIHandler) StopNetwork(w http.ResponseWriter, r *http.Request) {
+	h.networkAction(w, r, "stop_network", h.HostService.StopNetwork)
+}
+
+// SetNetworkAutostart sets whether a virtual network starts with libvirt.
+func (h *APIHandler) SetNetworkAutostart(w http.ResponseWriter, r *http.Request) {
+	var req services.NetworkAutostartRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		WriteError(w, NewAPIError(ErrorCodeValidation, "Invalid request body", "Failed to parse JSON request"), http.StatusBadRequest)
+		return
+	}
+	h.networkAction(w, r, "set_network_autostart", func(id string) (*services.NetworkDetail, error) {
+		return h.HostService.SetNetworkAutostart(id, req)
+	})
+}
+
+// DeleteNetwork stops and undefines a virtual network.
+func (h *APIHandler) DeleteNetwork(w http.ResponseWriter, r *http.Request) {
+	if err := h.HostService.DeleteNetwork(chi.URLParam(r, "id")); err != nil {
+		h.HandleError(w, err, "delete_network")
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// --- Security Group Endpoints ---
+
+// ListSecurityGroups returns all security groups with their rules.
+func (h *APIHandler) ListSecurityGroups(w http.ResponseWriter, r *http.Request) {
+	groups, err := h.HostService.ListSecurityGroups()
+	if err != nil {
+		h.HandleError(w, err, "list_security_groups")
+		return
+	}
+	if groups == nil {
+		groups = []storage.SecurityGroup{}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(groups)
+}
+
+// decodeSecurityGroupRequest reads a security group body, writing an error
+// and returning false when it is unusable.
+func decodeSecurityGroupRequest(w http.ResponseWriter, r *http.Request) (services.SecurityGroupRequest, bool) {
+	var req services.SecurityGroupRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		WriteError(w, NewAPIError(ErrorCodeValidation, "Invalid request body", "Failed to parse JSON request"), http.StatusBadRequest)
+		return req, false
+	}
+	if req.Name == "" {
+		WriteError(w, NewAPIError(ErrorCodeValidation, "Missing required fields", "name is required"), http.StatusBadRequest)
+		return req, false
+	}
+	return req, true
+}
+
+// CreateSecurityGroup stores a new security group.
+func (h *APIHandler) CreateSecurityGroup(w http.ResponseWriter, r *http.Request) {
+	req, ok := decodeSecurityGroupRequest(w, r)
+	if !ok {
+		return
+	}
+	group, err := h.HostService.CreateSecurityGroup(req)
+	if err != nil {
+		h.HandleError(w, err, "create_security_group")
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(group)
+}
+
+// GetSecurityGroup returns a security group with its rules.
+func (h *APIHandler) GetSecurityGroup(w http.ResponseWriter, r *http.Request) {
+	group, err := h.HostService.GetSecurityGroup(chi.URLParam(r, "id"))
+	if err != nil {
+		h.HandleError(w, err, "get_security_group")
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(group)
+}
+
+// UpdateSecurityGroup replaces a security group's rules and re-applies them
+// on every host using the group.
+func (h *APIHandler) UpdateSecurityGroup(w http.ResponseWriter, r *http.Request) {
+	req, ok := decodeSecurityGroupRequest(w, r)
+	if !ok {
+		return
+	}
+	group, err := h.HostService.UpdateSecurityGroup(chi.URLParam(r, "id"), req)
+	if err != nil {
+		h.HandleError(w, err, "update_security_group")
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(group)
+}
+
+// DeleteSecurityGroup removes an unused security group.
+func (h *APIHandler) DeleteSecurityGroup(w http.ResponseWriter, r *http.Request) {
+	if err := h.HostService.DeleteSecurityGroup(chi.URLParam(r, "id")); err != nil {
+		h.HandleError(w, err, "delete_security_group")
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// GetVMNICSecurityGroups returns the security groups bound to a VM's NIC.
+func (h *APIHandler) GetVMNICSecurityGroups(w http.ResponseWriter, r *http.Request) {
+	hostID := chi.URLParam(r, "hostID")
+	vmName := chi.URLParam(r, "vmName")
+	mac := chi.URLParam(r, "mac")
+
+	groups, err := h.HostService.GetVMNICSecurityGroups(hostID, vmName, mac)
+	if err != nil {
+		h.HandleError(w, err, "get_vm_nic_security_groups")
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(groups)
+}
+
+// SetVMNICSecurityGroups binds a VM's NIC to a set of security groups.
+func (h *APIHandler) SetVMNICSecurityGroups(w http.ResponseWriter, r *http.Request) {
+	hostID := chi.URLParam(r, "hostID")
+	vmName := chi.URLParam(r, "vmName")
+	mac := chi.URLParam(r, "mac")
+
+	var req services.NICSecurityGroupsRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		WriteError(w, NewAPIError(ErrorCodeValidation, "Invalid request body", "Failed to parse JSON request"), http.StatusBadRequest)
+		return
+	}
+
+	groups, err := h.HostService.SetVMNICSecurityGroups(hostID, vmName, mac, req)
+	if err != nil {
+		h.HandleError(w, err, "set_vm_nic_security_groups")
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(groups)
+}
+
 // --- Network Endpoints ---
 
 // ListNetworks returns all networks across all hosts.
@@ -1,14 +1,23 @@
 package api
 
 import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
 	"encoding/json"
+	"io"
 	"net/http"
 	"net/http/httptest"
+	"path/filepath"
+	"strings"
 	"testing"
 
+	"github.com/capsali/virtumancer/internal/libvirt"
 	"github.com/capsali/virtumancer/internal/services"
 	"github.com/capsali/virtumancer/internal/storage"
 	"github.com/capsali/virtumancer/internal/ws"
+	golibvirt "github.com/digitalocean/go-libvirt"
+	"github.com/go-chi/chi/v5"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
 	"gorm.io/driver/sqlite"
@@ -55,3 +64,751 @@ func TestHealthCheckEndpoint(t *testing.T) {
 	require.NoError(t, err)
 	assert.True(t, response["ok"])
 }
+
+// setupFakeAPITest builds a router backed by an in-memory hypervisor with one
+// connected host that has a "default" pool and network.
+func setupFakeAPITest(t *testing.T) (http.Handler, *libvirt.FakeHypervisor) {
+	db, err := storage.InitDB(filepath.Join(t.TempDir(), "test.db"))
+	require.NoError(t, err)
+
+	hub := ws.NewHub()
+	go hub.Run()
+
+	fake := libvirt.NewFakeHypervisor()
+	fake.AddStoragePool("host-1", libvirt.StoragePoolInfo{Name: "default", Path: "/var/lib/libvirt/images", CapacityBytes: 100 << 30})
+	fake.AddNetwork("host-1", "default", "virbr0")
+	host := storage.Host{Base: storage.Base{ID: "host-1"}, URI: "qemu:///system", State: string(storage.HostStateConnected)}
+	require.NoError(t, db.Create(&host).Error)
+	require.NoError(t, fake.AddHost(host))
+
+	apiHandler := NewAPIHandler(services.NewHostService(db, fake, hub), hub, db, fake)
+
+	r := chi.NewRouter()
+	r.Mount("/api/v1", Routes(apiHandler))
+	return r, fake
+}
+
+func TestGetHostsReportsConnection(t *testing.T) {
+	router, _ := setupFakeAPITest(t)
+
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest("GET", "/api/v1/hosts", nil))
+	require.Equal(t, http.StatusOK, w.Code)
+
+	var hosts []map[string]interface{}
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &hosts))
+	require.Len(t, hosts, 1)
+	assert.Equal(t, true, hosts[0]["connected"])
+}
+
+func TestCreateAndStartVMEndpoints(t *testing.T) {
+	router, fake := setupFakeAPITest(t)
+
+	body := `{"name":"api-vm","vcpu_count":2,"memory_bytes":1073741824,"disk_size_gb":5}`
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest("POST", "/api/v1/hosts/host-1/vms", strings.NewReader(body)))
+	require.Equal(t, http.StatusCreated, w.Code, w.Body.String())
+
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest("POST", "/api/v1/hosts/host-1/vms/api-vm/start", nil))
+	assert.Equal(t, http.StatusNoContent, w.Code, w.Body.String())
+
+	state, ok := fake.DomainState("host-1", "api-vm")
+	require.True(t, ok)
+	assert.Equal(t, golibvirt.DomainRunning, state)
+
+	// Starting an unknown domain surfaces as a 404 through HandleError.
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest("POST", "/api/v1/hosts/host-1/vms/missing/start", nil))
+	assert.Equal(t, http.StatusNotFound, w.Code)
+}
+
+func TestCreateVMEndpointProvisioning(t *testing.T) {
+	router, fake := setupFakeAPITest(t)
+
+	body := `{"name":"both","vcpu_count":1,"memory_bytes":1073741824,"cloud_init":{"user_data":"#cloud-config\n"},"ignition":"{}"}`
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest("POST", "/api/v1/hosts/host-1/vms", strings.NewReader(body)))
+	assert.Equal(t, http.StatusBadRequest, w.Code, w.Body.String())
+
+	body = `{"name":"seeded","vcpu_count":1,"memory_bytes":1073741824,"cloud_init":{"user_data":"#cloud-config\nhostname: seeded\n"}}`
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest("POST", "/api/v1/hosts/host-1/vms", strings.NewReader(body)))
+	require.Equal(t, http.StatusCreated, w.Code, w.Body.String())
+	assert.True(t, fake.HasVolume("host-1", "default", "seeded-seed.img"))
+}
+
+func TestTemplateEndpoints(t *testing.T) {
+	router, _ := setupFakeAPITest(t)
+
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest("POST", "/api/v1/hosts/host-1/vms", strings.NewReader(`{"name":"golden","vcpu_count":1,"memory_bytes":1073741824,"disk_size_gb":5}`)))
+	require.Equal(t, http.StatusCreated, w.Code, w.Body.String())
+
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest("POST", "/api/v1/hosts/host-1/vms/golden/template", nil))
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest("POST", "/api/v1/hosts/host-1/vms/golden/start", nil))
+	assert.Equal(t, http.StatusConflict, w.Code, w.Body.String())
+
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest("POST", "/api/v1/hosts/host-1/vms/golden/instances", strings.NewReader(`{"name_pattern":"web","count":2}`)))
+	assert.Equal(t, http.StatusBadRequest, w.Code, w.Body.String())
+
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest("POST", "/api/v1/hosts/host-1/vms/golden/instances", strings.NewReader(`{"name_pattern":"web-{n}","count":2,"linked":true}`)))
+	require.Equal(t, http.StatusCreated, w.Code, w.Body.String())
+	var instances []storage.VirtualMachine
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &instances))
+	require.Len(t, instances, 2)
+	assert.Equal(t, "web-2", instances[1].Name)
+
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest("GET", "/api/v1/templates", nil))
+	require.Equal(t, http.StatusOK, w.Code)
+	var templates []storage.VirtualMachine
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &templates))
+	require.Len(t, templates, 1)
+	assert.Equal(t, "golden", templates[0].Name)
+}
+
+func TestFlavorEndpoints(t *testing.T) {
+	router, _ := setupFakeAPITest(t)
+
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest("POST", "/api/v1/flavors", strings.NewReader(`{"name":"m1.tiny","cpu_cores":0,"memory_mb":512}`)))
+	assert.Equal(t, http.StatusBadRequest, w.Code, w.Body.String())
+
+	body := `{"name":"m1.tiny","cpu_cores":1,"memory_mb":512,"storage_gb":5,"extra_specs":{"cpu_model":"host-model"}}`
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest("POST", "/api/v1/flavors", strings.NewReader(body)))
+	require.Equal(t, http.StatusCreated, w.Code, w.Body.String())
+	var tiny storage.ResourceClass
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &tiny))
+	assert.JSONEq(t, `{"cpu_model":"host-model"}`, tiny.ConfigJSON)
+
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest("POST", "/api/v1/flavors", strings.NewReader(`{"name":"m1.small","cpu_cores":2,"memory_mb":1024}`)))
+	require.Equal(t, http.StatusCreated, w.Code, w.Body.String())
+
+	var shape map[string]interface{}
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &shape))
+	assert.IsType(t, "", shape["id"])
+	assert.Contains(t, shape, "created_at")
+	assert.NotContains(t, shape, "ID")
+
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest("GET", "/api/v1/flavors/missing", nil))
+	assert.Equal(t, http.StatusNotFound, w.Code)
+
+	// vCPUs and memory may come from the flavor alone.
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest("POST", "/api/v1/hosts/host-1/vms", strings.NewReader(`{"name":"flavored","resource_class":"m1.tiny"}`)))
+	require.Equal(t, http.StatusCreated, w.Code, w.Body.String())
+
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest("POST", "/api/v1/hosts/host-1/vms/flavored/resize-to-flavor", strings.NewReader(`{"resource_class":"m1.small"}`)))
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	var vm storage.VirtualMachine
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &vm))
+	assert.Equal(t, uint(2), vm.VCPUCount)
+	require.NotNil(t, vm.ResourceClassID)
+
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest("PUT", "/api/v1/flavors/"+tiny.ID, strings.NewReader(`{"name":"m1.tiny","cpu_cores":1,"memory_mb":768}`)))
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &tiny))
+	assert.Equal(t, 768, tiny.MemoryMB)
+	assert.Empty(t, tiny.ConfigJSON)
+
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest("DELETE", "/api/v1/flavors/"+*vm.ResourceClassID, nil))
+	assert.Equal(t, http.StatusConflict, w.Code, w.Body.String())
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest("DELETE", "/api/v1/flavors/"+tiny.ID, nil))
+	assert.Equal(t, http.StatusNoContent, w.Code, w.Body.String())
+
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest("GET", "/api/v1/flavors", nil))
+	require.Equal(t, http.StatusOK, w.Code)
+	var flavors []storage.ResourceClass
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &flavors))
+	require.Len(t, flavors, 1)
+	assert.Equal(t, "m1.small", flavors[0].Name)
+}
+
+func TestSnapshotEndpoints(t *testing.T) {
+	router, _ := setupFakeAPITest(t)
+
+	body := `{"name":"snap-vm","vcpu_count":1,"memory_bytes":1073741824,"disk_size_gb":5}`
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest("POST", "/api/v1/hosts/host-1/vms", strings.NewReader(body)))
+	require.Equal(t, http.StatusCreated, w.Code, w.Body.String())
+
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest("POST", "/api/v1/hosts/host-1/vms/snap-vm/snapshots", strings.NewReader(`{"name":"s1"}`)))
+	require.Equal(t, http.StatusCreated, w.Code, w.Body.String())
+
+	// Disk-only snapshots only exist as external snapshots.
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest("POST", "/api/v1/hosts/host-1/vms/snap-vm/snapshots", strings.NewReader(`{"name":"s2","disk_only":true}`)))
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest("GET", "/api/v1/hosts/host-1/vms/snap-vm/snapshots", nil))
+	require.Equal(t, http.StatusOK, w.Code)
+	var snapshots []map[string]interface{}
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &snapshots))
+	require.Len(t, snapshots, 1)
+	assert.Equal(t, "s1", snapshots[0]["name"])
+	assert.Equal(t, true, snapshots[0]["current"])
+
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest("DELETE", "/api/v1/hosts/host-1/vms/snap-vm/snapshots/s1", nil))
+	assert.Equal(t, http.StatusNoContent, w.Code, w.Body.String())
+
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest("DELETE", "/api/v1/hosts/host-1/vms/snap-vm/snapshots/s1", nil))
+	assert.Equal(t, http.StatusNotFound, w.Code)
+}
+
+func TestMigrateEndpointValidatesTarget(t *testing.T) {
+	router, _ := setupFakeAPITest(t)
+
+	body := `{"name":"mig-vm","vcpu_count":1,"memory_bytes":1073741824,"disk_size_gb":5}`
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest("POST", "/api/v1/hosts/host-1/vms", strings.NewReader(body)))
+	require.Equal(t, http.StatusCreated, w.Code, w.Body.String())
+
+	for _, tc := range []struct {
+		body string
+		want int
+	}{
+		{`{}`, http.StatusBadRequest},
+		{`{"target_host_id":"host-1"}`, http.StatusBadRequest},
+		{`{"target_host_id":"host-9"}`, http.StatusNotFound},
+	} {
+		w = httptest.NewRecorder()
+		router.ServeHTTP(w, httptest.NewRequest("POST", "/api/v1/hosts/host-1/vms/mig-vm/migrate", strings.NewReader(tc.body)))
+		assert.Equal(t, tc.want, w.Code, "%s: %s", tc.body, w.Body.String())
+	}
+}
+
+func TestCloneEndpoint(t *testing.T) {
+	router, _ := setupFakeAPITest(t)
+
+	body := `{"name":"base","vcpu_count":1,"memory_bytes":1073741824,"disk_size_gb":5}`
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest("POST", "/api/v1/hosts/host-1/vms", strings.NewReader(body)))
+	require.Equal(t, http.StatusCreated, w.Code, w.Body.String())
+
+	for _, tc := range []struct {
+		body string
+		want int
+	}{
+		{`{}`, http.StatusBadRequest},
+		{`{"name":"base-2","target_host_id":"host-9"}`, http.StatusNotFound},
+		{`{"name":"base-2"}`, http.StatusCreated},
+		{`{"name":"base-2"}`, http.StatusConflict},
+	} {
+		w = httptest.NewRecorder()
+		router.ServeHTTP(w, httptest.NewRequest("POST", "/api/v1/hosts/host-1/vms/base/clone", strings.NewReader(tc.body)))
+		assert.Equal(t, tc.want, w.Code, "%s: %s", tc.body, w.Body.String())
+	}
+}
+
+func TestDiskHotplugEndpoints(t *testing.T) {
+	router, _ := setupFakeAPITest(t)
+
+	body := `{"name":"disky","vcpu_count":1,"memory_bytes":1073741824,"disk_size_gb":5}`
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest("POST", "/api/v1/hosts/host-1/vms", strings.NewReader(body)))
+	require.Equal(t, http.StatusCreated, w.Code, w.Body.String())
+
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest("POST", "/api/v1/hosts/host-1/vms/disky/disks", strings.NewReader(`{}`)))
+	assert.Equal(t, http.StatusBadRequest, w.Code, w.Body.String())
+
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest("POST", "/api/v1/hosts/host-1/vms/disky/disks", strings.NewReader(`{"size_bytes":1073741824,"bus":"scsi"}`)))
+	require.Equal(t, http.StatusCreated, w.Code, w.Body.String())
+	var att map[string]interface{}
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &att))
+	assert.Equal(t, "sda", att["device_name"])
+
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest("PATCH", "/api/v1/hosts/host-1/vms/disky/disks/sda", strings.NewReader(`{"shareable":true}`)))
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest("DELETE", "/api/v1/hosts/host-1/vms/disky/disks/sda", nil))
+	assert.Equal(t, http.StatusNoContent, w.Code, w.Body.String())
+
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest("DELETE", "/api/v1/hosts/host-1/vms/disky/disks/sda", nil))
+	assert.Equal(t, http.StatusNotFound, w.Code, w.Body.String())
+}
+
+func TestNICHotplugEndpoints(t *testing.T) {
+	router, _ := setupFakeAPITest(t)
+
+	body := `{"name":"nicky","vcpu_count":1,"memory_bytes":1073741824,"disk_size_gb":5}`
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest("POST", "/api/v1/hosts/host-1/vms", strings.NewReader(body)))
+	require.Equal(t, http.StatusCreated, w.Code, w.Body.String())
+
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest("POST", "/api/v1/hosts/host-1/vms/nicky/nics", strings.NewReader(`{"type":"network"}`)))
+	assert.Equal(t, http.StatusBadRequest, w.Code, w.Body.String())
+
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest("POST", "/api/v1/hosts/host-1/vms/nicky/nics", strings.NewReader(`{"type":"network","source":"default","mac":"52:54:00:12:34:56"}`)))
+	require.Equal(t, http.StatusCreated, w.Code, w.Body.String())
+	var att map[string]interface{}
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &att))
+	assert.Equal(t, "52:54:00:12:34:56", att["mac_address"])
+
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest("POST", "/api/v1/hosts/host-1/vms/nicky/nics", strings.NewReader(`{"type":"network","source":"default","mac":"52:54:00:12:34:56"}`)))
+	assert.Equal(t, http.StatusConflict, w.Code, w.Body.String())
+
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest("PATCH", "/api/v1/hosts/host-1/vms/nicky/nics/52:54:00:12:34:56", strings.NewReader(`{"link_state":"down"}`)))
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest("DELETE", "/api/v1/hosts/host-1/vms/nicky/nics/52:54:00:12:34:56", nil))
+	assert.Equal(t, http.StatusNoContent, w.Code, w.Body.String())
+
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest("DELETE", "/api/v1/hosts/host-1/vms/nicky/nics/52:54:00:12:34:56", nil))
+	assert.Equal(t, http.StatusNotFound, w.Code, w.Body.String())
+}
+
+func TestResizeVolumeEndpoint(t *testing.T) {
+	router, _ := setupFakeAPITest(t)
+
+	body := `{"name":"roomy","vcpu_count":1,"memory_bytes":1073741824,"disk_size_gb":5}`
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest("POST", "/api/v1/hosts/host-1/vms", strings.NewReader(body)))
+	require.Equal(t, http.StatusCreated, w.Code, w.Body.String())
+
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest("GET", "/api/v1/storage/volumes", nil))
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	var volumes []map[string]interface{}
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &volumes))
+	require.Len(t, volumes, 1)
+	url := "/api/v1/storage/volumes/" + volumes[0]["id"].(string) + "/resize"
+
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest("POST", url, strings.NewReader(`{}`)))
+	assert.Equal(t, http.StatusBadRequest, w.Code, w.Body.String())
+
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest("POST", url, strings.NewReader(`{"size_bytes":1073741824}`)))
+	assert.Equal(t, http.StatusBadRequest, w.Code, w.Body.String())
+
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest("POST", url, strings.NewReader(`{"size_bytes":10737418240}`)))
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	var vol map[string]interface{}
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &vol))
+	assert.Equal(t, float64(10737418240), vol["capacity_bytes"])
+
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest("POST", "/api/v1/storage/volumes/missing/resize", strings.NewReader(`{"size_bytes":10737418240}`)))
+	assert.Equal(t, http.StatusNotFound, w.Code, w.Body.String())
+}
+
+func TestVolumeTransferEndpoints(t *testing.T) {
+	router, _ := setupFakeAPITest(t)
+
+	content := []byte(strings.Repeat("virtumancer!", 1000))
+	body := `{"name":"seed.img","size_bytes":12000}`
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest("POST", "/api/v1/hosts/host-1/storage/volumes/uploads", strings.NewReader(body)))
+	require.Equal(t, http.StatusCreated, w.Code, w.Body.String())
+	var vol map[string]interface{}
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &vol))
+	base := "/api/v1/storage/volumes/" + vol["id"].(string)
+
+	req := httptest.NewRequest("PUT", base+"/content", bytes.NewReader(content[:5000]))
+	req.Header.Set("Content-Range", "bytes 0-4999/12000")
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+
+	// A chunk that skips ahead is refused with the offset to resume from.
+	req = httptest.NewRequest("PUT", base+"/content", bytes.NewReader(content[6000:]))
+	req.Header.Set("Content-Range", "bytes 6000-11999/12000")
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	require.Equal(t, http.StatusConflict, w.Code, w.Body.String())
+	var status map[string]interface{}
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &status))
+	assert.Equal(t, float64(5000), status["offset"])
+
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest("GET", base+"/upload", nil))
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+
+	req = httptest.NewRequest("PUT", base+"/content", bytes.NewReader(content[5000:]))
+	req.Header.Set("Content-Range", "bytes 5000-11999/12000")
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &status))
+	assert.Equal(t, true, status["complete"])
+
+	// Trailers only reach real clients on a chunked body, which the
+	// recorder does not check, so the full download goes over the wire.
+	server := httptest.NewServer(router)
+	defer server.Close()
+	resp, err := http.Get(server.URL + base + "/content")
+	require.NoError(t, err)
+	defer resp.Body.Close()
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	downloaded, err := io.ReadAll(resp.Body)
+	require.NoError(t, err)
+	assert.Equal(t, content, downloaded)
+	assert.Equal(t, []string{"chunked"}, resp.TransferEncoding)
+	sum := sha256.Sum256(content)
+	assert.Equal(t, hex.EncodeToString(sum[:]), resp.Trailer.Get("X-Checksum-Sha256"))
+
+	req = httptest.NewRequest("GET", base+"/content", nil)
+	req.Header.Set("Range", "bytes=11990-")
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	require.Equal(t, http.StatusPartialContent, w.Code)
+	assert.Equal(t, "bytes 11990-11999/12000", w.Header().Get("Content-Range"))
+	assert.Equal(t, content[11990:], w.Body.Bytes())
+
+	req = httptest.NewRequest("GET", base+"/content", nil)
+	req.Header.Set("Range", "bytes=20000-")
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusRequestedRangeNotSatisfiable, w.Code)
+}
+
+func TestISOLibraryEndpoints(t *testing.T) {
+	router, fake := setupFakeAPITest(t)
+	_, err := fake.AddStorageVolume("host-1", "default", "alpine.iso", "iso", 64<<20)
+	require.NoError(t, err)
+
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest("GET", "/api/v1/storage/isos?host_id=host-1", nil))
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	var images []map[string]interface{}
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &images))
+	require.Len(t, images, 1)
+	assert.Equal(t, "default", images[0]["pool_name"])
+	isoID := images[0]["id"].(string)
+
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest("GET", "/api/v1/storage/isos?host_id=missing", nil))
+	assert.Equal(t, http.StatusNotFound, w.Code, w.Body.String())
+
+	body := `{"name":"live","vcpu_count":1,"memory_bytes":1073741824,"disk_size_gb":5,"iso_volume_id":"` + isoID + `"}`
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest("POST", "/api/v1/hosts/host-1/vms", strings.NewReader(body)))
+	require.Equal(t, http.StatusCreated, w.Code, w.Body.String())
+
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest("DELETE", "/api/v1/hosts/host-1/vms/live/cdroms/sda/media", nil))
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest("PUT", "/api/v1/hosts/host-1/vms/live/cdroms/sda/media", strings.NewReader(`{}`)))
+	assert.Equal(t, http.StatusBadRequest, w.Code, w.Body.String())
+
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest("PUT", "/api/v1/hosts/host-1/vms/live/cdroms/sda/media", strings.NewReader(`{"volume_id":"`+isoID+`"}`)))
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	var att map[string]interface{}
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &att))
+	assert.Equal(t, "sda", att["device_name"])
+
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest("PUT", "/api/v1/hosts/host-1/vms/live/cdroms/vda/media", strings.NewReader(`{"volume_id":"`+isoID+`"}`)))
+	assert.Equal(t, http.StatusBadRequest, w.Code, w.Body.String())
+}
+
+func TestStoragePoolEndpoints(t *testing.T) {
+	router, _ := setupFakeAPITest(t)
+
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest("POST", "/api/v1/hosts/host-1/storage/pools", strings.NewReader(`{"name":"vg0","type":"logical"}`)))
+	assert.Equal(t, http.StatusBadRequest, w.Code, w.Body.String())
+
+	body := `{"name":"vg0","type":"logical","source_name":"vg0","source_devices":["/dev/sdb"],"build":true,"start":true}`
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest("POST", "/api/v1/hosts/host-1/storage/pools", strings.NewReader(body)))
+	require.Equal(t, http.StatusCreated, w.Code, w.Body.String())
+	var pool map[string]interface{}
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &pool))
+	assert.Equal(t, "active", pool["state"])
+	assert.Equal(t, "/dev/vg0", pool["path"])
+	base := "/api/v1/storage/pools/" + pool["id"].(string)
+
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest("POST", "/api/v1/hosts/host-1/storage/pools", strings.NewReader(body)))
+	assert.Equal(t, http.StatusConflict, w.Code, w.Body.String())
+
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest("PUT", base+"/autostart", strings.NewReader(`{"autostart":true}`)))
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &pool))
+	assert.Equal(t, true, pool["autostart"])
+
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest("POST", base+"/stop", nil))
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &pool))
+	assert.Equal(t, "inactive", pool["state"])
+
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest("DELETE", base+"?delete_storage=maybe", nil))
+	assert.Equal(t, http.StatusBadRequest, w.Code, w.Body.String())
+
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest("DELETE", base+"?delete_storage=true", nil))
+	require.Equal(t, http.StatusNoContent, w.Code, w.Body.String())
+
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest("POST", base+"/start", nil))
+	assert.Equal(t, http.StatusNotFound, w.Code, w.Body.String())
+}
+
+func TestNetworkEndpoints(t *testing.T) {
+	router, fake := setupFakeAPITest(t)
+
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest("POST", "/api/v1/hosts/host-1/networks", strings.NewReader(`{"name":"lab","mode":"bridge"}`)))
+	assert.Equal(t, http.StatusBadRequest, w.Code, w.Body.String())
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest("POST", "/api/v1/hosts/host-1/networks", strings.NewReader(`{"name":"default","mode":"isolated"}`)))
+	assert.Equal(t, http.StatusConflict, w.Code, w.Body.String())
+
+	body := `{"name":"lab","mode":"isolated","ips":[{"address":"192.168.50.1","prefix":24,"dhcp_ranges":[{"start":"192.168.50.10","end":"192.168.50.99"}]}],"start":true}`
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest("POST", "/api/v1/hosts/host-1/networks", strings.NewReader(body)))
+	require.Equal(t, http.StatusCreated, w.Code, w.Body.String())
+	var network map[string]interface{}
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &network))
+	assert.Equal(t, "active", network["state"])
+	assert.Equal(t, "isolated", network["mode"])
+	base := "/api/v1/networks/" + network["id"].(string)
+
+	update := `{"mode":"isolated","ips":[{"address":"192.168.50.1","prefix":24,"dhcp_ranges":[{"start":"192.168.50.10","end":"192.168.50.99"}],"dhcp_hosts":[{"mac":"52:54:00:12:34:56","ip":"192.168.50.5"}]}]}`
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest("PUT", base, strings.NewReader(update)))
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	assert.Zero(t, fake.NetworkRestarts("host-1", "lab"))
+
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest("GET", base, nil))
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	var detail struct {
+		Spec struct {
+			IPs []struct {
+				DHCPHosts []map[string]string `json:"dhcp_hosts"`
+			} `json:"ips"`
+		} `json:"spec"`
+	}
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &detail))
+	require.Len(t, detail.Spec.IPs, 1)
+	require.Len(t, detail.Spec.IPs[0].DHCPHosts, 1)
+	assert.Equal(t, "192.168.50.5", detail.Spec.IPs[0].DHCPHosts[0]["ip"])
+
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest("PUT", base, strings.NewReader(`{"mode":"open"}`)))
+	assert.Equal(t, http.StatusBadRequest, w.Code, w.Body.String())
+
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest("DELETE", base, nil))
+	require.Equal(t, http.StatusNoContent, w.Code, w.Body.String())
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest("GET", base, nil))
+	assert.Equal(t, http.StatusNotFound, w.Code, w.Body.String())
+}
+
+func TestSecurityGroupEndpoints(t *testing.T) {
+	router, fake := setupFakeAPITest(t)
+
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest("POST", "/api/v1/security-groups", strings.NewReader(`{"name":"ssh","rules":[{"direction":"sideways"}]}`)))
+	assert.Equal(t, http.StatusBadRequest, w.Code, w.Body.String())
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest("POST", "/api/v1/security-groups", strings.NewReader(`{"name":"ssh","rules":[{"direction":"ingress","protocol":"tcp","port_min":22}]}`)))
+	require.Equal(t, http.StatusCreated, w.Code, w.Body.String())
+	var group map[string]interface{}
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &group))
+	groupID := group["id"].(string)
+	assert.Len(t, group["rules"], 1)
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest("POST", "/api/v1/security-groups", strings.NewReader(`{"name":"ssh"}`)))
+	assert.Equal(t, http.StatusConflict, w.Code, w.Body.String())
+
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest("POST", "/api/v1/hosts/host-1/vms", strings.NewReader(`{"name":"guarded","vcpu_count":1,"memory_bytes":1073741824,"disk_size_gb":5}`)))
+	require.Equal(t, http.StatusCreated, w.Code, w.Body.String())
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest("POST", "/api/v1/hosts/host-1/vms/guarded/nics", strings.NewReader(`{"type":"network","source":"default","mac":"52:54:00:12:34:99"}`)))
+	require.Equal(t, http.StatusCreated, w.Code, w.Body.String())
+
+	nicGroups := "/api/v1/hosts/host-1/vms/guarded/nics/52:54:00:12:34:99/security-groups"
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest("PUT", nicGroups, strings.NewReader(`{"security_group_ids":["`+groupID+`"]}`)))
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	_, ok := fake.NWFilter("host-1", "virtumancer-sg-"+groupID)
+	assert.True(t, ok)
+
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest("PUT", "/api/v1/security-groups/"+groupID, strings.NewReader(`{"name":"ssh","rules":[{"direction":"ingress","protocol":"tcp","port_min":2222}]}`)))
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	filter, _ := fake.NWFilter("host-1", "virtumancer-sg-"+groupID)
+	require.NotEmpty(t, filter.Rules)
+	assert.Equal(t, 2222, filter.Rules[0].PortStart)
+
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest("DELETE", "/api/v1/security-groups/"+groupID, nil))
+	assert.Equal(t, http.StatusConflict, w.Code, w.Body.String())
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest("PUT", nicGroups, strings.NewReader(`{"security_group_ids":[]}`)))
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest("DELETE", "/api/v1/security-groups/"+groupID, nil))
+	assert.Equal(t, http.StatusNoContent, w.Code, w.Body.String())
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest("GET", "/api/v1/security-groups", nil))
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	assert.JSONEq(t, "[]", w.Body.String())
+}
+
+func TestGuestAgentEndpoints(t *testing.T) {
+	router, fake := setupFakeAPITest(t)
+
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest("POST", "/api/v1/hosts/host-1/vms", strings.NewReader(`{"name":"agent","vcpu_count":1,"memory_bytes":1073741824,"disk_size_gb":5}`)))
+	require.Equal(t, http.StatusCreated, w.Code, w.Body.String())
+
+	agent := "/api/v1/hosts/host-1/vms/agent/agent/"
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest("POST", agent+"exec", strings.NewReader(`{"path":"/bin/echo","args":["hi"]}`)))
+	assert.Equal(t, http.StatusConflict, w.Code, w.Body.String())
+
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest("POST", "/api/v1/hosts/host-1/vms/agent/start", nil))
+	require.Equal(t, http.StatusNoContent, w.Code, w.Body.String())
+
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest("POST", agent+"exec", strings.NewReader(`{"path":""}`)))
+	assert.Equal(t, http.StatusBadRequest, w.Code, w.Body.String())
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest("POST", agent+"exec", strings.NewReader(`{"path":"/bin/cat","input":"from stdin"}`)))
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	var result map[string]interface{}
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &result))
+	assert.Equal(t, "from stdin", result["stdout"])
+	assert.EqualValues(t, 0, result["exit_code"])
+
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest("POST", agent+"password", strings.NewReader(`{"user":"admin","password":"pw"}`)))
+	require.Equal(t, http.StatusNoContent, w.Code, w.Body.String())
+	password, _ := fake.GuestUserPassword("host-1", "agent", "admin")
+	assert.Equal(t, "pw", password)
+
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest("POST", agent+"fsfreeze", nil))
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	assert.JSONEq(t, `{"frozen":1}`, w.Body.String())
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest("POST", agent+"fsthaw", strings.NewReader(`{"mountpoints":["/"]}`)))
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	assert.JSONEq(t, `{"thawed":1}`, w.Body.String())
+}
+
+func TestPauseAndManagedSaveEndpoints(t *testing.T) {
+	router, fake := setupFakeAPITest(t)
+
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest("POST", "/api/v1/hosts/host-1/vms", strings.NewReader(`{"name":"saver","vcpu_count":1,"memory_bytes":1073741824,"disk_size_gb":5}`)))
+	require.Equal(t, http.StatusCreated, w.Code, w.Body.String())
+
+	vm := "/api/v1/hosts/host-1/vms/saver/"
+	for _, step := range []struct {
+		action string
+		state  golibvirt.DomainState
+	}{
+		{"start", golibvirt.DomainRunning},
+		{"pause", golibvirt.DomainPaused},
+		{"resume", golibvirt.DomainRunning},
+		{"managed-save", golibvirt.DomainShutoff},
+		{"restore", golibvirt.DomainRunning},
+	} {
+		w = httptest.NewRecorder()
+		router.ServeHTTP(w, httptest.NewRequest("POST", vm+step.action, nil))
+		require.Equal(t, http.StatusNoContent, w.Code, "%s: %s", step.action, w.Body.String())
+		state, _ := fake.DomainState("host-1", "saver")
+		assert.Equal(t, step.state, state, step.action)
+	}
+
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest("POST", vm+"restore", nil))
+	assert.Equal(t, http.StatusBadRequest, w.Code, w.Body.String())
+}
+
+func TestDeleteVMEndpoint(t *testing.T) {
+	router, fake := setupFakeAPITest(t)
+
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest("POST", "/api/v1/hosts/host-1/vms", strings.NewReader(`{"name":"doomed","vcpu_count":1,"memory_bytes":1073741824,"disk_size_gb":5}`)))
+	require.Equal(t, http.StatusCreated, w.Code, w.Body.String())
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest("POST", "/api/v1/hosts/host-1/vms/doomed/start", nil))
+	require.Equal(t, http.StatusNoContent, w.Code, w.Body.String())
+
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest("DELETE", "/api/v1/hosts/host-1/vms/doomed", nil))
+	assert.Equal(t, http.StatusBadRequest, w.Code, w.Body.String())
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest("DELETE", "/api/v1/hosts/host-1/vms/doomed", strings.NewReader(`{"force":true,"disk_policy":"shred"}`)))
+	assert.Equal(t, http.StatusBadRequest, w.Code, w.Body.String())
+
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest("DELETE", "/api/v1/hosts/host-1/vms/doomed", strings.NewReader(`{"force":true,"disk_policy":"delete"}`)))
+	require.Equal(t, http.StatusNoContent, w.Code, w.Body.String())
+	_, exists := fake.DomainState("host-1", "doomed")
+	assert.False(t, exists)
+
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest("DELETE", "/api/v1/hosts/host-1/vms/doomed", nil))
+	assert.Equal(t, http.StatusNotFound, w.Code, w.Body.String())
+}
+
+func TestResizeVMEndpoint(t *testing.T) {
+	router, fake := setupFakeAPITest(t)
+
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest("POST", "/api/v1/hosts/host-1/vms", strings.NewReader(`{"name":"elastic","vcpu_count":1,"memory_bytes":1073741824,"disk_size_gb":5}`)))
+	require.Equal(t, http.StatusCreated, w.Code, w.Body.String())
+
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest("PATCH", "/api/v1/hosts/host-1/vms/elastic", strings.NewReader(`{"vcpu_count":2}`)))
+	assert.Equal(t, http.StatusBadRequest, w.Code, w.Body.String())
+
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest("PATCH", "/api/v1/hosts/host-1/vms/elastic", strings.NewReader(`{"vcpu_count":2,"max_vcpu_count":2,"memory_bytes":2147483648}`)))
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	var vm storage.VirtualMachine
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &vm))
+	assert.Equal(t, uint(2), vm.VCPUCount)
+	assert.Equal(t, uint64(2<<30), vm.MemoryBytes)
+	info, err := fake.GetDomainInfo("host-1", "elastic")
+	require.NoError(t, err)
+	assert.Equal(t, uint(2), info.Vcpu)
+	assert.Equal(t, uint64(2<<20), info.MaxMem)
+}
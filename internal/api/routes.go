@@ -0,0 +1,164 @@
+package api
+
+import (
+	"net/http"
+
+	"github.com/go-chi/chi/v5"
+)
+
+// Routes returns the REST API router. It is mounted under /api/v1 by the
+// server and used as-is by the handler tests, so both see the same table.
+func Routes(h *APIHandler) http.Handler {
+	r := chi.NewRouter()
+
+	r.Get("/health", h.HealthCheck)
+
+	// Host routes
+	r.Get("/hosts", h.GetHosts)
+	r.Post("/hosts", h.CreateHost)
+
+	// Templates of every host
+	r.Get("/templates", h.ListTemplates)
+
+	// Flavors
+	r.Get("/flavors", h.ListFlavors)
+	r.Post("/flavors", h.CreateFlavor)
+	r.Get("/flavors/{id}", h.GetFlavor)
+	r.Put("/flavors/{id}", h.UpdateFlavor)
+	r.Delete("/flavors/{id}", h.DeleteFlavor)
+
+	// Global discovered VMs routes
+	r.Get("/discovered-vms", h.ListAllDiscoveredVMs)
+	r.Post("/discovered-vms/refresh", h.RefreshAllDiscoveredVMs)
+
+	r.Post("/hosts/{hostID}/connect", h.ConnectHost)
+	r.Post("/hosts/{hostID}/disconnect", h.DisconnectHost)
+	r.Get("/hosts/{hostID}/info", h.GetHostInfo)
+	r.Get("/hosts/{hostID}/stats", h.GetHostStats)
+	r.Get("/hosts/{hostID}/capabilities", h.GetHostCapabilities)
+	r.Post("/hosts/{hostID}/capabilities/refresh", h.RefreshHostCapabilities)
+	r.Patch("/hosts/{hostID}", h.UpdateHost)
+	r.Post("/hosts/{hostID}/ssh/retrust", h.RetrustHostKeys)
+	r.Delete("/hosts/{hostID}", h.DeleteHost)
+
+	// VM routes
+	r.Get("/hosts/{hostID}/vms", h.ListVMsFromLibvirt)
+	r.Post("/hosts/{hostID}/vms", h.CreateVM)
+	// Discovered/Import routes
+	r.Get("/hosts/{hostID}/discovered-vms", h.ListDiscoveredVMs)
+	r.Post("/hosts/{hostID}/vms/{vmName}/import", h.ImportVM)
+	r.Post("/hosts/{hostID}/vms/import-all", h.ImportAllVMs)
+	r.Post("/hosts/{hostID}/vms/import-selected", h.ImportSelectedVMs)
+	r.Delete("/hosts/{hostID}/discovered-vms", h.DeleteSelectedDiscoveredVMs)
+	r.Post("/hosts/{hostID}/vms/{vmName}/start", h.StartVM)
+	r.Post("/hosts/{hostID}/vms/{vmName}/shutdown", h.ShutdownVM)
+	r.Post("/hosts/{hostID}/vms/{vmName}/reboot", h.RebootVM)
+	r.Post("/hosts/{hostID}/vms/{vmName}/forceoff", h.ForceOffVM)
+	r.Post("/hosts/{hostID}/vms/{vmName}/forcereset", h.ForceResetVM)
+	r.Post("/hosts/{hostID}/vms/{vmName}/pause", h.PauseVM)
+	r.Post("/hosts/{hostID}/vms/{vmName}/resume", h.ResumeVM)
+	r.Post("/hosts/{hostID}/vms/{vmName}/managed-save", h.ManagedSaveVM)
+	r.Post("/hosts/{hostID}/vms/{vmName}/restore", h.RestoreVM)
+	r.Delete("/hosts/{hostID}/vms/{vmName}", h.DeleteVM)
+	r.Patch("/hosts/{hostID}/vms/{vmName}", h.ResizeVM)
+	r.Post("/hosts/{hostID}/vms/{vmName}/resize-to-flavor", h.ResizeVMToFlavor)
+	r.Post("/hosts/{hostID}/vms/{vmName}/sync-from-libvirt", h.SyncVMLive)
+	r.Post("/hosts/{hostID}/vms/{vmName}/rebuild-from-db", h.RebuildVM)
+	r.Put("/hosts/{hostID}/vms/{vmName}/state", h.UpdateVMState)
+	r.Get("/hosts/{hostID}/vms/{vmName}/stats", h.GetVMStats)
+	r.Get("/hosts/{hostID}/vms/{vmName}/hardware", h.GetVMHardware)
+	r.Get("/hosts/{hostID}/vms/{vmName}/hardware/extended", h.GetVMExtendedHardware)
+	r.Get("/hosts/{hostID}/vms/{vmName}/snapshots", h.ListVMSnapshots)
+	r.Post("/hosts/{hostID}/vms/{vmName}/snapshots", h.CreateVMSnapshot)
+	r.Post("/hosts/{hostID}/vms/{vmName}/snapshots/{snapshotName}/revert", h.RevertVMSnapshot)
+	r.Delete("/hosts/{hostID}/vms/{vmName}/snapshots/{snapshotName}", h.DeleteVMSnapshot)
+	r.Post("/hosts/{hostID}/vms/{vmName}/migrate", h.MigrateVM)
+	r.Post("/hosts/{hostID}/vms/{vmName}/clone", h.CloneVM)
+	r.Post("/hosts/{hostID}/vms/{vmName}/template", h.ConvertVMToTemplate)
+	r.Delete("/hosts/{hostID}/vms/{vmName}/template", h.ConvertTemplateToVM)
+	r.Post("/hosts/{hostID}/vms/{vmName}/template/copy", h.CopyTemplate)
+	r.Post("/hosts/{hostID}/vms/{vmName}/instances", h.InstantiateTemplate)
+	r.Post("/hosts/{hostID}/vms/{vmName}/disks", h.AttachVMDisk)
+	r.Patch("/hosts/{hostID}/vms/{vmName}/disks/{device}", h.UpdateVMDisk)
+	r.Delete("/hosts/{hostID}/vms/{vmName}/disks/{device}", h.DetachVMDisk)
+	r.Put("/hosts/{hostID}/vms/{vmName}/cdroms/{device}/media", h.InsertVMMedia)
+	r.Delete("/hosts/{hostID}/vms/{vmName}/cdroms/{device}/media", h.EjectVMMedia)
+	r.Post("/hosts/{hostID}/vms/{vmName}/nics", h.AttachVMNIC)
+	r.Patch("/hosts/{hostID}/vms/{vmName}/nics/{mac}", h.UpdateVMNIC)
+	r.Delete("/hosts/{hostID}/vms/{vmName}/nics/{mac}", h.DetachVMNIC)
+	r.Get("/hosts/{hostID}/vms/{vmName}/nics/{mac}/security-groups", h.GetVMNICSecurityGroups)
+	r.Put("/hosts/{hostID}/vms/{vmName}/nics/{mac}/security-groups", h.SetVMNICSecurityGroups)
+	r.Post("/hosts/{hostID}/vms/{vmName}/agent/exec", h.ExecInGuest)
+	r.Post("/hosts/{hostID}/vms/{vmName}/agent/password", h.SetGuestPassword)
+	r.Post("/hosts/{hostID}/vms/{vmName}/agent/fsfreeze", h.FreezeGuestFilesystems)
+	r.Post("/hosts/{hostID}/vms/{vmName}/agent/fsthaw", h.ThawGuestFilesystems)
+	r.Post("/hosts/{hostID}/vms/{vmName}/agent/shutdown", h.ShutdownVMViaAgent)
+	r.Post("/hosts/{hostID}/vms/{vmName}/agent/reboot", h.RebootVMViaAgent)
+	r.Post("/hosts/{hostID}/vms/{vmName}/agent/time-sync", h.SyncGuestTime)
+
+	// Port routes
+	r.Get("/hosts/{hostID}/ports", h.ListHostPorts)
+	r.Get("/hosts/{hostID}/vms/{vmName}/port-attachments", h.ListVMPortAttachments)
+
+	// Storage routes
+	r.Get("/storage/pools", h.ListStoragePools)
+	r.Post("/storage/pools/{id}/build", h.BuildStoragePool)
+	r.Post("/storage/pools/{id}/start", h.StartStoragePool)
+	r.Post("/storage/pools/{id}/stop", h.StopStoragePool)
+	r.Post("/storage/pools/{id}/refresh", h.RefreshStoragePool)
+	r.Put("/storage/pools/{id}/autostart", h.SetStoragePoolAutostart)
+	r.Delete("/storage/pools/{id}", h.DeleteStoragePool)
+	r.Get("/storage/volumes", h.ListStorageVolumes)
+	r.Delete("/storage/volumes/{id}", h.DeleteStorageVolume)
+	r.Post("/storage/volumes/{id}/resize", h.ResizeStorageVolume)
+	r.Get("/storage/volumes/{id}/upload", h.GetVolumeUploadStatus)
+	r.Put("/storage/volumes/{id}/content", h.UploadVolumeContent)
+	r.Get("/storage/volumes/{id}/content", h.DownloadVolumeContent)
+	r.Get("/storage/isos", h.ListISOs)
+	r.Get("/storage/disk-attachments", h.ListDiskAttachments)
+	r.Get("/hosts/{hostID}/storage/pools", h.ListHostStoragePools)
+	r.Post("/hosts/{hostID}/storage/pools", h.CreateStoragePool)
+	r.Get("/hosts/{hostID}/storage/volumes", h.ListHostStorageVolumes)
+	r.Post("/hosts/{hostID}/storage/volumes/uploads", h.CreateVolumeUpload)
+
+	// Network routes
+	r.Get("/networks", h.ListNetworks)
+	r.Get("/networks/{id}", h.GetNetwork)
+	r.Put("/networks/{id}", h.UpdateNetwork)
+	r.Delete("/networks/{id}", h.DeleteNetwork)
+	r.Post("/networks/{id}/start", h.StartNetwork)
+	r.Post("/networks/{id}/stop", h.StopNetwork)
+	r.Put("/networks/{id}/autostart", h.SetNetworkAutostart)
+	r.Get("/ports", h.ListPorts)
+	r.Get("/port-attachments", h.ListPortAttachments)
+	r.Get("/hosts/{hostID}/networks", h.ListHostNetworks)
+	r.Post("/hosts/{hostID}/networks", h.CreateNetwork)
+
+	// Security group routes
+	r.Get("/security-groups", h.ListSecurityGroups)
+	r.Post("/security-groups", h.CreateSecurityGroup)
+	r.Get("/security-groups/{id}", h.GetSecurityGroup)
+	r.Put("/security-groups/{id}", h.UpdateSecurityGroup)
+	r.Delete("/security-groups/{id}", h.DeleteSecurityGroup)
+
+	// Video / GPU routes
+	r.Get("/video/models", h.ListVideoModels)
+	r.Get("/hosts/{hostID}/video/devices", h.ListHostVideoDevices)
+	r.Get("/hosts/{hostID}/vms/{vmName}/video-attachments", h.ListVMVideoAttachments)
+
+	// Console routes
+	r.Get("/hosts/{hostID}/vms/{vmName}/console", h.HandleVMConsole)
+	r.Get("/hosts/{hostID}/vms/{vmName}/spice", h.HandleSpiceConsole)
+
+	// Dashboard routes
+	r.Get("/dashboard/stats", h.GetDashboardStats)
+	r.Get("/dashboard/activity", h.GetDashboardActivity)
+	r.Get("/dashboard/overview", h.GetDashboardOverview)
+
+	// Settings routes
+	r.Get("/settings/metrics", h.GetMetricsSettings)
+	r.Put("/settings/metrics", h.UpdateMetricsSettings)
+	r.Get("/settings/metrics/runtime", h.GetRuntimeMetricsSettings)
+
+	return r
+}
@@ -93,7 +93,7 @@ func (w *wsConnWrapper) Close() error {
 }
 
 // HandleConsole finds the VM's VNC console details and proxies the connection.
-func HandleConsole(db *gorm.DB, connector *libvirt.Connector, w http.ResponseWriter, r *http.Request) {
+func HandleConsole(db *gorm.DB, connector libvirt.Hypervisor, w http.ResponseWriter, r *http.Request) {
 	hostID := chi.URLParam(r, "hostID")
 	vmName := chi.URLParam(r, "vmName")
 
@@ -217,7 +217,7 @@ func HandleConsole(db *gorm.DB, connector *libvirt.Connector, w http.ResponseWri
 }
 
 // HandleSpiceConsole finds the VM's SPICE console details and proxies the connection.
-func HandleSpiceConsole(db *gorm.DB, connector *libvirt.Connector, w http.ResponseWriter, r *http.Request) {
+func HandleSpiceConsole(db *gorm.DB, connector libvirt.Hypervisor, w http.ResponseWriter, r *http.Request) {
 	hostID := chi.URLParam(r, "hostID")
 	vmName := chi.URLParam(r, "vmName")
 
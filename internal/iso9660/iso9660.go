@@ -0,0 +1,288 @@
+// Package iso9660 writes small ISO 9660 images holding a flat set of files,
+// such as the cloud-init NoCloud seeds attached to new VMs as CD-ROMs.
+//
+// Images carry Joliet names next to the 8.3 names plain ISO 9660 allows, so
+// guests see files under their real names ("user-data", not "USER_DAT.").
+package iso9660
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+	"unicode/utf16"
+)
+
+const (
+	sectorSize = 2048
+	// systemAreaSectors precede the first volume descriptor.
+	systemAreaSectors = 16
+	// maxLabel and maxName are what Joliet's UCS-2 fields hold.
+	maxLabel = 16
+	maxName  = 64
+)
+
+// File is a file in the root directory of an image.
+type File struct {
+	Name string
+	Data []byte
+}
+
+// entry is a file as one directory tree names it.
+type entry struct {
+	name   []byte
+	extent uint32
+	size   uint32
+}
+
+// Build returns an image labelled label holding files in its root
+// directory. modTime stamps the volume and its files.
+func Build(label string, files []File, modTime time.Time) ([]byte, error) {
+	if label == "" || len(label) > maxLabel {
+		return nil, fmt.Errorf("invalid image: label must be 1 to %d characters", maxLabel)
+	}
+	seen := make(map[string]bool, len(files))
+	for _, f := range files {
+		if f.Name == "" || len(f.Name) > maxName || strings.ContainsAny(f.Name, "/;\x00") {
+			return nil, fmt.Errorf("invalid image: bad file name %q", f.Name)
+		}
+		if seen[f.Name] {
+			return nil, fmt.Errorf("invalid image: duplicate file name %q", f.Name)
+		}
+		seen[f.Name] = true
+	}
+	modTime = modTime.UTC()
+
+	// Sectors 16 to 18 hold the primary and Joliet volume descriptors and
+	// the set terminator, followed by a little- and a big-endian path table
+	// for each tree, each tree's root directory, then the file data.
+	primary := make([]entry, len(files))
+	joliet := make([]entry, len(files))
+	shortNames := shortNamer{}
+	for i, f := range files {
+		primary[i].name = []byte(shortNames.name(f.Name) + ";1")
+		joliet[i].name = ucs2(f.Name + ";1")
+	}
+	primaryDirSectors := dirSectors(primary)
+	jolietDirSectors := dirSectors(joliet)
+	const pathTablesLBA = systemAreaSectors + 3
+	primaryDirLBA := uint32(pathTablesLBA + 4)
+	jolietDirLBA := primaryDirLBA + primaryDirSectors
+	next := jolietDirLBA + jolietDirSectors
+	for i, f := range files {
+		primary[i].extent, primary[i].size = next, uint32(len(f.Data))
+		joliet[i].extent, joliet[i].size = next, uint32(len(f.Data))
+		next += sectorsFor(len(f.Data))
+	}
+	totalSectors := next
+
+	img := make([]byte, int(totalSectors)*sectorSize)
+	sector := func(lba uint32) []byte {
+		return img[int(lba)*sectorSize : int(lba+1)*sectorSize]
+	}
+
+	pvd := sector(systemAreaSectors)
+	writeDescriptorHeader(pvd, 1)
+	copy(pvd[8:40], padded([]byte("LINUX"), 32, " "))
+	copy(pvd[40:72], padded([]byte(label), 32, " "))
+	writeCommonDescriptor(pvd, totalSectors, pathTablesLBA, primaryDirLBA, primaryDirSectors, modTime, " ")
+
+	svd := sector(systemAreaSectors + 1)
+	writeDescriptorHeader(svd, 2)
+	copy(svd[8:40], padded(ucs2("LINUX"), 32, "\x00 "))
+	copy(svd[40:72], padded(ucs2(label), 32, "\x00 "))
+	// UCS-2 level 3 is what marks the descriptor as Joliet.
+	copy(svd[88:91], "%/E")
+	writeCommonDescriptor(svd, totalSectors, pathTablesLBA+2, jolietDirLBA, jolietDirSectors, modTime, "\x00 ")
+
+	writeDescriptorHeader(sector(systemAreaSectors+2), 255)
+
+	writePathTable(sector(pathTablesLBA), primaryDirLBA, binary.LittleEndian)
+	writePathTable(sector(pathTablesLBA+1), primaryDirLBA, binary.BigEndian)
+	writePathTable(sector(pathTablesLBA+2), jolietDirLBA, binary.LittleEndian)
+	writePathTable(sector(pathTablesLBA+3), jolietDirLBA, binary.BigEndian)
+
+	writeDirectory(img[int(primaryDirLBA)*sectorSize:], primary, primaryDirLBA, primaryDirSectors, modTime)
+	writeDirectory(img[int(jolietDirLBA)*sectorSize:], joliet, jolietDirLBA, jolietDirSectors, modTime)
+
+	for i, f := range files {
+		copy(img[int(primary[i].extent)*sectorSize:], f.Data)
+	}
+	return img, nil
+}
+
+func sectorsFor(n int) uint32 {
+	return uint32((n + sectorSize - 1) / sectorSize)
+}
+
+// dirSectors is the size of a root directory holding entries. Records
+// never straddle a sector boundary.
+func dirSectors(entries []entry) uint32 {
+	sectors, used := uint32(1), 2*dirRecordLen(1)
+	for _, e := range entries {
+		n := dirRecordLen(len(e.name))
+		if used+n > sectorSize {
+			sectors++
+			used = 0
+		}
+		used += n
+	}
+	return sectors
+}
+
+func dirRecordLen(nameLen int) int {
+	n := 33 + nameLen
+	if n%2 != 0 {
+		n++
+	}
+	return n
+}
+
+func writeDescriptorHeader(b []byte, kind byte) {
+	b[0] = kind
+	copy(b[1:6], "CD001")
+	b[6] = 1
+}
+
+// writeCommonDescriptor fills in the fields primary and supplementary
+// volume descriptors share. pad is the text padding of the descriptor's
+// character set.
+func writeCommonDescriptor(b []byte, totalSectors, pathTableLBA, rootLBA, rootSectors uint32, modTime time.Time, pad string) {
+	putBoth32(b[80:88], totalSectors)
+	putBoth16(b[120:124], 1)
+	putBoth16(b[124:128], 1)
+	putBoth16(b[128:132], sectorSize)
+	putBoth32(b[132:140], pathTableLen)
+	binary.LittleEndian.PutUint32(b[140:144], pathTableLBA)
+	binary.BigEndian.PutUint32(b[148:152], pathTableLBA+1)
+	writeDirRecord(b[156:190], []byte{0}, rootLBA, rootSectors*sectorSize, true, modTime)
+	for _, field := range [][2]int{{190, 318}, {318, 446}, {446, 574}, {574, 702}, {702, 739}, {739, 776}, {776, 813}} {
+		copy(b[field[0]:field[1]], padded(nil, field[1]-field[0], pad))
+	}
+	stamp := []byte(modTime.Format("20060102150405") + "00")
+	copy(b[813:829], stamp)
+	copy(b[830:846], stamp)
+	copy(b[847:863], "0000000000000000")
+	copy(b[864:880], "0000000000000000")
+	b[881] = 1
+}
+
+// pathTableLen is the size of a path table listing only the root.
+const pathTableLen = 10
+
+func writePathTable(b []byte, rootLBA uint32, order binary.ByteOrder) {
+	b[0] = 1
+	order.PutUint32(b[2:6], rootLBA)
+	order.PutUint16(b[6:8], 1)
+}
+
+// writeDirectory writes a root directory: its "." and ".." records, then
+// the entries sorted by name as the standard requires.
+func writeDirectory(b []byte, entries []entry, lba, sectors uint32, modTime time.Time) {
+	sorted := append([]entry(nil), entries...)
+	sort.Slice(sorted, func(i, j int) bool { return bytes.Compare(sorted[i].name, sorted[j].name) < 0 })
+
+	size := sectors * sectorSize
+	off := 0
+	off += writeDirRecord(b[off:], []byte{0}, lba, size, true, modTime)
+	off += writeDirRecord(b[off:], []byte{1}, lba, size, true, modTime)
+	for _, e := range sorted {
+		n := dirRecordLen(len(e.name))
+		if off%sectorSize+n > sectorSize {
+			off += sectorSize - off%sectorSize
+		}
+		off += writeDirRecord(b[off:], e.name, e.extent, e.size, false, modTime)
+	}
+}
+
+func writeDirRecord(b []byte, name []byte, extent, size uint32, dir bool, modTime time.Time) int {
+	n := dirRecordLen(len(name))
+	b[0] = byte(n)
+	putBoth32(b[2:10], extent)
+	putBoth32(b[10:18], size)
+	b[18] = byte(modTime.Year() - 1900)
+	b[19] = byte(modTime.Month())
+	b[20] = byte(modTime.Day())
+	b[21] = byte(modTime.Hour())
+	b[22] = byte(modTime.Minute())
+	b[23] = byte(modTime.Second())
+	if dir {
+		b[25] = 2
+	}
+	putBoth16(b[28:32], 1)
+	b[32] = byte(len(name))
+	copy(b[33:], name)
+	return n
+}
+
+func putBoth16(b []byte, v uint16) {
+	binary.LittleEndian.PutUint16(b[0:2], v)
+	binary.BigEndian.PutUint16(b[2:4], v)
+}
+
+func putBoth32(b []byte, v uint32) {
+	binary.LittleEndian.PutUint32(b[0:4], v)
+	binary.BigEndian.PutUint32(b[4:8], v)
+}
+
+// padded returns b filled out to n bytes with repetitions of pad.
+func padded(b []byte, n int, pad string) []byte {
+	out := make([]byte, 0, n)
+	out = append(out, b...)
+	for len(out) < n {
+		out = append(out, pad...)
+	}
+	return out[:n]
+}
+
+// ucs2 encodes s as Joliet names and labels are stored, big-endian UCS-2.
+func ucs2(s string) []byte {
+	units := utf16.Encode([]rune(s))
+	b := make([]byte, 2*len(units))
+	for i, u := range units {
+		binary.BigEndian.PutUint16(b[2*i:], u)
+	}
+	return b
+}
+
+// shortNamer derives unique 8.3 names from long ones.
+type shortNamer map[string]bool
+
+func (s shortNamer) name(long string) string {
+	base, ext := long, ""
+	if i := strings.LastIndex(long, "."); i > 0 {
+		base, ext = long[:i], long[i+1:]
+	}
+	base, ext = dChars(base, 8), dChars(ext, 3)
+	for n := 1; ; n++ {
+		name := base + "." + ext
+		if !s[name] {
+			s[name] = true
+			return name
+		}
+		suffix := fmt.Sprintf("_%d", n)
+		if len(base) > 8-len(suffix) {
+			base = base[:8-len(suffix)]
+		}
+		base = strings.TrimRight(base, "_0123456789") + suffix
+	}
+}
+
+// dChars keeps the first n characters of s, mapping anything outside the
+// d-characters ISO 9660 allows in names to "_".
+func dChars(s string, n int) string {
+	var b strings.Builder
+	for _, r := range strings.ToUpper(s) {
+		if b.Len() == n {
+			break
+		}
+		if (r >= 'A' && r <= 'Z') || (r >= '0' && r <= '9') || r == '_' {
+			b.WriteRune(r)
+		} else {
+			b.WriteByte('_')
+		}
+	}
+	return b.String()
+}
@@ -0,0 +1,347 @@
+package libvirt
+
+import (
+	"crypto/rand"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"path"
+	"strings"
+
+	log "github.com/capsali/virtumancer/internal/logging"
+
+	"github.com/digitalocean/go-libvirt"
+)
+
+// VolumeCloneSpec describes copying a storage volume, possibly to another
+// host.
+type VolumeCloneSpec struct {
+	SourceHostID string
+	SourcePath   string
+	HostID       string
+	// PoolName is the pool that receives the copy; it defaults to the pool
+	// of the source volume.
+	PoolName string
+	Name     string
+	// Linked creates a qcow2 overlay backed by the source instead of copying
+	// its data. The source must then stay in place for the clone's lifetime.
+	Linked bool
+}
+
+// DomainCloneSpec describes how a cloned domain's definition differs from
+// the original's.
+type DomainCloneSpec struct {
+	Name string
+	UUID string
+	// Disks maps the source path of each copied disk to its copy.
+	Disks map[string]ClonedDisk
+	// MACs maps each interface's MAC address to the one the clone uses.
+	MACs map[string]string
+}
+
+// ClonedDisk is the copy of one disk of a cloned domain.
+type ClonedDisk struct {
+	Path   string
+	Format string
+}
+
+type volumeSizeXML struct {
+	Unit  string `xml:"unit,attr,omitempty"`
+	Value uint64 `xml:",chardata"`
+}
+
+type volumeFormatXML struct {
+	Type string `xml:"type,attr"`
+}
+
+type volumeBackingXML struct {
+	Path   string          `xml:"path"`
+	Format volumeFormatXML `xml:"format"`
+}
+
+type storageVolumeXML struct {
+	XMLName    xml.Name       `xml:"volume"`
+	Name       string         `xml:"name"`
+	Capacity   volumeSizeXML  `xml:"capacity"`
+	Allocation *volumeSizeXML `xml:"allocation,omitempty"`
+	Target     struct {
+		Format volumeFormatXML `xml:"format"`
+	} `xml:"target"`
+	BackingStore *volumeBackingXML `xml:"backingStore,omitempty"`
+}
+
+func validateVolumeCloneSpec(spec VolumeCloneSpec) error {
+	if spec.Name == "" {
+		return fmt.Errorf("invalid clone: volume name is required")
+	}
+	if spec.Linked && spec.HostID != spec.SourceHostID {
+		return fmt.Errorf("invalid clone: linked clones must stay on the host of their backing volume")
+	}
+	return nil
+}
+
+// CloneStorageVolume copies a volume and returns the copy. Full copies on
+// the same host use libvirt's own copy; copies to another host are streamed
+// through Virtumancer, which holds a connection to each daemon.
+func (c *Connector) CloneStorageVolume(spec VolumeCloneSpec) (*VolumeDetail, error) {
+	if err := validateVolumeCloneSpec(spec); err != nil {
+		return nil, err
+	}
+	src, err := c.GetConnection(spec.SourceHostID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get libvirt connection: %w", err)
+	}
+	srcVol, err := src.StorageVolLookupByPath(spec.SourcePath)
+	if err != nil {
+		return nil, fmt.Errorf("failed to find storage volume %s: %w", spec.SourcePath, err)
+	}
+	_, capacity, _, err := src.StorageVolGetInfo(srcVol)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get info for storage volume %s: %w", spec.SourcePath, err)
+	}
+	srcDesc, err := src.StorageVolGetXMLDesc(srcVol, 0)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get XML for storage volume %s: %w", spec.SourcePath, err)
+	}
+	var srcDoc storageVolumeXML
+	if err := xml.Unmarshal([]byte(srcDesc), &srcDoc); err != nil {
+		return nil, fmt.Errorf("failed to parse XML for storage volume %s: %w", spec.SourcePath, err)
+	}
+	srcFormat := srcDoc.Target.Format.Type
+	if srcFormat == "" {
+		srcFormat = "raw"
+	}
+
+	poolName := spec.PoolName
+	if poolName == "" {
+		srcPool, err := src.StoragePoolLookupByVolume(srcVol)
+		if err != nil {
+			return nil, fmt.Errorf("failed to find storage pool of volume %s: %w", spec.SourcePath, err)
+		}
+		poolName = srcPool.Name
+	}
+	dst, err := c.GetConnection(spec.HostID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get libvirt connection: %w", err)
+	}
+	pool, err := dst.StoragePoolLookupByName(poolName)
+	if err != nil {
+		return nil, fmt.Errorf("failed to find storage pool %s: %w", poolName, err)
+	}
+
+	doc := storageVolumeXML{Name: spec.Name, Capacity: volumeSizeXML{Unit: "bytes", Value: capacity}}
+	doc.Target.Format.Type = srcFormat
+	if spec.Linked {
+		doc.Target.Format.Type = "qcow2"
+		doc.BackingStore = &volumeBackingXML{Path: spec.SourcePath, Format: volumeFormatXML{Type: srcFormat}}
+	}
+	volXML, err := xml.Marshal(doc)
+	if err != nil {
+		return nil, fmt.Errorf("failed to build XML for storage volume %s: %w", spec.Name, err)
+	}
+
+	var vol libvirt.StorageVol
+	switch {
+	case spec.Linked:
+		vol, err = dst.StorageVolCreateXML(pool, string(volXML), 0)
+	case spec.HostID == spec.SourceHostID:
+		vol, err = dst.StorageVolCreateXMLFrom(pool, string(volXML), srcVol, 0)
+	default:
+		vol, err = dst.StorageVolCreateXML(pool, string(volXML), 0)
+		if err == nil {
+			log.Debugf("Streaming volume %s from host %s to %s on host %s", spec.SourcePath, spec.SourceHostID, spec.Name, spec.HostID)
+			if err = streamVolume(src, srcVol, dst, vol); err != nil {
+				if delErr := dst.StorageVolDelete(vol, 0); delErr != nil {
+					log.Warnf("Failed to remove partial copy %s on host %s: %v", spec.Name, spec.HostID, delErr)
+				}
+			}
+		}
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to clone storage volume %s: %w", spec.SourcePath, err)
+	}
+
+	volPath, err := dst.StorageVolGetPath(vol)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get path of storage volume %s: %w", spec.Name, err)
+	}
+	detail := &VolumeDetail{
+		Name:     spec.Name,
+		Capacity: capacity,
+		Path:     volPath,
+		Format:   doc.Target.Format.Type,
+		PoolName: poolName,
+	}
+	if spec.Linked {
+		detail.BackingPath = spec.SourcePath
+	}
+	return detail, nil
+}
+
+// streamVolume copies the contents of one volume into another through a
+// pipe, so the data never has to fit in memory.
+func streamVolume(src *libvirt.Libvirt, srcVol libvirt.StorageVol, dst *libvirt.Libvirt, dstVol libvirt.StorageVol) error {
+	r, w := io.Pipe()
+	downloaded := make(chan error, 1)
+	go func() {
+		err := src.StorageVolDownload(srcVol, w, 0, 0, 0)
+		w.CloseWithError(err)
+		downloaded <- err
+	}()
+	uploadErr := dst.StorageVolUpload(dstVol, r, 0, 0, 0)
+	// Unblock the download if the upload gave up early.
+	r.CloseWithError(uploadErr)
+	if err := <-downloaded; err != nil {
+		return fmt.Errorf("download failed: %w", err)
+	}
+	if uploadErr != nil {
+		return fmt.Errorf("upload failed: %w", uploadErr)
+	}
+	return nil
+}
+
+// GenerateMAC returns a random MAC address in the range QEMU reserves for
+// guest NICs.
+func GenerateMAC() (string, error) {
+	buf := make([]byte, 3)
+	if _, err := rand.Read(buf); err != nil {
+		return "", fmt.Errorf("failed to generate MAC address: %w", err)
+	}
+	return fmt.Sprintf("52:54:00:%02x:%02x:%02x", buf[0], buf[1], buf[2]), nil
+}
+
+// CloneDomainXML rewrites a domain definition for a clone: a new name and
+// UUID, new interface MACs, copied disk paths and a per-domain NVRAM file.
+// Everything else is copied byte for byte so that elements Virtumancer does
+// not model survive the round trip.
+func CloneDomainXML(doc string, spec DomainCloneSpec) (string, error) {
+	// <driver> comes before <source> inside a disk, so find each disk's
+	// source up front.
+	var def struct {
+		Disks []DiskInfo `xml:"devices>disk"`
+	}
+	if err := xml.Unmarshal([]byte(doc), &def); err != nil {
+		return "", fmt.Errorf("failed to parse domain XML: %w", err)
+	}
+
+	dec := xml.NewDecoder(strings.NewReader(doc))
+	var out strings.Builder
+	var stack []string
+	var copied int64
+	diskIndex := -1
+	var disk *ClonedDisk
+	for {
+		start := dec.InputOffset()
+		tok, err := dec.RawToken()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return "", fmt.Errorf("failed to parse domain XML: %w", err)
+		}
+		end := dec.InputOffset()
+
+		var replacement string
+		replace := false
+		switch t := tok.(type) {
+		case xml.StartElement:
+			stack = append(stack, t.Name.Local)
+			selfClosing := strings.HasSuffix(doc[start:end], "/>")
+			switch strings.Join(stack, "/") {
+			case "domain/devices/disk":
+				diskIndex++
+				disk = nil
+				if diskIndex < len(def.Disks) {
+					if d, ok := spec.Disks[def.Disks[diskIndex].Source.File]; ok {
+						disk = &d
+					}
+				}
+			case "domain/devices/disk/source":
+				if disk != nil {
+					replacement, replace = renderStartElement(withAttr(t, "file", disk.Path), selfClosing), true
+				}
+			case "domain/devices/disk/driver":
+				if disk != nil && disk.Format != "" {
+					replacement, replace = renderStartElement(withAttr(t, "type", disk.Format), selfClosing), true
+				}
+			case "domain/devices/interface/mac":
+				for _, a := range t.Attr {
+					if mac, ok := spec.MACs[strings.ToLower(a.Value)]; ok && a.Name.Local == "address" {
+						replacement, replace = renderStartElement(withAttr(t, "address", mac), selfClosing), true
+					}
+				}
+			}
+		case xml.EndElement:
+			// Also reported, without consuming input, for "<x/>".
+			if len(stack) > 0 {
+				stack = stack[:len(stack)-1]
+			}
+		case xml.CharData:
+			var text string
+			switch strings.Join(stack, "/") {
+			case "domain/name":
+				text, replace = spec.Name, true
+			case "domain/uuid":
+				text, replace = spec.UUID, true
+			case "domain/os/nvram":
+				if current := strings.TrimSpace(string(t)); current != "" {
+					text, replace = path.Join(path.Dir(current), spec.Name+"_VARS.fd"), true
+				}
+			}
+			if replace {
+				var b strings.Builder
+				xml.EscapeText(&b, []byte(text))
+				replacement = b.String()
+			}
+		}
+		if replace {
+			out.WriteString(doc[copied:start])
+			out.WriteString(replacement)
+			copied = end
+		}
+	}
+	out.WriteString(doc[copied:])
+	return out.String(), nil
+}
+
+// withAttr returns a copy of el with the named attribute set to value.
+func withAttr(el xml.StartElement, name, value string) xml.StartElement {
+	attrs := make([]xml.Attr, 0, len(el.Attr)+1)
+	found := false
+	for _, a := range el.Attr {
+		if a.Name.Space == "" && a.Name.Local == name {
+			a.Value = value
+			found = true
+		}
+		attrs = append(attrs, a)
+	}
+	if !found {
+		attrs = append(attrs, xml.Attr{Name: xml.Name{Local: name}, Value: value})
+	}
+	el.Attr = attrs
+	return el
+}
+
+// renderStartElement writes a start tag as it appeared in the source, keeping
+// namespace prefixes as written.
+func renderStartElement(el xml.StartElement, selfClosing bool) string {
+	qualified := func(n xml.Name) string {
+		if n.Space != "" {
+			return n.Space + ":" + n.Local
+		}
+		return n.Local
+	}
+	var b strings.Builder
+	b.WriteString("<" + qualified(el.Name))
+	for _, a := range el.Attr {
+		b.WriteString(" " + qualified(a.Name) + "='")
+		xml.EscapeText(&b, []byte(a.Value))
+		b.WriteString("'")
+	}
+	if selfClosing {
+		b.WriteString("/>")
+	} else {
+		b.WriteString(">")
+	}
+	return b.String()
+}
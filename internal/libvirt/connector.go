@@ -5,7 +5,6 @@ import (
 	"fmt"
 	"net"
 	"net/url"
-	"os"
 	"path/filepath"
 	"strconv"
 	"strings"
@@ -40,6 +39,8 @@ type VMInfo struct {
 	Persistent bool                `json:"persistent"`
 	Autostart  bool                `json:"autostart"`
 	Graphics   GraphicsInfo        `json:"graphics"`
+	// HasManagedSave is set while the domain has a managed save image.
+	HasManagedSave bool `json:"has_managed_save"`
 	// Enhanced API-based data
 	VcpuDetails       []VcpuDetail           `json:"vcpu_details,omitempty"`
 	NetworkInterfaces []NetworkInterface     `json:"network_interfaces,omitempty"`
@@ -694,8 +695,9 @@ type StoragePoolInfo struct {
 	AllocationBytes uint64 `json:"allocation_bytes"`
 	AvailableBytes  uint64 `json:"available_bytes"`
 	// New: path on the host (for dir/backing stores) and pool type (dir, logical, netfs, rbd, etc)
-	Path string `json:"path"`
-	Type string `json:"type"`
+	Path      string `json:"path"`
+	Type      string `json:"type"`
+	Autostart bool   `json:"autostart"`
 }
 
 // DomainDiskStats holds I/O statistics for a single disk device.
@@ -782,8 +784,9 @@ type DiskInfo struct {
 	Type   string `xml:"type,attr" json:"type"`
 	Device string `xml:"device,attr" json:"device"`
 	Driver struct {
-		Name string `xml:"name,attr" json:"driver_name"`
-		Type string `xml:"type,attr" json:"type"`
+		Name  string `xml:"name,attr" json:"driver_name"`
+		Type  string `xml:"type,attr" json:"type"`
+		Cache string `xml:"cache,attr" json:"cache,omitempty"`
 	} `xml:"driver" json:"driver"`
 	Source struct {
 		File string `xml:"file,attr" json:"file"`
@@ -801,6 +804,7 @@ type DiskInfo struct {
 		Dev string `xml:"dev,attr" json:"dev"`
 		Bus string `xml:"bus,attr" json:"bus"`
 	} `xml:"target" json:"target"`
+	IOTune *DiskIOTune `xml:"iotune" json:"iotune,omitempty"`
 }
 
 // NetworkInfo represents a virtual network interface.
@@ -813,6 +817,9 @@ type NetworkInfo struct {
 		Bridge    string `xml:"bridge,attr" json:"bridge"`
 		Network   string `xml:"network,attr" json:"network"`
 		PortGroup string `xml:"portgroup,attr" json:"portgroup"`
+		// Dev and Mode describe a direct (macvtap) attachment.
+		Dev  string `xml:"dev,attr" json:"dev,omitempty"`
+		Mode string `xml:"mode,attr" json:"mode,omitempty"`
 	} `xml:"source" json:"source"`
 	Model struct {
 		Type string `xml:"type,attr" json:"type"`
@@ -820,6 +827,17 @@ type NetworkInfo struct {
 	Target struct {
 		Dev string `xml:"dev,attr" json:"dev"`
 	} `xml:"target" json:"target"`
+	Link struct {
+		State string `xml:"state,attr" json:"state,omitempty"`
+	} `xml:"link" json:"link"`
+	VLAN struct {
+		Tags []struct {
+			ID uint `xml:"id,attr" json:"id"`
+		} `xml:"tag" json:"tags,omitempty"`
+	} `xml:"vlan" json:"vlan"`
+	FilterRef struct {
+		Filter string `xml:"filter,attr" json:"filter,omitempty"`
+	} `xml:"filterref" json:"filterref"`
 }
 
 // DomainHardwareXML is used for unmarshalling hardware info from the domain XML.
@@ -832,8 +850,13 @@ type DomainHardwareXML struct {
 		Content string `xml:",innerxml" json:"content"`
 	} `xml:"metadata" json:"metadata"`
 	OS struct {
-		Type   string `xml:"type" json:"type"`
-		Loader struct {
+		Type struct {
+			Value   string `xml:",chardata" json:"value"`
+			Arch    string `xml:"arch,attr" json:"arch"`
+			Machine string `xml:"machine,attr" json:"machine"`
+		} `xml:"type" json:"type"`
+		Firmware string `xml:"firmware,attr" json:"firmware"`
+		Loader   struct {
 			Path      string `xml:",chardata" json:"path"`
 			Type      string `xml:"type,attr" json:"type"`
 			Readonly  string `xml:"readonly,attr" json:"readonly"`
@@ -852,13 +875,11 @@ type DomainHardwareXML struct {
 		SmBIOS struct {
 			Mode string `xml:"mode,attr" json:"mode"`
 		} `xml:"smbios" json:"smbios"`
-		Firmware struct {
-			Value string `xml:",chardata" json:"value"`
-		} `xml:"firmware" json:"firmware"`
 		BIOS struct {
 			UsesSerial    string `xml:"useserial,attr" json:"useserial"`
 			RebootTimeout string `xml:"rebootTimeout,attr" json:"rebootTimeout"`
 		} `xml:"bios" json:"bios"`
+		Boot []BootEntry `xml:"boot" json:"boot"`
 	} `xml:"os" json:"os"`
 	Memory struct {
 		Value uint64 `xml:",chardata" json:"value"`
@@ -883,6 +904,9 @@ type DomainHardwareXML struct {
 			Name   string `xml:"name,attr" json:"name"`
 			Policy string `xml:"policy,attr" json:"policy"`
 		} `xml:"feature" json:"features"`
+		NUMA struct {
+			Cell []NUMANodeInfo `xml:"cell" json:"cell"`
+		} `xml:"numa" json:"numa"`
 	} `xml:"cpu" json:"cpu"`
 	MemoryBacking struct {
 		Hugepages struct {
@@ -892,8 +916,8 @@ type DomainHardwareXML struct {
 				Nodeset string `xml:"nodeset,attr" json:"nodeset"`
 			} `xml:"page" json:"page"`
 		} `xml:"hugepages" json:"hugepages"`
-		Nosharepages struct{} `xml:"nosharepages" json:"nosharepages"`
-		Locked       struct{} `xml:"locked" json:"locked"`
+		Nosharepages *struct{} `xml:"nosharepages" json:"nosharepages"`
+		Locked       *struct{} `xml:"locked" json:"locked"`
 		Source       struct {
 			Type string `xml:"type,attr" json:"type"`
 		} `xml:"source" json:"source"`
@@ -901,15 +925,12 @@ type DomainHardwareXML struct {
 			Mode string `xml:"mode,attr" json:"mode"`
 		} `xml:"access" json:"access"`
 	} `xml:"memoryBacking" json:"memoryBacking"`
-	NUMA struct {
-		Cell []NUMANodeInfo `xml:"cell" json:"cell"`
-	} `xml:"numa" json:"numa"`
 	Features struct {
-		PAE     struct{} `xml:"pae" json:"pae"`
-		ACPI    struct{} `xml:"acpi" json:"acpi"`
-		APIC    struct{} `xml:"apic" json:"apic"`
-		HAP     struct{} `xml:"hap" json:"hap"`
-		Privnet struct{} `xml:"privnet" json:"privnet"`
+		PAE     *struct{} `xml:"pae" json:"pae"`
+		ACPI    *struct{} `xml:"acpi" json:"acpi"`
+		APIC    *struct{} `xml:"apic" json:"apic"`
+		HAP     *struct{} `xml:"hap" json:"hap"`
+		Privnet *struct{} `xml:"privnet" json:"privnet"`
 		HyperV  struct {
 			Mode    string `xml:"mode,attr" json:"mode"`
 			Relaxed struct {
@@ -935,10 +956,10 @@ type DomainHardwareXML struct {
 			State string `xml:"state,attr" json:"state"`
 		} `xml:"pvspinlock" json:"pvspinlock"`
 	} `xml:"features" json:"features"`
-	OnPoweroff    string `xml:"on_poweroff,attr" json:"on_poweroff"`
-	OnReboot      string `xml:"on_reboot,attr" json:"on_reboot"`
-	OnCrash       string `xml:"on_crash,attr" json:"on_crash"`
-	OnLockfailure string `xml:"on_lockfailure,attr" json:"on_lockfailure"`
+	OnPoweroff    string `xml:"on_poweroff" json:"on_poweroff"`
+	OnReboot      string `xml:"on_reboot" json:"on_reboot"`
+	OnCrash       string `xml:"on_crash" json:"on_crash"`
+	OnLockfailure string `xml:"on_lockfailure" json:"on_lockfailure"`
 	Clock         struct {
 		Offset     string `xml:"offset,attr" json:"offset"`
 		Timezone   string `xml:"timezone,attr" json:"timezone"`
@@ -951,18 +972,30 @@ type DomainHardwareXML struct {
 			State string `xml:"enabled,attr" json:"state"`
 		} `xml:"event" json:"event"`
 	} `xml:"perf" json:"perf"`
+	SecLabels []struct {
+		Type    string `xml:"type,attr" json:"type"`
+		Model   string `xml:"model,attr" json:"model"`
+		Relabel string `xml:"relabel,attr" json:"relabel"`
+		Label   string `xml:"label" json:"label"`
+	} `xml:"seclabel" json:"seclabel"`
+	LaunchSecurity *struct {
+		Type            string `xml:"type,attr" json:"type"`
+		CBitPos         string `xml:"cbitpos" json:"cbitpos"`
+		ReducedPhysBits string `xml:"reducedPhysBits" json:"reducedPhysBits"`
+		Policy          string `xml:"policy" json:"policy"`
+		DHCert          string `xml:"dhCert" json:"dhCert"`
+		Session         string `xml:"session" json:"session"`
+	} `xml:"launchSecurity" json:"launchSecurity"`
 	Devices struct {
-		Disks      []DiskInfo     `xml:"disk"`
-		Interfaces []NetworkInfo  `xml:"interface"`
-		Videos     []VideoInfo    `xml:"video"`
-		Consoles   []ConsoleInfo  `xml:"console"`
-		Hostdevs   []HostdevInfo  `xml:"hostdev"`
-		BlockDevs  []BlockDev     `xml:"blockdev"`
-		IOThreads  []IOThread     `xml:"iothread"`
-		Mdevs      []MdevInfo     `xml:"mdev"`
-		NUMANodes  []NUMANodeInfo `xml:"numa>cell"`
-		Boot       []BootEntry    `xml:"boot"`
-		CPU        *CPUInfo       `xml:"cpu"`
+		Disks      []DiskInfo    `xml:"disk"`
+		Interfaces []NetworkInfo `xml:"interface"`
+		Videos     []VideoInfo   `xml:"video"`
+		Consoles   []ConsoleInfo `xml:"console"`
+		Hostdevs   []HostdevInfo `xml:"hostdev"`
+		BlockDevs  []BlockDev    `xml:"blockdev"`
+		IOThreads  []IOThread    `xml:"iothread"`
+		Mdevs      []MdevInfo    `xml:"mdev"`
+		CPU        *CPUInfo      `xml:"cpu"`
 	} `xml:"devices"`
 }
 
@@ -1017,11 +1050,14 @@ type MdevInfo struct {
 	UUID string `xml:"uuid,attr,omitempty" json:"uuid,omitempty"`
 }
 
-// NUMANodeInfo represents a <numa><cell>...</cell></numa> cell entry.
+// NUMANodeInfo represents a <cpu><numa><cell .../></numa></cpu> cell entry.
 type NUMANodeInfo struct {
 	ID       int    `xml:"id,attr" json:"id"`
 	MemoryKB uint64 `xml:"memory,attr" json:"memory_kb"`
-	CPUs     string `xml:"cpus" json:"cpus"`
+	// MemoryUnit is the unit of memory in the XML; hardwareFromXML
+	// converts MemoryKB to KiB.
+	MemoryUnit string `xml:"unit,attr" json:"-"`
+	CPUs       string `xml:"cpus,attr" json:"cpus"`
 }
 
 // BootEntry represents <boot dev="..."/> entries.
@@ -1037,17 +1073,23 @@ type CPUInfo struct {
 
 // OSConfigInfo represents OS configuration information.
 type OSConfigInfo struct {
-	Type      string        `json:"type"`
-	Arch      string        `json:"arch,omitempty"`
-	Machine   string        `json:"machine,omitempty"`
-	BootMenu  *BootMenuInfo `json:"boot_menu,omitempty"`
-	BootDev   []string      `json:"boot_dev,omitempty"`
-	Init      string        `json:"init,omitempty"`
-	InitArgs  []string      `json:"init_args,omitempty"`
-	InitEnv   []InitEnvInfo `json:"init_env,omitempty"`
-	InitDir   string        `json:"init_dir,omitempty"`
-	InitUser  string        `json:"init_user,omitempty"`
-	InitGroup string        `json:"init_group,omitempty"`
+	Type     string `json:"type"`
+	Arch     string `json:"arch,omitempty"`
+	Machine  string `json:"machine,omitempty"`
+	Firmware string `json:"firmware,omitempty"`
+	// Loader also carries the NVRAM path and template.
+	Loader            *OSLoaderConfig `json:"loader,omitempty"`
+	SMBIOSMode        string          `json:"smbios_mode,omitempty"`
+	BIOSUseSerial     bool            `json:"bios_use_serial,omitempty"`
+	BIOSRebootTimeout string          `json:"bios_reboot_timeout,omitempty"`
+	BootMenu          *BootMenuInfo   `json:"boot_menu,omitempty"`
+	BootDev           []string        `json:"boot_dev,omitempty"`
+	Init              string          `json:"init,omitempty"`
+	InitArgs          []string        `json:"init_args,omitempty"`
+	InitEnv           []InitEnvInfo   `json:"init_env,omitempty"`
+	InitDir           string          `json:"init_dir,omitempty"`
+	InitUser          string          `json:"init_user,omitempty"`
+	InitGroup         string          `json:"init_group,omitempty"`
 }
 
 // BootMenuInfo represents boot menu configuration.
@@ -1118,6 +1160,7 @@ type HugePageInfo struct {
 // SecurityLabelInfo represents security label configuration.
 type SecurityLabelInfo struct {
 	Type    string `json:"type"`
+	Model   string `json:"model,omitempty"`
 	Label   string `json:"label,omitempty"`
 	Relabel string `json:"relabel,omitempty"`
 }
@@ -1203,6 +1246,12 @@ type Connector struct {
 		uptime int64
 		at     time.Time
 	}
+	// lost holds a channel per host that is closed when the connection drops
+	// without RemoveHost having been called.
+	lost map[string]chan struct{}
+	// learnedHostKeys holds the updated pinned SSH host keys for hosts whose
+	// last connect trusted a key for the first time.
+	learnedHostKeys map[string]string
 }
 
 // NewConnector creates a new libvirt connection manager.
@@ -1216,6 +1265,8 @@ func NewConnector() *Connector {
 			uptime int64
 			at     time.Time
 		}),
+		lost:            make(map[string]chan struct{}),
+		learnedHostKeys: make(map[string]string),
 	}
 }
 
@@ -1336,98 +1387,19 @@ func nodeMemoryStatsToTypedParams(stats []libvirt.NodeGetMemoryStats) []libvirt.
 	return out
 }
 
-// sshKeyAuth provides an AuthMethod for key-based SSH authentication
-// by reading the user's default private key.
-func sshKeyAuth() (ssh.AuthMethod, error) {
-	home, err := os.UserHomeDir()
-	if err != nil {
-		return nil, fmt.Errorf("could not get user home directory: %w", err)
-	}
-
-	keyPath := filepath.Join(home, ".ssh", "id_rsa")
-	key, err := os.ReadFile(keyPath)
-	if err != nil {
-		return nil, fmt.Errorf("unable to read private key from %s: %w. Ensure SSH key-based auth is set up", keyPath, err)
-	}
-
-	signer, err := ssh.ParsePrivateKey(key)
-	if err != nil {
-		return nil, fmt.Errorf("unable to parse private key: %w", err)
-	}
-
-	return ssh.PublicKeys(signer), nil
-}
-
-// sshTunneledConn wraps a net.Conn to ensure the underlying SSH client is also closed.
-type sshTunneledConn struct {
-	net.Conn
-	client *ssh.Client
-}
-
-func (c *sshTunneledConn) Close() error {
-	connErr := c.Conn.Close()
-	clientErr := c.client.Close()
-	if connErr != nil {
-		return connErr
-	}
-	return clientErr
-}
-
-// dialLibvirt establishes a network connection based on the URI.
-func dialLibvirt(uri string) (net.Conn, error) {
-	parsedURI, err := url.Parse(uri)
+// dialLibvirt establishes a network connection based on the host's URI.
+func dialLibvirt(host storage.Host) (net.Conn, error) {
+	parsedURI, err := url.Parse(host.URI)
 	if err != nil {
 		return nil, fmt.Errorf("invalid URI: %w", err)
 	}
 
 	switch parsedURI.Scheme {
 	case "qemu+ssh":
-		user := "root" // default user
-		if parsedURI.User != nil {
-			user = parsedURI.User.Username()
-		}
-
-		host := parsedURI.Hostname()
-		port := parsedURI.Port()
-		if port == "" {
-			port = "22" // default ssh port
-		}
-		sshAddr := fmt.Sprintf("%s:%s", host, port)
-
-		authMethod, err := sshKeyAuth()
-		if err != nil {
-			return nil, fmt.Errorf("SSH key authentication setup failed: %w", err)
-		}
-
-		sshConfig := &ssh.ClientConfig{
-			User: user,
-			Auth: []ssh.AuthMethod{
-				authMethod,
-			},
-			// Insecure: fine for this tool where hosts are explicitly added.
-			// Production systems might use a known_hosts file.
-			HostKeyCallback: ssh.InsecureIgnoreHostKey(),
-		}
+		return dialSSH(host, parsedURI)
 
-		log.Debugf("dialLibvirt: attempting SSH connection to %s for user %s", sshAddr, user)
-		sshClient, err := sshDialWithTimeout("tcp", sshAddr, sshConfig, defaultDialTimeout)
-		if err != nil {
-			log.Debugf("dialLibvirt: ssh dial to %s failed: %v", sshAddr, err)
-			return nil, fmt.Errorf("failed to dial SSH to %s: %w", sshAddr, err)
-		}
-
-		// Dial the libvirt socket on the remote machine through the SSH tunnel.
-		remoteSocketPath := "/var/run/libvirt/libvirt-sock"
-		log.Verbosef("SSH connected to %s. Dialing remote libvirt socket at %s", sshAddr, remoteSocketPath)
-		conn, err := sshClient.Dial("unix", remoteSocketPath)
-		if err != nil {
-			sshClient.Close()
-			return nil, fmt.Errorf("failed to dial remote libvirt socket (%s) via SSH: %w", remoteSocketPath, err)
-		}
-		return &sshTunneledConn{
-			Conn:   conn,
-			client: sshClient,
-		}, nil
+	case "qemu+tls":
+		return dialTLS(host, parsedURI)
 
 	case "qemu+tcp":
 		address := parsedURI.Host
@@ -1437,13 +1409,18 @@ func dialLibvirt(uri string) (net.Conn, error) {
 		return net.DialTimeout("tcp", address, defaultDialTimeout)
 
 	case "qemu", "qemu+unix":
-		address := parsedURI.Path
-		if address == "" || address == "/system" {
-			address = "/var/run/libvirt/libvirt-sock"
-		}
 		// For unix sockets, use a short timeout by dialing via a net.Dialer with deadline.
 		d := net.Dialer{Timeout: defaultDialTimeout}
-		return d.Dial("unix", address)
+		if isLegacySocketPath(parsedURI) {
+			return d.Dial("unix", parsedURI.Path)
+		}
+		sockets, err := daemonSockets(parsedURI, localRuntimeDir())
+		if err != nil {
+			return nil, err
+		}
+		return dialDaemonSocket(sockets, func(path string) (net.Conn, error) {
+			return d.Dial("unix", path)
+		})
 
 	default:
 		return nil, fmt.Errorf("unsupported scheme: %s", parsedURI.Scheme)
@@ -1459,16 +1436,19 @@ func (c *Connector) AddHost(host storage.Host) error {
 		return fmt.Errorf("host '%s' is already connected", host.ID)
 	}
 
-	conn, err := dialLibvirt(host.URI)
+	conn, err := dialLibvirt(host)
 	if err != nil {
 		return fmt.Errorf("failed to dial libvirt for host '%s': %w", host.ID, err)
 	}
 
-	// If this connection wraps an SSH client, capture it for reuse.
+	// If this connection wraps an SSH client, capture it for reuse along
+	// with any host keys trusted for the first time while dialling.
+	var learnedHostKeys string
 	if stc, ok := conn.(*sshTunneledConn); ok {
 		if stc.client != nil {
 			c.sshClients[host.ID] = stc.client
 		}
+		learnedHostKeys = stc.learnedHostKeys
 	}
 
 	l := libvirt.New(conn)
@@ -1478,6 +1458,12 @@ func (c *Connector) AddHost(host storage.Host) error {
 	}
 
 	c.connections[host.ID] = l
+	if learnedHostKeys != "" {
+		c.learnedHostKeys[host.ID] = learnedHostKeys
+	}
+	lost := make(chan struct{})
+	c.lost[host.ID] = lost
+	go c.watchConnection(host.ID, l, conn, lost)
 	log.Verbosef("Successfully connected to host: %s", host.ID)
 	return nil
 }
@@ -1496,6 +1482,13 @@ func (c *Connector) RemoveHost(hostID string) error {
 		return fmt.Errorf("failed to close connection to host '%s': %w", hostID, err)
 	}
 
+	c.forgetHostLocked(hostID)
+	log.Verbosef("Disconnected from host: %s", hostID)
+	return nil
+}
+
+// forgetHostLocked drops all per-host connection state. Callers must hold c.mu.
+func (c *Connector) forgetHostLocked(hostID string) {
 	delete(c.connections, hostID)
 	// Close and remove any stored ssh client for this host.
 	if client, ok := c.sshClients[hostID]; ok {
@@ -1504,8 +1497,8 @@ func (c *Connector) RemoveHost(hostID string) error {
 	}
 	// Remove uptime cache entry as well.
 	delete(c.uptimeCache, hostID)
-	log.Verbosef("Disconnected from host: %s", hostID)
-	return nil
+	delete(c.lost, hostID)
+	delete(c.learnedHostKeys, hostID)
 }
 
 // getHostUptime returns host uptime in seconds, using a cached value when recent.
@@ -1568,6 +1561,14 @@ func (c *Connector) getHostUptime(hostID string, ttl time.Duration, timeout time
 	}
 }
 
+// IsConnected reports whether an active connection exists for the host.
+func (c *Connector) IsConnected(hostID string) bool {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	_, ok := c.connections[hostID]
+	return ok
+}
+
 // GetConnection returns the active connection for a given host ID.
 func (c *Connector) GetConnection(hostID string) (*libvirt.Libvirt, error) {
 	c.mu.RLock()
@@ -1873,6 +1874,10 @@ func (c *Connector) domainToVMInfo(l *libvirt.Libvirt, domain libvirt.Domain) (*
 	if err != nil {
 		autostart = 0
 	}
+	managedSave, err := l.DomainHasManagedSaveImage(domain, 0)
+	if err != nil {
+		managedSave = 0
+	}
 	xmlDesc, err := l.DomainGetXMLDesc(domain, 0)
 	if err != nil {
 		return nil, err
@@ -1907,6 +1912,8 @@ func (c *Connector) domainToVMInfo(l *libvirt.Libvirt, domain libvirt.Domain) (*
 		Persistent: persistent == 1,
 		Autostart:  autostart == 1,
 		Graphics:   graphics,
+		// A saved domain is shut off; starting it restores the image.
+		HasManagedSave: managedSave == 1,
 	}
 
 	// Enhance with additional API-based data
@@ -1989,6 +1996,9 @@ func (c *Connector) storagePoolToInfo(l *libvirt.Libvirt, pool libvirt.StoragePo
 		Path:            "",
 		Type:            "unknown",
 	}
+	if autostart, err := l.StoragePoolGetAutostart(pool); err == nil {
+		info.Autostart = autostart != 0
+	}
 
 	// Try to get pool XML desc to extract pool type and target path when available
 	if poolXML, err := l.StoragePoolGetXMLDesc(pool, 0); err == nil {
@@ -2127,6 +2137,11 @@ func (c *Connector) GetDomainHardware(hostID, vmName string) (*HardwareInfo, err
 		return nil, fmt.Errorf("failed to get XML for %s to read hardware: %w", vmName, err)
 	}
 
+	return hardwareFromXML(xmlDesc)
+}
+
+// hardwareFromXML parses a domain XML document into a HardwareInfo.
+func hardwareFromXML(xmlDesc string) (*HardwareInfo, error) {
 	var def DomainHardwareXML
 	if err := xml.Unmarshal([]byte(xmlDesc), &def); err != nil {
 		return nil, fmt.Errorf("failed to parse domain XML for hardware: %w", err)
@@ -2138,7 +2153,7 @@ func (c *Connector) GetDomainHardware(hostID, vmName string) (*HardwareInfo, err
 		Title:         def.Title,
 		Description:   def.Description,
 		Metadata:      def.Metadata.Content,
-		OSType:        def.OS.Type,
+		OSType:        def.OS.Type.Value,
 		CurrentMemory: def.CurrentMemory.Value,
 		Disks:         def.Devices.Disks,
 		Networks:      def.Devices.Interfaces,
@@ -2148,8 +2163,8 @@ func (c *Connector) GetDomainHardware(hostID, vmName string) (*HardwareInfo, err
 		BlockDevs:     def.Devices.BlockDevs,
 		IOThreads:     def.Devices.IOThreads,
 		Mdevs:         def.Devices.Mdevs,
-		NUMANodes:     def.Devices.NUMANodes,
-		Boot:          def.Devices.Boot,
+		NUMANodes:     def.CPU.NUMA.Cell,
+		Boot:          def.OS.Boot,
 	}
 
 	// Post-process disks to populate the unified 'Path' field.
@@ -2161,17 +2176,55 @@ func (c *Connector) GetDomainHardware(hostID, vmName string) (*HardwareInfo, err
 		}
 	}
 
+	// <readonly/> and <shareable/> are empty elements, which encoding/xml
+	// decodes into a bool as false, so check for their presence instead.
+	var diskFlags struct {
+		Disks []struct {
+			ReadOnly  *struct{} `xml:"readonly"`
+			Shareable *struct{} `xml:"shareable"`
+		} `xml:"devices>disk"`
+	}
+	if err := xml.Unmarshal([]byte(xmlDesc), &diskFlags); err == nil && len(diskFlags.Disks) == len(hardware.Disks) {
+		for i, flags := range diskFlags.Disks {
+			hardware.Disks[i].ReadOnly = flags.ReadOnly != nil
+			hardware.Disks[i].Shareable = flags.Shareable != nil
+		}
+	}
+
 	// Normalize NUMA CPU lists (if present) by trimming whitespace.
 	for i := range hardware.NUMANodes {
 		hardware.NUMANodes[i].CPUs = strings.TrimSpace(hardware.NUMANodes[i].CPUs)
+		hardware.NUMANodes[i].MemoryKB = toKiB(hardware.NUMANodes[i].MemoryKB, hardware.NUMANodes[i].MemoryUnit)
+		hardware.NUMANodes[i].MemoryUnit = ""
+	}
+
+	// <boot> entries are ordered by position unless they say otherwise.
+	for i := range hardware.Boot {
+		if hardware.Boot[i].Order == 0 {
+			hardware.Boot[i].Order = i + 1
+		}
 	}
 
 	// Populate OS Configuration
-	if def.OS.Type != "" {
+	if def.OS.Type.Value != "" {
 		hardware.OSConfig = &OSConfigInfo{
-			Type:    def.OS.Type,
-			Arch:    def.OS.Loader.Type, // This might need adjustment based on actual XML structure
-			Machine: def.OS.Firmware.Value,
+			Type:              def.OS.Type.Value,
+			Arch:              def.OS.Type.Arch,
+			Machine:           def.OS.Type.Machine,
+			Firmware:          def.OS.Firmware,
+			SMBIOSMode:        def.OS.SmBIOS.Mode,
+			BIOSUseSerial:     def.OS.BIOS.UsesSerial == "yes",
+			BIOSRebootTimeout: def.OS.BIOS.RebootTimeout,
+		}
+		if def.OS.Loader.Path != "" || def.OS.Loader.Type != "" || def.OS.NVram.Path != "" || def.OS.NVram.Template != "" {
+			hardware.OSConfig.Loader = &OSLoaderConfig{
+				Type:          def.OS.Loader.Type,
+				ReadOnly:      def.OS.Loader.Readonly == "yes",
+				Secure:        def.OS.Loader.Secure == "yes",
+				Path:          strings.TrimSpace(def.OS.Loader.Path),
+				NVRAM:         strings.TrimSpace(def.OS.NVram.Path),
+				NVRAMTemplate: def.OS.NVram.Template,
+			}
 		}
 		if def.OS.Bootmenu.Enable != "" {
 			hardware.OSConfig.BootMenu = &BootMenuInfo{
@@ -2210,7 +2263,8 @@ func (c *Connector) GetDomainHardware(hostID, vmName string) (*HardwareInfo, err
 	}
 
 	// Populate Memory Backing
-	if def.MemoryBacking.Source.Type != "" || len(def.MemoryBacking.Hugepages.Page) > 0 {
+	if def.MemoryBacking.Source.Type != "" || def.MemoryBacking.Access.Mode != "" || len(def.MemoryBacking.Hugepages.Page) > 0 ||
+		def.MemoryBacking.Nosharepages != nil || def.MemoryBacking.Locked != nil {
 		hardware.MemoryBacking = &MemoryBackingInfo{
 			Source: def.MemoryBacking.Source.Type,
 			Access: def.MemoryBacking.Access.Mode,
@@ -2225,25 +2279,26 @@ func (c *Connector) GetDomainHardware(hostID, vmName string) (*HardwareInfo, err
 				})
 			}
 		}
-		// Set boolean flags
-		hardware.MemoryBacking.NoSharePages = def.MemoryBacking.Nosharepages != struct{}{}
-		hardware.MemoryBacking.Locked = def.MemoryBacking.Locked != struct{}{}
+		// <nosharepages/> and <locked/> are empty elements, so their
+		// presence is the flag.
+		hardware.MemoryBacking.NoSharePages = def.MemoryBacking.Nosharepages != nil
+		hardware.MemoryBacking.Locked = def.MemoryBacking.Locked != nil
 	}
 
 	// Populate Hypervisor Features
-	if def.Features.PAE != (struct{}{}) {
+	if def.Features.PAE != nil {
 		hardware.HypervisorFeatures = append(hardware.HypervisorFeatures, HypervisorFeatureInfo{Name: "pae", State: "on"})
 	}
-	if def.Features.ACPI != (struct{}{}) {
+	if def.Features.ACPI != nil {
 		hardware.HypervisorFeatures = append(hardware.HypervisorFeatures, HypervisorFeatureInfo{Name: "acpi", State: "on"})
 	}
-	if def.Features.APIC != (struct{}{}) {
+	if def.Features.APIC != nil {
 		hardware.HypervisorFeatures = append(hardware.HypervisorFeatures, HypervisorFeatureInfo{Name: "apic", State: "on"})
 	}
-	if def.Features.HAP != (struct{}{}) {
+	if def.Features.HAP != nil {
 		hardware.HypervisorFeatures = append(hardware.HypervisorFeatures, HypervisorFeatureInfo{Name: "hap", State: "on"})
 	}
-	if def.Features.Privnet != (struct{}{}) {
+	if def.Features.Privnet != nil {
 		hardware.HypervisorFeatures = append(hardware.HypervisorFeatures, HypervisorFeatureInfo{Name: "privnet", State: "on"})
 	}
 	if def.Features.PVSpinlock.State != "" {
@@ -2291,6 +2346,25 @@ func (c *Connector) GetDomainHardware(hostID, vmName string) (*HardwareInfo, err
 		})
 	}
 
+	for _, label := range def.SecLabels {
+		hardware.SecurityLabels = append(hardware.SecurityLabels, SecurityLabelInfo{
+			Type:    label.Type,
+			Model:   label.Model,
+			Label:   label.Label,
+			Relabel: label.Relabel,
+		})
+	}
+	if ls := def.LaunchSecurity; ls != nil {
+		hardware.LaunchSecurity = &LaunchSecurityInfo{
+			Type:            ls.Type,
+			CBitPos:         strings.TrimSpace(ls.CBitPos),
+			ReducedPhysBits: strings.TrimSpace(ls.ReducedPhysBits),
+			Policy:          strings.TrimSpace(ls.Policy),
+			DHCert:          strings.TrimSpace(ls.DHCert),
+			Session:         strings.TrimSpace(ls.Session),
+		}
+	}
+
 	return hardware, nil
 }
 
@@ -2369,6 +2443,46 @@ func (c *Connector) ResetDomain(hostID, vmName string) error {
 	return l.DomainReset(domain, 0)
 }
 
+// SuspendDomain pauses a running domain's vCPUs, keeping its memory resident.
+func (c *Connector) SuspendDomain(hostID, vmName string) error {
+	l, domain, err := c.getDomainByName(hostID, vmName)
+	if err != nil {
+		return err
+	}
+	if err := l.DomainSuspend(domain); err != nil {
+		return fmt.Errorf("libvirt suspend failed for %s: %w", vmName, err)
+	}
+	log.Debugf("Suspended domain %s on host %s", vmName, hostID)
+	return nil
+}
+
+// ResumeDomain resumes a domain paused by SuspendDomain.
+func (c *Connector) ResumeDomain(hostID, vmName string) error {
+	l, domain, err := c.getDomainByName(hostID, vmName)
+	if err != nil {
+		return err
+	}
+	if err := l.DomainResume(domain); err != nil {
+		return fmt.Errorf("libvirt resume failed for %s: %w", vmName, err)
+	}
+	log.Debugf("Resumed domain %s on host %s", vmName, hostID)
+	return nil
+}
+
+// ManagedSaveDomain saves a running domain's memory to an image libvirt
+// manages and stops it. The next StartDomain restores from the image.
+func (c *Connector) ManagedSaveDomain(hostID, vmName string) error {
+	l, domain, err := c.getDomainByName(hostID, vmName)
+	if err != nil {
+		return err
+	}
+	if err := l.DomainManagedSave(domain, 0); err != nil {
+		return fmt.Errorf("libvirt managed save failed for %s: %w", vmName, err)
+	}
+	log.Debugf("Saved domain %s on host %s", vmName, hostID)
+	return nil
+}
+
 // DefineAndCreateDomain creates a new domain from XML definition
 func (c *Connector) DefineAndCreateDomain(hostID, domainXML string) (*libvirt.Domain, error) {
 	conn, err := c.GetConnection(hostID)
@@ -2402,61 +2516,21 @@ func (c *Connector) UndefineDomain(hostID, vmName string) error {
 	return nil
 }
 
-// GenerateBasicVMXML generates a basic VM XML configuration
-func (c *Connector) GenerateBasicVMXML(name, uuid string, vcpus uint, memoryKB uint64, diskPath, networkSource string) string {
-	// This is a basic template - in a real implementation, this would be much more sophisticated
-	// and would use proper XML generation libraries and templates
-	xmlTemplate := `<domain type='kvm'>
-  <name>%s</name>
-  <uuid>%s</uuid>
-  <memory unit='KiB'>%d</memory>
-  <currentMemory unit='KiB'>%d</currentMemory>
-  <vcpu placement='static'>%d</vcpu>
-  <os>
-    <type arch='x86_64' machine='pc-i440fx-2.9'>hvm</type>
-    <boot dev='hd'/>
-  </os>
-  <features>
-    <acpi/>
-    <apic/>
-    <pae/>
-  </features>
-  <clock offset='utc'/>
-  <on_poweroff>destroy</on_poweroff>
-  <on_reboot>restart</on_reboot>
-  <on_crash>restart</on_crash>
-  <devices>
-    <emulator>/usr/bin/qemu-system-x86_64</emulator>
-    <disk type='file' device='disk'>
-      <driver name='qemu' type='qcow2'/>
-      <source file='%s'/>
-      <target dev='vda' bus='virtio'/>
-    </disk>
-    <interface type='%s'>
-      <source %s='%s'/>
-      <model type='virtio'/>
-    </interface>
-    <console type='pty'>
-      <target type='serial' port='0'/>
-    </console>
-    <input type='tablet' bus='usb'/>
-    <input type='mouse' bus='ps2'/>
-    <input type='keyboard' bus='ps2'/>
-    <graphics type='vnc' port='-1' autoport='yes'/>
-    <video>
-      <model type='vga' vram='16384' heads='1'/>
-    </video>
-  </devices>
-</domain>`
-
-	// Determine network configuration
-	networkType := "network"
-	networkAttr := "network"
-	if networkSource == "" {
-		networkSource = "default"
-	}
-
-	return fmt.Sprintf(xmlTemplate, name, uuid, memoryKB, memoryKB, vcpus, diskPath, networkType, networkAttr, networkSource)
+// DeleteDomain undefines an inactive domain along with the state libvirt
+// keeps beside its definition: the managed save image, snapshot and
+// checkpoint metadata, and UEFI NVRAM. Disk volumes are left alone.
+func (c *Connector) DeleteDomain(hostID, vmName string) error {
+	l, domain, err := c.getDomainByName(hostID, vmName)
+	if err != nil {
+		return err
+	}
+	flags := libvirt.DomainUndefineManagedSave | libvirt.DomainUndefineSnapshotsMetadata |
+		libvirt.DomainUndefineCheckpointsMetadata | libvirt.DomainUndefineNvram
+	if err := l.DomainUndefineFlags(domain, flags); err != nil {
+		return fmt.Errorf("failed to undefine domain %s: %w", vmName, err)
+	}
+	log.Debugf("Deleted domain %s on host %s", vmName, hostID)
+	return nil
 }
 
 // CreateStorageVolume creates a new storage volume for VM disk
@@ -2526,6 +2600,98 @@ func (c *Connector) DeleteStorageVolume(hostID, poolName, volumeName string) err
 	return nil
 }
 
+// ListStorageVolumes describes the volumes in the named pool. The pool is
+// refreshed first so files copied into its directory behind libvirt's back
+// are listed too.
+func (c *Connector) ListStorageVolumes(hostID, poolName string) ([]VolumeDetail, error) {
+	conn, err := c.GetConnection(hostID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get libvirt connection: %w", err)
+	}
+
+	pool, err := conn.StoragePoolLookupByName(poolName)
+	if err != nil {
+		return nil, fmt.Errorf("failed to find storage pool %s: %w", poolName, err)
+	}
+	if err := conn.StoragePoolRefresh(pool, 0); err != nil {
+		log.Verbosef("Failed to refresh storage pool %s: %v", poolName, err)
+	}
+	vols, _, err := conn.StoragePoolListAllVolumes(pool, 1, 0)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list volumes of storage pool %s: %w", poolName, err)
+	}
+
+	details := make([]VolumeDetail, 0, len(vols))
+	for _, vol := range vols {
+		volType, capacity, allocation, err := conn.StorageVolGetInfo(vol)
+		if err != nil {
+			// The volume may have been deleted since the listing.
+			log.Verbosef("Skipping volume %s of pool %s: %v", vol.Name, poolName, err)
+			continue
+		}
+		detail := VolumeDetail{
+			Name:       vol.Name,
+			Type:       volType,
+			Capacity:   capacity,
+			Allocation: allocation,
+			Path:       vol.Key,
+			PoolName:   poolName,
+		}
+		if volPath, err := conn.StorageVolGetPath(vol); err == nil {
+			detail.Path = volPath
+		}
+		if desc, err := conn.StorageVolGetXMLDesc(vol, 0); err == nil {
+			var doc storageVolumeXML
+			if xml.Unmarshal([]byte(desc), &doc) == nil {
+				detail.Format = doc.Target.Format.Type
+				if doc.BackingStore != nil {
+					detail.BackingPath = doc.BackingStore.Path
+				}
+			}
+		}
+		details = append(details, detail)
+	}
+	return details, nil
+}
+
+// ResizeStorageVolume grows a volume that no running domain is using.
+func (c *Connector) ResizeStorageVolume(hostID, poolName, volumeName string, capacityBytes uint64) error {
+	conn, err := c.GetConnection(hostID)
+	if err != nil {
+		return fmt.Errorf("failed to get libvirt connection: %w", err)
+	}
+
+	pool, err := conn.StoragePoolLookupByName(poolName)
+	if err != nil {
+		return fmt.Errorf("failed to find storage pool %s: %w", poolName, err)
+	}
+	vol, err := conn.StorageVolLookupByName(pool, volumeName)
+	if err != nil {
+		return fmt.Errorf("failed to find storage volume %s in pool %s: %w", volumeName, poolName, err)
+	}
+	if err := conn.StorageVolResize(vol, capacityBytes, 0); err != nil {
+		return fmt.Errorf("failed to resize storage volume %s: %w", volumeName, err)
+	}
+
+	log.Debugf("Resized storage volume %s in pool %s to %d bytes", volumeName, poolName, capacityBytes)
+	return nil
+}
+
+// ResizeDomainDisk grows a disk of a running domain through QEMU, so the
+// guest sees the new size without a restart.
+func (c *Connector) ResizeDomainDisk(hostID, vmName, device string, capacityBytes uint64) error {
+	l, domain, err := c.getDomainByName(hostID, vmName)
+	if err != nil {
+		return err
+	}
+	if err := l.DomainBlockResize(domain, device, capacityBytes, libvirt.DomainBlockResizeBytes); err != nil {
+		return fmt.Errorf("failed to resize disk %s of domain %s: %w", device, vmName, err)
+	}
+
+	log.Debugf("Resized disk %s of domain %s to %d bytes", device, vmName, capacityBytes)
+	return nil
+}
+
 // GetDiskSize gets the actual size of a disk file from the host
 func (c *Connector) GetDiskSize(hostID, diskPath string) (uint64, error) {
 	conn, err := c.GetConnection(hostID)
@@ -4050,6 +4216,9 @@ type VolumeDetail struct {
 	Path        string
 	Format      string
 	BackingPath string
+	// Physical is the size of the volume's file on the host, which is what
+	// a download of the volume returns.
+	Physical uint64
 	// Pool linkage when available
 	PoolName string
 	PoolUUID string
@@ -0,0 +1,393 @@
+package libvirt
+
+import (
+	"encoding/xml"
+	"fmt"
+	"strings"
+
+	log "github.com/capsali/virtumancer/internal/logging"
+
+	"github.com/digitalocean/go-libvirt"
+)
+
+// DiskDevice describes a disk to hotplug or reconfigure.
+type DiskDevice struct {
+	// Device is "disk" when empty, or "cdrom". A CD-ROM without a Path is
+	// an empty drive.
+	Device    string
+	Path      string
+	Format    string
+	Bus       string
+	Target    string
+	Cache     string
+	ReadOnly  bool
+	Shareable bool
+	IOTune    *DiskIOTune
+}
+
+// DiskIOTune throttles a disk's I/O. Zero fields are unlimited. A total
+// limit cannot be combined with the read or write limit of the same kind.
+type DiskIOTune struct {
+	TotalBytesSec uint64 `xml:"total_bytes_sec,omitempty" json:"total_bytes_sec,omitempty"`
+	ReadBytesSec  uint64 `xml:"read_bytes_sec,omitempty" json:"read_bytes_sec,omitempty"`
+	WriteBytesSec uint64 `xml:"write_bytes_sec,omitempty" json:"write_bytes_sec,omitempty"`
+	TotalIOPSSec  uint64 `xml:"total_iops_sec,omitempty" json:"total_iops_sec,omitempty"`
+	ReadIOPSSec   uint64 `xml:"read_iops_sec,omitempty" json:"read_iops_sec,omitempty"`
+	WriteIOPSSec  uint64 `xml:"write_iops_sec,omitempty" json:"write_iops_sec,omitempty"`
+}
+
+// Validate checks the limits the way libvirt does.
+func (t DiskIOTune) Validate() error {
+	if t.TotalBytesSec > 0 && (t.ReadBytesSec > 0 || t.WriteBytesSec > 0) {
+		return fmt.Errorf("invalid disk: total_bytes_sec cannot be set with read_bytes_sec or write_bytes_sec")
+	}
+	if t.TotalIOPSSec > 0 && (t.ReadIOPSSec > 0 || t.WriteIOPSSec > 0) {
+		return fmt.Errorf("invalid disk: total_iops_sec cannot be set with read_iops_sec or write_iops_sec")
+	}
+	return nil
+}
+
+type diskSourceXML struct {
+	File string `xml:"file,attr,omitempty"`
+	Dev  string `xml:"dev,attr,omitempty"`
+}
+
+type diskDeviceXML struct {
+	XMLName xml.Name `xml:"disk"`
+	Type    string   `xml:"type,attr"`
+	Device  string   `xml:"device,attr"`
+	Driver  struct {
+		Name  string `xml:"name,attr"`
+		Type  string `xml:"type,attr,omitempty"`
+		Cache string `xml:"cache,attr,omitempty"`
+	} `xml:"driver"`
+	Source *diskSourceXML `xml:"source"`
+	Target struct {
+		Dev string `xml:"dev,attr"`
+		Bus string `xml:"bus,attr,omitempty"`
+	} `xml:"target"`
+	ReadOnly  *struct{}   `xml:"readonly"`
+	Shareable *struct{}   `xml:"shareable"`
+	IOTune    *DiskIOTune `xml:"iotune"`
+}
+
+// XML renders the disk as a <disk> device element.
+func (d DiskDevice) XML() (string, error) {
+	doc, err := d.element()
+	if err != nil {
+		return "", err
+	}
+	out, err := xml.Marshal(doc)
+	if err != nil {
+		return "", fmt.Errorf("failed to build disk XML: %w", err)
+	}
+	return string(out), nil
+}
+
+func (d DiskDevice) element() (diskDeviceXML, error) {
+	if d.Target == "" {
+		return diskDeviceXML{}, fmt.Errorf("invalid disk: target device is required")
+	}
+	doc := diskDeviceXML{Type: "file", Device: "disk"}
+	switch d.Device {
+	case "", "disk":
+	case "cdrom":
+		doc.Device = d.Device
+	default:
+		return diskDeviceXML{}, fmt.Errorf("invalid disk: unsupported device %q", d.Device)
+	}
+	doc.Driver.Name = "qemu"
+	doc.Driver.Type = d.Format
+	doc.Driver.Cache = d.Cache
+	if d.Path != "" {
+		doc.Source = &diskSourceXML{}
+		if strings.HasPrefix(d.Path, "/dev/") {
+			doc.Type = "block"
+			doc.Source.Dev = d.Path
+		} else {
+			doc.Source.File = d.Path
+		}
+	}
+	doc.Target.Dev = d.Target
+	doc.Target.Bus = d.Bus
+	if d.ReadOnly {
+		doc.ReadOnly = &struct{}{}
+	}
+	if d.Shareable {
+		doc.Shareable = &struct{}{}
+	}
+	if d.IOTune != nil && *d.IOTune != (DiskIOTune{}) {
+		if err := d.IOTune.Validate(); err != nil {
+			return diskDeviceXML{}, err
+		}
+		doc.IOTune = d.IOTune
+	}
+	return doc, nil
+}
+
+// DiskDeviceFromInfo describes an existing disk of a domain, for detaching
+// or reconfiguring it.
+func DiskDeviceFromInfo(disk DiskInfo) DiskDevice {
+	return DiskDevice{
+		Device:    disk.Device,
+		Path:      disk.Path,
+		Format:    disk.Driver.Type,
+		Bus:       disk.Target.Bus,
+		Target:    disk.Target.Dev,
+		Cache:     disk.Driver.Cache,
+		ReadOnly:  disk.ReadOnly,
+		Shareable: disk.Shareable,
+		IOTune:    disk.IOTune,
+	}
+}
+
+// InterfaceDevice describes a NIC to hotplug or reconfigure.
+type InterfaceDevice struct {
+	// Type is "network", "bridge" or "direct"; Source names the libvirt
+	// network, the host bridge or the host interface respectively.
+	Type      string
+	Source    string
+	PortGroup string
+	// Mode is the macvtap mode of a direct interface.
+	Mode      string
+	Model     string
+	MAC       string
+	LinkState string
+	VLANs     []uint
+	// FilterRef names the nwfilter applied to the NIC's traffic.
+	FilterRef string
+}
+
+type interfaceDeviceXML struct {
+	XMLName xml.Name `xml:"interface"`
+	Type    string   `xml:"type,attr"`
+	MAC     struct {
+		Address string `xml:"address,attr"`
+	} `xml:"mac"`
+	Source struct {
+		Network   string `xml:"network,attr,omitempty"`
+		Bridge    string `xml:"bridge,attr,omitempty"`
+		Dev       string `xml:"dev,attr,omitempty"`
+		Mode      string `xml:"mode,attr,omitempty"`
+		PortGroup string `xml:"portgroup,attr,omitempty"`
+	} `xml:"source"`
+	Model *struct {
+		Type string `xml:"type,attr"`
+	} `xml:"model,omitempty"`
+	Link *struct {
+		State string `xml:"state,attr"`
+	} `xml:"link,omitempty"`
+	VLAN *struct {
+		Trunk string `xml:"trunk,attr,omitempty"`
+		Tags  []struct {
+			ID uint `xml:"id,attr"`
+		} `xml:"tag"`
+	} `xml:"vlan,omitempty"`
+	FilterRef *struct {
+		Filter string `xml:"filter,attr"`
+	} `xml:"filterref,omitempty"`
+}
+
+// XML renders the NIC as an <interface> device element.
+func (n InterfaceDevice) XML() (string, error) {
+	doc, err := n.element()
+	if err != nil {
+		return "", err
+	}
+	out, err := xml.Marshal(doc)
+	if err != nil {
+		return "", fmt.Errorf("failed to build interface XML: %w", err)
+	}
+	return string(out), nil
+}
+
+func (n InterfaceDevice) element() (interfaceDeviceXML, error) {
+	if n.MAC == "" {
+		return interfaceDeviceXML{}, fmt.Errorf("invalid interface: MAC address is required")
+	}
+	doc := interfaceDeviceXML{Type: n.Type}
+	doc.MAC.Address = n.MAC
+	switch n.Type {
+	case "network":
+		doc.Source.Network = n.Source
+		doc.Source.PortGroup = n.PortGroup
+	case "bridge":
+		doc.Source.Bridge = n.Source
+	case "direct":
+		doc.Source.Dev = n.Source
+		doc.Source.Mode = n.Mode
+	default:
+		return interfaceDeviceXML{}, fmt.Errorf("invalid interface: unsupported type %q", n.Type)
+	}
+	if n.Source == "" {
+		return interfaceDeviceXML{}, fmt.Errorf("invalid interface: %s source is required", n.Type)
+	}
+	if n.Model != "" {
+		doc.Model = &struct {
+			Type string `xml:"type,attr"`
+		}{Type: n.Model}
+	}
+	if n.LinkState != "" {
+		doc.Link = &struct {
+			State string `xml:"state,attr"`
+		}{State: n.LinkState}
+	}
+	if len(n.VLANs) > 0 {
+		doc.VLAN = &struct {
+			Trunk string `xml:"trunk,attr,omitempty"`
+			Tags  []struct {
+				ID uint `xml:"id,attr"`
+			} `xml:"tag"`
+		}{}
+		if len(n.VLANs) > 1 {
+			doc.VLAN.Trunk = "yes"
+		}
+		for _, id := range n.VLANs {
+			doc.VLAN.Tags = append(doc.VLAN.Tags, struct {
+				ID uint `xml:"id,attr"`
+			}{ID: id})
+		}
+	}
+	if n.FilterRef != "" {
+		doc.FilterRef = &struct {
+			Filter string `xml:"filter,attr"`
+		}{Filter: n.FilterRef}
+	}
+	return doc, nil
+}
+
+// InterfaceDeviceFromInfo describes an existing NIC of a domain, for
+// detaching or reconfiguring it.
+func InterfaceDeviceFromInfo(nic NetworkInfo) InterfaceDevice {
+	dev := InterfaceDevice{
+		Type:      nic.Type,
+		PortGroup: nic.Source.PortGroup,
+		Mode:      nic.Source.Mode,
+		Model:     nic.Model.Type,
+		MAC:       nic.Mac.Address,
+		LinkState: nic.Link.State,
+		FilterRef: nic.FilterRef.Filter,
+	}
+	switch nic.Type {
+	case "network":
+		dev.Source = nic.Source.Network
+	case "bridge":
+		dev.Source = nic.Source.Bridge
+	case "direct":
+		dev.Source = nic.Source.Dev
+	}
+	for _, tag := range nic.VLAN.Tags {
+		dev.VLANs = append(dev.VLANs, tag.ID)
+	}
+	return dev
+}
+
+// diskTargetPrefixes are the device name prefixes guests see for each bus.
+var diskTargetPrefixes = map[string]string{
+	"virtio": "vd",
+	"scsi":   "sd",
+	"sata":   "sd",
+	"usb":    "sd",
+	"ide":    "hd",
+	"xen":    "xvd",
+}
+
+// NextDiskTarget returns the first free target device name for bus, such as
+// "vdb" when "vda" is taken. Names continue "vdz", "vdaa", "vdab" as libvirt's
+// own naming does.
+func NextDiskTarget(bus string, used []string) (string, error) {
+	prefix, ok := diskTargetPrefixes[bus]
+	if !ok {
+		return "", fmt.Errorf("invalid disk: unsupported bus %q", bus)
+	}
+	taken := make(map[string]bool, len(used))
+	for _, name := range used {
+		taken[name] = true
+	}
+	// Two letters give 702 names, far beyond any bus's device limit.
+	for i := 0; i < 26*27; i++ {
+		name := prefix + diskTargetSuffix(i)
+		if !taken[name] {
+			return name, nil
+		}
+	}
+	return "", fmt.Errorf("no free %s target device names", bus)
+}
+
+// diskTargetSuffix maps 0 to "a", 25 to "z", 26 to "aa" and so on.
+func diskTargetSuffix(i int) string {
+	suffix := ""
+	for i >= 0 {
+		suffix = string(rune('a'+i%26)) + suffix
+		i = i/26 - 1
+	}
+	return suffix
+}
+
+// deviceModifyFlags changes the persistent definition and, when the domain
+// is running, the live guest as well.
+func deviceModifyFlags(l *libvirt.Libvirt, domain libvirt.Domain) (libvirt.DomainDeviceModifyFlags, error) {
+	state, _, err := l.DomainGetState(domain, 0)
+	if err != nil {
+		return 0, fmt.Errorf("failed to get state of domain %s: %w", domain.Name, err)
+	}
+	flags := libvirt.DomainDeviceModifyConfig
+	switch libvirt.DomainState(state) {
+	case libvirt.DomainRunning, libvirt.DomainPaused, libvirt.DomainBlocked:
+		flags |= libvirt.DomainDeviceModifyLive
+	}
+	return flags, nil
+}
+
+// AttachDevice adds a device element to a domain.
+func (c *Connector) AttachDevice(hostID, vmName, deviceXML string) error {
+	l, domain, err := c.getDomainByName(hostID, vmName)
+	if err != nil {
+		return err
+	}
+	flags, err := deviceModifyFlags(l, domain)
+	if err != nil {
+		return err
+	}
+	log.Debugf("Attaching device to domain %s on host %s (flags %#x)", vmName, hostID, uint32(flags))
+	if err := l.DomainAttachDeviceFlags(domain, deviceXML, uint32(flags)); err != nil {
+		return fmt.Errorf("failed to attach device to domain %s: %w", vmName, err)
+	}
+	return nil
+}
+
+// DetachDevice removes the device matching deviceXML from a domain. For a
+// running domain the guest has to release the device, so a guest that
+// ignores the request keeps it until it is shut down.
+func (c *Connector) DetachDevice(hostID, vmName, deviceXML string) error {
+	l, domain, err := c.getDomainByName(hostID, vmName)
+	if err != nil {
+		return err
+	}
+	flags, err := deviceModifyFlags(l, domain)
+	if err != nil {
+		return err
+	}
+	log.Debugf("Detaching device from domain %s on host %s (flags %#x)", vmName, hostID, uint32(flags))
+	if err := l.DomainDetachDeviceFlags(domain, deviceXML, uint32(flags)); err != nil {
+		return fmt.Errorf("failed to detach device from domain %s: %w", vmName, err)
+	}
+	return nil
+}
+
+// UpdateDevice changes the settings of an existing device in place.
+func (c *Connector) UpdateDevice(hostID, vmName, deviceXML string) error {
+	l, domain, err := c.getDomainByName(hostID, vmName)
+	if err != nil {
+		return err
+	}
+	flags, err := deviceModifyFlags(l, domain)
+	if err != nil {
+		return err
+	}
+	log.Debugf("Updating device of domain %s on host %s (flags %#x)", vmName, hostID, uint32(flags))
+	if err := l.DomainUpdateDeviceFlags(domain, deviceXML, flags); err != nil {
+		return fmt.Errorf("failed to update device of domain %s: %w", vmName, err)
+	}
+	return nil
+}
@@ -0,0 +1,815 @@
+package libvirt
+
+import (
+	"encoding/xml"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// DomainSpec describes a complete KVM domain definition, from which XML
+// renders the <domain> document to define or redefine it with.
+type DomainSpec struct {
+	Name        string
+	UUID        string
+	Title       string
+	Description string
+	// Metadata is the inner XML of <metadata>.
+	Metadata string
+
+	// VCPUs is the number of vCPUs the domain boots with, and MaxVCPUs
+	// the number it can be hotplugged up to; zero means VCPUs.
+	VCPUs    uint
+	MaxVCPUs uint
+	// MemoryKB is the maximum memory; CurrentMemoryKB defaults to it.
+	MemoryKB        uint64
+	CurrentMemoryKB uint64
+
+	OS            DomainOS
+	CPU           DomainCPU
+	MemoryBacking *MemoryBackingInfo
+	NUMACells     []NUMANodeInfo
+	// Features are named as HardwareInfo reports them, such as "acpi" or
+	// "hyperv_relaxed".
+	Features       []HypervisorFeatureInfo
+	Lifecycle      LifecycleActionInfo
+	ClockOffset    string
+	PerfEvents     []PerfEventInfo
+	SecurityLabels []SecurityLabelInfo
+	LaunchSecurity *LaunchSecurityInfo
+	// FirmwareConfig passes host files to the guest through QEMU's
+	// firmware config device, as Ignition expects its config.
+	FirmwareConfig []FirmwareConfigEntry
+
+	Disks       []DiskDevice
+	Interfaces  []InterfaceDevice
+	Graphics    []DomainGraphics
+	Videos      []VideoDevice
+	Hostdevs    []HostdevInfo
+	Controllers []DomainController
+	Inputs      []InputDevice
+	Sounds      []SoundDevice
+	TPM         *DomainTPM
+	Watchdog    *DomainWatchdog
+	MemBalloon  *MemBalloonDevice
+}
+
+// DomainOS is the <os> element of a domain.
+type DomainOS struct {
+	// Arch and Machine default to what the host's emulator prefers.
+	Arch    string
+	Machine string
+	// Firmware is "bios" or "efi" to let libvirt pick a matching loader,
+	// or empty when Loader names one.
+	Firmware          string
+	Loader            *OSLoaderConfig
+	BootMenu          bool
+	BootMenuTimeout   uint
+	SMBIOSMode        string
+	BIOSUseSerial     bool
+	BIOSRebootTimeout string
+	// Boot lists boot devices ("hd", "cdrom", "network", "fd") in order.
+	Boot []string
+}
+
+// DomainCPU is the <cpu> element of a domain. Mode is "host-passthrough",
+// "host-model" or "maximum", or "custom" with a named Model.
+type DomainCPU struct {
+	Mode     string
+	Model    string
+	Sockets  uint
+	Cores    uint
+	Threads  uint
+	Features []CPUFeatureInfo
+}
+
+// DomainGraphics is a VNC or SPICE display. A zero Port lets libvirt
+// allocate one when the domain starts.
+type DomainGraphics struct {
+	Type   string
+	Listen string
+	Port   uint
+}
+
+// DomainController is a bus controller such as a USB or SCSI controller.
+type DomainController struct {
+	Type  string
+	Model string
+	Index uint
+}
+
+// FirmwareConfigEntry is a firmware config (fw_cfg) item named Name that
+// holds the contents of the host file File, read when the domain starts.
+type FirmwareConfigEntry struct {
+	Name string
+	File string
+}
+
+// DomainTPM is an emulated or passed-through TPM. Path is the host device
+// of a passthrough TPM.
+type DomainTPM struct {
+	Model   string
+	Backend string
+	Path    string
+}
+
+// DomainWatchdog is a watchdog device and what happens when it fires.
+type DomainWatchdog struct {
+	Model  string
+	Action string
+}
+
+type domainMemoryXML struct {
+	Unit  string `xml:"unit,attr"`
+	Value uint64 `xml:",chardata"`
+}
+
+type domainStateXML struct {
+	State string `xml:"state,attr"`
+}
+
+type domainHugePageXML struct {
+	Size    string `xml:"size,attr"`
+	Unit    string `xml:"unit,attr,omitempty"`
+	Nodeset string `xml:"nodeset,attr,omitempty"`
+}
+
+type domainMemoryBackingXML struct {
+	HugePages    *[]domainHugePageXML `xml:"hugepages>page"`
+	Nosharepages *struct{}            `xml:"nosharepages"`
+	Locked       *struct{}            `xml:"locked"`
+	Source       *struct {
+		Type string `xml:"type,attr"`
+	} `xml:"source"`
+	Access *struct {
+		Mode string `xml:"mode,attr"`
+	} `xml:"access"`
+}
+
+type domainLoaderXML struct {
+	ReadOnly string `xml:"readonly,attr,omitempty"`
+	Secure   string `xml:"secure,attr,omitempty"`
+	Type     string `xml:"type,attr,omitempty"`
+	Path     string `xml:",chardata"`
+}
+
+type domainNVRAMXML struct {
+	Template string `xml:"template,attr,omitempty"`
+	Path     string `xml:",chardata"`
+}
+
+type domainBootXML struct {
+	Dev string `xml:"dev,attr"`
+}
+
+type domainOSXML struct {
+	Firmware string `xml:"firmware,attr,omitempty"`
+	Type     struct {
+		Arch    string `xml:"arch,attr,omitempty"`
+		Machine string `xml:"machine,attr,omitempty"`
+		Value   string `xml:",chardata"`
+	} `xml:"type"`
+	Loader   *domainLoaderXML `xml:"loader"`
+	NVRAM    *domainNVRAMXML  `xml:"nvram"`
+	Boot     []domainBootXML  `xml:"boot"`
+	BootMenu *struct {
+		Enable  string `xml:"enable,attr"`
+		Timeout string `xml:"timeout,attr,omitempty"`
+	} `xml:"bootmenu"`
+	SMBIOS *struct {
+		Mode string `xml:"mode,attr"`
+	} `xml:"smbios"`
+	BIOS *struct {
+		UseSerial     string `xml:"useserial,attr,omitempty"`
+		RebootTimeout string `xml:"rebootTimeout,attr,omitempty"`
+	} `xml:"bios"`
+}
+
+type domainSpinlocksXML struct {
+	State   string `xml:"state,attr"`
+	Retries string `xml:"retries,attr,omitempty"`
+}
+
+type domainHyperVXML struct {
+	Relaxed   *domainStateXML     `xml:"relaxed"`
+	VAPIC     *domainStateXML     `xml:"vapic"`
+	Spinlocks *domainSpinlocksXML `xml:"spinlocks"`
+}
+
+type domainKVMXML struct {
+	Hidden        *domainStateXML `xml:"hidden"`
+	HintDedicated *domainStateXML `xml:"hint-dedicated"`
+}
+
+type domainFeaturesXML struct {
+	PAE        *struct{}        `xml:"pae"`
+	ACPI       *struct{}        `xml:"acpi"`
+	APIC       *struct{}        `xml:"apic"`
+	HAP        *struct{}        `xml:"hap"`
+	Privnet    *struct{}        `xml:"privnet"`
+	HyperV     *domainHyperVXML `xml:"hyperv"`
+	KVM        *domainKVMXML    `xml:"kvm"`
+	PVSpinlock *domainStateXML  `xml:"pvspinlock"`
+}
+
+type domainCPUModelXML struct {
+	Fallback string `xml:"fallback,attr,omitempty"`
+	Name     string `xml:",chardata"`
+}
+
+type domainTopologyXML struct {
+	Sockets uint `xml:"sockets,attr"`
+	Cores   uint `xml:"cores,attr"`
+	Threads uint `xml:"threads,attr"`
+}
+
+type domainCPUFeatureXML struct {
+	Policy string `xml:"policy,attr"`
+	Name   string `xml:"name,attr"`
+}
+
+type domainNUMACellXML struct {
+	ID     int    `xml:"id,attr"`
+	CPUs   string `xml:"cpus,attr"`
+	Memory uint64 `xml:"memory,attr"`
+	Unit   string `xml:"unit,attr"`
+}
+
+type domainCPUXML struct {
+	Mode     string                `xml:"mode,attr"`
+	Model    *domainCPUModelXML    `xml:"model"`
+	Topology *domainTopologyXML    `xml:"topology"`
+	Features []domainCPUFeatureXML `xml:"feature"`
+	NUMA     *[]domainNUMACellXML  `xml:"numa>cell"`
+}
+
+type domainPerfEventXML struct {
+	Name    string `xml:"name,attr"`
+	Enabled string `xml:"enabled,attr"`
+}
+
+type domainControllerXML struct {
+	Type  string `xml:"type,attr"`
+	Index uint   `xml:"index,attr"`
+	Model string `xml:"model,attr,omitempty"`
+}
+
+type domainCharXML struct {
+	Type   string `xml:"type,attr"`
+	Target struct {
+		Type string `xml:"type,attr"`
+		Port *uint  `xml:"port,attr"`
+		Name string `xml:"name,attr,omitempty"`
+	} `xml:"target"`
+}
+
+type domainInputXML struct {
+	Type string `xml:"type,attr"`
+	Bus  string `xml:"bus,attr,omitempty"`
+}
+
+type domainTPMXML struct {
+	Model   string `xml:"model,attr,omitempty"`
+	Backend struct {
+		Type    string `xml:"type,attr"`
+		Version string `xml:"version,attr,omitempty"`
+		Device  *struct {
+			Path string `xml:"path,attr"`
+		} `xml:"device"`
+	} `xml:"backend"`
+}
+
+type domainGraphicsXML struct {
+	Type     string `xml:"type,attr"`
+	Port     string `xml:"port,attr"`
+	AutoPort string `xml:"autoport,attr"`
+	Listen   string `xml:"listen,attr,omitempty"`
+}
+
+type domainSoundXML struct {
+	Model string `xml:"model,attr"`
+}
+
+type domainVideoXML struct {
+	Model struct {
+		Type    string `xml:"type,attr"`
+		VRAM    uint64 `xml:"vram,attr,omitempty"`
+		Heads   int    `xml:"heads,attr,omitempty"`
+		Primary string `xml:"primary,attr,omitempty"`
+		Accel   *struct {
+			Accel3D string `xml:"accel3d,attr"`
+		} `xml:"acceleration"`
+	} `xml:"model"`
+}
+
+type domainHostdevXML struct {
+	Mode    string `xml:"mode,attr"`
+	Type    string `xml:"type,attr"`
+	Managed string `xml:"managed,attr"`
+	Source  struct {
+		Address struct {
+			Domain   string `xml:"domain,attr"`
+			Bus      string `xml:"bus,attr"`
+			Slot     string `xml:"slot,attr"`
+			Function string `xml:"function,attr"`
+		} `xml:"address"`
+	} `xml:"source"`
+}
+
+type domainWatchdogXML struct {
+	Model  string `xml:"model,attr"`
+	Action string `xml:"action,attr,omitempty"`
+}
+
+type domainMemBalloonXML struct {
+	Model       string `xml:"model,attr"`
+	AutoDeflate string `xml:"autodeflate,attr,omitempty"`
+}
+
+type domainDevicesXML struct {
+	Disks       []diskDeviceXML       `xml:"disk"`
+	Controllers []domainControllerXML `xml:"controller"`
+	Interfaces  []interfaceDeviceXML  `xml:"interface"`
+	Serials     []domainCharXML       `xml:"serial"`
+	Consoles    []domainCharXML       `xml:"console"`
+	Channels    []domainCharXML       `xml:"channel"`
+	Inputs      []domainInputXML      `xml:"input"`
+	TPM         *domainTPMXML         `xml:"tpm"`
+	Graphics    []domainGraphicsXML   `xml:"graphics"`
+	Sounds      []domainSoundXML      `xml:"sound"`
+	Videos      []domainVideoXML      `xml:"video"`
+	Hostdevs    []domainHostdevXML    `xml:"hostdev"`
+	Watchdog    *domainWatchdogXML    `xml:"watchdog"`
+	MemBalloon  *domainMemBalloonXML  `xml:"memballoon"`
+}
+
+type domainSecLabelXML struct {
+	Type    string `xml:"type,attr"`
+	Model   string `xml:"model,attr,omitempty"`
+	Relabel string `xml:"relabel,attr,omitempty"`
+	Label   string `xml:"label,omitempty"`
+}
+
+type domainLaunchSecurityXML struct {
+	Type            string `xml:"type,attr"`
+	CBitPos         string `xml:"cbitpos,omitempty"`
+	ReducedPhysBits string `xml:"reducedPhysBits,omitempty"`
+	Policy          string `xml:"policy,omitempty"`
+	DHCert          string `xml:"dhCert,omitempty"`
+	Session         string `xml:"session,omitempty"`
+}
+
+type domainSysinfoEntryXML struct {
+	Name string `xml:"name,attr"`
+	File string `xml:"file,attr"`
+}
+
+type domainSysinfoXML struct {
+	Type    string                  `xml:"type,attr"`
+	Entries []domainSysinfoEntryXML `xml:"entry"`
+}
+
+type domainXML struct {
+	XMLName     xml.Name `xml:"domain"`
+	Type        string   `xml:"type,attr"`
+	Name        string   `xml:"name"`
+	UUID        string   `xml:"uuid,omitempty"`
+	Title       string   `xml:"title,omitempty"`
+	Description string   `xml:"description,omitempty"`
+	Metadata    *struct {
+		Inner string `xml:",innerxml"`
+	} `xml:"metadata"`
+	Memory        domainMemoryXML         `xml:"memory"`
+	CurrentMemory domainMemoryXML         `xml:"currentMemory"`
+	MemoryBacking *domainMemoryBackingXML `xml:"memoryBacking"`
+	VCPU          struct {
+		Placement string `xml:"placement,attr"`
+		Current   uint   `xml:"current,attr,omitempty"`
+		Value     uint   `xml:",chardata"`
+	} `xml:"vcpu"`
+	Sysinfo  *domainSysinfoXML  `xml:"sysinfo"`
+	OS       domainOSXML        `xml:"os"`
+	Features *domainFeaturesXML `xml:"features"`
+	CPU      *domainCPUXML      `xml:"cpu"`
+	Clock    struct {
+		Offset string `xml:"offset,attr"`
+	} `xml:"clock"`
+	OnPoweroff     string                   `xml:"on_poweroff,omitempty"`
+	OnReboot       string                   `xml:"on_reboot,omitempty"`
+	OnCrash        string                   `xml:"on_crash,omitempty"`
+	OnLockfailure  string                   `xml:"on_lockfailure,omitempty"`
+	Perf           *[]domainPerfEventXML    `xml:"perf>event"`
+	Devices        domainDevicesXML         `xml:"devices"`
+	SecLabels      []domainSecLabelXML      `xml:"seclabel"`
+	LaunchSecurity *domainLaunchSecurityXML `xml:"launchSecurity"`
+}
+
+// XML renders the domain definition. Every domain also gets a serial
+// console and a QEMU guest agent channel, which Virtumancer's console and
+// guest agent features rely on.
+func (d DomainSpec) XML() (string, error) {
+	if d.Name == "" {
+		return "", fmt.Errorf("invalid domain: name is required")
+	}
+	if d.VCPUs == 0 {
+		return "", fmt.Errorf("invalid domain: at least one vCPU is required")
+	}
+	if d.MemoryKB == 0 {
+		return "", fmt.Errorf("invalid domain: memory is required")
+	}
+	doc := domainXML{Type: "kvm", Name: d.Name, UUID: d.UUID, Title: d.Title, Description: d.Description}
+	if d.Metadata != "" {
+		doc.Metadata = &struct {
+			Inner string `xml:",innerxml"`
+		}{Inner: d.Metadata}
+	}
+
+	doc.Memory = domainMemoryXML{Unit: "KiB", Value: d.MemoryKB}
+	doc.CurrentMemory = domainMemoryXML{Unit: "KiB", Value: d.MemoryKB}
+	if d.CurrentMemoryKB != 0 && d.CurrentMemoryKB < d.MemoryKB {
+		doc.CurrentMemory.Value = d.CurrentMemoryKB
+	}
+	doc.VCPU.Placement = "static"
+	doc.VCPU.Value = d.VCPUs
+	if d.MaxVCPUs > d.VCPUs {
+		doc.VCPU.Value = d.MaxVCPUs
+		doc.VCPU.Current = d.VCPUs
+	}
+	if len(d.FirmwareConfig) > 0 {
+		doc.Sysinfo = &domainSysinfoXML{Type: "fwcfg"}
+		for _, entry := range d.FirmwareConfig {
+			if entry.Name == "" || entry.File == "" {
+				return "", fmt.Errorf("invalid domain: firmware config entries need a name and a file")
+			}
+			doc.Sysinfo.Entries = append(doc.Sysinfo.Entries, domainSysinfoEntryXML{Name: entry.Name, File: entry.File})
+		}
+	}
+	doc.MemoryBacking = renderMemoryBacking(d.MemoryBacking)
+	doc.OS = d.OS.render()
+	features, err := renderFeatures(d.Features)
+	if err != nil {
+		return "", err
+	}
+	doc.Features = features
+	doc.CPU = d.CPU.render(d.NUMACells)
+
+	doc.Clock.Offset = d.ClockOffset
+	if doc.Clock.Offset == "" {
+		doc.Clock.Offset = "utc"
+	}
+	doc.OnPoweroff = d.Lifecycle.OnPoweroff
+	doc.OnReboot = d.Lifecycle.OnReboot
+	doc.OnCrash = d.Lifecycle.OnCrash
+	doc.OnLockfailure = d.Lifecycle.OnLockFailure
+	if len(d.PerfEvents) > 0 {
+		events := make([]domainPerfEventXML, 0, len(d.PerfEvents))
+		for _, ev := range d.PerfEvents {
+			events = append(events, domainPerfEventXML{Name: ev.Name, Enabled: ev.Event})
+		}
+		doc.Perf = &events
+	}
+
+	devices, err := d.renderDevices()
+	if err != nil {
+		return "", err
+	}
+	doc.Devices = devices
+
+	for _, label := range d.SecurityLabels {
+		doc.SecLabels = append(doc.SecLabels, domainSecLabelXML{Type: label.Type, Model: label.Model, Relabel: label.Relabel, Label: label.Label})
+	}
+	if ls := d.LaunchSecurity; ls != nil {
+		doc.LaunchSecurity = &domainLaunchSecurityXML{Type: ls.Type, CBitPos: ls.CBitPos, ReducedPhysBits: ls.ReducedPhysBits, Policy: ls.Policy, DHCert: ls.DHCert, Session: ls.Session}
+	}
+
+	out, err := xml.MarshalIndent(doc, "", "  ")
+	if err != nil {
+		return "", fmt.Errorf("failed to build domain XML: %w", err)
+	}
+	return string(out), nil
+}
+
+func renderMemoryBacking(mb *MemoryBackingInfo) *domainMemoryBackingXML {
+	if mb == nil {
+		return nil
+	}
+	el := &domainMemoryBackingXML{}
+	if mb.HugePages != nil && len(mb.HugePages.Page) > 0 {
+		pages := make([]domainHugePageXML, 0, len(mb.HugePages.Page))
+		for _, page := range mb.HugePages.Page {
+			pages = append(pages, domainHugePageXML{Size: page.Size, Unit: page.Unit, Nodeset: page.Nodeset})
+		}
+		el.HugePages = &pages
+	}
+	if mb.NoSharePages {
+		el.Nosharepages = &struct{}{}
+	}
+	if mb.Locked {
+		el.Locked = &struct{}{}
+	}
+	if mb.Source != "" {
+		el.Source = &struct {
+			Type string `xml:"type,attr"`
+		}{Type: mb.Source}
+	}
+	if mb.Access != "" {
+		el.Access = &struct {
+			Mode string `xml:"mode,attr"`
+		}{Mode: mb.Access}
+	}
+	return el
+}
+
+func (o DomainOS) render() domainOSXML {
+	var el domainOSXML
+	el.Firmware = o.Firmware
+	el.Type.Arch = o.Arch
+	el.Type.Machine = o.Machine
+	el.Type.Value = "hvm"
+	if l := o.Loader; l != nil {
+		if l.Path != "" || l.Type != "" {
+			el.Loader = &domainLoaderXML{Type: l.Type, Path: l.Path}
+			if l.ReadOnly {
+				el.Loader.ReadOnly = "yes"
+			}
+			if l.Secure {
+				el.Loader.Secure = "yes"
+			}
+		}
+		if l.NVRAM != "" || l.NVRAMTemplate != "" {
+			el.NVRAM = &domainNVRAMXML{Template: l.NVRAMTemplate, Path: l.NVRAM}
+		}
+	}
+	for _, dev := range o.Boot {
+		el.Boot = append(el.Boot, domainBootXML{Dev: dev})
+	}
+	if o.BootMenu {
+		el.BootMenu = &struct {
+			Enable  string `xml:"enable,attr"`
+			Timeout string `xml:"timeout,attr,omitempty"`
+		}{Enable: "yes"}
+		if o.BootMenuTimeout > 0 {
+			el.BootMenu.Timeout = strconv.FormatUint(uint64(o.BootMenuTimeout), 10)
+		}
+	}
+	if o.SMBIOSMode != "" {
+		el.SMBIOS = &struct {
+			Mode string `xml:"mode,attr"`
+		}{Mode: o.SMBIOSMode}
+	}
+	if o.BIOSUseSerial || o.BIOSRebootTimeout != "" {
+		el.BIOS = &struct {
+			UseSerial     string `xml:"useserial,attr,omitempty"`
+			RebootTimeout string `xml:"rebootTimeout,attr,omitempty"`
+		}{RebootTimeout: o.BIOSRebootTimeout}
+		if o.BIOSUseSerial {
+			el.BIOS.UseSerial = "yes"
+		}
+	}
+	return el
+}
+
+func renderFeatures(features []HypervisorFeatureInfo) (*domainFeaturesXML, error) {
+	if len(features) == 0 {
+		return nil, nil
+	}
+	el := &domainFeaturesXML{}
+	present := &struct{}{}
+	for _, feature := range features {
+		state := feature.State
+		if state == "" {
+			state = "on"
+		}
+		on := state == "on"
+		switch feature.Name {
+		// These are switched on by their presence alone.
+		case "pae":
+			if on {
+				el.PAE = present
+			}
+		case "acpi":
+			if on {
+				el.ACPI = present
+			}
+		case "apic":
+			if on {
+				el.APIC = present
+			}
+		case "hap":
+			if on {
+				el.HAP = present
+			}
+		case "privnet":
+			if on {
+				el.Privnet = present
+			}
+		case "pvspinlock":
+			el.PVSpinlock = &domainStateXML{State: state}
+		case "hyperv_relaxed", "hyperv_vapic", "hyperv_spinlocks":
+			if el.HyperV == nil {
+				el.HyperV = &domainHyperVXML{}
+			}
+			switch feature.Name {
+			case "hyperv_relaxed":
+				el.HyperV.Relaxed = &domainStateXML{State: state}
+			case "hyperv_vapic":
+				el.HyperV.VAPIC = &domainStateXML{State: state}
+			default:
+				el.HyperV.Spinlocks = &domainSpinlocksXML{State: state}
+				if on {
+					// libvirt requires a retry count with spinlocks on.
+					el.HyperV.Spinlocks.Retries = "8191"
+				}
+			}
+		case "kvm_hidden", "kvm_hint_dedicated":
+			if el.KVM == nil {
+				el.KVM = &domainKVMXML{}
+			}
+			if feature.Name == "kvm_hidden" {
+				el.KVM.Hidden = &domainStateXML{State: state}
+			} else {
+				el.KVM.HintDedicated = &domainStateXML{State: state}
+			}
+		default:
+			return nil, fmt.Errorf("invalid domain: unsupported hypervisor feature %q", feature.Name)
+		}
+	}
+	return el, nil
+}
+
+func (c DomainCPU) render(cells []NUMANodeInfo) *domainCPUXML {
+	if c.Mode == "" && c.Model == "" && c.Sockets == 0 && c.Cores == 0 && c.Threads == 0 && len(c.Features) == 0 && len(cells) == 0 {
+		return nil
+	}
+	el := &domainCPUXML{Mode: c.Mode}
+	if el.Mode == "" {
+		el.Mode = "host-model"
+		if c.Model != "" {
+			el.Mode = "custom"
+		}
+	}
+	if c.Model != "" {
+		el.Model = &domainCPUModelXML{Fallback: "allow", Name: c.Model}
+	}
+	if c.Sockets > 0 || c.Cores > 0 || c.Threads > 0 {
+		el.Topology = &domainTopologyXML{Sockets: c.Sockets, Cores: c.Cores, Threads: c.Threads}
+		for _, n := range []*uint{&el.Topology.Sockets, &el.Topology.Cores, &el.Topology.Threads} {
+			if *n == 0 {
+				*n = 1
+			}
+		}
+	}
+	for _, feature := range c.Features {
+		policy := feature.Policy
+		if policy == "" {
+			policy = "require"
+		}
+		el.Features = append(el.Features, domainCPUFeatureXML{Policy: policy, Name: feature.Name})
+	}
+	if len(cells) > 0 {
+		numa := make([]domainNUMACellXML, 0, len(cells))
+		for _, cell := range cells {
+			numa = append(numa, domainNUMACellXML{ID: cell.ID, CPUs: cell.CPUs, Memory: cell.MemoryKB, Unit: "KiB"})
+		}
+		el.NUMA = &numa
+	}
+	return el
+}
+
+func (d DomainSpec) renderDevices() (domainDevicesXML, error) {
+	var devs domainDevicesXML
+	for _, disk := range d.Disks {
+		el, err := disk.element()
+		if err != nil {
+			return devs, err
+		}
+		devs.Disks = append(devs.Disks, el)
+	}
+	for _, c := range d.Controllers {
+		devs.Controllers = append(devs.Controllers, domainControllerXML{Type: c.Type, Index: c.Index, Model: c.Model})
+	}
+	for _, nic := range d.Interfaces {
+		el, err := nic.element()
+		if err != nil {
+			return devs, err
+		}
+		devs.Interfaces = append(devs.Interfaces, el)
+	}
+
+	port := uint(0)
+	serial := domainCharXML{Type: "pty"}
+	serial.Target.Type = "isa-serial"
+	serial.Target.Port = &port
+	console := domainCharXML{Type: "pty"}
+	console.Target.Type = "serial"
+	console.Target.Port = &port
+	agent := domainCharXML{Type: "unix"}
+	agent.Target.Type = "virtio"
+	agent.Target.Name = "org.qemu.guest_agent.0"
+	devs.Serials = []domainCharXML{serial}
+	devs.Consoles = []domainCharXML{console}
+	devs.Channels = []domainCharXML{agent}
+
+	for _, in := range d.Inputs {
+		devs.Inputs = append(devs.Inputs, domainInputXML{Type: in.Type, Bus: in.Bus})
+	}
+	if t := d.TPM; t != nil {
+		tpm := &domainTPMXML{Model: t.Model}
+		tpm.Backend.Type = t.Backend
+		switch t.Backend {
+		case "emulator":
+			tpm.Backend.Version = "2.0"
+		case "passthrough":
+			if t.Path == "" {
+				return devs, fmt.Errorf("invalid domain: a passthrough TPM needs a host device path")
+			}
+			tpm.Backend.Device = &struct {
+				Path string `xml:"path,attr"`
+			}{Path: t.Path}
+		default:
+			return devs, fmt.Errorf("invalid domain: unsupported TPM backend %q", t.Backend)
+		}
+		devs.TPM = tpm
+	}
+	for _, g := range d.Graphics {
+		switch g.Type {
+		case "vnc", "spice":
+		default:
+			return devs, fmt.Errorf("invalid domain: unsupported graphics type %q", g.Type)
+		}
+		el := domainGraphicsXML{Type: g.Type, Port: "-1", AutoPort: "yes", Listen: g.Listen}
+		if g.Port != 0 {
+			el.Port = strconv.FormatUint(uint64(g.Port), 10)
+			el.AutoPort = "no"
+		}
+		devs.Graphics = append(devs.Graphics, el)
+	}
+	for _, s := range d.Sounds {
+		devs.Sounds = append(devs.Sounds, domainSoundXML{Model: s.Model})
+	}
+	for i, v := range d.Videos {
+		var el domainVideoXML
+		el.Model.Type = v.Model
+		el.Model.VRAM = v.VRAMBytes / 1024
+		el.Model.Heads = v.Heads
+		// With several video devices, the first is the primary one.
+		if len(d.Videos) > 1 && i == 0 {
+			el.Model.Primary = "yes"
+		}
+		if v.Acceleration != nil && v.Acceleration.Accel3D {
+			el.Model.Accel = &struct {
+				Accel3D string `xml:"accel3d,attr"`
+			}{Accel3D: "yes"}
+		}
+		devs.Videos = append(devs.Videos, el)
+	}
+	for _, hd := range d.Hostdevs {
+		el := domainHostdevXML{Mode: hd.Mode, Type: hd.Type, Managed: "yes"}
+		if el.Mode == "" {
+			el.Mode = "subsystem"
+		}
+		el.Source.Address.Domain = hd.Source.Address.Domain
+		el.Source.Address.Bus = hd.Source.Address.Bus
+		el.Source.Address.Slot = hd.Source.Address.Slot
+		el.Source.Address.Function = hd.Source.Address.Function
+		devs.Hostdevs = append(devs.Hostdevs, el)
+	}
+	if w := d.Watchdog; w != nil {
+		devs.Watchdog = &domainWatchdogXML{Model: w.Model, Action: w.Action}
+	}
+	if b := d.MemBalloon; b != nil {
+		devs.MemBalloon = &domainMemBalloonXML{Model: b.Model}
+		if b.AutoDeflate {
+			devs.MemBalloon.AutoDeflate = "on"
+		}
+	}
+	return devs, nil
+}
+
+// ParsePCIAddress splits a host PCI address such as "0000:01:00.0", or
+// with 0x-prefixed parts as HostDevice rows store them, into the domain,
+// bus, slot and function of a <hostdev> source.
+func ParsePCIAddress(addr string) (HostdevInfo, error) {
+	var hd HostdevInfo
+	hd.Mode = "subsystem"
+	hd.Type = "pci"
+	parts := strings.Split(addr, ":")
+	if len(parts) != 3 {
+		return hd, fmt.Errorf("invalid PCI address %q", addr)
+	}
+	slotFn := strings.Split(parts[2], ".")
+	if len(slotFn) != 2 {
+		return hd, fmt.Errorf("invalid PCI address %q", addr)
+	}
+	hex := func(s string) string {
+		if strings.HasPrefix(s, "0x") {
+			return s
+		}
+		return "0x" + s
+	}
+	hd.Source.Address.Domain = hex(parts[0])
+	hd.Source.Address.Bus = hex(parts[1])
+	hd.Source.Address.Slot = hex(slotFn[0])
+	hd.Source.Address.Function = hex(slotFn[1])
+	return hd, nil
+}
@@ -0,0 +1,129 @@
+package libvirt
+
+import (
+	"context"
+	"fmt"
+	"sync"
+
+	log "github.com/capsali/virtumancer/internal/logging"
+
+	"github.com/digitalocean/go-libvirt"
+	"github.com/google/uuid"
+)
+
+// DomainEventKind identifies which libvirt event stream a DomainEvent came from.
+type DomainEventKind string
+
+const (
+	DomainEventKindLifecycle     DomainEventKind = "lifecycle"
+	DomainEventKindReboot        DomainEventKind = "reboot"
+	DomainEventKindDeviceAdded   DomainEventKind = "device-added"
+	DomainEventKindDeviceRemoved DomainEventKind = "device-removed"
+)
+
+// DomainEvent is a normalized domain event delivered by SubscribeDomainEvents.
+// Event and Detail are only meaningful for lifecycle events; DevAlias is only
+// set for device events.
+type DomainEvent struct {
+	HostID   string
+	Kind     DomainEventKind
+	Name     string
+	UUID     string
+	Event    libvirt.DomainEventType
+	Detail   int32
+	DevAlias string
+}
+
+// domainEventBuffer bounds how far consumers may lag before producers block.
+const domainEventBuffer = 64
+
+// SubscribeDomainEvents registers for lifecycle, reboot and device
+// added/removed events on the host and merges them into one channel. The
+// channel is closed when ctx is cancelled or the connection to the host drops.
+func (c *Connector) SubscribeDomainEvents(ctx context.Context, hostID string) (<-chan DomainEvent, error) {
+	l, err := c.GetConnection(hostID)
+	if err != nil {
+		return nil, err
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	lifecycle, err := l.LifecycleEvents(ctx)
+	if err != nil {
+		cancel()
+		return nil, fmt.Errorf("failed to subscribe to lifecycle events on host '%s': %w", hostID, err)
+	}
+
+	out := make(chan DomainEvent, domainEventBuffer)
+	forward := func(ev DomainEvent) {
+		select {
+		case out <- ev:
+		case <-ctx.Done():
+		}
+	}
+
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for msg := range lifecycle {
+			forward(DomainEvent{
+				HostID: hostID,
+				Kind:   DomainEventKindLifecycle,
+				Name:   msg.Dom.Name,
+				UUID:   domainUUIDString(msg.Dom),
+				Event:  libvirt.DomainEventType(msg.Event),
+				Detail: msg.Detail,
+			})
+		}
+	}()
+
+	for _, id := range []libvirt.DomainEventID{libvirt.DomainEventIDReboot, libvirt.DomainEventIDDeviceAdded, libvirt.DomainEventIDDeviceRemoved} {
+		ch, err := l.SubscribeEvents(ctx, id, nil)
+		if err != nil {
+			// Older daemons lack some event IDs; lifecycle events alone still
+			// keep state current, so carry on without this stream.
+			log.Verbosef("Host %s: could not subscribe to domain event %d: %v", hostID, id, err)
+			continue
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for raw := range ch {
+				if ev, ok := domainEventFromMsg(hostID, raw); ok {
+					forward(ev)
+				}
+			}
+		}()
+	}
+
+	go func() {
+		wg.Wait()
+		cancel()
+		close(out)
+	}()
+
+	return out, nil
+}
+
+// domainEventFromMsg converts a message from a go-libvirt event stream into a
+// DomainEvent. Unknown message types are dropped.
+func domainEventFromMsg(hostID string, raw interface{}) (DomainEvent, bool) {
+	switch msg := raw.(type) {
+	case *libvirt.DomainEventCallbackRebootMsg:
+		return DomainEvent{HostID: hostID, Kind: DomainEventKindReboot, Name: msg.Msg.Dom.Name, UUID: domainUUIDString(msg.Msg.Dom)}, true
+	case *libvirt.DomainEventCallbackDeviceAddedMsg:
+		return DomainEvent{HostID: hostID, Kind: DomainEventKindDeviceAdded, Name: msg.Dom.Name, UUID: domainUUIDString(msg.Dom), DevAlias: msg.DevAlias}, true
+	case *libvirt.DomainEventCallbackDeviceRemovedMsg:
+		return DomainEvent{HostID: hostID, Kind: DomainEventKindDeviceRemoved, Name: msg.Msg.Dom.Name, UUID: domainUUIDString(msg.Msg.Dom), DevAlias: msg.Msg.DevAlias}, true
+	default:
+		return DomainEvent{}, false
+	}
+}
+
+func domainUUIDString(dom libvirt.Domain) string {
+	parsed, err := uuid.FromBytes(dom.UUID[:])
+	if err != nil {
+		return ""
+	}
+	return parsed.String()
+}
@@ -0,0 +1,1316 @@
+package libvirt
+
+import (
+	"context"
+	"encoding/xml"
+	"fmt"
+	"net"
+	"net/url"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/capsali/virtumancer/internal/storage"
+	"github.com/digitalocean/go-libvirt"
+	"github.com/google/uuid"
+	"golang.org/x/crypto/ssh"
+)
+
+// FakeHypervisor is an in-memory Hypervisor for tests. It models hosts with
+// domains, storage pools, volumes and networks, and applies the same state
+// transitions a libvirt daemon would for lifecycle operations, so the service
+// and API layers can be exercised end to end without a real host.
+//
+// Host state survives disconnects, mirroring a real daemon: seeding a host
+// before AddHost is allowed and domains remain defined after RemoveHost.
+type FakeHypervisor struct {
+	mu       sync.Mutex
+	hosts    map[string]*fakeHost
+	injected map[string]error
+}
+
+type fakeHost struct {
+	connected bool
+	info      HostInfo
+	domains   map[string]*fakeDomain
+	pools     map[string]*fakePool
+	networks  map[string]*fakeNetwork
+	nwfilters map[string]*fakeNWFilter
+	nextID    int32
+	// subscribers receive domain events until their context ends or the
+	// host is disconnected.
+	subscribers []chan DomainEvent
+	// lost is closed by DropConnection to simulate the daemon going away.
+	lost chan struct{}
+	// sshHostKey is presented to qemu+ssh connections when set, and
+	// learnedHostKeys records any keys trusted on the latest connect.
+	sshHostKey      ssh.PublicKey
+	learnedHostKeys string
+	// uri is the URI of the latest connect, which peer-to-peer migrations
+	// use to find the destination.
+	uri string
+}
+
+type fakeDomain struct {
+	name       string
+	uuid       string
+	xml        string
+	state      libvirt.DomainState
+	id         int32
+	persistent bool
+	autostart  bool
+	maxMemKB   uint64
+	memKB      uint64
+	maxVcpus   uint
+	vcpus      uint
+	cpuTime    uint64
+	networks   []string
+	// snapshots are kept in creation order; currentSnapshot names the one
+	// the domain last reverted to or took.
+	snapshots       []*fakeSnapshot
+	currentSnapshot string
+	// agentDown makes a configured guest agent stop answering; frozen is
+	// set between a filesystem freeze and thaw. passwords records what
+	// SetGuestUserPassword set per guest account.
+	agentDown bool
+	frozen    bool
+	passwords map[string]string
+	// managedSave is set between ManagedSaveDomain and the start that
+	// restores the image.
+	managedSave bool
+	// addresses maps NIC MACs to the IP the guest reports for them.
+	addresses map[string]string
+}
+
+type fakePool struct {
+	info    StoragePoolInfo
+	volumes map[string]*fakeVolume
+	// built is set once the pool's directory, filesystem or volume group
+	// exists; seeded pools start out built.
+	built bool
+}
+
+type fakeVolume struct {
+	name     string
+	path     string
+	capacity uint64
+	format   string
+	// backing is the path of the volume a linked clone overlays.
+	backing string
+	// data holds uploaded content; the rest of the volume's file, which is
+	// size bytes long, reads as zeros. allocation counts the bytes written.
+	data       []byte
+	size       uint64
+	allocation uint64
+}
+
+type fakeNetwork struct {
+	uuid      string
+	spec      NetworkSpec
+	active    bool
+	autostart bool
+	// restarts counts how often the network went down while active, which
+	// cuts off attached guests.
+	restarts int
+}
+
+// fakeDomainXML is the subset of a domain definition the fake tracks.
+type fakeDomainXML struct {
+	Name   string `xml:"name"`
+	UUID   string `xml:"uuid"`
+	Memory struct {
+		Value uint64 `xml:",chardata"`
+		Unit  string `xml:"unit,attr"`
+	} `xml:"memory"`
+	CurrentMemory struct {
+		Value uint64 `xml:",chardata"`
+		Unit  string `xml:"unit,attr"`
+	} `xml:"currentMemory"`
+	VCPU struct {
+		Value   uint `xml:",chardata"`
+		Current uint `xml:"current,attr"`
+	} `xml:"vcpu"`
+	Interfaces []NetworkInfo `xml:"devices>interface"`
+}
+
+// errFakeUnsupported is returned by API-only detail calls the fake does not
+// model; callers already treat these as optional and fall back to XML data.
+var errFakeUnsupported = fmt.Errorf("operation not supported by fake hypervisor")
+
+var _ Hypervisor = (*FakeHypervisor)(nil)
+
+// NewFakeHypervisor returns an empty fake with no hosts.
+func NewFakeHypervisor() *FakeHypervisor {
+	return &FakeHypervisor{
+		hosts:    make(map[string]*fakeHost),
+		injected: make(map[string]error),
+	}
+}
+
+// host returns the state for hostID, creating it on first use. Callers must hold f.mu.
+func (f *FakeHypervisor) host(hostID string) *fakeHost {
+	h, ok := f.hosts[hostID]
+	if !ok {
+		h = &fakeHost{
+			info: HostInfo{
+				Hostname: "fake-" + hostID,
+				CPU:      8,
+				Memory:   16 << 30,
+				Cores:    4,
+				Threads:  2,
+			},
+			domains:   make(map[string]*fakeDomain),
+			pools:     make(map[string]*fakePool),
+			networks:  make(map[string]*fakeNetwork),
+			nwfilters: make(map[string]*fakeNWFilter),
+			nextID:    1,
+		}
+		f.hosts[hostID] = h
+	}
+	return h
+}
+
+// connectedHost returns the host state if connected. Callers must hold f.mu.
+func (f *FakeHypervisor) connectedHost(hostID string) (*fakeHost, error) {
+	h, ok := f.hosts[hostID]
+	if !ok || !h.connected {
+		return nil, fmt.Errorf("not connected to host '%s'", hostID)
+	}
+	return h, nil
+}
+
+// domain looks up a domain on a connected host. Callers must hold f.mu.
+func (f *FakeHypervisor) domain(hostID, vmName string) (*fakeDomain, error) {
+	h, err := f.connectedHost(hostID)
+	if err != nil {
+		return nil, err
+	}
+	d, ok := h.domains[vmName]
+	if !ok {
+		return nil, fmt.Errorf("could not find VM '%s' on host '%s': Domain not found", vmName, hostID)
+	}
+	return d, nil
+}
+
+// takeInjected pops a one-shot error registered with InjectError. Callers must hold f.mu.
+func (f *FakeHypervisor) takeInjected(method string) error {
+	if err, ok := f.injected[method]; ok {
+		delete(f.injected, method)
+		return err
+	}
+	return nil
+}
+
+// --- Test helpers ---
+
+// InjectError makes the next call to the named method return err.
+func (f *FakeHypervisor) InjectError(method string, err error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.injected[method] = err
+}
+
+// DropConnection simulates the connection to hostID going away without
+// RemoveHost, as when libvirtd restarts or an SSH tunnel dies.
+func (f *FakeHypervisor) DropConnection(hostID string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	h, ok := f.hosts[hostID]
+	if !ok || !h.connected {
+		return
+	}
+	h.disconnectLocked()
+	close(h.lost)
+}
+
+// SetSSHHostKey makes qemu+ssh connections to hostID present key, so host key
+// pinning can be exercised.
+func (f *FakeHypervisor) SetSSHHostKey(hostID string, key ssh.PublicKey) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.host(hostID).sshHostKey = key
+}
+
+// SetHostInfo replaces the host information reported for hostID.
+func (f *FakeHypervisor) SetHostInfo(hostID string, info HostInfo) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.host(hostID).info = info
+}
+
+// AddStoragePool seeds an active storage pool on hostID.
+func (f *FakeHypervisor) AddStoragePool(hostID string, pool StoragePoolInfo) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if pool.UUID == "" {
+		pool.UUID = uuid.New().String()
+	}
+	if pool.Type == "" {
+		pool.Type = "dir"
+	}
+	if pool.State == 0 {
+		pool.State = int(libvirt.StoragePoolRunning)
+	}
+	f.host(hostID).pools[pool.Name] = &fakePool{info: pool, volumes: make(map[string]*fakeVolume), built: true}
+}
+
+// AddNetwork seeds an active virtual network on hostID.
+func (f *FakeHypervisor) AddNetwork(hostID, name, bridge string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.host(hostID).networks[name] = &fakeNetwork{uuid: uuid.New().String(), spec: NetworkSpec{Name: name, Mode: "nat", Bridge: bridge}, active: true}
+}
+
+// AddStorageVolume seeds a volume in a pool on hostID and returns its path.
+func (f *FakeHypervisor) AddStorageVolume(hostID, poolName, volumeName, format string, capacityBytes uint64) (string, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	p, ok := f.host(hostID).pools[poolName]
+	if !ok {
+		return "", fmt.Errorf("storage pool %s not found on host %s", poolName, hostID)
+	}
+	volPath := path.Join(p.info.Path, volumeName)
+	p.volumes[volumeName] = &fakeVolume{name: volumeName, path: volPath, capacity: capacityBytes, size: capacityBytes, allocation: capacityBytes, format: format}
+	return volPath, nil
+}
+
+// AddDomain seeds a persistent domain defined by domainXML in the given state.
+func (f *FakeHypervisor) AddDomain(hostID, domainXML string, state libvirt.DomainState) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	h := f.host(hostID)
+	d, err := h.define(domainXML)
+	if err != nil {
+		return err
+	}
+	if state == libvirt.DomainRunning || state == libvirt.DomainPaused {
+		d.id = h.nextID
+		h.nextID++
+	}
+	d.state = state
+	return nil
+}
+
+// SetDomainState changes a domain's state behind the service's back, as an
+// out-of-band virsh command would, and emits the matching lifecycle event.
+func (f *FakeHypervisor) SetDomainState(hostID, vmName string, state libvirt.DomainState) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	d, ok := f.host(hostID).domains[vmName]
+	if !ok {
+		return fmt.Errorf("domain %s not found on host %s", vmName, hostID)
+	}
+	prev := d.state
+	d.state = state
+	switch {
+	case state == libvirt.DomainRunning && prev == libvirt.DomainPaused:
+		f.emitLifecycleLocked(hostID, d, libvirt.DomainEventResumed, int32(libvirt.DomainEventResumedUnpaused))
+	case state == libvirt.DomainRunning:
+		f.emitLifecycleLocked(hostID, d, libvirt.DomainEventStarted, int32(libvirt.DomainEventStartedBooted))
+	case state == libvirt.DomainPaused:
+		f.emitLifecycleLocked(hostID, d, libvirt.DomainEventSuspended, int32(libvirt.DomainEventSuspendedPaused))
+	case state == libvirt.DomainShutoff:
+		f.emitLifecycleLocked(hostID, d, libvirt.DomainEventStopped, int32(libvirt.DomainEventStoppedShutdown))
+	case state == libvirt.DomainCrashed:
+		f.emitLifecycleLocked(hostID, d, libvirt.DomainEventCrashed, int32(libvirt.DomainEventCrashedPanicked))
+	}
+	return nil
+}
+
+// EmitDeviceEvent delivers a device added or removed event for a domain, as
+// libvirt does once a hotplug or unplug completes.
+func (f *FakeHypervisor) EmitDeviceEvent(hostID, vmName string, kind DomainEventKind, devAlias string) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	d, ok := f.host(hostID).domains[vmName]
+	if !ok {
+		return fmt.Errorf("domain %s not found on host %s", vmName, hostID)
+	}
+	f.emitLocked(hostID, DomainEvent{Kind: kind, Name: d.name, UUID: d.uuid, DevAlias: devAlias})
+	return nil
+}
+
+// DomainState reports the current state of a domain.
+func (f *FakeHypervisor) DomainState(hostID, vmName string) (libvirt.DomainState, bool) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	d, ok := f.host(hostID).domains[vmName]
+	if !ok {
+		return libvirt.DomainNostate, false
+	}
+	return d.state, true
+}
+
+// DomainXML returns the stored definition of a domain.
+func (f *FakeHypervisor) DomainXML(hostID, vmName string) (string, bool) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	d, ok := f.host(hostID).domains[vmName]
+	if !ok {
+		return "", false
+	}
+	return d.xml, true
+}
+
+// HasVolume reports whether a volume exists in the named pool.
+func (f *FakeHypervisor) HasVolume(hostID, poolName, volumeName string) bool {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	p, ok := f.host(hostID).pools[poolName]
+	if !ok {
+		return false
+	}
+	_, ok = p.volumes[volumeName]
+	return ok
+}
+
+// VolumeCapacity reports the capacity of a fake volume.
+func (f *FakeHypervisor) VolumeCapacity(hostID, poolName, volumeName string) (uint64, bool) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	p, ok := f.host(hostID).pools[poolName]
+	if !ok {
+		return 0, false
+	}
+	v, ok := p.volumes[volumeName]
+	if !ok {
+		return 0, false
+	}
+	return v.capacity, true
+}
+
+// emitLocked delivers ev to every subscriber on hostID. Subscribers that are
+// not keeping up lose the event, like a slow libvirt client would. Callers
+// must hold f.mu.
+func (f *FakeHypervisor) emitLocked(hostID string, ev DomainEvent) {
+	h, ok := f.hosts[hostID]
+	if !ok {
+		return
+	}
+	ev.HostID = hostID
+	for _, ch := range h.subscribers {
+		select {
+		case ch <- ev:
+		default:
+		}
+	}
+}
+
+// emitLifecycleLocked emits a lifecycle event for d. Callers must hold f.mu.
+func (f *FakeHypervisor) emitLifecycleLocked(hostID string, d *fakeDomain, event libvirt.DomainEventType, detail int32) {
+	f.emitLocked(hostID, DomainEvent{Kind: DomainEventKindLifecycle, Name: d.name, UUID: d.uuid, Event: event, Detail: detail})
+}
+
+// define parses domainXML and creates or updates the matching domain.
+func (h *fakeHost) define(domainXML string) (*fakeDomain, error) {
+	var def fakeDomainXML
+	if err := xml.Unmarshal([]byte(domainXML), &def); err != nil {
+		return nil, fmt.Errorf("failed to define domain: XML error: %w", err)
+	}
+	if def.Name == "" {
+		return nil, fmt.Errorf("failed to define domain: missing domain name")
+	}
+	if def.UUID == "" {
+		def.UUID = uuid.New().String()
+	}
+	for name, existing := range h.domains {
+		if name != def.Name && existing.uuid == def.UUID {
+			return nil, fmt.Errorf("failed to define domain: domain '%s' already exists with uuid %s", name, def.UUID)
+		}
+	}
+
+	d, ok := h.domains[def.Name]
+	if ok && d.uuid != def.UUID {
+		return nil, fmt.Errorf("failed to define domain: domain '%s' already exists with uuid %s", def.Name, d.uuid)
+	}
+	if !ok {
+		d = &fakeDomain{name: def.Name, uuid: def.UUID, state: libvirt.DomainShutoff}
+		h.domains[def.Name] = d
+	}
+	d.xml = domainXML
+	d.persistent = true
+	d.loadResources(def)
+	d.networks = d.networks[:0]
+	for _, iface := range def.Interfaces {
+		if iface.Type == "network" && iface.Source.Network != "" {
+			d.networks = append(d.networks, iface.Source.Network)
+		}
+	}
+	return d, nil
+}
+
+// loadResources sets the domain's vCPUs and memory from its definition, as
+// booting it does.
+func (d *fakeDomain) loadResources(def fakeDomainXML) {
+	d.maxMemKB = toKiB(def.Memory.Value, def.Memory.Unit)
+	d.memKB = toKiB(def.CurrentMemory.Value, def.CurrentMemory.Unit)
+	if d.memKB == 0 {
+		d.memKB = d.maxMemKB
+	}
+	d.maxVcpus = def.VCPU.Value
+	d.vcpus = def.VCPU.Current
+	if d.vcpus == 0 {
+		d.vcpus = d.maxVcpus
+	}
+}
+
+// fakeDomainName extracts the domain name from domainXML, or "" if it does not parse.
+func fakeDomainName(domainXML string) string {
+	var def fakeDomainXML
+	if err := xml.Unmarshal([]byte(domainXML), &def); err != nil {
+		return ""
+	}
+	return def.Name
+}
+
+// toKiB converts a libvirt memory value with unit into KiB.
+func toKiB(value uint64, unit string) uint64 {
+	switch strings.ToLower(unit) {
+	case "", "k", "kib":
+		return value
+	case "b", "bytes":
+		return value / 1024
+	case "kb":
+		return value * 1000 / 1024
+	case "m", "mib":
+		return value * 1024
+	case "mb":
+		return value * 1000 * 1000 / 1024
+	case "g", "gib":
+		return value * 1024 * 1024
+	case "gb":
+		return value * 1000 * 1000 * 1000 / 1024
+	default:
+		return value
+	}
+}
+
+func (d *fakeDomain) active() bool {
+	return d.state == libvirt.DomainRunning || d.state == libvirt.DomainPaused || d.state == libvirt.DomainBlocked
+}
+
+func (d *fakeDomain) info() VMInfo {
+	graphics, _ := parseGraphicsFromXML(d.xml)
+	var id uint32
+	var uptime int64 = -1
+	if d.active() {
+		id = uint32(d.id)
+		uptime = 0
+	}
+	return VMInfo{
+		ID:             id,
+		UUID:           d.uuid,
+		Name:           d.name,
+		State:          d.state,
+		MaxMem:         d.maxMemKB,
+		Memory:         d.memKB,
+		Vcpu:           d.vcpus,
+		CpuTime:        d.cpuTime,
+		Uptime:         uptime,
+		Persistent:     d.persistent,
+		Autostart:      d.autostart,
+		Graphics:       graphics,
+		HasManagedSave: d.managedSave,
+	}
+}
+
+// --- Connection management ---
+
+func (f *FakeHypervisor) AddHost(host storage.Host) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if err := f.takeInjected("AddHost"); err != nil {
+		return fmt.Errorf("failed to dial libvirt for host '%s': %w", host.ID, err)
+	}
+	if err := ValidateURI(host.URI); err != nil {
+		return fmt.Errorf("failed to dial libvirt for host '%s': %w", host.ID, err)
+	}
+	h := f.host(host.ID)
+	if h.connected {
+		return fmt.Errorf("host '%s' is already connected", host.ID)
+	}
+	h.learnedHostKeys = ""
+	if h.sshHostKey != nil {
+		learned, err := fakeVerifySSHHostKey(host, h.sshHostKey)
+		if err != nil {
+			return fmt.Errorf("failed to dial libvirt for host '%s': %w", host.ID, err)
+		}
+		h.learnedHostKeys = learned
+	}
+	h.connected = true
+	h.uri = host.URI
+	h.lost = make(chan struct{})
+	return nil
+}
+
+func (f *FakeHypervisor) RemoveHost(hostID string) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	h, ok := f.hosts[hostID]
+	if !ok || !h.connected {
+		return fmt.Errorf("host '%s' not found", hostID)
+	}
+	h.disconnectLocked()
+	return nil
+}
+
+// disconnectLocked marks the host disconnected and ends its event streams.
+// Callers must hold f.mu.
+func (h *fakeHost) disconnectLocked() {
+	h.connected = false
+	for _, ch := range h.subscribers {
+		close(ch)
+	}
+	h.subscribers = nil
+}
+
+func (f *FakeHypervisor) ConnectionLost(hostID string) (<-chan struct{}, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	h, err := f.connectedHost(hostID)
+	if err != nil {
+		return nil, err
+	}
+	return h.lost, nil
+}
+
+func (f *FakeHypervisor) LearnedHostKeys(hostID string) string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	h, err := f.connectedHost(hostID)
+	if err != nil {
+		return ""
+	}
+	return h.learnedHostKeys
+}
+
+// fakeVerifySSHHostKey runs the connector's host key checks against key as if
+// the SSH server at host.URI had presented it.
+func fakeVerifySSHHostKey(host storage.Host, key ssh.PublicKey) (string, error) {
+	u, err := url.Parse(host.URI)
+	if err != nil || u.Scheme != "qemu+ssh" {
+		return "", nil
+	}
+	port := u.Port()
+	if port == "" {
+		port = "22"
+	}
+	addr := net.JoinHostPort(u.Hostname(), port)
+	v, err := newHostKeyVerifier(host, u)
+	if err != nil {
+		return "", err
+	}
+	if err := v.check(addr, nil, key); err != nil {
+		return "", fmt.Errorf("failed to dial SSH to %s: ssh: handshake failed: %w", addr, err)
+	}
+	return v.learned(), nil
+}
+
+func (f *FakeHypervisor) IsConnected(hostID string) bool {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	h, ok := f.hosts[hostID]
+	return ok && h.connected
+}
+
+// GetConnection always fails: the fake has no RPC client to hand out.
+func (f *FakeHypervisor) GetConnection(hostID string) (*libvirt.Libvirt, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if _, err := f.connectedHost(hostID); err != nil {
+		return nil, err
+	}
+	return nil, fmt.Errorf("host '%s': %w", hostID, errFakeUnsupported)
+}
+
+// --- Events ---
+
+func (f *FakeHypervisor) SubscribeDomainEvents(ctx context.Context, hostID string) (<-chan DomainEvent, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	h, err := f.connectedHost(hostID)
+	if err != nil {
+		return nil, err
+	}
+	if err := f.takeInjected("SubscribeDomainEvents"); err != nil {
+		return nil, fmt.Errorf("failed to subscribe to lifecycle events on host '%s': %w", hostID, err)
+	}
+	ch := make(chan DomainEvent, domainEventBuffer)
+	h.subscribers = append(h.subscribers, ch)
+	go func() {
+		<-ctx.Done()
+		f.mu.Lock()
+		defer f.mu.Unlock()
+		for i, sub := range h.subscribers {
+			if sub == ch {
+				h.subscribers = append(h.subscribers[:i], h.subscribers[i+1:]...)
+				close(ch)
+				return
+			}
+		}
+	}()
+	return ch, nil
+}
+
+// --- Host information ---
+
+func (f *FakeHypervisor) GetHostInfo(hostID string) (*HostInfo, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	h, err := f.connectedHost(hostID)
+	if err != nil {
+		return nil, err
+	}
+	info := h.info
+	for _, d := range h.domains {
+		if d.active() {
+			info.MemoryUsed += d.memKB * 1024
+		}
+	}
+	return &info, nil
+}
+
+func (f *FakeHypervisor) GetHostStats(hostID string) (*HostStats, error) {
+	info, err := f.GetHostInfo(hostID)
+	if err != nil {
+		return nil, err
+	}
+	return &HostStats{MemoryUsed: info.MemoryUsed}, nil
+}
+
+func (f *FakeHypervisor) GetNodePerformance(hostID string) (*NodePerformanceInfo, error) {
+	return nil, errFakeUnsupported
+}
+
+// --- Inventory ---
+
+func (f *FakeHypervisor) ListAllDomains(hostID string) ([]VMInfo, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	h, err := f.connectedHost(hostID)
+	if err != nil {
+		return nil, err
+	}
+	if err := f.takeInjected("ListAllDomains"); err != nil {
+		return nil, fmt.Errorf("failed to list domains: %w", err)
+	}
+	names := make([]string, 0, len(h.domains))
+	for name := range h.domains {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var vms []VMInfo
+	for _, name := range names {
+		vms = append(vms, h.domains[name].info())
+	}
+	return vms, nil
+}
+
+func (f *FakeHypervisor) ListAllStoragePools(hostID string) ([]StoragePoolInfo, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	h, err := f.connectedHost(hostID)
+	if err != nil {
+		return nil, err
+	}
+	names := make([]string, 0, len(h.pools))
+	for name := range h.pools {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var pools []StoragePoolInfo
+	for _, name := range names {
+		info := h.pools[name].info
+		if info.CapacityBytes > info.AllocationBytes {
+			info.AvailableBytes = info.CapacityBytes - info.AllocationBytes
+		}
+		pools = append(pools, info)
+	}
+	return pools, nil
+}
+
+// --- Domain information ---
+
+func (f *FakeHypervisor) GetDomainInfo(hostID, vmName string) (*VMInfo, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	d, err := f.domain(hostID, vmName)
+	if err != nil {
+		return nil, err
+	}
+	info := d.info()
+	return &info, nil
+}
+
+func (f *FakeHypervisor) GetDomainStats(hostID, vmName string) (*VMStats, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	d, err := f.domain(hostID, vmName)
+	if err != nil {
+		return nil, err
+	}
+	info := d.info()
+	return &VMStats{
+		State:   info.State,
+		Memory:  info.Memory,
+		MaxMem:  info.MaxMem,
+		Vcpu:    info.Vcpu,
+		CpuTime: info.CpuTime,
+		Uptime:  info.Uptime,
+	}, nil
+}
+
+func (f *FakeHypervisor) GetDomainHardware(hostID, vmName string) (*HardwareInfo, error) {
+	f.mu.Lock()
+	d, err := f.domain(hostID, vmName)
+	var xmlDesc string
+	if err == nil {
+		xmlDesc = d.xml
+	}
+	f.mu.Unlock()
+	if err != nil {
+		return nil, err
+	}
+	return hardwareFromXML(xmlDesc)
+}
+
+func (f *FakeHypervisor) GetDomainMemoryDetails(hostID, vmName string) (*MemoryDetails, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	d, err := f.domain(hostID, vmName)
+	if err != nil {
+		return nil, err
+	}
+	return &MemoryDetails{MaxMemoryKB: d.maxMemKB}, nil
+}
+
+func (f *FakeHypervisor) GetDomainCPUDetails(hostID, vmName string) (*CPUDetails, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	d, err := f.domain(hostID, vmName)
+	if err != nil {
+		return nil, err
+	}
+	return &CPUDetails{MaxVcpus: int32(d.maxVcpus), CurrentVcpus: int32(d.vcpus)}, nil
+}
+
+func (f *FakeHypervisor) GetDomainBlockDetails(hostID, vmName string) ([]BlockDeviceDetail, error) {
+	return nil, errFakeUnsupported
+}
+
+func (f *FakeHypervisor) GetDomainSecurityDetails(hostID, vmName string) ([]SecurityDetail, error) {
+	return nil, errFakeUnsupported
+}
+
+func (f *FakeHypervisor) GetDomainIOThreadDetails(hostID, vmName string) ([]IOThreadDetail, error) {
+	return nil, errFakeUnsupported
+}
+
+func (f *FakeHypervisor) GetDomainNUMADetails(hostID, vmName string) (*NUMADetails, error) {
+	return nil, errFakeUnsupported
+}
+
+func (f *FakeHypervisor) GetDomainMemoryStats(hostID, vmName string) (*MemoryStats, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	d, err := f.domain(hostID, vmName)
+	if err != nil {
+		return nil, err
+	}
+	return &MemoryStats{Actual: d.memKB}, nil
+}
+
+func (f *FakeHypervisor) GetDomainGuestAgentDetails(hostID, vmName string) (*GuestAgentDetails, error) {
+	return nil, errFakeUnsupported
+}
+
+func (f *FakeHypervisor) GetDomainPerformanceDetails(hostID, vmName string) (*PerformanceDetails, error) {
+	return nil, errFakeUnsupported
+}
+
+func (f *FakeHypervisor) GetDomainCPUPerformance(hostID, vmName string) (*CPUPerformanceDetails, error) {
+	return nil, errFakeUnsupported
+}
+
+func (f *FakeHypervisor) GetDomainInterfaceAddresses(hostID, vmName string) (*NetworkInterfaceDetails, error) {
+	return nil, errFakeUnsupported
+}
+
+func (f *FakeHypervisor) GetDomainHybridDetails(hostID, vmName string) (*HybridDomainDetails, error) {
+	return nil, errFakeUnsupported
+}
+
+func (f *FakeHypervisor) GetDomainOptimizedSync(hostID, vmName string) (*OptimizedSyncData, error) {
+	return nil, errFakeUnsupported
+}
+
+func (f *FakeHypervisor) GetDomainXMLOnlyFeatures(hostID, vmName string) (*XMLOnlyFeatures, error) {
+	return nil, errFakeUnsupported
+}
+
+func (f *FakeHypervisor) GetEnhancedDiskInfo(hostID, vmUUID string, disks []DiskInfo) ([]EnhancedDiskInfo, error) {
+	return nil, errFakeUnsupported
+}
+
+// GetEnhancedNetworkInfo reports the addresses set with SetInterfaceAddress.
+// Domains without any fall back to XML-only data, as before.
+func (f *FakeHypervisor) GetEnhancedNetworkInfo(hostID, vmUUID string, networks []NetworkInfo) ([]EnhancedNetworkInfo, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	h, err := f.connectedHost(hostID)
+	if err != nil {
+		return nil, err
+	}
+	var dom *fakeDomain
+	for _, d := range h.domains {
+		if d.uuid == vmUUID {
+			dom = d
+		}
+	}
+	if dom == nil || len(dom.addresses) == 0 {
+		return nil, errFakeUnsupported
+	}
+	enhanced := make([]EnhancedNetworkInfo, 0, len(networks))
+	for _, nic := range networks {
+		info := EnhancedNetworkInfo{NetworkInfo: nic}
+		if ip, ok := dom.addresses[strings.ToLower(nic.Mac.Address)]; ok {
+			info.InterfaceAddrs = []DomainInterfaceAddress{{MacAddr: nic.Mac.Address, Addrs: []NetworkInterfaceAddress{{Addr: ip}}}}
+		}
+		enhanced = append(enhanced, info)
+	}
+	return enhanced, nil
+}
+
+// SetInterfaceAddress makes the guest report ip for the NIC with mac, as a
+// guest agent or DHCP lease would.
+func (f *FakeHypervisor) SetInterfaceAddress(hostID, vmName, mac, ip string) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	d, err := f.domain(hostID, vmName)
+	if err != nil {
+		return err
+	}
+	if d.addresses == nil {
+		d.addresses = make(map[string]string)
+	}
+	d.addresses[strings.ToLower(mac)] = ip
+	return nil
+}
+
+func (f *FakeHypervisor) GetDevicePerformance(hostID, vmUUID string) ([]DevicePerformanceInfo, error) {
+	return nil, errFakeUnsupported
+}
+
+// --- Domain lifecycle ---
+
+func (f *FakeHypervisor) StartDomain(hostID, vmName string) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	d, err := f.domain(hostID, vmName)
+	if err != nil {
+		return err
+	}
+	if err := f.takeInjected("StartDomain"); err != nil {
+		return fmt.Errorf("libvirt start failed for %s: %w", vmName, err)
+	}
+	if d.active() {
+		return fmt.Errorf("libvirt start failed for %s: Requested operation is not valid: domain is already running", vmName)
+	}
+	h := f.hosts[hostID]
+	for _, netName := range d.networks {
+		n, ok := h.networks[netName]
+		if !ok {
+			return fmt.Errorf("libvirt start failed for %s: Network not found: no network with matching name '%s'", vmName, netName)
+		}
+		if !n.active {
+			return fmt.Errorf("libvirt start failed for %s: Requested operation is not valid: network '%s' is not active", vmName, netName)
+		}
+	}
+	for _, filter := range d.filterRefs() {
+		if _, ok := h.nwfilters[filter]; !ok {
+			return fmt.Errorf("libvirt start failed for %s: internal error: referenced filter '%s' is missing", vmName, filter)
+		}
+	}
+	d.state = libvirt.DomainRunning
+	d.id = h.nextID
+	h.nextID++
+	detail := libvirt.DomainEventStartedBooted
+	if d.managedSave {
+		d.managedSave = false
+		detail = libvirt.DomainEventStartedRestored
+	} else {
+		// Resource changes made to the definition while the domain ran
+		// take effect now.
+		var def fakeDomainXML
+		if xml.Unmarshal([]byte(d.xml), &def) == nil {
+			d.loadResources(def)
+		}
+	}
+	f.emitLifecycleLocked(hostID, d, libvirt.DomainEventStarted, int32(detail))
+	return nil
+}
+
+func (f *FakeHypervisor) ShutdownDomain(hostID, vmName string) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	d, err := f.domain(hostID, vmName)
+	if err != nil {
+		return err
+	}
+	if err := f.takeInjected("ShutdownDomain"); err != nil {
+		return fmt.Errorf("libvirt shutdown failed for %s: %w", vmName, err)
+	}
+	if d.state != libvirt.DomainRunning {
+		return fmt.Errorf("libvirt shutdown failed for %s: Requested operation is not valid: domain is not running", vmName)
+	}
+	f.stopLocked(hostID, d, libvirt.DomainEventStoppedShutdown)
+	return nil
+}
+
+func (f *FakeHypervisor) RebootDomain(hostID, vmName string) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	d, err := f.domain(hostID, vmName)
+	if err != nil {
+		return err
+	}
+	if err := f.takeInjected("RebootDomain"); err != nil {
+		return fmt.Errorf("libvirt reboot failed for %s: %w", vmName, err)
+	}
+	if d.state != libvirt.DomainRunning {
+		return fmt.Errorf("libvirt reboot failed for %s: Requested operation is not valid: domain is not running", vmName)
+	}
+	f.emitLocked(hostID, DomainEvent{Kind: DomainEventKindReboot, Name: d.name, UUID: d.uuid})
+	return nil
+}
+
+func (f *FakeHypervisor) DestroyDomain(hostID, vmName string) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	d, err := f.domain(hostID, vmName)
+	if err != nil {
+		return err
+	}
+	if err := f.takeInjected("DestroyDomain"); err != nil {
+		return fmt.Errorf("libvirt destroy failed for %s: %w", vmName, err)
+	}
+	if !d.active() {
+		return fmt.Errorf("libvirt destroy failed for %s: Requested operation is not valid: domain is not running", vmName)
+	}
+	f.stopLocked(hostID, d, libvirt.DomainEventStoppedDestroyed)
+	return nil
+}
+
+func (f *FakeHypervisor) ResetDomain(hostID, vmName string) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	d, err := f.domain(hostID, vmName)
+	if err != nil {
+		return err
+	}
+	if err := f.takeInjected("ResetDomain"); err != nil {
+		return fmt.Errorf("libvirt reset failed for %s: %w", vmName, err)
+	}
+	if !d.active() {
+		return fmt.Errorf("libvirt reset failed for %s: Requested operation is not valid: domain is not running", vmName)
+	}
+	return nil
+}
+
+func (f *FakeHypervisor) SuspendDomain(hostID, vmName string) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	d, err := f.domain(hostID, vmName)
+	if err != nil {
+		return err
+	}
+	if err := f.takeInjected("SuspendDomain"); err != nil {
+		return fmt.Errorf("libvirt suspend failed for %s: %w", vmName, err)
+	}
+	if d.state != libvirt.DomainRunning {
+		return fmt.Errorf("libvirt suspend failed for %s: Requested operation is not valid: domain is not running", vmName)
+	}
+	d.state = libvirt.DomainPaused
+	f.emitLifecycleLocked(hostID, d, libvirt.DomainEventSuspended, int32(libvirt.DomainEventSuspendedPaused))
+	return nil
+}
+
+func (f *FakeHypervisor) ResumeDomain(hostID, vmName string) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	d, err := f.domain(hostID, vmName)
+	if err != nil {
+		return err
+	}
+	if err := f.takeInjected("ResumeDomain"); err != nil {
+		return fmt.Errorf("libvirt resume failed for %s: %w", vmName, err)
+	}
+	if d.state != libvirt.DomainPaused {
+		return fmt.Errorf("libvirt resume failed for %s: Requested operation is not valid: domain is not paused", vmName)
+	}
+	d.state = libvirt.DomainRunning
+	f.emitLifecycleLocked(hostID, d, libvirt.DomainEventResumed, int32(libvirt.DomainEventResumedUnpaused))
+	return nil
+}
+
+// ManagedSaveDomain stops the domain and marks it as having a save image,
+// which the next StartDomain consumes.
+func (f *FakeHypervisor) ManagedSaveDomain(hostID, vmName string) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	d, err := f.domain(hostID, vmName)
+	if err != nil {
+		return err
+	}
+	if err := f.takeInjected("ManagedSaveDomain"); err != nil {
+		return fmt.Errorf("libvirt managed save failed for %s: %w", vmName, err)
+	}
+	if !d.active() {
+		return fmt.Errorf("libvirt managed save failed for %s: Requested operation is not valid: domain is not running", vmName)
+	}
+	if !d.persistent {
+		return fmt.Errorf("libvirt managed save failed for %s: Requested operation is not valid: cannot do managed save for transient domain", vmName)
+	}
+	d.managedSave = true
+	f.stopLocked(hostID, d, libvirt.DomainEventStoppedSaved)
+	return nil
+}
+
+// stopLocked moves a domain to shutoff, dropping transient domains entirely.
+func (f *FakeHypervisor) stopLocked(hostID string, d *fakeDomain, detail libvirt.DomainEventStoppedDetailType) {
+	d.state = libvirt.DomainShutoff
+	d.id = 0
+	d.frozen = false
+	f.emitLifecycleLocked(hostID, d, libvirt.DomainEventStopped, int32(detail))
+	if !d.persistent {
+		delete(f.hosts[hostID].domains, d.name)
+		f.emitLifecycleLocked(hostID, d, libvirt.DomainEventUndefined, int32(libvirt.DomainEventUndefinedRemoved))
+	}
+}
+
+func (f *FakeHypervisor) DefineAndCreateDomain(hostID, domainXML string) (*libvirt.Domain, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	h, err := f.connectedHost(hostID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get libvirt connection: %w", err)
+	}
+	if err := f.takeInjected("DefineAndCreateDomain"); err != nil {
+		return nil, fmt.Errorf("failed to define domain: %w", err)
+	}
+	_, existed := h.domains[fakeDomainName(domainXML)]
+	d, err := h.define(domainXML)
+	if err != nil {
+		return nil, err
+	}
+	detail := libvirt.DomainEventDefinedAdded
+	if existed {
+		detail = libvirt.DomainEventDefinedUpdated
+	}
+	f.emitLifecycleLocked(hostID, d, libvirt.DomainEventDefined, int32(detail))
+	dom := &libvirt.Domain{Name: d.name}
+	if parsed, err := uuid.Parse(d.uuid); err == nil {
+		copy(dom.UUID[:], parsed[:])
+	}
+	if d.active() {
+		dom.ID = d.id
+	}
+	return dom, nil
+}
+
+func (f *FakeHypervisor) UndefineDomain(hostID, vmName string) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	d, err := f.domain(hostID, vmName)
+	if err != nil {
+		return err
+	}
+	if err := f.takeInjected("UndefineDomain"); err != nil {
+		return fmt.Errorf("failed to undefine domain %s: %w", vmName, err)
+	}
+	// Undefining a running domain leaves it running as a transient domain.
+	if d.active() {
+		d.persistent = false
+		return nil
+	}
+	if d.managedSave {
+		return fmt.Errorf("failed to undefine domain %s: Requested operation is not valid: Refusing to undefine while domain managed save image exists", vmName)
+	}
+	if len(d.snapshots) > 0 {
+		return fmt.Errorf("failed to undefine domain %s: Requested operation is not valid: cannot delete inactive domain with %d snapshots", vmName, len(d.snapshots))
+	}
+	delete(f.hosts[hostID].domains, vmName)
+	f.emitLifecycleLocked(hostID, d, libvirt.DomainEventUndefined, int32(libvirt.DomainEventUndefinedRemoved))
+	return nil
+}
+
+// DeleteDomain drops the domain with its snapshots and managed save image.
+func (f *FakeHypervisor) DeleteDomain(hostID, vmName string) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	d, err := f.domain(hostID, vmName)
+	if err != nil {
+		return err
+	}
+	if err := f.takeInjected("DeleteDomain"); err != nil {
+		return fmt.Errorf("failed to undefine domain %s: %w", vmName, err)
+	}
+	if d.active() {
+		d.persistent = false
+		return nil
+	}
+	delete(f.hosts[hostID].domains, vmName)
+	f.emitLifecycleLocked(hostID, d, libvirt.DomainEventUndefined, int32(libvirt.DomainEventUndefinedRemoved))
+	return nil
+}
+
+// --- Storage ---
+
+func (f *FakeHypervisor) CreateStorageVolume(hostID, poolName, volumeName string, capacityBytes uint64) (string, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	h, err := f.connectedHost(hostID)
+	if err != nil {
+		return "", fmt.Errorf("failed to get libvirt connection: %w", err)
+	}
+	p, ok := h.pools[poolName]
+	if !ok {
+		return "", fmt.Errorf("failed to find storage pool %s: Storage pool not found", poolName)
+	}
+	if err := f.takeInjected("CreateStorageVolume"); err != nil {
+		return "", fmt.Errorf("failed to create storage volume: %w", err)
+	}
+	if _, exists := p.volumes[volumeName]; exists {
+		return "", fmt.Errorf("failed to create storage volume: storage volume '%s' already exists", volumeName)
+	}
+	volPath := path.Join(p.info.Path, volumeName)
+	p.volumes[volumeName] = &fakeVolume{name: volumeName, path: volPath, capacity: capacityBytes, format: "qcow2"}
+	return volPath, nil
+}
+
+func (f *FakeHypervisor) ResizeStorageVolume(hostID, poolName, volumeName string, capacityBytes uint64) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	h, err := f.connectedHost(hostID)
+	if err != nil {
+		return fmt.Errorf("failed to get libvirt connection: %w", err)
+	}
+	p, ok := h.pools[poolName]
+	if !ok {
+		return fmt.Errorf("failed to find storage pool %s: Storage pool not found", poolName)
+	}
+	v, ok := p.volumes[volumeName]
+	if !ok {
+		return fmt.Errorf("failed to find storage volume %s in pool %s: Storage volume not found", volumeName, poolName)
+	}
+	if err := f.takeInjected("ResizeStorageVolume"); err != nil {
+		return fmt.Errorf("failed to resize storage volume %s: %w", volumeName, err)
+	}
+	if capacityBytes < v.capacity {
+		return fmt.Errorf("failed to resize storage volume %s: invalid argument: Can't shrink capacity below current capacity unless shrink flag explicitly specified", volumeName)
+	}
+	v.capacity = capacityBytes
+	return nil
+}
+
+func (f *FakeHypervisor) ResizeDomainDisk(hostID, vmName, device string, capacityBytes uint64) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	d, err := f.domain(hostID, vmName)
+	if err != nil {
+		return err
+	}
+	if err := f.takeInjected("ResizeDomainDisk"); err != nil {
+		return fmt.Errorf("failed to resize disk %s of domain %s: %w", device, vmName, err)
+	}
+	if !d.active() {
+		return fmt.Errorf("failed to resize disk %s of domain %s: Requested operation is not valid: domain is not running", device, vmName)
+	}
+	dev, err := parseFakeDevice(fmt.Sprintf("<disk><target dev='%s'/></disk>", device))
+	if err != nil {
+		return fmt.Errorf("failed to resize disk %s of domain %s: %w", device, vmName, err)
+	}
+	start, end, ok := findFakeDevice(d.xml, dev)
+	if !ok {
+		return fmt.Errorf("failed to resize disk %s of domain %s: invalid argument: disk '%s' was not found in the domain config", device, vmName, device)
+	}
+	var disk DiskInfo
+	if err := xml.Unmarshal([]byte(d.xml[start:end]), &disk); err != nil {
+		return fmt.Errorf("failed to resize disk %s of domain %s: %w", device, vmName, err)
+	}
+	v := f.hosts[hostID].volumeByPath(disk.Source.File)
+	if v == nil {
+		return fmt.Errorf("failed to resize disk %s of domain %s: Storage volume not found", device, vmName)
+	}
+	if capacityBytes < v.capacity {
+		return fmt.Errorf("failed to resize disk %s of domain %s: invalid argument: Can't shrink disk", device, vmName)
+	}
+	v.capacity = capacityBytes
+	return nil
+}
+
+func (f *FakeHypervisor) DeleteStorageVolume(hostID, poolName, volumeName string) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	h, err := f.connectedHost(hostID)
+	if err != nil {
+		return fmt.Errorf("failed to get libvirt connection: %w", err)
+	}
+	p, ok := h.pools[poolName]
+	if !ok {
+		return fmt.Errorf("failed to find storage pool %s: Storage pool not found", poolName)
+	}
+	if _, ok := p.volumes[volumeName]; !ok {
+		return fmt.Errorf("failed to find storage volume %s in pool %s: Storage volume not found", volumeName, poolName)
+	}
+	delete(p.volumes, volumeName)
+	return nil
+}
+
+func (f *FakeHypervisor) ListStorageVolumes(hostID, poolName string) ([]VolumeDetail, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	h, err := f.connectedHost(hostID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get libvirt connection: %w", err)
+	}
+	p, ok := h.pools[poolName]
+	if !ok {
+		return nil, fmt.Errorf("failed to find storage pool %s: Storage pool not found", poolName)
+	}
+	if err := f.takeInjected("ListStorageVolumes"); err != nil {
+		return nil, fmt.Errorf("failed to list volumes of storage pool %s: %w", poolName, err)
+	}
+	details := make([]VolumeDetail, 0, len(p.volumes))
+	for _, v := range p.volumes {
+		details = append(details, VolumeDetail{
+			Name:        v.name,
+			Capacity:    v.capacity,
+			Allocation:  v.allocation,
+			Path:        v.path,
+			Format:      v.format,
+			BackingPath: v.backing,
+			PoolName:    poolName,
+		})
+	}
+	sort.Slice(details, func(i, j int) bool { return details[i].Name < details[j].Name })
+	return details, nil
+}
+
+func (f *FakeHypervisor) GetDiskSize(hostID, diskPath string) (uint64, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	h, err := f.connectedHost(hostID)
+	if err != nil {
+		return 0, fmt.Errorf("failed to get libvirt connection: %w", err)
+	}
+	for _, p := range h.pools {
+		for _, v := range p.volumes {
+			if v.path == diskPath {
+				return v.capacity, nil
+			}
+		}
+	}
+	return 0, fmt.Errorf("unable to determine disk size for %s", diskPath)
+}
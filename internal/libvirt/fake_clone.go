@@ -0,0 +1,87 @@
+package libvirt
+
+import (
+	"fmt"
+	"path"
+)
+
+// CloneStorageVolume copies a fake volume. No data is involved, so full
+// copies, linked clones and copies between hosts differ only in the
+// volume's format and backing.
+func (f *FakeHypervisor) CloneStorageVolume(spec VolumeCloneSpec) (*VolumeDetail, error) {
+	if err := validateVolumeCloneSpec(spec); err != nil {
+		return nil, err
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	src, err := f.connectedHost(spec.SourceHostID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get libvirt connection: %w", err)
+	}
+	var srcPool string
+	var srcVol *fakeVolume
+	for name, p := range src.pools {
+		for _, v := range p.volumes {
+			if v.path == spec.SourcePath {
+				srcPool, srcVol = name, v
+			}
+		}
+	}
+	if srcVol == nil {
+		return nil, fmt.Errorf("failed to find storage volume %s: Storage volume not found", spec.SourcePath)
+	}
+
+	poolName := spec.PoolName
+	if poolName == "" {
+		poolName = srcPool
+	}
+	dst, err := f.connectedHost(spec.HostID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get libvirt connection: %w", err)
+	}
+	p, ok := dst.pools[poolName]
+	if !ok {
+		return nil, fmt.Errorf("failed to find storage pool %s: Storage pool not found", poolName)
+	}
+	if err := f.takeInjected("CloneStorageVolume"); err != nil {
+		return nil, fmt.Errorf("failed to clone storage volume %s: %w", spec.SourcePath, err)
+	}
+	if _, exists := p.volumes[spec.Name]; exists {
+		return nil, fmt.Errorf("failed to clone storage volume %s: storage volume '%s' already exists", spec.SourcePath, spec.Name)
+	}
+
+	vol := &fakeVolume{
+		name:     spec.Name,
+		path:     path.Join(p.info.Path, spec.Name),
+		capacity: srcVol.capacity,
+		format:   srcVol.format,
+	}
+	if spec.Linked {
+		vol.format, vol.backing = "qcow2", srcVol.path
+	}
+	p.volumes[spec.Name] = vol
+	return &VolumeDetail{
+		Name:        vol.name,
+		Capacity:    vol.capacity,
+		Path:        vol.path,
+		Format:      vol.format,
+		BackingPath: vol.backing,
+		PoolName:    poolName,
+	}, nil
+}
+
+// VolumeBacking returns the backing path of a fake volume, or "" for a
+// volume that holds its own data, for tests that check linked clones.
+func (f *FakeHypervisor) VolumeBacking(hostID, volPath string) (string, bool) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	h, ok := f.hosts[hostID]
+	if !ok {
+		return "", false
+	}
+	v := h.volumeByPath(volPath)
+	if v == nil {
+		return "", false
+	}
+	return v.backing, true
+}
@@ -0,0 +1,172 @@
+package libvirt
+
+import (
+	"encoding/xml"
+	"fmt"
+	"strings"
+)
+
+// fakeDeviceXML identifies a device element the fake can hotplug: disks by
+// target device and interfaces by MAC address, as libvirt matches them.
+type fakeDeviceXML struct {
+	XMLName xml.Name
+	Target  struct {
+		Dev string `xml:"dev,attr"`
+		Bus string `xml:"bus,attr"`
+	} `xml:"target"`
+	MAC struct {
+		Address string `xml:"address,attr"`
+	} `xml:"mac"`
+	FilterRef struct {
+		Filter string `xml:"filter,attr"`
+	} `xml:"filterref"`
+}
+
+func (d fakeDeviceXML) key() string {
+	switch d.XMLName.Local {
+	case "disk":
+		return d.Target.Dev
+	case "interface":
+		return strings.ToLower(d.MAC.Address)
+	}
+	return ""
+}
+
+func parseFakeDevice(deviceXML string) (fakeDeviceXML, error) {
+	var dev fakeDeviceXML
+	if err := xml.Unmarshal([]byte(deviceXML), &dev); err != nil {
+		return dev, fmt.Errorf("XML error: %w", err)
+	}
+	switch dev.XMLName.Local {
+	case "disk", "interface":
+	default:
+		return dev, fmt.Errorf("Operation not supported: device type '%s' is not supported by the fake", dev.XMLName.Local)
+	}
+	if dev.key() == "" {
+		return dev, fmt.Errorf("XML error: %s has no target device or MAC address", dev.XMLName.Local)
+	}
+	return dev, nil
+}
+
+// hotpluggable rejects disk buses QEMU cannot add or remove while the guest
+// runs.
+func (d fakeDeviceXML) hotpluggable() error {
+	if d.XMLName.Local == "disk" && (d.Target.Bus == "ide" || d.Target.Bus == "sata") {
+		return fmt.Errorf("Operation not supported: disk bus '%s' cannot be hotplugged", d.Target.Bus)
+	}
+	return nil
+}
+
+// findFakeDevice returns the byte range of the element under <devices> that
+// matches dev.
+func findFakeDevice(doc string, dev fakeDeviceXML) (int, int, bool) {
+	dec := xml.NewDecoder(strings.NewReader(doc))
+	var stack []string
+	start := int64(-1)
+	for {
+		offset := dec.InputOffset()
+		tok, err := dec.RawToken()
+		if err != nil {
+			return 0, 0, false
+		}
+		switch t := tok.(type) {
+		case xml.StartElement:
+			stack = append(stack, t.Name.Local)
+			if len(stack) == 3 && stack[1] == "devices" && t.Name.Local == dev.XMLName.Local {
+				start = offset
+			}
+		case xml.EndElement:
+			if len(stack) == 3 && start >= 0 {
+				end := dec.InputOffset()
+				var candidate fakeDeviceXML
+				if xml.Unmarshal([]byte(doc[start:end]), &candidate) == nil && candidate.key() == dev.key() {
+					return int(start), int(end), true
+				}
+				start = -1
+			}
+			if len(stack) > 0 {
+				stack = stack[:len(stack)-1]
+			}
+		}
+	}
+}
+
+// fakeDeviceDomain looks up the domain and parses the device for a device
+// operation. Callers must hold f.mu.
+func (f *FakeHypervisor) fakeDeviceDomain(hostID, vmName, deviceXML, method string) (*fakeHost, *fakeDomain, fakeDeviceXML, error) {
+	d, err := f.domain(hostID, vmName)
+	if err != nil {
+		return nil, nil, fakeDeviceXML{}, err
+	}
+	if err := f.takeInjected(method); err != nil {
+		return nil, nil, fakeDeviceXML{}, err
+	}
+	dev, err := parseFakeDevice(deviceXML)
+	if err != nil {
+		return nil, nil, dev, err
+	}
+	// Changing the media of a CD-ROM is an update that any bus allows.
+	if d.active() && method != "UpdateDevice" {
+		if err := dev.hotpluggable(); err != nil {
+			return nil, nil, dev, err
+		}
+	}
+	h := f.hosts[hostID]
+	// A running guest's filter is instantiated right away, so it must exist.
+	if name := dev.FilterRef.Filter; d.active() && name != "" {
+		if _, ok := h.nwfilters[name]; !ok {
+			return nil, nil, dev, fmt.Errorf("internal error: referenced filter '%s' is missing", name)
+		}
+	}
+	return h, d, dev, nil
+}
+
+func (f *FakeHypervisor) AttachDevice(hostID, vmName, deviceXML string) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	h, d, dev, err := f.fakeDeviceDomain(hostID, vmName, deviceXML, "AttachDevice")
+	if err != nil {
+		return fmt.Errorf("failed to attach device to domain %s: %w", vmName, err)
+	}
+	if _, _, exists := findFakeDevice(d.xml, dev); exists {
+		return fmt.Errorf("failed to attach device to domain %s: Requested operation is not valid: %s %s already exists", vmName, dev.XMLName.Local, dev.key())
+	}
+	at := strings.LastIndex(d.xml, "</devices>")
+	if at < 0 {
+		return fmt.Errorf("failed to attach device to domain %s: domain has no <devices> element", vmName)
+	}
+	_, err = h.define(d.xml[:at] + deviceXML + "\n  " + d.xml[at:])
+	return err
+}
+
+func (f *FakeHypervisor) DetachDevice(hostID, vmName, deviceXML string) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	h, d, dev, err := f.fakeDeviceDomain(hostID, vmName, deviceXML, "DetachDevice")
+	if err != nil {
+		return fmt.Errorf("failed to detach device from domain %s: %w", vmName, err)
+	}
+	start, end, ok := findFakeDevice(d.xml, dev)
+	if !ok {
+		return fmt.Errorf("failed to detach device from domain %s: operation failed: %s %s not found", vmName, dev.XMLName.Local, dev.key())
+	}
+	// Drop the element's indentation along with it.
+	start = len(strings.TrimRight(d.xml[:start], " \t"))
+	_, err = h.define(d.xml[:start] + strings.TrimPrefix(d.xml[end:], "\n"))
+	return err
+}
+
+func (f *FakeHypervisor) UpdateDevice(hostID, vmName, deviceXML string) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	h, d, dev, err := f.fakeDeviceDomain(hostID, vmName, deviceXML, "UpdateDevice")
+	if err != nil {
+		return fmt.Errorf("failed to update device of domain %s: %w", vmName, err)
+	}
+	start, end, ok := findFakeDevice(d.xml, dev)
+	if !ok {
+		return fmt.Errorf("failed to update device of domain %s: operation failed: %s %s not found", vmName, dev.XMLName.Local, dev.key())
+	}
+	_, err = h.define(d.xml[:start] + deviceXML + d.xml[end:])
+	return err
+}
@@ -0,0 +1,211 @@
+package libvirt
+
+import (
+	"encoding/xml"
+	"fmt"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/digitalocean/go-libvirt"
+)
+
+// guestAgentChannel is the virtio channel name the QEMU guest agent uses.
+const guestAgentChannel = "org.qemu.guest_agent.0"
+
+// GuestUserPassword returns the password last set for user in a domain.
+func (f *FakeHypervisor) GuestUserPassword(hostID, vmName, user string) (string, bool) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	d, ok := f.host(hostID).domains[vmName]
+	if !ok {
+		return "", false
+	}
+	password, ok := d.passwords[user]
+	return password, ok
+}
+
+// SetGuestAgentResponding simulates the guest agent process in a domain
+// stopping or starting again.
+func (f *FakeHypervisor) SetGuestAgentResponding(hostID, vmName string, responding bool) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if d, ok := f.host(hostID).domains[vmName]; ok {
+		d.agentDown = !responding
+	}
+}
+
+// hasAgentChannel reports whether the domain defines a guest agent channel.
+func (d *fakeDomain) hasAgentChannel() bool {
+	var def struct {
+		Channels []struct {
+			Target struct {
+				Name string `xml:"name,attr"`
+			} `xml:"target"`
+		} `xml:"devices>channel"`
+	}
+	if xml.Unmarshal([]byte(d.xml), &def) != nil {
+		return false
+	}
+	for _, ch := range def.Channels {
+		if ch.Target.Name == guestAgentChannel {
+			return true
+		}
+	}
+	return false
+}
+
+// agentDomain looks up a domain whose guest agent can take a command,
+// failing the way libvirt does when it cannot. Callers must hold f.mu.
+func (f *FakeHypervisor) agentDomain(hostID, vmName, method string) (*fakeDomain, error) {
+	d, err := f.domain(hostID, vmName)
+	if err != nil {
+		return nil, err
+	}
+	if err := f.takeInjected(method); err != nil {
+		return nil, agentError(vmName, method, err)
+	}
+	switch {
+	case d.state != libvirt.DomainRunning:
+		return nil, &GuestAgentUnavailableError{VM: vmName, Reason: "Requested operation is not valid: domain is not running"}
+	case !d.hasAgentChannel():
+		return nil, &GuestAgentUnavailableError{VM: vmName, Reason: "argument unsupported: QEMU guest agent is not configured"}
+	case d.agentDown:
+		return nil, &GuestAgentUnavailableError{VM: vmName, Reason: "Guest agent is not responding: QEMU guest agent is not connected"}
+	}
+	return d, nil
+}
+
+// frozenError is what the agent answers to commands other than a thaw while
+// the guest's filesystems are frozen.
+func frozenError(vmName, op string) error {
+	return fmt.Errorf("libvirt guest agent %s failed for %s: internal error: unable to execute QEMU agent command: Command has been disabled: the agent is in frozen state", op, vmName)
+}
+
+// GuestExec runs a tiny built-in command set: echo, cat (echoing its input),
+// true and false. Anything else fails to start as a missing binary would.
+func (f *FakeHypervisor) GuestExec(hostID, vmName string, cmd GuestCommand, timeout time.Duration) (*GuestExecResult, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	d, err := f.agentDomain(hostID, vmName, "GuestExec")
+	if err != nil {
+		return nil, err
+	}
+	if d.frozen {
+		return nil, frozenError(vmName, "guest-exec")
+	}
+	res := &GuestExecResult{PID: int(d.id)*1000 + len(cmd.Path)}
+	switch path.Base(cmd.Path) {
+	case "echo":
+		res.Stdout = strings.Join(cmd.Args, " ") + "\n"
+	case "cat":
+		res.Stdout = cmd.Input
+	case "true":
+	case "false":
+		res.ExitCode = 1
+	default:
+		return nil, fmt.Errorf("libvirt guest agent guest-exec failed for %s: internal error: unable to execute QEMU agent command 'guest-exec': Failed to execute child process \"%s\" (No such file or directory)", vmName, cmd.Path)
+	}
+	return res, nil
+}
+
+func (f *FakeHypervisor) SetGuestUserPassword(hostID, vmName, user, password string, encrypted bool) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	d, err := f.agentDomain(hostID, vmName, "SetGuestUserPassword")
+	if err != nil {
+		return err
+	}
+	if d.frozen {
+		return frozenError(vmName, "set-user-password")
+	}
+	if d.passwords == nil {
+		d.passwords = make(map[string]string)
+	}
+	d.passwords[user] = password
+	return nil
+}
+
+// FreezeGuestFilesystems pretends the guest has a single root filesystem
+// unless mountpoints are given.
+func (f *FakeHypervisor) FreezeGuestFilesystems(hostID, vmName string, mountpoints []string) (int, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	d, err := f.agentDomain(hostID, vmName, "FreezeGuestFilesystems")
+	if err != nil {
+		return 0, err
+	}
+	if d.frozen {
+		return 0, frozenError(vmName, "fsfreeze")
+	}
+	d.frozen = true
+	if len(mountpoints) > 0 {
+		return len(mountpoints), nil
+	}
+	return 1, nil
+}
+
+func (f *FakeHypervisor) ThawGuestFilesystems(hostID, vmName string, mountpoints []string) (int, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	d, err := f.agentDomain(hostID, vmName, "ThawGuestFilesystems")
+	if err != nil {
+		return 0, err
+	}
+	if !d.frozen {
+		return 0, nil
+	}
+	d.frozen = false
+	if len(mountpoints) > 0 {
+		return len(mountpoints), nil
+	}
+	return 1, nil
+}
+
+func (f *FakeHypervisor) ShutdownDomainViaAgent(hostID, vmName string) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	d, err := f.agentDomain(hostID, vmName, "ShutdownDomainViaAgent")
+	if err != nil {
+		return err
+	}
+	if d.frozen {
+		return frozenError(vmName, "shutdown")
+	}
+	f.stopLocked(hostID, d, libvirt.DomainEventStoppedShutdown)
+	return nil
+}
+
+func (f *FakeHypervisor) RebootDomainViaAgent(hostID, vmName string) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	d, err := f.agentDomain(hostID, vmName, "RebootDomainViaAgent")
+	if err != nil {
+		return err
+	}
+	if d.frozen {
+		return frozenError(vmName, "reboot")
+	}
+	f.emitLocked(hostID, DomainEvent{Kind: DomainEventKindReboot, Name: d.name, UUID: d.uuid})
+	return nil
+}
+
+func (f *FakeHypervisor) SyncGuestTime(hostID, vmName string) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	d, err := f.agentDomain(hostID, vmName, "SyncGuestTime")
+	if err != nil {
+		return err
+	}
+	if d.frozen {
+		return frozenError(vmName, "set-time")
+	}
+	return nil
+}
+
+func (f *FakeHypervisor) PingGuestAgent(hostID, vmName string) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	_, err := f.agentDomain(hostID, vmName, "PingGuestAgent")
+	return err
+}
@@ -0,0 +1,139 @@
+package libvirt
+
+import (
+	"fmt"
+	"path"
+
+	"github.com/digitalocean/go-libvirt"
+)
+
+// volumeByPath finds the volume backing path in any pool of h.
+func (h *fakeHost) volumeByPath(volPath string) *fakeVolume {
+	for _, p := range h.pools {
+		for _, v := range p.volumes {
+			if v.path == volPath {
+				return v
+			}
+		}
+	}
+	return nil
+}
+
+// MigrateDomain moves the domain to the connected host whose URI matches the
+// destination. Disks must already be visible there unless storage is copied,
+// in which case a pool on the destination must cover each disk's directory,
+// as libvirt's storage pre-creation requires.
+func (f *FakeHypervisor) MigrateDomain(hostID, vmName string, spec MigrationSpec) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	d, err := f.domain(hostID, vmName)
+	if err != nil {
+		return err
+	}
+	if err := f.takeInjected("MigrateDomain"); err != nil {
+		return fmt.Errorf("failed to migrate domain %s to %s: %w", vmName, spec.DestinationURI, err)
+	}
+	if !d.active() {
+		return fmt.Errorf("failed to migrate domain %s to %s: Requested operation is not valid: domain is not running", vmName, spec.DestinationURI)
+	}
+	if len(d.snapshots) > 0 {
+		return fmt.Errorf("failed to migrate domain %s to %s: Requested operation is not valid: cannot migrate domain with %d snapshots", vmName, spec.DestinationURI, len(d.snapshots))
+	}
+
+	var destID string
+	var dest *fakeHost
+	for id, h := range f.hosts {
+		if id != hostID && h.connected && h.uri == spec.DestinationURI {
+			destID, dest = id, h
+			break
+		}
+	}
+	if dest == nil {
+		return fmt.Errorf("failed to migrate domain %s to %s: unable to connect to server", vmName, spec.DestinationURI)
+	}
+	for name, existing := range dest.domains {
+		if name == d.name || existing.uuid == d.uuid {
+			return fmt.Errorf("failed to migrate domain %s to %s: Requested operation is not valid: domain '%s' already exists", vmName, spec.DestinationURI, name)
+		}
+	}
+
+	hardware, err := hardwareFromXML(d.xml)
+	if err != nil {
+		return err
+	}
+	source := f.hosts[hostID]
+	type copyTarget struct {
+		pool     *fakePool
+		name     string
+		capacity uint64
+		format   string
+	}
+	var copies []copyTarget
+	for _, disk := range hardware.Disks {
+		if disk.Device != "disk" || disk.Path == "" || dest.volumeByPath(disk.Path) != nil {
+			continue
+		}
+		if !spec.CopyStorage {
+			return fmt.Errorf("failed to migrate domain %s to %s: Cannot access storage file '%s': No such file or directory", vmName, spec.DestinationURI, disk.Path)
+		}
+		var pool *fakePool
+		for _, p := range dest.pools {
+			if p.info.Path == path.Dir(disk.Path) {
+				pool = p
+				break
+			}
+		}
+		if pool == nil {
+			return fmt.Errorf("failed to migrate domain %s to %s: no storage pool on the destination contains '%s'", vmName, spec.DestinationURI, disk.Path)
+		}
+		c := copyTarget{pool: pool, name: path.Base(disk.Path)}
+		if v := source.volumeByPath(disk.Path); v != nil {
+			c.capacity, c.format = v.capacity, v.format
+		}
+		copies = append(copies, c)
+	}
+	for _, c := range copies {
+		c.pool.volumes[c.name] = &fakeVolume{name: c.name, path: path.Join(c.pool.info.Path, c.name), capacity: c.capacity, format: c.format}
+	}
+
+	state := d.state
+	f.emitLifecycleLocked(hostID, d, libvirt.DomainEventStopped, int32(libvirt.DomainEventStoppedMigrated))
+	delete(source.domains, d.name)
+	f.emitLifecycleLocked(hostID, d, libvirt.DomainEventUndefined, int32(libvirt.DomainEventUndefinedRemoved))
+
+	d.persistent = true
+	d.state = state
+	d.id = dest.nextID
+	dest.nextID++
+	dest.domains[d.name] = d
+	f.emitLifecycleLocked(destID, d, libvirt.DomainEventDefined, int32(libvirt.DomainEventDefinedAdded))
+	f.emitLifecycleLocked(destID, d, libvirt.DomainEventStarted, int32(libvirt.DomainEventStartedMigrated))
+	return nil
+}
+
+// GetDomainJobInfo reports no running job: fake migrations complete within
+// the MigrateDomain call.
+func (f *FakeHypervisor) GetDomainJobInfo(hostID, vmName string) (*DomainJobInfo, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if _, err := f.domain(hostID, vmName); err != nil {
+		return nil, err
+	}
+	if err := f.takeInjected("GetDomainJobInfo"); err != nil {
+		return nil, fmt.Errorf("failed to get job info for domain %s: %w", vmName, err)
+	}
+	return &DomainJobInfo{Type: int(libvirt.DomainJobNone)}, nil
+}
+
+func (f *FakeHypervisor) GetDomainXML(hostID, vmName string) (string, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	d, err := f.domain(hostID, vmName)
+	if err != nil {
+		return "", err
+	}
+	if err := f.takeInjected("GetDomainXML"); err != nil {
+		return "", fmt.Errorf("failed to get XML for domain %s: %w", vmName, err)
+	}
+	return d.xml, nil
+}
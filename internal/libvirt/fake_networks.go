@@ -0,0 +1,253 @@
+package libvirt
+
+import (
+	"encoding/xml"
+	"fmt"
+	"reflect"
+	"sort"
+
+	"github.com/google/uuid"
+
+	"github.com/digitalocean/go-libvirt"
+)
+
+// network looks up a virtual network on a connected host. Callers must hold f.mu.
+func (f *FakeHypervisor) network(hostID, name string) (*fakeNetwork, error) {
+	h, err := f.connectedHost(hostID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get libvirt connection: %w", err)
+	}
+	n, ok := h.networks[name]
+	if !ok {
+		return nil, fmt.Errorf("failed to find network %s: Network not found: no network with matching name '%s'", name, name)
+	}
+	return n, nil
+}
+
+// info copies the network's state so callers never share slices with the fake.
+func (n *fakeNetwork) info() VirtualNetworkInfo {
+	spec := n.spec
+	spec.IPs = nil
+	for _, ip := range n.spec.IPs {
+		ip.DHCPRanges = append([]NetworkDHCPRange(nil), ip.DHCPRanges...)
+		ip.DHCPHosts = append([]NetworkDHCPHost(nil), ip.DHCPHosts...)
+		spec.IPs = append(spec.IPs, ip)
+	}
+	spec.DNSHosts = nil
+	for _, h := range n.spec.DNSHosts {
+		h.Hostnames = append([]string(nil), h.Hostnames...)
+		spec.DNSHosts = append(spec.DNSHosts, h)
+	}
+	return VirtualNetworkInfo{UUID: n.uuid, Active: n.active, Autostart: n.autostart, Spec: spec}
+}
+
+// NetworkRestarts reports how often an active network was taken down.
+func (f *FakeHypervisor) NetworkRestarts(hostID, name string) int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if n, ok := f.host(hostID).networks[name]; ok {
+		return n.restarts
+	}
+	return 0
+}
+
+func (f *FakeHypervisor) ListAllNetworks(hostID string) ([]VirtualNetworkInfo, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	h, err := f.connectedHost(hostID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get libvirt connection: %w", err)
+	}
+	if err := f.takeInjected("ListAllNetworks"); err != nil {
+		return nil, fmt.Errorf("failed to list networks: %w", err)
+	}
+	names := make([]string, 0, len(h.networks))
+	for name := range h.networks {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	infos := make([]VirtualNetworkInfo, 0, len(names))
+	for _, name := range names {
+		infos = append(infos, h.networks[name].info())
+	}
+	return infos, nil
+}
+
+func (f *FakeHypervisor) GetNetwork(hostID, name string) (*VirtualNetworkInfo, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	n, err := f.network(hostID, name)
+	if err != nil {
+		return nil, err
+	}
+	info := n.info()
+	return &info, nil
+}
+
+func (f *FakeHypervisor) DefineNetwork(hostID string, spec NetworkSpec) error {
+	if _, err := spec.XML(""); err != nil {
+		return err
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	h, err := f.connectedHost(hostID)
+	if err != nil {
+		return fmt.Errorf("failed to get libvirt connection: %w", err)
+	}
+	if err := f.takeInjected("DefineNetwork"); err != nil {
+		return fmt.Errorf("failed to define network %s: %w", spec.Name, err)
+	}
+	if spec.Bridge == "" && spec.Mode != "bridge" {
+		spec.Bridge = fmt.Sprintf("virbr%d", len(h.networks))
+	}
+	for i := range spec.IPs {
+		spec.IPs[i].DHCPHosts = stripPortIDs(spec.IPs[i].DHCPHosts)
+	}
+	if n, ok := h.networks[spec.Name]; ok {
+		n.spec = spec
+		return nil
+	}
+	h.networks[spec.Name] = &fakeNetwork{uuid: uuid.New().String(), spec: spec}
+	return nil
+}
+
+// UpdateNetwork applies changes the way libvirt does, refusing to add an
+// entry that clashes with one already there or delete one that is missing.
+func (f *FakeHypervisor) UpdateNetwork(hostID, name string, changes []NetworkChange) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	n, err := f.network(hostID, name)
+	if err != nil {
+		return err
+	}
+	if err := f.takeInjected("UpdateNetwork"); err != nil {
+		return fmt.Errorf("failed to update network %s: %w", name, err)
+	}
+	spec := n.info().Spec
+	for _, ch := range changes {
+		if err := applyFakeNetworkChange(&spec, ch); err != nil {
+			return fmt.Errorf("failed to update network %s: %w", name, err)
+		}
+	}
+	n.spec = spec
+	return nil
+}
+
+func applyFakeNetworkChange(spec *NetworkSpec, ch NetworkChange) error {
+	if ch.Section != libvirt.NetworkSectionDNSHost && (ch.ParentIndex < 0 || ch.ParentIndex >= len(spec.IPs)) {
+		return fmt.Errorf("couldn't locate a matching IP at index %d", ch.ParentIndex)
+	}
+	switch ch.Section {
+	case libvirt.NetworkSectionIPDhcpRange:
+		var r networkDHCPRangeXML
+		if err := xml.Unmarshal([]byte(ch.XML), &r); err != nil {
+			return err
+		}
+		ip := &spec.IPs[ch.ParentIndex]
+		return applyFakeEntry(&ip.DHCPRanges, NetworkDHCPRange{Start: r.Start, End: r.End}, ch.Command, func(a, b NetworkDHCPRange) bool {
+			return a.Start == b.Start || a.End == b.End
+		})
+	case libvirt.NetworkSectionIPDhcpHost:
+		var h networkDHCPHostXML
+		if err := xml.Unmarshal([]byte(ch.XML), &h); err != nil {
+			return err
+		}
+		ip := &spec.IPs[ch.ParentIndex]
+		return applyFakeEntry(&ip.DHCPHosts, NetworkDHCPHost{MAC: h.MAC, Name: h.Name, IP: h.IP}, ch.Command, func(a, b NetworkDHCPHost) bool {
+			return a.IP == b.IP || (a.MAC != "" && a.MAC == b.MAC) || (a.Name != "" && a.Name == b.Name)
+		})
+	case libvirt.NetworkSectionDNSHost:
+		var h networkDNSHostXML
+		if err := xml.Unmarshal([]byte(ch.XML), &h); err != nil {
+			return err
+		}
+		return applyFakeEntry(&spec.DNSHosts, NetworkDNSHost{IP: h.IP, Hostnames: h.Hostnames}, ch.Command, func(a, b NetworkDNSHost) bool {
+			return a.IP == b.IP
+		})
+	}
+	return fmt.Errorf("this function is not supported by the connection driver: can't update section %d", ch.Section)
+}
+
+func applyFakeEntry[T any](entries *[]T, entry T, cmd libvirt.NetworkUpdateCommand, clash func(a, b T) bool) error {
+	switch cmd {
+	case libvirt.NetworkUpdateCommandAddLast, libvirt.NetworkUpdateCommandAddFirst:
+		for _, e := range *entries {
+			if clash(e, entry) {
+				return fmt.Errorf("there is an existing entry that matches the new one")
+			}
+		}
+		*entries = append(*entries, entry)
+		return nil
+	case libvirt.NetworkUpdateCommandDelete:
+		for i, e := range *entries {
+			if reflect.DeepEqual(e, entry) {
+				*entries = append((*entries)[:i], (*entries)[i+1:]...)
+				return nil
+			}
+		}
+		return fmt.Errorf("couldn't locate a matching entry to delete")
+	}
+	return fmt.Errorf("this function is not supported by the connection driver: command %d", cmd)
+}
+
+func (f *FakeHypervisor) StartNetwork(hostID, name string) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	n, err := f.network(hostID, name)
+	if err != nil {
+		return err
+	}
+	if err := f.takeInjected("StartNetwork"); err != nil {
+		return fmt.Errorf("failed to start network %s: %w", name, err)
+	}
+	if n.active {
+		return fmt.Errorf("failed to start network %s: Requested operation is not valid: network is already active", name)
+	}
+	n.active = true
+	return nil
+}
+
+func (f *FakeHypervisor) StopNetwork(hostID, name string) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	n, err := f.network(hostID, name)
+	if err != nil {
+		return err
+	}
+	if err := f.takeInjected("StopNetwork"); err != nil {
+		return fmt.Errorf("failed to stop network %s: %w", name, err)
+	}
+	if !n.active {
+		return fmt.Errorf("failed to stop network %s: Requested operation is not valid: network '%s' is not active", name, name)
+	}
+	n.active = false
+	n.restarts++
+	return nil
+}
+
+func (f *FakeHypervisor) SetNetworkAutostart(hostID, name string, autostart bool) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	n, err := f.network(hostID, name)
+	if err != nil {
+		return err
+	}
+	if err := f.takeInjected("SetNetworkAutostart"); err != nil {
+		return fmt.Errorf("failed to set autostart of network %s: %w", name, err)
+	}
+	n.autostart = autostart
+	return nil
+}
+
+func (f *FakeHypervisor) UndefineNetwork(hostID, name string) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if _, err := f.network(hostID, name); err != nil {
+		return err
+	}
+	if err := f.takeInjected("UndefineNetwork"); err != nil {
+		return fmt.Errorf("failed to undefine network %s: %w", name, err)
+	}
+	delete(f.hosts[hostID].networks, name)
+	return nil
+}
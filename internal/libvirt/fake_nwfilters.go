@@ -0,0 +1,98 @@
+package libvirt
+
+import (
+	"encoding/xml"
+	"fmt"
+
+	"github.com/google/uuid"
+)
+
+type fakeNWFilter struct {
+	uuid string
+	spec NWFilterSpec
+}
+
+// NWFilter returns the definition of a network filter on a host.
+func (f *FakeHypervisor) NWFilter(hostID, name string) (NWFilterSpec, bool) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	nf, ok := f.host(hostID).nwfilters[name]
+	if !ok {
+		return NWFilterSpec{}, false
+	}
+	return nf.spec, true
+}
+
+// filterRefs returns the filters the domain's interfaces reference.
+func (d *fakeDomain) filterRefs() []string {
+	var def fakeDomainXML
+	if xml.Unmarshal([]byte(d.xml), &def) != nil {
+		return nil
+	}
+	var names []string
+	for _, iface := range def.Interfaces {
+		if iface.FilterRef.Filter != "" {
+			names = append(names, iface.FilterRef.Filter)
+		}
+	}
+	return names
+}
+
+func (f *FakeHypervisor) DefineNWFilter(hostID string, spec NWFilterSpec) error {
+	if _, err := spec.XML(""); err != nil {
+		return err
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	h, err := f.connectedHost(hostID)
+	if err != nil {
+		return fmt.Errorf("failed to get libvirt connection: %w", err)
+	}
+	if err := f.takeInjected("DefineNWFilter"); err != nil {
+		return fmt.Errorf("failed to define nwfilter %s: %w", spec.Name, err)
+	}
+	spec.Filters = append([]string(nil), spec.Filters...)
+	spec.Rules = append([]NWFilterRule(nil), spec.Rules...)
+	if nf, ok := h.nwfilters[spec.Name]; ok {
+		nf.spec = spec
+		return nil
+	}
+	h.nwfilters[spec.Name] = &fakeNWFilter{uuid: uuid.New().String(), spec: spec}
+	return nil
+}
+
+// UndefineNWFilter refuses, as libvirt does, while another filter or a
+// running domain's interface references the filter.
+func (f *FakeHypervisor) UndefineNWFilter(hostID, name string) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	h, err := f.connectedHost(hostID)
+	if err != nil {
+		return fmt.Errorf("failed to get libvirt connection: %w", err)
+	}
+	if _, ok := h.nwfilters[name]; !ok {
+		return fmt.Errorf("failed to find nwfilter %s: Network filter not found: no nwfilter with matching name '%s'", name, name)
+	}
+	if err := f.takeInjected("UndefineNWFilter"); err != nil {
+		return fmt.Errorf("failed to undefine nwfilter %s: %w", name, err)
+	}
+	for _, other := range h.nwfilters {
+		for _, ref := range other.spec.Filters {
+			if ref == name {
+				return fmt.Errorf("failed to undefine nwfilter %s: Requested operation is not valid: nwfilter is in use", name)
+			}
+		}
+	}
+	for _, d := range h.domains {
+		if !d.active() {
+			continue
+		}
+		for _, ref := range d.filterRefs() {
+			if ref == name {
+				return fmt.Errorf("failed to undefine nwfilter %s: Requested operation is not valid: nwfilter is in use", name)
+			}
+		}
+	}
+	delete(h.nwfilters, name)
+	return nil
+}
@@ -0,0 +1,181 @@
+package libvirt
+
+import (
+	"fmt"
+
+	"github.com/google/uuid"
+
+	"github.com/digitalocean/go-libvirt"
+)
+
+// pool looks up a storage pool on a connected host. Callers must hold f.mu.
+func (f *FakeHypervisor) pool(hostID, poolName string) (*fakePool, error) {
+	h, err := f.connectedHost(hostID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get libvirt connection: %w", err)
+	}
+	p, ok := h.pools[poolName]
+	if !ok {
+		return nil, fmt.Errorf("failed to find storage pool %s: Storage pool not found", poolName)
+	}
+	return p, nil
+}
+
+func (p *fakePool) active() bool {
+	return p.info.State == int(libvirt.StoragePoolRunning)
+}
+
+func (f *FakeHypervisor) DefineStoragePool(hostID string, spec StoragePoolSpec) error {
+	if _, err := spec.XML(); err != nil {
+		return err
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	h, err := f.connectedHost(hostID)
+	if err != nil {
+		return fmt.Errorf("failed to get libvirt connection: %w", err)
+	}
+	if err := f.takeInjected("DefineStoragePool"); err != nil {
+		return fmt.Errorf("failed to define storage pool %s: %w", spec.Name, err)
+	}
+	if _, exists := h.pools[spec.Name]; exists {
+		return fmt.Errorf("failed to define storage pool %s: operation failed: pool '%s' already exists", spec.Name, spec.Name)
+	}
+	target := spec.TargetPath
+	switch {
+	case target == "" && spec.Type == "logical":
+		target = "/dev/" + spec.SourceName
+	case target == "" && spec.Type == "iscsi":
+		target = "/dev/disk/by-path"
+	}
+	h.pools[spec.Name] = &fakePool{
+		info: StoragePoolInfo{
+			Name:  spec.Name,
+			UUID:  uuid.New().String(),
+			State: int(libvirt.StoragePoolInactive),
+			Path:  target,
+			Type:  spec.Type,
+		},
+		volumes: make(map[string]*fakeVolume),
+		built:   !StoragePoolBuildable(spec.Type),
+	}
+	return nil
+}
+
+func (f *FakeHypervisor) BuildStoragePool(hostID, poolName string) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	p, err := f.pool(hostID, poolName)
+	if err != nil {
+		return err
+	}
+	if err := f.takeInjected("BuildStoragePool"); err != nil {
+		return fmt.Errorf("failed to build storage pool %s: %w", poolName, err)
+	}
+	if !StoragePoolBuildable(p.info.Type) {
+		return fmt.Errorf("failed to build storage pool %s: this function is not supported by the connection driver: pool does not support pool build", poolName)
+	}
+	if p.active() {
+		return fmt.Errorf("failed to build storage pool %s: Requested operation is not valid: storage pool '%s' is already active", poolName, poolName)
+	}
+	p.built = true
+	return nil
+}
+
+func (f *FakeHypervisor) StartStoragePool(hostID, poolName string) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	p, err := f.pool(hostID, poolName)
+	if err != nil {
+		return err
+	}
+	if err := f.takeInjected("StartStoragePool"); err != nil {
+		return fmt.Errorf("failed to start storage pool %s: %w", poolName, err)
+	}
+	if p.active() {
+		return fmt.Errorf("failed to start storage pool %s: Requested operation is not valid: storage pool '%s' is already active", poolName, poolName)
+	}
+	if !p.built {
+		return fmt.Errorf("failed to start storage pool %s: cannot open directory '%s': No such file or directory", poolName, p.info.Path)
+	}
+	p.info.State = int(libvirt.StoragePoolRunning)
+	return nil
+}
+
+func (f *FakeHypervisor) StopStoragePool(hostID, poolName string) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	p, err := f.pool(hostID, poolName)
+	if err != nil {
+		return err
+	}
+	if err := f.takeInjected("StopStoragePool"); err != nil {
+		return fmt.Errorf("failed to stop storage pool %s: %w", poolName, err)
+	}
+	if !p.active() {
+		return fmt.Errorf("failed to stop storage pool %s: Requested operation is not valid: storage pool '%s' is not active", poolName, poolName)
+	}
+	p.info.State = int(libvirt.StoragePoolInactive)
+	return nil
+}
+
+func (f *FakeHypervisor) RefreshStoragePool(hostID, poolName string) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	p, err := f.pool(hostID, poolName)
+	if err != nil {
+		return err
+	}
+	if err := f.takeInjected("RefreshStoragePool"); err != nil {
+		return fmt.Errorf("failed to refresh storage pool %s: %w", poolName, err)
+	}
+	if !p.active() {
+		return fmt.Errorf("failed to refresh storage pool %s: Requested operation is not valid: storage pool '%s' is not active", poolName, poolName)
+	}
+	return nil
+}
+
+func (f *FakeHypervisor) SetStoragePoolAutostart(hostID, poolName string, autostart bool) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	p, err := f.pool(hostID, poolName)
+	if err != nil {
+		return err
+	}
+	if err := f.takeInjected("SetStoragePoolAutostart"); err != nil {
+		return fmt.Errorf("failed to set autostart of storage pool %s: %w", poolName, err)
+	}
+	p.info.Autostart = autostart
+	return nil
+}
+
+// UndefineStoragePool follows libvirt in refusing to delete the directory
+// of a pool that still holds volumes.
+func (f *FakeHypervisor) UndefineStoragePool(hostID, poolName string, deleteStorage bool) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	h, err := f.connectedHost(hostID)
+	if err != nil {
+		return fmt.Errorf("failed to get libvirt connection: %w", err)
+	}
+	p, err := f.pool(hostID, poolName)
+	if err != nil {
+		return err
+	}
+	if err := f.takeInjected("UndefineStoragePool"); err != nil {
+		return fmt.Errorf("failed to undefine storage pool %s: %w", poolName, err)
+	}
+	if p.active() {
+		return fmt.Errorf("failed to undefine storage pool %s: Requested operation is not valid: storage pool '%s' is still active", poolName, poolName)
+	}
+	if deleteStorage {
+		if !StoragePoolBuildable(p.info.Type) {
+			return fmt.Errorf("failed to delete storage of pool %s: this function is not supported by the connection driver: pool does not support pool deletion", poolName)
+		}
+		if len(p.volumes) > 0 && p.info.Type != "logical" {
+			return fmt.Errorf("failed to delete storage of pool %s: cannot remove directory '%s': Directory not empty", poolName, p.info.Path)
+		}
+	}
+	delete(h.pools, poolName)
+	return nil
+}
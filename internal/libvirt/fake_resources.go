@@ -0,0 +1,180 @@
+package libvirt
+
+import (
+	"encoding/xml"
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+var (
+	fakeVcpuRe          = regexp.MustCompile(`<vcpu\b([^>]*)>[^<]*</vcpu>`)
+	fakeVcpuCurrentRe   = regexp.MustCompile(`\s+current=['"][^'"]*['"]`)
+	fakeMemoryRe        = regexp.MustCompile(`<memory\b[^>]*>[^<]*</memory>`)
+	fakeCurrentMemoryRe = regexp.MustCompile(`<currentMemory\b[^>]*>[^<]*</currentMemory>`)
+)
+
+// config parses the domain's persistent definition.
+func (d *fakeDomain) config() (fakeDomainXML, error) {
+	var def fakeDomainXML
+	err := xml.Unmarshal([]byte(d.xml), &def)
+	return def, err
+}
+
+// configVcpus returns the maximum and current vCPUs of a definition.
+func (def fakeDomainXML) configVcpus() (maximum, current uint) {
+	maximum, current = def.VCPU.Value, def.VCPU.Current
+	if current == 0 {
+		current = maximum
+	}
+	return maximum, current
+}
+
+// configMemory returns the maximum and current memory of a definition.
+func (def fakeDomainXML) configMemory() (maxKB, currentKB uint64) {
+	maxKB = toKiB(def.Memory.Value, def.Memory.Unit)
+	currentKB = toKiB(def.CurrentMemory.Value, def.CurrentMemory.Unit)
+	if currentKB == 0 {
+		currentKB = maxKB
+	}
+	return maxKB, currentKB
+}
+
+// setConfigVcpus rewrites the <vcpu> element of the definition. An inactive
+// domain picks the change up at once.
+func (d *fakeDomain) setConfigVcpus(maximum, current uint) {
+	d.xml = fakeVcpuRe.ReplaceAllStringFunc(d.xml, func(el string) string {
+		attrs := fakeVcpuCurrentRe.ReplaceAllString(fakeVcpuRe.FindStringSubmatch(el)[1], "")
+		if current < maximum {
+			attrs += fmt.Sprintf(" current='%d'", current)
+		}
+		return fmt.Sprintf("<vcpu%s>%d</vcpu>", attrs, maximum)
+	})
+	if !d.active() {
+		d.maxVcpus, d.vcpus = maximum, current
+	}
+}
+
+// setConfigMemory rewrites the <memory> and <currentMemory> elements of the
+// definition. An inactive domain picks the change up at once.
+func (d *fakeDomain) setConfigMemory(maxKB, currentKB uint64) {
+	d.xml = fakeMemoryRe.ReplaceAllString(d.xml, fmt.Sprintf("<memory unit='KiB'>%d</memory>", maxKB))
+	current := fmt.Sprintf("<currentMemory unit='KiB'>%d</currentMemory>", currentKB)
+	if fakeCurrentMemoryRe.MatchString(d.xml) {
+		d.xml = fakeCurrentMemoryRe.ReplaceAllString(d.xml, current)
+	} else {
+		d.xml = strings.Replace(d.xml, "</memory>", "</memory>\n  "+current, 1)
+	}
+	if !d.active() {
+		d.maxMemKB, d.memKB = maxKB, currentKB
+	}
+}
+
+func (f *FakeHypervisor) SetDomainVcpus(hostID, vmName string, count uint, live bool) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	d, err := f.domain(hostID, vmName)
+	if err != nil {
+		return err
+	}
+	if err := f.takeInjected("SetDomainVcpus"); err != nil {
+		return fmt.Errorf("failed to set vcpus of domain %s to %d: %w", vmName, count, err)
+	}
+	def, err := d.config()
+	if err != nil {
+		return fmt.Errorf("failed to set vcpus of domain %s to %d: %w", vmName, count, err)
+	}
+	maximum, _ := def.configVcpus()
+	switch {
+	case count == 0:
+		return fmt.Errorf("failed to set vcpus of domain %s to %d: invalid argument: argument unsupported: 0 vcpus", vmName, count)
+	case count > maximum:
+		return fmt.Errorf("failed to set vcpus of domain %s to %d: invalid argument: requested vcpus is greater than max allowable vcpus for the persistent domain: %d > %d", vmName, count, count, maximum)
+	case live && !d.active():
+		return fmt.Errorf("failed to set vcpus of domain %s to %d: Requested operation is not valid: domain is not running", vmName, count)
+	case live && count > d.maxVcpus:
+		return fmt.Errorf("failed to set vcpus of domain %s to %d: invalid argument: requested vcpus is greater than max allowable vcpus for the live domain: %d > %d", vmName, count, count, d.maxVcpus)
+	}
+	if live {
+		d.vcpus = count
+	}
+	d.setConfigVcpus(maximum, count)
+	return nil
+}
+
+func (f *FakeHypervisor) SetDomainMaxVcpus(hostID, vmName string, count uint) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	d, err := f.domain(hostID, vmName)
+	if err != nil {
+		return err
+	}
+	if err := f.takeInjected("SetDomainMaxVcpus"); err != nil {
+		return fmt.Errorf("failed to set maximum vcpus of domain %s to %d: %w", vmName, count, err)
+	}
+	def, err := d.config()
+	if err != nil {
+		return fmt.Errorf("failed to set maximum vcpus of domain %s to %d: %w", vmName, count, err)
+	}
+	if count == 0 {
+		return fmt.Errorf("failed to set maximum vcpus of domain %s to %d: invalid argument: argument unsupported: 0 vcpus", vmName, count)
+	}
+	_, current := def.configVcpus()
+	if current > count {
+		current = count
+	}
+	d.setConfigVcpus(count, current)
+	return nil
+}
+
+func (f *FakeHypervisor) SetDomainMemory(hostID, vmName string, memoryKB uint64, live bool) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	d, err := f.domain(hostID, vmName)
+	if err != nil {
+		return err
+	}
+	if err := f.takeInjected("SetDomainMemory"); err != nil {
+		return fmt.Errorf("failed to set memory of domain %s to %d KiB: %w", vmName, memoryKB, err)
+	}
+	def, err := d.config()
+	if err != nil {
+		return fmt.Errorf("failed to set memory of domain %s to %d KiB: %w", vmName, memoryKB, err)
+	}
+	maxKB, _ := def.configMemory()
+	switch {
+	case memoryKB > maxKB:
+		return fmt.Errorf("failed to set memory of domain %s to %d KiB: invalid argument: cannot set memory higher than max memory", vmName, memoryKB)
+	case live && !d.active():
+		return fmt.Errorf("failed to set memory of domain %s to %d KiB: Requested operation is not valid: domain is not running", vmName, memoryKB)
+	case live && memoryKB > d.maxMemKB:
+		return fmt.Errorf("failed to set memory of domain %s to %d KiB: invalid argument: cannot set memory higher than max memory", vmName, memoryKB)
+	}
+	if live {
+		d.memKB = memoryKB
+	}
+	d.setConfigMemory(maxKB, memoryKB)
+	return nil
+}
+
+func (f *FakeHypervisor) SetDomainMaxMemory(hostID, vmName string, memoryKB uint64) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	d, err := f.domain(hostID, vmName)
+	if err != nil {
+		return err
+	}
+	if err := f.takeInjected("SetDomainMaxMemory"); err != nil {
+		return fmt.Errorf("failed to set maximum memory of domain %s to %d KiB: %w", vmName, memoryKB, err)
+	}
+	def, err := d.config()
+	if err != nil {
+		return fmt.Errorf("failed to set maximum memory of domain %s to %d KiB: %w", vmName, memoryKB, err)
+	}
+	_, currentKB := def.configMemory()
+	if currentKB > memoryKB {
+		currentKB = memoryKB
+	}
+	d.setConfigMemory(memoryKB, currentKB)
+	return nil
+}
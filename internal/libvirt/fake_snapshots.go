@@ -0,0 +1,179 @@
+package libvirt
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/digitalocean/go-libvirt"
+)
+
+// fakeSnapshot records what a snapshot captured so a revert can restore it.
+type fakeSnapshot struct {
+	info  SnapshotInfo
+	xml   string
+	state libvirt.DomainState
+}
+
+// snapshot looks up a snapshot of a domain on a connected host. Callers must hold f.mu.
+func (f *FakeHypervisor) snapshot(hostID, vmName, snapshotName string) (*fakeDomain, *fakeSnapshot, error) {
+	d, err := f.domain(hostID, vmName)
+	if err != nil {
+		return nil, nil, err
+	}
+	for _, snap := range d.snapshots {
+		if snap.info.Name == snapshotName {
+			return d, snap, nil
+		}
+	}
+	return nil, nil, fmt.Errorf("could not find snapshot '%s' of VM '%s': Domain snapshot not found", snapshotName, vmName)
+}
+
+// fakeSnapshotState maps a domain state to the state name libvirt records in
+// snapshot XML.
+func fakeSnapshotState(state libvirt.DomainState, diskOnly bool) string {
+	if diskOnly {
+		return "disk-snapshot"
+	}
+	switch state {
+	case libvirt.DomainRunning:
+		return "running"
+	case libvirt.DomainPaused:
+		return "paused"
+	default:
+		return "shutoff"
+	}
+}
+
+func (f *FakeHypervisor) ListDomainSnapshots(hostID, vmName string) ([]SnapshotInfo, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	d, err := f.domain(hostID, vmName)
+	if err != nil {
+		return nil, err
+	}
+	if err := f.takeInjected("ListDomainSnapshots"); err != nil {
+		return nil, fmt.Errorf("failed to list snapshots for domain %s: %w", vmName, err)
+	}
+	result := make([]SnapshotInfo, 0, len(d.snapshots))
+	for _, snap := range d.snapshots {
+		info := snap.info
+		info.Current = info.Name == d.currentSnapshot
+		result = append(result, info)
+	}
+	sortSnapshots(result)
+	return result, nil
+}
+
+func (f *FakeHypervisor) CreateDomainSnapshot(hostID, vmName string, spec SnapshotSpec) (*SnapshotInfo, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	d, err := f.domain(hostID, vmName)
+	if err != nil {
+		return nil, err
+	}
+	if err := f.takeInjected("CreateDomainSnapshot"); err != nil {
+		return nil, fmt.Errorf("failed to create snapshot %s of domain %s: %w", spec.Name, vmName, err)
+	}
+	hardware, err := hardwareFromXML(d.xml)
+	if err != nil {
+		return nil, err
+	}
+	if _, _, err := buildSnapshotXML(vmName, spec, hardware.Disks); err != nil {
+		return nil, err
+	}
+	for _, snap := range d.snapshots {
+		if snap.info.Name == spec.Name {
+			return nil, fmt.Errorf("failed to create snapshot %s of domain %s: Operation not supported: domain snapshot %s already exists", spec.Name, vmName, spec.Name)
+		}
+	}
+	if spec.External && !spec.DiskOnly && !d.active() {
+		return nil, fmt.Errorf("failed to create snapshot %s of domain %s: Requested operation is not valid: memory snapshots require a running domain", spec.Name, vmName)
+	}
+
+	// Keep creation times strictly increasing so ordering is stable even
+	// when several snapshots are taken within a second.
+	created := time.Now().Unix()
+	if n := len(d.snapshots); n > 0 && created <= d.snapshots[n-1].info.CreationTime {
+		created = d.snapshots[n-1].info.CreationTime + 1
+	}
+	snap := &fakeSnapshot{
+		info: SnapshotInfo{
+			Name:         spec.Name,
+			Description:  spec.Description,
+			Parent:       d.currentSnapshot,
+			State:        fakeSnapshotState(d.state, spec.DiskOnly),
+			CreationTime: created,
+			External:     spec.External,
+			HasMemory:    !spec.DiskOnly && d.active(),
+		},
+		xml:   d.xml,
+		state: d.state,
+	}
+	snap.info.XML = fmt.Sprintf("<domainsnapshot><name>%s</name><state>%s</state></domainsnapshot>", spec.Name, snap.info.State)
+	d.snapshots = append(d.snapshots, snap)
+	d.currentSnapshot = spec.Name
+
+	info := snap.info
+	info.Current = true
+	return &info, nil
+}
+
+func (f *FakeHypervisor) RevertDomainSnapshot(hostID, vmName, snapshotName string) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	d, snap, err := f.snapshot(hostID, vmName, snapshotName)
+	if err != nil {
+		return err
+	}
+	if err := f.takeInjected("RevertDomainSnapshot"); err != nil {
+		return fmt.Errorf("failed to revert domain %s to snapshot %s: %w", vmName, snapshotName, err)
+	}
+	if snap.info.External {
+		return fmt.Errorf("failed to revert domain %s to snapshot %s: Operation not supported: revert to external snapshot not supported yet", vmName, snapshotName)
+	}
+
+	h := f.hosts[hostID]
+	if _, err := h.define(snap.xml); err != nil {
+		return err
+	}
+	d.currentSnapshot = snapshotName
+	switch {
+	case snap.info.HasMemory && !d.active():
+		d.state = snap.state
+		d.id = h.nextID
+		h.nextID++
+		f.emitLifecycleLocked(hostID, d, libvirt.DomainEventStarted, int32(libvirt.DomainEventStartedFromSnapshot))
+	case snap.info.HasMemory:
+		d.state = snap.state
+	case d.active():
+		f.stopLocked(hostID, d, libvirt.DomainEventStoppedFromSnapshot)
+	}
+	return nil
+}
+
+func (f *FakeHypervisor) DeleteDomainSnapshot(hostID, vmName, snapshotName string) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	d, snap, err := f.snapshot(hostID, vmName, snapshotName)
+	if err != nil {
+		return err
+	}
+	if err := f.takeInjected("DeleteDomainSnapshot"); err != nil {
+		return fmt.Errorf("failed to delete snapshot %s of domain %s: %w", snapshotName, vmName, err)
+	}
+	kept := d.snapshots[:0]
+	for _, other := range d.snapshots {
+		if other == snap {
+			continue
+		}
+		if other.info.Parent == snapshotName {
+			other.info.Parent = snap.info.Parent
+		}
+		kept = append(kept, other)
+	}
+	d.snapshots = kept
+	if d.currentSnapshot == snapshotName {
+		d.currentSnapshot = snap.info.Parent
+	}
+	return nil
+}
@@ -0,0 +1,147 @@
+package libvirt
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"path"
+)
+
+// qcow2Magic starts every qcow2 image; the fake probes uploaded content
+// for it the way a pool refresh does.
+var qcow2Magic = []byte{'Q', 'F', 'I', 0xfb}
+
+func (f *FakeHypervisor) CreateRawStorageVolume(hostID, poolName, volumeName string, capacityBytes uint64) (string, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	h, err := f.connectedHost(hostID)
+	if err != nil {
+		return "", fmt.Errorf("failed to get libvirt connection: %w", err)
+	}
+	p, ok := h.pools[poolName]
+	if !ok {
+		return "", fmt.Errorf("failed to find storage pool %s: Storage pool not found", poolName)
+	}
+	if err := f.takeInjected("CreateRawStorageVolume"); err != nil {
+		return "", fmt.Errorf("failed to create storage volume: %w", err)
+	}
+	if _, exists := p.volumes[volumeName]; exists {
+		return "", fmt.Errorf("failed to create storage volume: storage volume '%s' already exists", volumeName)
+	}
+	volPath := path.Join(p.info.Path, volumeName)
+	p.volumes[volumeName] = &fakeVolume{name: volumeName, path: volPath, capacity: capacityBytes, size: capacityBytes, format: "raw"}
+	return volPath, nil
+}
+
+func (f *FakeHypervisor) GetStorageVolume(hostID, volPath string) (*VolumeDetail, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	h, err := f.connectedHost(hostID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get libvirt connection: %w", err)
+	}
+	for poolName, p := range h.pools {
+		for _, v := range p.volumes {
+			if v.path != volPath {
+				continue
+			}
+			detail := &VolumeDetail{
+				Name:        v.name,
+				Capacity:    v.capacity,
+				Allocation:  v.allocation,
+				Physical:    v.fileSize(),
+				Path:        v.path,
+				Format:      v.format,
+				BackingPath: v.backing,
+				PoolName:    poolName,
+			}
+			if bytes.HasPrefix(v.data, qcow2Magic) && len(v.data) >= 32 {
+				detail.Format = "qcow2"
+				detail.Capacity = binary.BigEndian.Uint64(v.data[24:32])
+			}
+			return detail, nil
+		}
+	}
+	return nil, fmt.Errorf("failed to find storage volume %s: Storage volume not found", volPath)
+}
+
+func (v *fakeVolume) fileSize() uint64 {
+	if v.size > uint64(len(v.data)) {
+		return v.size
+	}
+	return uint64(len(v.data))
+}
+
+// fakeStreamVolume looks up a volume for an upload or download. Callers
+// must hold f.mu.
+func (f *FakeHypervisor) fakeStreamVolume(hostID, volPath, method string) (*fakeVolume, error) {
+	h, err := f.connectedHost(hostID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get libvirt connection: %w", err)
+	}
+	v := h.volumeByPath(volPath)
+	if v == nil {
+		return nil, fmt.Errorf("failed to find storage volume %s: Storage volume not found", volPath)
+	}
+	return v, f.takeInjected(method)
+}
+
+func (f *FakeHypervisor) UploadStorageVolume(hostID, volPath string, r io.Reader, offset, length uint64) error {
+	f.mu.Lock()
+	v, err := f.fakeStreamVolume(hostID, volPath, "UploadStorageVolume")
+	f.mu.Unlock()
+	if err != nil {
+		return fmt.Errorf("failed to upload to storage volume %s: %w", volPath, err)
+	}
+	if length > 0 {
+		r = io.LimitReader(r, int64(length))
+	}
+	// Read outside the lock; the caller may be feeding r from another
+	// goroutine.
+	content, err := io.ReadAll(r)
+	if err != nil {
+		return fmt.Errorf("failed to upload to storage volume %s: %w", volPath, err)
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	end := offset + uint64(len(content))
+	if v.size > 0 && end > v.size {
+		return fmt.Errorf("failed to upload to storage volume %s: invalid argument: can't write past the end of the volume", volPath)
+	}
+	if end > uint64(len(v.data)) {
+		v.data = append(v.data, make([]byte, end-uint64(len(v.data)))...)
+	}
+	copy(v.data[offset:], content)
+	v.allocation += uint64(len(content))
+	return nil
+}
+
+func (f *FakeHypervisor) DownloadStorageVolume(hostID, volPath string, w io.Writer, offset, length uint64) error {
+	f.mu.Lock()
+	v, err := f.fakeStreamVolume(hostID, volPath, "DownloadStorageVolume")
+	if err != nil {
+		f.mu.Unlock()
+		return fmt.Errorf("failed to download storage volume %s: %w", volPath, err)
+	}
+	size := v.fileSize()
+	if offset > size {
+		f.mu.Unlock()
+		return fmt.Errorf("failed to download storage volume %s: invalid argument: offset is past the end of the volume", volPath)
+	}
+	end := size
+	if length > 0 && offset+length < size {
+		end = offset + length
+	}
+	content := make([]byte, end-offset)
+	if offset < uint64(len(v.data)) {
+		copy(content, v.data[offset:])
+	}
+	f.mu.Unlock()
+
+	if _, err := w.Write(content); err != nil {
+		return fmt.Errorf("failed to download storage volume %s: %w", volPath, err)
+	}
+	return nil
+}
@@ -0,0 +1,251 @@
+package libvirt
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	log "github.com/capsali/virtumancer/internal/logging"
+
+	"github.com/digitalocean/go-libvirt"
+)
+
+// guestExecPollInterval is how often a running guest command is checked.
+const guestExecPollInterval = 200 * time.Millisecond
+
+// GuestAgentUnavailableError reports that a domain's QEMU guest agent cannot
+// be reached: the domain is not running, has no agent channel, or no agent
+// answers on it.
+type GuestAgentUnavailableError struct {
+	VM     string
+	Reason string
+}
+
+func (e *GuestAgentUnavailableError) Error() string {
+	return fmt.Sprintf("guest agent of %s is unavailable: %s", e.VM, e.Reason)
+}
+
+// GuestCommand is a program to run inside a guest. Input is written to its
+// standard input.
+type GuestCommand struct {
+	Path  string   `json:"path"`
+	Args  []string `json:"args,omitempty"`
+	Env   []string `json:"env,omitempty"`
+	Input string   `json:"input,omitempty"`
+}
+
+// GuestExecResult is the outcome of a guest command. The agent caps captured
+// output and sets the truncated flags when it does.
+type GuestExecResult struct {
+	PID             int    `json:"pid"`
+	ExitCode        int    `json:"exit_code"`
+	Signal          int    `json:"signal,omitempty"`
+	Stdout          string `json:"stdout"`
+	Stderr          string `json:"stderr"`
+	StdoutTruncated bool   `json:"stdout_truncated,omitempty"`
+	StderrTruncated bool   `json:"stderr_truncated,omitempty"`
+}
+
+type guestExecStatus struct {
+	Exited       bool   `json:"exited"`
+	ExitCode     int    `json:"exitcode"`
+	Signal       int    `json:"signal"`
+	OutData      string `json:"out-data"`
+	ErrData      string `json:"err-data"`
+	OutTruncated bool   `json:"out-truncated"`
+	ErrTruncated bool   `json:"err-truncated"`
+}
+
+// agentError wraps the error of a guest agent call, turning libvirt's
+// errors for an unreachable agent into a GuestAgentUnavailableError.
+func agentError(vmName, op string, err error) error {
+	var lerr libvirt.Error
+	if errors.As(err, &lerr) {
+		switch {
+		case lerr.Code == uint32(libvirt.ErrAgentUnresponsive),
+			lerr.Code == uint32(libvirt.ErrArgumentUnsupported) && strings.Contains(lerr.Message, "agent"),
+			lerr.Code == uint32(libvirt.ErrOperationInvalid) && strings.Contains(lerr.Message, "not running"):
+			return &GuestAgentUnavailableError{VM: vmName, Reason: lerr.Message}
+		}
+	}
+	return fmt.Errorf("libvirt guest agent %s failed for %s: %w", op, vmName, err)
+}
+
+// agentCommand sends a raw QMP command to the guest agent and decodes the
+// "return" member of its reply into out.
+func agentCommand(l *libvirt.Libvirt, domain libvirt.Domain, vmName, execute string, args interface{}, out interface{}) error {
+	cmd := map[string]interface{}{"execute": execute}
+	if args != nil {
+		cmd["arguments"] = args
+	}
+	payload, err := json.Marshal(cmd)
+	if err != nil {
+		return fmt.Errorf("failed to encode guest agent command %s: %w", execute, err)
+	}
+	reply, err := l.QEMUDomainAgentCommand(domain, string(payload), int32(libvirt.DomainAgentResponseTimeoutDefault), 0)
+	if err != nil {
+		return agentError(vmName, execute, err)
+	}
+	if out == nil || len(reply) == 0 {
+		return nil
+	}
+	var resp struct {
+		Return json.RawMessage `json:"return"`
+	}
+	if err := json.Unmarshal([]byte(reply[0]), &resp); err != nil {
+		return fmt.Errorf("failed to decode guest agent reply to %s: %w", execute, err)
+	}
+	if err := json.Unmarshal(resp.Return, out); err != nil {
+		return fmt.Errorf("failed to decode guest agent reply to %s: %w", execute, err)
+	}
+	return nil
+}
+
+// GuestExec runs a command in the guest through its agent and waits up to
+// timeout for it to exit, returning its exit code and captured output.
+func (c *Connector) GuestExec(hostID, vmName string, cmd GuestCommand, timeout time.Duration) (*GuestExecResult, error) {
+	l, domain, err := c.getDomainByName(hostID, vmName)
+	if err != nil {
+		return nil, err
+	}
+	args := map[string]interface{}{
+		"path":           cmd.Path,
+		"arg":            cmd.Args,
+		"capture-output": true,
+	}
+	if len(cmd.Env) > 0 {
+		args["env"] = cmd.Env
+	}
+	if cmd.Input != "" {
+		args["input-data"] = base64.StdEncoding.EncodeToString([]byte(cmd.Input))
+	}
+	var started struct {
+		PID int `json:"pid"`
+	}
+	if err := agentCommand(l, domain, vmName, "guest-exec", args, &started); err != nil {
+		return nil, err
+	}
+	log.Debugf("Started guest command %s (pid %d) in %s on host %s", cmd.Path, started.PID, vmName, hostID)
+
+	deadline := time.Now().Add(timeout)
+	for {
+		var status guestExecStatus
+		if err := agentCommand(l, domain, vmName, "guest-exec-status", map[string]int{"pid": started.PID}, &status); err != nil {
+			return nil, err
+		}
+		if status.Exited {
+			stdout, _ := base64.StdEncoding.DecodeString(status.OutData)
+			stderr, _ := base64.StdEncoding.DecodeString(status.ErrData)
+			return &GuestExecResult{
+				PID:             started.PID,
+				ExitCode:        status.ExitCode,
+				Signal:          status.Signal,
+				Stdout:          string(stdout),
+				Stderr:          string(stderr),
+				StdoutTruncated: status.OutTruncated,
+				StderrTruncated: status.ErrTruncated,
+			}, nil
+		}
+		if time.Now().After(deadline) {
+			return nil, fmt.Errorf("timeout waiting for guest command %s (pid %d) in %s after %s", cmd.Path, started.PID, vmName, timeout)
+		}
+		time.Sleep(guestExecPollInterval)
+	}
+}
+
+// SetGuestUserPassword sets the password of a guest account. With
+// encrypted, password is already a crypt(3) hash.
+func (c *Connector) SetGuestUserPassword(hostID, vmName, user, password string, encrypted bool) error {
+	l, domain, err := c.getDomainByName(hostID, vmName)
+	if err != nil {
+		return err
+	}
+	var flags libvirt.DomainSetUserPasswordFlags
+	if encrypted {
+		flags = libvirt.DomainPasswordEncrypted
+	}
+	if err := l.DomainSetUserPassword(domain, libvirt.OptString{user}, libvirt.OptString{password}, flags); err != nil {
+		return agentError(vmName, "set-user-password", err)
+	}
+	return nil
+}
+
+// FreezeGuestFilesystems quiesces and freezes the guest's filesystems, or
+// only those mounted at mountpoints, and returns how many were frozen.
+func (c *Connector) FreezeGuestFilesystems(hostID, vmName string, mountpoints []string) (int, error) {
+	l, domain, err := c.getDomainByName(hostID, vmName)
+	if err != nil {
+		return 0, err
+	}
+	n, err := l.DomainFsfreeze(domain, mountpoints, 0)
+	if err != nil {
+		return 0, agentError(vmName, "fsfreeze", err)
+	}
+	return int(n), nil
+}
+
+// ThawGuestFilesystems thaws filesystems frozen by FreezeGuestFilesystems
+// and returns how many were thawed.
+func (c *Connector) ThawGuestFilesystems(hostID, vmName string, mountpoints []string) (int, error) {
+	l, domain, err := c.getDomainByName(hostID, vmName)
+	if err != nil {
+		return 0, err
+	}
+	n, err := l.DomainFsthaw(domain, mountpoints, 0)
+	if err != nil {
+		return 0, agentError(vmName, "fsthaw", err)
+	}
+	return int(n), nil
+}
+
+// ShutdownDomainViaAgent asks the guest agent, rather than ACPI, to shut the
+// guest down.
+func (c *Connector) ShutdownDomainViaAgent(hostID, vmName string) error {
+	l, domain, err := c.getDomainByName(hostID, vmName)
+	if err != nil {
+		return err
+	}
+	if err := l.DomainShutdownFlags(domain, libvirt.DomainShutdownGuestAgent); err != nil {
+		return agentError(vmName, "shutdown", err)
+	}
+	return nil
+}
+
+// RebootDomainViaAgent asks the guest agent to reboot the guest.
+func (c *Connector) RebootDomainViaAgent(hostID, vmName string) error {
+	l, domain, err := c.getDomainByName(hostID, vmName)
+	if err != nil {
+		return err
+	}
+	if err := l.DomainReboot(domain, libvirt.DomainRebootGuestAgent); err != nil {
+		return agentError(vmName, "reboot", err)
+	}
+	return nil
+}
+
+// SyncGuestTime has the guest agent reset the guest's clock from its
+// emulated hardware clock, which follows the host. Guests need this after
+// being paused or restored.
+func (c *Connector) SyncGuestTime(hostID, vmName string) error {
+	l, domain, err := c.getDomainByName(hostID, vmName)
+	if err != nil {
+		return err
+	}
+	if err := l.DomainSetTime(domain, 0, 0, libvirt.DomainTimeSync); err != nil {
+		return agentError(vmName, "set-time", err)
+	}
+	return nil
+}
+
+// PingGuestAgent checks that the guest agent answers, which it only does
+// once the guest OS has booted far enough to start it.
+func (c *Connector) PingGuestAgent(hostID, vmName string) error {
+	l, domain, err := c.getDomainByName(hostID, vmName)
+	if err != nil {
+		return err
+	}
+	return agentCommand(l, domain, vmName, "guest-ping", nil, nil)
+}
@@ -0,0 +1,142 @@
+package libvirt
+
+import (
+	"context"
+	"io"
+	"time"
+
+	"github.com/capsali/virtumancer/internal/storage"
+	"github.com/digitalocean/go-libvirt"
+)
+
+// Hypervisor is the set of host and domain operations the service and API
+// layers depend on. Connector implements it against real libvirt daemons;
+// FakeHypervisor implements it in memory for tests.
+type Hypervisor interface {
+	// Connection management
+	AddHost(host storage.Host) error
+	RemoveHost(hostID string) error
+	IsConnected(hostID string) bool
+	ConnectionLost(hostID string) (<-chan struct{}, error)
+	LearnedHostKeys(hostID string) string
+	// GetConnection exposes the raw RPC client for callers that need
+	// libvirt calls not covered by this interface (consoles, capabilities).
+	GetConnection(hostID string) (*libvirt.Libvirt, error)
+
+	// Events
+	SubscribeDomainEvents(ctx context.Context, hostID string) (<-chan DomainEvent, error)
+
+	// Host information
+	GetHostInfo(hostID string) (*HostInfo, error)
+	GetHostStats(hostID string) (*HostStats, error)
+	GetNodePerformance(hostID string) (*NodePerformanceInfo, error)
+
+	// Inventory
+	ListAllDomains(hostID string) ([]VMInfo, error)
+	ListAllStoragePools(hostID string) ([]StoragePoolInfo, error)
+
+	// Domain information
+	GetDomainInfo(hostID, vmName string) (*VMInfo, error)
+	GetDomainStats(hostID, vmName string) (*VMStats, error)
+	GetDomainHardware(hostID, vmName string) (*HardwareInfo, error)
+	GetDomainMemoryDetails(hostID, vmName string) (*MemoryDetails, error)
+	GetDomainCPUDetails(hostID, vmName string) (*CPUDetails, error)
+	GetDomainBlockDetails(hostID, vmName string) ([]BlockDeviceDetail, error)
+	GetDomainSecurityDetails(hostID, vmName string) ([]SecurityDetail, error)
+	GetDomainIOThreadDetails(hostID, vmName string) ([]IOThreadDetail, error)
+	GetDomainNUMADetails(hostID, vmName string) (*NUMADetails, error)
+	GetDomainMemoryStats(hostID, vmName string) (*MemoryStats, error)
+	GetDomainGuestAgentDetails(hostID, vmName string) (*GuestAgentDetails, error)
+	GetDomainPerformanceDetails(hostID, vmName string) (*PerformanceDetails, error)
+	GetDomainCPUPerformance(hostID, vmName string) (*CPUPerformanceDetails, error)
+	GetDomainInterfaceAddresses(hostID, vmName string) (*NetworkInterfaceDetails, error)
+	GetDomainHybridDetails(hostID, vmName string) (*HybridDomainDetails, error)
+	GetDomainOptimizedSync(hostID, vmName string) (*OptimizedSyncData, error)
+	GetDomainXMLOnlyFeatures(hostID, vmName string) (*XMLOnlyFeatures, error)
+	GetEnhancedDiskInfo(hostID, vmUUID string, disks []DiskInfo) ([]EnhancedDiskInfo, error)
+	GetEnhancedNetworkInfo(hostID, vmUUID string, networks []NetworkInfo) ([]EnhancedNetworkInfo, error)
+	GetDevicePerformance(hostID, vmUUID string) ([]DevicePerformanceInfo, error)
+
+	// Domain lifecycle
+	StartDomain(hostID, vmName string) error
+	ShutdownDomain(hostID, vmName string) error
+	RebootDomain(hostID, vmName string) error
+	DestroyDomain(hostID, vmName string) error
+	ResetDomain(hostID, vmName string) error
+	SuspendDomain(hostID, vmName string) error
+	ResumeDomain(hostID, vmName string) error
+	ManagedSaveDomain(hostID, vmName string) error
+	DefineAndCreateDomain(hostID, domainXML string) (*libvirt.Domain, error)
+	UndefineDomain(hostID, vmName string) error
+	DeleteDomain(hostID, vmName string) error
+
+	// Snapshots
+	ListDomainSnapshots(hostID, vmName string) ([]SnapshotInfo, error)
+	CreateDomainSnapshot(hostID, vmName string, spec SnapshotSpec) (*SnapshotInfo, error)
+	RevertDomainSnapshot(hostID, vmName, snapshotName string) error
+	DeleteDomainSnapshot(hostID, vmName, snapshotName string) error
+
+	// Migration
+	MigrateDomain(hostID, vmName string, spec MigrationSpec) error
+	GetDomainJobInfo(hostID, vmName string) (*DomainJobInfo, error)
+	GetDomainXML(hostID, vmName string) (string, error)
+
+	// Devices
+	AttachDevice(hostID, vmName, deviceXML string) error
+	DetachDevice(hostID, vmName, deviceXML string) error
+	UpdateDevice(hostID, vmName, deviceXML string) error
+
+	// Resources
+	SetDomainVcpus(hostID, vmName string, count uint, live bool) error
+	SetDomainMaxVcpus(hostID, vmName string, count uint) error
+	SetDomainMemory(hostID, vmName string, memoryKB uint64, live bool) error
+	SetDomainMaxMemory(hostID, vmName string, memoryKB uint64) error
+
+	// Storage
+	CreateStorageVolume(hostID, poolName, volumeName string, capacityBytes uint64) (string, error)
+	DeleteStorageVolume(hostID, poolName, volumeName string) error
+	CloneStorageVolume(spec VolumeCloneSpec) (*VolumeDetail, error)
+	ResizeStorageVolume(hostID, poolName, volumeName string, capacityBytes uint64) error
+	ResizeDomainDisk(hostID, vmName, device string, capacityBytes uint64) error
+	CreateRawStorageVolume(hostID, poolName, volumeName string, capacityBytes uint64) (string, error)
+	GetStorageVolume(hostID, volPath string) (*VolumeDetail, error)
+	ListStorageVolumes(hostID, poolName string) ([]VolumeDetail, error)
+	UploadStorageVolume(hostID, volPath string, r io.Reader, offset, length uint64) error
+	DownloadStorageVolume(hostID, volPath string, w io.Writer, offset, length uint64) error
+	GetDiskSize(hostID, diskPath string) (uint64, error)
+
+	// Storage pools
+	DefineStoragePool(hostID string, spec StoragePoolSpec) error
+	BuildStoragePool(hostID, poolName string) error
+	StartStoragePool(hostID, poolName string) error
+	StopStoragePool(hostID, poolName string) error
+	RefreshStoragePool(hostID, poolName string) error
+	SetStoragePoolAutostart(hostID, poolName string, autostart bool) error
+	UndefineStoragePool(hostID, poolName string, deleteStorage bool) error
+
+	// Virtual networks
+	ListAllNetworks(hostID string) ([]VirtualNetworkInfo, error)
+	GetNetwork(hostID, name string) (*VirtualNetworkInfo, error)
+	DefineNetwork(hostID string, spec NetworkSpec) error
+	UpdateNetwork(hostID, name string, changes []NetworkChange) error
+	StartNetwork(hostID, name string) error
+	StopNetwork(hostID, name string) error
+	SetNetworkAutostart(hostID, name string, autostart bool) error
+	UndefineNetwork(hostID, name string) error
+
+	// Network filters
+	DefineNWFilter(hostID string, spec NWFilterSpec) error
+	UndefineNWFilter(hostID, name string) error
+
+	// Guest agent
+	GuestExec(hostID, vmName string, cmd GuestCommand, timeout time.Duration) (*GuestExecResult, error)
+	SetGuestUserPassword(hostID, vmName, user, password string, encrypted bool) error
+	FreezeGuestFilesystems(hostID, vmName string, mountpoints []string) (int, error)
+	ThawGuestFilesystems(hostID, vmName string, mountpoints []string) (int, error)
+	ShutdownDomainViaAgent(hostID, vmName string) error
+	RebootDomainViaAgent(hostID, vmName string) error
+	SyncGuestTime(hostID, vmName string) error
+	PingGuestAgent(hostID, vmName string) error
+}
+
+var _ Hypervisor = (*Connector)(nil)
@@ -0,0 +1,83 @@
+package libvirt
+
+import (
+	"fmt"
+	"net"
+	"time"
+
+	log "github.com/capsali/virtumancer/internal/logging"
+
+	"github.com/digitalocean/go-libvirt"
+)
+
+// Keepalive settings mirror libvirt's client defaults: a probe every five
+// seconds, and the connection is declared dead after five missed probes.
+const (
+	keepaliveInterval = 5 * time.Second
+	keepaliveCount    = 5
+)
+
+// ConnectionLost returns a channel that is closed when the connection to the
+// host drops on its own, either because the peer went away or because
+// keepalive probes stopped being answered. It is not closed by RemoveHost.
+func (c *Connector) ConnectionLost(hostID string) (<-chan struct{}, error) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	lost, ok := c.lost[hostID]
+	if !ok {
+		return nil, fmt.Errorf("not connected to host '%s'", hostID)
+	}
+	return lost, nil
+}
+
+// watchConnection probes the host until the connection closes. go-libvirt
+// has no keepalive support of its own and a half-open TCP or SSH session can
+// hang forever, so unanswered probes force the socket closed, which in turn
+// trips l.Disconnected().
+func (c *Connector) watchConnection(hostID string, l *libvirt.Libvirt, conn net.Conn, lost chan struct{}) {
+	ticker := time.NewTicker(keepaliveInterval)
+	defer ticker.Stop()
+
+	missed := 0
+	for {
+		select {
+		case <-l.Disconnected():
+			c.mu.Lock()
+			// If RemoveHost already dropped this connection (or a newer one
+			// replaced it) the disconnect was intentional.
+			if current, ok := c.connections[hostID]; ok && current == l {
+				c.forgetHostLocked(hostID)
+				close(lost)
+				log.Infof("Lost connection to host %s", hostID)
+			}
+			c.mu.Unlock()
+			return
+		case <-ticker.C:
+			if err := probeLibvirt(l, keepaliveInterval); err != nil {
+				missed++
+				log.Debugf("Keepalive probe %d/%d to host %s failed: %v", missed, keepaliveCount, hostID, err)
+				if missed >= keepaliveCount {
+					log.Verbosef("Host %s stopped answering keepalives, closing connection", hostID)
+					conn.Close()
+				}
+				continue
+			}
+			missed = 0
+		}
+	}
+}
+
+// probeLibvirt issues a cheap RPC and fails if no reply arrives within timeout.
+func probeLibvirt(l *libvirt.Libvirt, timeout time.Duration) error {
+	done := make(chan error, 1)
+	go func() {
+		_, err := l.ConnectGetLibVersion()
+		done <- err
+	}()
+	select {
+	case err := <-done:
+		return err
+	case <-time.After(timeout):
+		return fmt.Errorf("keepalive timed out after %s", timeout)
+	}
+}
@@ -0,0 +1,93 @@
+package libvirt
+
+import (
+	"fmt"
+
+	log "github.com/capsali/virtumancer/internal/logging"
+
+	"github.com/digitalocean/go-libvirt"
+)
+
+// MigrationSpec describes a peer-to-peer migration. The source daemon opens
+// its own connection to DestinationURI, so the URI must be reachable from the
+// source host rather than from Virtumancer.
+type MigrationSpec struct {
+	DestinationURI string
+	// Live keeps the domain running while memory is copied; otherwise it is
+	// paused for the duration of the transfer.
+	Live bool
+	// CopyStorage streams every writable disk to the destination, for hosts
+	// that do not share storage. The destination pool must already exist.
+	CopyStorage bool
+	// BandwidthMiBps caps the transfer rate; zero leaves it unlimited.
+	BandwidthMiBps uint64
+}
+
+// Active reports whether a job is still running.
+func (j DomainJobInfo) Active() bool {
+	return j.Type == int(libvirt.DomainJobBounded) || j.Type == int(libvirt.DomainJobUnbounded)
+}
+
+// Percent estimates how much of the job's data has been transferred. Memory
+// is re-sent as the guest dirties it, so the figure can move backwards.
+func (j DomainJobInfo) Percent() float64 {
+	if j.DataTotal == 0 {
+		return 0
+	}
+	return float64(j.DataProcessed) * 100 / float64(j.DataTotal)
+}
+
+// migrationFlags returns the flags for a peer-to-peer migration that leaves
+// the domain defined only on the destination.
+func migrationFlags(spec MigrationSpec) libvirt.DomainMigrateFlags {
+	flags := libvirt.MigratePeer2peer | libvirt.MigratePersistDest | libvirt.MigrateUndefineSource
+	if spec.Live {
+		flags |= libvirt.MigrateLive
+	}
+	if spec.CopyStorage {
+		flags |= libvirt.MigrateNonSharedDisk
+	}
+	return flags
+}
+
+// MigrateDomain moves a running domain to another host. It blocks until
+// libvirt finishes or fails the migration; GetDomainJobInfo on the source
+// reports progress in the meantime.
+func (c *Connector) MigrateDomain(hostID, vmName string, spec MigrationSpec) error {
+	if spec.DestinationURI == "" {
+		return fmt.Errorf("invalid migration: destination URI is required")
+	}
+	l, domain, err := c.getDomainByName(hostID, vmName)
+	if err != nil {
+		return err
+	}
+
+	var params []libvirt.TypedParam
+	if spec.BandwidthMiBps > 0 {
+		params = append(params, libvirt.TypedParam{
+			Field: libvirt.MigrateParamBandwidth,
+			Value: *libvirt.NewTypedParamValueUllong(spec.BandwidthMiBps),
+		})
+	}
+
+	flags := migrationFlags(spec)
+	log.Debugf("Migrating domain %s from host %s to %s (flags %#x)", vmName, hostID, spec.DestinationURI, uint32(flags))
+	if _, err := l.DomainMigratePerform3Params(domain, libvirt.OptString{spec.DestinationURI}, params, nil, flags); err != nil {
+		return fmt.Errorf("failed to migrate domain %s to %s: %w", vmName, spec.DestinationURI, err)
+	}
+	return nil
+}
+
+// GetDomainXML returns the persistent definition of a domain, including
+// secrets such as VNC passwords, in a form another host can define.
+func (c *Connector) GetDomainXML(hostID, vmName string) (string, error) {
+	l, domain, err := c.getDomainByName(hostID, vmName)
+	if err != nil {
+		return "", err
+	}
+	doc, err := l.DomainGetXMLDesc(domain, libvirt.DomainXMLInactive|libvirt.DomainXMLSecure|libvirt.DomainXMLMigratable)
+	if err != nil {
+		return "", fmt.Errorf("failed to get XML for domain %s: %w", vmName, err)
+	}
+	return doc, nil
+}
@@ -0,0 +1,620 @@
+package libvirt
+
+import (
+	"encoding/xml"
+	"fmt"
+	"net"
+	"reflect"
+	"strings"
+
+	log "github.com/capsali/virtumancer/internal/logging"
+
+	"github.com/digitalocean/go-libvirt"
+	"github.com/google/uuid"
+)
+
+// NetworkSpec describes a libvirt virtual network. Mode is one of:
+//
+//	nat       guests reach outside through NAT on the host (ForwardDev
+//	          optionally pins the outgoing interface)
+//	route     traffic is routed without NAT
+//	isolated  guests only reach each other and the host
+//	open      like route, but libvirt adds no firewall rules
+//	bridge    guests join Bridge, an existing host bridge, directly
+//
+// Bridge names the bridge libvirt creates for the other modes; libvirt picks
+// one when it is empty.
+type NetworkSpec struct {
+	Name       string           `json:"name"`
+	Mode       string           `json:"mode"`
+	Bridge     string           `json:"bridge,omitempty"`
+	ForwardDev string           `json:"forward_dev,omitempty"`
+	Domain     string           `json:"domain,omitempty"`
+	IPs        []NetworkIP      `json:"ips,omitempty"`
+	DNSHosts   []NetworkDNSHost `json:"dns_hosts,omitempty"`
+}
+
+// NetworkIP is a subnet the network's bridge has an address in, with the
+// DHCP service libvirt runs on it.
+type NetworkIP struct {
+	// Family is ipv4 or ipv6; empty means ipv4.
+	Family     string             `json:"family,omitempty"`
+	Address    string             `json:"address"`
+	Prefix     uint               `json:"prefix"`
+	DHCPRanges []NetworkDHCPRange `json:"dhcp_ranges,omitempty"`
+	DHCPHosts  []NetworkDHCPHost  `json:"dhcp_hosts,omitempty"`
+}
+
+// NetworkDHCPRange is a block of addresses DHCP hands out.
+type NetworkDHCPRange struct {
+	Start string `json:"start"`
+	End   string `json:"end"`
+}
+
+// NetworkDHCPHost is a static DHCP reservation. IPv4 reservations match
+// guests by MAC, IPv6 ones by Name. PortID names the managed port the MAC
+// belongs to; it is resolved by the caller and never reaches libvirt.
+type NetworkDHCPHost struct {
+	MAC    string `json:"mac,omitempty"`
+	PortID string `json:"port_id,omitempty"`
+	Name   string `json:"name,omitempty"`
+	IP     string `json:"ip"`
+}
+
+// NetworkDNSHost maps hostnames to an address in the network's DNS.
+type NetworkDNSHost struct {
+	IP        string   `json:"ip"`
+	Hostnames []string `json:"hostnames"`
+}
+
+// VirtualNetworkInfo is a libvirt network as defined on a host.
+type VirtualNetworkInfo struct {
+	UUID      string      `json:"uuid"`
+	Active    bool        `json:"active"`
+	Autostart bool        `json:"autostart"`
+	Spec      NetworkSpec `json:"spec"`
+}
+
+// NetworkChange is one NetworkUpdate call: a command on a section of the
+// network definition, with the XML of the element it adds or removes.
+type NetworkChange struct {
+	Command libvirt.NetworkUpdateCommand
+	Section libvirt.NetworkUpdateSection
+	// ParentIndex picks the <ip> element DHCP changes apply to.
+	ParentIndex int
+	XML         string
+}
+
+type networkXML struct {
+	XMLName xml.Name           `xml:"network"`
+	Name    string             `xml:"name"`
+	UUID    string             `xml:"uuid,omitempty"`
+	Forward *networkForwardXML `xml:"forward,omitempty"`
+	Bridge  *networkBridgeXML  `xml:"bridge,omitempty"`
+	Domain  *networkDomainXML  `xml:"domain,omitempty"`
+	DNS     *networkDNSXML     `xml:"dns,omitempty"`
+	IPs     []networkIPXML     `xml:"ip"`
+}
+
+type networkForwardXML struct {
+	Mode string `xml:"mode,attr,omitempty"`
+	Dev  string `xml:"dev,attr,omitempty"`
+}
+
+type networkBridgeXML struct {
+	Name  string `xml:"name,attr,omitempty"`
+	STP   string `xml:"stp,attr,omitempty"`
+	Delay string `xml:"delay,attr,omitempty"`
+}
+
+type networkDomainXML struct {
+	Name string `xml:"name,attr"`
+}
+
+type networkDNSXML struct {
+	Hosts []networkDNSHostXML `xml:"host"`
+}
+
+type networkDNSHostXML struct {
+	XMLName   xml.Name `xml:"host"`
+	IP        string   `xml:"ip,attr"`
+	Hostnames []string `xml:"hostname"`
+}
+
+type networkIPXML struct {
+	Family  string          `xml:"family,attr,omitempty"`
+	Address string          `xml:"address,attr"`
+	Prefix  uint            `xml:"prefix,attr,omitempty"`
+	Netmask string          `xml:"netmask,attr,omitempty"`
+	DHCP    *networkDHCPXML `xml:"dhcp,omitempty"`
+}
+
+type networkDHCPXML struct {
+	Ranges []networkDHCPRangeXML `xml:"range"`
+	Hosts  []networkDHCPHostXML  `xml:"host"`
+}
+
+type networkDHCPRangeXML struct {
+	XMLName xml.Name `xml:"range"`
+	Start   string   `xml:"start,attr"`
+	End     string   `xml:"end,attr"`
+}
+
+type networkDHCPHostXML struct {
+	XMLName xml.Name `xml:"host"`
+	MAC     string   `xml:"mac,attr,omitempty"`
+	Name    string   `xml:"name,attr,omitempty"`
+	IP      string   `xml:"ip,attr"`
+}
+
+// subnet returns the network an IP block's address lies in.
+func (ip NetworkIP) subnet() (*net.IPNet, error) {
+	addr := net.ParseIP(ip.Address)
+	if addr == nil {
+		return nil, fmt.Errorf("invalid network: %q is not an IP address", ip.Address)
+	}
+	bits := 32
+	if ip.Family == "ipv6" {
+		bits = 128
+	}
+	if (addr.To4() != nil) != (bits == 32) {
+		return nil, fmt.Errorf("invalid network: %s is not an %s address", ip.Address, ip.familyName())
+	}
+	if ip.Prefix == 0 || int(ip.Prefix) > bits {
+		return nil, fmt.Errorf("invalid network: prefix /%d does not fit %s", ip.Prefix, ip.familyName())
+	}
+	return &net.IPNet{IP: addr.Mask(net.CIDRMask(int(ip.Prefix), bits)), Mask: net.CIDRMask(int(ip.Prefix), bits)}, nil
+}
+
+func (ip NetworkIP) familyName() string {
+	if ip.Family == "" {
+		return "ipv4"
+	}
+	return ip.Family
+}
+
+// Validate checks the spec for settings libvirt would reject or that would
+// leave guests without working addresses.
+func (s NetworkSpec) Validate() error {
+	if s.Name == "" || strings.ContainsAny(s.Name, "/ ") {
+		return fmt.Errorf("invalid network: name %q is empty or contains a slash or space", s.Name)
+	}
+	switch s.Mode {
+	case "nat", "route", "isolated", "open":
+	case "bridge":
+		if s.Bridge == "" {
+			return fmt.Errorf("invalid network: bridge networks need the host bridge to use")
+		}
+		if len(s.IPs) > 0 || len(s.DNSHosts) > 0 || s.Domain != "" {
+			return fmt.Errorf("invalid network: bridge networks cannot have addresses, DHCP or DNS")
+		}
+	default:
+		return fmt.Errorf("invalid network: unsupported mode %q", s.Mode)
+	}
+	if s.ForwardDev != "" && s.Mode != "nat" && s.Mode != "route" {
+		return fmt.Errorf("invalid network: forward_dev only applies to nat and route networks")
+	}
+
+	dhcpFamilies := make(map[string]bool)
+	for _, ip := range s.IPs {
+		if ip.Family != "" && ip.Family != "ipv4" && ip.Family != "ipv6" {
+			return fmt.Errorf("invalid network: unsupported family %q", ip.Family)
+		}
+		subnet, err := ip.subnet()
+		if err != nil {
+			return err
+		}
+		if len(ip.DHCPRanges) > 0 || len(ip.DHCPHosts) > 0 {
+			if dhcpFamilies[ip.familyName()] {
+				return fmt.Errorf("invalid network: only one %s subnet can run DHCP", ip.familyName())
+			}
+			dhcpFamilies[ip.familyName()] = true
+		}
+		inSubnet := func(what, addr string) error {
+			parsed := net.ParseIP(addr)
+			if parsed == nil || !subnet.Contains(parsed) {
+				return fmt.Errorf("invalid network: %s %q is not in %s", what, addr, subnet)
+			}
+			return nil
+		}
+		for _, r := range ip.DHCPRanges {
+			if err := inSubnet("DHCP range start", r.Start); err != nil {
+				return err
+			}
+			if err := inSubnet("DHCP range end", r.End); err != nil {
+				return err
+			}
+			if compareIPs(net.ParseIP(r.Start), net.ParseIP(r.End)) > 0 {
+				return fmt.Errorf("invalid network: DHCP range %s-%s ends before it starts", r.Start, r.End)
+			}
+		}
+		seen := make(map[string]bool)
+		for _, h := range ip.DHCPHosts {
+			if err := inSubnet("DHCP host address", h.IP); err != nil {
+				return err
+			}
+			if ip.Family == "ipv6" {
+				if h.Name == "" || h.MAC != "" {
+					return fmt.Errorf("invalid network: IPv6 DHCP hosts are matched by name, not MAC")
+				}
+			} else if _, err := net.ParseMAC(h.MAC); err != nil {
+				return fmt.Errorf("invalid network: DHCP host %s needs a valid MAC", h.IP)
+			}
+			for _, key := range []string{"ip:" + h.IP, "mac:" + strings.ToLower(h.MAC), "name:" + h.Name} {
+				if key == "mac:" || key == "name:" {
+					continue
+				}
+				if seen[key] {
+					return fmt.Errorf("invalid network: DHCP host %s is reserved twice", strings.SplitN(key, ":", 2)[1])
+				}
+				seen[key] = true
+			}
+		}
+	}
+	for _, h := range s.DNSHosts {
+		if net.ParseIP(h.IP) == nil || len(h.Hostnames) == 0 {
+			return fmt.Errorf("invalid network: DNS hosts need an IP address and a hostname")
+		}
+	}
+	return nil
+}
+
+// compareIPs orders two addresses of the same family.
+func compareIPs(a, b net.IP) int {
+	if a4, b4 := a.To4(), b.To4(); a4 != nil && b4 != nil {
+		a, b = a4, b4
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			if a[i] < b[i] {
+				return -1
+			}
+			return 1
+		}
+	}
+	return 0
+}
+
+func dhcpHostXML(h NetworkDHCPHost) networkDHCPHostXML {
+	return networkDHCPHostXML{MAC: h.MAC, Name: h.Name, IP: h.IP}
+}
+
+func dnsHostXML(h NetworkDNSHost) networkDNSHostXML {
+	return networkDNSHostXML{IP: h.IP, Hostnames: h.Hostnames}
+}
+
+// XML renders the spec as a <network> document. uuid is kept when a
+// network is redefined.
+func (s NetworkSpec) XML(uuid string) (string, error) {
+	if err := s.Validate(); err != nil {
+		return "", err
+	}
+	doc := networkXML{Name: s.Name, UUID: uuid}
+	switch s.Mode {
+	case "nat", "route", "open":
+		doc.Forward = &networkForwardXML{Mode: s.Mode, Dev: s.ForwardDev}
+	case "bridge":
+		doc.Forward = &networkForwardXML{Mode: "bridge"}
+	}
+	if s.Bridge != "" {
+		doc.Bridge = &networkBridgeXML{Name: s.Bridge}
+		if s.Mode != "bridge" {
+			doc.Bridge.STP, doc.Bridge.Delay = "on", "0"
+		}
+	}
+	if s.Domain != "" {
+		doc.Domain = &networkDomainXML{Name: s.Domain}
+	}
+	if len(s.DNSHosts) > 0 {
+		doc.DNS = &networkDNSXML{}
+		for _, h := range s.DNSHosts {
+			doc.DNS.Hosts = append(doc.DNS.Hosts, dnsHostXML(h))
+		}
+	}
+	for _, ip := range s.IPs {
+		ipDoc := networkIPXML{Address: ip.Address, Prefix: ip.Prefix}
+		if ip.Family == "ipv6" {
+			ipDoc.Family = "ipv6"
+		}
+		if len(ip.DHCPRanges) > 0 || len(ip.DHCPHosts) > 0 {
+			ipDoc.DHCP = &networkDHCPXML{}
+			for _, r := range ip.DHCPRanges {
+				ipDoc.DHCP.Ranges = append(ipDoc.DHCP.Ranges, networkDHCPRangeXML{Start: r.Start, End: r.End})
+			}
+			for _, h := range ip.DHCPHosts {
+				ipDoc.DHCP.Hosts = append(ipDoc.DHCP.Hosts, dhcpHostXML(h))
+			}
+		}
+		doc.IPs = append(doc.IPs, ipDoc)
+	}
+	out, err := xml.MarshalIndent(doc, "", "  ")
+	if err != nil {
+		return "", fmt.Errorf("failed to build XML for network %s: %w", s.Name, err)
+	}
+	return string(out), nil
+}
+
+// parseNetworkXML reads a network definition back into a spec, returning
+// its UUID too.
+func parseNetworkXML(data string) (NetworkSpec, string, error) {
+	var doc networkXML
+	if err := xml.Unmarshal([]byte(data), &doc); err != nil {
+		return NetworkSpec{}, "", fmt.Errorf("failed to parse network XML: %w", err)
+	}
+	spec := NetworkSpec{Name: doc.Name, Mode: "isolated"}
+	if doc.Forward != nil {
+		spec.Mode = doc.Forward.Mode
+		if spec.Mode == "" {
+			spec.Mode = "nat"
+		}
+		spec.ForwardDev = doc.Forward.Dev
+	}
+	if doc.Bridge != nil {
+		spec.Bridge = doc.Bridge.Name
+	}
+	if doc.Domain != nil {
+		spec.Domain = doc.Domain.Name
+	}
+	if doc.DNS != nil {
+		for _, h := range doc.DNS.Hosts {
+			spec.DNSHosts = append(spec.DNSHosts, NetworkDNSHost{IP: h.IP, Hostnames: h.Hostnames})
+		}
+	}
+	for _, ipDoc := range doc.IPs {
+		ip := NetworkIP{Address: ipDoc.Address, Prefix: ipDoc.Prefix}
+		if ipDoc.Family == "ipv6" {
+			ip.Family = "ipv6"
+		}
+		if ipDoc.Prefix == 0 && ipDoc.Netmask != "" {
+			if mask := net.ParseIP(ipDoc.Netmask).To4(); mask != nil {
+				ones, _ := net.IPMask(mask).Size()
+				ip.Prefix = uint(ones)
+			}
+		}
+		if ipDoc.DHCP != nil {
+			for _, r := range ipDoc.DHCP.Ranges {
+				ip.DHCPRanges = append(ip.DHCPRanges, NetworkDHCPRange{Start: r.Start, End: r.End})
+			}
+			for _, h := range ipDoc.DHCP.Hosts {
+				ip.DHCPHosts = append(ip.DHCPHosts, NetworkDHCPHost{MAC: h.MAC, Name: h.Name, IP: h.IP})
+			}
+		}
+		spec.IPs = append(spec.IPs, ip)
+	}
+	return spec, doc.UUID, nil
+}
+
+// NetworkLiveChanges works out the NetworkUpdate calls that turn current
+// into desired. It reports false when the specs differ in more than DHCP
+// ranges, DHCP hosts and DNS hosts, which libvirt only changes by
+// redefining the network and restarting it.
+func NetworkLiveChanges(current, desired NetworkSpec) ([]NetworkChange, bool) {
+	strip := func(s NetworkSpec) NetworkSpec {
+		s.DNSHosts = nil
+		ips := s.IPs
+		s.IPs = nil
+		for _, ip := range ips {
+			ip.DHCPRanges, ip.DHCPHosts = nil, nil
+			s.IPs = append(s.IPs, ip)
+		}
+		return s
+	}
+	if !reflect.DeepEqual(strip(current), strip(desired)) {
+		return nil, false
+	}
+
+	var deletes, adds []NetworkChange
+	change := func(cmd libvirt.NetworkUpdateCommand, section libvirt.NetworkUpdateSection, parent int, v interface{}) NetworkChange {
+		out, _ := xml.Marshal(v)
+		return NetworkChange{Command: cmd, Section: section, ParentIndex: parent, XML: string(out)}
+	}
+	for i := range desired.IPs {
+		cur, want := current.IPs[i], desired.IPs[i]
+		for _, r := range diffSlice(cur.DHCPRanges, want.DHCPRanges) {
+			deletes = append(deletes, change(libvirt.NetworkUpdateCommandDelete, libvirt.NetworkSectionIPDhcpRange, i, networkDHCPRangeXML{Start: r.Start, End: r.End}))
+		}
+		for _, r := range diffSlice(want.DHCPRanges, cur.DHCPRanges) {
+			adds = append(adds, change(libvirt.NetworkUpdateCommandAddLast, libvirt.NetworkSectionIPDhcpRange, i, networkDHCPRangeXML{Start: r.Start, End: r.End}))
+		}
+		for _, h := range diffSlice(stripPortIDs(cur.DHCPHosts), stripPortIDs(want.DHCPHosts)) {
+			deletes = append(deletes, change(libvirt.NetworkUpdateCommandDelete, libvirt.NetworkSectionIPDhcpHost, i, dhcpHostXML(h)))
+		}
+		for _, h := range diffSlice(stripPortIDs(want.DHCPHosts), stripPortIDs(cur.DHCPHosts)) {
+			adds = append(adds, change(libvirt.NetworkUpdateCommandAddLast, libvirt.NetworkSectionIPDhcpHost, i, dhcpHostXML(h)))
+		}
+	}
+	for _, h := range diffSlice(current.DNSHosts, desired.DNSHosts) {
+		deletes = append(deletes, change(libvirt.NetworkUpdateCommandDelete, libvirt.NetworkSectionDNSHost, -1, dnsHostXML(h)))
+	}
+	for _, h := range diffSlice(desired.DNSHosts, current.DNSHosts) {
+		adds = append(adds, change(libvirt.NetworkUpdateCommandAddLast, libvirt.NetworkSectionDNSHost, -1, dnsHostXML(h)))
+	}
+	// Deleting first frees MACs and addresses that changed entries reuse.
+	return append(deletes, adds...), true
+}
+
+// diffSlice returns the entries of a missing from b.
+func diffSlice[T any](a, b []T) []T {
+	var out []T
+	for _, x := range a {
+		found := false
+		for _, y := range b {
+			if reflect.DeepEqual(x, y) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			out = append(out, x)
+		}
+	}
+	return out
+}
+
+func stripPortIDs(hosts []NetworkDHCPHost) []NetworkDHCPHost {
+	out := make([]NetworkDHCPHost, len(hosts))
+	for i, h := range hosts {
+		h.PortID = ""
+		h.MAC = strings.ToLower(h.MAC)
+		out[i] = h
+	}
+	return out
+}
+
+func (c *Connector) lookupNetwork(hostID, name string) (*libvirt.Libvirt, libvirt.Network, error) {
+	conn, err := c.GetConnection(hostID)
+	if err != nil {
+		return nil, libvirt.Network{}, fmt.Errorf("failed to get libvirt connection: %w", err)
+	}
+	network, err := conn.NetworkLookupByName(name)
+	if err != nil {
+		return nil, libvirt.Network{}, fmt.Errorf("failed to find network %s: %w", name, err)
+	}
+	return conn, network, nil
+}
+
+func (c *Connector) networkToInfo(conn *libvirt.Libvirt, network libvirt.Network) (*VirtualNetworkInfo, error) {
+	// The inactive XML is the persistent definition updates are made to.
+	desc, err := conn.NetworkGetXMLDesc(network, uint32(libvirt.NetworkXMLInactive))
+	if err != nil {
+		return nil, fmt.Errorf("failed to get XML of network %s: %w", network.Name, err)
+	}
+	spec, _, err := parseNetworkXML(desc)
+	if err != nil {
+		return nil, err
+	}
+	info := &VirtualNetworkInfo{UUID: uuid.UUID(network.UUID).String(), Spec: spec}
+	if active, err := conn.NetworkIsActive(network); err == nil {
+		info.Active = active == 1
+	}
+	if autostart, err := conn.NetworkGetAutostart(network); err == nil {
+		info.Autostart = autostart == 1
+	}
+	return info, nil
+}
+
+// ListAllNetworks returns the virtual networks defined on a host.
+func (c *Connector) ListAllNetworks(hostID string) ([]VirtualNetworkInfo, error) {
+	conn, err := c.GetConnection(hostID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get libvirt connection: %w", err)
+	}
+	networks, _, err := conn.ConnectListAllNetworks(1, 0)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list networks: %w", err)
+	}
+	var infos []VirtualNetworkInfo
+	for _, network := range networks {
+		info, err := c.networkToInfo(conn, network)
+		if err != nil {
+			log.Debugf("Warning: could not get info for network %s on host %s: %v", network.Name, hostID, err)
+			continue
+		}
+		infos = append(infos, *info)
+	}
+	return infos, nil
+}
+
+// GetNetwork returns one virtual network on a host.
+func (c *Connector) GetNetwork(hostID, name string) (*VirtualNetworkInfo, error) {
+	conn, network, err := c.lookupNetwork(hostID, name)
+	if err != nil {
+		return nil, err
+	}
+	return c.networkToInfo(conn, network)
+}
+
+// DefineNetwork defines a persistent network, or replaces the definition
+// of the network with the same name. A running network keeps its old
+// settings until it is restarted.
+func (c *Connector) DefineNetwork(hostID string, spec NetworkSpec) error {
+	conn, err := c.GetConnection(hostID)
+	if err != nil {
+		return fmt.Errorf("failed to get libvirt connection: %w", err)
+	}
+	var existingUUID string
+	if existing, err := conn.NetworkLookupByName(spec.Name); err == nil {
+		existingUUID = uuid.UUID(existing.UUID).String()
+	}
+	networkXML, err := spec.XML(existingUUID)
+	if err != nil {
+		return err
+	}
+	if _, err := conn.NetworkDefineXML(networkXML); err != nil {
+		return fmt.Errorf("failed to define network %s: %w", spec.Name, err)
+	}
+	log.Debugf("Defined %s network %s on host %s", spec.Mode, spec.Name, hostID)
+	return nil
+}
+
+// UpdateNetwork applies changes to a network's definition and, when it is
+// running, to the live network, without restarting it.
+func (c *Connector) UpdateNetwork(hostID, name string, changes []NetworkChange) error {
+	conn, network, err := c.lookupNetwork(hostID, name)
+	if err != nil {
+		return err
+	}
+	flags := libvirt.NetworkUpdateAffectConfig
+	if active, err := conn.NetworkIsActive(network); err == nil && active == 1 {
+		flags |= libvirt.NetworkUpdateAffectLive
+	}
+	for _, ch := range changes {
+		if err := conn.NetworkUpdateCompat(network, ch.Command, ch.Section, int32(ch.ParentIndex), ch.XML, flags); err != nil {
+			return fmt.Errorf("failed to update network %s: %w", name, err)
+		}
+	}
+	return nil
+}
+
+// StartNetwork activates a network.
+func (c *Connector) StartNetwork(hostID, name string) error {
+	conn, network, err := c.lookupNetwork(hostID, name)
+	if err != nil {
+		return err
+	}
+	if err := conn.NetworkCreate(network); err != nil {
+		return fmt.Errorf("failed to start network %s: %w", name, err)
+	}
+	return nil
+}
+
+// StopNetwork deactivates a network. Guests attached to it lose their link.
+func (c *Connector) StopNetwork(hostID, name string) error {
+	conn, network, err := c.lookupNetwork(hostID, name)
+	if err != nil {
+		return err
+	}
+	if err := conn.NetworkDestroy(network); err != nil {
+		return fmt.Errorf("failed to stop network %s: %w", name, err)
+	}
+	return nil
+}
+
+// SetNetworkAutostart sets whether a network starts with the daemon.
+func (c *Connector) SetNetworkAutostart(hostID, name string, autostart bool) error {
+	conn, network, err := c.lookupNetwork(hostID, name)
+	if err != nil {
+		return err
+	}
+	var value int32
+	if autostart {
+		value = 1
+	}
+	if err := conn.NetworkSetAutostart(network, value); err != nil {
+		return fmt.Errorf("failed to set autostart of network %s: %w", name, err)
+	}
+	return nil
+}
+
+// UndefineNetwork removes an inactive network's definition.
+func (c *Connector) UndefineNetwork(hostID, name string) error {
+	conn, network, err := c.lookupNetwork(hostID, name)
+	if err != nil {
+		return err
+	}
+	if err := conn.NetworkUndefine(network); err != nil {
+		return fmt.Errorf("failed to undefine network %s: %w", name, err)
+	}
+	log.Debugf("Undefined network %s on host %s", name, hostID)
+	return nil
+}
@@ -0,0 +1,225 @@
+package libvirt
+
+import (
+	"encoding/xml"
+	"fmt"
+	"net"
+	"strings"
+
+	log "github.com/capsali/virtumancer/internal/logging"
+	"github.com/google/uuid"
+)
+
+// nwfilterProtocols are the rule protocols NWFilterRule accepts. Each maps
+// to the address family its remote address must belong to.
+var nwfilterProtocols = map[string]int{
+	"all":      4,
+	"tcp":      4,
+	"udp":      4,
+	"icmp":     4,
+	"all-ipv6": 6,
+	"tcp-ipv6": 6,
+	"udp-ipv6": 6,
+	"icmpv6":   6,
+}
+
+// NWFilterRule is one rule of a network filter. Addresses and ports are
+// seen from the guest: the remote address of an "in" rule is the packet's
+// source and of an "out" rule its destination, while the port range always
+// matches the destination port.
+type NWFilterRule struct {
+	// Action is "accept" or "drop"; Direction is "in", "out" or "inout".
+	Action    string
+	Direction string
+	// Priority orders rules across a filter and the filters it references,
+	// lowest first, from -1000 to 1000. Zero means libvirt's default of 500.
+	Priority int
+	// Protocol is an nwfilter protocol element, such as "tcp", "udp-ipv6",
+	// "icmp" or "all".
+	Protocol     string
+	RemoteIP     string
+	RemotePrefix int
+	PortStart    int
+	PortEnd      int
+	// State matches connection tracking states, such as "NEW" or
+	// "ESTABLISHED,RELATED".
+	State string
+}
+
+// NWFilterSpec describes a network filter to define. Filters lists other
+// filters whose rules are pulled in, ordered with this filter's own rules
+// by priority.
+type NWFilterSpec struct {
+	Name    string
+	Filters []string
+	Rules   []NWFilterRule
+}
+
+type nwfilterXML struct {
+	XMLName    xml.Name          `xml:"filter"`
+	Name       string            `xml:"name,attr"`
+	Chain      string            `xml:"chain,attr"`
+	UUID       string            `xml:"uuid,omitempty"`
+	FilterRefs []nwfilterRefXML  `xml:"filterref"`
+	Rules      []nwfilterRuleXML `xml:"rule"`
+}
+
+type nwfilterRefXML struct {
+	Filter string `xml:"filter,attr"`
+}
+
+type nwfilterRuleXML struct {
+	Action    string              `xml:"action,attr"`
+	Direction string              `xml:"direction,attr"`
+	Priority  int                 `xml:"priority,attr,omitempty"`
+	Match     nwfilterProtocolXML `xml:",any"`
+}
+
+type nwfilterProtocolXML struct {
+	XMLName      xml.Name
+	SrcIPAddr    string `xml:"srcipaddr,attr,omitempty"`
+	SrcIPMask    string `xml:"srcipmask,attr,omitempty"`
+	DstIPAddr    string `xml:"dstipaddr,attr,omitempty"`
+	DstIPMask    string `xml:"dstipmask,attr,omitempty"`
+	DstPortStart int    `xml:"dstportstart,attr,omitempty"`
+	DstPortEnd   int    `xml:"dstportend,attr,omitempty"`
+	State        string `xml:"state,attr,omitempty"`
+}
+
+// Validate checks the rule's action, direction, protocol and match values.
+func (r NWFilterRule) Validate() error {
+	switch r.Action {
+	case "accept", "drop":
+	default:
+		return fmt.Errorf("invalid nwfilter rule: unsupported action %q", r.Action)
+	}
+	switch r.Direction {
+	case "in", "out", "inout":
+	default:
+		return fmt.Errorf("invalid nwfilter rule: unsupported direction %q", r.Direction)
+	}
+	if r.Priority < -1000 || r.Priority > 1000 {
+		return fmt.Errorf("invalid nwfilter rule: priority %d is out of range", r.Priority)
+	}
+	family, ok := nwfilterProtocols[r.Protocol]
+	if !ok {
+		return fmt.Errorf("invalid nwfilter rule: unsupported protocol %q", r.Protocol)
+	}
+	if r.RemoteIP != "" {
+		if r.Direction == "inout" {
+			return fmt.Errorf("invalid nwfilter rule: inout rules cannot match a remote address")
+		}
+		ip := net.ParseIP(r.RemoteIP)
+		if ip == nil || (ip.To4() != nil) != (family == 4) {
+			return fmt.Errorf("invalid nwfilter rule: %q is not an IPv%d address", r.RemoteIP, family)
+		}
+		bits := 32
+		if family == 6 {
+			bits = 128
+		}
+		if r.RemotePrefix < 0 || r.RemotePrefix > bits {
+			return fmt.Errorf("invalid nwfilter rule: prefix %d is out of range", r.RemotePrefix)
+		}
+	}
+	if r.PortStart != 0 || r.PortEnd != 0 {
+		if !strings.HasPrefix(r.Protocol, "tcp") && !strings.HasPrefix(r.Protocol, "udp") {
+			return fmt.Errorf("invalid nwfilter rule: %s rules do not match ports", r.Protocol)
+		}
+		if r.PortStart < 1 || r.PortEnd > 65535 || (r.PortEnd != 0 && r.PortEnd < r.PortStart) {
+			return fmt.Errorf("invalid nwfilter rule: bad port range %d-%d", r.PortStart, r.PortEnd)
+		}
+	}
+	return nil
+}
+
+// Validate checks the filter's name and rules.
+func (s NWFilterSpec) Validate() error {
+	if s.Name == "" || strings.ContainsAny(s.Name, "/ ") {
+		return fmt.Errorf("invalid nwfilter: name %q is empty or contains a slash or space", s.Name)
+	}
+	for _, r := range s.Rules {
+		if err := r.Validate(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// XML renders the spec as a <filter> document in the root chain. An empty
+// filterUUID lets libvirt generate one.
+func (s NWFilterSpec) XML(filterUUID string) (string, error) {
+	if err := s.Validate(); err != nil {
+		return "", err
+	}
+	doc := nwfilterXML{Name: s.Name, Chain: "root", UUID: filterUUID}
+	for _, name := range s.Filters {
+		doc.FilterRefs = append(doc.FilterRefs, nwfilterRefXML{Filter: name})
+	}
+	for _, r := range s.Rules {
+		match := nwfilterProtocolXML{
+			XMLName:      xml.Name{Local: r.Protocol},
+			DstPortStart: r.PortStart,
+			DstPortEnd:   r.PortEnd,
+			State:        r.State,
+		}
+		if r.RemoteIP != "" {
+			mask := fmt.Sprint(r.RemotePrefix)
+			if r.Direction == "in" {
+				match.SrcIPAddr, match.SrcIPMask = r.RemoteIP, mask
+			} else {
+				match.DstIPAddr, match.DstIPMask = r.RemoteIP, mask
+			}
+		}
+		doc.Rules = append(doc.Rules, nwfilterRuleXML{
+			Action:    r.Action,
+			Direction: r.Direction,
+			Priority:  r.Priority,
+			Match:     match,
+		})
+	}
+	out, err := xml.Marshal(doc)
+	if err != nil {
+		return "", fmt.Errorf("failed to build XML for nwfilter %s: %w", s.Name, err)
+	}
+	return string(out), nil
+}
+
+// DefineNWFilter defines a network filter, replacing any filter of the same
+// name. libvirt re-instantiates the rules of running guests that use it.
+func (c *Connector) DefineNWFilter(hostID string, spec NWFilterSpec) error {
+	conn, err := c.GetConnection(hostID)
+	if err != nil {
+		return fmt.Errorf("failed to get libvirt connection: %w", err)
+	}
+	var existingUUID string
+	if existing, err := conn.NwfilterLookupByName(spec.Name); err == nil {
+		existingUUID = uuid.UUID(existing.UUID).String()
+	}
+	filterXML, err := spec.XML(existingUUID)
+	if err != nil {
+		return err
+	}
+	if _, err := conn.NwfilterDefineXML(filterXML); err != nil {
+		return fmt.Errorf("failed to define nwfilter %s: %w", spec.Name, err)
+	}
+	log.Debugf("Defined nwfilter %s on host %s", spec.Name, hostID)
+	return nil
+}
+
+// UndefineNWFilter removes a network filter. libvirt refuses while other
+// filters or running guests still use it.
+func (c *Connector) UndefineNWFilter(hostID, name string) error {
+	conn, err := c.GetConnection(hostID)
+	if err != nil {
+		return fmt.Errorf("failed to get libvirt connection: %w", err)
+	}
+	filter, err := conn.NwfilterLookupByName(name)
+	if err != nil {
+		return fmt.Errorf("failed to find nwfilter %s: %w", name, err)
+	}
+	if err := conn.NwfilterUndefine(filter); err != nil {
+		return fmt.Errorf("failed to undefine nwfilter %s: %w", name, err)
+	}
+	log.Debugf("Undefined nwfilter %s on host %s", name, hostID)
+	return nil
+}
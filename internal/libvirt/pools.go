@@ -0,0 +1,325 @@
+package libvirt
+
+import (
+	"encoding/xml"
+	"fmt"
+	"strings"
+
+	log "github.com/capsali/virtumancer/internal/logging"
+
+	"github.com/digitalocean/go-libvirt"
+)
+
+// StoragePoolHost is a server a network pool connects to.
+type StoragePoolHost struct {
+	Name string `json:"name"`
+	Port int    `json:"port,omitempty"`
+}
+
+// StoragePoolSpec describes a storage pool to define. Which source fields
+// apply depends on Type:
+//
+//	dir      target_path
+//	fs       target_path, one source_devices entry, source_format (default auto)
+//	netfs    target_path, one source_hosts entry, source_dir
+//	logical  source_name (the volume group), source_devices to build it
+//	iscsi    one source_hosts entry (the portal), the target IQN in source_devices
+//	rbd      source_hosts (the monitors), source_name (the Ceph pool)
+type StoragePoolSpec struct {
+	Name       string `json:"name"`
+	Type       string `json:"type"`
+	TargetPath string `json:"target_path,omitempty"`
+
+	SourceHosts   []StoragePoolHost `json:"source_hosts,omitempty"`
+	SourceDir     string            `json:"source_dir,omitempty"`
+	SourceDevices []string          `json:"source_devices,omitempty"`
+	SourceName    string            `json:"source_name,omitempty"`
+	SourceFormat  string            `json:"source_format,omitempty"`
+	// Initiator is the IQN an iSCSI pool logs in with.
+	Initiator string `json:"initiator,omitempty"`
+	// AuthUsername and AuthSecretUUID name a libvirt secret holding the
+	// CHAP password of an iSCSI target or the cephx key of an rbd pool.
+	AuthUsername   string `json:"auth_username,omitempty"`
+	AuthSecretUUID string `json:"auth_secret_uuid,omitempty"`
+}
+
+// StoragePoolBuildable reports whether libvirt can build pools of a type,
+// creating their directory, filesystem or volume group.
+func StoragePoolBuildable(poolType string) bool {
+	switch poolType {
+	case "dir", "fs", "netfs", "logical":
+		return true
+	}
+	return false
+}
+
+type storagePoolXML struct {
+	XMLName xml.Name              `xml:"pool"`
+	Type    string                `xml:"type,attr"`
+	Name    string                `xml:"name"`
+	Source  *storagePoolSourceXML `xml:"source,omitempty"`
+	Target  *storagePoolTargetXML `xml:"target,omitempty"`
+}
+
+type storagePoolSourceXML struct {
+	Hosts   []storagePoolHostXML `xml:"host"`
+	Dir     *storagePoolPathXML  `xml:"dir,omitempty"`
+	Devices []storagePoolPathXML `xml:"device"`
+	Name    string               `xml:"name,omitempty"`
+	Format  *struct {
+		Type string `xml:"type,attr"`
+	} `xml:"format,omitempty"`
+	Initiator *struct {
+		IQN struct {
+			Name string `xml:"name,attr"`
+		} `xml:"iqn"`
+	} `xml:"initiator,omitempty"`
+	Auth *storagePoolAuthXML `xml:"auth,omitempty"`
+}
+
+type storagePoolHostXML struct {
+	Name string `xml:"name,attr"`
+	Port int    `xml:"port,attr,omitempty"`
+}
+
+type storagePoolPathXML struct {
+	Path string `xml:"path,attr"`
+}
+
+type storagePoolAuthXML struct {
+	Type     string `xml:"type,attr"`
+	Username string `xml:"username,attr"`
+	Secret   struct {
+		UUID string `xml:"uuid,attr"`
+	} `xml:"secret"`
+}
+
+type storagePoolTargetXML struct {
+	Path string `xml:"path"`
+}
+
+// Validate checks that the spec names a supported type and carries the
+// source fields that type needs.
+func (s StoragePoolSpec) Validate() error {
+	if s.Name == "" || strings.ContainsAny(s.Name, "/ ") {
+		return fmt.Errorf("invalid storage pool: name %q is empty or contains a slash or space", s.Name)
+	}
+	if (s.AuthUsername == "") != (s.AuthSecretUUID == "") {
+		return fmt.Errorf("invalid storage pool: auth_username and auth_secret_uuid go together")
+	}
+	switch s.Type {
+	case "dir":
+		if s.TargetPath == "" {
+			return fmt.Errorf("invalid storage pool: dir pools need target_path")
+		}
+	case "fs":
+		if s.TargetPath == "" || len(s.SourceDevices) != 1 {
+			return fmt.Errorf("invalid storage pool: fs pools need target_path and one source device")
+		}
+	case "netfs":
+		if s.TargetPath == "" || len(s.SourceHosts) != 1 || s.SourceDir == "" {
+			return fmt.Errorf("invalid storage pool: netfs pools need target_path, one source host and source_dir")
+		}
+	case "logical":
+		if s.SourceName == "" {
+			return fmt.Errorf("invalid storage pool: logical pools need source_name, the volume group")
+		}
+	case "iscsi":
+		if len(s.SourceHosts) != 1 || len(s.SourceDevices) != 1 {
+			return fmt.Errorf("invalid storage pool: iscsi pools need one source host and the target IQN as their source device")
+		}
+	case "rbd":
+		if len(s.SourceHosts) == 0 || s.SourceName == "" {
+			return fmt.Errorf("invalid storage pool: rbd pools need source hosts and source_name, the Ceph pool")
+		}
+	default:
+		return fmt.Errorf("invalid storage pool: unsupported type %q", s.Type)
+	}
+	if s.AuthUsername != "" && s.Type != "iscsi" && s.Type != "rbd" {
+		return fmt.Errorf("invalid storage pool: %s pools do not take auth", s.Type)
+	}
+	return nil
+}
+
+// XML renders the spec as a <pool> document.
+func (s StoragePoolSpec) XML() (string, error) {
+	if err := s.Validate(); err != nil {
+		return "", err
+	}
+	doc := storagePoolXML{Type: s.Type, Name: s.Name}
+	src := &storagePoolSourceXML{Name: s.SourceName}
+	for _, h := range s.SourceHosts {
+		src.Hosts = append(src.Hosts, storagePoolHostXML{Name: h.Name, Port: h.Port})
+	}
+	if s.SourceDir != "" {
+		src.Dir = &storagePoolPathXML{Path: s.SourceDir}
+	}
+	for _, dev := range s.SourceDevices {
+		src.Devices = append(src.Devices, storagePoolPathXML{Path: dev})
+	}
+
+	format := s.SourceFormat
+	switch {
+	case format == "" && s.Type == "fs":
+		format = "auto"
+	case format == "" && s.Type == "netfs":
+		format = "nfs"
+	case format == "" && s.Type == "logical":
+		format = "lvm2"
+	}
+	if format != "" {
+		src.Format = &struct {
+			Type string `xml:"type,attr"`
+		}{Type: format}
+	}
+	if s.Initiator != "" {
+		src.Initiator = &struct {
+			IQN struct {
+				Name string `xml:"name,attr"`
+			} `xml:"iqn"`
+		}{}
+		src.Initiator.IQN.Name = s.Initiator
+	}
+	if s.AuthUsername != "" {
+		src.Auth = &storagePoolAuthXML{Type: "chap", Username: s.AuthUsername}
+		if s.Type == "rbd" {
+			src.Auth.Type = "ceph"
+		}
+		src.Auth.Secret.UUID = s.AuthSecretUUID
+	}
+	if s.Type != "dir" {
+		doc.Source = src
+	}
+
+	target := s.TargetPath
+	switch {
+	case target == "" && s.Type == "logical":
+		target = "/dev/" + s.SourceName
+	case target == "" && s.Type == "iscsi":
+		target = "/dev/disk/by-path"
+	}
+	if target != "" && s.Type != "rbd" {
+		doc.Target = &storagePoolTargetXML{Path: target}
+	}
+
+	out, err := xml.Marshal(doc)
+	if err != nil {
+		return "", fmt.Errorf("failed to build XML for storage pool %s: %w", s.Name, err)
+	}
+	return string(out), nil
+}
+
+func (c *Connector) lookupStoragePool(hostID, poolName string) (*libvirt.Libvirt, libvirt.StoragePool, error) {
+	conn, err := c.GetConnection(hostID)
+	if err != nil {
+		return nil, libvirt.StoragePool{}, fmt.Errorf("failed to get libvirt connection: %w", err)
+	}
+	pool, err := conn.StoragePoolLookupByName(poolName)
+	if err != nil {
+		return nil, libvirt.StoragePool{}, fmt.Errorf("failed to find storage pool %s: %w", poolName, err)
+	}
+	return conn, pool, nil
+}
+
+// DefineStoragePool defines a persistent, inactive storage pool.
+func (c *Connector) DefineStoragePool(hostID string, spec StoragePoolSpec) error {
+	poolXML, err := spec.XML()
+	if err != nil {
+		return err
+	}
+	conn, err := c.GetConnection(hostID)
+	if err != nil {
+		return fmt.Errorf("failed to get libvirt connection: %w", err)
+	}
+	if _, err := conn.StoragePoolDefineXML(poolXML, 0); err != nil {
+		return fmt.Errorf("failed to define storage pool %s: %w", spec.Name, err)
+	}
+	log.Debugf("Defined %s storage pool %s on host %s", spec.Type, spec.Name, hostID)
+	return nil
+}
+
+// BuildStoragePool creates a pool's underlying storage: its directory, or
+// the filesystem or volume group on its devices. Devices that already hold
+// a filesystem or volume group are left alone.
+func (c *Connector) BuildStoragePool(hostID, poolName string) error {
+	conn, pool, err := c.lookupStoragePool(hostID, poolName)
+	if err != nil {
+		return err
+	}
+	if err := conn.StoragePoolBuild(pool, libvirt.StoragePoolBuildNoOverwrite); err != nil {
+		return fmt.Errorf("failed to build storage pool %s: %w", poolName, err)
+	}
+	return nil
+}
+
+// StartStoragePool activates a pool, mounting or logging in to its source.
+func (c *Connector) StartStoragePool(hostID, poolName string) error {
+	conn, pool, err := c.lookupStoragePool(hostID, poolName)
+	if err != nil {
+		return err
+	}
+	if err := conn.StoragePoolCreate(pool, 0); err != nil {
+		return fmt.Errorf("failed to start storage pool %s: %w", poolName, err)
+	}
+	return nil
+}
+
+// StopStoragePool deactivates a pool. Its definition and data are kept.
+func (c *Connector) StopStoragePool(hostID, poolName string) error {
+	conn, pool, err := c.lookupStoragePool(hostID, poolName)
+	if err != nil {
+		return err
+	}
+	if err := conn.StoragePoolDestroy(pool); err != nil {
+		return fmt.Errorf("failed to stop storage pool %s: %w", poolName, err)
+	}
+	return nil
+}
+
+// RefreshStoragePool rescans an active pool for volumes and free space.
+func (c *Connector) RefreshStoragePool(hostID, poolName string) error {
+	conn, pool, err := c.lookupStoragePool(hostID, poolName)
+	if err != nil {
+		return err
+	}
+	if err := conn.StoragePoolRefresh(pool, 0); err != nil {
+		return fmt.Errorf("failed to refresh storage pool %s: %w", poolName, err)
+	}
+	return nil
+}
+
+// SetStoragePoolAutostart sets whether a pool starts with the daemon.
+func (c *Connector) SetStoragePoolAutostart(hostID, poolName string, autostart bool) error {
+	conn, pool, err := c.lookupStoragePool(hostID, poolName)
+	if err != nil {
+		return err
+	}
+	var value int32
+	if autostart {
+		value = 1
+	}
+	if err := conn.StoragePoolSetAutostart(pool, value); err != nil {
+		return fmt.Errorf("failed to set autostart of storage pool %s: %w", poolName, err)
+	}
+	return nil
+}
+
+// UndefineStoragePool removes an inactive pool's definition. With
+// deleteStorage, the pool's underlying storage, such as its directory or
+// volume group, is deleted first.
+func (c *Connector) UndefineStoragePool(hostID, poolName string, deleteStorage bool) error {
+	conn, pool, err := c.lookupStoragePool(hostID, poolName)
+	if err != nil {
+		return err
+	}
+	if deleteStorage {
+		if err := conn.StoragePoolDelete(pool, libvirt.StoragePoolDeleteNormal); err != nil {
+			return fmt.Errorf("failed to delete storage of pool %s: %w", poolName, err)
+		}
+	}
+	if err := conn.StoragePoolUndefine(pool); err != nil {
+		return fmt.Errorf("failed to undefine storage pool %s: %w", poolName, err)
+	}
+	log.Debugf("Undefined storage pool %s on host %s", poolName, hostID)
+	return nil
+}
@@ -0,0 +1,76 @@
+package libvirt
+
+import (
+	"fmt"
+
+	log "github.com/capsali/virtumancer/internal/logging"
+
+	"github.com/digitalocean/go-libvirt"
+)
+
+// SetDomainVcpus sets how many vCPUs a domain has enabled, up to its
+// maximum. The persistent definition always changes; with live the running
+// guest's vCPUs are hot(un)plugged as well.
+func (c *Connector) SetDomainVcpus(hostID, vmName string, count uint, live bool) error {
+	l, domain, err := c.getDomainByName(hostID, vmName)
+	if err != nil {
+		return err
+	}
+	flags := libvirt.DomainVCPUConfig
+	if live {
+		flags |= libvirt.DomainVCPULive
+	}
+	if err := l.DomainSetVcpusFlags(domain, uint32(count), uint32(flags)); err != nil {
+		return fmt.Errorf("failed to set vcpus of domain %s to %d: %w", vmName, count, err)
+	}
+	log.Debugf("Set vCPUs of domain %s on host %s to %d (flags %#x)", vmName, hostID, count, uint32(flags))
+	return nil
+}
+
+// SetDomainMaxVcpus sets the most vCPUs a domain can have. QEMU fixes the
+// maximum at boot, so only the persistent definition changes.
+func (c *Connector) SetDomainMaxVcpus(hostID, vmName string, count uint) error {
+	l, domain, err := c.getDomainByName(hostID, vmName)
+	if err != nil {
+		return err
+	}
+	if err := l.DomainSetVcpusFlags(domain, uint32(count), uint32(libvirt.DomainVCPUConfig|libvirt.DomainVCPUMaximum)); err != nil {
+		return fmt.Errorf("failed to set maximum vcpus of domain %s to %d: %w", vmName, count, err)
+	}
+	log.Debugf("Set maximum vCPUs of domain %s on host %s to %d", vmName, hostID, count)
+	return nil
+}
+
+// SetDomainMemory sets a domain's current memory, up to its maximum. The
+// persistent definition always changes; with live the running guest's
+// balloon is inflated or deflated to match.
+func (c *Connector) SetDomainMemory(hostID, vmName string, memoryKB uint64, live bool) error {
+	l, domain, err := c.getDomainByName(hostID, vmName)
+	if err != nil {
+		return err
+	}
+	flags := libvirt.DomainMemConfig
+	if live {
+		flags |= libvirt.DomainMemLive
+	}
+	if err := l.DomainSetMemoryFlags(domain, memoryKB, uint32(flags)); err != nil {
+		return fmt.Errorf("failed to set memory of domain %s to %d KiB: %w", vmName, memoryKB, err)
+	}
+	log.Debugf("Set memory of domain %s on host %s to %d KiB (flags %#x)", vmName, hostID, memoryKB, uint32(flags))
+	return nil
+}
+
+// SetDomainMaxMemory sets a domain's maximum memory in its persistent
+// definition, where it takes effect at the next boot. libvirt lowers the
+// current memory along with it if needed.
+func (c *Connector) SetDomainMaxMemory(hostID, vmName string, memoryKB uint64) error {
+	l, domain, err := c.getDomainByName(hostID, vmName)
+	if err != nil {
+		return err
+	}
+	if err := l.DomainSetMemoryFlags(domain, memoryKB, uint32(libvirt.DomainMemConfig|libvirt.DomainMemMaximum)); err != nil {
+		return fmt.Errorf("failed to set maximum memory of domain %s to %d KiB: %w", vmName, memoryKB, err)
+	}
+	log.Debugf("Set maximum memory of domain %s on host %s to %d KiB", vmName, hostID, memoryKB)
+	return nil
+}
@@ -0,0 +1,270 @@
+package libvirt
+
+import (
+	"encoding/xml"
+	"fmt"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	log "github.com/capsali/virtumancer/internal/logging"
+
+	"github.com/digitalocean/go-libvirt"
+)
+
+// SnapshotInfo describes one domain snapshot as libvirt reports it.
+type SnapshotInfo struct {
+	Name        string `json:"name"`
+	Description string `json:"description,omitempty"`
+	// Parent is the name of the snapshot this one was taken on top of, or
+	// empty for a root of the snapshot tree.
+	Parent string `json:"parent,omitempty"`
+	// State is the domain state captured by the snapshot, e.g. "running",
+	// "shutoff" or "disk-snapshot".
+	State        string `json:"state"`
+	CreationTime int64  `json:"creation_time"`
+	Current      bool   `json:"current"`
+	External     bool   `json:"external"`
+	HasMemory    bool   `json:"has_memory"`
+	XML          string `json:"-"`
+}
+
+// SnapshotSpec describes a snapshot to create. Internal snapshots keep disk
+// and, for running domains, memory state inside the qcow2 images. External
+// snapshots switch each writable disk to a new overlay; unless DiskOnly is
+// set, memory is saved to MemoryFile, which defaults to a file next to the
+// first disk.
+type SnapshotSpec struct {
+	Name        string `json:"name"`
+	Description string `json:"description,omitempty"`
+	External    bool   `json:"external"`
+	DiskOnly    bool   `json:"disk_only"`
+	MemoryFile  string `json:"memory_file,omitempty"`
+}
+
+// snapshotXML is the domainsnapshot document, used both to request a
+// snapshot and to read one back.
+type snapshotXML struct {
+	XMLName      xml.Name           `xml:"domainsnapshot"`
+	Name         string             `xml:"name"`
+	Description  string             `xml:"description,omitempty"`
+	State        string             `xml:"state,omitempty"`
+	CreationTime int64              `xml:"creationTime,omitempty"`
+	Parent       *snapshotParentXML `xml:"parent,omitempty"`
+	Memory       *snapshotMemoryXML `xml:"memory,omitempty"`
+	Disks        []snapshotDiskXML  `xml:"disks>disk,omitempty"`
+}
+
+type snapshotParentXML struct {
+	Name string `xml:"name"`
+}
+
+type snapshotMemoryXML struct {
+	Snapshot string `xml:"snapshot,attr"`
+	File     string `xml:"file,attr,omitempty"`
+}
+
+type snapshotDiskXML struct {
+	Name     string `xml:"name,attr"`
+	Snapshot string `xml:"snapshot,attr,omitempty"`
+}
+
+// parseSnapshotXML extracts SnapshotInfo from a domainsnapshot document.
+func parseSnapshotXML(doc string) (SnapshotInfo, error) {
+	var parsed snapshotXML
+	if err := xml.Unmarshal([]byte(doc), &parsed); err != nil {
+		return SnapshotInfo{}, fmt.Errorf("failed to parse snapshot XML: %w", err)
+	}
+	info := SnapshotInfo{
+		Name:         parsed.Name,
+		Description:  parsed.Description,
+		State:        parsed.State,
+		CreationTime: parsed.CreationTime,
+		XML:          doc,
+	}
+	if parsed.Parent != nil {
+		info.Parent = parsed.Parent.Name
+	}
+	if parsed.Memory != nil {
+		info.HasMemory = parsed.Memory.Snapshot == "internal" || parsed.Memory.Snapshot == "external"
+		info.External = parsed.Memory.Snapshot == "external"
+	} else {
+		// Older daemons omit <memory>; only a running internal snapshot
+		// carries memory state then.
+		info.HasMemory = parsed.State == "running" || parsed.State == "paused"
+	}
+	for _, disk := range parsed.Disks {
+		if disk.Snapshot == "external" {
+			info.External = true
+		}
+	}
+	return info, nil
+}
+
+// buildSnapshotXML renders the request for spec. disks are the domain's
+// disks, needed to mark each writable one external and leave the rest alone.
+func buildSnapshotXML(vmName string, spec SnapshotSpec, disks []DiskInfo) (string, uint32, error) {
+	if !snapshotNameValid(spec.Name) {
+		return "", 0, fmt.Errorf("invalid snapshot name %q", spec.Name)
+	}
+	if spec.DiskOnly && !spec.External {
+		return "", 0, fmt.Errorf("disk-only snapshots must be external")
+	}
+
+	doc := snapshotXML{Name: spec.Name, Description: spec.Description}
+	var flags libvirt.DomainSnapshotCreateFlags
+	if spec.External {
+		firstDisk := ""
+		for _, disk := range disks {
+			mode := "no"
+			if disk.Device == "disk" && !disk.ReadOnly {
+				mode = "external"
+				if firstDisk == "" {
+					firstDisk = disk.Path
+				}
+			}
+			doc.Disks = append(doc.Disks, snapshotDiskXML{Name: disk.Target.Dev, Snapshot: mode})
+		}
+		if firstDisk == "" {
+			return "", 0, fmt.Errorf("domain %s has no writable disks to snapshot externally", vmName)
+		}
+		if spec.DiskOnly {
+			doc.Memory = &snapshotMemoryXML{Snapshot: "no"}
+			flags |= libvirt.DomainSnapshotCreateDiskOnly
+		} else {
+			memoryFile := spec.MemoryFile
+			if memoryFile == "" {
+				memoryFile = filepath.Join(filepath.Dir(firstDisk), fmt.Sprintf("%s-%s.mem", vmName, spec.Name))
+			}
+			doc.Memory = &snapshotMemoryXML{Snapshot: "external", File: memoryFile}
+		}
+		flags |= libvirt.DomainSnapshotCreateAtomic
+	}
+
+	out, err := xml.Marshal(doc)
+	if err != nil {
+		return "", 0, fmt.Errorf("failed to build snapshot XML: %w", err)
+	}
+	return string(out), uint32(flags), nil
+}
+
+// sortSnapshots orders snapshots oldest first, which also places parents
+// before their children.
+func sortSnapshots(snapshots []SnapshotInfo) {
+	sort.SliceStable(snapshots, func(i, j int) bool {
+		if snapshots[i].CreationTime != snapshots[j].CreationTime {
+			return snapshots[i].CreationTime < snapshots[j].CreationTime
+		}
+		return snapshots[i].Name < snapshots[j].Name
+	})
+}
+
+// ListDomainSnapshots returns every snapshot of a domain with its parent link.
+func (c *Connector) ListDomainSnapshots(hostID, vmName string) ([]SnapshotInfo, error) {
+	l, domain, err := c.getDomainByName(hostID, vmName)
+	if err != nil {
+		return nil, err
+	}
+	snaps, _, err := l.DomainListAllSnapshots(domain, 1, 0)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list snapshots for domain %s: %w", vmName, err)
+	}
+
+	result := make([]SnapshotInfo, 0, len(snaps))
+	for _, snap := range snaps {
+		doc, err := l.DomainSnapshotGetXMLDesc(snap, 0)
+		if err != nil {
+			return nil, fmt.Errorf("failed to get XML for snapshot %s of domain %s: %w", snap.Name, vmName, err)
+		}
+		info, err := parseSnapshotXML(doc)
+		if err != nil {
+			return nil, err
+		}
+		if current, err := l.DomainSnapshotIsCurrent(snap, 0); err == nil {
+			info.Current = current == 1
+		}
+		result = append(result, info)
+	}
+	sortSnapshots(result)
+	return result, nil
+}
+
+// CreateDomainSnapshot takes a snapshot of a domain as described by spec.
+func (c *Connector) CreateDomainSnapshot(hostID, vmName string, spec SnapshotSpec) (*SnapshotInfo, error) {
+	l, domain, err := c.getDomainByName(hostID, vmName)
+	if err != nil {
+		return nil, err
+	}
+
+	var disks []DiskInfo
+	if spec.External {
+		hardware, err := c.GetDomainHardware(hostID, vmName)
+		if err != nil {
+			return nil, err
+		}
+		disks = hardware.Disks
+	}
+	doc, flags, err := buildSnapshotXML(vmName, spec, disks)
+	if err != nil {
+		return nil, err
+	}
+
+	log.Debugf("Creating snapshot %s of domain %s: %s", spec.Name, vmName, doc)
+	snap, err := l.DomainSnapshotCreateXML(domain, doc, flags)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create snapshot %s of domain %s: %w", spec.Name, vmName, err)
+	}
+	created, err := l.DomainSnapshotGetXMLDesc(snap, 0)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get XML for snapshot %s of domain %s: %w", spec.Name, vmName, err)
+	}
+	info, err := parseSnapshotXML(created)
+	if err != nil {
+		return nil, err
+	}
+	info.Current = true
+	return &info, nil
+}
+
+// RevertDomainSnapshot returns a domain to the state captured by a snapshot.
+func (c *Connector) RevertDomainSnapshot(hostID, vmName, snapshotName string) error {
+	l, snap, err := c.getSnapshotByName(hostID, vmName, snapshotName)
+	if err != nil {
+		return err
+	}
+	if err := l.DomainRevertToSnapshot(snap, 0); err != nil {
+		return fmt.Errorf("failed to revert domain %s to snapshot %s: %w", vmName, snapshotName, err)
+	}
+	return nil
+}
+
+// DeleteDomainSnapshot removes a snapshot. Its children are re-parented onto
+// its parent, as libvirt does by default.
+func (c *Connector) DeleteDomainSnapshot(hostID, vmName, snapshotName string) error {
+	l, snap, err := c.getSnapshotByName(hostID, vmName, snapshotName)
+	if err != nil {
+		return err
+	}
+	if err := l.DomainSnapshotDelete(snap, 0); err != nil {
+		return fmt.Errorf("failed to delete snapshot %s of domain %s: %w", snapshotName, vmName, err)
+	}
+	return nil
+}
+
+func (c *Connector) getSnapshotByName(hostID, vmName, snapshotName string) (*libvirt.Libvirt, libvirt.DomainSnapshot, error) {
+	l, domain, err := c.getDomainByName(hostID, vmName)
+	if err != nil {
+		return nil, libvirt.DomainSnapshot{}, err
+	}
+	snap, err := l.DomainSnapshotLookupByName(domain, snapshotName, 0)
+	if err != nil {
+		return nil, libvirt.DomainSnapshot{}, fmt.Errorf("could not find snapshot '%s' of VM '%s': %w", snapshotName, vmName, err)
+	}
+	return l, snap, nil
+}
+
+// snapshotNameValid rejects names libvirt would accept but that break the
+// memory file naming or URL routing.
+func snapshotNameValid(name string) bool {
+	return name != "" && !strings.ContainsAny(name, "/\\") && name != "." && name != ".."
+}
@@ -0,0 +1,430 @@
+package libvirt
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/capsali/virtumancer/internal/logging"
+
+	"github.com/capsali/virtumancer/internal/storage"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
+	"golang.org/x/crypto/ssh/knownhosts"
+)
+
+// defaultSSHKeyFiles are tried, in order, when a host has no key of its own.
+var defaultSSHKeyFiles = []string{"id_ed25519", "id_ecdsa", "id_rsa"}
+
+// HostKeyMismatchError reports that an SSH server presented a different host
+// key than the one pinned for it.
+type HostKeyMismatchError struct {
+	Address   string
+	Pinned    string
+	Presented string
+}
+
+func (e *HostKeyMismatchError) Error() string {
+	return fmt.Sprintf("ssh host key mismatch for %s: pinned %s but server presented %s; re-trust the host if the key change is expected", e.Address, e.Pinned, e.Presented)
+}
+
+// sshEndpoint is one hop in an SSH connection chain.
+type sshEndpoint struct {
+	user string
+	addr string
+}
+
+// sshTunneledConn wraps a net.Conn to ensure the underlying SSH client, and
+// any jump host clients it was reached through, are also closed.
+type sshTunneledConn struct {
+	net.Conn
+	client *ssh.Client
+	jumps  []*ssh.Client
+	// learnedHostKeys is the updated pinned key set if any key was trusted
+	// for the first time while dialling.
+	learnedHostKeys string
+}
+
+func (c *sshTunneledConn) Close() error {
+	connErr := c.Conn.Close()
+	clientErr := c.client.Close()
+	for i := len(c.jumps) - 1; i >= 0; i-- {
+		c.jumps[i].Close()
+	}
+	if connErr != nil {
+		return connErr
+	}
+	return clientErr
+}
+
+// dialSSH connects to libvirtd on a qemu+ssh host, verifying host keys and
+// hopping through any configured jump hosts.
+func dialSSH(host storage.Host, uri *url.URL) (net.Conn, error) {
+	user := "root" // default user
+	if uri.User != nil && uri.User.Username() != "" {
+		user = uri.User.Username()
+	}
+	port := uri.Port()
+	if port == "" {
+		port = "22" // default ssh port
+	}
+	target := sshEndpoint{user: user, addr: net.JoinHostPort(uri.Hostname(), port)}
+
+	// Catch a bad path or mode before opening any connections; the real
+	// socket list needs the remote runtime directory for /session.
+	if _, err := daemonSockets(uri, ""); err != nil {
+		return nil, err
+	}
+
+	jumps, err := parseJumpHosts(host.SSHJumpHosts, user)
+	if err != nil {
+		return nil, err
+	}
+
+	signers, cleanup, err := sshSigners(host, uri.Query().Get("keyfile"))
+	if err != nil {
+		return nil, fmt.Errorf("SSH key authentication setup failed: %w", err)
+	}
+	defer cleanup()
+
+	verifier, err := newHostKeyVerifier(host, uri)
+	if err != nil {
+		return nil, err
+	}
+
+	var clients []*ssh.Client
+	closeAll := func() {
+		for i := len(clients) - 1; i >= 0; i-- {
+			clients[i].Close()
+		}
+	}
+	for _, hop := range append(jumps, target) {
+		config := &ssh.ClientConfig{
+			User:            hop.user,
+			Auth:            []ssh.AuthMethod{ssh.PublicKeys(signers...)},
+			HostKeyCallback: verifier.check,
+			Timeout:         defaultDialTimeout,
+		}
+		log.Debugf("dialLibvirt: attempting SSH connection to %s for user %s", hop.addr, hop.user)
+		var client *ssh.Client
+		if len(clients) == 0 {
+			client, err = sshDialWithTimeout("tcp", hop.addr, config, defaultDialTimeout)
+		} else {
+			client, err = sshDialVia(clients[len(clients)-1], hop.addr, config, defaultDialTimeout)
+		}
+		if err != nil {
+			closeAll()
+			log.Debugf("dialLibvirt: ssh dial to %s failed: %v", hop.addr, err)
+			return nil, fmt.Errorf("failed to dial SSH to %s: %w", hop.addr, err)
+		}
+		clients = append(clients, client)
+	}
+
+	// Dial the libvirt socket on the remote machine through the SSH tunnel.
+	final := clients[len(clients)-1]
+	runtimeDir := ""
+	if isSessionURI(uri) {
+		runtimeDir, err = remoteRuntimeDir(final)
+		if err != nil {
+			closeAll()
+			return nil, err
+		}
+	}
+	sockets, err := daemonSockets(uri, runtimeDir)
+	if err != nil {
+		closeAll()
+		return nil, err
+	}
+	log.Verbosef("SSH connected to %s. Dialing remote libvirt socket (%s)", target.addr, strings.Join(sockets, ", "))
+	conn, err := dialDaemonSocket(sockets, func(path string) (net.Conn, error) {
+		return final.Dial("unix", path)
+	})
+	if err != nil {
+		closeAll()
+		return nil, fmt.Errorf("failed to dial remote libvirt socket via SSH: %w", err)
+	}
+	return &sshTunneledConn{
+		Conn:            conn,
+		client:          final,
+		jumps:           clients[:len(clients)-1],
+		learnedHostKeys: verifier.learned(),
+	}, nil
+}
+
+// sshDialVia opens an SSH client to addr through an existing client, as
+// OpenSSH's ProxyJump does.
+func sshDialVia(via *ssh.Client, addr string, config *ssh.ClientConfig, timeout time.Duration) (*ssh.Client, error) {
+	type result struct {
+		client *ssh.Client
+		err    error
+	}
+	conn, err := via.Dial("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	ch := make(chan result, 1)
+	go func() {
+		c, chans, reqs, err := ssh.NewClientConn(conn, addr, config)
+		if err != nil {
+			ch <- result{err: err}
+			return
+		}
+		ch <- result{client: ssh.NewClient(c, chans, reqs)}
+	}()
+
+	select {
+	case r := <-ch:
+		if r.err != nil {
+			conn.Close()
+		}
+		return r.client, r.err
+	case <-time.After(timeout):
+		conn.Close()
+		return nil, fmt.Errorf("ssh dial to %s timed out after %s", addr, timeout)
+	}
+}
+
+// parseJumpHosts parses a ProxyJump-style list such as
+// "admin@bastion:2222,jump2". Hops without a user inherit defaultUser.
+func parseJumpHosts(spec, defaultUser string) ([]sshEndpoint, error) {
+	var hops []sshEndpoint
+	for _, part := range strings.Split(spec, ",") {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+		hop := sshEndpoint{user: defaultUser}
+		if at := strings.LastIndex(part, "@"); at >= 0 {
+			hop.user = part[:at]
+			part = part[at+1:]
+		}
+		if part == "" || hop.user == "" {
+			return nil, fmt.Errorf("invalid jump host %q", spec)
+		}
+		if _, _, err := net.SplitHostPort(part); err != nil {
+			part = net.JoinHostPort(strings.Trim(part, "[]"), "22")
+		}
+		hop.addr = part
+		hops = append(hops, hop)
+	}
+	return hops, nil
+}
+
+// sshSigners collects the keys offered to SSH servers: the host's own key,
+// then keyFile (the URI's keyfile= parameter) if set, then ssh-agent keys if
+// enabled, then the user's default keys. The returned cleanup closes the
+// agent connection and must be called once dialling is done.
+func sshSigners(host storage.Host, keyFile string) ([]ssh.Signer, func(), error) {
+	var signers []ssh.Signer
+	cleanup := func() {}
+
+	if host.SSHPrivateKey != "" {
+		pemKey, err := storage.DecryptSecret(host.SSHPrivateKey)
+		if err != nil {
+			return nil, cleanup, fmt.Errorf("unable to decrypt private key for host %s: %w", host.ID, err)
+		}
+		signer, err := ParseSSHPrivateKey(pemKey)
+		if err != nil {
+			return nil, cleanup, err
+		}
+		signers = append(signers, signer)
+	}
+
+	if keyFile != "" {
+		key, err := os.ReadFile(keyFile)
+		if err != nil {
+			return nil, cleanup, fmt.Errorf("unable to read keyfile %s: %w", keyFile, err)
+		}
+		signer, err := ParseSSHPrivateKey(string(key))
+		if err != nil {
+			return nil, cleanup, fmt.Errorf("keyfile %s: %w", keyFile, err)
+		}
+		signers = append(signers, signer)
+	}
+
+	if host.SSHUseAgent {
+		sock := os.Getenv("SSH_AUTH_SOCK")
+		if sock == "" {
+			return nil, cleanup, fmt.Errorf("ssh-agent requested but SSH_AUTH_SOCK is not set")
+		}
+		agentConn, err := net.Dial("unix", sock)
+		if err != nil {
+			return nil, cleanup, fmt.Errorf("unable to reach ssh-agent at %s: %w", sock, err)
+		}
+		cleanup = func() { agentConn.Close() }
+		agentSigners, err := agent.NewClient(agentConn).Signers()
+		if err != nil {
+			cleanup()
+			return nil, func() {}, fmt.Errorf("unable to list ssh-agent keys: %w", err)
+		}
+		signers = append(signers, agentSigners...)
+	}
+
+	signers = append(signers, defaultSSHSigners()...)
+	if len(signers) == 0 {
+		cleanup()
+		return nil, func() {}, fmt.Errorf("no SSH keys available: upload a private key for the host, enable ssh-agent, or place an unencrypted key in ~/.ssh")
+	}
+	return signers, cleanup, nil
+}
+
+// defaultSSHSigners loads whichever of the user's default private keys exist
+// and are not passphrase protected.
+func defaultSSHSigners() []ssh.Signer {
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return nil
+	}
+	var signers []ssh.Signer
+	for _, name := range defaultSSHKeyFiles {
+		keyPath := filepath.Join(home, ".ssh", name)
+		key, err := os.ReadFile(keyPath)
+		if err != nil {
+			continue
+		}
+		signer, err := ssh.ParsePrivateKey(key)
+		if err != nil {
+			log.Debugf("Skipping SSH key %s: %v", keyPath, err)
+			continue
+		}
+		signers = append(signers, signer)
+	}
+	return signers
+}
+
+// ParseSSHPrivateKey parses a PEM or OpenSSH private key. Passphrase
+// protected keys are rejected since there is nowhere to supply the passphrase.
+func ParseSSHPrivateKey(pemKey string) (ssh.Signer, error) {
+	signer, err := ssh.ParsePrivateKey([]byte(pemKey))
+	var missing *ssh.PassphraseMissingError
+	if errors.As(err, &missing) {
+		return nil, fmt.Errorf("private key is passphrase protected; provide an unencrypted key or use ssh-agent")
+	}
+	if err != nil {
+		return nil, fmt.Errorf("unable to parse private key: %w", err)
+	}
+	return signer, nil
+}
+
+// hostKeyVerifier checks presented host keys against an optional known_hosts
+// file and the keys pinned on the host, trusting unknown addresses on first use.
+type hostKeyVerifier struct {
+	hostID     string
+	knownHosts ssh.HostKeyCallback
+
+	mu         sync.Mutex
+	pinned     map[string]ssh.PublicKey
+	pinnedText string
+	newLines   []string
+}
+
+// newHostKeyVerifier builds the verifier for a host. A known_hosts= URI
+// parameter takes precedence over the host's configured known_hosts file.
+func newHostKeyVerifier(host storage.Host, uri *url.URL) (*hostKeyVerifier, error) {
+	v := &hostKeyVerifier{hostID: host.ID, pinnedText: host.SSHHostKeys}
+	pinned, err := ParsePinnedHostKeys(host.SSHHostKeys)
+	if err != nil {
+		return nil, fmt.Errorf("invalid pinned SSH host keys for host %s: %w", host.ID, err)
+	}
+	v.pinned = pinned
+	knownHostsFile := host.SSHKnownHostsFile
+	if file := uri.Query().Get("known_hosts"); file != "" {
+		knownHostsFile = file
+	}
+	if knownHostsFile != "" {
+		cb, err := knownhosts.New(knownHostsFile)
+		if err != nil {
+			return nil, fmt.Errorf("unable to load known_hosts file %s: %w", knownHostsFile, err)
+		}
+		v.knownHosts = cb
+	}
+	return v, nil
+}
+
+func (v *hostKeyVerifier) check(hostname string, remote net.Addr, key ssh.PublicKey) error {
+	if v.knownHosts != nil {
+		if err := v.knownHosts(hostname, remote, key); err != nil {
+			return fmt.Errorf("host key for %s rejected by known_hosts: %w", hostname, err)
+		}
+	}
+
+	addr := knownhosts.Normalize(hostname)
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	if want, ok := v.pinned[addr]; ok {
+		if !bytes.Equal(want.Marshal(), key.Marshal()) {
+			return &HostKeyMismatchError{Address: addr, Pinned: ssh.FingerprintSHA256(want), Presented: ssh.FingerprintSHA256(key)}
+		}
+		return nil
+	}
+
+	log.Infof("Trusting SSH host key for %s on first use (host %s): %s", addr, v.hostID, ssh.FingerprintSHA256(key))
+	v.pinned[addr] = key
+	v.newLines = append(v.newLines, knownhosts.Line([]string{addr}, key))
+	return nil
+}
+
+// learned returns the full pinned key set if new keys were trusted, else "".
+func (v *hostKeyVerifier) learned() string {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	if len(v.newLines) == 0 {
+		return ""
+	}
+	lines := v.newLines
+	if existing := strings.TrimSpace(v.pinnedText); existing != "" {
+		lines = append([]string{existing}, lines...)
+	}
+	return strings.Join(lines, "\n") + "\n"
+}
+
+// ParsePinnedHostKeys parses pinned host keys stored in known_hosts format,
+// keyed by normalized address.
+func ParsePinnedHostKeys(text string) (map[string]ssh.PublicKey, error) {
+	keys := make(map[string]ssh.PublicKey)
+	rest := []byte(text)
+	for len(bytes.TrimSpace(rest)) > 0 {
+		_, hosts, key, _, next, err := ssh.ParseKnownHosts(rest)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		for _, h := range hosts {
+			keys[knownhosts.Normalize(h)] = key
+		}
+		rest = next
+	}
+	return keys, nil
+}
+
+// PinnedHostKeyFingerprints returns the SHA256 fingerprint of each pinned
+// host key, keyed by address.
+func PinnedHostKeyFingerprints(text string) (map[string]string, error) {
+	keys, err := ParsePinnedHostKeys(text)
+	if err != nil {
+		return nil, err
+	}
+	out := make(map[string]string, len(keys))
+	for addr, key := range keys {
+		out[addr] = ssh.FingerprintSHA256(key)
+	}
+	return out, nil
+}
+
+// LearnedHostKeys returns the updated pinned SSH host keys for a host if its
+// latest connect trusted a key for the first time, or "" otherwise.
+func (c *Connector) LearnedHostKeys(hostID string) string {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.learnedHostKeys[hostID]
+}
@@ -0,0 +1,224 @@
+package libvirt
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/capsali/virtumancer/internal/storage"
+)
+
+// Locations libvirt clients read TLS credentials from when neither the host
+// record nor a pkipath URI parameter says otherwise.
+const (
+	defaultTLSCACert     = "/etc/pki/CA/cacert.pem"
+	defaultTLSClientCert = "/etc/pki/libvirt/clientcert.pem"
+	defaultTLSClientKey  = "/etc/pki/libvirt/private/clientkey.pem"
+)
+
+// defaultTLSPort is libvirtd's TLS listen port.
+const defaultTLSPort = "16514"
+
+// tlsCredential is one PEM item together with a description of where it came
+// from, so errors can point at the file or upload that was wrong.
+type tlsCredential struct {
+	pem    []byte
+	source string
+}
+
+// dialTLS connects to libvirtd on a qemu+tls host. The handshake is completed
+// before returning so certificate problems surface here rather than on the
+// first RPC.
+func dialTLS(host storage.Host, uri *url.URL) (net.Conn, error) {
+	config, err := tlsConfigForHost(host, uri)
+	if err != nil {
+		return nil, err
+	}
+
+	port := uri.Port()
+	if port == "" {
+		port = defaultTLSPort
+	}
+	address := net.JoinHostPort(uri.Hostname(), port)
+
+	dialer := &net.Dialer{Timeout: defaultDialTimeout}
+	conn, err := tls.DialWithDialer(dialer, "tcp", address, config)
+	if err != nil {
+		return nil, describeTLSError(address, err)
+	}
+	return conn, nil
+}
+
+// tlsConfigForHost assembles the client TLS configuration for a host. Each
+// credential is taken from the uploaded PEM on the host record, then the
+// configured path, then the URI's pkipath directory, then libvirt's default
+// location. With no_verify=1 the server certificate is not checked and a CA
+// is optional, matching libvirt's client behaviour.
+func tlsConfigForHost(host storage.Host, uri *url.URL) (*tls.Config, error) {
+	query := uri.Query()
+	pkiPath := query.Get("pkipath")
+	noVerify := query.Get("no_verify") == "1"
+
+	pkiFile := func(name, fallback string) string {
+		if pkiPath != "" {
+			return filepath.Join(pkiPath, name)
+		}
+		return fallback
+	}
+
+	config := &tls.Config{
+		ServerName:         uri.Hostname(),
+		MinVersion:         tls.VersionTLS12,
+		InsecureSkipVerify: noVerify,
+	}
+
+	ca, err := loadTLSCredential(host.TLSCACert, "uploaded CA certificate", host.TLSCACertPath, pkiFile("cacert.pem", defaultTLSCACert))
+	if err != nil {
+		return nil, fmt.Errorf("TLS CA certificate check failed: %w", err)
+	}
+	if ca == nil && !noVerify {
+		return nil, fmt.Errorf("TLS CA certificate check failed: no CA certificate configured for host %s; upload one, set a path, or use the pkipath URI parameter", host.ID)
+	}
+	if ca != nil {
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(ca.pem) {
+			return nil, fmt.Errorf("TLS CA certificate check failed: %s contains no PEM certificates", ca.source)
+		}
+		config.RootCAs = pool
+	}
+
+	cert, err := loadTLSCredential(host.TLSClientCert, "uploaded client certificate", host.TLSClientCertPath, pkiFile("clientcert.pem", defaultTLSClientCert))
+	if err != nil {
+		return nil, fmt.Errorf("TLS client certificate check failed: %w", err)
+	}
+	keyPEM := ""
+	if host.TLSClientKey != "" {
+		keyPEM, err = storage.DecryptSecret(host.TLSClientKey)
+		if err != nil {
+			return nil, fmt.Errorf("unable to decrypt TLS client key for host %s: %w", host.ID, err)
+		}
+	}
+	key, err := loadTLSCredential(keyPEM, "uploaded client key", host.TLSClientKeyPath, pkiFile("clientkey.pem", defaultTLSClientKey))
+	if err != nil {
+		return nil, fmt.Errorf("TLS client key check failed: %w", err)
+	}
+
+	switch {
+	case cert == nil && key == nil:
+		// Servers with tls_no_verify_certificate accept anonymous clients.
+	case cert == nil:
+		return nil, fmt.Errorf("TLS client certificate check failed: client key %s has no matching certificate", key.source)
+	case key == nil:
+		return nil, fmt.Errorf("TLS client key check failed: client certificate %s has no matching key", cert.source)
+	default:
+		pair, err := tls.X509KeyPair(cert.pem, key.pem)
+		if err != nil {
+			return nil, fmt.Errorf("TLS client certificate check failed: %s and %s do not form a valid key pair: %w", cert.source, key.source, err)
+		}
+		config.Certificates = []tls.Certificate{pair}
+	}
+
+	return config, nil
+}
+
+// loadTLSCredential returns the first configured source of a credential. An
+// explicitly configured path must exist; a missing pkipath or default file
+// just means the credential is absent.
+func loadTLSCredential(uploaded, uploadedDesc, path, fallback string) (*tlsCredential, error) {
+	if uploaded != "" {
+		return &tlsCredential{pem: []byte(uploaded), source: uploadedDesc}, nil
+	}
+	if path != "" {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return nil, fmt.Errorf("unable to read %s: %w", path, err)
+		}
+		return &tlsCredential{pem: data, source: path}, nil
+	}
+	data, err := os.ReadFile(fallback)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("unable to read %s: %w", fallback, err)
+	}
+	return &tlsCredential{pem: data, source: fallback}, nil
+}
+
+// describeTLSError turns a failed handshake into an error naming the check
+// that failed. The original error stays wrapped.
+func describeTLSError(address string, err error) error {
+	var hostnameErr x509.HostnameError
+	var authorityErr x509.UnknownAuthorityError
+	var invalidErr x509.CertificateInvalidError
+	var alert tls.AlertError
+
+	switch {
+	case errors.As(err, &hostnameErr):
+		return fmt.Errorf("TLS server certificate check failed for %s: certificate is not valid for host name %q: %w", address, hostnameErr.Host, err)
+	case errors.As(err, &authorityErr):
+		return fmt.Errorf("TLS server certificate check failed for %s: certificate is not signed by the configured CA: %w", address, err)
+	case errors.As(err, &invalidErr):
+		if invalidErr.Reason == x509.Expired {
+			return fmt.Errorf("TLS server certificate check failed for %s: certificate has expired or is not yet valid: %w", address, err)
+		}
+		return fmt.Errorf("TLS server certificate check failed for %s: certificate is invalid: %w", address, err)
+	case errors.As(err, &alert) && strings.Contains(alert.Error(), "certificate"):
+		return fmt.Errorf("TLS client certificate check failed: %s rejected the client certificate: %w", address, err)
+	default:
+		return fmt.Errorf("TLS handshake with %s failed: %w", address, err)
+	}
+}
+
+// ParseTLSPrivateKey checks that pemKey holds an unencrypted private key that
+// a TLS client certificate could be paired with.
+func ParseTLSPrivateKey(pemKey string) error {
+	block, _ := pem.Decode([]byte(pemKey))
+	if block == nil {
+		return fmt.Errorf("TLS client key is not PEM encoded")
+	}
+	if x509.IsEncryptedPEMBlock(block) { //nolint:staticcheck // still the only way to detect legacy encrypted PEM
+		return fmt.Errorf("TLS client key is passphrase protected; upload an unencrypted key")
+	}
+	if _, err := x509.ParsePKCS8PrivateKey(block.Bytes); err == nil {
+		return nil
+	}
+	if _, err := x509.ParsePKCS1PrivateKey(block.Bytes); err == nil {
+		return nil
+	}
+	if _, err := x509.ParseECPrivateKey(block.Bytes); err == nil {
+		return nil
+	}
+	return fmt.Errorf("TLS client key is not a supported private key")
+}
+
+// ParseTLSCertificates checks that pemCerts holds at least one certificate.
+func ParseTLSCertificates(pemCerts string) error {
+	rest := []byte(pemCerts)
+	found := 0
+	for {
+		var block *pem.Block
+		block, rest = pem.Decode(rest)
+		if block == nil {
+			break
+		}
+		if block.Type != "CERTIFICATE" {
+			continue
+		}
+		if _, err := x509.ParseCertificate(block.Bytes); err != nil {
+			return fmt.Errorf("invalid certificate: %w", err)
+		}
+		found++
+	}
+	if found == 0 {
+		return fmt.Errorf("no PEM certificates found")
+	}
+	return nil
+}
@@ -0,0 +1,148 @@
+package libvirt
+
+import (
+	"fmt"
+	"net"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	log "github.com/capsali/virtumancer/internal/logging"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// Values accepted by the mode= URI parameter. "legacy" talks to the
+// monolithic libvirtd, "direct" to the modular virtqemud, and "auto" picks
+// whichever is running.
+const (
+	daemonModeAuto   = "auto"
+	daemonModeLegacy = "legacy"
+	daemonModeDirect = "direct"
+)
+
+const (
+	systemSocketDir   = "/var/run/libvirt"
+	monolithicSocket  = "libvirt-sock"
+	modularQEMUSocket = "virtqemud-sock"
+)
+
+// isSessionURI reports whether the URI asks for the per-user session daemon
+// rather than the system one.
+func isSessionURI(uri *url.URL) bool {
+	return uri.Path == "/session"
+}
+
+// daemonSockets returns the unix sockets to try, in order, for a URI. An
+// explicit socket= parameter wins; otherwise the socket follows from the
+// /system or /session path and the mode= parameter. runtimeDir is the XDG
+// runtime directory of the daemon's user and only matters for /session.
+func daemonSockets(uri *url.URL, runtimeDir string) ([]string, error) {
+	query := uri.Query()
+	if socket := query.Get("socket"); socket != "" {
+		return []string{socket}, nil
+	}
+
+	var dir string
+	switch uri.Path {
+	case "", "/system":
+		dir = systemSocketDir
+	case "/session":
+		dir = filepath.Join(runtimeDir, "libvirt")
+	default:
+		return nil, fmt.Errorf("unsupported libvirt URI path %q: use /system or /session, or set socket=", uri.Path)
+	}
+
+	switch mode := query.Get("mode"); mode {
+	case "", daemonModeAuto:
+		return []string{filepath.Join(dir, modularQEMUSocket), filepath.Join(dir, monolithicSocket)}, nil
+	case daemonModeDirect:
+		return []string{filepath.Join(dir, modularQEMUSocket)}, nil
+	case daemonModeLegacy:
+		return []string{filepath.Join(dir, monolithicSocket)}, nil
+	default:
+		return nil, fmt.Errorf("unsupported mode %q: use auto, legacy or direct", mode)
+	}
+}
+
+// dialDaemonSocket dials each socket in turn and returns the first that
+// accepts a connection, which is how modular and monolithic daemons are told
+// apart in auto mode.
+func dialDaemonSocket(sockets []string, dial func(path string) (net.Conn, error)) (net.Conn, error) {
+	var failures []string
+	for _, path := range sockets {
+		conn, err := dial(path)
+		if err == nil {
+			if len(sockets) > 1 {
+				log.Verbosef("Using libvirt daemon socket %s", path)
+			}
+			return conn, nil
+		}
+		log.Debugf("libvirt socket %s unavailable: %v", path, err)
+		failures = append(failures, fmt.Sprintf("%s: %v", path, err))
+	}
+	return nil, fmt.Errorf("no libvirt daemon socket reachable (%s)", strings.Join(failures, "; "))
+}
+
+// localRuntimeDir mirrors how libvirt finds the session daemon of the user
+// Virtumancer runs as.
+func localRuntimeDir() string {
+	if dir := os.Getenv("XDG_RUNTIME_DIR"); dir != "" {
+		return dir
+	}
+	return filepath.Join("/run/user", strconv.Itoa(os.Getuid()))
+}
+
+// remoteRuntimeDir asks the SSH server for the login user's runtime
+// directory. Non-interactive sessions often lack XDG_RUNTIME_DIR, so the
+// systemd default is derived from the uid when it is unset.
+func remoteRuntimeDir(client *ssh.Client) (string, error) {
+	session, err := client.NewSession()
+	if err != nil {
+		return "", fmt.Errorf("unable to open SSH session: %w", err)
+	}
+	defer session.Close()
+	out, err := session.Output(`echo "${XDG_RUNTIME_DIR:-/run/user/$(id -u)}"`)
+	if err != nil {
+		return "", fmt.Errorf("unable to determine remote runtime directory: %w", err)
+	}
+	dir := strings.TrimSpace(string(out))
+	if dir == "" {
+		return "", fmt.Errorf("remote runtime directory is empty")
+	}
+	return dir, nil
+}
+
+// ValidateURI checks the parts of a libvirt URI that are resolved locally,
+// without connecting anywhere.
+func ValidateURI(rawURI string) error {
+	uri, err := url.Parse(rawURI)
+	if err != nil {
+		return fmt.Errorf("invalid URI: %w", err)
+	}
+	switch uri.Scheme {
+	case "qemu+ssh":
+		_, err = daemonSockets(uri, "")
+	case "qemu", "qemu+unix":
+		if !isLegacySocketPath(uri) {
+			_, err = daemonSockets(uri, "")
+		}
+	case "qemu+tcp", "qemu+tls":
+	default:
+		err = fmt.Errorf("unsupported scheme: %s", uri.Scheme)
+	}
+	return err
+}
+
+// isLegacySocketPath reports whether a local URI names its socket in the path,
+// as in qemu+unix:///run/libvirt/virtqemud-sock, which older Virtumancer
+// releases accepted in place of socket=.
+func isLegacySocketPath(uri *url.URL) bool {
+	switch uri.Path {
+	case "", "/system", "/session":
+		return false
+	}
+	return uri.Query().Get("socket") == ""
+}
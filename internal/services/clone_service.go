@@ -0,0 +1,409 @@
+package services
+
+import (
+	"encoding/json"
+	"fmt"
+	"path/filepath"
+	"strings"
+
+	"github.com/capsali/virtumancer/internal/libvirt"
+	log "github.com/capsali/virtumancer/internal/logging"
+	"github.com/capsali/virtumancer/internal/storage"
+	golibvirt "github.com/digitalocean/go-libvirt"
+	"github.com/google/uuid"
+)
+
+// CloneRequest describes a copy of a shut-off VM.
+type CloneRequest struct {
+	Name string `json:"name"`
+	// TargetHostID is the host that runs the clone; it defaults to the
+	// source VM's host.
+	TargetHostID string `json:"target_host_id,omitempty"`
+	// TargetPool receives the copied volumes. By default each copy goes to
+	// the pool of the volume it was copied from.
+	TargetPool string `json:"target_pool,omitempty"`
+	// Linked creates qcow2 overlays backed by the source VM's volumes
+	// instead of copying them. Linked clones must stay on the source host.
+	Linked bool `json:"linked"`
+}
+
+// clonedVolume is one volume copied for a clone, with the source disk it
+// replaces.
+type clonedVolume struct {
+	source libvirt.DiskInfo
+	detail *libvirt.VolumeDetail
+	// backingDiskID is the source disk a linked copy overlays.
+	backingDiskID string
+}
+
+// cloneVolumeName names the copy of a disk. Disks named after the source VM
+// are renamed after the clone; others get the clone's name and the disk's
+// target device.
+func cloneVolumeName(srcVM, cloneName string, disk libvirt.DiskInfo, linked bool) string {
+	base := filepath.Base(disk.Source.File)
+	ext := filepath.Ext(base)
+	stem := strings.TrimSuffix(base, ext)
+	if linked {
+		ext = ".qcow2"
+	}
+	if strings.HasPrefix(stem, srcVM) {
+		return cloneName + strings.TrimPrefix(stem, srcVM) + ext
+	}
+	return fmt.Sprintf("%s-%s%s", cloneName, disk.Target.Dev, ext)
+}
+
+// CloneVM copies a shut-off VM under a new name, on the same host or
+// another one. Every writable disk is copied, or overlaid when req.Linked is
+// set; read-only and shareable disks such as ISOs are used in place. The
+// clone gets a new UUID and new MAC addresses.
+func (s *HostService) CloneVM(hostID, vmName string, req CloneRequest) (*storage.VirtualMachine, error) {
+	if req.Name == "" {
+		return nil, fmt.Errorf("invalid clone: name is required")
+	}
+	targetHostID := req.TargetHostID
+	if targetHostID == "" {
+		targetHostID = hostID
+	}
+	if req.Linked && targetHostID != hostID {
+		return nil, fmt.Errorf("invalid clone: linked clones must stay on host %s", hostID)
+	}
+	src, err := s.findVM(hostID, vmName)
+	if err != nil {
+		return nil, err
+	}
+	if targetHostID != hostID {
+		var target storage.Host
+		if err := s.db.Where("id = ?", targetHostID).First(&target).Error; err != nil {
+			return nil, fmt.Errorf("target host %s not found: %w", targetHostID, err)
+		}
+	}
+	if !s.connector.IsConnected(hostID) {
+		return nil, fmt.Errorf("host %s is disconnected", hostID)
+	}
+	if !s.connector.IsConnected(targetHostID) {
+		return nil, fmt.Errorf("target host %s is disconnected", targetHostID)
+	}
+
+	var clashes int64
+	if err := s.db.Model(&storage.VirtualMachine{}).Where("host_id = ? AND name = ?", targetHostID, req.Name).Count(&clashes).Error; err != nil {
+		return nil, fmt.Errorf("failed to check host %s for vm %s: %w", targetHostID, req.Name, err)
+	}
+	if _, err := s.connector.GetDomainInfo(targetHostID, req.Name); err == nil || clashes > 0 {
+		return nil, fmt.Errorf("vm name %s is already in use on host %s", req.Name, targetHostID)
+	}
+
+	info, err := s.connector.GetDomainInfo(hostID, vmName)
+	if err != nil {
+		return nil, err
+	}
+	if info.State != golibvirt.DomainShutoff {
+		return nil, fmt.Errorf("invalid clone: vm %s must be shut off to be cloned", vmName)
+	}
+	hardware, err := s.connector.GetDomainHardware(hostID, vmName)
+	if err != nil {
+		return nil, err
+	}
+	domainXML, err := s.connector.GetDomainXML(hostID, vmName)
+	if err != nil {
+		return nil, err
+	}
+
+	srcDisks := s.db.Model(&storage.DiskAttachment{}).Select("disk_id").Where("vm_uuid = ?", src.ID)
+	s.db.Model(&storage.Disk{}).Where("id IN (?)", srcDisks).Update("task_state", storage.StorageTaskCloning)
+	defer s.db.Model(&storage.Disk{}).Where("id IN (?)", srcDisks).Update("task_state", "")
+
+	cloneUUID := uuid.New().String()
+	spec := libvirt.DomainCloneSpec{
+		Name:  req.Name,
+		UUID:  cloneUUID,
+		Disks: make(map[string]libvirt.ClonedDisk),
+		MACs:  make(map[string]string),
+	}
+	for _, nic := range hardware.Networks {
+		if nic.Mac.Address == "" {
+			continue
+		}
+		mac, err := libvirt.GenerateMAC()
+		if err != nil {
+			return nil, err
+		}
+		spec.MACs[strings.ToLower(nic.Mac.Address)] = mac
+	}
+
+	// Linked copies record the disk they overlay, so the source can be
+	// locked against writes while they exist.
+	srcDiskIDs := make(map[string]string)
+	if req.Linked {
+		var atts []storage.DiskAttachment
+		if err := s.db.Preload("Disk").Where("vm_uuid = ?", src.ID).Find(&atts).Error; err != nil {
+			return nil, fmt.Errorf("failed to load disks of vm %s: %w", vmName, err)
+		}
+		for _, att := range atts {
+			srcDiskIDs[att.Disk.Path] = att.DiskID
+		}
+	}
+
+	var copies []clonedVolume
+	removeCopies := func() {
+		for _, c := range copies {
+			if err := s.connector.DeleteStorageVolume(targetHostID, c.detail.PoolName, c.detail.Name); err != nil {
+				log.Warnf("Failed to remove volume %s of clone %s: %v", c.detail.Path, req.Name, err)
+			}
+		}
+	}
+	for _, disk := range hardware.Disks {
+		if disk.Device != "disk" || disk.Source.File == "" || disk.ReadOnly || disk.Shareable {
+			continue
+		}
+		backingDiskID := srcDiskIDs[disk.Source.File]
+		if req.Linked && backingDiskID == "" {
+			removeCopies()
+			return nil, fmt.Errorf("invalid clone: disk %s of vm %s is not tracked yet; sync the vm first", disk.Target.Dev, vmName)
+		}
+		detail, err := s.connector.CloneStorageVolume(libvirt.VolumeCloneSpec{
+			SourceHostID: hostID,
+			SourcePath:   disk.Source.File,
+			HostID:       targetHostID,
+			PoolName:     req.TargetPool,
+			Name:         cloneVolumeName(vmName, req.Name, disk, req.Linked),
+			Linked:       req.Linked,
+		})
+		if err != nil {
+			removeCopies()
+			return nil, err
+		}
+		copies = append(copies, clonedVolume{source: disk, detail: detail, backingDiskID: backingDiskID})
+		spec.Disks[disk.Source.File] = libvirt.ClonedDisk{Path: detail.Path, Format: detail.Format}
+	}
+
+	cloneXML, err := libvirt.CloneDomainXML(domainXML, spec)
+	if err != nil {
+		removeCopies()
+		return nil, err
+	}
+	if _, err := s.connector.DefineAndCreateDomain(targetHostID, cloneXML); err != nil {
+		removeCopies()
+		return nil, err
+	}
+
+	clone, err := s.recordClone(src, targetHostID, spec, copies)
+	if err != nil {
+		if undefErr := s.connector.UndefineDomain(targetHostID, req.Name); undefErr != nil {
+			log.Warnf("Failed to remove definition of clone %s from host %s: %v", req.Name, targetHostID, undefErr)
+		}
+		removeCopies()
+		return nil, err
+	}
+
+	log.Infof("Cloned VM %s on host %s to %s on host %s", vmName, hostID, req.Name, targetHostID)
+	if _, err := s.detectDriftOrIngestVM(targetHostID, req.Name, false); err != nil {
+		log.Verbosef("Warning: failed to sync clone %s on host %s: %v", req.Name, targetHostID, err)
+	}
+	s.broadcastVMsChanged(targetHostID)
+	s.broadcastDiscoveredVMsChanged(targetHostID)
+	return clone, nil
+}
+
+// recordClone creates the rows of a cloned VM, its copied disks and its
+// re-addressed ports in one transaction.
+func (s *HostService) recordClone(src *storage.VirtualMachine, targetHostID string, spec libvirt.DomainCloneSpec, copies []clonedVolume) (*storage.VirtualMachine, error) {
+	var ports []storage.PortAttachment
+	if err := s.db.Preload("Port").Where("vm_uuid = ?", src.ID).Order("ordinal").Find(&ports).Error; err != nil {
+		return nil, fmt.Errorf("failed to load ports of vm %s: %w", src.Name, err)
+	}
+
+	clone := storage.VirtualMachine{
+		Base:            storage.Base{ID: spec.UUID},
+		HostID:          targetHostID,
+		Name:            spec.Name,
+		DomainUUID:      spec.UUID,
+		Source:          "managed",
+		Title:           src.Title,
+		Description:     src.Description,
+		State:           storage.StateStopped,
+		LibvirtState:    storage.StateStopped,
+		VCPUCount:       src.VCPUCount,
+		CPUModel:        src.CPUModel,
+		CPUTopologyJSON: src.CPUTopologyJSON,
+		MemoryBytes:     src.MemoryBytes,
+		CurrentMemory:   src.CurrentMemory,
+		OSType:          src.OSType,
+		Metadata:        src.Metadata,
+		SyncStatus:      storage.StatusSynced,
+	}
+	if clone.Title == "" || clone.Title == src.Name {
+		clone.Title = spec.Name
+	}
+
+	tx := s.db.Begin()
+	if err := tx.Create(&clone).Error; err != nil {
+		tx.Rollback()
+		return nil, fmt.Errorf("failed to save clone %s: %w", spec.Name, err)
+	}
+	for _, c := range copies {
+		vol := storage.Volume{
+			Name:          c.detail.Name,
+			Path:          c.detail.Path,
+			Type:          "DISK",
+			Format:        c.detail.Format,
+			CapacityBytes: c.detail.Capacity,
+			State:         string(storage.StorageStateAvailable),
+		}
+		var pool storage.StoragePool
+		if err := tx.Where("host_id = ? AND name = ?", targetHostID, c.detail.PoolName).First(&pool).Error; err == nil {
+			vol.StoragePoolID = pool.ID
+		}
+		if err := tx.Create(&vol).Error; err != nil {
+			tx.Rollback()
+			return nil, fmt.Errorf("failed to save volume %s: %w", c.detail.Path, err)
+		}
+
+		driverJSON, _ := json.Marshal(map[string]interface{}{
+			"name": c.source.Driver.Name,
+			"type": c.detail.Format,
+		})
+		disk := storage.Disk{
+			Name:          normalizeStorageName(c.detail.Path),
+			VolumeID:      &vol.ID,
+			Path:          c.detail.Path,
+			Format:        c.detail.Format,
+			CapacityBytes: c.detail.Capacity,
+			DriverJSON:    string(driverJSON),
+			State:         string(storage.StorageStateAvailable),
+		}
+		if c.detail.BackingPath != "" {
+			backingJSON, _ := json.Marshal(map[string]interface{}{
+				"path":   c.detail.BackingPath,
+				"format": c.source.Driver.Type,
+			})
+			disk.BackingJSON = string(backingJSON)
+		}
+		if c.backingDiskID != "" {
+			disk.BackingDiskID = &c.backingDiskID
+		}
+		if err := tx.Create(&disk).Error; err != nil {
+			tx.Rollback()
+			return nil, fmt.Errorf("failed to save disk %s: %w", c.detail.Path, err)
+		}
+		att := storage.DiskAttachment{
+			VMUUID:     clone.ID,
+			DiskID:     disk.ID,
+			DeviceName: c.source.Target.Dev,
+			BusType:    c.source.Target.Bus,
+		}
+		if err := tx.Create(&att).Error; err != nil {
+			tx.Rollback()
+			return nil, fmt.Errorf("failed to attach disk %s to clone %s: %w", c.detail.Path, spec.Name, err)
+		}
+		if err := s.ensureAttachmentIndex(tx, storage.AttachmentIndex{VMUUID: clone.ID, DeviceType: "disk", AttachmentID: att.ID, DeviceID: &disk.ID}); err != nil {
+			tx.Rollback()
+			return nil, err
+		}
+	}
+
+	for _, att := range ports {
+		mac, ok := spec.MACs[strings.ToLower(att.MACAddress)]
+		if !ok {
+			// The attachment is stale; the next sync records the NIC anyway.
+			continue
+		}
+		port := att.Port
+		port.Base = storage.Base{}
+		port.MACAddress = mac
+		port.IPAddress = ""
+		port.HostID = targetHostID
+		if err := tx.Create(&port).Error; err != nil {
+			tx.Rollback()
+			return nil, fmt.Errorf("failed to save port %s of clone %s: %w", mac, spec.Name, err)
+		}
+		// Bind the port like an attached NIC, to the network of the same
+		// name on the clone's host.
+		switch port.SourceType {
+		case NICTypeNetwork, NICTypeBridge, NICTypeDirect:
+			if port.SourceRef == "" {
+				break
+			}
+			network, err := s.findOrCreateNICNetwork(tx, targetHostID, port.SourceType, port.SourceRef)
+			if err != nil {
+				tx.Rollback()
+				return nil, err
+			}
+			if err := s.rebindPort(tx, port.ID, network.ID); err != nil {
+				tx.Rollback()
+				return nil, err
+			}
+		}
+		portAtt := storage.PortAttachment{
+			VMUUID:      clone.ID,
+			PortID:      port.ID,
+			HostID:      targetHostID,
+			DeviceName:  att.DeviceName,
+			MACAddress:  mac,
+			ModelName:   att.ModelName,
+			Ordinal:     att.Ordinal,
+			AddressJSON: att.AddressJSON,
+		}
+		if err := tx.Create(&portAtt).Error; err != nil {
+			tx.Rollback()
+			return nil, fmt.Errorf("failed to attach port %s to clone %s: %w", mac, spec.Name, err)
+		}
+		if err := s.ensureAttachmentIndex(tx, storage.AttachmentIndex{VMUUID: clone.ID, DeviceType: "port", AttachmentID: portAtt.ID, DeviceID: &port.ID}); err != nil {
+			tx.Rollback()
+			return nil, err
+		}
+	}
+
+	// The target may have listed the domain as discovered once it was defined.
+	if err := tx.Where("host_id = ? AND domain_uuid = ?", targetHostID, spec.UUID).Delete(&storage.DiscoveredVM{}).Error; err != nil {
+		tx.Rollback()
+		return nil, fmt.Errorf("failed to clear discovered vm %s on host %s: %w", spec.Name, targetHostID, err)
+	}
+	if err := tx.Commit().Error; err != nil {
+		return nil, fmt.Errorf("failed to save clone %s: %w", spec.Name, err)
+	}
+	return &clone, nil
+}
+
+// linkedCloneOf names a linked clone with an overlay backed by one of
+// diskIDs, a list or subquery of disk IDs. Overlays no longer attached to a
+// VM are named by path. It returns "" when the disks back nothing.
+func (s *HostService) linkedCloneOf(diskIDs interface{}) (string, error) {
+	var overlays []storage.Disk
+	if err := s.db.Where("backing_disk_id IN (?)", diskIDs).Order("path").Find(&overlays).Error; err != nil {
+		return "", fmt.Errorf("failed to look up linked clones: %w", err)
+	}
+	if len(overlays) == 0 {
+		return "", nil
+	}
+	var clones []storage.VirtualMachine
+	err := s.db.Where("id IN (?)", s.db.Model(&storage.DiskAttachment{}).Select("vm_uuid").Where("disk_id = ?", overlays[0].ID)).
+		Limit(1).Find(&clones).Error
+	if err != nil {
+		return "", fmt.Errorf("failed to look up linked clones: %w", err)
+	}
+	if len(clones) == 0 {
+		return overlays[0].Path, nil
+	}
+	return clones[0].Name, nil
+}
+
+// ensureNotLinkedCloneBase refuses an operation that could write to a VM's
+// disks while linked clones read through to them; any change to the base
+// image corrupts every overlay. VMs without a record have no clones.
+func (s *HostService) ensureNotLinkedCloneBase(hostID, vmName, operation string) error {
+	var vms []storage.VirtualMachine
+	if err := s.db.Where("host_id = ? AND name = ?", hostID, vmName).Limit(1).Find(&vms).Error; err != nil {
+		return fmt.Errorf("failed to load vm %s: %w", vmName, err)
+	}
+	if len(vms) == 0 {
+		return nil
+	}
+	clone, err := s.linkedCloneOf(s.db.Model(&storage.DiskAttachment{}).Select("disk_id").Where("vm_uuid = ?", vms[0].ID))
+	if err != nil {
+		return err
+	}
+	if clone != "" {
+		return fmt.Errorf("vm %s is in use as the base of linked clone %s and cannot be %s", vmName, clone, operation)
+	}
+	return nil
+}
@@ -0,0 +1,429 @@
+package services
+
+import (
+	"encoding/json"
+	"fmt"
+
+	"github.com/capsali/virtumancer/internal/libvirt"
+	log "github.com/capsali/virtumancer/internal/logging"
+	"github.com/capsali/virtumancer/internal/storage"
+	"gorm.io/gorm"
+)
+
+// diskCacheModes are the cache modes libvirt accepts on a disk driver.
+var diskCacheModes = map[string]bool{
+	"default":      true,
+	"none":         true,
+	"writethrough": true,
+	"writeback":    true,
+	"directsync":   true,
+	"unsafe":       true,
+}
+
+// DiskAttachRequest attaches an existing volume, or a new one created in
+// Pool, to a VM.
+type DiskAttachRequest struct {
+	VolumeID string `json:"volume_id,omitempty"`
+	// Pool, Name and SizeBytes describe a new qcow2 volume. Pool defaults
+	// to "default" and Name to one derived from the VM and target device.
+	Pool      string `json:"pool,omitempty"`
+	Name      string `json:"name,omitempty"`
+	SizeBytes uint64 `json:"size_bytes,omitempty"`
+	Bus       string `json:"bus,omitempty"`
+	Cache     string `json:"cache,omitempty"`
+	ReadOnly  bool   `json:"read_only"`
+	Shareable bool   `json:"shareable"`
+}
+
+// DiskUpdateRequest changes the settings of an attached disk. Nil fields are
+// left as they are.
+type DiskUpdateRequest struct {
+	Cache     *string `json:"cache,omitempty"`
+	ReadOnly  *bool   `json:"read_only,omitempty"`
+	Shareable *bool   `json:"shareable,omitempty"`
+}
+
+func validateDiskCache(cache string) error {
+	if cache != "" && !diskCacheModes[cache] {
+		return fmt.Errorf("invalid disk: unsupported cache mode %q", cache)
+	}
+	return nil
+}
+
+// diskDriverJSON records the driver settings of a disk the way host syncs do.
+func diskDriverJSON(format, cache string) string {
+	driver := map[string]interface{}{"name": "qemu", "type": format}
+	if cache != "" {
+		driver["cache"] = cache
+	}
+	out, _ := json.Marshal(driver)
+	return string(out)
+}
+
+// diskIOTuneJSON records a disk's I/O limits, or "" when it has none.
+func diskIOTuneJSON(tune *libvirt.DiskIOTune) string {
+	if tune == nil || *tune == (libvirt.DiskIOTune{}) {
+		return ""
+	}
+	out, _ := json.Marshal(tune)
+	return string(out)
+}
+
+// syncedDiskDriver is the driver of a disk in domain XML, as host syncs
+// record it.
+func syncedDiskDriver(disk libvirt.DiskInfo) map[string]interface{} {
+	driver := map[string]interface{}{"name": disk.Driver.Name, "type": disk.Driver.Type}
+	if disk.Driver.Cache != "" {
+		driver["cache"] = disk.Driver.Cache
+	}
+	return driver
+}
+
+// findVMDisk returns the disk of a VM's domain with the given target device.
+func (s *HostService) findVMDisk(hostID, vmName, device string) (*libvirt.DiskInfo, error) {
+	hardware, err := s.connector.GetDomainHardware(hostID, vmName)
+	if err != nil {
+		return nil, err
+	}
+	for i := range hardware.Disks {
+		if hardware.Disks[i].Target.Dev == device {
+			return &hardware.Disks[i], nil
+		}
+	}
+	return nil, fmt.Errorf("disk %s not found on vm %s", device, vmName)
+}
+
+// AttachVMDisk attaches a disk to a VM, hotplugging it when the VM is
+// running. The target device name is the first free one on the chosen bus.
+func (s *HostService) AttachVMDisk(hostID, vmName string, req DiskAttachRequest) (*storage.DiskAttachment, error) {
+	if (req.VolumeID == "") == (req.SizeBytes == 0) {
+		return nil, fmt.Errorf("invalid disk: set either volume_id or size_bytes")
+	}
+	if req.Bus == "" {
+		req.Bus = "virtio"
+	}
+	if err := validateDiskCache(req.Cache); err != nil {
+		return nil, err
+	}
+	vm, err := s.findVM(hostID, vmName)
+	if err != nil {
+		return nil, err
+	}
+	if err := s.ensureNotLinkedCloneBase(hostID, vmName, "changed"); err != nil {
+		return nil, err
+	}
+	if !s.connector.IsConnected(hostID) {
+		return nil, fmt.Errorf("host %s is disconnected", hostID)
+	}
+	hardware, err := s.connector.GetDomainHardware(hostID, vmName)
+	if err != nil {
+		return nil, err
+	}
+	used := make([]string, 0, len(hardware.Disks))
+	for _, disk := range hardware.Disks {
+		used = append(used, disk.Target.Dev)
+	}
+	target, err := libvirt.NextDiskTarget(req.Bus, used)
+	if err != nil {
+		return nil, err
+	}
+
+	var vol storage.Volume
+	created := false
+	if req.VolumeID != "" {
+		if err := s.db.Where("id = ?", req.VolumeID).First(&vol).Error; err != nil {
+			return nil, fmt.Errorf("volume %s not found: %w", req.VolumeID, err)
+		}
+		if vol.Path == "" {
+			return nil, fmt.Errorf("invalid disk: volume %s has no path", vol.Name)
+		}
+		var pool storage.StoragePool
+		if vol.StoragePoolID != "" && s.db.Where("id = ?", vol.StoragePoolID).First(&pool).Error == nil && pool.HostID != hostID {
+			return nil, fmt.Errorf("invalid disk: volume %s is on host %s", vol.Name, pool.HostID)
+		}
+		if !req.Shareable && !req.ReadOnly {
+			if owner, err := s.diskOwner(vol.Path); err != nil {
+				return nil, err
+			} else if owner != "" {
+				return nil, fmt.Errorf("volume %s is already in use by vm %s", vol.Name, owner)
+			}
+		}
+	} else {
+		poolName := req.Pool
+		if poolName == "" {
+			poolName = "default"
+		}
+		name := req.Name
+		if name == "" {
+			name = fmt.Sprintf("%s-%s.qcow2", vmName, target)
+		}
+		path, err := s.connector.CreateStorageVolume(hostID, poolName, name, req.SizeBytes)
+		if err != nil {
+			return nil, err
+		}
+		vol = storage.Volume{
+			Name:          name,
+			Path:          path,
+			Type:          "DISK",
+			Format:        "qcow2",
+			CapacityBytes: req.SizeBytes,
+			State:         string(storage.StorageStateAvailable),
+		}
+		var pool storage.StoragePool
+		if err := s.db.Where("host_id = ? AND name = ?", hostID, poolName).First(&pool).Error; err == nil {
+			vol.StoragePoolID = pool.ID
+		}
+		if err := s.db.Create(&vol).Error; err != nil {
+			s.removeNewVolume(hostID, poolName, name)
+			return nil, fmt.Errorf("failed to save volume %s: %w", name, err)
+		}
+		created = true
+	}
+	format := vol.Format
+	if format == "" {
+		format = "raw"
+	}
+
+	device := libvirt.DiskDevice{
+		Path:      vol.Path,
+		Format:    format,
+		Bus:       req.Bus,
+		Target:    target,
+		Cache:     req.Cache,
+		ReadOnly:  req.ReadOnly,
+		Shareable: req.Shareable,
+	}
+	deviceXML, err := device.XML()
+	if err == nil {
+		err = s.connector.AttachDevice(hostID, vmName, deviceXML)
+	}
+	if err != nil {
+		if created {
+			s.db.Unscoped().Delete(&vol)
+			s.removeNewVolume(hostID, req.Pool, vol.Name)
+		}
+		return nil, err
+	}
+
+	att, err := s.recordDiskAttachment(vm.ID, vol, device)
+	if err != nil {
+		if detachErr := s.connector.DetachDevice(hostID, vmName, deviceXML); detachErr != nil {
+			log.Warnf("Failed to detach disk %s from %s after a failed attach: %v", target, vmName, detachErr)
+		}
+		return nil, err
+	}
+	log.Infof("Attached %s to VM %s on host %s as %s", vol.Path, vmName, hostID, target)
+	s.broadcastVMsChanged(hostID)
+	return att, nil
+}
+
+// removeNewVolume deletes a volume AttachVMDisk created for an attach that
+// did not go through.
+func (s *HostService) removeNewVolume(hostID, poolName, name string) {
+	if poolName == "" {
+		poolName = "default"
+	}
+	if err := s.connector.DeleteStorageVolume(hostID, poolName, name); err != nil {
+		log.Warnf("Failed to remove volume %s after a failed attach: %v", name, err)
+	}
+}
+
+// diskOwner returns the name of the VM an exclusive disk at path is
+// attached to, if any.
+func (s *HostService) diskOwner(path string) (string, error) {
+	var disks []storage.Disk
+	if err := s.db.Where("path = ?", path).Find(&disks).Error; err != nil {
+		return "", fmt.Errorf("failed to load disk %s: %w", path, err)
+	}
+	for _, disk := range disks {
+		var allocs []storage.AttachmentIndex
+		s.db.Where("device_type = ? AND device_id = ?", "disk", disk.ID).Limit(1).Find(&allocs)
+		if len(allocs) == 0 {
+			continue
+		}
+		var owner storage.VirtualMachine
+		if err := s.db.Where("id = ?", allocs[0].VMUUID).First(&owner).Error; err != nil {
+			return allocs[0].VMUUID, nil
+		}
+		return owner.Name, nil
+	}
+	return "", nil
+}
+
+// recordDiskAttachment stores a hotplugged disk and indexes the attachment.
+// Exclusive disks are indexed by disk so a second VM cannot claim them.
+func (s *HostService) recordDiskAttachment(vmUUID string, vol storage.Volume, device libvirt.DiskDevice) (*storage.DiskAttachment, error) {
+	tx := s.db.Begin()
+	var disk storage.Disk
+	err := tx.Where("path = ?", device.Path).First(&disk).Error
+	switch {
+	case err == gorm.ErrRecordNotFound:
+		disk = storage.Disk{
+			Name:          normalizeStorageName(device.Path),
+			VolumeID:      &vol.ID,
+			Path:          device.Path,
+			Format:        device.Format,
+			CapacityBytes: vol.CapacityBytes,
+			DriverJSON:    diskDriverJSON(device.Format, device.Cache),
+			State:         string(storage.StorageStateAvailable),
+		}
+		if err := tx.Create(&disk).Error; err != nil {
+			tx.Rollback()
+			return nil, fmt.Errorf("failed to save disk %s: %w", device.Path, err)
+		}
+	case err != nil:
+		tx.Rollback()
+		return nil, fmt.Errorf("failed to load disk %s: %w", device.Path, err)
+	default:
+		if err := tx.Model(&disk).Update("driver_json", diskDriverJSON(device.Format, device.Cache)).Error; err != nil {
+			tx.Rollback()
+			return nil, fmt.Errorf("failed to update disk %s: %w", device.Path, err)
+		}
+	}
+
+	att := storage.DiskAttachment{
+		VMUUID:     vmUUID,
+		DiskID:     disk.ID,
+		DeviceName: device.Target,
+		BusType:    device.Bus,
+		ReadOnly:   device.ReadOnly,
+		Shareable:  device.Shareable,
+	}
+	if err := tx.Create(&att).Error; err != nil {
+		tx.Rollback()
+		return nil, fmt.Errorf("failed to attach disk %s: %w", device.Path, err)
+	}
+	alloc := storage.AttachmentIndex{VMUUID: vmUUID, DeviceType: "disk", AttachmentID: att.ID}
+	if !device.Shareable && !device.ReadOnly {
+		alloc.DeviceID = &disk.ID
+	}
+	if err := s.ensureAttachmentIndex(tx, alloc); err != nil {
+		tx.Rollback()
+		return nil, err
+	}
+	if err := tx.Commit().Error; err != nil {
+		return nil, fmt.Errorf("failed to attach disk %s: %w", device.Path, err)
+	}
+	att.Disk = disk
+	return &att, nil
+}
+
+// UpdateVMDisk changes the cache mode or sharing flags of an attached disk.
+// Libvirt refuses changes a running guest cannot take; those need the VM
+// shut off.
+func (s *HostService) UpdateVMDisk(hostID, vmName, device string, req DiskUpdateRequest) (*storage.DiskAttachment, error) {
+	if req.Cache != nil {
+		if err := validateDiskCache(*req.Cache); err != nil {
+			return nil, err
+		}
+	}
+	vm, err := s.findVM(hostID, vmName)
+	if err != nil {
+		return nil, err
+	}
+	if err := s.ensureNotLinkedCloneBase(hostID, vmName, "changed"); err != nil {
+		return nil, err
+	}
+	if !s.connector.IsConnected(hostID) {
+		return nil, fmt.Errorf("host %s is disconnected", hostID)
+	}
+	current, err := s.findVMDisk(hostID, vmName, device)
+	if err != nil {
+		return nil, err
+	}
+	disk := libvirt.DiskDeviceFromInfo(*current)
+	if req.Cache != nil {
+		disk.Cache = *req.Cache
+	}
+	if req.ReadOnly != nil {
+		disk.ReadOnly = *req.ReadOnly
+	}
+	if req.Shareable != nil {
+		disk.Shareable = *req.Shareable
+	}
+	var att storage.DiskAttachment
+	if err := s.db.Where("vm_uuid = ? AND device_name = ?", vm.ID, device).First(&att).Error; err != nil {
+		return nil, fmt.Errorf("disk attachment %s not found on vm %s: %w", device, vmName, err)
+	}
+	deviceXML, err := disk.XML()
+	if err != nil {
+		return nil, err
+	}
+	if err := s.connector.UpdateDevice(hostID, vmName, deviceXML); err != nil {
+		return nil, err
+	}
+
+	tx := s.db.Begin()
+	if err := tx.Model(&att).Updates(map[string]interface{}{"read_only": disk.ReadOnly, "shareable": disk.Shareable}).Error; err != nil {
+		tx.Rollback()
+		return nil, fmt.Errorf("failed to update disk attachment %s: %w", device, err)
+	}
+	if err := tx.Model(&storage.Disk{}).Where("id = ?", att.DiskID).Update("driver_json", diskDriverJSON(disk.Format, disk.Cache)).Error; err != nil {
+		tx.Rollback()
+		return nil, fmt.Errorf("failed to update disk %s: %w", device, err)
+	}
+	var deviceID *string
+	if !disk.Shareable && !disk.ReadOnly {
+		deviceID = &att.DiskID
+	}
+	if err := tx.Model(&storage.AttachmentIndex{}).Where("device_type = ? AND attachment_id = ?", "disk", att.ID).Update("device_id", deviceID).Error; err != nil {
+		tx.Rollback()
+		return nil, fmt.Errorf("failed to update attachment index of disk %s: %w", device, err)
+	}
+	if err := tx.Commit().Error; err != nil {
+		return nil, fmt.Errorf("failed to update disk %s: %w", device, err)
+	}
+	s.broadcastVMsChanged(hostID)
+	if err := s.db.Preload("Disk").First(&att, "id = ?", att.ID).Error; err != nil {
+		return nil, fmt.Errorf("failed to reload disk attachment %s: %w", device, err)
+	}
+	return &att, nil
+}
+
+// DetachVMDisk removes a disk from a VM. The volume itself is kept.
+func (s *HostService) DetachVMDisk(hostID, vmName, device string) error {
+	vm, err := s.findVM(hostID, vmName)
+	if err != nil {
+		return err
+	}
+	if err := s.ensureNotLinkedCloneBase(hostID, vmName, "changed"); err != nil {
+		return err
+	}
+	if !s.connector.IsConnected(hostID) {
+		return fmt.Errorf("host %s is disconnected", hostID)
+	}
+	current, err := s.findVMDisk(hostID, vmName, device)
+	if err != nil {
+		return err
+	}
+	deviceXML, err := libvirt.DiskDeviceFromInfo(*current).XML()
+	if err != nil {
+		return err
+	}
+	if err := s.connector.DetachDevice(hostID, vmName, deviceXML); err != nil {
+		return err
+	}
+
+	tx := s.db.Begin()
+	var atts []storage.DiskAttachment
+	if err := tx.Where("vm_uuid = ? AND device_name = ?", vm.ID, device).Find(&atts).Error; err != nil {
+		tx.Rollback()
+		return fmt.Errorf("failed to load disk attachment %s: %w", device, err)
+	}
+	for _, att := range atts {
+		if err := tx.Unscoped().Where("device_type = ? AND attachment_id = ?", "disk", att.ID).Delete(&storage.AttachmentIndex{}).Error; err != nil {
+			tx.Rollback()
+			return fmt.Errorf("failed to remove attachment index of disk %s: %w", device, err)
+		}
+		if err := tx.Unscoped().Delete(&att).Error; err != nil {
+			tx.Rollback()
+			return fmt.Errorf("failed to remove disk attachment %s: %w", device, err)
+		}
+	}
+	if err := tx.Commit().Error; err != nil {
+		return fmt.Errorf("failed to remove disk attachment %s: %w", device, err)
+	}
+	log.Infof("Detached disk %s from VM %s on host %s", device, vmName, hostID)
+	s.broadcastVMsChanged(hostID)
+	return nil
+}
@@ -0,0 +1,389 @@
+package services
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/capsali/virtumancer/internal/libvirt"
+	log "github.com/capsali/virtumancer/internal/logging"
+	"github.com/capsali/virtumancer/internal/storage"
+	golibvirt "github.com/digitalocean/go-libvirt"
+)
+
+// FlavorExtraSpecs are the settings of a flavor beyond its sizes, stored
+// as the ConfigJSON of its ResourceClass.
+type FlavorExtraSpecs struct {
+	// CPUModel is a libvirt CPU mode such as "host-passthrough" or a named
+	// CPU model.
+	CPUModel string `json:"cpu_model,omitempty"`
+	// HugepageSizeKB backs guest memory with huge pages of this size, such
+	// as 2048 or 1048576.
+	HugepageSizeKB uint64 `json:"hugepage_size_kb,omitempty"`
+	// DiskIOTune throttles every writable disk of the VM.
+	DiskIOTune *libvirt.DiskIOTune `json:"disk_iotune,omitempty"`
+}
+
+// FlavorRequest creates a flavor or replaces its settings.
+type FlavorRequest struct {
+	Name        string            `json:"name"`
+	Description string            `json:"description,omitempty"`
+	CPUCores    int               `json:"cpu_cores"`
+	MemoryMB    int               `json:"memory_mb"`
+	StorageGB   int               `json:"storage_gb,omitempty"`
+	ExtraSpecs  *FlavorExtraSpecs `json:"extra_specs,omitempty"`
+}
+
+// VMFlavorResizeRequest resizes a VM to a flavor.
+type VMFlavorResizeRequest struct {
+	ResourceClass string `json:"resource_class"`
+}
+
+// flavorExtraSpecs reads the extra specs of a flavor.
+func flavorExtraSpecs(rc storage.ResourceClass) (FlavorExtraSpecs, error) {
+	var specs FlavorExtraSpecs
+	if rc.ConfigJSON == "" {
+		return specs, nil
+	}
+	if err := json.Unmarshal([]byte(rc.ConfigJSON), &specs); err != nil {
+		return specs, fmt.Errorf("invalid flavor %s: bad extra specs: %w", rc.Name, err)
+	}
+	return specs, nil
+}
+
+// hugePages is the memory backing the extra specs ask for, as MemoryConfig
+// records it, or "" for normal pages.
+func (specs FlavorExtraSpecs) hugePages() string {
+	if specs.HugepageSizeKB == 0 {
+		return ""
+	}
+	pages, _ := json.Marshal([]libvirt.HugePageInfo{{Size: strconv.FormatUint(specs.HugepageSizeKB, 10), Unit: "KiB"}})
+	return string(pages)
+}
+
+// resourceClassFromRequest validates a flavor request and returns its row.
+func resourceClassFromRequest(req FlavorRequest) (storage.ResourceClass, error) {
+	rc := storage.ResourceClass{
+		Name:        strings.TrimSpace(req.Name),
+		Description: req.Description,
+		CPUCores:    req.CPUCores,
+		MemoryMB:    req.MemoryMB,
+		StorageGB:   req.StorageGB,
+	}
+	switch {
+	case rc.Name == "":
+		return rc, fmt.Errorf("invalid flavor: name is required")
+	case rc.CPUCores < 1:
+		return rc, fmt.Errorf("invalid flavor: cpu_cores must be at least 1")
+	case rc.MemoryMB < 1:
+		return rc, fmt.Errorf("invalid flavor: memory_mb must be at least 1")
+	case rc.StorageGB < 0:
+		return rc, fmt.Errorf("invalid flavor: storage_gb cannot be negative")
+	}
+	if req.ExtraSpecs != nil {
+		specs := *req.ExtraSpecs
+		if specs.HugepageSizeKB != 0 && (specs.HugepageSizeKB&(specs.HugepageSizeKB-1) != 0 || specs.HugepageSizeKB < 4) {
+			return rc, fmt.Errorf("invalid flavor: hugepage_size_kb must be a power of two")
+		}
+		if specs.HugepageSizeKB != 0 && uint64(rc.MemoryMB)*1024%specs.HugepageSizeKB != 0 {
+			return rc, fmt.Errorf("invalid flavor: memory_mb must be a multiple of the huge page size")
+		}
+		if specs.DiskIOTune != nil {
+			if err := specs.DiskIOTune.Validate(); err != nil {
+				return rc, fmt.Errorf("invalid flavor: %w", err)
+			}
+			if *specs.DiskIOTune == (libvirt.DiskIOTune{}) {
+				specs.DiskIOTune = nil
+			}
+		}
+		if specs != (FlavorExtraSpecs{}) {
+			config, _ := json.Marshal(specs)
+			rc.ConfigJSON = string(config)
+		}
+	}
+	return rc, nil
+}
+
+// ListFlavors returns every flavor by name.
+func (s *HostService) ListFlavors() ([]storage.ResourceClass, error) {
+	var flavors []storage.ResourceClass
+	if err := s.db.Order("name").Find(&flavors).Error; err != nil {
+		return nil, fmt.Errorf("failed to list flavors: %w", err)
+	}
+	return flavors, nil
+}
+
+// GetFlavor returns a flavor by ID.
+func (s *HostService) GetFlavor(id string) (*storage.ResourceClass, error) {
+	var rc storage.ResourceClass
+	if err := s.db.Where("id = ?", id).First(&rc).Error; err != nil {
+		return nil, fmt.Errorf("flavor %s not found: %w", id, err)
+	}
+	return &rc, nil
+}
+
+// findFlavor looks a flavor up by name.
+func (s *HostService) findFlavor(name string) (*storage.ResourceClass, error) {
+	var rc storage.ResourceClass
+	if err := s.db.Where("name = ?", name).First(&rc).Error; err != nil {
+		return nil, fmt.Errorf("flavor %s not found: %w", name, err)
+	}
+	return &rc, nil
+}
+
+// ensureFlavorNameFree refuses a name another flavor already has.
+func (s *HostService) ensureFlavorNameFree(name, id string) error {
+	var count int64
+	if err := s.db.Model(&storage.ResourceClass{}).Where("name = ? AND id <> ?", name, id).Count(&count).Error; err != nil {
+		return fmt.Errorf("failed to check flavor name %s: %w", name, err)
+	}
+	if count > 0 {
+		return fmt.Errorf("flavor name %s is already in use", name)
+	}
+	return nil
+}
+
+// CreateFlavor saves a new flavor; its extra specs become its ConfigJSON.
+func (s *HostService) CreateFlavor(req FlavorRequest) (*storage.ResourceClass, error) {
+	rc, err := resourceClassFromRequest(req)
+	if err != nil {
+		return nil, err
+	}
+	if err := s.ensureFlavorNameFree(rc.Name, ""); err != nil {
+		return nil, err
+	}
+	if err := s.db.Create(&rc).Error; err != nil {
+		return nil, fmt.Errorf("failed to save flavor %s: %w", rc.Name, err)
+	}
+	log.Infof("Created flavor %s", rc.Name)
+	return &rc, nil
+}
+
+// UpdateFlavor replaces a flavor's settings. VMs built from it keep their
+// sizes until they are resized to it again.
+func (s *HostService) UpdateFlavor(id string, req FlavorRequest) (*storage.ResourceClass, error) {
+	existing, err := s.GetFlavor(id)
+	if err != nil {
+		return nil, err
+	}
+	rc, err := resourceClassFromRequest(req)
+	if err != nil {
+		return nil, err
+	}
+	if err := s.ensureFlavorNameFree(rc.Name, id); err != nil {
+		return nil, err
+	}
+	err = s.db.Model(existing).Updates(map[string]interface{}{
+		"name":        rc.Name,
+		"description": rc.Description,
+		"cpu_cores":   rc.CPUCores,
+		"memory_mb":   rc.MemoryMB,
+		"storage_gb":  rc.StorageGB,
+		"config_json": rc.ConfigJSON,
+	}).Error
+	if err != nil {
+		return nil, fmt.Errorf("failed to update flavor %s: %w", existing.Name, err)
+	}
+	return s.GetFlavor(id)
+}
+
+// DeleteFlavor removes a flavor no VM records as its own.
+func (s *HostService) DeleteFlavor(id string) error {
+	rc, err := s.GetFlavor(id)
+	if err != nil {
+		return err
+	}
+	var vms []storage.VirtualMachine
+	if err := s.db.Where("resource_class_id = ?", id).Order("name").Limit(1).Find(&vms).Error; err != nil {
+		return fmt.Errorf("failed to look up vms of flavor %s: %w", rc.Name, err)
+	}
+	if len(vms) > 0 {
+		return fmt.Errorf("flavor %s is in use by vm %s", rc.Name, vms[0].Name)
+	}
+	// Hard delete, so the name can be reused.
+	if err := s.db.Unscoped().Delete(rc).Error; err != nil {
+		return fmt.Errorf("failed to delete flavor %s: %w", rc.Name, err)
+	}
+	log.Infof("Deleted flavor %s", rc.Name)
+	return nil
+}
+
+// applyFlavor fills the sizes and CPU model a VM request leaves out from
+// the flavor it names, and returns the flavor and its extra specs.
+func (s *HostService) applyFlavor(req *storage.CreateVMRequest) (*storage.ResourceClass, FlavorExtraSpecs, error) {
+	if req.ResourceClass == "" {
+		return nil, FlavorExtraSpecs{}, nil
+	}
+	rc, err := s.findFlavor(req.ResourceClass)
+	if err != nil {
+		return nil, FlavorExtraSpecs{}, err
+	}
+	specs, err := flavorExtraSpecs(*rc)
+	if err != nil {
+		return nil, FlavorExtraSpecs{}, err
+	}
+	if req.VCPUCount == 0 {
+		req.VCPUCount = uint(rc.CPUCores)
+	}
+	if req.MemoryBytes == 0 {
+		req.MemoryBytes = uint64(rc.MemoryMB) << 20
+	}
+	if req.DiskSizeGB == 0 {
+		req.DiskSizeGB = uint(rc.StorageGB)
+	}
+	if req.CPUModel == "" {
+		req.CPUModel = specs.CPUModel
+	}
+	return rc, specs, nil
+}
+
+// recordFlavorMemory records or clears the huge page backing of a VM and
+// reports whether it changed.
+func (s *HostService) recordFlavorMemory(vmUUID string, specs FlavorExtraSpecs) (bool, error) {
+	pages := specs.hugePages()
+	var backings []storage.MemoryConfig
+	if err := s.db.Where("vm_uuid = ? AND config_type = ?", vmUUID, "backing").Limit(1).Find(&backings).Error; err != nil {
+		return false, fmt.Errorf("failed to load memory backing of vm %s: %w", vmUUID, err)
+	}
+	var err error
+	switch {
+	case len(backings) == 0 && pages == "", len(backings) > 0 && backings[0].ConfigJSON == pages:
+		return false, nil
+	case len(backings) == 0:
+		err = s.db.Create(&storage.MemoryConfig{VMUUID: vmUUID, ConfigType: "backing", ConfigJSON: pages}).Error
+	case pages == "" && backings[0].SourceType == "" && backings[0].Mode == "" && !backings[0].Nosharepages && !backings[0].Locked:
+		// Nothing else is left in the backing, and sync never removes it.
+		err = s.db.Unscoped().Delete(&backings[0]).Error
+	default:
+		err = s.db.Model(&backings[0]).Update("config_json", pages).Error
+	}
+	if err != nil {
+		return false, fmt.Errorf("failed to record memory backing of vm %s: %w", vmUUID, err)
+	}
+	return true, nil
+}
+
+// ResizeVMToFlavor brings a VM to the sizes and extra specs of a flavor.
+// vCPUs and memory change like ResizeVM changes them. The first writable
+// disk grows to the flavor's disk size but never shrinks. The CPU model,
+// huge pages and disk I/O limits go into the persistent definition and
+// apply at the next boot of a running VM.
+func (s *HostService) ResizeVMToFlavor(hostID, vmName string, req VMFlavorResizeRequest) (*storage.VirtualMachine, error) {
+	if req.ResourceClass == "" {
+		return nil, fmt.Errorf("invalid resize request: resource_class is required")
+	}
+	vm, err := s.findVM(hostID, vmName)
+	if err != nil {
+		return nil, err
+	}
+	rc, err := s.findFlavor(req.ResourceClass)
+	if err != nil {
+		return nil, err
+	}
+	specs, err := flavorExtraSpecs(*rc)
+	if err != nil {
+		return nil, err
+	}
+	if !s.connector.IsConnected(hostID) {
+		return nil, fmt.Errorf("host %s is disconnected", hostID)
+	}
+
+	info, err := s.connector.GetDomainInfo(hostID, vmName)
+	if err != nil {
+		return nil, err
+	}
+	cpu, err := s.connector.GetDomainCPUDetails(hostID, vmName)
+	if err != nil {
+		return nil, err
+	}
+	vcpus, memory := uint(rc.CPUCores), uint64(rc.MemoryMB)<<20
+	var resize VMResizeRequest
+	if vcpus != info.Vcpu {
+		resize.VCPUCount = &vcpus
+		if vcpus > uint(cpu.MaxVcpus) {
+			resize.MaxVCPUCount = &vcpus
+		}
+	}
+	if memory != info.MaxMem*1024 || memory != info.Memory*1024 {
+		resize.MemoryBytes, resize.CurrentMemoryBytes = &memory, &memory
+	}
+	if resize.VCPUCount != nil || resize.MemoryBytes != nil {
+		if _, err := s.ResizeVM(hostID, vmName, resize); err != nil {
+			return nil, err
+		}
+	}
+
+	var atts []storage.DiskAttachment
+	if err := s.db.Preload("Disk").Where("vm_uuid = ?", vm.ID).Order("device_name").Find(&atts).Error; err != nil {
+		return nil, fmt.Errorf("failed to load disks of vm %s: %w", vmName, err)
+	}
+	var writable []storage.DiskAttachment
+	for _, att := range atts {
+		if !att.ReadOnly && att.Metadata != cdromMetadata {
+			writable = append(writable, att)
+		}
+	}
+	if size := uint64(rc.StorageGB) << 30; size > 0 && len(writable) > 0 && writable[0].Disk.VolumeID != nil {
+		var vol storage.Volume
+		if err := s.db.Where("id = ?", *writable[0].Disk.VolumeID).First(&vol).Error; err != nil {
+			return nil, fmt.Errorf("volume of disk %s of vm %s not found: %w", writable[0].DeviceName, vmName, err)
+		}
+		if vol.CapacityBytes < size {
+			if _, err := s.ResizeVolume(vol.ID, VolumeResizeRequest{SizeBytes: size}); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	// The extra specs only change the persistent definition, which is
+	// rendered again when any of them differs.
+	redefine := false
+	if specs.CPUModel != "" && specs.CPUModel != vm.CPUModel {
+		if err := s.db.Model(&storage.VirtualMachine{}).Where("id = ?", vm.ID).Update("cpu_model", specs.CPUModel).Error; err != nil {
+			return nil, fmt.Errorf("failed to update vm %s: %w", vmName, err)
+		}
+		redefine = true
+	}
+	changed, err := s.recordFlavorMemory(vm.ID, specs)
+	if err != nil {
+		return nil, err
+	}
+	redefine = redefine || changed
+	iotune := diskIOTuneJSON(specs.DiskIOTune)
+	for _, att := range writable {
+		if att.Disk.IOTune == iotune {
+			continue
+		}
+		if err := s.db.Model(&storage.Disk{}).Where("id = ?", att.DiskID).Update("io_tune", iotune).Error; err != nil {
+			return nil, fmt.Errorf("failed to update disk %s of vm %s: %w", att.DeviceName, vmName, err)
+		}
+		redefine = true
+	}
+	if redefine {
+		if vm, err = s.findVM(hostID, vmName); err != nil {
+			return nil, err
+		}
+		spec, err := s.definedDomainSpec(*vm)
+		if err != nil {
+			return nil, err
+		}
+		domainXML, err := spec.XML()
+		if err != nil {
+			return nil, err
+		}
+		if _, err := s.connector.DefineAndCreateDomain(hostID, domainXML); err != nil {
+			return nil, err
+		}
+		if info, err := s.connector.GetDomainInfo(hostID, vmName); err == nil && info.State != golibvirt.DomainShutoff {
+			s.db.Model(&storage.VirtualMachine{}).Where("id = ?", vm.ID).Update("needs_rebuild", true)
+		}
+	}
+
+	if err := s.db.Model(&storage.VirtualMachine{}).Where("id = ?", vm.ID).Update("resource_class_id", rc.ID).Error; err != nil {
+		return nil, fmt.Errorf("failed to record flavor of vm %s: %w", vmName, err)
+	}
+	log.Infof("Resized VM %s on host %s to flavor %s", vmName, hostID, rc.Name)
+	s.broadcastVMsChanged(hostID)
+	return s.findVM(hostID, vmName)
+}
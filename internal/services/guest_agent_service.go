@@ -0,0 +1,176 @@
+package services
+
+import (
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/capsali/virtumancer/internal/libvirt"
+	log "github.com/capsali/virtumancer/internal/logging"
+	"github.com/capsali/virtumancer/internal/storage"
+)
+
+const (
+	defaultGuestExecTimeout = 30 * time.Second
+	maxGuestExecTimeout     = 5 * time.Minute
+)
+
+// GuestExecRequest is a command to run in a guest. TimeoutSeconds bounds
+// the wait for it to exit and defaults to 30.
+type GuestExecRequest struct {
+	libvirt.GuestCommand
+	TimeoutSeconds int `json:"timeout_seconds,omitempty"`
+}
+
+// GuestPasswordRequest sets the password of a guest account. With
+// Encrypted, Password is a crypt(3) hash rather than plain text.
+type GuestPasswordRequest struct {
+	User      string `json:"user"`
+	Password  string `json:"password"`
+	Encrypted bool   `json:"encrypted"`
+}
+
+// GuestFilesystemsRequest limits a freeze or thaw to some mountpoints; an
+// empty list means all of the guest's filesystems.
+type GuestFilesystemsRequest struct {
+	Mountpoints []string `json:"mountpoints,omitempty"`
+}
+
+// auditGuestAgent records a guest agent operation in the audit log. details
+// must never carry passwords or command input.
+func (s *HostService) auditGuestAgent(vm *storage.VirtualMachine, op string, details map[string]interface{}, opErr error) {
+	if details == nil {
+		details = map[string]interface{}{}
+	}
+	details["host_id"] = vm.HostID
+	details["vm_name"] = vm.Name
+	if opErr != nil {
+		details["result"] = "failed"
+		details["error"] = opErr.Error()
+	} else {
+		details["result"] = "succeeded"
+	}
+	encoded, err := json.Marshal(details)
+	if err != nil {
+		log.Warnf("Failed to encode audit details for guest agent %s on %s: %v", op, vm.Name, err)
+		return
+	}
+	entry := storage.AuditLog{
+		Action:     "guest_agent." + op,
+		TargetType: "vm",
+		TargetID:   vm.ID,
+		Details:    string(encoded),
+	}
+	if err := s.db.Create(&entry).Error; err != nil {
+		log.Warnf("Failed to write audit log for guest agent %s on %s: %v", op, vm.Name, err)
+	}
+}
+
+// ExecInGuest runs a command in a VM through its guest agent and returns
+// the command's exit code and output.
+func (s *HostService) ExecInGuest(hostID, vmName string, req GuestExecRequest) (*libvirt.GuestExecResult, error) {
+	if req.Path == "" {
+		return nil, fmt.Errorf("invalid guest command: path is required")
+	}
+	timeout := defaultGuestExecTimeout
+	if req.TimeoutSeconds < 0 {
+		return nil, fmt.Errorf("invalid guest command: timeout must not be negative")
+	}
+	if req.TimeoutSeconds > 0 {
+		timeout = time.Duration(req.TimeoutSeconds) * time.Second
+	}
+	if timeout > maxGuestExecTimeout {
+		return nil, fmt.Errorf("invalid guest command: timeout exceeds %s", maxGuestExecTimeout)
+	}
+	vm, err := s.findVM(hostID, vmName)
+	if err != nil {
+		return nil, err
+	}
+	result, err := s.connector.GuestExec(hostID, vmName, req.GuestCommand, timeout)
+	details := map[string]interface{}{"path": req.Path, "args": len(req.Args)}
+	if result != nil {
+		details["exit_code"] = result.ExitCode
+	}
+	s.auditGuestAgent(vm, "exec", details, err)
+	if err != nil {
+		return nil, err
+	}
+	return result, nil
+}
+
+// SetGuestPassword sets the password of an account inside a VM.
+func (s *HostService) SetGuestPassword(hostID, vmName string, req GuestPasswordRequest) error {
+	if req.User == "" || req.Password == "" {
+		return fmt.Errorf("invalid password request: user and password are required")
+	}
+	vm, err := s.findVM(hostID, vmName)
+	if err != nil {
+		return err
+	}
+	err = s.connector.SetGuestUserPassword(hostID, vmName, req.User, req.Password, req.Encrypted)
+	s.auditGuestAgent(vm, "set_password", map[string]interface{}{"user": req.User, "encrypted": req.Encrypted}, err)
+	return err
+}
+
+// FreezeGuestFilesystems freezes a VM's filesystems so its disks can be
+// copied consistently. They stay frozen until ThawGuestFilesystems.
+func (s *HostService) FreezeGuestFilesystems(hostID, vmName string, req GuestFilesystemsRequest) (int, error) {
+	vm, err := s.findVM(hostID, vmName)
+	if err != nil {
+		return 0, err
+	}
+	n, err := s.connector.FreezeGuestFilesystems(hostID, vmName, req.Mountpoints)
+	s.auditGuestAgent(vm, "fsfreeze", map[string]interface{}{"mountpoints": req.Mountpoints, "count": n}, err)
+	return n, err
+}
+
+// ThawGuestFilesystems thaws filesystems frozen by FreezeGuestFilesystems.
+func (s *HostService) ThawGuestFilesystems(hostID, vmName string, req GuestFilesystemsRequest) (int, error) {
+	vm, err := s.findVM(hostID, vmName)
+	if err != nil {
+		return 0, err
+	}
+	n, err := s.connector.ThawGuestFilesystems(hostID, vmName, req.Mountpoints)
+	s.auditGuestAgent(vm, "fsthaw", map[string]interface{}{"mountpoints": req.Mountpoints, "count": n}, err)
+	return n, err
+}
+
+// ShutdownVMViaAgent shuts a VM down through its guest agent, for guests
+// that ignore ACPI power button events.
+func (s *HostService) ShutdownVMViaAgent(hostID, vmName string) error {
+	vm, err := s.findVM(hostID, vmName)
+	if err != nil {
+		return err
+	}
+	err = s.performVMAction(hostID, vmName, storage.TaskStateStopping, func() error {
+		return s.connector.ShutdownDomainViaAgent(hostID, vmName)
+	})
+	s.auditGuestAgent(vm, "shutdown", nil, err)
+	return err
+}
+
+// RebootVMViaAgent reboots a VM through its guest agent.
+func (s *HostService) RebootVMViaAgent(hostID, vmName string) error {
+	vm, err := s.findVM(hostID, vmName)
+	if err != nil {
+		return err
+	}
+	err = s.performVMAction(hostID, vmName, storage.TaskStateRebooting, func() error {
+		s.db.Model(&storage.VirtualMachine{}).Where("host_id = ? AND name = ?", hostID, vmName).Update("needs_rebuild", false)
+		return s.connector.RebootDomainViaAgent(hostID, vmName)
+	})
+	s.auditGuestAgent(vm, "reboot", nil, err)
+	return err
+}
+
+// SyncGuestTime resets a VM's clock to the host's time, as needed after the
+// VM was paused or restored.
+func (s *HostService) SyncGuestTime(hostID, vmName string) error {
+	vm, err := s.findVM(hostID, vmName)
+	if err != nil {
+		return err
+	}
+	err = s.connector.SyncGuestTime(hostID, vmName)
+	s.auditGuestAgent(vm, "time_sync", nil, err)
+	return err
+}
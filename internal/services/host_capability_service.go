@@ -16,11 +16,11 @@ import (
 // HostCapabilityService handles discovery and management of host capabilities
 type HostCapabilityService struct {
 	db        *gorm.DB
-	connector *libvirt.Connector
+	connector libvirt.Hypervisor
 }
 
 // NewHostCapabilityService creates a new host capability service
-func NewHostCapabilityService(db *gorm.DB, connector *libvirt.Connector) *HostCapabilityService {
+func NewHostCapabilityService(db *gorm.DB, connector libvirt.Hypervisor) *HostCapabilityService {
 	return &HostCapabilityService{
 		db:        db,
 		connector: connector,
@@ -5,6 +5,7 @@ import (
 	"encoding/json"
 	"errors"
 	"fmt"
+	"io"
 	"path/filepath"
 	"strconv"
 	"strings"
@@ -41,6 +42,10 @@ type VMView struct {
 	DriftDetails string             `json:"drift_details"`
 	NeedsRebuild bool               `json:"needs_rebuild"`
 
+	// HasManagedSave is set while the VM is stopped with a managed save
+	// image that its next start resumes from.
+	HasManagedSave bool `json:"has_managed_save"`
+
 	// Timestamps from gorm.Model
 	CreatedAt time.Time `json:"createdAt"`
 	UpdatedAt time.Time `json:"updatedAt"`
@@ -206,6 +211,7 @@ type HostServiceProvider interface {
 	GetHostStats(hostID string) (*libvirt.HostStats, error)
 	AddHost(host storage.Host) (*storage.Host, error)
 	RemoveHost(hostID string) error
+	RetrustHostKeys(hostID string) (*storage.Host, error)
 	ConnectToAllHosts()
 	GetVMsForHostFromDB(hostID string) ([]VMView, error)
 	GetVMStats(hostID, vmName string) (*ProcessedVMStats, error)
@@ -228,6 +234,50 @@ type HostServiceProvider interface {
 	// libvirt storage volume and delete the DB row. It sets transient task_state
 	// during the operation.
 	DeleteVolume(volumeID string, poolName string) error
+	// Grow a storage volume, through the VM when a running VM uses it.
+	ResizeVolume(volumeID string, req VolumeResizeRequest) (*storage.Volume, error)
+	// Volume uploads and downloads
+	CreateVolumeUpload(hostID string, req VolumeUploadRequest) (*storage.Volume, error)
+	GetVolumeUploadStatus(volumeID string) (*VolumeUploadStatus, error)
+	UploadVolumeData(volumeID string, offset uint64, r io.Reader) (*VolumeUploadStatus, error)
+	StatVolumeDownload(volumeID string) (*VolumeDownload, error)
+	DownloadVolume(dl *VolumeDownload, w io.Writer, offset, length uint64) error
+	// ISO library and CD-ROM media
+	ListISOs(hostID, poolID string) ([]ISOImage, error)
+	InsertVMMedia(hostID, vmName, device string, req CDROMMediaRequest) (*storage.DiskAttachment, error)
+	EjectVMMedia(hostID, vmName, device string) (*storage.DiskAttachment, error)
+	// Storage pool lifecycle
+	CreateStoragePool(hostID string, req StoragePoolCreateRequest) (*storage.StoragePool, error)
+	BuildStoragePool(poolID string) (*storage.StoragePool, error)
+	StartStoragePool(poolID string) (*storage.StoragePool, error)
+	StopStoragePool(poolID string) (*storage.StoragePool, error)
+	RefreshStoragePool(poolID string) (*storage.StoragePool, error)
+	SetStoragePoolAutostart(poolID string, req StoragePoolAutostartRequest) (*storage.StoragePool, error)
+	DeleteStoragePool(poolID string, deleteStorage bool) error
+	// Virtual networks
+	CreateNetwork(hostID string, req NetworkCreateRequest) (*NetworkDetail, error)
+	GetNetwork(networkID string) (*NetworkDetail, error)
+	UpdateNetwork(networkID string, spec libvirt.NetworkSpec) (*NetworkDetail, error)
+	StartNetwork(networkID string) (*NetworkDetail, error)
+	StopNetwork(networkID string) (*NetworkDetail, error)
+	SetNetworkAutostart(networkID string, req NetworkAutostartRequest) (*NetworkDetail, error)
+	DeleteNetwork(networkID string) error
+	// Security groups
+	ListSecurityGroups() ([]storage.SecurityGroup, error)
+	GetSecurityGroup(groupID string) (*storage.SecurityGroup, error)
+	CreateSecurityGroup(req SecurityGroupRequest) (*storage.SecurityGroup, error)
+	UpdateSecurityGroup(groupID string, req SecurityGroupRequest) (*storage.SecurityGroup, error)
+	DeleteSecurityGroup(groupID string) error
+	GetVMNICSecurityGroups(hostID, vmName, mac string) ([]storage.SecurityGroup, error)
+	SetVMNICSecurityGroups(hostID, vmName, mac string, req NICSecurityGroupsRequest) ([]storage.SecurityGroup, error)
+	// Guest agent
+	ExecInGuest(hostID, vmName string, req GuestExecRequest) (*libvirt.GuestExecResult, error)
+	SetGuestPassword(hostID, vmName string, req GuestPasswordRequest) error
+	FreezeGuestFilesystems(hostID, vmName string, req GuestFilesystemsRequest) (int, error)
+	ThawGuestFilesystems(hostID, vmName string, req GuestFilesystemsRequest) (int, error)
+	ShutdownVMViaAgent(hostID, vmName string) error
+	RebootVMViaAgent(hostID, vmName string) error
+	SyncGuestTime(hostID, vmName string) error
 	SyncVMFromLibvirt(hostID, vmName string) error
 	RebuildVMFromDB(hostID, vmName string) error
 	StartVM(hostID, vmName string) error
@@ -235,6 +285,44 @@ type HostServiceProvider interface {
 	RebootVM(hostID, vmName string) error
 	ForceOffVM(hostID, vmName string) error
 	ForceResetVM(hostID, vmName string) error
+	PauseVM(hostID, vmName string) error
+	ResumeVM(hostID, vmName string) error
+	ManagedSaveVM(hostID, vmName string) error
+	RestoreVM(hostID, vmName string) error
+	DeleteVM(hostID, vmName string, req VMDeleteRequest) error
+	ResizeVM(hostID, vmName string, req VMResizeRequest) (*storage.VirtualMachine, error)
+	// Snapshots
+	ListVMSnapshots(hostID, vmName string) ([]SnapshotView, error)
+	CreateVMSnapshot(hostID, vmName string, spec libvirt.SnapshotSpec) (*SnapshotView, error)
+	RevertVMSnapshot(hostID, vmName, snapshotName string) error
+	DeleteVMSnapshot(hostID, vmName, snapshotName string) error
+	// Migration
+	MigrateVM(hostID, vmName string, req MigrationRequest) (*MigrationResult, error)
+	// Cloning
+	CloneVM(hostID, vmName string, req CloneRequest) (*storage.VirtualMachine, error)
+	// Templates
+	ListTemplates() ([]storage.VirtualMachine, error)
+	ConvertVMToTemplate(hostID, vmName string) (*storage.VirtualMachine, error)
+	ConvertTemplateToVM(hostID, vmName string) (*storage.VirtualMachine, error)
+	InstantiateTemplate(hostID, vmName string, req TemplateInstantiateRequest) ([]storage.VirtualMachine, error)
+	CopyTemplate(hostID, vmName string, req TemplateCopyRequest) (*storage.VirtualMachine, error)
+	// Flavors
+	ListFlavors() ([]storage.ResourceClass, error)
+	GetFlavor(id string) (*storage.ResourceClass, error)
+	CreateFlavor(req FlavorRequest) (*storage.ResourceClass, error)
+	UpdateFlavor(id string, req FlavorRequest) (*storage.ResourceClass, error)
+	DeleteFlavor(id string) error
+	ResizeVMToFlavor(hostID, vmName string, req VMFlavorResizeRequest) (*storage.VirtualMachine, error)
+	// Disk hotplug
+	AttachVMDisk(hostID, vmName string, req DiskAttachRequest) (*storage.DiskAttachment, error)
+	UpdateVMDisk(hostID, vmName, device string, req DiskUpdateRequest) (*storage.DiskAttachment, error)
+	DetachVMDisk(hostID, vmName, device string) error
+
+	// NIC hotplug
+	AttachVMNIC(hostID, vmName string, req NICAttachRequest) (*storage.PortAttachment, error)
+	UpdateVMNIC(hostID, vmName, mac string, req NICUpdateRequest) (*storage.PortAttachment, error)
+	DetachVMNIC(hostID, vmName, mac string) error
+
 	// Dashboard methods
 	GetDashboardStats() (*DashboardStats, error)
 	GetDashboardActivity(limit int) ([]ActivityEntry, error)
@@ -245,7 +333,7 @@ type HostServiceProvider interface {
 
 type HostService struct {
 	db                *gorm.DB
-	connector         *libvirt.Connector
+	connector         libvirt.Hypervisor
 	hub               *ws.Hub
 	monitor           *MonitoringManager
 	hostMonitor       *HostMonitoringManager
@@ -253,10 +341,13 @@ type HostService struct {
 	syncMutex         sync.Map // map[string]*sync.Mutex for per-host sync locking
 	lastSync          sync.Map // map[string]time.Time for last sync time
 	vmPollers         sync.Map // map[string]chan struct{} for stopping VM state polling
+	vmEventListeners  sync.Map // map[string]context.CancelFunc for stopping domain event listeners
+	hostWatchers      sync.Map // map[string]context.CancelFunc for connection watchers and reconnect loops
 	prevCpuSamples    sync.Map // key: "hostID:vmName" -> struct{cpuTime uint64; at time.Time}
 	prevDiskSamples   sync.Map // key: "hostID:vmName" -> struct{readBytes int64; writeBytes int64; readReq int64; writeReq int64; at time.Time}
 	prevNetSamples    sync.Map // key: "hostID:vmName" -> struct{rxBytes int64; txBytes int64; at time.Time}
 	hostCores         sync.Map // key: hostID -> uint (number of cores)
+	uploads           sync.Map // key: volume ID -> *volumeUpload for uploads in progress
 	// smoothing state: store last smoothed host-normalized percent per vm
 	cpuSmoothStore sync.Map // key: "hostID:vmName" -> float64
 	// disk smoothing store: key: "hostID:vmName" -> struct{read float64; write float64; readIOPS float64; writeIOPS float64}
@@ -267,9 +358,12 @@ type HostService struct {
 	cpuSmoothAlpha  float64
 	netSmoothAlpha  float64
 	diskSmoothAlpha float64
+	// reconnect backoff bounds for hosts whose connection drops
+	reconnectBaseDelay time.Duration
+	reconnectMaxDelay  time.Duration
 }
 
-func NewHostService(db *gorm.DB, connector *libvirt.Connector, hub *ws.Hub) *HostService {
+func NewHostService(db *gorm.DB, connector libvirt.Hypervisor, hub *ws.Hub) *HostService {
 	s := &HostService{
 		db:        db,
 		connector: connector,
@@ -284,6 +378,9 @@ func NewHostService(db *gorm.DB, connector *libvirt.Connector, hub *ws.Hub) *Hos
 	s.netSmoothAlpha = 0.6
 	// default disk smoothing alpha
 	s.diskSmoothAlpha = 0.3
+	// reconnect after 2s, doubling up to 5 minutes between attempts
+	s.reconnectBaseDelay = 2 * time.Second
+	s.reconnectMaxDelay = 5 * time.Minute
 	return s
 }
 
@@ -370,7 +467,7 @@ func (s *HostService) GetRuntimeSmoothing() (cpu, disk, net float64) {
 // hosts that were manually disconnected by the user.
 func (s *HostService) EnsureHostConnected(hostID string) error {
 	log.Debugf("EnsureHostConnected: checking connection for host %s", hostID)
-	if _, err := s.connector.GetConnection(hostID); err == nil {
+	if s.connector.IsConnected(hostID) {
 		log.Debugf("EnsureHostConnected: host %s already connected", hostID)
 		return nil // already connected
 	}
@@ -396,6 +493,7 @@ func (s *HostService) EnsureHostConnected(hostID string) error {
 		return fmt.Errorf("failed to connect to host %s: %w", hostID, err)
 	}
 	log.Verbosef("EnsureHostConnected: connection established for host %s", hostID)
+	s.persistLearnedHostKeys(hostID)
 	// Clear task state and mark connected
 	s.db.Model(&storage.Host{}).Where("id = ?", hostID).Updates(map[string]interface{}{"task_state": "", "state": storage.HostStateConnected})
 	// Notify clients that the host is now connected
@@ -412,8 +510,14 @@ func (s *HostService) EnsureHostConnected(hostID string) error {
 		}
 	}()
 
-	// Start VM state polling for this host
-	s.startVMPolling(hostID)
+	// Track VM state through libvirt events, with polling as a fallback
+	s.startVMStateTracking(hostID)
+
+	// Reconnect automatically if the connection drops, and restart stats
+	// polling for clients that stayed subscribed through an outage
+	s.watchHostConnection(hostID)
+	s.monitor.ResumeHostMonitoring(hostID)
+	s.hostMonitor.ResumeHostMonitoring(hostID)
 
 	// Sync VMs for the newly connected host
 	go s.SyncVMsForHost(hostID)
@@ -426,7 +530,7 @@ func (s *HostService) EnsureHostConnected(hostID string) error {
 // for manual connect requests from the user.
 func (s *HostService) EnsureHostConnectedForced(hostID string) error {
 	log.Debugf("EnsureHostConnectedForced: forcing connection for host %s", hostID)
-	if _, err := s.connector.GetConnection(hostID); err == nil {
+	if s.connector.IsConnected(hostID) {
 		log.Debugf("EnsureHostConnectedForced: host %s already connected", hostID)
 		return nil // already connected
 	}
@@ -446,6 +550,7 @@ func (s *HostService) EnsureHostConnectedForced(hostID string) error {
 		return fmt.Errorf("failed to connect to host %s: %w", hostID, err)
 	}
 	log.Verbosef("EnsureHostConnectedForced: connection established for host %s", hostID)
+	s.persistLearnedHostKeys(hostID)
 	// Clear task state, mark connected, and enable auto-reconnection
 	s.db.Model(&storage.Host{}).Where("id = ?", hostID).Updates(map[string]interface{}{
 		"task_state":              "",
@@ -456,6 +561,15 @@ func (s *HostService) EnsureHostConnectedForced(hostID string) error {
 	s.broadcastHostConnectionChanged(hostID, true)
 	s.broadcastHostsChanged()
 
+	// Track VM state through libvirt events, with polling as a fallback
+	s.startVMStateTracking(hostID)
+
+	// Reconnect automatically if the connection drops, and restart stats
+	// polling for clients that stayed subscribed through an outage
+	s.watchHostConnection(hostID)
+	s.monitor.ResumeHostMonitoring(hostID)
+	s.hostMonitor.ResumeHostMonitoring(hostID)
+
 	// Sync VMs for the newly connected host
 	go s.SyncVMsForHost(hostID)
 
@@ -468,9 +582,25 @@ func (s *HostService) EnsureHostConnectedForced(hostID string) error {
 // (in which case auto-reconnection will be disabled).
 func (s *HostService) DisconnectHost(hostID string, userInitiated bool) error {
 	log.Debugf("DisconnectHost: disconnecting host %s (userInitiated=%v)", hostID, userInitiated)
+	// Stop watching the connection first so this disconnect is not treated
+	// as a lost connection, and cancel any reconnect already in progress.
+	s.stopHostWatch(hostID)
+
 	// If there's no connection, return nil
-	if _, err := s.connector.GetConnection(hostID); err != nil {
+	if !s.connector.IsConnected(hostID) {
 		log.Debugf("DisconnectHost: no active connection for host %s", hostID)
+		if userInitiated {
+			// The host may be in ERROR with subscribers paused while it was
+			// being reconnected; the user has now given up on it.
+			s.db.Model(&storage.Host{}).Where("id = ?", hostID).Updates(map[string]interface{}{
+				"task_state":              "",
+				"state":                   storage.HostStateDisconnected,
+				"auto_reconnect_disabled": true,
+			})
+			s.monitor.StopHostMonitoring(hostID)
+			s.hostMonitor.StopHostMonitoring(hostID)
+			s.broadcastHostsChanged()
+		}
 		return nil
 	}
 
@@ -498,7 +628,7 @@ func (s *HostService) DisconnectHost(hostID string, userInitiated bool) error {
 	// Stop all monitoring for this host
 	s.monitor.StopHostMonitoring(hostID)
 	s.hostMonitor.StopHostMonitoring(hostID)
-	s.stopVMPolling(hostID)
+	s.stopVMStateTracking(hostID)
 
 	log.Infof("Host %s disconnected successfully (userInitiated=%v)", hostID, userInitiated)
 	s.broadcastHostConnectionChanged(hostID, false)
@@ -506,6 +636,60 @@ func (s *HostService) DisconnectHost(hostID string, userInitiated bool) error {
 	return nil
 }
 
+// persistLearnedHostKeys stores SSH host keys that were trusted on first use
+// during the latest connect, pinning them for future connections.
+func (s *HostService) persistLearnedHostKeys(hostID string) {
+	keys := s.connector.LearnedHostKeys(hostID)
+	if keys == "" {
+		return
+	}
+	if err := s.db.Model(&storage.Host{}).Where("id = ?", hostID).Update("ssh_host_keys", keys).Error; err != nil {
+		log.Errorf("Failed to pin SSH host keys for host %s: %v", hostID, err)
+	}
+}
+
+// RetrustHostKeys forgets the pinned SSH host keys for a host and reconnects,
+// trusting whatever keys are presented now. Use it after a host has been
+// legitimately reinstalled or had its keys rotated.
+func (s *HostService) RetrustHostKeys(hostID string) (*storage.Host, error) {
+	var host storage.Host
+	if err := s.db.Where("id = ?", hostID).First(&host).Error; err != nil {
+		return nil, fmt.Errorf("could not find host %s in database: %w", hostID, err)
+	}
+	if err := s.DisconnectHost(hostID, false); err != nil {
+		return nil, err
+	}
+	if err := s.db.Model(&host).Update("ssh_host_keys", "").Error; err != nil {
+		return nil, fmt.Errorf("failed to clear pinned SSH host keys for host %s: %w", hostID, err)
+	}
+	log.Infof("Cleared pinned SSH host keys for host %s; reconnecting to re-trust", hostID)
+	if err := s.EnsureHostConnectedForced(hostID); err != nil {
+		return nil, err
+	}
+	if err := s.db.Where("id = ?", hostID).First(&host).Error; err != nil {
+		return nil, fmt.Errorf("could not reload host %s: %w", hostID, err)
+	}
+	return &host, nil
+}
+
+// EncryptSSHPrivateKey validates a private key and encrypts it for storage
+// in Host.SSHPrivateKey.
+func EncryptSSHPrivateKey(pemKey string) (string, error) {
+	if _, err := libvirt.ParseSSHPrivateKey(pemKey); err != nil {
+		return "", err
+	}
+	return storage.EncryptSecret(pemKey)
+}
+
+// EncryptTLSClientKey validates a TLS client key and encrypts it for storage
+// in Host.TLSClientKey.
+func EncryptTLSClientKey(pemKey string) (string, error) {
+	if err := libvirt.ParseTLSPrivateKey(pemKey); err != nil {
+		return "", err
+	}
+	return storage.EncryptSecret(pemKey)
+}
+
 // AddHost creates a new Host record and triggers a background connection attempt.
 func (s *HostService) AddHost(host storage.Host) (*storage.Host, error) {
 	if host.ID == "" {
@@ -571,6 +755,15 @@ func mapLibvirtStateToVMState(state golibvirt.DomainState) storage.VMState {
 	}
 }
 
+// observedVMState is the state libvirt reports for a domain, counting a shut
+// off domain with a managed save image as suspended.
+func observedVMState(vmInfo *libvirt.VMInfo) storage.VMState {
+	if vmInfo.HasManagedSave && vmInfo.State == golibvirt.DomainShutoff {
+		return storage.StateSuspended
+	}
+	return mapLibvirtStateToVMState(vmInfo.State)
+}
+
 // ensureAttachmentIndex tries to create an AttachmentIndex. If creation fails
 // due to a UNIQUE constraint (possible because a soft-deleted row exists or
 // a concurrent transaction inserted it), it will attempt to reconcile by
@@ -683,6 +876,8 @@ func (s *HostService) RemoveHost(hostID string) error {
 	// Mark as disconnecting in DB
 	s.db.Model(&storage.Host{}).Where("id = ?", hostID).Updates(map[string]interface{}{"task_state": storage.HostTaskStateDisconnecting})
 
+	s.stopHostWatch(hostID)
+	s.stopVMStateTracking(hostID)
 	if err := s.connector.RemoveHost(hostID); err != nil {
 		log.Verbosef("RemoveHost: failed to disconnect from host %s during removal: %v", hostID, err)
 		s.db.Model(&storage.Host{}).Where("id = ?", hostID).Updates(map[string]interface{}{"task_state": "", "state": storage.HostStateError})
@@ -765,7 +960,8 @@ func (s *HostService) AutoConnectHosts() error {
 		log.Infof("Auto-connecting to previously connected host %s (%s)", host.ID, host.URI)
 		if err := s.EnsureHostConnected(host.ID); err != nil {
 			log.Errorf("Failed to auto-connect to host %s: %v", host.ID, err)
-			// Continue with other hosts even if one fails
+			// Keep retrying in the background and continue with other hosts
+			s.scheduleReconnect(host.ID)
 		}
 	}
 	return nil
@@ -849,7 +1045,7 @@ func (s *HostService) GetVMsForHostFromDB(hostID string) ([]VMView, error) {
 	// Check if host is connected to populate live data
 	// Temporarily disabled for performance
 	// hostConnected := false
-	// if _, err := s.connector.GetConnection(hostID); err == nil {
+	// if s.connector.IsConnected(hostID) {
 	//     hostConnected = true
 	// }
 
@@ -903,6 +1099,7 @@ func (s *HostService) GetVMsForHostFromDB(hostID string) ([]VMView, error) {
 			SyncStatus:      dbVM.SyncStatus,
 			DriftDetails:    dbVM.DriftDetails,
 			NeedsRebuild:    dbVM.NeedsRebuild,
+			HasManagedSave:  dbVM.HasManagedSave,
 			// Timestamps
 			CreatedAt: dbVM.CreatedAt,
 			UpdatedAt: dbVM.UpdatedAt,
@@ -1033,8 +1230,9 @@ func (s *HostService) getVMHardwareFromDB(hostID, vmName string) (*libvirt.Hardw
 			}
 		}
 		var driver struct {
-			Name string `xml:"name,attr" json:"driver_name"`
-			Type string `xml:"type,attr" json:"type"`
+			Name  string `xml:"name,attr" json:"driver_name"`
+			Type  string `xml:"type,attr" json:"type"`
+			Cache string `xml:"cache,attr" json:"cache,omitempty"`
 		}
 		if da.Disk.DriverJSON != "" {
 			json.Unmarshal([]byte(da.Disk.DriverJSON), &driver)
@@ -1091,6 +1289,8 @@ func (s *HostService) getVMHardwareFromDB(hostID, vmName string) (*libvirt.Hardw
 						Bridge    string `xml:"bridge,attr" json:"bridge"`
 						Network   string `xml:"network,attr" json:"network"`
 						PortGroup string `xml:"portgroup,attr" json:"portgroup"`
+						Dev       string `xml:"dev,attr" json:"dev,omitempty"`
+						Mode      string `xml:"mode,attr" json:"mode,omitempty"`
 					}{
 						Bridge: binding.Network.BridgeName,
 					},
@@ -1138,7 +1338,7 @@ func (s *HostService) getVMHardwareFromDB(hostID, vmName string) (*libvirt.Hardw
 }
 func (s *HostService) GetVMHardwareAndDetectDrift(hostID, vmName string) (*libvirt.HardwareInfo, error) {
 	// Check if host is connected
-	if _, err := s.connector.GetConnection(hostID); err != nil {
+	if !s.connector.IsConnected(hostID) {
 		return nil, fmt.Errorf("host %s is not connected", hostID)
 	}
 
@@ -1181,22 +1381,241 @@ func (s *HostService) SyncVMsForHost(hostID string) {
 	// Note: syncHostVMs already broadcasts vms-changed and discovered-vms-changed if changed
 }
 
-// startVMPolling starts background polling of VM states for a connected host
-func (s *HostService) startVMPolling(hostID string) {
-	// Stop any existing poller for this host
-	if stopChan, exists := s.vmPollers.Load(hostID); exists {
-		close(stopChan.(chan struct{}))
+// watchHostConnection waits for the connection to a host to drop and then
+// reconnects with backoff. It replaces any existing watcher for the host.
+func (s *HostService) watchHostConnection(hostID string) {
+	lost, err := s.connector.ConnectionLost(hostID)
+	if err != nil {
+		log.Verbosef("Cannot watch connection to host %s: %v", hostID, err)
+		return
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	if prev, exists := s.hostWatchers.Swap(hostID, cancel); exists {
+		prev.(context.CancelFunc)()
+	}
+
+	go func() {
+		select {
+		case <-ctx.Done():
+			return
+		case <-lost:
+		}
+		s.handleConnectionLost(hostID)
+		s.reconnectWithBackoff(ctx, hostID)
+	}()
+}
+
+// scheduleReconnect starts a backoff reconnect loop for a host that is not
+// currently connected, replacing any existing watcher.
+func (s *HostService) scheduleReconnect(hostID string) {
+	ctx, cancel := context.WithCancel(context.Background())
+	if prev, exists := s.hostWatchers.Swap(hostID, cancel); exists {
+		prev.(context.CancelFunc)()
+	}
+	go s.reconnectWithBackoff(ctx, hostID)
+}
+
+// stopHostWatch cancels the connection watcher or reconnect loop for a host.
+func (s *HostService) stopHostWatch(hostID string) {
+	if cancel, exists := s.hostWatchers.LoadAndDelete(hostID); exists {
+		cancel.(context.CancelFunc)()
+	}
+}
+
+// handleConnectionLost records that a host dropped off unexpectedly. Stats
+// subscribers are paused rather than dropped so they resume on reconnect.
+func (s *HostService) handleConnectionLost(hostID string) {
+	log.Errorf("Connection to host %s lost", hostID)
+	s.db.Model(&storage.Host{}).Where("id = ?", hostID).Updates(map[string]interface{}{"task_state": "", "state": storage.HostStateError})
+	if err := s.db.Model(&storage.VirtualMachine{}).Where("host_id = ?", hostID).Update("libvirt_state", storage.StateUnknown).Error; err != nil {
+		log.Warnf("Failed to update VM libvirt states to unknown for host %s: %v", hostID, err)
+	}
+
+	s.stopVMStateTracking(hostID)
+	s.monitor.PauseHostMonitoring(hostID)
+	s.hostMonitor.PauseHostMonitoring(hostID)
+
+	s.broadcastHostConnectionChanged(hostID, false)
+	s.broadcastHostsChanged()
+	s.broadcastVMsChanged(hostID)
+}
+
+// reconnectWithBackoff retries the connection to a host with exponentially
+// growing delays until it succeeds, ctx is cancelled, the host is deleted, or
+// auto-reconnection is disabled for it.
+func (s *HostService) reconnectWithBackoff(ctx context.Context, hostID string) {
+	delay := s.reconnectBaseDelay
+	for attempt := 1; ; attempt++ {
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(delay):
+		}
+
+		if s.connector.IsConnected(hostID) {
+			return
+		}
+		var host storage.Host
+		if err := s.db.Where("id = ?", hostID).First(&host).Error; err != nil {
+			log.Verbosef("Giving up reconnecting to host %s: %v", hostID, err)
+			return
+		}
+		if host.AutoReconnectDisabled {
+			log.Verbosef("Not reconnecting to host %s: auto-reconnection disabled", hostID)
+			return
+		}
+
+		// EnsureHostConnected restarts state tracking and monitoring and
+		// installs a fresh watcher, which cancels this loop's context.
+		err := s.EnsureHostConnected(hostID)
+		if err == nil {
+			log.Infof("Reconnected to host %s after %d attempt(s)", hostID, attempt)
+			return
+		}
+		delay = min(delay*2, s.reconnectMaxDelay)
+		log.Verbosef("Reconnect attempt %d for host %s failed, retrying in %s: %v", attempt, hostID, delay, err)
+	}
+}
+
+const (
+	// vmPollInterval is used when domain events are unavailable for a host.
+	vmPollInterval = 30 * time.Second
+	// vmReconcileInterval is used alongside domain events to catch anything
+	// the event stream missed.
+	vmReconcileInterval = 5 * time.Minute
+)
+
+// startVMStateTracking subscribes to domain events for a connected host and
+// starts a reconciliation poller. If the subscription fails the poller runs
+// at the faster fallback interval instead.
+func (s *HostService) startVMStateTracking(hostID string) {
+	if s.startVMEventListener(hostID) {
+		s.startVMPolling(hostID, vmReconcileInterval)
+		return
+	}
+	s.startVMPolling(hostID, vmPollInterval)
+}
+
+// stopVMStateTracking stops the event listener and poller for a host.
+func (s *HostService) stopVMStateTracking(hostID string) {
+	s.stopVMEventListener(hostID)
+	s.stopVMPolling(hostID)
+}
+
+// startVMEventListener subscribes to libvirt domain events for a host and
+// applies them as they arrive. It reports whether the subscription succeeded.
+func (s *HostService) startVMEventListener(hostID string) bool {
+	s.stopVMEventListener(hostID)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	events, err := s.connector.SubscribeDomainEvents(ctx, hostID)
+	if err != nil {
+		cancel()
+		log.Verbosef("Domain events unavailable for host %s, falling back to polling: %v", hostID, err)
+		return false
+	}
+	s.vmEventListeners.Store(hostID, cancel)
+
+	go func() {
+		log.Debugf("Started domain event listener for host %s", hostID)
+		for ev := range events {
+			s.handleDomainEvent(ev)
+		}
+		// The stream also ends when the connection drops. If the host is
+		// somehow still connected, poll at the fallback rate until the
+		// listener is restarted.
+		if ctx.Err() == nil && s.connector.IsConnected(hostID) {
+			log.Verbosef("Domain event stream for host %s closed unexpectedly, falling back to polling", hostID)
+			s.startVMPolling(hostID, vmPollInterval)
+		}
+		log.Debugf("Stopped domain event listener for host %s", hostID)
+	}()
+	return true
+}
+
+// stopVMEventListener cancels the domain event subscription for a host.
+func (s *HostService) stopVMEventListener(hostID string) {
+	if cancel, exists := s.vmEventListeners.LoadAndDelete(hostID); exists {
+		cancel.(context.CancelFunc)()
+	}
+}
+
+// handleDomainEvent updates the database for a single libvirt domain event
+// and notifies clients if anything changed.
+func (s *HostService) handleDomainEvent(ev libvirt.DomainEvent) {
+	log.Debugf("Domain event on host %s: kind=%s vm=%s event=%d detail=%d alias=%s", ev.HostID, ev.Kind, ev.Name, ev.Event, ev.Detail, ev.DevAlias)
+
+	var vms []storage.VirtualMachine
+	s.db.Where("host_id = ? AND domain_uuid = ?", ev.HostID, ev.UUID).Limit(1).Find(&vms)
+	if len(vms) == 0 {
+		// Unmanaged domains only matter when they are defined or undefined,
+		// since that changes the discovered VM list.
+		if ev.Kind == libvirt.DomainEventKindLifecycle && (ev.Event == golibvirt.DomainEventDefined || ev.Event == golibvirt.DomainEventUndefined) {
+			if _, err := s.syncHostVMs(ev.HostID); err != nil {
+				log.Verbosef("Failed to refresh VMs for host %s after domain event: %v", ev.HostID, err)
+			}
+		}
+		return
 	}
+	vm := vms[0]
 
-	// Create a stop channel for this poller
+	changed, err := s.detectDriftOrIngestVM(ev.HostID, ev.Name, false)
+	if err != nil {
+		log.Verbosef("Failed to apply domain event for VM %s on host %s: %v", ev.Name, ev.HostID, err)
+	}
+
+	if ev.Kind == libvirt.DomainEventKindDeviceAdded || ev.Kind == libvirt.DomainEventKindDeviceRemoved {
+		hwChanged, err := s.resyncVMHardware(ev.HostID, vm.ID, ev.Name)
+		if err != nil {
+			log.Verbosef("Failed to resync hardware for VM %s after %s of %s: %v", ev.Name, ev.Kind, ev.DevAlias, err)
+		}
+		changed = changed || hwChanged
+	}
+
+	if changed {
+		s.broadcastVMsChanged(ev.HostID)
+	}
+}
+
+// resyncVMHardware re-reads a domain's devices from libvirt and stores them.
+func (s *HostService) resyncVMHardware(hostID, vmID, vmName string) (bool, error) {
+	vmInfo, err := s.connector.GetDomainInfo(hostID, vmName)
+	if err != nil {
+		return false, err
+	}
+	hardware, err := s.connector.GetDomainHardware(hostID, vmName)
+	if err != nil {
+		return false, err
+	}
+	tx := s.db.Begin()
+	changed, err := s.syncVMHardware(tx, vmID, hostID, hardware, &vmInfo.Graphics, nil, nil)
+	if err != nil {
+		tx.Rollback()
+		return false, err
+	}
+	if err := tx.Commit().Error; err != nil {
+		return false, err
+	}
+	if changed {
+		s.refreshVMSecurityGroupSources(vmID)
+	}
+	return changed, nil
+}
+
+// startVMPolling starts background polling of VM states for a connected host
+func (s *HostService) startVMPolling(hostID string, interval time.Duration) {
+	// Replace any existing poller for this host. Swap hands each stop channel
+	// to exactly one closer, so this is safe against a concurrent stop.
 	stopChan := make(chan struct{})
-	s.vmPollers.Store(hostID, stopChan)
+	if prev, exists := s.vmPollers.Swap(hostID, stopChan); exists {
+		close(prev.(chan struct{}))
+	}
 
 	go func() {
-		ticker := time.NewTicker(30 * time.Second) // Poll every 30 seconds
+		ticker := time.NewTicker(interval)
 		defer ticker.Stop()
 
-		log.Debugf("Started VM state polling for host %s", hostID)
+		log.Debugf("Started VM state polling for host %s every %s", hostID, interval)
 
 		// Do an initial poll immediately
 		if err := s.pollVMStates(hostID); err != nil {
@@ -1210,7 +1629,7 @@ func (s *HostService) startVMPolling(hostID string) {
 				return
 			case <-ticker.C:
 				// Check if host is still connected
-				if _, err := s.connector.GetConnection(hostID); err != nil {
+				if !s.connector.IsConnected(hostID) {
 					log.Debugf("Host %s no longer connected, stopping VM polling", hostID)
 					return
 				}
@@ -1253,7 +1672,7 @@ func (s *HostService) pollVMStates(hostID string) error {
 		}
 
 		// Update libvirtState if it changed
-		newLibvirtState := mapLibvirtStateToVMState(vmInfo.State)
+		newLibvirtState := observedVMState(vmInfo)
 		if dbVM.LibvirtState != newLibvirtState {
 			if err := s.db.Model(&dbVM).Update("libvirt_state", newLibvirtState).Error; err != nil {
 				log.Verbosef("Failed to update libvirtState for VM %s: %v", dbVM.Name, err)
@@ -1262,12 +1681,20 @@ func (s *HostService) pollVMStates(hostID string) error {
 			changed = true
 			log.Debugf("Updated libvirtState for VM %s on host %s: %s -> %s", dbVM.Name, hostID, dbVM.LibvirtState, newLibvirtState)
 		}
+		if dbVM.HasManagedSave != vmInfo.HasManagedSave {
+			if err := s.db.Model(&dbVM).Update("has_managed_save", vmInfo.HasManagedSave).Error; err != nil {
+				log.Verbosef("Failed to update managed save flag for VM %s: %v", dbVM.Name, err)
+				continue
+			}
+			changed = true
+		}
 	}
 
 	if changed {
 		s.broadcastVMsChanged(hostID)
 	}
 
+	s.releaseProvisioningSeeds(hostID)
 	return nil
 }
 
@@ -1391,6 +1818,22 @@ func (s *HostService) CreateVM(hostID string, vmData storage.CreateVMRequest) (*
 		return nil, fmt.Errorf("VM with name %s already exists on host %s", vmData.Name, hostID)
 	}
 
+	if err := validateProvisioning(vmData); err != nil {
+		return nil, err
+	}
+	flavor, specs, err := s.applyFlavor(&vmData)
+	if err != nil {
+		return nil, err
+	}
+
+	var iso *storage.Volume
+	if vmData.ISOVolumeID != "" {
+		var err error
+		if iso, err = s.findISO(hostID, vmData.ISOVolumeID); err != nil {
+			return nil, err
+		}
+	}
+
 	// Generate UUID for the new VM
 	vmUUID := uuid.New().String()
 
@@ -1410,11 +1853,20 @@ func (s *HostService) CreateVM(hostID string, vmData storage.CreateVMRequest) (*
 	if vmData.BootDevice == "" {
 		vmData.BootDevice = "hd"
 	}
+	if vmData.Pool == "" {
+		vmData.Pool = "default"
+	}
+	var poolRows []storage.StoragePool
+	s.db.Where("host_id = ? AND name = ?", hostID, vmData.Pool).Limit(1).Find(&poolRows)
+	poolID := ""
+	if len(poolRows) > 0 {
+		poolID = poolRows[0].ID
+	}
 
 	// Create storage volume record in DB with a CREATING task state before provisioning
 	volumeName := fmt.Sprintf("%s.qcow2", vmData.Name)
 	newVol := storage.Volume{
-		StoragePoolID:   "",
+		StoragePoolID:   poolID,
 		Name:            volumeName,
 		Path:            "",
 		Type:            "DISK",
@@ -1430,7 +1882,7 @@ func (s *HostService) CreateVM(hostID string, vmData storage.CreateVMRequest) (*
 	}
 
 	// Provision the actual storage volume on the host
-	diskPath, err := s.connector.CreateStorageVolume(hostID, "default", volumeName, uint64(vmData.DiskSizeGB)*1024*1024*1024)
+	diskPath, err := s.connector.CreateStorageVolume(hostID, vmData.Pool, volumeName, uint64(vmData.DiskSizeGB)*1024*1024*1024)
 	if err != nil {
 		// mark the volume as errored and clear task state
 		s.db.Model(&storage.Volume{}).Where("id = ?", newVol.ID).Updates(map[string]interface{}{"state": string(storage.StorageStateError), "task_state": ""})
@@ -1449,6 +1901,8 @@ func (s *HostService) CreateVM(hostID string, vmData storage.CreateVMRequest) (*
 		Path:          diskPath,
 		Format:        "qcow2",
 		CapacityBytes: uint64(vmData.DiskSizeGB) * 1024 * 1024 * 1024,
+		DriverJSON:    diskDriverJSON("qcow2", ""),
+		IOTune:        diskIOTuneJSON(specs.DiskIOTune),
 		State:         string(storage.StorageStateAvailable),
 		TaskState:     "",
 	}
@@ -1470,21 +1924,50 @@ func (s *HostService) CreateVM(hostID string, vmData storage.CreateVMRequest) (*
 		log.Verbosef("Warning: failed to create disk attachment record for VM: %v", err)
 	}
 
-	// Generate VM XML configuration
-	memoryKB := vmData.MemoryBytes / 1024
-	domainXML := s.connector.GenerateBasicVMXML(vmData.Name, vmUUID, vmData.VCPUCount, memoryKB, diskPath, vmData.NetworkInterface)
+	boot := []string{vmData.BootDevice}
+	if iso != nil {
+		if _, err := s.recordMediaAttachment(vmUUID, libvirt.DiskDevice{Device: "cdrom", Path: iso.Path, Format: "raw", Bus: "sata", Target: "sda", ReadOnly: true}, iso); err != nil {
+			log.Verbosef("Warning: failed to create CD-ROM attachment record for VM: %v", err)
+		}
+		// Install media sits on SATA, which every machine type has and
+		// guests boot from without extra drivers.
+		if vmData.BootDevice != "cdrom" {
+			boot = append([]string{"cdrom"}, boot...)
+		}
+	}
+	// The seed goes in the next SATA drive; a guest that boots from CD
+	// boots from the install image in the first.
+	seedTarget := "sda"
+	if iso != nil {
+		seedTarget = "sdb"
+	}
+	if _, err := s.createProvisioningSeed(hostID, vmData.Pool, vmUUID, vmData, seedTarget); err != nil {
+		s.discardNewVM(hostID, vmData.Pool, volumeName, vmUUID)
+		return nil, err
+	}
 
-	// Define the domain in libvirt
-	_, err = s.connector.DefineAndCreateDomain(hostID, domainXML)
+	nic, err := s.newVMNIC(hostID, vmData.NetworkInterface)
 	if err != nil {
-		// Cleanup: remove the storage volume if domain creation failed
-		// Note: In a production system, you'd want more robust cleanup
-		log.Errorf("Failed to define domain, cleaning up storage volume: %v", err)
-		return nil, fmt.Errorf("failed to define domain: %w", err)
+		s.discardNewVM(hostID, vmData.Pool, volumeName, vmUUID)
+		return nil, err
+	}
+	if _, err := s.recordNICAttachment(hostID, vmUUID, nic.MAC, nic); err != nil {
+		s.discardNewVM(hostID, vmData.Pool, volumeName, vmUUID)
+		return nil, err
+	}
+	if err := s.recordVMDefaults(hostID, vmUUID, boot); err != nil {
+		s.discardNewVM(hostID, vmData.Pool, volumeName, vmUUID)
+		return nil, err
+	}
+	if _, err := s.recordFlavorMemory(vmUUID, specs); err != nil {
+		s.discardNewVM(hostID, vmData.Pool, volumeName, vmUUID)
+		return nil, err
 	}
 
-	// Create VM record in database
+	// Create VM record in database. The row ID doubles as the vm_uuid key for
+	// attachment tables, so it must match the attachments created above.
 	newVM := storage.VirtualMachine{
+		Base:          storage.Base{ID: vmUUID},
 		HostID:        hostID,
 		Name:          vmData.Name,
 		DomainUUID:    vmUUID,
@@ -1502,12 +1985,31 @@ func (s *HostService) CreateVM(hostID string, vmData storage.CreateVMRequest) (*
 		SyncStatus:    storage.StatusSynced,
 		NeedsRebuild:  false,
 	}
+	if flavor != nil {
+		newVM.ResourceClassID = &flavor.ID
+	}
 
 	// Set default title if not provided
 	if newVM.Title == "" {
 		newVM.Title = vmData.Name
 	}
 
+	// The domain is rendered from the records above, so what libvirt runs
+	// and what the database describes cannot disagree.
+	domainXML, err := s.renderVMDomain(newVM)
+	if err != nil {
+		s.discardNewVM(hostID, vmData.Pool, volumeName, vmUUID)
+		return nil, err
+	}
+
+	// Define the domain in libvirt
+	_, err = s.connector.DefineAndCreateDomain(hostID, domainXML)
+	if err != nil {
+		log.Errorf("Failed to define domain, cleaning up storage volume: %v", err)
+		s.discardNewVM(hostID, vmData.Pool, volumeName, vmUUID)
+		return nil, fmt.Errorf("failed to define domain: %w", err)
+	}
+
 	// Save to database
 	if err := s.db.Create(&newVM).Error; err != nil {
 		// Cleanup: undefine domain if database save failed
@@ -1515,6 +2017,7 @@ func (s *HostService) CreateVM(hostID string, vmData storage.CreateVMRequest) (*
 		if undefErr := s.connector.UndefineDomain(hostID, vmData.Name); undefErr != nil {
 			log.Errorf("Failed to cleanup domain after database error: %v", undefErr)
 		}
+		s.discardNewVM(hostID, vmData.Pool, volumeName, vmUUID)
 		return nil, fmt.Errorf("failed to save VM to database: %w", err)
 	}
 
@@ -1525,6 +2028,59 @@ func (s *HostService) CreateVM(hostID string, vmData storage.CreateVMRequest) (*
 	return &newVM, nil
 }
 
+// newVMNIC describes the NIC a new VM gets on the named network. A network
+// Virtumancer knows as a host bridge is attached as a bridge.
+func (s *HostService) newVMNIC(hostID, network string) (libvirt.InterfaceDevice, error) {
+	nic := libvirt.InterfaceDevice{Type: NICTypeNetwork, Source: network, Model: "virtio"}
+	var nets []storage.Network
+	s.db.Where("host_id = ? AND name = ?", hostID, network).Limit(1).Find(&nets)
+	if len(nets) > 0 && nets[0].Mode == "bridged" && nets[0].BridgeName != "" {
+		nic.Type = NICTypeBridge
+		nic.Source = nets[0].BridgeName
+	}
+	mac, err := libvirt.GenerateMAC()
+	if err != nil {
+		return libvirt.InterfaceDevice{}, err
+	}
+	nic.MAC = mac
+	return nic, nil
+}
+
+// discardNewVM removes what CreateVM recorded and provisioned for a VM
+// whose domain was never defined.
+func (s *HostService) discardNewVM(hostID, poolName, volumeName, vmUUID string) {
+	var ports []storage.PortAttachment
+	s.db.Where("vm_uuid = ?", vmUUID).Find(&ports)
+	var disks []storage.DiskAttachment
+	s.db.Preload("Disk").Where("vm_uuid = ?", vmUUID).Find(&disks)
+	s.discardProvisioningSeed(hostID, vmUUID)
+
+	tx := s.db.Begin()
+	for _, att := range ports {
+		tx.Unscoped().Where("port_id = ?", att.PortID).Delete(&storage.PortBinding{})
+		tx.Unscoped().Where("id = ?", att.PortID).Delete(&storage.Port{})
+	}
+	for _, att := range disks {
+		// Only the VM's own disk goes; ISO images stay in the library.
+		if att.ReadOnly || att.Disk.VolumeID == nil {
+			continue
+		}
+		tx.Unscoped().Where("id = ?", att.DiskID).Delete(&storage.Disk{})
+		tx.Unscoped().Where("id = ?", *att.Disk.VolumeID).Delete(&storage.Volume{})
+	}
+	if err := storage.DeleteVMRecords(tx, vmUUID); err != nil {
+		tx.Rollback()
+		log.Warnf("Failed to remove records of VM %s: %v", vmUUID, err)
+		return
+	}
+	if err := tx.Commit().Error; err != nil {
+		log.Warnf("Failed to remove records of VM %s: %v", vmUUID, err)
+	}
+	if err := s.connector.DeleteStorageVolume(hostID, poolName, volumeName); err != nil {
+		log.Warnf("Failed to remove volume %s of VM %s: %v", volumeName, vmUUID, err)
+	}
+}
+
 // ImportVM imports a single discovered VM into the database by name.
 func (s *HostService) ImportVM(hostID, vmName string) error {
 	log.Infof("ImportVM started - hostID: %s, vmName: %s", hostID, vmName)
@@ -1723,7 +2279,7 @@ func (s *HostService) ingestVMFromLibvirt(hostID, vmName string) (bool, error) {
 			softVM.HostID = hostID
 			softVM.Name = vmInfo.Name
 			softVM.DomainUUID = vmInfo.UUID
-			softVM.State = mapLibvirtStateToVMState(vmInfo.State)
+			softVM.State = observedVMState(vmInfo)
 			softVM.VCPUCount = vmInfo.Vcpu
 			softVM.MemoryBytes = vmInfo.MaxMem * 1024
 			softVM.SyncStatus = storage.StatusSynced
@@ -1790,15 +2346,16 @@ func (s *HostService) ingestVMFromLibvirt(hostID, vmName string) (bool, error) {
 
 	log.Verbosef("Creating new VM record for %s (UUID: %s)", vmName, vmInfo.UUID)
 	newVM := storage.VirtualMachine{
-		HostID:       hostID,
-		Name:         vmInfo.Name,
-		DomainUUID:   vmInfo.UUID,
-		State:        mapLibvirtStateToVMState(vmInfo.State),
-		LibvirtState: mapLibvirtStateToVMState(vmInfo.State),
-		VCPUCount:    vmInfo.Vcpu,
-		MemoryBytes:  vmInfo.MaxMem * 1024,
-		SyncStatus:   storage.StatusSynced,
-		Source:       "managed",
+		HostID:         hostID,
+		Name:           vmInfo.Name,
+		DomainUUID:     vmInfo.UUID,
+		State:          observedVMState(vmInfo),
+		LibvirtState:   observedVMState(vmInfo),
+		VCPUCount:      vmInfo.Vcpu,
+		MemoryBytes:    vmInfo.MaxMem * 1024,
+		SyncStatus:     storage.StatusSynced,
+		Source:         "managed",
+		HasManagedSave: vmInfo.HasManagedSave,
 	}
 	var existingVMs []storage.VirtualMachine
 	tx.Where("domain_uuid = ?", vmInfo.UUID).Limit(1).Find(&existingVMs)
@@ -1869,7 +2426,7 @@ func (s *HostService) detectDriftOrIngestVM(hostID, vmName string, isInitialSync
 		// If we can't get info from libvirt, first check whether the connector
 		// actually has an active connection to the host. If the host is not
 		// connected, treat this as a transient error and do NOT prune the VM.
-		if _, connErr := s.connector.GetConnection(hostID); connErr != nil {
+		if !s.connector.IsConnected(hostID) {
 			// Host not connected — skip pruning and report the underlying error.
 			return false, fmt.Errorf("could not fetch info for VM %s on host %s: %w", vmName, hostID, err)
 		}
@@ -1877,7 +2434,13 @@ func (s *HostService) detectDriftOrIngestVM(hostID, vmName string, isInitialSync
 		// Host is connected but the domain lookup failed — this likely means
 		// the VM truly no longer exists in libvirt, so prune stale DB entries.
 		var dbVM storage.VirtualMachine
-		if err := s.db.Where("host_id = ? AND name = ?", hostID, vmName).First(&dbVM).Error; err == nil {
+		if dbErr := s.db.Where("host_id = ? AND name = ?", hostID, vmName).First(&dbVM).Error; dbErr == nil {
+			// A migrating VM is briefly undefined on the source; MigrateVM
+			// moves its record once libvirt is done.
+			if dbVM.TaskState == storage.TaskStateMigrating {
+				log.Verbosef("Skipping pruning VM %s while it migrates off host %s", vmName, hostID)
+				return false, nil
+			}
 			// Don't prune VMs that were created very recently (within last 5 minutes)
 			// to avoid pruning VMs that were just imported but may not be immediately
 			// visible to libvirt due to timing issues
@@ -1928,11 +2491,15 @@ func (s *HostService) detectDriftOrIngestVM(hostID, vmName string, isInitialSync
 		driftDetails := make(map[string]map[string]interface{})
 
 		// Always update observed state from libvirt
-		newLibvirtState := mapLibvirtStateToVMState(vmInfo.State)
+		newLibvirtState := observedVMState(vmInfo)
 		if existingVM.LibvirtState != newLibvirtState {
 			updates["libvirt_state"] = newLibvirtState
 			changed = true
 		}
+		if existingVM.HasManagedSave != vmInfo.HasManagedSave {
+			updates["has_managed_save"] = vmInfo.HasManagedSave
+			changed = true
+		}
 
 		// Sync intended state with libvirt state if they differ and VM is not in a task state
 		// This handles cases where async operations (shutdown/reboot) have completed
@@ -1988,7 +2555,7 @@ func (s *HostService) detectDriftOrIngestVM(hostID, vmName string, isInitialSync
 			softVM.HostID = hostID
 			softVM.Name = vmInfo.Name
 			softVM.DomainUUID = vmInfo.UUID
-			softVM.State = mapLibvirtStateToVMState(vmInfo.State)
+			softVM.State = observedVMState(vmInfo)
 			softVM.VCPUCount = vmInfo.Vcpu
 			softVM.MemoryBytes = vmInfo.MaxMem * 1024
 			softVM.SyncStatus = storage.StatusSynced
@@ -2045,10 +2612,11 @@ func (s *HostService) syncVMSecurityLabels(tx *gorm.DB, vmUUID string, securityL
 			relabel = true
 		}
 		secLabel := storage.SecurityLabel{
-			VMUUID:  vmUUID,
-			Type:    label.Type,
-			Label:   label.Label,
-			Relabel: relabel,
+			VMUUID:        vmUUID,
+			Type:          label.Type,
+			SecurityModel: label.Model,
+			Label:         label.Label,
+			Relabel:       relabel,
 		}
 		var existingLabels []storage.SecurityLabel
 		tx.Where("vm_uuid = ? AND type = ?", vmUUID, label.Type).Limit(1).Find(&existingLabels)
@@ -2059,6 +2627,7 @@ func (s *HostService) syncVMSecurityLabels(tx *gorm.DB, vmUUID string, securityL
 			changed = true
 		} else {
 			if err := tx.Model(&existingLabels[0]).Updates(map[string]interface{}{
+				"model":   secLabel.SecurityModel,
 				"label":   secLabel.Label,
 				"relabel": secLabel.Relabel,
 			}).Error; err != nil {
@@ -2087,7 +2656,8 @@ func (s *HostService) syncVMLaunchSecurity(tx *gorm.DB, vmUUID string, launchSec
 		if reducedBits, err := strconv.ParseUint(launchSecurity.ReducedPhysBits, 10, 32); err == nil {
 			launchSec.ReducedPhysBits = uint(reducedBits)
 		}
-		if policy, err := strconv.ParseUint(launchSecurity.Policy, 10, 64); err == nil {
+		// Policies are usually written in hex, such as 0x0003.
+		if policy, err := strconv.ParseUint(launchSecurity.Policy, 0, 64); err == nil {
 			launchSec.Policy = policy
 		}
 		launchSec.DHCert = launchSecurity.DHCert
@@ -2103,7 +2673,7 @@ func (s *HostService) syncVMLaunchSecurity(tx *gorm.DB, vmUUID string, launchSec
 		} else {
 			if err := tx.Model(&existingLaunch[0]).Updates(map[string]interface{}{
 				"type":              launchSec.Type,
-				"cbitpos":           launchSec.CBitPos,
+				"c_bit_pos":         launchSec.CBitPos,
 				"reduced_phys_bits": launchSec.ReducedPhysBits,
 				"policy":            launchSec.Policy,
 				"dh_cert":           launchSec.DHCert,
@@ -2253,17 +2823,26 @@ func (s *HostService) syncVMOSConfig(tx *gorm.DB, vmUUID string, osConfig *libvi
 	if osConfig != nil {
 		osConfigData := storage.OSConfig{
 			VMUUID:         vmUUID,
-			LoaderPath:     osConfig.Init, // This might need adjustment based on actual XML structure
-			LoaderType:     osConfig.Arch,
 			BootMenuEnable: osConfig.BootMenu != nil && osConfig.BootMenu.Enable == "yes",
+			SMBIOSMode:     osConfig.SMBIOSMode,
+			Firmware:       osConfig.Firmware,
+			BIOSUsesSerial: osConfig.BIOSUseSerial,
+		}
+		if loader := osConfig.Loader; loader != nil {
+			osConfigData.LoaderPath = loader.Path
+			osConfigData.LoaderType = loader.Type
+			osConfigData.LoaderReadonly = loader.ReadOnly
+			osConfigData.LoaderSecure = loader.Secure
+			osConfigData.NVramPath = loader.NVRAM
+			osConfigData.NVramTemplate = loader.NVRAMTemplate
 		}
 		if osConfig.BootMenu != nil {
 			if timeout, err := strconv.Atoi(osConfig.BootMenu.Timeout); err == nil {
 				osConfigData.BootMenuTimeout = uint(timeout)
 			}
 		}
-		if osConfig.Type != "" {
-			osConfigData.Firmware = osConfig.Type
+		if timeout, err := strconv.ParseUint(osConfig.BIOSRebootTimeout, 10, 32); err == nil {
+			osConfigData.BIOSRebootTimeout = uint(timeout)
 		}
 
 		var existingOS []storage.OSConfig
@@ -2276,11 +2855,18 @@ func (s *HostService) syncVMOSConfig(tx *gorm.DB, vmUUID string, osConfig *libvi
 		} else {
 			// Update existing
 			if err := tx.Model(&existingOS[0]).Updates(map[string]interface{}{
-				"loader_path":       osConfigData.LoaderPath,
-				"loader_type":       osConfigData.LoaderType,
-				"boot_menu_enable":  osConfigData.BootMenuEnable,
-				"boot_menu_timeout": osConfigData.BootMenuTimeout,
-				"firmware":          osConfigData.Firmware,
+				"loader_path":         osConfigData.LoaderPath,
+				"loader_type":         osConfigData.LoaderType,
+				"loader_readonly":     osConfigData.LoaderReadonly,
+				"loader_secure":       osConfigData.LoaderSecure,
+				"n_vram_path":         osConfigData.NVramPath,
+				"n_vram_template":     osConfigData.NVramTemplate,
+				"boot_menu_enable":    osConfigData.BootMenuEnable,
+				"boot_menu_timeout":   osConfigData.BootMenuTimeout,
+				"smbios_mode":         osConfigData.SMBIOSMode,
+				"firmware":            osConfigData.Firmware,
+				"bios_uses_serial":    osConfigData.BIOSUsesSerial,
+				"bios_reboot_timeout": osConfigData.BIOSRebootTimeout,
 			}).Error; err != nil {
 				return false, err
 			}
@@ -2394,6 +2980,7 @@ func (s *HostService) syncVMMemoryConfig(tx *gorm.DB, vmUUID string, memoryBacki
 			VMUUID:       vmUUID,
 			ConfigType:   "backing",
 			SourceType:   memoryBacking.Source,
+			Mode:         memoryBacking.Access,
 			Nosharepages: memoryBacking.NoSharePages,
 			Locked:       memoryBacking.Locked,
 		}
@@ -2412,6 +2999,7 @@ func (s *HostService) syncVMMemoryConfig(tx *gorm.DB, vmUUID string, memoryBacki
 		} else {
 			if err := tx.Model(&existingMem[0]).Updates(map[string]interface{}{
 				"source_type":  memConfig.SourceType,
+				"mode":         memConfig.Mode,
 				"nosharepages": memConfig.Nosharepages,
 				"locked":       memConfig.Locked,
 				"config_json":  memConfig.ConfigJSON,
@@ -2975,10 +3563,7 @@ func (s *HostService) syncVMDisks(tx *gorm.DB, vmUUID, hostID string, disks []li
 		}
 
 		// For driver options, serialize to JSON
-		driverJSON, _ := json.Marshal(map[string]interface{}{
-			"name": disk.Driver.Name,
-			"type": disk.Driver.Type,
-		})
+		driverJSON, _ := json.Marshal(syncedDiskDriver(disk))
 
 		updates := make(map[string]interface{})
 		if volume != nil {
@@ -2991,6 +3576,7 @@ func (s *HostService) syncVMDisks(tx *gorm.DB, vmUUID, hostID string, disks []li
 		updates["path"] = path
 		updates["format"] = disk.Driver.Type
 		updates["driver_json"] = string(driverJSON)
+		updates["io_tune"] = diskIOTuneJSON(disk.IOTune)
 
 		// Prioritize API-sourced capacity data over XML
 		var capacityBytes uint64
@@ -3075,6 +3661,8 @@ func (s *HostService) syncVMDisks(tx *gorm.DB, vmUUID, hostID string, disks []li
 					diskRes.Format = v.(string)
 				case "driver_json":
 					diskRes.DriverJSON = v.(string)
+				case "io_tune":
+					diskRes.IOTune = v.(string)
 				case "capacity_bytes":
 					if cb, ok := v.(uint64); ok {
 						diskRes.CapacityBytes = cb
@@ -3124,6 +3712,9 @@ func (s *HostService) syncVMDisks(tx *gorm.DB, vmUUID, hostID string, disks []li
 			newAttachment := storage.DiskAttachment{
 				VMUUID: vmUUID, DiskID: diskRes.ID, DeviceName: disk.Target.Dev, BusType: disk.Target.Bus, ReadOnly: disk.ReadOnly, Shareable: disk.Shareable,
 			}
+			if disk.Device == "cdrom" {
+				newAttachment.Metadata = cdromMetadata
+			}
 			if err := tx.Create(&newAttachment).Error; err != nil {
 				return false, err
 			}
@@ -3251,10 +3842,7 @@ func (s *HostService) syncVMDisksXMLOnly(tx *gorm.DB, vmUUID, hostID string, dis
 			diskName = fmt.Sprintf("disk-%s", disk.Target.Dev)
 		}
 		// For driver options, serialize to JSON
-		driverJSON, _ := json.Marshal(map[string]interface{}{
-			"name": disk.Driver.Name,
-			"type": disk.Driver.Type,
-		})
+		driverJSON, _ := json.Marshal(syncedDiskDriver(disk))
 		updates := make(map[string]interface{})
 		if volume != nil {
 			updates["volume_id"] = volume.ID
@@ -3266,6 +3854,7 @@ func (s *HostService) syncVMDisksXMLOnly(tx *gorm.DB, vmUUID, hostID string, dis
 		updates["path"] = path
 		updates["format"] = disk.Driver.Type
 		updates["driver_json"] = string(driverJSON)
+		updates["io_tune"] = diskIOTuneJSON(disk.IOTune)
 
 		// Extract capacity if available
 		if disk.Capacity.Value > 0 {
@@ -3328,6 +3917,8 @@ func (s *HostService) syncVMDisksXMLOnly(tx *gorm.DB, vmUUID, hostID string, dis
 					diskRes.Format = v.(string)
 				case "driver_json":
 					diskRes.DriverJSON = v.(string)
+				case "io_tune":
+					diskRes.IOTune = v.(string)
 				case "capacity_bytes":
 					if cb, ok := v.(uint64); ok {
 						diskRes.CapacityBytes = cb
@@ -3365,6 +3956,9 @@ func (s *HostService) syncVMDisksXMLOnly(tx *gorm.DB, vmUUID, hostID string, dis
 			newAttachment := storage.DiskAttachment{
 				VMUUID: vmUUID, DiskID: diskRes.ID, DeviceName: disk.Target.Dev, BusType: disk.Target.Bus, ReadOnly: disk.ReadOnly, Shareable: disk.Shareable,
 			}
+			if disk.Device == "cdrom" {
+				newAttachment.Metadata = cdromMetadata
+			}
 			if err := tx.Create(&newAttachment).Error; err != nil {
 				return false, err
 			}
@@ -3507,6 +4101,12 @@ func (s *HostService) syncVMNetworks(tx *gorm.DB, vmUUID string, hostID string,
 			} else {
 				netRes = existingNets[0]
 			}
+		} else if network.Source.Dev != "" {
+			// Direct (macvtap) attachment to a host interface
+			netRes, err = s.findOrCreateNICNetwork(tx, hostID, NICTypeDirect, network.Source.Dev)
+			if err != nil {
+				return false, err
+			}
 		} else {
 			// Create a default network entry
 			netRes = storage.Network{
@@ -3567,8 +4167,21 @@ func (s *HostService) syncVMNetworks(tx *gorm.DB, vmUUID string, hostID string,
 			if err := tx.Create(&portRes).Error; err != nil {
 				return false, err
 			}
+			if err := tx.Model(&portRes).Updates(nicPortFields(libvirt.InterfaceDeviceFromInfo(network))).Error; err != nil {
+				return false, err
+			}
 		} else {
 			portRes = portResList[0]
+			if portRes.SourceType == "" {
+				// Ports recorded before sources were tracked get them now.
+				for k, v := range nicPortFields(libvirt.InterfaceDeviceFromInfo(network)) {
+					updates[k] = v
+				}
+			}
+			if ip, ok := updates["ip_address"]; ok && ip != portRes.IPAddress {
+				// Remote group rules expand to this address.
+				changed = true
+			}
 			if err := tx.Model(&portRes).Updates(updates).Error; err != nil {
 				return false, err
 			}
@@ -3622,7 +4235,9 @@ func (s *HostService) syncVMNetworks(tx *gorm.DB, vmUUID string, hostID string,
 			if attachment.PortID != portRes.ID {
 				updates["port_id"] = portRes.ID
 			}
-			if attachment.DeviceName != network.Target.Dev {
+			// Interfaces without a target (inactive or not yet reported)
+			// keep the name they were recorded under.
+			if network.Target.Dev != "" && attachment.DeviceName != network.Target.Dev {
 				updates["device_name"] = network.Target.Dev
 			}
 			if attachment.ModelName != network.Model.Type {
@@ -3634,9 +4249,12 @@ func (s *HostService) syncVMNetworks(tx *gorm.DB, vmUUID string, hostID string,
 				}
 				changed = true
 			}
-			// Remove from maps to avoid cleanup
+			// Remove from maps to avoid cleanup, under the keys the
+			// attachment was found by as well as the ones it had.
 			delete(existingByMAC, network.Mac.Address)
 			delete(existingByDev, network.Target.Dev)
+			delete(existingByMAC, existingAttachment.MACAddress)
+			delete(existingByDev, existingAttachment.DeviceName)
 		} else {
 			attachment = storage.PortAttachment{
 				VMUUID:     vmUUID,
@@ -3777,6 +4395,9 @@ func (s *HostService) syncVMNetworksXMLOnly(tx *gorm.DB, vmUUID string, hostID s
 			if err := tx.Create(&newPort).Error; err != nil {
 				return false, err
 			}
+			if err := tx.Model(&newPort).Updates(nicPortFields(libvirt.InterfaceDeviceFromInfo(net))).Error; err != nil {
+				return false, err
+			}
 
 			if network.ID != "" && newPort.ID != "" {
 				binding := storage.PortBinding{PortID: newPort.ID, NetworkID: network.ID}
@@ -4206,6 +4827,15 @@ func (s *HostService) syncVMHardware(tx *gorm.DB, vmUUID string, hostID string,
 		}
 	}
 
+	// Snapshots can be taken or removed with virsh, so reconcile them too.
+	if vm.Name != "" {
+		if snapshotsChanged, err := s.syncVMSnapshots(tx, vmUUID, hostID, vm.Name); err != nil {
+			log.Debugf("Failed to sync snapshots for VM %s: %v", vm.Name, err)
+		} else if snapshotsChanged {
+			changed = true
+		}
+	}
+
 	return changed, nil
 }
 
@@ -4256,6 +4886,10 @@ func (s *HostService) syncHostVMs(hostID string) (bool, error) {
 
 	for _, dbVM := range dbVMs {
 		if _, exists := liveVMUUIDs[dbVM.DomainUUID]; !exists {
+			if dbVM.TaskState == storage.TaskStateMigrating {
+				log.Verbosef("Skipping pruning VM %s while it migrates off host %s", dbVM.Name, hostID)
+				continue
+			}
 			// Don't prune VMs that were created very recently (within last 5 minutes)
 			// to avoid pruning VMs that were just imported but may not be immediately
 			// visible to libvirt due to timing issues
@@ -4265,8 +4899,8 @@ func (s *HostService) syncHostVMs(hostID string) (bool, error) {
 			}
 			// Ensure connector is connected to the host; if not, skip pruning as the
 			// missing VM may be due to a transient connection issue.
-			if _, connErr := s.connector.GetConnection(hostID); connErr != nil {
-				log.Verbosef("Skipping pruning VM %s because host %s is not connected: %v", dbVM.Name, hostID, connErr)
+			if !s.connector.IsConnected(hostID) {
+				log.Verbosef("Skipping pruning VM %s because host %s is not connected", dbVM.Name, hostID)
 				continue
 			}
 			log.Verbosef("Pruning VM %s (UUID: %s) from database as it's no longer in libvirt.", dbVM.Name, dbVM.ID)
@@ -4318,6 +4952,23 @@ func (s *HostService) syncHostVMs(hostID string) (bool, error) {
 	return overallChanged, nil
 }
 
+// storagePoolStateName maps a libvirt pool state to the name stored for it.
+func storagePoolStateName(state int) string {
+	switch golibvirt.StoragePoolState(state) {
+	case golibvirt.StoragePoolInactive:
+		return "inactive"
+	case golibvirt.StoragePoolBuilding:
+		return "building"
+	case golibvirt.StoragePoolRunning:
+		return "active"
+	case golibvirt.StoragePoolDegraded:
+		return "degraded"
+	case golibvirt.StoragePoolInaccessible:
+		return "inaccessible"
+	}
+	return "unknown"
+}
+
 // syncHostStoragePools synchronizes storage pools from libvirt to the database.
 func (s *HostService) syncHostStoragePools(hostID string) (bool, error) {
 	livePools, err := s.connector.ListAllStoragePools(hostID)
@@ -4332,16 +4983,7 @@ func (s *HostService) syncHostStoragePools(hostID string) (bool, error) {
 	for _, poolInfo := range livePools {
 		livePoolUUIDs[poolInfo.UUID] = struct{}{}
 
-		// Map numeric libvirt pool state to friendly string
-		poolState := "unknown"
-		switch poolInfo.State {
-		case 1:
-			poolState = "active"
-		case 2:
-			poolState = "inactive"
-		default:
-			poolState = "unknown"
-		}
+		poolState := storagePoolStateName(poolInfo.State)
 
 		// Check if storage pool is already in the database
 		var existing []storage.StoragePool
@@ -4357,6 +4999,7 @@ func (s *HostService) syncHostStoragePools(hostID string) (bool, error) {
 				State:           poolState,
 				CapacityBytes:   poolInfo.CapacityBytes,
 				AllocationBytes: poolInfo.AllocationBytes,
+				Autostart:       poolInfo.Autostart,
 			}
 			if err := s.db.Create(&newPool).Error; err != nil {
 				log.Verbosef("Error creating storage pool %s: %v", poolInfo.Name, err)
@@ -4382,6 +5025,9 @@ func (s *HostService) syncHostStoragePools(hostID string) (bool, error) {
 			if existing[0].State != poolState {
 				updates["state"] = poolState
 			}
+			if existing[0].Autostart != poolInfo.Autostart {
+				updates["autostart"] = poolInfo.Autostart
+			}
 			if len(updates) > 0 {
 				if err := s.db.Model(&existing[0]).Updates(updates).Error; err != nil {
 					log.Verbosef("Error updating storage pool %s: %v", poolInfo.Name, err)
@@ -4416,7 +5062,7 @@ func (s *HostService) syncHostStoragePools(hostID string) (bool, error) {
 func (s *HostService) GetVMStats(hostID, vmName string) (*ProcessedVMStats, error) {
 
 	// Check if host is connected
-	if _, err := s.connector.GetConnection(hostID); err != nil {
+	if !s.connector.IsConnected(hostID) {
 		return nil, fmt.Errorf("host %s is not connected", hostID)
 	}
 
@@ -4821,11 +5467,23 @@ func (s *HostService) calculateVMUptime(hostID, vmName string) int64 {
 
 // --- VM Actions ---
 
+// findVM loads the VM record for a domain on a host.
+func (s *HostService) findVM(hostID, vmName string) (*storage.VirtualMachine, error) {
+	var vm storage.VirtualMachine
+	if err := s.db.Where("host_id = ? AND name = ?", hostID, vmName).First(&vm).Error; err != nil {
+		return nil, fmt.Errorf("vm %s not found on host %s: %w", vmName, hostID, err)
+	}
+	return &vm, nil
+}
+
 func (s *HostService) performVMAction(hostID, vmName string, taskState storage.VMTaskState, action func() error, intendedState ...storage.VMState) error {
 	// Check if host is connected
-	if _, err := s.connector.GetConnection(hostID); err != nil {
+	if !s.connector.IsConnected(hostID) {
 		return fmt.Errorf("host %s is not connected", hostID)
 	}
+	if err := s.ensureNotTemplate(hostID, vmName); err != nil {
+		return err
+	}
 
 	// Set task state
 	if err := s.db.Model(&storage.VirtualMachine{}).Where("host_id = ? AND name = ?", hostID, vmName).Update("task_state", taskState).Error; err != nil {
@@ -4866,6 +5524,9 @@ func (s *HostService) performVMAction(hostID, vmName string, taskState storage.V
 }
 
 func (s *HostService) StartVM(hostID, vmName string) error {
+	if err := s.ensureNotLinkedCloneBase(hostID, vmName, "started"); err != nil {
+		return err
+	}
 	return s.performVMAction(hostID, vmName, storage.TaskStateStarting, func() error {
 		// If a rebuild is needed, this power cycle will apply the changes.
 		// So, we can clear the flag.
@@ -4908,13 +5569,53 @@ func (s *HostService) ForceResetVM(hostID, vmName string) error {
 	}, storage.StateActive)
 }
 
+// PauseVM freezes a running VM's vCPUs. Its memory stays allocated on the
+// host until it is resumed or stopped.
+func (s *HostService) PauseVM(hostID, vmName string) error {
+	return s.performVMAction(hostID, vmName, storage.TaskStatePausing, func() error {
+		return s.connector.SuspendDomain(hostID, vmName)
+	}, storage.StatePaused)
+}
+
+func (s *HostService) ResumeVM(hostID, vmName string) error {
+	return s.performVMAction(hostID, vmName, storage.TaskStateUnpausing, func() error {
+		return s.connector.ResumeDomain(hostID, vmName)
+	}, storage.StateActive)
+}
+
+// ManagedSaveVM saves a VM's memory to disk and stops it, freeing its host
+// memory. Starting or restoring the VM picks up where it left off.
+func (s *HostService) ManagedSaveVM(hostID, vmName string) error {
+	return s.performVMAction(hostID, vmName, storage.TaskStateSuspending, func() error {
+		return s.connector.ManagedSaveDomain(hostID, vmName)
+	}, storage.StateSuspended)
+}
+
+// RestoreVM starts a VM from its managed save image. Unlike StartVM it
+// refuses to cold boot a VM that has no image.
+func (s *HostService) RestoreVM(hostID, vmName string) error {
+	if err := s.ensureNotLinkedCloneBase(hostID, vmName, "started"); err != nil {
+		return err
+	}
+	return s.performVMAction(hostID, vmName, storage.TaskStateResuming, func() error {
+		info, err := s.connector.GetDomainInfo(hostID, vmName)
+		if err != nil {
+			return err
+		}
+		if !info.HasManagedSave {
+			return fmt.Errorf("invalid restore: vm %s has no managed save image", vmName)
+		}
+		return s.connector.StartDomain(hostID, vmName)
+	}, storage.StateActive)
+}
+
 // --- Drift and Sync Actions ---
 
 // SyncVMFromLibvirt forces an update from the live libvirt state into the database,
 // overwriting the DB record and clearing any drift status.
 func (s *HostService) SyncVMFromLibvirt(hostID, vmName string) error {
 	// Check if host is connected
-	if _, err := s.connector.GetConnection(hostID); err != nil {
+	if !s.connector.IsConnected(hostID) {
 		return fmt.Errorf("host %s is not connected", hostID)
 	}
 
@@ -4943,13 +5644,14 @@ func (s *HostService) SyncVMFromLibvirt(hostID, vmName string) error {
 
 	// Update the main VM record
 	updates := map[string]interface{}{
-		"Name":         vmInfo.Name,
-		"VCPUCount":    vmInfo.Vcpu,
-		"MemoryBytes":  vmInfo.MaxMem * 1024,
-		"LibvirtState": mapLibvirtStateToVMState(vmInfo.State), // Update observed state
-		"SyncStatus":   storage.StatusSynced,
-		"DriftDetails": "",
-		"NeedsRebuild": false,
+		"Name":           vmInfo.Name,
+		"VCPUCount":      vmInfo.Vcpu,
+		"MemoryBytes":    vmInfo.MaxMem * 1024,
+		"LibvirtState":   observedVMState(vmInfo), // Update observed state
+		"HasManagedSave": vmInfo.HasManagedSave,
+		"SyncStatus":     storage.StatusSynced,
+		"DriftDetails":   "",
+		"NeedsRebuild":   false,
 	}
 	if hardwareInfo != nil {
 		if hardwareInfo.OSType != "" {
@@ -4979,27 +5681,62 @@ func (s *HostService) SyncVMFromLibvirt(hostID, vmName string) error {
 	if err := tx.Commit().Error; err != nil {
 		return err
 	}
+	s.refreshVMSecurityGroupSources(vmToUpdate.ID)
 
 	s.broadcastVMsChanged(hostID)
 	return nil
 }
 
-// RebuildVMFromDB flags a VM as needing a rebuild. The actual rebuild would
-// happen on the next power cycle or via a more complex process.
-func (s *HostService) RebuildVMFromDB(hostID, vmName string) error {
-	log.Infof("Flagging VM %s for rebuild; changes will be applied on next power cycle.", vmName)
-	if err := s.db.Model(&storage.VirtualMachine{}).Where("host_id = ? AND name = ?", hostID, vmName).Update("needs_rebuild", true).Error; err != nil {
-		return fmt.Errorf("failed to set needs_rebuild flag for %s: %w", vmName, err)
+// definedDomainSpec is the definition to redefine a VM's existing domain
+// with. The VM row only records the vCPUs in use, so the hotplug headroom
+// the domain already has is kept.
+func (s *HostService) definedDomainSpec(vm storage.VirtualMachine) (libvirt.DomainSpec, error) {
+	spec, err := s.domainSpecFromDB(vm)
+	if err != nil {
+		return libvirt.DomainSpec{}, err
+	}
+	if details, err := s.connector.GetDomainCPUDetails(vm.HostID, vm.Name); err == nil && uint(details.MaxVcpus) > spec.VCPUs {
+		spec.MaxVCPUs = uint(details.MaxVcpus)
 	}
+	return spec, nil
+}
 
-	// In a real implementation, we would generate an XML from our DB state and
-	// redefine the domain in libvirt. For now, we just set the flag.
-	// Example:
-	// xml, err := s.generateXMLFromDB(hostID, vmName)
-	// if err != nil { return err }
-	// err = s.connector.RedefineDomain(hostID, xml)
-	// if err != nil { return err }
+// RebuildVMFromDB redefines a VM's domain from its database records,
+// discarding changes made to the domain outside Virtumancer. A running VM
+// keeps its old configuration until it is next powered off, so it stays
+// flagged as needing a rebuild until then.
+func (s *HostService) RebuildVMFromDB(hostID, vmName string) error {
+	vm, err := s.findVM(hostID, vmName)
+	if err != nil {
+		return err
+	}
+	if !s.connector.IsConnected(hostID) {
+		return fmt.Errorf("host %s is disconnected", hostID)
+	}
+	spec, err := s.definedDomainSpec(*vm)
+	if err != nil {
+		return err
+	}
+	domainXML, err := spec.XML()
+	if err != nil {
+		return err
+	}
+	if _, err := s.connector.DefineAndCreateDomain(hostID, domainXML); err != nil {
+		return err
+	}
 
+	running := false
+	if info, err := s.connector.GetDomainInfo(hostID, vmName); err == nil {
+		running = info.State != golibvirt.DomainShutoff && info.State != golibvirt.DomainCrashed
+	}
+	if err := s.db.Model(&storage.VirtualMachine{}).Where("id = ?", vm.ID).Updates(map[string]interface{}{
+		"needs_rebuild": running,
+		"sync_status":   storage.StatusSynced,
+		"drift_details": "",
+	}).Error; err != nil {
+		return fmt.Errorf("failed to update vm %s after rebuild: %w", vmName, err)
+	}
+	log.Infof("Rebuilt domain of VM %s on host %s from the database", vmName, hostID)
 	s.broadcastVMsChanged(hostID)
 	return nil
 }
@@ -5067,7 +5804,7 @@ func (m *MonitoringManager) Subscribe(client *ws.Client, hostID, vmName string)
 	sub, exists := m.subscriptions[key]
 	if !exists {
 		// Check if host is connected before starting monitoring
-		if _, err := m.service.connector.GetConnection(hostID); err != nil {
+		if !m.service.connector.IsConnected(hostID) {
 			log.Verbosef("Skipping VM monitoring for %s: host not connected", key)
 			// Don't start monitoring if host is not connected
 			return
@@ -5079,7 +5816,7 @@ func (m *MonitoringManager) Subscribe(client *ws.Client, hostID, vmName string)
 			stop:    make(chan struct{}),
 		}
 		m.subscriptions[key] = sub
-		go m.pollVmStats(hostID, vmName, sub)
+		go m.pollVmStats(hostID, vmName, sub, sub.stop)
 	}
 	sub.clients[client] = true
 	// If we already have cached stats for this VM, send them immediately so the
@@ -5166,6 +5903,37 @@ func (m *MonitoringManager) StopHostMonitoring(hostID string) {
 	}
 }
 
+// PauseHostMonitoring stops polling for all VMs on a host but keeps their
+// subscribers, so ResumeHostMonitoring can pick up where it left off once the
+// host is reachable again.
+func (m *MonitoringManager) PauseHostMonitoring(hostID string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for key, sub := range m.subscriptions {
+		if strings.HasPrefix(key, hostID+":") {
+			log.Verbosef("Pausing VM monitoring for %s while host is unreachable", key)
+			close(sub.stop)
+			sub.stop = make(chan struct{})
+		}
+	}
+}
+
+// ResumeHostMonitoring restarts polling for every VM subscription on a host.
+func (m *MonitoringManager) ResumeHostMonitoring(hostID string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for key, sub := range m.subscriptions {
+		if name, ok := strings.CutPrefix(key, hostID+":"); ok {
+			log.Verbosef("Resuming VM monitoring for %s", key)
+			close(sub.stop)
+			sub.stop = make(chan struct{})
+			go m.pollVmStats(hostID, name, sub, sub.stop)
+		}
+	}
+}
+
 func (m *MonitoringManager) GetLastKnownStats(hostID, vmName string) *libvirt.VMStats {
 	m.mu.Lock()
 	defer m.mu.Unlock()
@@ -5179,7 +5947,7 @@ func (m *MonitoringManager) GetLastKnownStats(hostID, vmName string) *libvirt.VM
 	return nil
 }
 
-func (m *MonitoringManager) pollVmStats(hostID, vmName string, sub *VmSubscription) {
+func (m *MonitoringManager) pollVmStats(hostID, vmName string, sub *VmSubscription, stop <-chan struct{}) {
 	// Perform an immediate fetch to provide instant feedback, then poll on a ticker.
 	log.Debugf("pollVmStats: immediate fetch for %s:%s", hostID, vmName)
 	stats, err := m.service.connector.GetDomainStats(hostID, vmName)
@@ -5257,7 +6025,7 @@ func (m *MonitoringManager) pollVmStats(hostID, vmName string, sub *VmSubscripti
 				m.mu.Unlock()
 				return
 			}
-		case <-sub.stop:
+		case <-stop:
 			return
 		}
 	}
@@ -5272,7 +6040,7 @@ func (m *HostMonitoringManager) Subscribe(client *ws.Client, hostID string) {
 	sub, exists := m.subscriptions[hostID]
 	if !exists {
 		// Check if host is connected before starting monitoring
-		if _, err := m.service.connector.GetConnection(hostID); err != nil {
+		if !m.service.connector.IsConnected(hostID) {
 			log.Verbosef("Skipping host monitoring for %s: host not connected", hostID)
 			// Don't start monitoring if host is not connected
 			return
@@ -5284,7 +6052,7 @@ func (m *HostMonitoringManager) Subscribe(client *ws.Client, hostID string) {
 			stop:    make(chan struct{}),
 		}
 		m.subscriptions[hostID] = sub
-		go m.pollHostStats(hostID, sub)
+		go m.pollHostStats(hostID, sub, sub.stop)
 	}
 	sub.clients[client] = true
 	// If we already have cached host stats, send them immediately to the new
@@ -5345,6 +6113,31 @@ func (m *HostMonitoringManager) StopHostMonitoring(hostID string) {
 	}
 }
 
+// PauseHostMonitoring stops polling host stats but keeps the subscribers.
+func (m *HostMonitoringManager) PauseHostMonitoring(hostID string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if sub, exists := m.subscriptions[hostID]; exists {
+		log.Verbosef("Pausing host monitoring for %s while host is unreachable", hostID)
+		close(sub.stop)
+		sub.stop = make(chan struct{})
+	}
+}
+
+// ResumeHostMonitoring restarts polling for a host's existing subscribers.
+func (m *HostMonitoringManager) ResumeHostMonitoring(hostID string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if sub, exists := m.subscriptions[hostID]; exists {
+		log.Verbosef("Resuming host monitoring for %s", hostID)
+		close(sub.stop)
+		sub.stop = make(chan struct{})
+		go m.pollHostStats(hostID, sub, sub.stop)
+	}
+}
+
 // --- Dashboard Methods ---
 
 // GetDashboardStats aggregates system-wide statistics for the dashboard.
@@ -5365,7 +6158,7 @@ func (s *HostService) GetDashboardStats() (*DashboardStats, error) {
 	var totalCPUs int
 
 	for _, host := range hosts {
-		if _, err := s.connector.GetConnection(host.ID); err == nil {
+		if s.connector.IsConnected(host.ID) {
 			connectedHosts = append(connectedHosts, host)
 
 			// Get host info for resource calculations
@@ -5455,7 +6248,7 @@ func (s *HostService) GetDashboardActivity(limit int) ([]ActivityEntry, error) {
 
 	// Generate host connection activities
 	for _, host := range hosts {
-		if _, err := s.connector.GetConnection(host.ID); err == nil {
+		if s.connector.IsConnected(host.ID) {
 			activity := ActivityEntry{
 				ID:        fmt.Sprintf("host-%s-connected", host.ID),
 				Type:      "host_connect",
@@ -5471,7 +6264,7 @@ func (s *HostService) GetDashboardActivity(limit int) ([]ActivityEntry, error) {
 
 	// Generate VM activities for running VMs
 	for _, host := range hosts {
-		if _, err := s.connector.GetConnection(host.ID); err == nil {
+		if s.connector.IsConnected(host.ID) {
 			vms, err := s.GetVMsForHostFromDB(host.ID)
 			if err != nil {
 				continue
@@ -5514,7 +6307,7 @@ func (s *HostService) GetDashboardActivity(limit int) ([]ActivityEntry, error) {
 	return activities, nil
 }
 
-func (m *HostMonitoringManager) pollHostStats(hostID string, sub *HostSubscription) {
+func (m *HostMonitoringManager) pollHostStats(hostID string, sub *HostSubscription, stop <-chan struct{}) {
 	// Perform an immediate fetch so the UI receives data quickly.
 	stats, err := m.service.connector.GetHostStats(hostID)
 	if err != nil {
@@ -5545,7 +6338,7 @@ func (m *HostMonitoringManager) pollHostStats(hostID string, sub *HostSubscripti
 
 			m.service.hub.BroadcastMessage(ws.Message{Type: "host-stats-updated", Payload: ws.MessagePayload{"hostId": hostID, "stats": stats}})
 
-		case <-sub.stop:
+		case <-stop:
 			return
 		}
 	}
@@ -5685,8 +6478,8 @@ func (s *HostService) RefreshHostCapabilities(hostID string) error {
 	}
 
 	// Ensure connection exists
-	if _, err := s.connector.GetConnection(hostID); err != nil {
-		return fmt.Errorf("host %s not connected to libvirt: %w", hostID, err)
+	if !s.connector.IsConnected(hostID) {
+		return fmt.Errorf("host %s not connected to libvirt", hostID)
 	}
 
 	// Perform capability discovery
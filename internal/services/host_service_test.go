@@ -1,11 +1,38 @@
 package services
 
 import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync/atomic"
 	"testing"
+	"time"
+	"unicode/utf16"
 
+	"github.com/capsali/virtumancer/internal/libvirt"
 	"github.com/capsali/virtumancer/internal/storage"
+	"github.com/capsali/virtumancer/internal/ws"
+	golibvirt "github.com/digitalocean/go-libvirt"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
+	"golang.org/x/crypto/ssh"
 	"gorm.io/driver/sqlite"
 	"gorm.io/gorm"
 )
@@ -139,3 +166,2170 @@ func TestManualConnect_ResetsAutoReconnectDisabled(t *testing.T) {
 	assert.Equal(t, "CONNECTED", updatedHost.State)
 	assert.False(t, updatedHost.AutoReconnectDisabled)
 }
+
+const fakeHostID = "fake-host"
+
+// setupFakeHostService wires a HostService to an in-memory hypervisor with a
+// connected host that has a "default" pool and network.
+func setupFakeHostService(t *testing.T) (*HostService, *libvirt.FakeHypervisor, *gorm.DB) {
+	db, err := storage.InitDB(filepath.Join(t.TempDir(), "test.db"))
+	require.NoError(t, err)
+
+	hub := ws.NewHub()
+	go hub.Run()
+
+	fake := libvirt.NewFakeHypervisor()
+	fake.AddStoragePool(fakeHostID, libvirt.StoragePoolInfo{Name: "default", Path: "/var/lib/libvirt/images", CapacityBytes: 100 << 30})
+	fake.AddNetwork(fakeHostID, "default", "virbr0")
+
+	host := storage.Host{Base: storage.Base{ID: fakeHostID}, URI: "qemu:///system", State: string(storage.HostStateConnected)}
+	require.NoError(t, db.Create(&host).Error)
+	require.NoError(t, fake.AddHost(host))
+
+	return NewHostService(db, fake, hub), fake, db
+}
+
+// basicDomainXML renders a domain with one disk on the default network, as
+// a VM defined outside Virtumancer might look.
+func basicDomainXML(t *testing.T, name, uuid string, vcpus uint, memoryKB uint64) string {
+	spec := libvirt.DomainSpec{
+		Name:       name,
+		UUID:       uuid,
+		VCPUs:      vcpus,
+		MemoryKB:   memoryKB,
+		OS:         libvirt.DomainOS{Boot: []string{"hd"}},
+		Disks:      []libvirt.DiskDevice{{Path: "/var/lib/libvirt/images/" + name + ".qcow2", Format: "qcow2", Bus: "virtio", Target: "vda"}},
+		Interfaces: []libvirt.InterfaceDevice{{Type: "network", Source: "default", Model: "virtio", MAC: "52:54:00:00:00:01"}},
+		Graphics:   []libvirt.DomainGraphics{{Type: "vnc"}},
+	}
+	xml, err := spec.XML()
+	require.NoError(t, err)
+	return xml
+}
+
+func TestCreateVM_DefinesDomainAndPersistsRecords(t *testing.T) {
+	svc, fake, db := setupFakeHostService(t)
+
+	vm, err := svc.CreateVM(fakeHostID, storage.CreateVMRequest{
+		Name:        "web-01",
+		VCPUCount:   2,
+		MemoryBytes: 2 << 30,
+		DiskSizeGB:  10,
+	})
+	require.NoError(t, err)
+
+	state, ok := fake.DomainState(fakeHostID, "web-01")
+	require.True(t, ok)
+	assert.Equal(t, golibvirt.DomainShutoff, state)
+	assert.True(t, fake.HasVolume(fakeHostID, "default", "web-01.qcow2"))
+
+	var stored storage.VirtualMachine
+	require.NoError(t, db.Where("domain_uuid = ?", vm.DomainUUID).First(&stored).Error)
+	assert.Equal(t, storage.StateStopped, stored.State)
+
+	var attachment storage.DiskAttachment
+	require.NoError(t, db.Preload("Disk").Where("vm_uuid = ?", vm.ID).First(&attachment).Error)
+	assert.Equal(t, "vda", attachment.DeviceName)
+	assert.Equal(t, "/var/lib/libvirt/images/web-01.qcow2", attachment.Disk.Path)
+}
+
+func TestCreateVM_DefineFailureLeavesNoVM(t *testing.T) {
+	svc, fake, db := setupFakeHostService(t)
+	fake.InjectError("DefineAndCreateDomain", fmt.Errorf("boom"))
+
+	_, err := svc.CreateVM(fakeHostID, storage.CreateVMRequest{Name: "broken", VCPUCount: 1, MemoryBytes: 1 << 30})
+	require.Error(t, err)
+
+	var count int64
+	db.Model(&storage.VirtualMachine{}).Where("name = ?", "broken").Count(&count)
+	assert.Zero(t, count)
+	_, ok := fake.DomainState(fakeHostID, "broken")
+	assert.False(t, ok)
+}
+
+func TestImportVM_IngestsDomainHardware(t *testing.T) {
+	svc, fake, db := setupFakeHostService(t)
+
+	domainXML := basicDomainXML(t, "legacy", "6f1c1b8e-0d5b-4c43-9d6e-0a4b2f8a1c11", 4, 4<<20)
+	require.NoError(t, fake.AddDomain(fakeHostID, domainXML, golibvirt.DomainRunning))
+
+	require.NoError(t, svc.ImportVM(fakeHostID, "legacy"))
+
+	var vm storage.VirtualMachine
+	require.NoError(t, db.Where("host_id = ? AND name = ?", fakeHostID, "legacy").First(&vm).Error)
+	assert.Equal(t, "6f1c1b8e-0d5b-4c43-9d6e-0a4b2f8a1c11", vm.DomainUUID)
+	assert.Equal(t, uint(4), vm.VCPUCount)
+	assert.Equal(t, storage.StateActive, vm.LibvirtState)
+
+	var attachments []storage.DiskAttachment
+	require.NoError(t, db.Where("vm_uuid = ?", vm.ID).Find(&attachments).Error)
+	require.Len(t, attachments, 1)
+	assert.Equal(t, "vda", attachments[0].DeviceName)
+}
+
+func TestDetectDrift_PicksUpOutOfBandStateChange(t *testing.T) {
+	svc, fake, db := setupFakeHostService(t)
+
+	_, err := svc.CreateVM(fakeHostID, storage.CreateVMRequest{Name: "drifter", VCPUCount: 1, MemoryBytes: 1 << 30})
+	require.NoError(t, err)
+
+	require.NoError(t, fake.SetDomainState(fakeHostID, "drifter", golibvirt.DomainRunning))
+	changed, err := svc.detectDriftOrIngestVM(fakeHostID, "drifter", false)
+	require.NoError(t, err)
+	assert.True(t, changed)
+
+	var vm storage.VirtualMachine
+	require.NoError(t, db.Where("name = ?", "drifter").First(&vm).Error)
+	assert.Equal(t, storage.StateActive, vm.LibvirtState)
+}
+
+func TestStartAndForceOffVM_TransitionDomain(t *testing.T) {
+	svc, fake, db := setupFakeHostService(t)
+
+	_, err := svc.CreateVM(fakeHostID, storage.CreateVMRequest{Name: "cycler", VCPUCount: 1, MemoryBytes: 1 << 30})
+	require.NoError(t, err)
+
+	require.NoError(t, svc.StartVM(fakeHostID, "cycler"))
+	state, _ := fake.DomainState(fakeHostID, "cycler")
+	assert.Equal(t, golibvirt.DomainRunning, state)
+	assert.Error(t, svc.StartVM(fakeHostID, "cycler"), "starting a running domain should fail")
+
+	require.NoError(t, svc.ForceOffVM(fakeHostID, "cycler"))
+	state, _ = fake.DomainState(fakeHostID, "cycler")
+	assert.Equal(t, golibvirt.DomainShutoff, state)
+
+	var vm storage.VirtualMachine
+	require.NoError(t, db.Where("name = ?", "cycler").First(&vm).Error)
+	assert.Equal(t, storage.StateStopped, vm.State)
+	assert.Empty(t, vm.TaskState)
+}
+
+func TestDomainEvents_UpdateStateWithoutPolling(t *testing.T) {
+	svc, fake, db := setupFakeHostService(t)
+
+	_, err := svc.CreateVM(fakeHostID, storage.CreateVMRequest{Name: "evented", VCPUCount: 1, MemoryBytes: 1 << 30})
+	require.NoError(t, err)
+
+	require.True(t, svc.startVMEventListener(fakeHostID))
+	t.Cleanup(func() { svc.stopVMEventListener(fakeHostID) })
+
+	// Start the domain out of band; with no poller running only the
+	// lifecycle event can report it.
+	require.NoError(t, fake.SetDomainState(fakeHostID, "evented", golibvirt.DomainRunning))
+	require.Eventually(t, func() bool {
+		var vm storage.VirtualMachine
+		return db.Where("name = ?", "evented").First(&vm).Error == nil && vm.LibvirtState == storage.StateActive
+	}, 2*time.Second, 10*time.Millisecond)
+}
+
+func TestDomainEvents_DefinedDomainIsDiscovered(t *testing.T) {
+	svc, fake, db := setupFakeHostService(t)
+
+	require.True(t, svc.startVMEventListener(fakeHostID))
+	t.Cleanup(func() { svc.stopVMEventListener(fakeHostID) })
+
+	xml := basicDomainXML(t, "outsider", "", 1, 1<<20)
+	_, err := fake.DefineAndCreateDomain(fakeHostID, xml)
+	require.NoError(t, err)
+
+	require.Eventually(t, func() bool {
+		var count int64
+		db.Model(&storage.DiscoveredVM{}).Where("host_id = ? AND name = ?", fakeHostID, "outsider").Count(&count)
+		return count == 1
+	}, 2*time.Second, 10*time.Millisecond)
+}
+
+func TestSubscriptionFailureFallsBackToPolling(t *testing.T) {
+	svc, fake, _ := setupFakeHostService(t)
+
+	fake.InjectError("SubscribeDomainEvents", fmt.Errorf("unsupported"))
+	assert.False(t, svc.startVMEventListener(fakeHostID))
+	_, exists := svc.vmEventListeners.Load(fakeHostID)
+	assert.False(t, exists)
+}
+
+func TestConnectionLoss_ReconnectsWithBackoff(t *testing.T) {
+	svc, fake, db := setupFakeHostService(t)
+	svc.reconnectBaseDelay = 10 * time.Millisecond
+	svc.watchHostConnection(fakeHostID)
+	t.Cleanup(func() { svc.stopHostWatch(fakeHostID) })
+
+	// The first reconnect attempt fails; the second should succeed.
+	fake.InjectError("AddHost", fmt.Errorf("connection refused"))
+	fake.DropConnection(fakeHostID)
+
+	require.Eventually(t, func() bool {
+		var host storage.Host
+		return fake.IsConnected(fakeHostID) &&
+			db.Where("id = ?", fakeHostID).First(&host).Error == nil &&
+			host.State == string(storage.HostStateConnected)
+	}, 2*time.Second, 10*time.Millisecond)
+
+	// The new connection is watched too.
+	_, watched := svc.hostWatchers.Load(fakeHostID)
+	assert.True(t, watched)
+}
+
+func TestConnectionLoss_RespectsAutoReconnectDisabled(t *testing.T) {
+	svc, fake, db := setupFakeHostService(t)
+	svc.reconnectBaseDelay = 10 * time.Millisecond
+	require.NoError(t, db.Model(&storage.Host{}).Where("id = ?", fakeHostID).Update("auto_reconnect_disabled", true).Error)
+	svc.watchHostConnection(fakeHostID)
+	t.Cleanup(func() { svc.stopHostWatch(fakeHostID) })
+
+	fake.DropConnection(fakeHostID)
+
+	require.Eventually(t, func() bool {
+		var host storage.Host
+		return db.Where("id = ?", fakeHostID).First(&host).Error == nil && host.State == string(storage.HostStateError)
+	}, 2*time.Second, 10*time.Millisecond)
+	time.Sleep(50 * time.Millisecond)
+	assert.False(t, fake.IsConnected(fakeHostID))
+}
+
+func TestDisconnectHost_IsNotTreatedAsConnectionLoss(t *testing.T) {
+	svc, fake, db := setupFakeHostService(t)
+	svc.reconnectBaseDelay = 10 * time.Millisecond
+	svc.watchHostConnection(fakeHostID)
+
+	require.NoError(t, svc.DisconnectHost(fakeHostID, false))
+	time.Sleep(50 * time.Millisecond)
+
+	assert.False(t, fake.IsConnected(fakeHostID))
+	var host storage.Host
+	require.NoError(t, db.Where("id = ?", fakeHostID).First(&host).Error)
+	assert.Equal(t, string(storage.HostStateDisconnected), host.State)
+}
+
+func newTestHostKey(t *testing.T) ssh.PublicKey {
+	pub, _, err := ed25519.GenerateKey(rand.Reader)
+	require.NoError(t, err)
+	key, err := ssh.NewPublicKey(pub)
+	require.NoError(t, err)
+	return key
+}
+
+func TestSSHHostKeys_PinnedOnFirstUseAndRetrusted(t *testing.T) {
+	svc, fake, db := setupFakeHostService(t)
+	const hostID = "ssh-host"
+	require.NoError(t, db.Create(&storage.Host{Base: storage.Base{ID: hostID}, URI: "qemu+ssh://root@kvm1.example.com/system"}).Error)
+	t.Cleanup(func() { svc.stopHostWatch(hostID) })
+
+	original := newTestHostKey(t)
+	fake.SetSSHHostKey(hostID, original)
+	require.NoError(t, svc.EnsureHostConnected(hostID))
+
+	var host storage.Host
+	require.NoError(t, db.Where("id = ?", hostID).First(&host).Error)
+	fingerprints, err := libvirt.PinnedHostKeyFingerprints(host.SSHHostKeys)
+	require.NoError(t, err)
+	assert.Equal(t, map[string]string{"kvm1.example.com": ssh.FingerprintSHA256(original)}, fingerprints)
+
+	// A different key on reconnect is refused.
+	require.NoError(t, svc.DisconnectHost(hostID, false))
+	rotated := newTestHostKey(t)
+	fake.SetSSHHostKey(hostID, rotated)
+	err = svc.EnsureHostConnected(hostID)
+	var mismatch *libvirt.HostKeyMismatchError
+	require.True(t, errors.As(err, &mismatch), "expected host key mismatch, got %v", err)
+	assert.False(t, fake.IsConnected(hostID))
+
+	// Re-trusting pins the new key.
+	updated, err := svc.RetrustHostKeys(hostID)
+	require.NoError(t, err)
+	assert.True(t, fake.IsConnected(hostID))
+	fingerprints, err = libvirt.PinnedHostKeyFingerprints(updated.SSHHostKeys)
+	require.NoError(t, err)
+	assert.Equal(t, map[string]string{"kvm1.example.com": ssh.FingerprintSHA256(rotated)}, fingerprints)
+}
+
+func TestEncryptSSHPrivateKey(t *testing.T) {
+	key := make([]byte, 32)
+	_, err := rand.Read(key)
+	require.NoError(t, err)
+	require.NoError(t, storage.SetSecretKey(key))
+
+	_, priv, err := ed25519.GenerateKey(rand.Reader)
+	require.NoError(t, err)
+	block, err := ssh.MarshalPrivateKey(priv, "")
+	require.NoError(t, err)
+	pemKey := string(pem.EncodeToMemory(block))
+
+	encrypted, err := EncryptSSHPrivateKey(pemKey)
+	require.NoError(t, err)
+	assert.NotContains(t, encrypted, "PRIVATE KEY")
+	decrypted, err := storage.DecryptSecret(encrypted)
+	require.NoError(t, err)
+	assert.Equal(t, pemKey, decrypted)
+
+	// Passphrase protected keys cannot be used unattended.
+	block, err = ssh.MarshalPrivateKeyWithPassphrase(priv, "", []byte("secret"))
+	require.NoError(t, err)
+	_, err = EncryptSSHPrivateKey(string(pem.EncodeToMemory(block)))
+	assert.ErrorContains(t, err, "passphrase")
+}
+
+// testCA is a throwaway certificate authority for TLS connection tests.
+type testCA struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+	pem  []byte
+}
+
+func newTestCA(t *testing.T) *testCA {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "test CA"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	require.NoError(t, err)
+	cert, err := x509.ParseCertificate(der)
+	require.NoError(t, err)
+	return &testCA{cert: cert, key: key, pem: pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})}
+}
+
+// issue signs a leaf certificate valid for the given IPs and DNS names and
+// returns it with its key, both PEM encoded.
+func (ca *testCA) issue(t *testing.T, ips []net.IP, names []string) (certPEM, keyPEM []byte) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: "leaf"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		IPAddresses:  ips,
+		DNSNames:     names,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, ca.cert, &key.PublicKey, ca.key)
+	require.NoError(t, err)
+	keyDER, err := x509.MarshalPKCS8PrivateKey(key)
+	require.NoError(t, err)
+	return pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: keyDER})
+}
+
+// startTLSServer accepts connections and completes the handshake with the
+// given certificate. It returns the listen address.
+func startTLSServer(t *testing.T, certPEM, keyPEM []byte) string {
+	pair, err := tls.X509KeyPair(certPEM, keyPEM)
+	require.NoError(t, err)
+	ln, err := tls.Listen("tcp", "127.0.0.1:0", &tls.Config{Certificates: []tls.Certificate{pair}})
+	require.NoError(t, err)
+	t.Cleanup(func() { ln.Close() })
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			conn.(*tls.Conn).Handshake()
+			conn.Close()
+		}
+	}()
+	return ln.Addr().String()
+}
+
+func TestTLSConnect_ReportsFailedCertificateCheck(t *testing.T) {
+	ca := newTestCA(t)
+	localhost := []net.IP{net.ParseIP("127.0.0.1")}
+	clientCert, clientKey := ca.issue(t, nil, []string{"client"})
+
+	// pkipath points at an empty directory so the libvirt defaults under
+	// /etc/pki never leak into the test.
+	emptyPKI := t.TempDir()
+	host := func(addr string) storage.Host {
+		return storage.Host{
+			Base:          storage.Base{ID: "tls-host"},
+			URI:           fmt.Sprintf("qemu+tls://%s/system?pkipath=%s", addr, emptyPKI),
+			TLSCACert:     string(ca.pem),
+			TLSClientCert: string(clientCert),
+		}
+	}
+	clientKeyPath := filepath.Join(t.TempDir(), "clientkey.pem")
+	require.NoError(t, os.WriteFile(clientKeyPath, clientKey, 0600))
+
+	t.Run("untrusted CA", func(t *testing.T) {
+		otherCert, otherKey := newTestCA(t).issue(t, localhost, nil)
+		h := host(startTLSServer(t, otherCert, otherKey))
+		h.TLSClientKeyPath = clientKeyPath
+		err := libvirt.NewConnector().AddHost(h)
+		assert.ErrorContains(t, err, "TLS server certificate check failed")
+		assert.ErrorContains(t, err, "not signed by the configured CA")
+	})
+
+	t.Run("host name mismatch", func(t *testing.T) {
+		serverCert, serverKey := ca.issue(t, nil, []string{"kvm1.example.com"})
+		h := host(startTLSServer(t, serverCert, serverKey))
+		h.TLSClientKeyPath = clientKeyPath
+		err := libvirt.NewConnector().AddHost(h)
+		assert.ErrorContains(t, err, `not valid for host name "127.0.0.1"`)
+	})
+
+	t.Run("missing CA", func(t *testing.T) {
+		h := host("127.0.0.1:1")
+		h.TLSCACert = ""
+		h.TLSClientKeyPath = clientKeyPath
+		err := libvirt.NewConnector().AddHost(h)
+		assert.ErrorContains(t, err, "TLS CA certificate check failed")
+	})
+
+	t.Run("mismatched client key", func(t *testing.T) {
+		_, otherKey := ca.issue(t, nil, []string{"client"})
+		otherKeyPath := filepath.Join(t.TempDir(), "clientkey.pem")
+		require.NoError(t, os.WriteFile(otherKeyPath, otherKey, 0600))
+		h := host("127.0.0.1:1")
+		h.TLSClientKeyPath = otherKeyPath
+		err := libvirt.NewConnector().AddHost(h)
+		assert.ErrorContains(t, err, "do not form a valid key pair")
+	})
+
+	t.Run("client key without certificate", func(t *testing.T) {
+		h := host("127.0.0.1:1")
+		h.TLSClientCert = ""
+		h.TLSClientKeyPath = clientKeyPath
+		err := libvirt.NewConnector().AddHost(h)
+		assert.ErrorContains(t, err, "has no matching certificate")
+	})
+}
+
+// listenUnix accepts and immediately closes connections on a unix socket,
+// counting how many arrived.
+func listenUnix(t *testing.T, path string) *atomic.Int32 {
+	require.NoError(t, os.MkdirAll(filepath.Dir(path), 0700))
+	ln, err := net.Listen("unix", path)
+	require.NoError(t, err)
+	t.Cleanup(func() { ln.Close() })
+	var accepted atomic.Int32
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			accepted.Add(1)
+			conn.Close()
+		}
+	}()
+	return &accepted
+}
+
+func TestLocalURI_SelectsDaemonSocket(t *testing.T) {
+	runtimeDir := t.TempDir()
+	t.Setenv("XDG_RUNTIME_DIR", runtimeDir)
+	monolithic := listenUnix(t, filepath.Join(runtimeDir, "libvirt", "libvirt-sock"))
+
+	connect := func(uri string) error {
+		return libvirt.NewConnector().AddHost(storage.Host{Base: storage.Base{ID: "local"}, URI: uri})
+	}
+
+	// The listener hangs up before answering, so the RPC handshake fails, but
+	// only after the socket was reached.
+	err := connect("qemu:///session")
+	require.Error(t, err)
+	assert.NotContains(t, err.Error(), "no libvirt daemon socket reachable")
+	assert.Equal(t, int32(1), monolithic.Load(), "auto mode falls back to the monolithic daemon")
+
+	err = connect("qemu:///session?mode=direct")
+	assert.ErrorContains(t, err, "virtqemud-sock")
+	assert.Equal(t, int32(1), monolithic.Load())
+
+	modular := listenUnix(t, filepath.Join(runtimeDir, "libvirt", "virtqemud-sock"))
+	require.Error(t, connect("qemu:///session"))
+	assert.Equal(t, int32(1), modular.Load(), "auto mode prefers the modular daemon")
+	assert.Equal(t, int32(1), monolithic.Load())
+
+	customPath := filepath.Join(t.TempDir(), "libvirt-sock-ro")
+	custom := listenUnix(t, customPath)
+	require.Error(t, connect("qemu+unix:///system?socket="+customPath))
+	assert.Equal(t, int32(1), custom.Load())
+
+	assert.ErrorContains(t, connect("qemu:///system?mode=bogus"), `unsupported mode "bogus"`)
+	assert.ErrorContains(t, connect("qemu+ssh://root@kvm1/other"), `unsupported libvirt URI path "/other"`)
+}
+
+func TestSnapshots_CreateRevertDeleteAndReconcile(t *testing.T) {
+	svc, fake, db := setupFakeHostService(t)
+
+	vm, err := svc.CreateVM(fakeHostID, storage.CreateVMRequest{Name: "snappy", VCPUCount: 1, MemoryBytes: 1 << 30, DiskSizeGB: 5})
+	require.NoError(t, err)
+
+	base, err := svc.CreateVMSnapshot(fakeHostID, "snappy", libvirt.SnapshotSpec{Name: "base", Description: "clean install"})
+	require.NoError(t, err)
+	assert.Equal(t, "shutoff", base.State)
+	assert.True(t, base.Current)
+
+	require.NoError(t, svc.StartVM(fakeHostID, "snappy"))
+	live, err := svc.CreateVMSnapshot(fakeHostID, "snappy", libvirt.SnapshotSpec{Name: "live"})
+	require.NoError(t, err)
+	assert.Equal(t, "base", live.Parent)
+	assert.True(t, live.HasMemory)
+
+	overlay, err := svc.CreateVMSnapshot(fakeHostID, "snappy", libvirt.SnapshotSpec{Name: "overlay", External: true, DiskOnly: true})
+	require.NoError(t, err)
+	assert.True(t, overlay.External)
+	assert.Equal(t, "disk-snapshot", overlay.State)
+
+	tree, err := svc.ListVMSnapshots(fakeHostID, "snappy")
+	require.NoError(t, err)
+	require.Len(t, tree, 3)
+	assert.Equal(t, []string{"live"}, tree[0].Children)
+	assert.Equal(t, []string{"overlay"}, tree[1].Children)
+
+	// Reverting to a shut-off snapshot stops the running domain.
+	require.NoError(t, svc.RevertVMSnapshot(fakeHostID, "snappy", "base"))
+	state, _ := fake.DomainState(fakeHostID, "snappy")
+	assert.Equal(t, golibvirt.DomainShutoff, state)
+	var current storage.VMSnapshot
+	require.NoError(t, db.Where("vm_uuid = ? AND is_current = ?", vm.ID, true).First(&current).Error)
+	assert.Equal(t, "base", current.Name)
+
+	// Deleting re-parents children onto the deleted snapshot's parent.
+	require.NoError(t, svc.DeleteVMSnapshot(fakeHostID, "snappy", "live"))
+	var overlayRow storage.VMSnapshot
+	require.NoError(t, db.Where("vm_uuid = ? AND name = ?", vm.ID, "overlay").First(&overlayRow).Error)
+	assert.Equal(t, "base", overlayRow.ParentName)
+
+	// Snapshots removed behind Virtumancer's back disappear on the next sync.
+	require.NoError(t, fake.DeleteDomainSnapshot(fakeHostID, "snappy", "overlay"))
+	tree, err = svc.ListVMSnapshots(fakeHostID, "snappy")
+	require.NoError(t, err)
+	require.Len(t, tree, 1)
+	assert.Equal(t, "base", tree[0].Name)
+
+	err = svc.RevertVMSnapshot(fakeHostID, "snappy", "missing")
+	assert.ErrorContains(t, err, "not found")
+	var stored storage.VirtualMachine
+	require.NoError(t, db.First(&stored, "id = ?", vm.ID).Error)
+	assert.Empty(t, stored.TaskState)
+}
+
+func TestMigrateVM_LiveWithStorageCopyThenOfflineBack(t *testing.T) {
+	svc, fake, db := setupFakeHostService(t)
+
+	const targetID = "fake-host-2"
+	fake.AddStoragePool(targetID, libvirt.StoragePoolInfo{Name: "default", Path: "/var/lib/libvirt/images", CapacityBytes: 100 << 30})
+	fake.AddNetwork(targetID, "default", "virbr0")
+	target := storage.Host{Base: storage.Base{ID: targetID}, URI: "qemu+tcp://host2/system", State: string(storage.HostStateConnected)}
+	require.NoError(t, db.Create(&target).Error)
+	require.NoError(t, fake.AddHost(target))
+
+	_, err := svc.syncHostStoragePools(fakeHostID)
+	require.NoError(t, err)
+	vm, err := svc.CreateVM(fakeHostID, storage.CreateVMRequest{Name: "mover", VCPUCount: 1, MemoryBytes: 1 << 30, DiskSizeGB: 5})
+	require.NoError(t, err)
+	require.NoError(t, svc.StartVM(fakeHostID, "mover"))
+	volumePool := func() storage.StoragePool {
+		var vol storage.Volume
+		require.NoError(t, db.Where("name = ?", "mover.qcow2").First(&vol).Error)
+		var pool storage.StoragePool
+		require.NoError(t, db.Where("id = ?", vol.StoragePoolID).First(&pool).Error)
+		return pool
+	}
+	require.Equal(t, fakeHostID, volumePool().HostID)
+
+	// Without shared storage the disks have to be copied.
+	_, err = svc.MigrateVM(fakeHostID, "mover", MigrationRequest{TargetHostID: targetID})
+	require.ErrorContains(t, err, "Cannot access storage file")
+	var stored storage.VirtualMachine
+	require.NoError(t, db.First(&stored, "id = ?", vm.ID).Error)
+	assert.Equal(t, fakeHostID, stored.HostID)
+	assert.Empty(t, stored.TaskState)
+
+	result, err := svc.MigrateVM(fakeHostID, "mover", MigrationRequest{TargetHostID: targetID, CopyStorage: true, BandwidthMiBps: 100})
+	require.NoError(t, err)
+	assert.Equal(t, MigrationModeLive, result.Mode)
+	state, ok := fake.DomainState(targetID, "mover")
+	require.True(t, ok)
+	assert.Equal(t, golibvirt.DomainRunning, state)
+	_, ok = fake.DomainState(fakeHostID, "mover")
+	assert.False(t, ok)
+	assert.True(t, fake.HasVolume(targetID, "default", "mover.qcow2"))
+
+	require.NoError(t, db.First(&stored, "id = ?", vm.ID).Error)
+	assert.Equal(t, targetID, stored.HostID)
+	assert.Empty(t, stored.TaskState)
+	var stale int64
+	db.Model(&storage.Console{}).Where("vm_uuid = ? AND host_id <> ?", vm.ID, targetID).Count(&stale)
+	assert.Zero(t, stale)
+	db.Model(&storage.PortAttachment{}).Where("vm_uuid = ? AND host_id <> ?", vm.ID, targetID).Count(&stale)
+	assert.Zero(t, stale)
+	// The copied volume belongs to the target's pool of the same name.
+	pool := volumePool()
+	assert.Equal(t, targetID, pool.HostID)
+	assert.Equal(t, "default", pool.Name)
+	var disk storage.Disk
+	require.NoError(t, db.Where("name = ?", "mover").First(&disk).Error)
+	assert.Empty(t, disk.TaskState)
+
+	// A running VM cannot be moved offline; once it is shut off, the
+	// original volume on the source serves as shared storage.
+	_, err = svc.MigrateVM(targetID, "mover", MigrationRequest{TargetHostID: fakeHostID, Offline: true})
+	require.ErrorContains(t, err, "offline")
+	require.NoError(t, svc.ForceOffVM(targetID, "mover"))
+
+	result, err = svc.MigrateVM(targetID, "mover", MigrationRequest{TargetHostID: fakeHostID})
+	require.NoError(t, err)
+	assert.Equal(t, MigrationModeOffline, result.Mode)
+	state, ok = fake.DomainState(fakeHostID, "mover")
+	require.True(t, ok)
+	assert.Equal(t, golibvirt.DomainShutoff, state)
+	_, ok = fake.DomainState(targetID, "mover")
+	assert.False(t, ok)
+	require.NoError(t, db.First(&stored, "id = ?", vm.ID).Error)
+	assert.Equal(t, fakeHostID, stored.HostID)
+}
+
+func TestCloneVM_FullLinkedAndCrossHost(t *testing.T) {
+	svc, fake, db := setupFakeHostService(t)
+
+	const targetID = "fake-host-2"
+	fake.AddStoragePool(targetID, libvirt.StoragePoolInfo{Name: "default", Path: "/var/lib/libvirt/images", CapacityBytes: 100 << 30})
+	fake.AddNetwork(targetID, "default", "virbr0")
+	target := storage.Host{Base: storage.Base{ID: targetID}, URI: "qemu+tcp://host2/system", State: string(storage.HostStateConnected)}
+	require.NoError(t, db.Create(&target).Error)
+	require.NoError(t, fake.AddHost(target))
+
+	srcDisk, err := fake.CreateStorageVolume(fakeHostID, "default", "web.qcow2", 5<<30)
+	require.NoError(t, err)
+	require.NoError(t, fake.AddDomain(fakeHostID, `<domain type='kvm'>
+  <name>web</name>
+  <uuid>6f1c9a52-3b1e-4c55-9d0a-2a7d1c0e9b11</uuid>
+  <memory unit='KiB'>1048576</memory>
+  <vcpu>2</vcpu>
+  <os><type arch='x86_64'>hvm</type></os>
+  <devices>
+    <disk type='file' device='disk'>
+      <driver name='qemu' type='qcow2'/>
+      <source file='`+srcDisk+`'/>
+      <target dev='vda' bus='virtio'/>
+    </disk>
+    <interface type='network'>
+      <mac address='52:54:00:0a:0b:0c'/>
+      <source network='default'/>
+      <model type='virtio'/>
+    </interface>
+  </devices>
+</domain>`, golibvirt.DomainShutoff))
+	require.NoError(t, svc.ImportVM(fakeHostID, "web"))
+	src, err := svc.findVM(fakeHostID, "web")
+	require.NoError(t, err)
+	srcHW, err := fake.GetDomainHardware(fakeHostID, "web")
+	require.NoError(t, err)
+	require.Len(t, srcHW.Networks, 1)
+
+	require.NoError(t, svc.StartVM(fakeHostID, "web"))
+	_, err = svc.CloneVM(fakeHostID, "web", CloneRequest{Name: "web-copy"})
+	require.ErrorContains(t, err, "shut off")
+	require.NoError(t, svc.ForceOffVM(fakeHostID, "web"))
+
+	_, err = svc.CloneVM(fakeHostID, "web", CloneRequest{Name: "web"})
+	require.ErrorContains(t, err, "already in use")
+	_, err = svc.CloneVM(fakeHostID, "web", CloneRequest{Name: "web-far", TargetHostID: targetID, Linked: true})
+	require.ErrorContains(t, err, "invalid clone")
+
+	// Full copy on the same host.
+	clone, err := svc.CloneVM(fakeHostID, "web", CloneRequest{Name: "web-copy"})
+	require.NoError(t, err)
+	assert.NotEqual(t, src.DomainUUID, clone.DomainUUID)
+	assert.Equal(t, clone.ID, clone.DomainUUID)
+	assert.Equal(t, uint(2), clone.VCPUCount)
+	assert.True(t, fake.HasVolume(fakeHostID, "default", "web-copy.qcow2"))
+	info, err := fake.GetDomainInfo(fakeHostID, "web-copy")
+	require.NoError(t, err)
+	assert.Equal(t, clone.DomainUUID, info.UUID)
+	hw, err := fake.GetDomainHardware(fakeHostID, "web-copy")
+	require.NoError(t, err)
+	require.Len(t, hw.Disks, 1)
+	assert.Equal(t, "/var/lib/libvirt/images/web-copy.qcow2", hw.Disks[0].Path)
+	require.Len(t, hw.Networks, 1)
+	assert.NotEqual(t, srcHW.Networks[0].Mac.Address, hw.Networks[0].Mac.Address)
+
+	var attachments []storage.DiskAttachment
+	require.NoError(t, db.Preload("Disk").Where("vm_uuid = ?", clone.ID).Find(&attachments).Error)
+	require.Len(t, attachments, 1)
+	assert.Equal(t, "vda", attachments[0].DeviceName)
+	assert.Equal(t, hw.Disks[0].Path, attachments[0].Disk.Path)
+	require.NotNil(t, attachments[0].Disk.VolumeID)
+	var ports []storage.PortAttachment
+	require.NoError(t, db.Where("vm_uuid = ?", clone.ID).Find(&ports).Error)
+	require.Len(t, ports, 1)
+	assert.Equal(t, hw.Networks[0].Mac.Address, ports[0].MACAddress)
+	// Cloned ports are bound to the network of the clone's host.
+	boundNetwork := func(vmUUID string) storage.Network {
+		var att storage.PortAttachment
+		require.NoError(t, db.Where("vm_uuid = ?", vmUUID).First(&att).Error)
+		var binding storage.PortBinding
+		require.NoError(t, db.Where("port_id = ?", att.PortID).First(&binding).Error)
+		var network storage.Network
+		require.NoError(t, db.Where("id = ?", binding.NetworkID).First(&network).Error)
+		return network
+	}
+	assert.Equal(t, fakeHostID, boundNetwork(clone.ID).HostID)
+	var indexed int64
+	db.Model(&storage.AttachmentIndex{}).Where("vm_uuid = ?", clone.ID).Count(&indexed)
+	assert.Equal(t, int64(2), indexed)
+	var srcDisks int64
+	db.Model(&storage.Disk{}).Where("task_state <> ''").Count(&srcDisks)
+	assert.Zero(t, srcDisks)
+
+	// Linked clone: a qcow2 overlay on the source volume.
+	linked, err := svc.CloneVM(fakeHostID, "web", CloneRequest{Name: "web-linked", Linked: true})
+	require.NoError(t, err)
+	backing, ok := fake.VolumeBacking(fakeHostID, "/var/lib/libvirt/images/web-linked.qcow2")
+	require.True(t, ok)
+	assert.Equal(t, srcDisk, backing)
+	require.NoError(t, db.Preload("Disk").Where("vm_uuid = ?", linked.ID).Find(&attachments).Error)
+	require.Len(t, attachments, 1)
+	assert.Contains(t, attachments[0].Disk.BackingJSON, srcDisk)
+	require.NotNil(t, attachments[0].Disk.BackingDiskID)
+
+	// Writes to the source would corrupt the overlay, so they are refused.
+	require.ErrorContains(t, svc.StartVM(fakeHostID, "web"), "base of linked clone web-linked")
+	_, err = svc.AttachVMDisk(fakeHostID, "web", DiskAttachRequest{SizeBytes: 1 << 30})
+	require.ErrorContains(t, err, "base of linked clone web-linked")
+	_, err = svc.CreateVMSnapshot(fakeHostID, "web", libvirt.SnapshotSpec{Name: "base"})
+	require.ErrorContains(t, err, "base of linked clone web-linked")
+	require.ErrorContains(t, svc.DeleteVM(fakeHostID, "web", VMDeleteRequest{Force: true}), "base of linked clone web-linked")
+	var srcVol storage.Volume
+	require.NoError(t, db.Where("path = ?", srcDisk).First(&srcVol).Error)
+	_, err = svc.ResizeVolume(srcVol.ID, VolumeResizeRequest{SizeBytes: 64 << 30})
+	require.ErrorContains(t, err, "base of linked clone web-linked")
+
+	// Full copy to another host.
+	far, err := svc.CloneVM(fakeHostID, "web", CloneRequest{Name: "web-far", TargetHostID: targetID})
+	require.NoError(t, err)
+	assert.Equal(t, targetID, far.HostID)
+	assert.True(t, fake.HasVolume(targetID, "default", "web-far.qcow2"))
+	state, ok := fake.DomainState(targetID, "web-far")
+	require.True(t, ok)
+	assert.Equal(t, golibvirt.DomainShutoff, state)
+	network := boundNetwork(far.ID)
+	assert.Equal(t, targetID, network.HostID)
+	assert.Equal(t, "default", network.Name)
+
+	// A failed copy leaves nothing behind.
+	fake.InjectError("CloneStorageVolume", errors.New("no space left on device"))
+	_, err = svc.CloneVM(fakeHostID, "web", CloneRequest{Name: "web-fail"})
+	require.Error(t, err)
+	_, ok = fake.DomainState(fakeHostID, "web-fail")
+	assert.False(t, ok)
+	var failed int64
+	db.Model(&storage.VirtualMachine{}).Where("name = ?", "web-fail").Count(&failed)
+	assert.Zero(t, failed)
+
+	// Deleting the overlay releases the source.
+	require.NoError(t, svc.DeleteVM(fakeHostID, "web-linked", VMDeleteRequest{DiskPolicy: DiskPolicyDelete}))
+	require.NoError(t, svc.StartVM(fakeHostID, "web"))
+}
+
+func TestVMDiskHotplug(t *testing.T) {
+	svc, fake, db := setupFakeHostService(t)
+
+	vm, err := svc.CreateVM(fakeHostID, storage.CreateVMRequest{Name: "data", VCPUCount: 1, MemoryBytes: 1 << 30, DiskSizeGB: 5})
+	require.NoError(t, err)
+	other, err := svc.CreateVM(fakeHostID, storage.CreateVMRequest{Name: "other", VCPUCount: 1, MemoryBytes: 1 << 30, DiskSizeGB: 5})
+	require.NoError(t, err)
+	require.NoError(t, svc.StartVM(fakeHostID, "data"))
+
+	att, err := svc.AttachVMDisk(fakeHostID, "data", DiskAttachRequest{SizeBytes: 1 << 30, Cache: "none"})
+	require.NoError(t, err)
+	assert.Equal(t, "vdb", att.DeviceName)
+	assert.Equal(t, "virtio", att.BusType)
+	assert.True(t, fake.HasVolume(fakeHostID, "default", "data-vdb.qcow2"))
+	disk, err := svc.findVMDisk(fakeHostID, "data", "vdb")
+	require.NoError(t, err)
+	assert.Equal(t, att.Disk.Path, disk.Path)
+	assert.Equal(t, "none", disk.Driver.Cache)
+	var indexed int64
+	db.Model(&storage.AttachmentIndex{}).Where("vm_uuid = ? AND device_type = ? AND attachment_id = ?", vm.ID, "disk", att.ID).Count(&indexed)
+	assert.Equal(t, int64(1), indexed)
+
+	var vol storage.Volume
+	require.NoError(t, db.Where("id = ?", *att.Disk.VolumeID).First(&vol).Error)
+	_, err = svc.AttachVMDisk(fakeHostID, "other", DiskAttachRequest{VolumeID: vol.ID})
+	require.ErrorContains(t, err, "in use")
+
+	// SATA disks cannot be hotplugged, and the new volume is cleaned up.
+	_, err = svc.AttachVMDisk(fakeHostID, "data", DiskAttachRequest{SizeBytes: 1 << 30, Bus: "sata"})
+	require.Error(t, err)
+	assert.False(t, fake.HasVolume(fakeHostID, "default", "data-sda.qcow2"))
+
+	_, err = svc.AttachVMDisk(fakeHostID, "data", DiskAttachRequest{SizeBytes: 1 << 30, Cache: "sometimes"})
+	require.ErrorContains(t, err, "invalid disk")
+
+	cache, readOnly := "writeback", true
+	att, err = svc.UpdateVMDisk(fakeHostID, "data", "vdb", DiskUpdateRequest{Cache: &cache, ReadOnly: &readOnly})
+	require.NoError(t, err)
+	assert.True(t, att.ReadOnly)
+	assert.Contains(t, att.Disk.DriverJSON, "writeback")
+	disk, err = svc.findVMDisk(fakeHostID, "data", "vdb")
+	require.NoError(t, err)
+	assert.Equal(t, "writeback", disk.Driver.Cache)
+	assert.True(t, disk.ReadOnly)
+
+	require.NoError(t, svc.DetachVMDisk(fakeHostID, "data", "vdb"))
+	_, err = svc.findVMDisk(fakeHostID, "data", "vdb")
+	require.ErrorContains(t, err, "not found")
+	db.Model(&storage.DiskAttachment{}).Where("vm_uuid = ? AND device_name = ?", vm.ID, "vdb").Count(&indexed)
+	assert.Zero(t, indexed)
+	db.Model(&storage.AttachmentIndex{}).Where("attachment_id = ?", att.ID).Count(&indexed)
+	assert.Zero(t, indexed)
+	assert.True(t, fake.HasVolume(fakeHostID, "default", "data-vdb.qcow2"))
+	require.ErrorContains(t, svc.DetachVMDisk(fakeHostID, "data", "vdb"), "not found")
+
+	// The freed device name can be reused straight away.
+	att, err = svc.AttachVMDisk(fakeHostID, "data", DiskAttachRequest{VolumeID: vol.ID})
+	require.NoError(t, err)
+	assert.Equal(t, "vdb", att.DeviceName)
+	require.NoError(t, svc.DetachVMDisk(fakeHostID, "data", "vdb"))
+
+	// Once detached the volume is free for another VM.
+	att, err = svc.AttachVMDisk(fakeHostID, "other", DiskAttachRequest{VolumeID: vol.ID, Bus: "sata"})
+	require.NoError(t, err)
+	assert.Equal(t, "sda", att.DeviceName)
+	assert.Equal(t, other.ID, att.VMUUID)
+}
+
+func TestVMNICHotplug(t *testing.T) {
+	svc, _, db := setupFakeHostService(t)
+
+	vm, err := svc.CreateVM(fakeHostID, storage.CreateVMRequest{Name: "web", VCPUCount: 1, MemoryBytes: 1 << 30, DiskSizeGB: 5})
+	require.NoError(t, err)
+	require.NoError(t, svc.StartVM(fakeHostID, "web"))
+
+	att, err := svc.AttachVMNIC(fakeHostID, "web", NICAttachRequest{Type: NICTypeNetwork, Source: "default", MAC: "52:54:00:AA:BB:01", VLANs: []uint{42}})
+	require.NoError(t, err)
+	assert.Equal(t, "52:54:00:aa:bb:01", att.MACAddress)
+	assert.Equal(t, "virtio", att.ModelName)
+	assert.Equal(t, "network", att.Port.SourceType)
+	assert.Equal(t, "[42]", att.Port.VlanTagsJSON)
+	nic, err := svc.findVMNIC(fakeHostID, "web", "52:54:00:aa:bb:01")
+	require.NoError(t, err)
+	assert.Equal(t, "default", nic.Source.Network)
+	require.Len(t, nic.VLAN.Tags, 1)
+	assert.Equal(t, uint(42), nic.VLAN.Tags[0].ID)
+
+	var binding storage.PortBinding
+	require.NoError(t, db.Preload("Network").Where("port_id = ?", att.PortID).First(&binding).Error)
+	assert.Equal(t, "default", binding.Network.Name)
+	var count int64
+	db.Model(&storage.AttachmentIndex{}).Where("vm_uuid = ? AND device_type = ? AND attachment_id = ?", vm.ID, "port", att.ID).Count(&count)
+	assert.Equal(t, int64(1), count)
+
+	_, err = svc.AttachVMNIC(fakeHostID, "web", NICAttachRequest{Type: NICTypeBridge, Source: "br0", MAC: "52:54:00:aa:bb:01"})
+	require.ErrorContains(t, err, "in use")
+	_, err = svc.AttachVMNIC(fakeHostID, "web", NICAttachRequest{Type: "tap", Source: "tap0"})
+	require.ErrorContains(t, err, "invalid nic")
+
+	bridged, err := svc.AttachVMNIC(fakeHostID, "web", NICAttachRequest{Type: NICTypeBridge, Source: "br0", Model: "e1000"})
+	require.NoError(t, err)
+	nic, err = svc.findVMNIC(fakeHostID, "web", bridged.MACAddress)
+	require.NoError(t, err)
+	assert.Equal(t, "br0", nic.Source.Bridge)
+	assert.Equal(t, "e1000", nic.Model.Type)
+
+	down, source, vlans := "down", "br1", []uint{}
+	bridgeType := NICTypeBridge
+	att, err = svc.UpdateVMNIC(fakeHostID, "web", "52:54:00:aa:bb:01", NICUpdateRequest{Type: &bridgeType, Source: &source, LinkState: &down, VLANs: &vlans})
+	require.NoError(t, err)
+	assert.Equal(t, "br1", att.Port.SourceRef)
+	assert.Empty(t, att.Port.VlanTagsJSON)
+	nic, err = svc.findVMNIC(fakeHostID, "web", "52:54:00:aa:bb:01")
+	require.NoError(t, err)
+	assert.Equal(t, "br1", nic.Source.Bridge)
+	assert.Equal(t, "down", nic.Link.State)
+	assert.Empty(t, nic.VLAN.Tags)
+	var bindings []storage.PortBinding
+	require.NoError(t, db.Preload("Network").Where("port_id = ?", att.PortID).Find(&bindings).Error)
+	require.Len(t, bindings, 1)
+	assert.Equal(t, "br1", bindings[0].Network.BridgeName)
+
+	require.NoError(t, svc.DetachVMNIC(fakeHostID, "web", "52:54:00:aa:bb:01"))
+	_, err = svc.findVMNIC(fakeHostID, "web", "52:54:00:aa:bb:01")
+	require.ErrorContains(t, err, "not found")
+	db.Model(&storage.PortAttachment{}).Where("id = ?", att.ID).Count(&count)
+	assert.Zero(t, count)
+	db.Model(&storage.Port{}).Where("id = ?", att.PortID).Count(&count)
+	assert.Zero(t, count)
+	db.Model(&storage.PortBinding{}).Where("port_id = ?", att.PortID).Count(&count)
+	assert.Zero(t, count)
+	db.Model(&storage.AttachmentIndex{}).Where("device_type = ? AND attachment_id = ?", "port", att.ID).Count(&count)
+	assert.Zero(t, count)
+	require.ErrorContains(t, svc.DetachVMNIC(fakeHostID, "web", "52:54:00:aa:bb:01"), "not found")
+
+	// The MAC and device name are free again once the NIC is gone.
+	att, err = svc.AttachVMNIC(fakeHostID, "web", NICAttachRequest{Type: NICTypeNetwork, Source: "default", MAC: "52:54:00:aa:bb:01"})
+	require.NoError(t, err)
+	assert.Equal(t, "52:54:00:aa:bb:01", att.MACAddress)
+	_, err = svc.findVMNIC(fakeHostID, "web", "52:54:00:aa:bb:01")
+	require.NoError(t, err)
+}
+
+func TestResizeVolume_OfflineAndLive(t *testing.T) {
+	svc, fake, db := setupFakeHostService(t)
+
+	vm, err := svc.CreateVM(fakeHostID, storage.CreateVMRequest{Name: "grow", VCPUCount: 1, MemoryBytes: 1 << 30, DiskSizeGB: 5})
+	require.NoError(t, err)
+	var vol storage.Volume
+	require.NoError(t, db.Where("name = ?", "grow.qcow2").First(&vol).Error)
+	var att storage.DiskAttachment
+	require.NoError(t, db.Where("vm_uuid = ?", vm.ID).First(&att).Error)
+	require.NoError(t, db.Create(&storage.BlockStatistics{DiskAttachmentID: att.ID, VMUUID: vm.ID, DeviceName: att.DeviceName, Capacity: 5 << 30}).Error)
+
+	_, err = svc.ResizeVolume(vol.ID, VolumeResizeRequest{SizeBytes: 4 << 30})
+	require.ErrorContains(t, err, "invalid resize")
+	_, err = svc.ResizeVolume(vol.ID, VolumeResizeRequest{SizeBytes: 200 << 30})
+	require.ErrorContains(t, err, "bytes free")
+
+	// A stopped VM's volume is resized in its pool.
+	resized, err := svc.ResizeVolume(vol.ID, VolumeResizeRequest{SizeBytes: 8 << 30})
+	require.NoError(t, err)
+	assert.Equal(t, uint64(8<<30), resized.CapacityBytes)
+	assert.Empty(t, resized.TaskState)
+	capacity, ok := fake.VolumeCapacity(fakeHostID, "default", "grow.qcow2")
+	require.True(t, ok)
+	assert.Equal(t, uint64(8<<30), capacity)
+	var disk storage.Disk
+	require.NoError(t, db.Where("id = ?", att.DiskID).First(&disk).Error)
+	assert.Equal(t, uint64(8<<30), disk.CapacityBytes)
+	var stats storage.BlockStatistics
+	require.NoError(t, db.Where("disk_attachment_id = ?", att.ID).First(&stats).Error)
+	assert.Equal(t, uint64(8<<30), stats.Capacity)
+
+	// A running VM resizes the disk itself; failures leave the volume idle.
+	require.NoError(t, svc.StartVM(fakeHostID, "grow"))
+	fake.InjectError("ResizeDomainDisk", fmt.Errorf("internal error: unable to execute QEMU command 'block_resize'"))
+	_, err = svc.ResizeVolume(vol.ID, VolumeResizeRequest{SizeBytes: 10 << 30})
+	require.Error(t, err)
+	require.NoError(t, db.Where("id = ?", vol.ID).First(&vol).Error)
+	assert.Empty(t, vol.TaskState)
+	assert.Equal(t, uint64(8<<30), vol.CapacityBytes)
+
+	resized, err = svc.ResizeVolume(vol.ID, VolumeResizeRequest{SizeBytes: 10 << 30, GrowFilesystem: true})
+	require.NoError(t, err)
+	assert.Equal(t, uint64(10<<30), resized.CapacityBytes)
+	capacity, _ = fake.VolumeCapacity(fakeHostID, "default", "grow.qcow2")
+	assert.Equal(t, uint64(10<<30), capacity)
+}
+
+func TestVolumeUploadAndDownload(t *testing.T) {
+	svc, fake, db := setupFakeHostService(t)
+
+	// A qcow2 header, two empty blocks and a block of data.
+	const mib = 1 << 20
+	image := make([]byte, 4*mib)
+	copy(image, []byte{'Q', 'F', 'I', 0xfb})
+	binary.BigEndian.PutUint64(image[24:32], 10<<30)
+	for i := 3 * mib; i < len(image); i++ {
+		image[i] = byte(i)
+	}
+	sum := sha256.Sum256(image)
+
+	vol, err := svc.CreateVolumeUpload(fakeHostID, VolumeUploadRequest{Name: "image.qcow2", SizeBytes: uint64(len(image)), SHA256: hex.EncodeToString(sum[:])})
+	require.NoError(t, err)
+	assert.Equal(t, string(storage.StorageTaskUploading), vol.TaskState)
+	assert.NotEmpty(t, vol.StoragePoolID)
+	assert.True(t, fake.HasVolume(fakeHostID, "default", "image.qcow2"))
+
+	status, err := svc.UploadVolumeData(vol.ID, 0, bytes.NewReader(image[:mib+mib/2]))
+	require.NoError(t, err)
+	assert.False(t, status.Complete)
+	assert.Equal(t, uint64(mib+mib/2), status.Offset)
+
+	var offsetErr *UploadOffsetError
+	_, err = svc.UploadVolumeData(vol.ID, 0, bytes.NewReader(image))
+	require.ErrorAs(t, err, &offsetErr)
+	assert.Equal(t, uint64(mib+mib/2), offsetErr.Status.Offset)
+
+	status, err = svc.UploadVolumeData(vol.ID, status.Offset, bytes.NewReader(image[mib+mib/2:]))
+	require.NoError(t, err)
+	assert.True(t, status.Complete)
+	assert.Equal(t, hex.EncodeToString(sum[:]), status.SHA256)
+
+	require.NoError(t, db.Where("id = ?", vol.ID).First(&vol).Error)
+	assert.Empty(t, vol.TaskState)
+	assert.Equal(t, string(storage.StorageStateAvailable), vol.State)
+	assert.Equal(t, "qcow2", vol.Format)
+	assert.Equal(t, uint64(10<<30), vol.CapacityBytes)
+	// Empty blocks were never sent.
+	assert.Less(t, vol.AllocationBytes, uint64(len(image)))
+
+	dl, err := svc.StatVolumeDownload(vol.ID)
+	require.NoError(t, err)
+	assert.Equal(t, uint64(len(image)), dl.SizeBytes)
+	var out bytes.Buffer
+	require.NoError(t, svc.DownloadVolume(dl, &out, 0, dl.SizeBytes))
+	assert.Equal(t, image, out.Bytes())
+	out.Reset()
+	require.NoError(t, svc.DownloadVolume(dl, &out, 3*mib, 16))
+	assert.Equal(t, image[3*mib:3*mib+16], out.Bytes())
+
+	bad, err := svc.CreateVolumeUpload(fakeHostID, VolumeUploadRequest{Name: "bad.iso", SizeBytes: 16, SHA256: hex.EncodeToString(sum[:])})
+	require.NoError(t, err)
+	assert.Equal(t, "ISO", bad.Type)
+	_, err = svc.UploadVolumeData(bad.ID, 0, bytes.NewReader([]byte("sixteen bytes!!!")))
+	require.ErrorContains(t, err, "checksum mismatch")
+	require.NoError(t, db.Where("id = ?", bad.ID).First(&bad).Error)
+	assert.Equal(t, string(storage.StorageStateError), bad.State)
+	_, err = svc.GetVolumeUploadStatus(bad.ID)
+	require.ErrorContains(t, err, "not found")
+
+	_, err = svc.CreateVolumeUpload(fakeHostID, VolumeUploadRequest{Name: "huge.img", SizeBytes: 200 << 30})
+	require.ErrorContains(t, err, "bytes free")
+	_, err = svc.CreateVolumeUpload(fakeHostID, VolumeUploadRequest{Name: "../escape.img", SizeBytes: 16})
+	require.ErrorContains(t, err, "invalid upload")
+
+	// Logical volumes may hold stale data, so their zeros are written too.
+	fake.AddStoragePool(fakeHostID, libvirt.StoragePoolInfo{Name: "vg", Type: "logical", Path: "/dev/vg", CapacityBytes: 50 << 30})
+	lv, err := svc.CreateVolumeUpload(fakeHostID, VolumeUploadRequest{Pool: "vg", Name: "blank", SizeBytes: 2 * mib})
+	require.NoError(t, err)
+	status, err = svc.UploadVolumeData(lv.ID, 0, bytes.NewReader(make([]byte, 2*mib)))
+	require.NoError(t, err)
+	assert.True(t, status.Complete)
+	require.NoError(t, db.Where("id = ?", lv.ID).First(&lv).Error)
+	assert.Equal(t, uint64(2*mib), lv.AllocationBytes)
+}
+
+func TestISOLibraryAndMediaChange(t *testing.T) {
+	svc, fake, db := setupFakeHostService(t)
+	fake.AddStoragePool(fakeHostID, libvirt.StoragePoolInfo{Name: "isos", Path: "/srv/isos", CapacityBytes: 50 << 30})
+	ubuntuPath, err := fake.AddStorageVolume(fakeHostID, "default", "ubuntu.iso", "iso", 2<<30)
+	require.NoError(t, err)
+	debianPath, err := fake.AddStorageVolume(fakeHostID, "isos", "debian.ISO", "raw", 600<<20)
+	require.NoError(t, err)
+	_, err = fake.AddStorageVolume(fakeHostID, "isos", "scratch.qcow2", "qcow2", 1<<30)
+	require.NoError(t, err)
+
+	images, err := svc.ListISOs("", "")
+	require.NoError(t, err)
+	require.Len(t, images, 2)
+	assert.Equal(t, "debian.ISO", images[0].Name)
+	assert.Equal(t, "isos", images[0].PoolName)
+	assert.Equal(t, fakeHostID, images[0].HostID)
+	assert.Equal(t, "ubuntu.iso", images[1].Name)
+
+	var isoPool storage.StoragePool
+	require.NoError(t, db.Where("host_id = ? AND name = ?", fakeHostID, "isos").First(&isoPool).Error)
+	images, err = svc.ListISOs(fakeHostID, isoPool.ID)
+	require.NoError(t, err)
+	require.Len(t, images, 1)
+	debian := images[0].Volume
+	_, err = svc.ListISOs("", "missing")
+	require.ErrorContains(t, err, "not found")
+
+	var ubuntu storage.Volume
+	require.NoError(t, db.Where("path = ?", ubuntuPath).First(&ubuntu).Error)
+	vm, err := svc.CreateVM(fakeHostID, storage.CreateVMRequest{Name: "installer", VCPUCount: 1, MemoryBytes: 1 << 30, DiskSizeGB: 5, ISOVolumeID: ubuntu.ID})
+	require.NoError(t, err)
+	domainXML, ok := fake.DomainXML(fakeHostID, "installer")
+	require.True(t, ok)
+	assert.Contains(t, domainXML, `<boot dev="cdrom"></boot>`+"\n"+`    <boot dev="hd"></boot>`)
+	assert.Contains(t, domainXML, `<source file="`+ubuntuPath+`"></source>`)
+	var cdrom storage.DiskAttachment
+	require.NoError(t, db.Preload("Disk").Where("vm_uuid = ? AND device_name = ?", vm.ID, "sda").First(&cdrom).Error)
+	assert.Equal(t, ubuntuPath, cdrom.Disk.Path)
+	assert.True(t, cdrom.ReadOnly)
+
+	// Discs change while the guest runs, even on a bus without hotplug.
+	require.NoError(t, svc.StartVM(fakeHostID, "installer"))
+	att, err := svc.InsertVMMedia(fakeHostID, "installer", "sda", CDROMMediaRequest{VolumeID: debian.ID})
+	require.NoError(t, err)
+	assert.Equal(t, debianPath, att.Disk.Path)
+	domainXML, _ = fake.DomainXML(fakeHostID, "installer")
+	assert.Contains(t, domainXML, debianPath)
+	assert.NotContains(t, domainXML, ubuntuPath)
+
+	att, err = svc.EjectVMMedia(fakeHostID, "installer", "sda")
+	require.NoError(t, err)
+	assert.Empty(t, att.Disk.Path)
+	assert.Equal(t, cdrom.ID, att.ID)
+	domainXML, _ = fake.DomainXML(fakeHostID, "installer")
+	assert.NotContains(t, domainXML, debianPath)
+	assert.Contains(t, domainXML, "device=\"cdrom\"")
+
+	_, err = svc.InsertVMMedia(fakeHostID, "installer", "vda", CDROMMediaRequest{VolumeID: debian.ID})
+	require.ErrorContains(t, err, "not a CD-ROM")
+	var disk storage.Volume
+	require.NoError(t, db.Where("name = ?", "installer.qcow2").First(&disk).Error)
+	_, err = svc.InsertVMMedia(fakeHostID, "installer", "sda", CDROMMediaRequest{VolumeID: disk.ID})
+	require.ErrorContains(t, err, "invalid media")
+
+	// Images deleted from their pool drop out of the library.
+	require.NoError(t, fake.DeleteStorageVolume(fakeHostID, "default", "ubuntu.iso"))
+	images, err = svc.ListISOs(fakeHostID, "")
+	require.NoError(t, err)
+	require.Len(t, images, 1)
+	assert.Equal(t, debian.ID, images[0].ID)
+}
+
+func TestStoragePoolLifecycle(t *testing.T) {
+	svc, fake, db := setupFakeHostService(t)
+
+	_, err := svc.CreateStoragePool(fakeHostID, StoragePoolCreateRequest{StoragePoolSpec: libvirt.StoragePoolSpec{Name: "nfs", Type: "netfs", TargetPath: "/mnt/nfs"}})
+	require.ErrorContains(t, err, "invalid storage pool")
+	_, err = svc.CreateStoragePool(fakeHostID, StoragePoolCreateRequest{StoragePoolSpec: libvirt.StoragePoolSpec{Name: "ceph", Type: "rbd", SourceHosts: []libvirt.StoragePoolHost{{Name: "mon1"}}, SourceName: "vms"}, Build: true})
+	require.ErrorContains(t, err, "cannot be built")
+	_, err = svc.CreateStoragePool(fakeHostID, StoragePoolCreateRequest{StoragePoolSpec: libvirt.StoragePoolSpec{Name: "default", Type: "dir", TargetPath: "/srv/other"}})
+	require.ErrorContains(t, err, "already in use")
+
+	pool, err := svc.CreateStoragePool(fakeHostID, StoragePoolCreateRequest{
+		StoragePoolSpec: libvirt.StoragePoolSpec{Name: "scratch", Type: "dir", TargetPath: "/srv/scratch"},
+		Build:           true,
+		Start:           true,
+		Autostart:       true,
+	})
+	require.NoError(t, err)
+	assert.Equal(t, "active", pool.State)
+	assert.Equal(t, "dir", pool.Type)
+	assert.Equal(t, "/srv/scratch", pool.Path)
+	assert.True(t, pool.Autostart)
+	var defaultPool storage.StoragePool
+	require.NoError(t, db.Where("name = ?", "default").First(&defaultPool).Error)
+	assert.Equal(t, "active", defaultPool.State)
+
+	// A pool that cannot start is not left defined.
+	_, err = svc.CreateStoragePool(fakeHostID, StoragePoolCreateRequest{StoragePoolSpec: libvirt.StoragePoolSpec{Name: "unbuilt", Type: "dir", TargetPath: "/srv/unbuilt"}, Start: true})
+	require.ErrorContains(t, err, "No such file or directory")
+	pools, err := fake.ListAllStoragePools(fakeHostID)
+	require.NoError(t, err)
+	assert.Len(t, pools, 2)
+
+	vm, err := svc.CreateVM(fakeHostID, storage.CreateVMRequest{Name: "web", VCPUCount: 1, MemoryBytes: 1 << 30, DiskSizeGB: 5, Pool: "scratch"})
+	require.NoError(t, err)
+	assert.True(t, fake.HasVolume(fakeHostID, "scratch", "web.qcow2"))
+	var vol storage.Volume
+	require.NoError(t, db.Where("name = ?", "web.qcow2").First(&vol).Error)
+	assert.Equal(t, pool.ID, vol.StoragePoolID)
+
+	// Paths are matched literally, so wildcards in a sibling pool's path do
+	// not pick up this pool's disks.
+	users, err := svc.storagePoolUsers(storage.StoragePool{Base: storage.Base{ID: "sibling"}, Name: "sibling", Path: "/srv/scratc_"})
+	require.NoError(t, err)
+	assert.Empty(t, users)
+
+	_, err = svc.StopStoragePool(pool.ID)
+	require.ErrorContains(t, err, "in use by vm web")
+	require.ErrorContains(t, svc.DeleteStoragePool(pool.ID, true), "in use by vm web")
+	require.NoError(t, db.Where("vm_uuid = ?", vm.ID).Delete(&storage.DiskAttachment{}).Error)
+
+	pool, err = svc.SetStoragePoolAutostart(pool.ID, StoragePoolAutostartRequest{Autostart: false})
+	require.NoError(t, err)
+	assert.False(t, pool.Autostart)
+	pool, err = svc.StopStoragePool(pool.ID)
+	require.NoError(t, err)
+	assert.Equal(t, "inactive", pool.State)
+	_, err = svc.RefreshStoragePool(pool.ID)
+	require.ErrorContains(t, err, "not active")
+	pool, err = svc.StartStoragePool(pool.ID)
+	require.NoError(t, err)
+	_, err = svc.RefreshStoragePool(pool.ID)
+	require.NoError(t, err)
+
+	// Libvirt will not remove a directory that still holds volumes; the
+	// pool is restarted rather than left down.
+	require.ErrorContains(t, svc.DeleteStoragePool(pool.ID, true), "Directory not empty")
+	_, err = svc.RefreshStoragePool(pool.ID)
+	require.NoError(t, err)
+	require.NoError(t, fake.DeleteStorageVolume(fakeHostID, "scratch", "web.qcow2"))
+	require.NoError(t, svc.DeleteStoragePool(pool.ID, true))
+	pools, err = fake.ListAllStoragePools(fakeHostID)
+	require.NoError(t, err)
+	assert.Len(t, pools, 1)
+	var count int64
+	db.Unscoped().Model(&storage.StoragePool{}).Where("id = ?", pool.ID).Count(&count)
+	assert.Zero(t, count)
+	db.Unscoped().Model(&storage.Volume{}).Where("id = ?", vol.ID).Count(&count)
+	assert.Zero(t, count)
+}
+
+func TestVirtualNetworkLifecycle(t *testing.T) {
+	svc, fake, db := setupFakeHostService(t)
+
+	lab := libvirt.NetworkSpec{
+		Name: "lab",
+		Mode: "nat",
+		IPs: []libvirt.NetworkIP{
+			{Address: "10.10.0.1", Prefix: 24, DHCPRanges: []libvirt.NetworkDHCPRange{{Start: "10.10.0.100", End: "10.10.0.200"}}},
+			{Family: "ipv6", Address: "fd00:10::1", Prefix: 64},
+		},
+		DNSHosts: []libvirt.NetworkDNSHost{{IP: "10.10.0.2", Hostnames: []string{"gw"}}},
+	}
+	bad := lab
+	bad.IPs = []libvirt.NetworkIP{{Address: "10.10.0.1", Prefix: 24, DHCPRanges: []libvirt.NetworkDHCPRange{{Start: "10.20.0.100", End: "10.20.0.200"}}}}
+	_, err := svc.CreateNetwork(fakeHostID, NetworkCreateRequest{NetworkSpec: bad})
+	require.ErrorContains(t, err, "invalid network")
+	_, err = svc.CreateNetwork(fakeHostID, NetworkCreateRequest{NetworkSpec: libvirt.NetworkSpec{Name: "default", Mode: "isolated"}})
+	require.ErrorContains(t, err, "already in use")
+
+	network, err := svc.CreateNetwork(fakeHostID, NetworkCreateRequest{NetworkSpec: lab, Start: true, Autostart: true})
+	require.NoError(t, err)
+	assert.Equal(t, "active", network.State)
+	assert.True(t, network.Autostart)
+	assert.Equal(t, "nat", network.Mode)
+	assert.NotEmpty(t, network.UUID)
+	assert.NotEmpty(t, network.Spec.Bridge)
+	assert.Equal(t, network.Spec.Bridge, network.BridgeName)
+
+	_, err = svc.CreateVM(fakeHostID, storage.CreateVMRequest{Name: "web", VCPUCount: 1, MemoryBytes: 1 << 30, DiskSizeGB: 5})
+	require.NoError(t, err)
+	att, err := svc.AttachVMNIC(fakeHostID, "web", NICAttachRequest{Type: NICTypeNetwork, Source: "lab", MAC: "52:54:00:AA:BB:10"})
+	require.NoError(t, err)
+
+	// Reservations and DNS entries change without taking the network down.
+	update := lab
+	update.IPs = []libvirt.NetworkIP{lab.IPs[0], lab.IPs[1]}
+	update.IPs[0].DHCPRanges = []libvirt.NetworkDHCPRange{{Start: "10.10.0.50", End: "10.10.0.99"}}
+	update.IPs[0].DHCPHosts = []libvirt.NetworkDHCPHost{{PortID: att.PortID, IP: "10.10.0.10"}}
+	update.DNSHosts = []libvirt.NetworkDNSHost{{IP: "10.10.0.10", Hostnames: []string{"web"}}}
+	network, err = svc.UpdateNetwork(network.ID, update)
+	require.NoError(t, err)
+	require.Len(t, network.Spec.IPs[0].DHCPHosts, 1)
+	assert.Equal(t, "52:54:00:aa:bb:10", network.Spec.IPs[0].DHCPHosts[0].MAC)
+	assert.Equal(t, att.PortID, network.Spec.IPs[0].DHCPHosts[0].PortID)
+	assert.Equal(t, []libvirt.NetworkDHCPRange{{Start: "10.10.0.50", End: "10.10.0.99"}}, network.Spec.IPs[0].DHCPRanges)
+	assert.Equal(t, "web", network.Spec.DNSHosts[0].Hostnames[0])
+	assert.Equal(t, "active", network.State)
+	assert.Zero(t, fake.NetworkRestarts(fakeHostID, "lab"))
+
+	routed := update
+	routed.Mode = "route"
+	_, err = svc.UpdateNetwork(network.ID, routed)
+	require.ErrorContains(t, err, "while it runs")
+	_, err = svc.StopNetwork(network.ID)
+	require.ErrorContains(t, err, "in use by vm web")
+	require.ErrorContains(t, svc.DeleteNetwork(network.ID), "in use by vm web")
+
+	require.NoError(t, svc.DetachVMNIC(fakeHostID, "web", "52:54:00:aa:bb:10"))
+	network, err = svc.StopNetwork(network.ID)
+	require.NoError(t, err)
+	assert.Equal(t, "inactive", network.State)
+	// The port went with the NIC, so the reservation now names its MAC.
+	routed.IPs = []libvirt.NetworkIP{update.IPs[0], update.IPs[1]}
+	routed.IPs[0].DHCPHosts = []libvirt.NetworkDHCPHost{{MAC: "52:54:00:aa:bb:10", IP: "10.10.0.10"}}
+	network, err = svc.UpdateNetwork(network.ID, routed)
+	require.NoError(t, err)
+	assert.Equal(t, "route", network.Mode)
+	assert.Len(t, network.Spec.IPs[0].DHCPHosts, 1)
+
+	require.NoError(t, svc.DeleteNetwork(network.ID))
+	_, err = fake.GetNetwork(fakeHostID, "lab")
+	require.ErrorContains(t, err, "not found")
+	var count int64
+	db.Model(&storage.Network{}).Where("id = ?", network.ID).Count(&count)
+	assert.Zero(t, count)
+
+	// The name can be used again right away.
+	network, err = svc.CreateNetwork(fakeHostID, NetworkCreateRequest{NetworkSpec: lab})
+	require.NoError(t, err)
+	assert.Equal(t, "lab", network.Name)
+	assert.Equal(t, "inactive", network.State)
+}
+
+func TestSecurityGroups(t *testing.T) {
+	svc, fake, db := setupFakeHostService(t)
+
+	_, err := svc.CreateSecurityGroup(SecurityGroupRequest{Name: "bad", Rules: []SecurityGroupRuleRequest{{Direction: "ingress", Protocol: "icmp", PortMin: 22}}})
+	require.ErrorContains(t, err, "invalid security group rule")
+	web, err := svc.CreateSecurityGroup(SecurityGroupRequest{Name: "web", Rules: []SecurityGroupRuleRequest{
+		{Direction: "ingress", Protocol: "tcp", PortMin: 80},
+		{Direction: "ingress", Protocol: "tcp", PortMin: 22, CIDR: "10.1.2.3/8"},
+	}})
+	require.NoError(t, err)
+	require.Len(t, web.Rules, 2)
+	assert.Equal(t, 80, web.Rules[0].PortMax)
+	assert.Equal(t, "10.0.0.0/8", web.Rules[1].CIDR)
+	_, err = svc.CreateSecurityGroup(SecurityGroupRequest{Name: "web"})
+	require.ErrorContains(t, err, "already in use")
+	dbGroup, err := svc.CreateSecurityGroup(SecurityGroupRequest{Name: "db", Rules: []SecurityGroupRuleRequest{
+		{Direction: "ingress", Protocol: "tcp", PortMin: 5432, RemoteGroupID: web.ID},
+	}})
+	require.NoError(t, err)
+
+	for _, name := range []string{"app", "pg"} {
+		_, err := svc.CreateVM(fakeHostID, storage.CreateVMRequest{Name: name, VCPUCount: 1, MemoryBytes: 1 << 30, DiskSizeGB: 5})
+		require.NoError(t, err)
+		require.NoError(t, svc.StartVM(fakeHostID, name))
+	}
+	appNIC, err := svc.AttachVMNIC(fakeHostID, "app", NICAttachRequest{Type: NICTypeNetwork, Source: "default", MAC: "52:54:00:aa:cc:01"})
+	require.NoError(t, err)
+	require.NoError(t, db.Model(&storage.Port{}).Where("id = ?", appNIC.PortID).Update("ip_address", "192.168.122.10").Error)
+	pgNIC, err := svc.AttachVMNIC(fakeHostID, "pg", NICAttachRequest{Type: NICTypeNetwork, Source: "default", MAC: "52:54:00:aa:cc:02"})
+	require.NoError(t, err)
+
+	// Binding a NIC defines the group's filter and the NIC's own filter,
+	// and points the running guest's interface at it.
+	groups, err := svc.SetVMNICSecurityGroups(fakeHostID, "app", "52:54:00:aa:cc:01", NICSecurityGroupsRequest{SecurityGroupIDs: []string{web.ID}})
+	require.NoError(t, err)
+	require.Len(t, groups, 1)
+	webFilter, ok := fake.NWFilter(fakeHostID, "virtumancer-sg-"+web.ID)
+	require.True(t, ok)
+	require.Len(t, webFilter.Rules, 3)
+	assert.Equal(t, libvirt.NWFilterRule{Action: "accept", Direction: "in", Protocol: "tcp", PortStart: 80, PortEnd: 80, State: "NEW"}, webFilter.Rules[0])
+	assert.Equal(t, "tcp-ipv6", webFilter.Rules[1].Protocol)
+	assert.Equal(t, "10.0.0.0", webFilter.Rules[2].RemoteIP)
+	assert.Equal(t, 8, webFilter.Rules[2].RemotePrefix)
+	portFilter, ok := fake.NWFilter(fakeHostID, "virtumancer-port-"+appNIC.PortID)
+	require.True(t, ok)
+	assert.Equal(t, []string{"virtumancer-sg-" + web.ID}, portFilter.Filters)
+	nic, err := svc.findVMNIC(fakeHostID, "app", "52:54:00:aa:cc:01")
+	require.NoError(t, err)
+	assert.Equal(t, "virtumancer-port-"+appNIC.PortID, nic.FilterRef.Filter)
+	var port storage.Port
+	require.NoError(t, db.First(&port, "id = ?", appNIC.PortID).Error)
+	assert.Contains(t, port.FilterRefJSON, "virtumancer-port-"+appNIC.PortID)
+
+	// Remote group rules expand to the addresses of the group's NICs.
+	_, err = svc.SetVMNICSecurityGroups(fakeHostID, "pg", "52:54:00:aa:cc:02", NICSecurityGroupsRequest{SecurityGroupIDs: []string{dbGroup.ID}})
+	require.NoError(t, err)
+	dbFilter, ok := fake.NWFilter(fakeHostID, "virtumancer-sg-"+dbGroup.ID)
+	require.True(t, ok)
+	require.Len(t, dbFilter.Rules, 1)
+	assert.Equal(t, "192.168.122.10", dbFilter.Rules[0].RemoteIP)
+	assert.Equal(t, 32, dbFilter.Rules[0].RemotePrefix)
+
+	// A member address learned by a later sync re-defines the filters that
+	// expand to it.
+	require.NoError(t, fake.SetInterfaceAddress(fakeHostID, "app", "52:54:00:aa:cc:01", "192.168.122.20"))
+	require.NoError(t, svc.SyncVMFromLibvirt(fakeHostID, "app"))
+	dbFilter, _ = fake.NWFilter(fakeHostID, "virtumancer-sg-"+dbGroup.ID)
+	require.Len(t, dbFilter.Rules, 1)
+	assert.Equal(t, "192.168.122.20", dbFilter.Rules[0].RemoteIP)
+
+	// Changing the rules re-defines the filter where the group is used.
+	web, err = svc.UpdateSecurityGroup(web.ID, SecurityGroupRequest{Name: "web", Rules: []SecurityGroupRuleRequest{{Direction: "ingress", Protocol: "tcp", PortMin: 443}}})
+	require.NoError(t, err)
+	webFilter, _ = fake.NWFilter(fakeHostID, "virtumancer-sg-"+web.ID)
+	require.Len(t, webFilter.Rules, 2)
+	assert.Equal(t, 443, webFilter.Rules[0].PortStart)
+
+	require.ErrorContains(t, svc.DeleteSecurityGroup(web.ID), "in use by vm app")
+	_, err = svc.SetVMNICSecurityGroups(fakeHostID, "app", "52:54:00:aa:cc:01", NICSecurityGroupsRequest{})
+	require.NoError(t, err)
+	nic, err = svc.findVMNIC(fakeHostID, "app", "52:54:00:aa:cc:01")
+	require.NoError(t, err)
+	assert.Empty(t, nic.FilterRef.Filter)
+	_, ok = fake.NWFilter(fakeHostID, "virtumancer-port-"+appNIC.PortID)
+	assert.False(t, ok)
+	_, ok = fake.NWFilter(fakeHostID, "virtumancer-sg-"+web.ID)
+	assert.False(t, ok)
+	dbFilter, _ = fake.NWFilter(fakeHostID, "virtumancer-sg-"+dbGroup.ID)
+	assert.Empty(t, dbFilter.Rules)
+	require.ErrorContains(t, svc.DeleteSecurityGroup(web.ID), "in use by security group db")
+
+	// Removing a NIC releases its groups.
+	require.NoError(t, svc.DetachVMNIC(fakeHostID, "pg", "52:54:00:aa:cc:02"))
+	_, ok = fake.NWFilter(fakeHostID, "virtumancer-sg-"+dbGroup.ID)
+	assert.False(t, ok)
+	_, ok = fake.NWFilter(fakeHostID, "virtumancer-port-"+pgNIC.PortID)
+	assert.False(t, ok)
+	require.NoError(t, svc.DeleteSecurityGroup(dbGroup.ID))
+	require.NoError(t, svc.DeleteSecurityGroup(web.ID))
+	_, err = svc.CreateSecurityGroup(SecurityGroupRequest{Name: "web"})
+	require.NoError(t, err)
+}
+
+func TestGuestAgentOperations(t *testing.T) {
+	svc, fake, db := setupFakeHostService(t)
+
+	_, err := svc.CreateVM(fakeHostID, storage.CreateVMRequest{Name: "agent", VCPUCount: 1, MemoryBytes: 1 << 30, DiskSizeGB: 5})
+	require.NoError(t, err)
+
+	// The agent only answers while the guest runs.
+	_, err = svc.ExecInGuest(fakeHostID, "agent", GuestExecRequest{GuestCommand: libvirt.GuestCommand{Path: "/bin/true"}})
+	var unavailable *libvirt.GuestAgentUnavailableError
+	require.ErrorAs(t, err, &unavailable)
+	require.NoError(t, svc.StartVM(fakeHostID, "agent"))
+
+	_, err = svc.ExecInGuest(fakeHostID, "agent", GuestExecRequest{})
+	require.ErrorContains(t, err, "path is required")
+	res, err := svc.ExecInGuest(fakeHostID, "agent", GuestExecRequest{GuestCommand: libvirt.GuestCommand{Path: "/bin/echo", Args: []string{"hello", "guest"}}})
+	require.NoError(t, err)
+	assert.Equal(t, 0, res.ExitCode)
+	assert.Equal(t, "hello guest\n", res.Stdout)
+	res, err = svc.ExecInGuest(fakeHostID, "agent", GuestExecRequest{GuestCommand: libvirt.GuestCommand{Path: "/bin/false"}})
+	require.NoError(t, err)
+	assert.Equal(t, 1, res.ExitCode)
+
+	require.NoError(t, svc.SetGuestPassword(fakeHostID, "agent", GuestPasswordRequest{User: "root", Password: "s3cret"}))
+	password, ok := fake.GuestUserPassword(fakeHostID, "agent", "root")
+	require.True(t, ok)
+	assert.Equal(t, "s3cret", password)
+
+	// Frozen filesystems block every agent command but a thaw.
+	n, err := svc.FreezeGuestFilesystems(fakeHostID, "agent", GuestFilesystemsRequest{})
+	require.NoError(t, err)
+	assert.Equal(t, 1, n)
+	require.ErrorContains(t, svc.SyncGuestTime(fakeHostID, "agent"), "frozen")
+	n, err = svc.ThawGuestFilesystems(fakeHostID, "agent", GuestFilesystemsRequest{})
+	require.NoError(t, err)
+	assert.Equal(t, 1, n)
+	require.NoError(t, svc.SyncGuestTime(fakeHostID, "agent"))
+
+	fake.SetGuestAgentResponding(fakeHostID, "agent", false)
+	require.ErrorAs(t, svc.RebootVMViaAgent(fakeHostID, "agent"), &unavailable)
+	fake.SetGuestAgentResponding(fakeHostID, "agent", true)
+	require.NoError(t, svc.ShutdownVMViaAgent(fakeHostID, "agent"))
+	state, _ := fake.DomainState(fakeHostID, "agent")
+	assert.Equal(t, golibvirt.DomainShutoff, state)
+
+	// Every call is audited, without the password.
+	var entries []storage.AuditLog
+	require.NoError(t, db.Order("id").Find(&entries).Error)
+	var actions []string
+	for _, e := range entries {
+		actions = append(actions, e.Action)
+		assert.NotContains(t, e.Details, "s3cret")
+	}
+	assert.Equal(t, []string{
+		"guest_agent.exec", "guest_agent.exec", "guest_agent.exec", "guest_agent.set_password",
+		"guest_agent.fsfreeze", "guest_agent.time_sync", "guest_agent.fsthaw", "guest_agent.time_sync",
+		"guest_agent.reboot", "guest_agent.shutdown",
+	}, actions)
+	assert.Contains(t, entries[0].Details, `"result":"failed"`)
+
+	// Guests defined without the agent channel are reported as such.
+	require.NoError(t, fake.AddDomain(fakeHostID, `<domain type='kvm'>
+  <name>bare</name>
+  <uuid>0b6c7f0e-5a43-4f1e-9d3c-4a1b2c3d4e5f</uuid>
+  <memory unit='KiB'>524288</memory>
+  <vcpu>1</vcpu>
+</domain>`, golibvirt.DomainRunning))
+	require.NoError(t, svc.ImportVM(fakeHostID, "bare"))
+	err = svc.SyncGuestTime(fakeHostID, "bare")
+	require.ErrorAs(t, err, &unavailable)
+	assert.Contains(t, err.Error(), "not configured")
+}
+
+func TestPauseResumeAndManagedSave(t *testing.T) {
+	svc, fake, _ := setupFakeHostService(t)
+
+	_, err := svc.CreateVM(fakeHostID, storage.CreateVMRequest{Name: "saver", VCPUCount: 1, MemoryBytes: 1 << 30, DiskSizeGB: 5})
+	require.NoError(t, err)
+	require.NoError(t, svc.StartVM(fakeHostID, "saver"))
+
+	require.NoError(t, svc.PauseVM(fakeHostID, "saver"))
+	vm, err := svc.findVM(fakeHostID, "saver")
+	require.NoError(t, err)
+	assert.Equal(t, storage.StatePaused, vm.State)
+	assert.Equal(t, storage.StatePaused, vm.LibvirtState)
+	assert.Empty(t, vm.TaskState)
+	require.Error(t, svc.PauseVM(fakeHostID, "saver"))
+
+	require.NoError(t, svc.ResumeVM(fakeHostID, "saver"))
+	state, _ := fake.DomainState(fakeHostID, "saver")
+	assert.Equal(t, golibvirt.DomainRunning, state)
+
+	// A saved VM is shut off in libvirt but reported as suspended, with
+	// its image surfaced, until a restore consumes the image.
+	require.ErrorContains(t, svc.RestoreVM(fakeHostID, "saver"), "no managed save image")
+	require.NoError(t, svc.ManagedSaveVM(fakeHostID, "saver"))
+	state, _ = fake.DomainState(fakeHostID, "saver")
+	assert.Equal(t, golibvirt.DomainShutoff, state)
+	views, err := svc.GetVMsForHostFromDB(fakeHostID)
+	require.NoError(t, err)
+	require.Len(t, views, 1)
+	assert.True(t, views[0].HasManagedSave)
+	assert.Equal(t, storage.StateSuspended, views[0].State)
+	assert.Equal(t, storage.StateSuspended, views[0].LibvirtState)
+
+	require.NoError(t, svc.RestoreVM(fakeHostID, "saver"))
+	vm, err = svc.findVM(fakeHostID, "saver")
+	require.NoError(t, err)
+	assert.False(t, vm.HasManagedSave)
+	assert.Equal(t, storage.StateActive, vm.LibvirtState)
+
+	require.NoError(t, svc.ForceOffVM(fakeHostID, "saver"))
+	require.ErrorContains(t, svc.RestoreVM(fakeHostID, "saver"), "no managed save image")
+	vm, err = svc.findVM(fakeHostID, "saver")
+	require.NoError(t, err)
+	assert.Empty(t, vm.TaskState)
+}
+
+func TestDeleteVM(t *testing.T) {
+	svc, fake, db := setupFakeHostService(t)
+
+	vm, err := svc.CreateVM(fakeHostID, storage.CreateVMRequest{Name: "doomed", VCPUCount: 1, MemoryBytes: 1 << 30, DiskSizeGB: 5})
+	require.NoError(t, err)
+	require.NoError(t, svc.StartVM(fakeHostID, "doomed"))
+	data, err := svc.AttachVMDisk(fakeHostID, "doomed", DiskAttachRequest{SizeBytes: 1 << 30})
+	require.NoError(t, err)
+	nic, err := svc.AttachVMNIC(fakeHostID, "doomed", NICAttachRequest{Type: NICTypeNetwork, Source: "default", MAC: "52:54:00:aa:bb:66"})
+	require.NoError(t, err)
+	_, err = svc.CreateVMSnapshot(fakeHostID, "doomed", libvirt.SnapshotSpec{Name: "base"})
+	require.NoError(t, err)
+
+	require.ErrorContains(t, svc.DeleteVM(fakeHostID, "doomed", VMDeleteRequest{}), "is running")
+	require.ErrorContains(t, svc.DeleteVM(fakeHostID, "doomed", VMDeleteRequest{Force: true, DiskPolicy: "shred"}), "invalid disk policy")
+	require.ErrorContains(t, svc.DeleteVM(fakeHostID, "doomed", VMDeleteRequest{Force: true, Disks: map[string]string{"vdz": DiskPolicyDelete}}), "not found")
+	state, _ := fake.DomainState(fakeHostID, "doomed")
+	assert.Equal(t, golibvirt.DomainRunning, state)
+
+	// The root disk goes with the VM while the data disk is kept.
+	require.NoError(t, svc.DeleteVM(fakeHostID, "doomed", VMDeleteRequest{
+		Force:      true,
+		DiskPolicy: DiskPolicyDelete,
+		Disks:      map[string]string{"vdb": DiskPolicyKeep},
+	}))
+	_, exists := fake.DomainState(fakeHostID, "doomed")
+	assert.False(t, exists)
+	assert.False(t, fake.HasVolume(fakeHostID, "default", "doomed.qcow2"))
+	assert.True(t, fake.HasVolume(fakeHostID, "default", "doomed-vdb.qcow2"))
+	var count int64
+	db.Model(&storage.Disk{}).Where("path = ?", data.Disk.Path).Count(&count)
+	assert.Equal(t, int64(1), count)
+	db.Model(&storage.Disk{}).Where("path = ?", "/var/lib/libvirt/images/doomed.qcow2").Count(&count)
+	assert.Zero(t, count)
+	for _, model := range []interface{}{&storage.DiskAttachment{}, &storage.PortAttachment{}, &storage.AttachmentIndex{}, &storage.Console{}, &storage.VMSnapshot{}} {
+		db.Unscoped().Model(model).Where("vm_uuid = ?", vm.ID).Count(&count)
+		assert.Zero(t, count, "%T", model)
+	}
+	db.Unscoped().Model(&storage.Port{}).Where("id = ?", nic.PortID).Count(&count)
+	assert.Zero(t, count)
+	_, err = svc.findVM(fakeHostID, "doomed")
+	require.ErrorContains(t, err, "not found")
+	require.ErrorContains(t, svc.DeleteVM(fakeHostID, "doomed", VMDeleteRequest{}), "not found")
+
+	// The name and MAC are free again, and the kept disk can be attached to
+	// its successor.
+	_, err = svc.CreateVM(fakeHostID, storage.CreateVMRequest{Name: "doomed", VCPUCount: 1, MemoryBytes: 1 << 30, DiskSizeGB: 5})
+	require.NoError(t, err)
+	_, err = svc.AttachVMDisk(fakeHostID, "doomed", DiskAttachRequest{VolumeID: *data.Disk.VolumeID})
+	require.NoError(t, err)
+	_, err = svc.AttachVMNIC(fakeHostID, "doomed", NICAttachRequest{Type: NICTypeNetwork, Source: "default", MAC: "52:54:00:aa:bb:66"})
+	require.NoError(t, err)
+	require.NoError(t, svc.DeleteVM(fakeHostID, "doomed", VMDeleteRequest{DiskPolicy: DiskPolicyDetach}))
+	assert.True(t, fake.HasVolume(fakeHostID, "default", "doomed-vdb.qcow2"))
+	db.Model(&storage.Disk{}).Where("path = ?", data.Disk.Path).Count(&count)
+	assert.Zero(t, count)
+
+	// Crashed and saved VMs have no guest to stop, so they go without force
+	// and without a destroy.
+	_, err = svc.CreateVM(fakeHostID, storage.CreateVMRequest{Name: "crashed", VCPUCount: 1, MemoryBytes: 1 << 30, DiskSizeGB: 5})
+	require.NoError(t, err)
+	require.NoError(t, svc.StartVM(fakeHostID, "crashed"))
+	require.NoError(t, fake.SetDomainState(fakeHostID, "crashed", golibvirt.DomainCrashed))
+	_, err = svc.CreateVM(fakeHostID, storage.CreateVMRequest{Name: "saved", VCPUCount: 1, MemoryBytes: 1 << 30, DiskSizeGB: 5})
+	require.NoError(t, err)
+	require.NoError(t, svc.StartVM(fakeHostID, "saved"))
+	require.NoError(t, svc.ManagedSaveVM(fakeHostID, "saved"))
+	for _, name := range []string{"crashed", "saved"} {
+		fake.InjectError("DestroyDomain", errors.New("domain is not running"))
+		require.NoError(t, svc.DeleteVM(fakeHostID, name, VMDeleteRequest{DiskPolicy: DiskPolicyDelete}), name)
+		_, exists = fake.DomainState(fakeHostID, name)
+		assert.False(t, exists, name)
+	}
+}
+
+func TestResizeVM(t *testing.T) {
+	svc, fake, _ := setupFakeHostService(t)
+
+	_, err := svc.CreateVM(fakeHostID, storage.CreateVMRequest{Name: "elastic", VCPUCount: 2, MemoryBytes: 2 << 30, DiskSizeGB: 5})
+	require.NoError(t, err)
+	vcpus := func(n uint) *uint { return &n }
+	bytes := func(n uint64) *uint64 { return &n }
+
+	_, err = svc.ResizeVM(fakeHostID, "elastic", VMResizeRequest{})
+	require.ErrorContains(t, err, "nothing to change")
+	_, err = svc.ResizeVM(fakeHostID, "elastic", VMResizeRequest{VCPUCount: vcpus(3)})
+	require.ErrorContains(t, err, "exceeds the maximum")
+	_, err = svc.ResizeVM(fakeHostID, "elastic", VMResizeRequest{MaxVCPUCount: vcpus(64)})
+	require.ErrorContains(t, err, "CPUs of host")
+	_, err = svc.ResizeVM(fakeHostID, "elastic", VMResizeRequest{MemoryBytes: bytes(64 << 30)})
+	require.ErrorContains(t, err, "of host")
+
+	// A stopped VM takes every change at once, and its current memory
+	// follows the maximum it was at.
+	vm, err := svc.ResizeVM(fakeHostID, "elastic", VMResizeRequest{MaxVCPUCount: vcpus(4), VCPUCount: vcpus(2), MemoryBytes: bytes(4 << 30)})
+	require.NoError(t, err)
+	assert.Equal(t, uint(2), vm.VCPUCount)
+	assert.Equal(t, uint64(4<<30), vm.MemoryBytes)
+	assert.Equal(t, uint64(4<<30), vm.CurrentMemory)
+	assert.False(t, vm.NeedsRebuild)
+	domainXML, _ := fake.DomainXML(fakeHostID, "elastic")
+	assert.Contains(t, domainXML, "current='2'>4</vcpu>")
+	cpu, err := fake.GetDomainCPUDetails(fakeHostID, "elastic")
+	require.NoError(t, err)
+	assert.Equal(t, int32(4), cpu.MaxVcpus)
+
+	// Running, vCPUs up to the maximum are hotplugged and memory is
+	// ballooned; a larger maximum waits for the next boot.
+	require.NoError(t, svc.StartVM(fakeHostID, "elastic"))
+	vm, err = svc.ResizeVM(fakeHostID, "elastic", VMResizeRequest{VCPUCount: vcpus(4), CurrentMemoryBytes: bytes(3 << 30)})
+	require.NoError(t, err)
+	assert.False(t, vm.NeedsRebuild)
+	info, err := fake.GetDomainInfo(fakeHostID, "elastic")
+	require.NoError(t, err)
+	assert.Equal(t, uint(4), info.Vcpu)
+	assert.Equal(t, uint64(3<<20), info.Memory)
+
+	// A step that fails puts back the ones already applied.
+	fake.InjectError("SetDomainMemory", errors.New("balloon stuck"))
+	_, err = svc.ResizeVM(fakeHostID, "elastic", VMResizeRequest{VCPUCount: vcpus(2), CurrentMemoryBytes: bytes(2 << 30)})
+	require.ErrorContains(t, err, "balloon stuck")
+	info, err = fake.GetDomainInfo(fakeHostID, "elastic")
+	require.NoError(t, err)
+	assert.Equal(t, uint(4), info.Vcpu)
+	assert.Equal(t, uint64(3<<20), info.Memory)
+	vm, err = svc.findVM(fakeHostID, "elastic")
+	require.NoError(t, err)
+	assert.Equal(t, uint(4), vm.VCPUCount)
+	assert.Equal(t, uint64(3<<30), vm.CurrentMemory)
+
+	vm, err = svc.ResizeVM(fakeHostID, "elastic", VMResizeRequest{MemoryBytes: bytes(8 << 30), CurrentMemoryBytes: bytes(6 << 30)})
+	require.NoError(t, err)
+	assert.True(t, vm.NeedsRebuild)
+	assert.Equal(t, uint64(8<<30), vm.MemoryBytes)
+	info, err = fake.GetDomainInfo(fakeHostID, "elastic")
+	require.NoError(t, err)
+	assert.Equal(t, uint64(4<<20), info.MaxMem)
+	assert.Equal(t, uint64(3<<20), info.Memory)
+
+	require.NoError(t, svc.ForceOffVM(fakeHostID, "elastic"))
+	require.NoError(t, svc.StartVM(fakeHostID, "elastic"))
+	info, err = fake.GetDomainInfo(fakeHostID, "elastic")
+	require.NoError(t, err)
+	assert.Equal(t, uint64(8<<20), info.MaxMem)
+	assert.Equal(t, uint64(6<<20), info.Memory)
+	vm, err = svc.findVM(fakeHostID, "elastic")
+	require.NoError(t, err)
+	assert.False(t, vm.NeedsRebuild)
+}
+
+// definitionRows snapshots the hardware rows a sync records for a VM, minus
+// row IDs and timestamps, in a stable order for comparison across databases.
+func definitionRows(t *testing.T, db *gorm.DB, vmUUID string) map[string][]string {
+	models := map[string]interface{}{
+		"boot":       &storage.BootConfig{},
+		"os":         &storage.OSConfig{},
+		"topology":   &storage.CPUTopology{},
+		"features":   &storage.CPUFeature{},
+		"numa":       &storage.NUMANode{},
+		"memory":     &storage.MemoryConfig{},
+		"hypervisor": &storage.HypervisorFeature{},
+		"lifecycle":  &storage.LifecycleAction{},
+		"clock":      &storage.Clock{},
+		"perf":       &storage.PerfEvent{},
+		"security":   &storage.SecurityLabel{},
+		"disks":      &storage.DiskAttachment{},
+		"nics":       &storage.PortAttachment{},
+		"videos":     &storage.VideoAttachment{},
+		"consoles":   &storage.Console{},
+	}
+	rows := make(map[string][]string)
+	for name, model := range models {
+		var found []map[string]interface{}
+		require.NoError(t, db.Model(model).Where("vm_uuid = ?", vmUUID).Find(&found).Error)
+		for _, row := range found {
+			for column := range row {
+				if column == "id" || column == "vm_uuid" || strings.HasSuffix(column, "_id") || strings.HasSuffix(column, "_at") {
+					delete(row, column)
+				}
+			}
+			rows[name] = append(rows[name], fmt.Sprint(row))
+		}
+		sort.Strings(rows[name])
+	}
+
+	var disks []storage.DiskAttachment
+	require.NoError(t, db.Preload("Disk").Where("vm_uuid = ?", vmUUID).Find(&disks).Error)
+	for _, attachment := range disks {
+		rows["disk_paths"] = append(rows["disk_paths"], attachment.DeviceName+"="+attachment.Disk.Path)
+	}
+	sort.Strings(rows["disk_paths"])
+	var nics []storage.PortAttachment
+	require.NoError(t, db.Preload("Port").Where("vm_uuid = ?", vmUUID).Find(&nics).Error)
+	for _, attachment := range nics {
+		port := attachment.Port
+		rows["ports"] = append(rows["ports"], fmt.Sprint(port.MACAddress, port.ModelName, port.SourceType, port.SourceRef, port.VlanTagsJSON))
+	}
+	sort.Strings(rows["ports"])
+	return rows
+}
+
+func TestRenderDomain_RoundTripsThroughSync(t *testing.T) {
+	svc, fake, db := setupFakeHostService(t)
+
+	spec := libvirt.DomainSpec{
+		Name:            "roundtrip",
+		UUID:            "0b7a7f5e-3c1d-4e8f-9a2b-6c5d4e3f2a10",
+		Title:           "Round trip",
+		Description:     "Every section the renderer knows",
+		VCPUs:           4,
+		MemoryKB:        4 << 20,
+		CurrentMemoryKB: 2 << 20,
+		OS: libvirt.DomainOS{
+			Arch:    "x86_64",
+			Machine: "q35",
+			Loader: &libvirt.OSLoaderConfig{
+				Type: "pflash", ReadOnly: true, Secure: true,
+				Path:          "/usr/share/OVMF/OVMF_CODE.secboot.fd",
+				NVRAM:         "/var/lib/libvirt/qemu/nvram/roundtrip_VARS.fd",
+				NVRAMTemplate: "/usr/share/OVMF/OVMF_VARS.fd",
+			},
+			BootMenu:        true,
+			BootMenuTimeout: 3000,
+			Boot:            []string{"cdrom", "hd"},
+		},
+		CPU: libvirt.DomainCPU{
+			Mode: "custom", Model: "Skylake-Client", Sockets: 1, Cores: 2, Threads: 2,
+			Features: []libvirt.CPUFeatureInfo{{Name: "vmx", Policy: "disable"}, {Name: "pcid", Policy: "require"}},
+		},
+		MemoryBacking: &libvirt.MemoryBackingInfo{
+			HugePages: &libvirt.HugePagesInfo{Page: []libvirt.HugePageInfo{{Size: "2048", Unit: "KiB"}}},
+			Locked:    true,
+			Access:    "shared",
+		},
+		NUMACells:   []libvirt.NUMANodeInfo{{ID: 0, CPUs: "0-1", MemoryKB: 2 << 20}, {ID: 1, CPUs: "2-3", MemoryKB: 2 << 20}},
+		Features:    []libvirt.HypervisorFeatureInfo{{Name: "acpi", State: "on"}, {Name: "apic", State: "on"}},
+		Lifecycle:   libvirt.LifecycleActionInfo{OnPoweroff: "destroy", OnReboot: "restart", OnCrash: "coredump-restart"},
+		ClockOffset: "localtime",
+		PerfEvents:  []libvirt.PerfEventInfo{{Name: "cmt", Event: "enabled"}},
+		SecurityLabels: []libvirt.SecurityLabelInfo{
+			{Type: "dynamic", Model: "selinux", Relabel: "yes"},
+		},
+		Disks: []libvirt.DiskDevice{
+			{Path: "/var/lib/libvirt/images/roundtrip.qcow2", Format: "qcow2", Bus: "virtio", Target: "vda", Cache: "none"},
+			{Path: "/var/lib/libvirt/images/data.raw", Format: "raw", Bus: "virtio", Target: "vdb", Shareable: true},
+			{Device: "cdrom", Path: "/var/lib/libvirt/images/installer.iso", Format: "raw", Bus: "sata", Target: "sda", ReadOnly: true},
+		},
+		Interfaces: []libvirt.InterfaceDevice{
+			{Type: "network", Source: "default", Model: "virtio", MAC: "52:54:00:aa:bb:01"},
+			{Type: "bridge", Source: "br0", Model: "e1000", MAC: "52:54:00:aa:bb:02"},
+		},
+		Graphics: []libvirt.DomainGraphics{{Type: "vnc"}},
+		Videos:   []libvirt.VideoDevice{{Model: "virtio", VRAMBytes: 16 << 20, Heads: 1}},
+	}
+	original, err := spec.XML()
+	require.NoError(t, err)
+	require.NoError(t, fake.AddDomain(fakeHostID, original, golibvirt.DomainShutoff))
+	require.NoError(t, svc.ImportVM(fakeHostID, "roundtrip"))
+	imported, err := svc.findVM(fakeHostID, "roundtrip")
+	require.NoError(t, err)
+
+	// Redefining from the imported rows and importing the result elsewhere
+	// must record the same hardware.
+	require.NoError(t, svc.RebuildVMFromDB(fakeHostID, "roundtrip"))
+	rebuilt, ok := fake.DomainXML(fakeHostID, "roundtrip")
+	require.True(t, ok)
+	assert.Contains(t, rebuilt, `<model fallback="allow">Skylake-Client</model>`)
+	assert.Contains(t, rebuilt, `<boot dev="cdrom"></boot>`)
+
+	svc2, fake2, db2 := setupFakeHostService(t)
+	require.NoError(t, fake2.AddDomain(fakeHostID, rebuilt, golibvirt.DomainShutoff))
+	require.NoError(t, svc2.ImportVM(fakeHostID, "roundtrip"))
+	reimported, err := svc2.findVM(fakeHostID, "roundtrip")
+	require.NoError(t, err)
+
+	assert.Equal(t, imported.DomainUUID, reimported.DomainUUID)
+	assert.Equal(t, imported.Title, reimported.Title)
+	assert.Equal(t, imported.Description, reimported.Description)
+	assert.Equal(t, imported.VCPUCount, reimported.VCPUCount)
+	assert.Equal(t, imported.CPUModel, reimported.CPUModel)
+	assert.Equal(t, imported.MemoryBytes, reimported.MemoryBytes)
+	assert.Equal(t, imported.CurrentMemory, reimported.CurrentMemory)
+
+	want := definitionRows(t, db, imported.ID)
+	got := definitionRows(t, db2, reimported.ID)
+	for name, rows := range want {
+		assert.NotEmpty(t, rows, name)
+		assert.Equal(t, rows, got[name], name)
+	}
+}
+
+func TestCreateVM_DomainIsRenderedFromRecords(t *testing.T) {
+	svc, fake, db := setupFakeHostService(t)
+
+	vm, err := svc.CreateVM(fakeHostID, storage.CreateVMRequest{Name: "fresh", VCPUCount: 2, MemoryBytes: 2 << 30, DiskSizeGB: 10})
+	require.NoError(t, err)
+	created, ok := fake.DomainXML(fakeHostID, "fresh")
+	require.True(t, ok)
+
+	// What CreateVM defines is exactly what its records render to, so a
+	// rebuild of an untouched VM is a no-op.
+	require.NoError(t, svc.RebuildVMFromDB(fakeHostID, "fresh"))
+	rebuilt, _ := fake.DomainXML(fakeHostID, "fresh")
+	assert.Equal(t, created, rebuilt)
+
+	var port storage.PortAttachment
+	require.NoError(t, db.Preload("Port").Where("vm_uuid = ?", vm.ID).First(&port).Error)
+	assert.Contains(t, created, `<mac address="`+port.Port.MACAddress+`"></mac>`)
+	assert.Contains(t, created, `<source file="/var/lib/libvirt/images/fresh.qcow2"></source>`)
+	assert.Contains(t, created, `<graphics type="vnc" port="-1" autoport="yes"`)
+
+	// Changes made to the records reach the domain on rebuild; a running
+	// VM only picks them up at its next boot.
+	require.NoError(t, db.Model(&storage.VirtualMachine{}).Where("id = ?", vm.ID).Update("cpu_model", "host-passthrough").Error)
+	require.NoError(t, svc.RebuildVMFromDB(fakeHostID, "fresh"))
+	rebuilt, _ = fake.DomainXML(fakeHostID, "fresh")
+	assert.Contains(t, rebuilt, `<cpu mode="host-passthrough"`)
+	stored, err := svc.findVM(fakeHostID, "fresh")
+	require.NoError(t, err)
+	assert.False(t, stored.NeedsRebuild)
+
+	require.NoError(t, svc.StartVM(fakeHostID, "fresh"))
+	require.NoError(t, svc.RebuildVMFromDB(fakeHostID, "fresh"))
+	stored, err = svc.findVM(fakeHostID, "fresh")
+	require.NoError(t, err)
+	assert.True(t, stored.NeedsRebuild)
+
+	fake.InjectError("DefineAndCreateDomain", errors.New("define refused"))
+	require.ErrorContains(t, svc.RebuildVMFromDB(fakeHostID, "fresh"), "define refused")
+}
+
+// seedFiles reads the files of a seed ISO through its Joliet directory, the
+// way guests see them.
+func seedFiles(t *testing.T, img []byte) map[string]string {
+	const sector = 2048
+	require.Greater(t, len(img), 18*sector)
+	svd := img[17*sector : 18*sector]
+	require.Equal(t, byte(2), svd[0])
+	require.Equal(t, "%/E", string(svd[88:91]))
+	dirLBA := binary.LittleEndian.Uint32(svd[158:162])
+	dirLen := binary.LittleEndian.Uint32(svd[166:170])
+	dir := img[dirLBA*sector : dirLBA*sector+dirLen]
+
+	files := make(map[string]string)
+	for off := 0; off < len(dir); {
+		n := int(dir[off])
+		if n == 0 {
+			off = (off/sector + 1) * sector
+			continue
+		}
+		rec := dir[off : off+n]
+		off += n
+		if rec[25]&2 != 0 {
+			continue
+		}
+		raw := rec[33 : 33+int(rec[32])]
+		units := make([]uint16, len(raw)/2)
+		for i := range units {
+			units[i] = binary.BigEndian.Uint16(raw[2*i:])
+		}
+		extent := binary.LittleEndian.Uint32(rec[2:6])
+		size := binary.LittleEndian.Uint32(rec[10:14])
+		files[strings.TrimSuffix(string(utf16.Decode(units)), ";1")] = string(img[extent*sector : extent*sector+size])
+	}
+	return files
+}
+
+func TestCreateVM_CloudInitSeed(t *testing.T) {
+	svc, fake, db := setupFakeHostService(t)
+
+	vm, err := svc.CreateVM(fakeHostID, storage.CreateVMRequest{
+		Name: "seeded", VCPUCount: 1, MemoryBytes: 1 << 30, DiskSizeGB: 5,
+		CloudInit: &storage.CloudInitConfig{
+			UserData:      "#cloud-config\nssh_authorized_keys:\n  - ssh-ed25519 AAAA test\n",
+			NetworkConfig: "version: 2\nethernets:\n  eth0:\n    dhcp4: true\n",
+		},
+	})
+	require.NoError(t, err)
+
+	seedPath := "/var/lib/libvirt/images/seeded-seed.img"
+	domainXML, _ := fake.DomainXML(fakeHostID, "seeded")
+	assert.Contains(t, domainXML, `<source file="`+seedPath+`"></source>`)
+	assert.Contains(t, domainXML, `<target dev="sda" bus="sata"></target>`)
+
+	var seed storage.ProvisioningSeed
+	require.NoError(t, db.Where("vm_uuid = ?", vm.ID).First(&seed).Error)
+	assert.Equal(t, SeedKindNoCloud, seed.Kind)
+	var image bytes.Buffer
+	require.NoError(t, fake.DownloadStorageVolume(fakeHostID, seedPath, &image, 0, 0))
+	assert.Equal(t, "cidata", strings.TrimRight(string(image.Bytes()[16*2048+40:16*2048+72]), " "))
+	files := seedFiles(t, image.Bytes())
+	assert.Equal(t, "#cloud-config\nssh_authorized_keys:\n  - ssh-ed25519 AAAA test\n", files["user-data"])
+	assert.Equal(t, "instance-id: "+vm.ID+"\nlocal-hostname: seeded\n", files["meta-data"])
+	assert.Contains(t, files["network-config"], "dhcp4: true")
+
+	// The seed stays until the guest agent shows the guest is up.
+	fake.SetGuestAgentResponding(fakeHostID, "seeded", false)
+	require.NoError(t, svc.StartVM(fakeHostID, "seeded"))
+	require.NoError(t, svc.pollVMStates(fakeHostID))
+	assert.True(t, fake.HasVolume(fakeHostID, "default", "seeded-seed.img"))
+
+	fake.SetGuestAgentResponding(fakeHostID, "seeded", true)
+	require.NoError(t, svc.pollVMStates(fakeHostID))
+	assert.False(t, fake.HasVolume(fakeHostID, "default", "seeded-seed.img"))
+	var count int64
+	db.Model(&storage.ProvisioningSeed{}).Where("vm_uuid = ?", vm.ID).Count(&count)
+	assert.Zero(t, count)
+	db.Model(&storage.DiskAttachment{}).Where("vm_uuid = ? AND device_name = ?", vm.ID, "sda").Count(&count)
+	assert.Zero(t, count)
+	db.Model(&storage.Volume{}).Where("path = ?", seedPath).Count(&count)
+	assert.Zero(t, count)
+	domainXML, _ = fake.DomainXML(fakeHostID, "seeded")
+	assert.NotContains(t, domainXML, "seed.img")
+	assert.NotContains(t, domainXML, `dev="sda"`)
+}
+
+func TestCreateVM_IgnitionSeed(t *testing.T) {
+	svc, fake, db := setupFakeHostService(t)
+
+	_, err := svc.CreateVM(fakeHostID, storage.CreateVMRequest{Name: "both", VCPUCount: 1, MemoryBytes: 1 << 30,
+		CloudInit: &storage.CloudInitConfig{UserData: "#cloud-config\n"}, Ignition: `{}`})
+	require.ErrorContains(t, err, "cannot both be set")
+	_, err = svc.CreateVM(fakeHostID, storage.CreateVMRequest{Name: "broken", VCPUCount: 1, MemoryBytes: 1 << 30, Ignition: `{"ignition":`})
+	require.ErrorContains(t, err, "not valid JSON")
+	assert.False(t, fake.HasVolume(fakeHostID, "default", "broken.qcow2"))
+
+	config := `{"ignition":{"version":"3.4.0"},"passwd":{"users":[{"name":"core"}]}}`
+	vm, err := svc.CreateVM(fakeHostID, storage.CreateVMRequest{Name: "coreos", VCPUCount: 2, MemoryBytes: 2 << 30, DiskSizeGB: 10, Ignition: config})
+	require.NoError(t, err)
+
+	configPath := "/var/lib/libvirt/images/coreos-ignition.ign"
+	domainXML, _ := fake.DomainXML(fakeHostID, "coreos")
+	assert.Contains(t, domainXML, `<sysinfo type="fwcfg">`)
+	assert.Contains(t, domainXML, `<entry name="opt/com.coreos/config" file="`+configPath+`"></entry>`)
+	var content bytes.Buffer
+	require.NoError(t, fake.DownloadStorageVolume(fakeHostID, configPath, &content, 0, 0))
+	assert.Equal(t, config, content.String())
+
+	// A rebuild keeps the pending config.
+	require.NoError(t, svc.RebuildVMFromDB(fakeHostID, "coreos"))
+	domainXML, _ = fake.DomainXML(fakeHostID, "coreos")
+	assert.Contains(t, domainXML, configPath)
+
+	require.NoError(t, svc.StartVM(fakeHostID, "coreos"))
+	require.NoError(t, svc.pollVMStates(fakeHostID))
+	domainXML, _ = fake.DomainXML(fakeHostID, "coreos")
+	assert.NotContains(t, domainXML, "sysinfo")
+	assert.False(t, fake.HasVolume(fakeHostID, "default", "coreos-ignition.ign"))
+	var count int64
+	db.Model(&storage.ProvisioningSeed{}).Where("vm_uuid = ?", vm.ID).Count(&count)
+	assert.Zero(t, count)
+}
+
+func TestDeleteVM_RemovesPendingSeed(t *testing.T) {
+	svc, fake, db := setupFakeHostService(t)
+
+	vm, err := svc.CreateVM(fakeHostID, storage.CreateVMRequest{Name: "short-lived", VCPUCount: 1, MemoryBytes: 1 << 30, DiskSizeGB: 5,
+		CloudInit: &storage.CloudInitConfig{UserData: "#cloud-config\n"}})
+	require.NoError(t, err)
+	require.True(t, fake.HasVolume(fakeHostID, "default", "short-lived-seed.img"))
+
+	require.NoError(t, svc.DeleteVM(fakeHostID, "short-lived", VMDeleteRequest{DiskPolicy: DiskPolicyDelete}))
+	assert.False(t, fake.HasVolume(fakeHostID, "default", "short-lived-seed.img"))
+	var count int64
+	db.Model(&storage.ProvisioningSeed{}).Where("vm_uuid = ?", vm.ID).Count(&count)
+	assert.Zero(t, count)
+}
+
+func TestTemplates_ConvertInstantiateAndCopy(t *testing.T) {
+	svc, fake, db := setupFakeHostService(t)
+
+	const targetID = "fake-host-2"
+	fake.AddStoragePool(targetID, libvirt.StoragePoolInfo{Name: "default", Path: "/var/lib/libvirt/images", CapacityBytes: 100 << 30})
+	fake.AddNetwork(targetID, "default", "virbr0")
+	target := storage.Host{Base: storage.Base{ID: targetID}, URI: "qemu+tcp://host2/system", State: string(storage.HostStateConnected)}
+	require.NoError(t, db.Create(&target).Error)
+	require.NoError(t, fake.AddHost(target))
+
+	base, err := svc.CreateVM(fakeHostID, storage.CreateVMRequest{Name: "golden", VCPUCount: 2, MemoryBytes: 1 << 30, DiskSizeGB: 5})
+	require.NoError(t, err)
+	baseHW, err := fake.GetDomainHardware(fakeHostID, "golden")
+	require.NoError(t, err)
+	require.Len(t, baseHW.Networks, 1)
+
+	_, err = svc.InstantiateTemplate(fakeHostID, "golden", TemplateInstantiateRequest{NamePattern: "web-{n}", Count: 1})
+	require.ErrorContains(t, err, "not a template")
+	require.NoError(t, svc.StartVM(fakeHostID, "golden"))
+	_, err = svc.ConvertVMToTemplate(fakeHostID, "golden")
+	require.ErrorContains(t, err, "shut off")
+	require.NoError(t, svc.ForceOffVM(fakeHostID, "golden"))
+
+	tmpl, err := svc.ConvertVMToTemplate(fakeHostID, "golden")
+	require.NoError(t, err)
+	assert.True(t, tmpl.IsTemplate)
+	require.ErrorContains(t, svc.StartVM(fakeHostID, "golden"), "in use as a template")
+	require.ErrorContains(t, svc.RestoreVM(fakeHostID, "golden"), "in use as a template")
+
+	_, err = svc.InstantiateTemplate(fakeHostID, "golden", TemplateInstantiateRequest{NamePattern: "web", Count: 2})
+	require.ErrorContains(t, err, "{n}")
+	_, err = svc.InstantiateTemplate(fakeHostID, "golden", TemplateInstantiateRequest{NamePattern: "web-{n}", Count: 2,
+		CloudInitOverrides: map[string]storage.CloudInitConfig{"web-7": {UserData: "#cloud-config\n"}}})
+	require.ErrorContains(t, err, "matches no instance")
+
+	instances, err := svc.InstantiateTemplate(fakeHostID, "golden", TemplateInstantiateRequest{
+		NamePattern: "web-{n}", Count: 3, Linked: true,
+		CloudInit: &storage.CloudInitConfig{UserData: "#cloud-config\npackages: [nginx]\n"},
+		CloudInitOverrides: map[string]storage.CloudInitConfig{
+			"web-2": {MetaData: "instance-id: web-2\nlocal-hostname: second\n"},
+		},
+	})
+	require.NoError(t, err)
+	require.Len(t, instances, 3)
+	macs := map[string]bool{baseHW.Networks[0].Mac.Address: true}
+	for i, vm := range instances {
+		name := fmt.Sprintf("web-%d", i+1)
+		assert.Equal(t, name, vm.Name)
+		assert.False(t, vm.IsTemplate)
+		assert.NotEqual(t, base.DomainUUID, vm.DomainUUID)
+		backing, ok := fake.VolumeBacking(fakeHostID, "/var/lib/libvirt/images/"+name+".qcow2")
+		require.True(t, ok)
+		assert.Equal(t, "/var/lib/libvirt/images/golden.qcow2", backing)
+
+		hw, err := fake.GetDomainHardware(fakeHostID, name)
+		require.NoError(t, err)
+		require.Len(t, hw.Networks, 1)
+		assert.False(t, macs[hw.Networks[0].Mac.Address], "MAC %s reused", hw.Networks[0].Mac.Address)
+		macs[hw.Networks[0].Mac.Address] = true
+
+		domainXML, _ := fake.DomainXML(fakeHostID, name)
+		assert.Contains(t, domainXML, "/var/lib/libvirt/images/"+name+"-seed.img")
+		var image bytes.Buffer
+		require.NoError(t, fake.DownloadStorageVolume(fakeHostID, "/var/lib/libvirt/images/"+name+"-seed.img", &image, 0, 0))
+		files := seedFiles(t, image.Bytes())
+		assert.Equal(t, "#cloud-config\npackages: [nginx]\n", files["user-data"])
+		if name == "web-2" {
+			assert.Equal(t, "instance-id: web-2\nlocal-hostname: second\n", files["meta-data"])
+		} else {
+			assert.Equal(t, "instance-id: "+vm.ID+"\nlocal-hostname: "+name+"\n", files["meta-data"])
+		}
+	}
+
+	// The seed drive is on record, so rendering the domain from the
+	// database keeps it until first boot.
+	require.NoError(t, svc.RebuildVMFromDB(fakeHostID, "web-3"))
+	rebuilt, _ := fake.DomainXML(fakeHostID, "web-3")
+	assert.Contains(t, rebuilt, "/var/lib/libvirt/images/web-3-seed.img")
+	var seedDrives int64
+	db.Model(&storage.DiskAttachment{}).Where("vm_uuid = ? AND metadata = ?", instances[2].ID, cdromMetadata).Count(&seedDrives)
+	assert.Equal(t, int64(1), seedDrives)
+
+	// Instances start; the seed goes once the guest agent answers.
+	require.NoError(t, svc.StartVM(fakeHostID, "web-1"))
+	require.NoError(t, svc.pollVMStates(fakeHostID))
+	assert.False(t, fake.HasVolume(fakeHostID, "default", "web-1-seed.img"))
+
+	// A failed instance takes the ones created before it along.
+	fake.InjectError("CloneStorageVolume", errors.New("no space left on device"))
+	_, err = svc.InstantiateTemplate(fakeHostID, "golden", TemplateInstantiateRequest{NamePattern: "db-{n}", Count: 1})
+	require.Error(t, err)
+	_, err = svc.InstantiateTemplate(fakeHostID, "golden", TemplateInstantiateRequest{NamePattern: "db-{n}", Count: 2, FirstIndex: 9,
+		CloudInit: &storage.CloudInitConfig{UserData: "#cloud-config\n"}})
+	require.NoError(t, err)
+	fake.InjectError("CreateRawStorageVolume", errors.New("no space left on device"))
+	_, err = svc.InstantiateTemplate(fakeHostID, "golden", TemplateInstantiateRequest{NamePattern: "cache-{n}", Count: 2,
+		CloudInit: &storage.CloudInitConfig{UserData: "#cloud-config\n"}})
+	require.Error(t, err)
+	_, ok := fake.DomainState(fakeHostID, "cache-1")
+	assert.False(t, ok)
+	assert.False(t, fake.HasVolume(fakeHostID, "default", "cache-1.qcow2"))
+	assert.False(t, fake.HasVolume(fakeHostID, "default", "cache-1-seed.img"))
+	var count int64
+	db.Model(&storage.VirtualMachine{}).Where("name LIKE ?", "cache-%").Count(&count)
+	assert.Zero(t, count)
+
+	// Copies to another host are full copies and stay templates.
+	copied, err := svc.CopyTemplate(fakeHostID, "golden", TemplateCopyRequest{TargetHostID: targetID})
+	require.NoError(t, err)
+	assert.Equal(t, "golden", copied.Name)
+	assert.Equal(t, targetID, copied.HostID)
+	assert.True(t, fake.HasVolume(targetID, "default", "golden.qcow2"))
+	farBacking, ok := fake.VolumeBacking(targetID, "/var/lib/libvirt/images/golden.qcow2")
+	require.True(t, ok)
+	assert.Empty(t, farBacking)
+
+	templates, err := svc.ListTemplates()
+	require.NoError(t, err)
+	require.Len(t, templates, 2)
+	assert.Equal(t, fakeHostID, templates[0].HostID)
+	assert.Equal(t, targetID, templates[1].HostID)
+
+	// Converting back unlocks power operations once no instance is linked.
+	_, err = svc.ConvertTemplateToVM(targetID, "golden")
+	require.NoError(t, err)
+	require.NoError(t, svc.StartVM(targetID, "golden"))
+	_, err = svc.ConvertTemplateToVM(fakeHostID, "golden")
+	require.NoError(t, err)
+	require.ErrorContains(t, svc.StartVM(fakeHostID, "golden"), "base of linked clone")
+}
+
+func TestFlavors_CreateAndResizeVM(t *testing.T) {
+	svc, fake, db := setupFakeHostService(t)
+
+	_, err := svc.CreateFlavor(FlavorRequest{Name: "odd", CPUCores: 1, MemoryMB: 1025, ExtraSpecs: &FlavorExtraSpecs{HugepageSizeKB: 2048}})
+	require.ErrorContains(t, err, "multiple of the huge page size")
+	_, err = svc.CreateFlavor(FlavorRequest{Name: "odd", CPUCores: 1, MemoryMB: 1024,
+		ExtraSpecs: &FlavorExtraSpecs{DiskIOTune: &libvirt.DiskIOTune{TotalIOPSSec: 100, ReadIOPSSec: 50}}})
+	require.ErrorContains(t, err, "total_iops_sec")
+
+	small, err := svc.CreateFlavor(FlavorRequest{Name: "m1.small", CPUCores: 2, MemoryMB: 1024, StorageGB: 5,
+		ExtraSpecs: &FlavorExtraSpecs{CPUModel: "host-model", HugepageSizeKB: 2048, DiskIOTune: &libvirt.DiskIOTune{TotalIOPSSec: 500}}})
+	require.NoError(t, err)
+	large, err := svc.CreateFlavor(FlavorRequest{Name: "m1.large", CPUCores: 4, MemoryMB: 2048, StorageGB: 10})
+	require.NoError(t, err)
+	_, err = svc.CreateFlavor(FlavorRequest{Name: "m1.small", CPUCores: 1, MemoryMB: 512})
+	require.ErrorContains(t, err, "already in use")
+
+	// The flavor fills in what the request leaves out, extra specs included.
+	vm, err := svc.CreateVM(fakeHostID, storage.CreateVMRequest{Name: "sized", ResourceClass: "m1.small"})
+	require.NoError(t, err)
+	assert.Equal(t, uint(2), vm.VCPUCount)
+	assert.Equal(t, uint64(1<<30), vm.MemoryBytes)
+	assert.Equal(t, "host-model", vm.CPUModel)
+	require.NotNil(t, vm.ResourceClassID)
+	assert.Equal(t, small.ID, *vm.ResourceClassID)
+	capacity, ok := fake.VolumeCapacity(fakeHostID, "default", "sized.qcow2")
+	require.True(t, ok)
+	assert.Equal(t, uint64(5<<30), capacity)
+	domainXML, _ := fake.DomainXML(fakeHostID, "sized")
+	assert.Contains(t, domainXML, `<cpu mode="host-model"`)
+	assert.Contains(t, domainXML, `<page size="2048" unit="KiB"`)
+	assert.Contains(t, domainXML, `<total_iops_sec>500</total_iops_sec>`)
+
+	// A rebuild from the records keeps the extra specs.
+	require.NoError(t, svc.RebuildVMFromDB(fakeHostID, "sized"))
+	rebuilt, _ := fake.DomainXML(fakeHostID, "sized")
+	assert.Equal(t, domainXML, rebuilt)
+
+	_, err = svc.CreateVM(fakeHostID, storage.CreateVMRequest{Name: "unsized", ResourceClass: "m1.huge"})
+	require.ErrorContains(t, err, "not found")
+
+	// Resizing applies the differences: the disk only grows, and extra
+	// specs the new flavor leaves out are dropped, except the CPU model.
+	vm, err = svc.ResizeVMToFlavor(fakeHostID, "sized", VMFlavorResizeRequest{ResourceClass: "m1.large"})
+	require.NoError(t, err)
+	assert.Equal(t, uint(4), vm.VCPUCount)
+	assert.Equal(t, uint64(2<<30), vm.MemoryBytes)
+	assert.Equal(t, "host-model", vm.CPUModel)
+	require.NotNil(t, vm.ResourceClassID)
+	assert.Equal(t, large.ID, *vm.ResourceClassID)
+	assert.False(t, vm.NeedsRebuild)
+	capacity, _ = fake.VolumeCapacity(fakeHostID, "default", "sized.qcow2")
+	assert.Equal(t, uint64(10<<30), capacity)
+	domainXML, _ = fake.DomainXML(fakeHostID, "sized")
+	assert.NotContains(t, domainXML, "<hugepages>")
+	assert.NotContains(t, domainXML, "<iotune>")
+	var backings int64
+	db.Model(&storage.MemoryConfig{}).Where("vm_uuid = ? AND config_type = ?", vm.ID, "backing").Count(&backings)
+	assert.Zero(t, backings)
+
+	// Running, the extra specs wait for the next boot.
+	require.NoError(t, svc.StartVM(fakeHostID, "sized"))
+	vm, err = svc.ResizeVMToFlavor(fakeHostID, "sized", VMFlavorResizeRequest{ResourceClass: "m1.small"})
+	require.NoError(t, err)
+	assert.True(t, vm.NeedsRebuild)
+	assert.Equal(t, small.ID, *vm.ResourceClassID)
+	capacity, _ = fake.VolumeCapacity(fakeHostID, "default", "sized.qcow2")
+	assert.Equal(t, uint64(10<<30), capacity)
+	domainXML, _ = fake.DomainXML(fakeHostID, "sized")
+	assert.Contains(t, domainXML, `<total_iops_sec>500</total_iops_sec>`)
+
+	require.ErrorContains(t, svc.DeleteFlavor(small.ID), "in use by vm sized")
+	require.NoError(t, svc.DeleteFlavor(large.ID))
+	_, err = svc.GetFlavor(large.ID)
+	require.ErrorContains(t, err, "not found")
+	flavors, err := svc.ListFlavors()
+	require.NoError(t, err)
+	require.Len(t, flavors, 1)
+	assert.Equal(t, "m1.small", flavors[0].Name)
+}
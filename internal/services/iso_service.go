@@ -0,0 +1,337 @@
+package services
+
+import (
+	"fmt"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/capsali/virtumancer/internal/libvirt"
+	log "github.com/capsali/virtumancer/internal/logging"
+	"github.com/capsali/virtumancer/internal/storage"
+	"gorm.io/gorm"
+)
+
+// ISOImage is an installation image in the ISO library.
+type ISOImage struct {
+	storage.Volume
+	HostID   string `json:"host_id"`
+	PoolName string `json:"pool_name"`
+}
+
+// CDROMMediaRequest names the library image to put in a CD-ROM drive.
+type CDROMMediaRequest struct {
+	VolumeID string `json:"volume_id"`
+}
+
+// isISOVolume reports whether a pool volume holds an installation image.
+// Libvirt reports the iso format for images it probes; the extension
+// catches the rest.
+func isISOVolume(v libvirt.VolumeDetail) bool {
+	return v.Format == "iso" || strings.EqualFold(filepath.Ext(v.Name), ".iso")
+}
+
+// indexPoolISOs records the ISO images in a pool in the library and drops
+// entries for images that have gone from it. Volumes first seen on a VM's
+// CD-ROM drive carry no pool and are adopted by the pool holding them.
+func (s *HostService) indexPoolISOs(pool storage.StoragePool) error {
+	vols, err := s.connector.ListStorageVolumes(pool.HostID, pool.Name)
+	if err != nil {
+		return err
+	}
+
+	tx := s.db.Begin()
+	seen := make(map[string]bool)
+	for _, v := range vols {
+		if !isISOVolume(v) {
+			continue
+		}
+		seen[v.Path] = true
+		format := v.Format
+		if format == "" {
+			format = "raw"
+		}
+		var existing []storage.Volume
+		tx.Where("storage_pool_id = ? AND path = ?", pool.ID, v.Path).Limit(1).Find(&existing)
+		if len(existing) == 0 {
+			tx.Where("storage_pool_id = ? AND path = ?", "", v.Path).Limit(1).Find(&existing)
+		}
+		if len(existing) == 0 {
+			vol := storage.Volume{
+				StoragePoolID:   pool.ID,
+				Name:            v.Name,
+				Path:            v.Path,
+				Type:            "ISO",
+				Format:          format,
+				CapacityBytes:   v.Capacity,
+				AllocationBytes: v.Allocation,
+				State:           string(storage.StorageStateAvailable),
+			}
+			if err := tx.Create(&vol).Error; err != nil {
+				tx.Rollback()
+				return fmt.Errorf("failed to save ISO %s: %w", v.Path, err)
+			}
+			continue
+		}
+		if existing[0].TaskState != "" {
+			// An upload still owns the volume and sets it up when done.
+			continue
+		}
+		updates := map[string]interface{}{
+			"storage_pool_id":  pool.ID,
+			"type":             "ISO",
+			"format":           format,
+			"capacity_bytes":   v.Capacity,
+			"allocation_bytes": v.Allocation,
+		}
+		if err := tx.Model(&existing[0]).Updates(updates).Error; err != nil {
+			tx.Rollback()
+			return fmt.Errorf("failed to update ISO %s: %w", v.Path, err)
+		}
+	}
+
+	var indexed []storage.Volume
+	if err := tx.Where("storage_pool_id = ? AND type = ?", pool.ID, "ISO").Find(&indexed).Error; err != nil {
+		tx.Rollback()
+		return fmt.Errorf("failed to load ISOs of pool %s: %w", pool.Name, err)
+	}
+	for _, vol := range indexed {
+		if seen[vol.Path] || vol.TaskState != "" {
+			continue
+		}
+		if err := tx.Unscoped().Delete(&vol).Error; err != nil {
+			tx.Rollback()
+			return fmt.Errorf("failed to remove ISO %s: %w", vol.Path, err)
+		}
+		log.Verbosef("Removed ISO %s from the library; it is no longer in pool %s on host %s", vol.Path, pool.Name, pool.HostID)
+	}
+	if err := tx.Commit().Error; err != nil {
+		return fmt.Errorf("failed to index ISOs of pool %s: %w", pool.Name, err)
+	}
+	return nil
+}
+
+// ListISOs returns the ISO library, narrowed to a host or a pool when
+// hostID or poolID is set. The pools of connected hosts are synced and
+// indexed first; pools that cannot be read are listed as last indexed.
+func (s *HostService) ListISOs(hostID, poolID string) ([]ISOImage, error) {
+	var hosts []storage.Host
+	query := s.db.Model(&storage.StoragePool{})
+	if hostID != "" {
+		var host storage.Host
+		if err := s.db.Where("id = ?", hostID).First(&host).Error; err != nil {
+			return nil, fmt.Errorf("host %s not found: %w", hostID, err)
+		}
+		hosts = append(hosts, host)
+		query = query.Where("host_id = ?", hostID)
+	} else if err := s.db.Find(&hosts).Error; err != nil {
+		return nil, fmt.Errorf("failed to load hosts: %w", err)
+	}
+	for _, host := range hosts {
+		if !s.connector.IsConnected(host.ID) {
+			continue
+		}
+		if _, err := s.syncHostStoragePools(host.ID); err != nil {
+			log.Warnf("Failed to sync storage pools of host %s: %v", host.ID, err)
+		}
+	}
+	if poolID != "" {
+		query = query.Where("id = ?", poolID)
+	}
+	var pools []storage.StoragePool
+	if err := query.Find(&pools).Error; err != nil {
+		return nil, fmt.Errorf("failed to load storage pools: %w", err)
+	}
+	if poolID != "" && len(pools) == 0 {
+		return nil, fmt.Errorf("storage pool %s not found", poolID)
+	}
+
+	poolsByID := make(map[string]storage.StoragePool, len(pools))
+	poolIDs := make([]string, 0, len(pools))
+	for _, pool := range pools {
+		poolsByID[pool.ID] = pool
+		poolIDs = append(poolIDs, pool.ID)
+		if !s.connector.IsConnected(pool.HostID) {
+			continue
+		}
+		if err := s.indexPoolISOs(pool); err != nil {
+			log.Warnf("Failed to index ISOs in pool %s on host %s: %v", pool.Name, pool.HostID, err)
+		}
+	}
+
+	images := make([]ISOImage, 0)
+	if len(poolIDs) == 0 {
+		return images, nil
+	}
+	var vols []storage.Volume
+	if err := s.db.Where("type = ? AND storage_pool_id IN ?", "ISO", poolIDs).Find(&vols).Error; err != nil {
+		return nil, fmt.Errorf("failed to load ISOs: %w", err)
+	}
+	for _, vol := range vols {
+		pool := poolsByID[vol.StoragePoolID]
+		images = append(images, ISOImage{Volume: vol, HostID: pool.HostID, PoolName: pool.Name})
+	}
+	sort.Slice(images, func(i, j int) bool {
+		if images[i].Name != images[j].Name {
+			return images[i].Name < images[j].Name
+		}
+		return images[i].HostID < images[j].HostID
+	})
+	return images, nil
+}
+
+// findISO loads a library image to use on hostID.
+func (s *HostService) findISO(hostID, volumeID string) (*storage.Volume, error) {
+	var vol storage.Volume
+	if err := s.db.Where("id = ?", volumeID).First(&vol).Error; err != nil {
+		return nil, fmt.Errorf("volume %s not found: %w", volumeID, err)
+	}
+	if vol.Type != "ISO" {
+		return nil, fmt.Errorf("invalid media: volume %s is not an ISO image", vol.Name)
+	}
+	if vol.TaskState != "" {
+		return nil, fmt.Errorf("volume %s is busy (%s)", vol.Name, vol.TaskState)
+	}
+	if vol.Path == "" {
+		return nil, fmt.Errorf("invalid media: volume %s has no path", vol.Name)
+	}
+	var pool storage.StoragePool
+	if vol.StoragePoolID != "" && s.db.Where("id = ?", vol.StoragePoolID).First(&pool).Error == nil && pool.HostID != hostID {
+		return nil, fmt.Errorf("invalid media: volume %s is on host %s", vol.Name, pool.HostID)
+	}
+	return &vol, nil
+}
+
+// InsertVMMedia puts a library image in a VM's CD-ROM drive, replacing the
+// disc already in it. A running guest sees the disc change.
+func (s *HostService) InsertVMMedia(hostID, vmName, device string, req CDROMMediaRequest) (*storage.DiskAttachment, error) {
+	if req.VolumeID == "" {
+		return nil, fmt.Errorf("invalid media: volume_id is required")
+	}
+	vol, err := s.findISO(hostID, req.VolumeID)
+	if err != nil {
+		return nil, err
+	}
+	return s.changeVMMedia(hostID, vmName, device, vol)
+}
+
+// EjectVMMedia empties a VM's CD-ROM drive.
+func (s *HostService) EjectVMMedia(hostID, vmName, device string) (*storage.DiskAttachment, error) {
+	return s.changeVMMedia(hostID, vmName, device, nil)
+}
+
+// changeVMMedia swaps the disc in a CD-ROM drive for vol, or ejects it when
+// vol is nil.
+func (s *HostService) changeVMMedia(hostID, vmName, device string, vol *storage.Volume) (*storage.DiskAttachment, error) {
+	vm, err := s.findVM(hostID, vmName)
+	if err != nil {
+		return nil, err
+	}
+	if !s.connector.IsConnected(hostID) {
+		return nil, fmt.Errorf("host %s is disconnected", hostID)
+	}
+	current, err := s.findVMDisk(hostID, vmName, device)
+	if err != nil {
+		return nil, err
+	}
+	if current.Device != "cdrom" {
+		return nil, fmt.Errorf("invalid media: %s of vm %s is not a CD-ROM drive", device, vmName)
+	}
+	drive := libvirt.DiskDeviceFromInfo(*current)
+	drive.Path = ""
+	drive.Format = "raw"
+	drive.ReadOnly = true
+	if vol != nil {
+		drive.Path = vol.Path
+	}
+	deviceXML, err := drive.XML()
+	if err != nil {
+		return nil, err
+	}
+	if err := s.connector.UpdateDevice(hostID, vmName, deviceXML); err != nil {
+		return nil, err
+	}
+
+	att, err := s.recordMediaAttachment(vm.ID, drive, vol)
+	if err != nil {
+		return nil, err
+	}
+	if vol != nil {
+		log.Infof("Inserted %s into %s of VM %s on host %s", vol.Path, device, vmName, hostID)
+	} else {
+		log.Infof("Ejected media from %s of VM %s on host %s", device, vmName, hostID)
+	}
+	s.broadcastVMsChanged(hostID)
+	return att, nil
+}
+
+// recordMediaAttachment points a CD-ROM drive's attachment at the disc now
+// in it. An empty drive uses the placeholder disk host syncs record for it.
+func (s *HostService) recordMediaAttachment(vmUUID string, drive libvirt.DiskDevice, vol *storage.Volume) (*storage.DiskAttachment, error) {
+	tx := s.db.Begin()
+	var disks []storage.Disk
+	if vol != nil {
+		tx.Where("path = ?", vol.Path).Limit(1).Find(&disks)
+	} else {
+		tx.Where("name = ? AND path = ?", fmt.Sprintf("disk-%s", drive.Target), "").Limit(1).Find(&disks)
+	}
+	var disk storage.Disk
+	if len(disks) > 0 {
+		disk = disks[0]
+	} else {
+		disk = storage.Disk{
+			Name:       fmt.Sprintf("disk-%s", drive.Target),
+			Format:     drive.Format,
+			DriverJSON: diskDriverJSON(drive.Format, drive.Cache),
+			State:      string(storage.StorageStateAvailable),
+		}
+		if vol != nil {
+			disk.Name = normalizeStorageName(vol.Path)
+			disk.VolumeID = &vol.ID
+			disk.Path = vol.Path
+			disk.CapacityBytes = vol.CapacityBytes
+		}
+		if err := tx.Create(&disk).Error; err != nil {
+			tx.Rollback()
+			return nil, fmt.Errorf("failed to save disk for %s: %w", drive.Target, err)
+		}
+	}
+
+	var att storage.DiskAttachment
+	err := tx.Where("vm_uuid = ? AND device_name = ?", vmUUID, drive.Target).First(&att).Error
+	switch {
+	case err == gorm.ErrRecordNotFound:
+		att = storage.DiskAttachment{
+			VMUUID:     vmUUID,
+			DiskID:     disk.ID,
+			DeviceName: drive.Target,
+			BusType:    drive.Bus,
+			ReadOnly:   true,
+			Metadata:   cdromMetadata,
+		}
+		if err := tx.Create(&att).Error; err != nil {
+			tx.Rollback()
+			return nil, fmt.Errorf("failed to attach disk for %s: %w", drive.Target, err)
+		}
+		// Discs are read-only, so the index does not claim the disk.
+		if err := s.ensureAttachmentIndex(tx, storage.AttachmentIndex{VMUUID: vmUUID, DeviceType: "disk", AttachmentID: att.ID}); err != nil {
+			tx.Rollback()
+			return nil, err
+		}
+	case err != nil:
+		tx.Rollback()
+		return nil, fmt.Errorf("failed to load disk attachment %s: %w", drive.Target, err)
+	default:
+		if err := tx.Model(&att).Updates(map[string]interface{}{"disk_id": disk.ID, "read_only": true}).Error; err != nil {
+			tx.Rollback()
+			return nil, fmt.Errorf("failed to update disk attachment %s: %w", drive.Target, err)
+		}
+	}
+	if err := tx.Commit().Error; err != nil {
+		return nil, fmt.Errorf("failed to update disk attachment %s: %w", drive.Target, err)
+	}
+	if err := s.db.Preload("Disk").First(&att, "id = ?", att.ID).Error; err != nil {
+		return nil, fmt.Errorf("failed to reload disk attachment %s: %w", drive.Target, err)
+	}
+	return &att, nil
+}
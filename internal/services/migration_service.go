@@ -0,0 +1,332 @@
+package services
+
+import (
+	"fmt"
+	"net/url"
+	"sync"
+	"time"
+
+	"github.com/capsali/virtumancer/internal/libvirt"
+	log "github.com/capsali/virtumancer/internal/logging"
+	"github.com/capsali/virtumancer/internal/storage"
+	"github.com/capsali/virtumancer/internal/ws"
+	golibvirt "github.com/digitalocean/go-libvirt"
+	"gorm.io/gorm"
+)
+
+// Migration modes reported back to callers.
+const (
+	MigrationModeLive    = "live"
+	MigrationModeOffline = "offline"
+)
+
+// migrationProgressInterval is how often the source host is asked for job
+// progress while a live migration runs.
+var migrationProgressInterval = time.Second
+
+// MigrationRequest describes moving a VM to another managed host.
+type MigrationRequest struct {
+	TargetHostID string `json:"target_host_id"`
+	// Offline moves only the definition of a shut-off VM. It is used
+	// automatically when the VM is not running.
+	Offline bool `json:"offline"`
+	// CopyStorage copies the VM's disks to the target during a live
+	// migration, for hosts that do not share storage.
+	CopyStorage    bool   `json:"copy_storage"`
+	BandwidthMiBps uint64 `json:"bandwidth_mibps"`
+	// DestinationURI is the URI the source host's daemon uses to reach the
+	// target. It defaults to the target host's own URI.
+	DestinationURI string `json:"destination_uri,omitempty"`
+}
+
+// MigrationResult reports where a VM ended up and how it got there.
+type MigrationResult struct {
+	HostID string `json:"host_id"`
+	Mode   string `json:"mode"`
+}
+
+// broadcastMigrationProgress reports a migration moving through "started",
+// any number of "running" updates carrying job progress, then "completed" or
+// "failed".
+func (s *HostService) broadcastMigrationProgress(hostID, vmName, targetHostID, mode, status string, job *libvirt.DomainJobInfo, opErr error) {
+	payload := ws.MessagePayload{
+		"hostId":       hostID,
+		"vmName":       vmName,
+		"targetHostId": targetHostID,
+		"mode":         mode,
+		"status":       status,
+	}
+	if job != nil {
+		payload["percent"] = job.Percent()
+		payload["data_total"] = job.DataTotal
+		payload["data_processed"] = job.DataProcessed
+		payload["data_remaining"] = job.DataRemaining
+		payload["time_elapsed_ms"] = job.TimeElapsed
+		payload["time_remaining_ms"] = job.TimeRemaining
+	}
+	if opErr != nil {
+		payload["error"] = opErr.Error()
+	}
+	s.hub.BroadcastMessage(ws.Message{Type: "vm-migration-progress", Payload: payload})
+}
+
+// MigrateVM moves a VM to another host. Running VMs are migrated live by the
+// source daemon, peer to peer; shut-off VMs have their definition copied
+// across Virtumancer's own connections. Either way the VM's records follow it
+// to the target host.
+func (s *HostService) MigrateVM(hostID, vmName string, req MigrationRequest) (*MigrationResult, error) {
+	if req.TargetHostID == "" {
+		return nil, fmt.Errorf("invalid migration: target host is required")
+	}
+	if req.TargetHostID == hostID {
+		return nil, fmt.Errorf("invalid migration: vm %s is already on host %s", vmName, hostID)
+	}
+	vm, err := s.findVM(hostID, vmName)
+	if err != nil {
+		return nil, err
+	}
+	if err := s.ensureNotLinkedCloneBase(hostID, vmName, "migrated"); err != nil {
+		return nil, err
+	}
+	var target storage.Host
+	if err := s.db.Where("id = ?", req.TargetHostID).First(&target).Error; err != nil {
+		return nil, fmt.Errorf("target host %s not found: %w", req.TargetHostID, err)
+	}
+	if !s.connector.IsConnected(hostID) {
+		return nil, fmt.Errorf("host %s is disconnected", hostID)
+	}
+	if !s.connector.IsConnected(target.ID) {
+		return nil, fmt.Errorf("target host %s is disconnected", target.ID)
+	}
+
+	var clashes int64
+	if err := s.db.Model(&storage.VirtualMachine{}).Where("host_id = ? AND name = ?", target.ID, vmName).Count(&clashes).Error; err != nil {
+		return nil, fmt.Errorf("failed to check target host %s for vm %s: %w", target.ID, vmName, err)
+	}
+	if _, err := s.connector.GetDomainInfo(target.ID, vmName); err == nil || clashes > 0 {
+		return nil, fmt.Errorf("vm name %s is already in use on host %s", vmName, target.ID)
+	}
+
+	info, err := s.connector.GetDomainInfo(hostID, vmName)
+	if err != nil {
+		return nil, err
+	}
+	running := info.State == golibvirt.DomainRunning || info.State == golibvirt.DomainPaused
+	mode := MigrationModeLive
+	if !running {
+		mode = MigrationModeOffline
+	}
+	var spec libvirt.MigrationSpec
+	switch {
+	case running && req.Offline:
+		return nil, fmt.Errorf("invalid migration: vm %s is running; shut it down for an offline migration", vmName)
+	case !running && req.CopyStorage:
+		return nil, fmt.Errorf("invalid migration: copy_storage needs a running vm; an offline migration moves only the definition")
+	case running:
+		spec = libvirt.MigrationSpec{
+			DestinationURI: req.DestinationURI,
+			Live:           info.State == golibvirt.DomainRunning,
+			CopyStorage:    req.CopyStorage,
+			BandwidthMiBps: req.BandwidthMiBps,
+		}
+		if spec.DestinationURI == "" {
+			spec.DestinationURI = target.URI
+		}
+		if uri, err := url.Parse(spec.DestinationURI); err != nil || uri.Host == "" {
+			return nil, fmt.Errorf("invalid migration: %q is not a remote URI the source host can reach; set destination_uri", spec.DestinationURI)
+		}
+	}
+
+	if err := s.defineVMSecurityFilters(vm.ID, target.ID); err != nil {
+		return nil, err
+	}
+
+	// The task state also keeps host syncs from pruning the VM while its
+	// domain exists on neither host or on both.
+	if err := s.db.Model(&storage.VirtualMachine{}).Where("id = ?", vm.ID).Update("task_state", storage.TaskStateMigrating).Error; err != nil {
+		return nil, fmt.Errorf("failed to set task state for %s: %w", vmName, err)
+	}
+	disks := s.db.Model(&storage.DiskAttachment{}).Select("disk_id").Where("vm_uuid = ?", vm.ID)
+	if spec.CopyStorage {
+		if err := s.db.Model(&storage.Disk{}).Where("id IN (?)", disks).Update("task_state", storage.StorageTaskMigrating).Error; err != nil {
+			log.Verbosef("Warning: failed to set task state of disks of %s: %v", vmName, err)
+		}
+	}
+	s.broadcastVMsChanged(hostID)
+	s.broadcastMigrationProgress(hostID, vmName, target.ID, mode, "started", nil, nil)
+
+	if mode == MigrationModeLive {
+		err = s.migrateLive(hostID, vmName, target.ID, spec)
+	} else {
+		err = s.migrateOffline(hostID, vmName, target.ID)
+	}
+	if err == nil {
+		err = s.moveVMRecords(vm, target.ID, spec.CopyStorage)
+	}
+	if spec.CopyStorage {
+		if err := s.db.Model(&storage.Disk{}).Where("id IN (?)", disks).Update("task_state", "").Error; err != nil {
+			log.Verbosef("Warning: failed to clear task state of disks of %s: %v", vmName, err)
+		}
+	}
+	if err != nil {
+		s.db.Model(&storage.VirtualMachine{}).Where("id = ?", vm.ID).Update("task_state", "")
+		s.broadcastVMsChanged(hostID)
+		s.broadcastMigrationProgress(hostID, vmName, target.ID, mode, "failed", nil, err)
+		return nil, err
+	}
+
+	log.Infof("Migrated VM %s from host %s to host %s (%s)", vmName, hostID, target.ID, mode)
+	if _, err := s.detectDriftOrIngestVM(target.ID, vmName, false); err != nil {
+		log.Verbosef("Warning: failed to sync VM %s on host %s after migration: %v", vmName, target.ID, err)
+	}
+	s.broadcastMigrationProgress(hostID, vmName, target.ID, mode, "completed", nil, nil)
+	s.broadcastVMsChanged(hostID)
+	s.broadcastVMsChanged(target.ID)
+	s.broadcastDiscoveredVMsChanged(target.ID)
+	return &MigrationResult{HostID: target.ID, Mode: mode}, nil
+}
+
+// migrateLive runs a peer-to-peer migration, relaying the source's job
+// progress until it returns.
+func (s *HostService) migrateLive(hostID, vmName, targetHostID string, spec libvirt.MigrationSpec) error {
+	done := make(chan struct{})
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		ticker := time.NewTicker(migrationProgressInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-done:
+				return
+			case <-ticker.C:
+				job, err := s.connector.GetDomainJobInfo(hostID, vmName)
+				if err != nil || job == nil || !job.Active() {
+					continue
+				}
+				s.broadcastMigrationProgress(hostID, vmName, targetHostID, MigrationModeLive, "running", job, nil)
+			}
+		}
+	}()
+
+	err := s.connector.MigrateDomain(hostID, vmName, spec)
+	close(done)
+	wg.Wait()
+	return err
+}
+
+// migrateOffline copies the definition of a shut-off VM to the target and
+// removes it from the source. Disks are not copied, so each one must already
+// be visible on the target.
+func (s *HostService) migrateOffline(hostID, vmName, targetHostID string) error {
+	hardware, err := s.connector.GetDomainHardware(hostID, vmName)
+	if err != nil {
+		return err
+	}
+	for _, disk := range hardware.Disks {
+		if disk.Device != "disk" || disk.Path == "" {
+			continue
+		}
+		if _, err := s.connector.GetDiskSize(targetHostID, disk.Path); err != nil {
+			return fmt.Errorf("invalid migration: disk %s is not available on host %s; an offline migration needs shared storage", disk.Path, targetHostID)
+		}
+	}
+
+	domainXML, err := s.connector.GetDomainXML(hostID, vmName)
+	if err != nil {
+		return err
+	}
+	if _, err := s.connector.DefineAndCreateDomain(targetHostID, domainXML); err != nil {
+		return err
+	}
+	if err := s.connector.UndefineDomain(hostID, vmName); err != nil {
+		// Keep a single definition so the VM is not managed twice.
+		if rbErr := s.connector.UndefineDomain(targetHostID, vmName); rbErr != nil {
+			log.Warnf("Failed to remove definition of %s from host %s after a failed migration: %v", vmName, targetHostID, rbErr)
+		}
+		return err
+	}
+	return nil
+}
+
+// moveVMRecords re-homes a VM and its host-scoped rows on the target host.
+// When its disks were copied, their volumes move to the pools of the same
+// name on the target.
+func (s *HostService) moveVMRecords(vm *storage.VirtualMachine, targetHostID string, copiedStorage bool) error {
+	if copiedStorage {
+		// The copies may have landed in pools the database has not seen.
+		if _, err := s.syncHostStoragePools(targetHostID); err != nil {
+			log.Verbosef("Warning: failed to sync storage pools of host %s: %v", targetHostID, err)
+		}
+	}
+	tx := s.db.Begin()
+	if err := tx.Model(&storage.VirtualMachine{}).Where("id = ?", vm.ID).Updates(map[string]interface{}{
+		"host_id":    targetHostID,
+		"task_state": "",
+	}).Error; err != nil {
+		tx.Rollback()
+		return fmt.Errorf("failed to move vm %s to host %s: %w", vm.Name, targetHostID, err)
+	}
+	if err := tx.Model(&storage.Console{}).Where("vm_uuid = ?", vm.ID).Update("host_id", targetHostID).Error; err != nil {
+		tx.Rollback()
+		return fmt.Errorf("failed to move consoles of vm %s: %w", vm.Name, err)
+	}
+	ports := tx.Model(&storage.PortAttachment{}).Select("port_id").Where("vm_uuid = ?", vm.ID)
+	if err := tx.Model(&storage.Port{}).Where("host_id = ? AND id IN (?)", vm.HostID, ports).Update("host_id", targetHostID).Error; err != nil {
+		tx.Rollback()
+		return fmt.Errorf("failed to move ports of vm %s: %w", vm.Name, err)
+	}
+	if err := tx.Model(&storage.PortAttachment{}).Where("vm_uuid = ?", vm.ID).Update("host_id", targetHostID).Error; err != nil {
+		tx.Rollback()
+		return fmt.Errorf("failed to move port attachments of vm %s: %w", vm.Name, err)
+	}
+	if copiedStorage {
+		if err := moveCopiedVolumes(tx, vm, targetHostID); err != nil {
+			tx.Rollback()
+			return err
+		}
+	}
+	// The target may have seen the domain appear before it was ours.
+	if err := tx.Where("host_id = ? AND domain_uuid = ?", targetHostID, vm.DomainUUID).Delete(&storage.DiscoveredVM{}).Error; err != nil {
+		tx.Rollback()
+		return fmt.Errorf("failed to clear discovered vm %s on host %s: %w", vm.Name, targetHostID, err)
+	}
+	return tx.Commit().Error
+}
+
+// moveCopiedVolumes points the volumes a storage-copying migration copied
+// at the target host's pool of the same name. Read-only and shareable disks
+// are not copied, and volumes whose pool has no counterpart stay where they
+// are.
+func moveCopiedVolumes(tx *gorm.DB, vm *storage.VirtualMachine, targetHostID string) error {
+	var atts []storage.DiskAttachment
+	if err := tx.Preload("Disk").Where("vm_uuid = ? AND read_only = ? AND shareable = ?", vm.ID, false, false).Find(&atts).Error; err != nil {
+		return fmt.Errorf("failed to load disks of vm %s: %w", vm.Name, err)
+	}
+	for _, att := range atts {
+		if att.Disk.VolumeID == nil {
+			continue
+		}
+		var vol storage.Volume
+		if err := tx.Where("id = ?", *att.Disk.VolumeID).First(&vol).Error; err != nil {
+			return fmt.Errorf("volume of disk %s of vm %s not found: %w", att.DeviceName, vm.Name, err)
+		}
+		var source storage.StoragePool
+		if err := tx.Where("id = ?", vol.StoragePoolID).First(&source).Error; err != nil || source.HostID == targetHostID {
+			continue
+		}
+		var pools []storage.StoragePool
+		if err := tx.Where("host_id = ? AND name = ?", targetHostID, source.Name).Limit(1).Find(&pools).Error; err != nil {
+			return fmt.Errorf("failed to look up pool %s on host %s: %w", source.Name, targetHostID, err)
+		}
+		if len(pools) == 0 {
+			log.Warnf("Volume %s of vm %s has no pool %s on host %s to move to", vol.Path, vm.Name, source.Name, targetHostID)
+			continue
+		}
+		if err := tx.Model(&storage.Volume{}).Where("id = ?", vol.ID).Update("storage_pool_id", pools[0].ID).Error; err != nil {
+			return fmt.Errorf("failed to move volume %s of vm %s: %w", vol.Path, vm.Name, err)
+		}
+	}
+	return nil
+}
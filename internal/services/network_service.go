@@ -0,0 +1,354 @@
+package services
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/capsali/virtumancer/internal/libvirt"
+	log "github.com/capsali/virtumancer/internal/logging"
+	"github.com/capsali/virtumancer/internal/storage"
+)
+
+// NetworkCreateRequest defines a virtual network and optionally starts it.
+type NetworkCreateRequest struct {
+	libvirt.NetworkSpec
+	Start     bool `json:"start"`
+	Autostart bool `json:"autostart"`
+}
+
+// NetworkAutostartRequest sets whether a network starts with libvirt.
+type NetworkAutostartRequest struct {
+	Autostart bool `json:"autostart"`
+}
+
+// NetworkDetail is a virtual network with its libvirt definition.
+type NetworkDetail struct {
+	storage.Network
+	Spec libvirt.NetworkSpec `json:"spec"`
+}
+
+// syncHostNetworks mirrors a host's libvirt networks into the database.
+// Rows for networks that are gone are pruned unless ports still bind to
+// them.
+func (s *HostService) syncHostNetworks(hostID string) error {
+	live, err := s.connector.ListAllNetworks(hostID)
+	if err != nil {
+		return fmt.Errorf("service failed to list networks for host %s: %w", hostID, err)
+	}
+	liveNames := make(map[string]bool, len(live))
+	for _, info := range live {
+		liveNames[info.Spec.Name] = true
+		state := "inactive"
+		if info.Active {
+			state = "active"
+		}
+		var existing []storage.Network
+		s.db.Where("host_id = ? AND name = ?", hostID, info.Spec.Name).Limit(1).Find(&existing)
+		if len(existing) == 0 {
+			network := storage.Network{
+				HostID:     hostID,
+				Name:       info.Spec.Name,
+				UUID:       info.UUID,
+				BridgeName: info.Spec.Bridge,
+				Mode:       info.Spec.Mode,
+				State:      state,
+				Autostart:  info.Autostart,
+			}
+			if err := s.db.Create(&network).Error; err != nil {
+				log.Verbosef("Error creating network %s: %v", info.Spec.Name, err)
+			}
+			continue
+		}
+		updates := map[string]interface{}{
+			"uuid":        info.UUID,
+			"bridge_name": info.Spec.Bridge,
+			"mode":        info.Spec.Mode,
+			"state":       state,
+			"autostart":   info.Autostart,
+		}
+		if err := s.db.Model(&existing[0]).Updates(updates).Error; err != nil {
+			log.Verbosef("Error updating network %s: %v", info.Spec.Name, err)
+		}
+	}
+
+	var known []storage.Network
+	if err := s.db.Where("host_id = ? AND uuid <> ?", hostID, "").Find(&known).Error; err != nil {
+		return fmt.Errorf("could not get network records for pruning check: %w", err)
+	}
+	for _, network := range known {
+		if liveNames[network.Name] {
+			continue
+		}
+		var bindings int64
+		s.db.Model(&storage.PortBinding{}).Where("network_id = ?", network.ID).Count(&bindings)
+		if bindings > 0 {
+			continue
+		}
+		log.Verbosef("Pruning network %s from database as it's no longer in libvirt.", network.Name)
+		if err := s.db.Unscoped().Delete(&network).Error; err != nil {
+			log.Verbosef("Warning: failed to prune network %s: %v", network.Name, err)
+		}
+	}
+	return nil
+}
+
+// findNetwork loads a network on a connected host.
+func (s *HostService) findNetwork(networkID string) (*storage.Network, error) {
+	var network storage.Network
+	if err := s.db.Where("id = ?", networkID).First(&network).Error; err != nil {
+		return nil, fmt.Errorf("network %s not found: %w", networkID, err)
+	}
+	if !s.connector.IsConnected(network.HostID) {
+		return nil, fmt.Errorf("host %s is disconnected", network.HostID)
+	}
+	return &network, nil
+}
+
+// networkDetail syncs a host's networks and returns one with its
+// definition. DHCP reservations name the managed port holding their MAC.
+func (s *HostService) networkDetail(hostID, name string) (*NetworkDetail, error) {
+	if err := s.syncHostNetworks(hostID); err != nil {
+		return nil, err
+	}
+	info, err := s.connector.GetNetwork(hostID, name)
+	if err != nil {
+		return nil, err
+	}
+	var network storage.Network
+	if err := s.db.Where("host_id = ? AND name = ?", hostID, name).First(&network).Error; err != nil {
+		return nil, fmt.Errorf("network %s not found on host %s: %w", name, hostID, err)
+	}
+	for i := range info.Spec.IPs {
+		for j := range info.Spec.IPs[i].DHCPHosts {
+			h := &info.Spec.IPs[i].DHCPHosts[j]
+			if h.MAC == "" {
+				continue
+			}
+			var ports []storage.Port
+			s.db.Where("LOWER(mac_address) = ?", strings.ToLower(h.MAC)).Limit(1).Find(&ports)
+			if len(ports) > 0 {
+				h.PortID = ports[0].ID
+			}
+		}
+	}
+	return &NetworkDetail{Network: network, Spec: info.Spec}, nil
+}
+
+// resolveNetworkPorts fills in the MACs of DHCP reservations made for a
+// port and puts all MACs in libvirt's form.
+func (s *HostService) resolveNetworkPorts(spec *libvirt.NetworkSpec) error {
+	for i := range spec.IPs {
+		for j := range spec.IPs[i].DHCPHosts {
+			h := &spec.IPs[i].DHCPHosts[j]
+			if h.PortID != "" {
+				var port storage.Port
+				if err := s.db.Where("id = ?", h.PortID).First(&port).Error; err != nil {
+					return fmt.Errorf("port %s not found: %w", h.PortID, err)
+				}
+				if h.MAC != "" && !strings.EqualFold(h.MAC, port.MACAddress) {
+					return fmt.Errorf("invalid network: DHCP host %s names port %s but MAC %s", h.IP, h.PortID, h.MAC)
+				}
+				h.MAC = port.MACAddress
+			}
+			h.MAC = strings.ToLower(h.MAC)
+		}
+	}
+	return nil
+}
+
+// networkUsers returns the managed VMs with a NIC on a network.
+func (s *HostService) networkUsers(network storage.Network) ([]storage.VirtualMachine, error) {
+	ports := s.db.Model(&storage.PortBinding{}).Select("port_id").Where("network_id = ?", network.ID)
+	vmUUIDs := s.db.Model(&storage.PortAttachment{}).Select("vm_uuid").Where("port_id IN (?)", ports)
+	var vms []storage.VirtualMachine
+	if err := s.db.Where("id IN (?)", vmUUIDs).Order("name").Find(&vms).Error; err != nil {
+		return nil, fmt.Errorf("failed to load VMs using network %s: %w", network.Name, err)
+	}
+	return vms, nil
+}
+
+// ensureNetworkUnused refuses to take a network away from managed VMs.
+func (s *HostService) ensureNetworkUnused(network storage.Network) error {
+	vms, err := s.networkUsers(network)
+	if err != nil {
+		return err
+	}
+	if len(vms) > 0 {
+		return fmt.Errorf("network %s is in use by vm %s", network.Name, vms[0].Name)
+	}
+	return nil
+}
+
+// CreateNetwork defines a virtual network on a host, then starts it and
+// marks it to autostart as asked. A network that fails to start is
+// undefined again.
+func (s *HostService) CreateNetwork(hostID string, req NetworkCreateRequest) (*NetworkDetail, error) {
+	if err := s.resolveNetworkPorts(&req.NetworkSpec); err != nil {
+		return nil, err
+	}
+	if err := req.Validate(); err != nil {
+		return nil, err
+	}
+	if err := s.EnsureHostConnected(hostID); err != nil {
+		return nil, fmt.Errorf("failed to connect to host %s: %w", hostID, err)
+	}
+	if _, err := s.connector.GetNetwork(hostID, req.Name); err == nil {
+		return nil, fmt.Errorf("network name %s is already in use on host %s", req.Name, hostID)
+	}
+
+	if err := s.connector.DefineNetwork(hostID, req.NetworkSpec); err != nil {
+		return nil, err
+	}
+	if req.Start {
+		if err := s.connector.StartNetwork(hostID, req.Name); err != nil {
+			if undefineErr := s.connector.UndefineNetwork(hostID, req.Name); undefineErr != nil {
+				log.Warnf("Failed to undefine network %s on host %s after a failed start: %v", req.Name, hostID, undefineErr)
+			}
+			return nil, err
+		}
+	}
+	if req.Autostart {
+		if err := s.connector.SetNetworkAutostart(hostID, req.Name, true); err != nil {
+			log.Warnf("Network %s on host %s was created but autostart could not be set: %v", req.Name, hostID, err)
+		}
+	}
+	log.Infof("Created %s network %s on host %s", req.Mode, req.Name, hostID)
+	return s.networkDetail(hostID, req.Name)
+}
+
+// GetNetwork returns a virtual network with its definition.
+func (s *HostService) GetNetwork(networkID string) (*NetworkDetail, error) {
+	network, err := s.findNetwork(networkID)
+	if err != nil {
+		return nil, err
+	}
+	return s.networkDetail(network.HostID, network.Name)
+}
+
+// UpdateNetwork replaces a network's definition with spec. Changes to DHCP
+// ranges, DHCP reservations and DNS hosts are applied in place, so a
+// running network keeps serving its guests; anything else needs the
+// network stopped first. An empty bridge keeps the current one.
+func (s *HostService) UpdateNetwork(networkID string, spec libvirt.NetworkSpec) (*NetworkDetail, error) {
+	network, err := s.findNetwork(networkID)
+	if err != nil {
+		return nil, err
+	}
+	current, err := s.connector.GetNetwork(network.HostID, network.Name)
+	if err != nil {
+		return nil, err
+	}
+	if spec.Name == "" {
+		spec.Name = network.Name
+	}
+	if spec.Name != network.Name {
+		return nil, fmt.Errorf("invalid network: networks cannot be renamed")
+	}
+	if spec.Bridge == "" && spec.Mode != "bridge" {
+		spec.Bridge = current.Spec.Bridge
+	}
+	if err := s.resolveNetworkPorts(&spec); err != nil {
+		return nil, err
+	}
+	if err := spec.Validate(); err != nil {
+		return nil, err
+	}
+
+	changes, live := libvirt.NetworkLiveChanges(current.Spec, spec)
+	switch {
+	case live && len(changes) > 0:
+		if err := s.connector.UpdateNetwork(network.HostID, network.Name, changes); err != nil {
+			return nil, err
+		}
+		log.Infof("Applied %d changes to network %s on host %s", len(changes), network.Name, network.HostID)
+	case live:
+	case current.Active:
+		return nil, fmt.Errorf("invalid network update: network %s is active; only DHCP ranges, DHCP hosts and DNS hosts can change while it runs", network.Name)
+	default:
+		if err := s.connector.DefineNetwork(network.HostID, spec); err != nil {
+			return nil, err
+		}
+		log.Infof("Redefined network %s on host %s", network.Name, network.HostID)
+	}
+	return s.networkDetail(network.HostID, network.Name)
+}
+
+// StartNetwork activates a network.
+func (s *HostService) StartNetwork(networkID string) (*NetworkDetail, error) {
+	network, err := s.findNetwork(networkID)
+	if err != nil {
+		return nil, err
+	}
+	if err := s.connector.StartNetwork(network.HostID, network.Name); err != nil {
+		return nil, err
+	}
+	log.Infof("Started network %s on host %s", network.Name, network.HostID)
+	return s.networkDetail(network.HostID, network.Name)
+}
+
+// StopNetwork deactivates a network that no managed VM has a NIC on.
+func (s *HostService) StopNetwork(networkID string) (*NetworkDetail, error) {
+	network, err := s.findNetwork(networkID)
+	if err != nil {
+		return nil, err
+	}
+	if err := s.ensureNetworkUnused(*network); err != nil {
+		return nil, err
+	}
+	if err := s.connector.StopNetwork(network.HostID, network.Name); err != nil {
+		return nil, err
+	}
+	log.Infof("Stopped network %s on host %s", network.Name, network.HostID)
+	return s.networkDetail(network.HostID, network.Name)
+}
+
+// SetNetworkAutostart sets whether a network starts with libvirt.
+func (s *HostService) SetNetworkAutostart(networkID string, req NetworkAutostartRequest) (*NetworkDetail, error) {
+	network, err := s.findNetwork(networkID)
+	if err != nil {
+		return nil, err
+	}
+	if err := s.connector.SetNetworkAutostart(network.HostID, network.Name, req.Autostart); err != nil {
+		return nil, err
+	}
+	return s.networkDetail(network.HostID, network.Name)
+}
+
+// DeleteNetwork stops and undefines a network that no managed VM has a
+// NIC on.
+func (s *HostService) DeleteNetwork(networkID string) error {
+	network, err := s.findNetwork(networkID)
+	if err != nil {
+		return err
+	}
+	if err := s.ensureNetworkUnused(*network); err != nil {
+		return err
+	}
+	info, err := s.connector.GetNetwork(network.HostID, network.Name)
+	if err != nil {
+		return err
+	}
+	if info.Active {
+		if err := s.connector.StopNetwork(network.HostID, network.Name); err != nil {
+			return err
+		}
+	}
+	if err := s.connector.UndefineNetwork(network.HostID, network.Name); err != nil {
+		return err
+	}
+
+	tx := s.db.Begin()
+	if err := tx.Unscoped().Where("network_id = ?", network.ID).Delete(&storage.PortBinding{}).Error; err != nil {
+		tx.Rollback()
+		return fmt.Errorf("failed to delete port bindings of network %s: %w", network.Name, err)
+	}
+	if err := tx.Unscoped().Delete(network).Error; err != nil {
+		tx.Rollback()
+		return fmt.Errorf("failed to delete network %s: %w", network.Name, err)
+	}
+	if err := tx.Commit().Error; err != nil {
+		return fmt.Errorf("failed to delete network %s: %w", network.Name, err)
+	}
+	log.Infof("Deleted network %s on host %s", network.Name, network.HostID)
+	return nil
+}
@@ -0,0 +1,455 @@
+package services
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"strings"
+
+	"github.com/capsali/virtumancer/internal/libvirt"
+	log "github.com/capsali/virtumancer/internal/logging"
+	"github.com/capsali/virtumancer/internal/storage"
+	"gorm.io/gorm"
+)
+
+// NIC source types, matching libvirt's <interface type='...'>.
+const (
+	NICTypeNetwork = "network"
+	NICTypeBridge  = "bridge"
+	NICTypeDirect  = "direct"
+)
+
+// directModes are the macvtap modes libvirt accepts for direct NICs.
+var directModes = map[string]bool{
+	"vepa":        true,
+	"bridge":      true,
+	"private":     true,
+	"passthrough": true,
+}
+
+// NICAttachRequest describes a NIC to add to a VM.
+type NICAttachRequest struct {
+	// Type is "network", "bridge" or "direct". Source is the libvirt
+	// network, host bridge or host interface the NIC connects to.
+	Type      string `json:"type"`
+	Source    string `json:"source"`
+	Mode      string `json:"mode,omitempty"`
+	PortGroup string `json:"port_group,omitempty"`
+	// Model defaults to virtio and MAC to a generated address.
+	Model     string `json:"model,omitempty"`
+	MAC       string `json:"mac,omitempty"`
+	LinkState string `json:"link_state,omitempty"`
+	VLANs     []uint `json:"vlans,omitempty"`
+}
+
+// NICUpdateRequest changes an attached NIC. Nil fields are left as they
+// are; Type and Source move the NIC to another network together.
+type NICUpdateRequest struct {
+	Type      *string `json:"type,omitempty"`
+	Source    *string `json:"source,omitempty"`
+	Mode      *string `json:"mode,omitempty"`
+	PortGroup *string `json:"port_group,omitempty"`
+	LinkState *string `json:"link_state,omitempty"`
+	VLANs     *[]uint `json:"vlans,omitempty"`
+}
+
+// normalizeMAC validates a MAC address and returns it in libvirt's
+// lowercase, colon-separated form.
+func normalizeMAC(mac string) (string, error) {
+	hw, err := net.ParseMAC(mac)
+	if err != nil || len(hw) != 6 {
+		return "", fmt.Errorf("invalid nic: bad MAC address %q", mac)
+	}
+	if hw[0]&1 == 1 {
+		return "", fmt.Errorf("invalid nic: %s is a multicast MAC address", mac)
+	}
+	return hw.String(), nil
+}
+
+func validateNIC(nic libvirt.InterfaceDevice) error {
+	switch nic.Type {
+	case NICTypeNetwork, NICTypeBridge:
+	case NICTypeDirect:
+		if !directModes[nic.Mode] {
+			return fmt.Errorf("invalid nic: unsupported direct mode %q", nic.Mode)
+		}
+	default:
+		return fmt.Errorf("invalid nic: unsupported type %q", nic.Type)
+	}
+	if nic.Source == "" {
+		return fmt.Errorf("invalid nic: source is required")
+	}
+	if nic.PortGroup != "" && nic.Type != NICTypeNetwork {
+		return fmt.Errorf("invalid nic: port groups only apply to network NICs")
+	}
+	switch nic.LinkState {
+	case "", "up", "down":
+	default:
+		return fmt.Errorf("invalid nic: link state must be up or down")
+	}
+	for _, id := range nic.VLANs {
+		if id > 4095 {
+			return fmt.Errorf("invalid nic: VLAN tag %d is out of range", id)
+		}
+	}
+	return nil
+}
+
+// findOrCreateNICNetwork returns the Network row a NIC source binds to,
+// creating it the way host syncs would when the source is not known yet.
+func (s *HostService) findOrCreateNICNetwork(tx *gorm.DB, hostID, nicType, source string) (storage.Network, error) {
+	var nets []storage.Network
+	query := tx.Where("host_id = ? AND name = ?", hostID, source)
+	if nicType == NICTypeBridge {
+		query = tx.Where("host_id = ? AND (name = ? OR bridge_name = ?)", hostID, source, source)
+	}
+	if err := query.Limit(1).Find(&nets).Error; err != nil {
+		return storage.Network{}, fmt.Errorf("failed to load network %s: %w", source, err)
+	}
+	if len(nets) > 0 {
+		return nets[0], nil
+	}
+	network := storage.Network{HostID: hostID, Name: source}
+	switch nicType {
+	case NICTypeNetwork:
+		network.Mode = "nat"
+	case NICTypeBridge:
+		network.BridgeName = source
+		network.Mode = "bridged"
+	case NICTypeDirect:
+		network.Mode = "direct"
+	}
+	if err := tx.Create(&network).Error; err != nil {
+		return storage.Network{}, fmt.Errorf("failed to save network %s: %w", source, err)
+	}
+	return network, nil
+}
+
+// findVMNIC returns the NIC of a VM's domain with the given MAC address.
+func (s *HostService) findVMNIC(hostID, vmName, mac string) (*libvirt.NetworkInfo, error) {
+	hardware, err := s.connector.GetDomainHardware(hostID, vmName)
+	if err != nil {
+		return nil, err
+	}
+	for i := range hardware.Networks {
+		if strings.EqualFold(hardware.Networks[i].Mac.Address, mac) {
+			return &hardware.Networks[i], nil
+		}
+	}
+	return nil, fmt.Errorf("nic %s not found on vm %s", mac, vmName)
+}
+
+// nicPortFields are the Port columns that mirror a NIC's configuration.
+func nicPortFields(nic libvirt.InterfaceDevice) map[string]interface{} {
+	fields := map[string]interface{}{
+		"model_name":     nic.Model,
+		"source_type":    nic.Type,
+		"source_ref":     nic.Source,
+		"port_group":     nic.PortGroup,
+		"vlan_tags_json": "",
+		"primary_vlan":   nil,
+	}
+	if len(nic.VLANs) > 0 {
+		tags, _ := json.Marshal(nic.VLANs)
+		fields["vlan_tags_json"] = string(tags)
+		primary := int(nic.VLANs[0])
+		fields["primary_vlan"] = &primary
+	}
+	return fields
+}
+
+// AttachVMNIC adds a NIC to a VM, hotplugging it when the VM is running.
+func (s *HostService) AttachVMNIC(hostID, vmName string, req NICAttachRequest) (*storage.PortAttachment, error) {
+	nic := libvirt.InterfaceDevice{
+		Type:      req.Type,
+		Source:    req.Source,
+		Mode:      req.Mode,
+		PortGroup: req.PortGroup,
+		Model:     req.Model,
+		LinkState: req.LinkState,
+		VLANs:     req.VLANs,
+	}
+	if nic.Model == "" {
+		nic.Model = "virtio"
+	}
+	if nic.Type == NICTypeDirect && nic.Mode == "" {
+		nic.Mode = "bridge"
+	}
+	if err := validateNIC(nic); err != nil {
+		return nil, err
+	}
+	if req.MAC != "" {
+		mac, err := normalizeMAC(req.MAC)
+		if err != nil {
+			return nil, err
+		}
+		nic.MAC = mac
+	} else {
+		mac, err := libvirt.GenerateMAC()
+		if err != nil {
+			return nil, err
+		}
+		nic.MAC = mac
+	}
+
+	vm, err := s.findVM(hostID, vmName)
+	if err != nil {
+		return nil, err
+	}
+	if !s.connector.IsConnected(hostID) {
+		return nil, fmt.Errorf("host %s is disconnected", hostID)
+	}
+	var inUse []storage.PortAttachment
+	if err := s.db.Where("LOWER(mac_address) = ?", nic.MAC).Limit(1).Find(&inUse).Error; err != nil {
+		return nil, fmt.Errorf("failed to check MAC address %s: %w", nic.MAC, err)
+	}
+	if len(inUse) > 0 {
+		return nil, fmt.Errorf("MAC address %s is already in use", nic.MAC)
+	}
+
+	deviceXML, err := nic.XML()
+	if err != nil {
+		return nil, err
+	}
+	if err := s.connector.AttachDevice(hostID, vmName, deviceXML); err != nil {
+		return nil, err
+	}
+	// Attachments are unique per VM by device name; a stopped VM has no tap
+	// device yet, so the MAC stands in until a sync records the real name.
+	deviceName := nic.MAC
+	if attached, err := s.findVMNIC(hostID, vmName, nic.MAC); err == nil && attached.Target.Dev != "" {
+		deviceName = attached.Target.Dev
+	}
+	att, err := s.recordNICAttachment(hostID, vm.ID, deviceName, nic)
+	if err != nil {
+		if detachErr := s.connector.DetachDevice(hostID, vmName, deviceXML); detachErr != nil {
+			log.Warnf("Failed to detach nic %s from %s after a failed attach: %v", nic.MAC, vmName, detachErr)
+		}
+		return nil, err
+	}
+	log.Infof("Attached %s NIC %s (%s) to VM %s on host %s", nic.Type, nic.MAC, nic.Source, vmName, hostID)
+	s.broadcastVMsChanged(hostID)
+	return att, nil
+}
+
+// recordNICAttachment stores the port, its network binding and the VM's
+// attachment for a hotplugged NIC.
+func (s *HostService) recordNICAttachment(hostID, vmUUID, deviceName string, nic libvirt.InterfaceDevice) (*storage.PortAttachment, error) {
+	tx := s.db.Begin()
+	network, err := s.findOrCreateNICNetwork(tx, hostID, nic.Type, nic.Source)
+	if err != nil {
+		tx.Rollback()
+		return nil, err
+	}
+
+	// A port left over from a removed NIC is reused rather than duplicated.
+	var port storage.Port
+	err = tx.Where("LOWER(mac_address) = ?", nic.MAC).First(&port).Error
+	switch {
+	case err == gorm.ErrRecordNotFound:
+		port = storage.Port{MACAddress: nic.MAC, HostID: hostID}
+		if err := tx.Create(&port).Error; err != nil {
+			tx.Rollback()
+			return nil, fmt.Errorf("failed to save port %s: %w", nic.MAC, err)
+		}
+	case err != nil:
+		tx.Rollback()
+		return nil, fmt.Errorf("failed to load port %s: %w", nic.MAC, err)
+	}
+	fields := nicPortFields(nic)
+	fields["host_id"] = hostID
+	if err := tx.Model(&port).Updates(fields).Error; err != nil {
+		tx.Rollback()
+		return nil, fmt.Errorf("failed to update port %s: %w", nic.MAC, err)
+	}
+	if err := s.rebindPort(tx, port.ID, network.ID); err != nil {
+		tx.Rollback()
+		return nil, err
+	}
+
+	var ordinal int
+	tx.Model(&storage.PortAttachment{}).Where("vm_uuid = ?", vmUUID).Select("COUNT(*)").Scan(&ordinal)
+	att := storage.PortAttachment{
+		VMUUID:     vmUUID,
+		PortID:     port.ID,
+		HostID:     hostID,
+		DeviceName: deviceName,
+		MACAddress: nic.MAC,
+		ModelName:  nic.Model,
+		Ordinal:    ordinal,
+	}
+	if err := tx.Create(&att).Error; err != nil {
+		tx.Rollback()
+		return nil, fmt.Errorf("failed to attach port %s: %w", nic.MAC, err)
+	}
+	if err := s.ensureAttachmentIndex(tx, storage.AttachmentIndex{VMUUID: vmUUID, DeviceType: "port", AttachmentID: att.ID, DeviceID: &port.ID}); err != nil {
+		tx.Rollback()
+		return nil, err
+	}
+	if err := tx.Commit().Error; err != nil {
+		return nil, fmt.Errorf("failed to attach port %s: %w", nic.MAC, err)
+	}
+	if err := s.db.Preload("Port").First(&att, "id = ?", att.ID).Error; err != nil {
+		return nil, fmt.Errorf("failed to reload port attachment %s: %w", nic.MAC, err)
+	}
+	return &att, nil
+}
+
+// rebindPort points a port at a single network.
+func (s *HostService) rebindPort(tx *gorm.DB, portID, networkID string) error {
+	if err := tx.Unscoped().Where("port_id = ? AND network_id <> ?", portID, networkID).Delete(&storage.PortBinding{}).Error; err != nil {
+		return fmt.Errorf("failed to remove old bindings of port %s: %w", portID, err)
+	}
+	var binding storage.PortBinding
+	if err := tx.Where("port_id = ? AND network_id = ?", portID, networkID).FirstOrCreate(&binding, storage.PortBinding{PortID: portID, NetworkID: networkID}).Error; err != nil {
+		return fmt.Errorf("failed to bind port %s: %w", portID, err)
+	}
+	return nil
+}
+
+// UpdateVMNIC changes the link state, source or VLANs of an attached NIC.
+// On a running VM the change applies to the live guest as well.
+func (s *HostService) UpdateVMNIC(hostID, vmName, mac string, req NICUpdateRequest) (*storage.PortAttachment, error) {
+	mac, err := normalizeMAC(mac)
+	if err != nil {
+		return nil, err
+	}
+	vm, err := s.findVM(hostID, vmName)
+	if err != nil {
+		return nil, err
+	}
+	if !s.connector.IsConnected(hostID) {
+		return nil, fmt.Errorf("host %s is disconnected", hostID)
+	}
+	current, err := s.findVMNIC(hostID, vmName, mac)
+	if err != nil {
+		return nil, err
+	}
+	nic := libvirt.InterfaceDeviceFromInfo(*current)
+	if req.Type != nil && *req.Type != nic.Type {
+		if req.Source == nil {
+			return nil, fmt.Errorf("invalid nic: changing the type needs a new source")
+		}
+		nic.Type, nic.Mode, nic.PortGroup = *req.Type, "", ""
+		if nic.Type == NICTypeDirect {
+			nic.Mode = "bridge"
+		}
+	}
+	if req.Source != nil {
+		nic.Source = *req.Source
+	}
+	if req.Mode != nil {
+		nic.Mode = *req.Mode
+	}
+	if req.PortGroup != nil {
+		nic.PortGroup = *req.PortGroup
+	}
+	if req.LinkState != nil {
+		nic.LinkState = *req.LinkState
+	}
+	if req.VLANs != nil {
+		nic.VLANs = *req.VLANs
+	}
+	if err := validateNIC(nic); err != nil {
+		return nil, err
+	}
+
+	var att storage.PortAttachment
+	if err := s.db.Where("vm_uuid = ? AND LOWER(mac_address) = ?", vm.ID, mac).First(&att).Error; err != nil {
+		return nil, fmt.Errorf("port attachment %s not found on vm %s: %w", mac, vmName, err)
+	}
+	deviceXML, err := nic.XML()
+	if err != nil {
+		return nil, err
+	}
+	if err := s.connector.UpdateDevice(hostID, vmName, deviceXML); err != nil {
+		return nil, err
+	}
+
+	tx := s.db.Begin()
+	network, err := s.findOrCreateNICNetwork(tx, hostID, nic.Type, nic.Source)
+	if err != nil {
+		tx.Rollback()
+		return nil, err
+	}
+	if err := tx.Model(&storage.Port{}).Where("id = ?", att.PortID).Updates(nicPortFields(nic)).Error; err != nil {
+		tx.Rollback()
+		return nil, fmt.Errorf("failed to update port %s: %w", mac, err)
+	}
+	if err := s.rebindPort(tx, att.PortID, network.ID); err != nil {
+		tx.Rollback()
+		return nil, err
+	}
+	if err := tx.Commit().Error; err != nil {
+		return nil, fmt.Errorf("failed to update port %s: %w", mac, err)
+	}
+	s.broadcastVMsChanged(hostID)
+	if err := s.db.Preload("Port").First(&att, "id = ?", att.ID).Error; err != nil {
+		return nil, fmt.Errorf("failed to reload port attachment %s: %w", mac, err)
+	}
+	return &att, nil
+}
+
+// DetachVMNIC removes a NIC from a VM along with its port records.
+func (s *HostService) DetachVMNIC(hostID, vmName, mac string) error {
+	mac, err := normalizeMAC(mac)
+	if err != nil {
+		return err
+	}
+	vm, err := s.findVM(hostID, vmName)
+	if err != nil {
+		return err
+	}
+	if !s.connector.IsConnected(hostID) {
+		return fmt.Errorf("host %s is disconnected", hostID)
+	}
+	current, err := s.findVMNIC(hostID, vmName, mac)
+	if err != nil {
+		return err
+	}
+	deviceXML, err := libvirt.InterfaceDeviceFromInfo(*current).XML()
+	if err != nil {
+		return err
+	}
+	if err := s.connector.DetachDevice(hostID, vmName, deviceXML); err != nil {
+		return err
+	}
+
+	tx := s.db.Begin()
+	var atts []storage.PortAttachment
+	if err := tx.Where("vm_uuid = ? AND LOWER(mac_address) = ?", vm.ID, mac).Find(&atts).Error; err != nil {
+		tx.Rollback()
+		return fmt.Errorf("failed to load port attachment %s: %w", mac, err)
+	}
+	for _, att := range atts {
+		if err := tx.Unscoped().Where("device_type = ? AND attachment_id = ?", "port", att.ID).Delete(&storage.AttachmentIndex{}).Error; err != nil {
+			tx.Rollback()
+			return fmt.Errorf("failed to remove attachment index of port %s: %w", mac, err)
+		}
+		if err := tx.Unscoped().Delete(&att).Error; err != nil {
+			tx.Rollback()
+			return fmt.Errorf("failed to remove port attachment %s: %w", mac, err)
+		}
+		if err := tx.Unscoped().Where("port_id = ?", att.PortID).Delete(&storage.PortBinding{}).Error; err != nil {
+			tx.Rollback()
+			return fmt.Errorf("failed to remove bindings of port %s: %w", mac, err)
+		}
+		if err := tx.Unscoped().Where("port_id = ?", att.PortID).Delete(&storage.FilterRef{}).Error; err != nil {
+			tx.Rollback()
+			return fmt.Errorf("failed to remove filters of port %s: %w", mac, err)
+		}
+		if err := tx.Unscoped().Where("id = ?", att.PortID).Delete(&storage.Port{}).Error; err != nil {
+			tx.Rollback()
+			return fmt.Errorf("failed to remove port %s: %w", mac, err)
+		}
+	}
+	if err := tx.Commit().Error; err != nil {
+		return fmt.Errorf("failed to remove port attachment %s: %w", mac, err)
+	}
+	for _, att := range atts {
+		s.releaseNICSecurityGroups(hostID, att)
+	}
+	log.Infof("Detached NIC %s from VM %s on host %s", mac, vmName, hostID)
+	s.broadcastVMsChanged(hostID)
+	return nil
+}
@@ -0,0 +1,264 @@
+package services
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/capsali/virtumancer/internal/libvirt"
+	log "github.com/capsali/virtumancer/internal/logging"
+	"github.com/capsali/virtumancer/internal/storage"
+)
+
+// StoragePoolCreateRequest defines a storage pool and optionally sets it up.
+type StoragePoolCreateRequest struct {
+	libvirt.StoragePoolSpec
+	// Build creates the pool's directory, filesystem or volume group before
+	// it is started. Existing filesystems and volume groups are kept.
+	Build     bool `json:"build"`
+	Start     bool `json:"start"`
+	Autostart bool `json:"autostart"`
+}
+
+// StoragePoolAutostartRequest sets whether a pool starts with libvirt.
+type StoragePoolAutostartRequest struct {
+	Autostart bool `json:"autostart"`
+}
+
+// findStoragePool loads a pool on a connected host.
+func (s *HostService) findStoragePool(poolID string) (*storage.StoragePool, error) {
+	var pool storage.StoragePool
+	if err := s.db.Where("id = ?", poolID).First(&pool).Error; err != nil {
+		return nil, fmt.Errorf("storage pool %s not found: %w", poolID, err)
+	}
+	if !s.connector.IsConnected(pool.HostID) {
+		return nil, fmt.Errorf("host %s is disconnected", pool.HostID)
+	}
+	return &pool, nil
+}
+
+// reloadStoragePool syncs a host's pools and returns the named pool's row.
+func (s *HostService) reloadStoragePool(hostID, name string) (*storage.StoragePool, error) {
+	if _, err := s.syncHostStoragePools(hostID); err != nil {
+		return nil, err
+	}
+	var pool storage.StoragePool
+	if err := s.db.Where("host_id = ? AND name = ?", hostID, name).First(&pool).Error; err != nil {
+		return nil, fmt.Errorf("storage pool %s not found on host %s: %w", name, hostID, err)
+	}
+	return &pool, nil
+}
+
+// storagePoolUsers returns the managed VMs with a disk in pool, matching
+// disks by the pool's volumes or, for disks found by host syncs, by path.
+func (s *HostService) storagePoolUsers(pool storage.StoragePool) ([]storage.VirtualMachine, error) {
+	var volIDs []string
+	if err := s.db.Model(&storage.Volume{}).Where("storage_pool_id = ?", pool.ID).Pluck("id", &volIDs).Error; err != nil {
+		return nil, fmt.Errorf("failed to load volumes of pool %s: %w", pool.Name, err)
+	}
+	query := s.db.Where("1 = 0")
+	if len(volIDs) > 0 {
+		query = query.Or("volume_id IN ?", volIDs)
+	}
+	if pool.Path != "" {
+		query = query.Or(`path LIKE ? ESCAPE '\'`, pathPrefixPattern(pool.Path))
+	}
+	var diskIDs []string
+	if err := query.Model(&storage.Disk{}).Pluck("id", &diskIDs).Error; err != nil {
+		return nil, fmt.Errorf("failed to load disks of pool %s: %w", pool.Name, err)
+	}
+	if len(diskIDs) == 0 {
+		return nil, nil
+	}
+	var vms []storage.VirtualMachine
+	err := s.db.Where("id IN (?)", s.db.Model(&storage.DiskAttachment{}).Select("vm_uuid").Where("disk_id IN ?", diskIDs)).
+		Order("name").Find(&vms).Error
+	if err != nil {
+		return nil, fmt.Errorf("failed to load VMs using pool %s: %w", pool.Name, err)
+	}
+	return vms, nil
+}
+
+// pathPrefixPattern returns a LIKE pattern matching paths below dir. The
+// LIKE wildcards are escaped so a pool at /srv/vm_a does not match
+// /srv/vmxa.
+func pathPrefixPattern(dir string) string {
+	escaped := strings.NewReplacer(`\`, `\\`, `%`, `\%`, `_`, `\_`).Replace(strings.TrimSuffix(dir, "/"))
+	return escaped + "/%"
+}
+
+// ensureStoragePoolUnused refuses to take away storage managed VMs rely on.
+func (s *HostService) ensureStoragePoolUnused(pool storage.StoragePool) error {
+	vms, err := s.storagePoolUsers(pool)
+	if err != nil {
+		return err
+	}
+	if len(vms) > 0 {
+		return fmt.Errorf("storage pool %s is in use by vm %s", pool.Name, vms[0].Name)
+	}
+	return nil
+}
+
+// CreateStoragePool defines a pool on a host, then builds, starts and marks
+// it to autostart as asked. A pool that fails to build or start is
+// undefined again so the request can be retried.
+func (s *HostService) CreateStoragePool(hostID string, req StoragePoolCreateRequest) (*storage.StoragePool, error) {
+	if err := req.Validate(); err != nil {
+		return nil, err
+	}
+	if req.Build && !libvirt.StoragePoolBuildable(req.Type) {
+		return nil, fmt.Errorf("invalid storage pool: %s pools cannot be built", req.Type)
+	}
+	if err := s.EnsureHostConnected(hostID); err != nil {
+		return nil, fmt.Errorf("failed to connect to host %s: %w", hostID, err)
+	}
+	if _, err := s.syncHostStoragePools(hostID); err != nil {
+		return nil, err
+	}
+	var count int64
+	s.db.Model(&storage.StoragePool{}).Where("host_id = ? AND name = ?", hostID, req.Name).Count(&count)
+	if count > 0 {
+		return nil, fmt.Errorf("storage pool name %s is already in use on host %s", req.Name, hostID)
+	}
+
+	if err := s.connector.DefineStoragePool(hostID, req.StoragePoolSpec); err != nil {
+		return nil, err
+	}
+	var setupErr error
+	if req.Build {
+		setupErr = s.connector.BuildStoragePool(hostID, req.Name)
+	}
+	if setupErr == nil && req.Start {
+		setupErr = s.connector.StartStoragePool(hostID, req.Name)
+	}
+	if setupErr != nil {
+		if err := s.connector.UndefineStoragePool(hostID, req.Name, false); err != nil {
+			log.Warnf("Failed to undefine storage pool %s on host %s after a failed setup: %v", req.Name, hostID, err)
+		}
+		return nil, setupErr
+	}
+	if req.Autostart {
+		if err := s.connector.SetStoragePoolAutostart(hostID, req.Name, true); err != nil {
+			log.Warnf("Storage pool %s on host %s was created but autostart could not be set: %v", req.Name, hostID, err)
+		}
+	}
+
+	log.Infof("Created %s storage pool %s on host %s", req.Type, req.Name, hostID)
+	return s.reloadStoragePool(hostID, req.Name)
+}
+
+// BuildStoragePool creates an inactive pool's underlying storage.
+func (s *HostService) BuildStoragePool(poolID string) (*storage.StoragePool, error) {
+	pool, err := s.findStoragePool(poolID)
+	if err != nil {
+		return nil, err
+	}
+	if !libvirt.StoragePoolBuildable(pool.Type) {
+		return nil, fmt.Errorf("invalid storage pool: %s pools cannot be built", pool.Type)
+	}
+	if err := s.connector.BuildStoragePool(pool.HostID, pool.Name); err != nil {
+		return nil, err
+	}
+	log.Infof("Built storage pool %s on host %s", pool.Name, pool.HostID)
+	return s.reloadStoragePool(pool.HostID, pool.Name)
+}
+
+// StartStoragePool activates a pool.
+func (s *HostService) StartStoragePool(poolID string) (*storage.StoragePool, error) {
+	pool, err := s.findStoragePool(poolID)
+	if err != nil {
+		return nil, err
+	}
+	if err := s.connector.StartStoragePool(pool.HostID, pool.Name); err != nil {
+		return nil, err
+	}
+	log.Infof("Started storage pool %s on host %s", pool.Name, pool.HostID)
+	return s.reloadStoragePool(pool.HostID, pool.Name)
+}
+
+// StopStoragePool deactivates a pool. Pools holding disks of managed VMs
+// are left running: stopping a network or volume group pool takes those
+// disks away from the VMs.
+func (s *HostService) StopStoragePool(poolID string) (*storage.StoragePool, error) {
+	pool, err := s.findStoragePool(poolID)
+	if err != nil {
+		return nil, err
+	}
+	if err := s.ensureStoragePoolUnused(*pool); err != nil {
+		return nil, err
+	}
+	if err := s.connector.StopStoragePool(pool.HostID, pool.Name); err != nil {
+		return nil, err
+	}
+	log.Infof("Stopped storage pool %s on host %s", pool.Name, pool.HostID)
+	return s.reloadStoragePool(pool.HostID, pool.Name)
+}
+
+// RefreshStoragePool rescans an active pool and re-indexes its ISO images.
+func (s *HostService) RefreshStoragePool(poolID string) (*storage.StoragePool, error) {
+	pool, err := s.findStoragePool(poolID)
+	if err != nil {
+		return nil, err
+	}
+	if err := s.connector.RefreshStoragePool(pool.HostID, pool.Name); err != nil {
+		return nil, err
+	}
+	if err := s.indexPoolISOs(*pool); err != nil {
+		log.Warnf("Failed to index ISOs in pool %s on host %s: %v", pool.Name, pool.HostID, err)
+	}
+	return s.reloadStoragePool(pool.HostID, pool.Name)
+}
+
+// SetStoragePoolAutostart sets whether a pool starts with libvirt.
+func (s *HostService) SetStoragePoolAutostart(poolID string, req StoragePoolAutostartRequest) (*storage.StoragePool, error) {
+	pool, err := s.findStoragePool(poolID)
+	if err != nil {
+		return nil, err
+	}
+	if err := s.connector.SetStoragePoolAutostart(pool.HostID, pool.Name, req.Autostart); err != nil {
+		return nil, err
+	}
+	return s.reloadStoragePool(pool.HostID, pool.Name)
+}
+
+// DeleteStoragePool stops and undefines a pool, deleting its underlying
+// storage when deleteStorage is set. Pools holding disks of managed VMs are
+// refused. The pool's volumes are dropped from the database.
+func (s *HostService) DeleteStoragePool(poolID string, deleteStorage bool) error {
+	pool, err := s.findStoragePool(poolID)
+	if err != nil {
+		return err
+	}
+	if err := s.ensureStoragePoolUnused(*pool); err != nil {
+		return err
+	}
+	stopped := false
+	if pool.State == "active" {
+		if err := s.connector.StopStoragePool(pool.HostID, pool.Name); err != nil {
+			return err
+		}
+		stopped = true
+	}
+	if err := s.connector.UndefineStoragePool(pool.HostID, pool.Name, deleteStorage); err != nil {
+		if stopped {
+			if startErr := s.connector.StartStoragePool(pool.HostID, pool.Name); startErr != nil {
+				log.Warnf("Failed to restart storage pool %s on host %s after a failed delete: %v", pool.Name, pool.HostID, startErr)
+			}
+		}
+		return err
+	}
+
+	tx := s.db.Begin()
+	if err := tx.Unscoped().Where("storage_pool_id = ?", pool.ID).Delete(&storage.Volume{}).Error; err != nil {
+		tx.Rollback()
+		return fmt.Errorf("failed to delete volumes of pool %s: %w", pool.Name, err)
+	}
+	if err := tx.Unscoped().Delete(pool).Error; err != nil {
+		tx.Rollback()
+		return fmt.Errorf("failed to delete storage pool %s: %w", pool.Name, err)
+	}
+	if err := tx.Commit().Error; err != nil {
+		return fmt.Errorf("failed to delete storage pool %s: %w", pool.Name, err)
+	}
+	log.Infof("Deleted storage pool %s on host %s", pool.Name, pool.HostID)
+	return nil
+}
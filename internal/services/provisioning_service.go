@@ -0,0 +1,247 @@
+package services
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/capsali/virtumancer/internal/iso9660"
+	"github.com/capsali/virtumancer/internal/libvirt"
+	log "github.com/capsali/virtumancer/internal/logging"
+	"github.com/capsali/virtumancer/internal/storage"
+)
+
+// Kinds of first boot seed.
+const (
+	SeedKindNoCloud  = "nocloud"
+	SeedKindIgnition = "ignition"
+)
+
+const (
+	// noCloudLabel is the volume label cloud-init looks for on a NoCloud
+	// seed.
+	noCloudLabel = "cidata"
+	// ignitionFwCfgName is where Ignition's QEMU platform reads its
+	// config from.
+	ignitionFwCfgName = "opt/com.coreos/config"
+)
+
+// validateProvisioning checks the first boot data of a new VM.
+func validateProvisioning(req storage.CreateVMRequest) error {
+	if req.CloudInit != nil && req.Ignition != "" {
+		return fmt.Errorf("invalid provisioning: cloud_init and ignition cannot both be set")
+	}
+	if req.CloudInit != nil && *req.CloudInit == (storage.CloudInitConfig{}) {
+		return fmt.Errorf("invalid provisioning: cloud_init has no user-data, meta-data or network-config")
+	}
+	if req.Ignition != "" && !json.Valid([]byte(req.Ignition)) {
+		return fmt.Errorf("invalid provisioning: ignition config is not valid JSON")
+	}
+	return nil
+}
+
+// buildNoCloudSeed renders the NoCloud seed ISO of a VM. cloud-init needs
+// both user-data and meta-data on it, even when empty.
+func buildNoCloudSeed(vmUUID, vmName string, cfg storage.CloudInitConfig) ([]byte, error) {
+	metaData := cfg.MetaData
+	if metaData == "" {
+		metaData = fmt.Sprintf("instance-id: %s\nlocal-hostname: %s\n", vmUUID, vmName)
+	}
+	files := []iso9660.File{
+		{Name: "user-data", Data: []byte(cfg.UserData)},
+		{Name: "meta-data", Data: []byte(metaData)},
+	}
+	if cfg.NetworkConfig != "" {
+		files = append(files, iso9660.File{Name: "network-config", Data: []byte(cfg.NetworkConfig)})
+	}
+	return iso9660.Build(noCloudLabel, files, time.Now())
+}
+
+// createProvisioningSeed uploads the first boot data of a new VM to
+// poolName and records it against the VM. A NoCloud seed is recorded in a
+// CD-ROM drive at cdromTarget; an Ignition config is picked up by
+// loadDomainProvisioning. Nothing is left behind when it fails.
+func (s *HostService) createProvisioningSeed(hostID, poolName, vmUUID string, req storage.CreateVMRequest, cdromTarget string) (*storage.ProvisioningSeed, error) {
+	seed := storage.ProvisioningSeed{VMUUID: vmUUID}
+	var data []byte
+	var volumeName string
+	switch {
+	case req.CloudInit != nil:
+		image, err := buildNoCloudSeed(vmUUID, req.Name, *req.CloudInit)
+		if err != nil {
+			return nil, err
+		}
+		seed.Kind, seed.DeviceName = SeedKindNoCloud, cdromTarget
+		data, volumeName = image, req.Name+"-seed.img"
+	case req.Ignition != "":
+		// QEMU reads fw_cfg files whole at startup, so the config has to
+		// be a plain file of its own size.
+		if err := s.ensureFilePool(hostID, poolName); err != nil {
+			return nil, err
+		}
+		seed.Kind = SeedKindIgnition
+		data, volumeName = []byte(req.Ignition), req.Name+"-ignition.ign"
+	default:
+		return nil, nil
+	}
+
+	vol, err := s.CreateVolumeUpload(hostID, VolumeUploadRequest{Pool: poolName, Name: volumeName, SizeBytes: uint64(len(data))})
+	if err != nil {
+		return nil, fmt.Errorf("failed to create first boot seed: %w", err)
+	}
+	seed.VolumeID, seed.Path = vol.ID, vol.Path
+	discard := func(err error) (*storage.ProvisioningSeed, error) {
+		s.uploads.Delete(vol.ID)
+		s.removeSeedVolume(hostID, seed)
+		return nil, err
+	}
+	if _, err := s.UploadVolumeData(vol.ID, 0, bytes.NewReader(data)); err != nil {
+		return discard(fmt.Errorf("failed to upload first boot seed: %w", err))
+	}
+	if seed.Kind == SeedKindNoCloud {
+		drive := libvirt.DiskDevice{Device: "cdrom", Path: vol.Path, Format: "raw", Bus: "sata", Target: cdromTarget, ReadOnly: true}
+		if _, err := s.recordMediaAttachment(vmUUID, drive, vol); err != nil {
+			return discard(err)
+		}
+	}
+	if err := s.db.Create(&seed).Error; err != nil {
+		return discard(fmt.Errorf("failed to save first boot seed: %w", err))
+	}
+	log.Infof("Created %s first boot seed %s for VM %s on host %s", seed.Kind, vol.Path, req.Name, hostID)
+	return &seed, nil
+}
+
+// ensureFilePool checks that the volumes of a pool are plain files.
+func (s *HostService) ensureFilePool(hostID, poolName string) error {
+	pools, err := s.connector.ListAllStoragePools(hostID)
+	if err != nil {
+		return err
+	}
+	for _, p := range pools {
+		if p.Name == poolName {
+			if !poolVolumesAreFiles(p.Type) {
+				return fmt.Errorf("invalid provisioning: ignition configs need a file-backed pool, and pool %s is %s", poolName, p.Type)
+			}
+			return nil
+		}
+	}
+	return fmt.Errorf("storage pool %s not found on host %s", poolName, hostID)
+}
+
+// loadDomainProvisioning passes a pending Ignition config to the guest.
+func (s *HostService) loadDomainProvisioning(spec *libvirt.DomainSpec, vm storage.VirtualMachine) error {
+	var seeds []storage.ProvisioningSeed
+	if err := s.db.Where("vm_uuid = ? AND kind = ?", vm.ID, SeedKindIgnition).Find(&seeds).Error; err != nil {
+		return fmt.Errorf("failed to load first boot seed of vm %s: %w", vm.Name, err)
+	}
+	for _, seed := range seeds {
+		spec.FirmwareConfig = append(spec.FirmwareConfig, libvirt.FirmwareConfigEntry{Name: ignitionFwCfgName, File: seed.Path})
+	}
+	return nil
+}
+
+// releaseProvisioningSeeds retires the first boot seeds of a host's active
+// VMs whose guest agent answers, which shows the guest has booted and read
+// its seed. VMs without an agent keep their seed until they are deleted.
+func (s *HostService) releaseProvisioningSeeds(hostID string) {
+	var seeds []storage.ProvisioningSeed
+	s.db.Joins("JOIN virtual_machines ON virtual_machines.id = provisioning_seeds.vm_uuid").
+		Where("virtual_machines.host_id = ? AND virtual_machines.libvirt_state = ? AND virtual_machines.deleted_at IS NULL", hostID, storage.StateActive).
+		Find(&seeds)
+	for _, seed := range seeds {
+		var vm storage.VirtualMachine
+		if err := s.db.Where("id = ?", seed.VMUUID).First(&vm).Error; err != nil {
+			continue
+		}
+		if err := s.connector.PingGuestAgent(hostID, vm.Name); err != nil {
+			log.Debugf("First boot of VM %s on host %s not confirmed yet: %v", vm.Name, hostID, err)
+			continue
+		}
+		if err := s.releaseProvisioningSeed(vm, seed); err != nil {
+			log.Warnf("Failed to release first boot seed of VM %s on host %s: %v", vm.Name, hostID, err)
+			continue
+		}
+		s.broadcastVMsChanged(hostID)
+	}
+}
+
+// releaseProvisioningSeed detaches a VM's seed and deletes its volume. SATA
+// CD-ROM drives cannot be unplugged from a running guest, so the seed is
+// ejected and the drive only leaves the persistent definition.
+func (s *HostService) releaseProvisioningSeed(vm storage.VirtualMachine, seed storage.ProvisioningSeed) error {
+	if seed.Kind == SeedKindNoCloud {
+		if _, err := s.EjectVMMedia(vm.HostID, vm.Name, seed.DeviceName); err != nil {
+			return err
+		}
+	}
+
+	spec, err := s.definedDomainSpec(vm)
+	if err != nil {
+		return err
+	}
+	disks := spec.Disks[:0]
+	for _, disk := range spec.Disks {
+		if seed.Kind != SeedKindNoCloud || disk.Target != seed.DeviceName {
+			disks = append(disks, disk)
+		}
+	}
+	spec.Disks = disks
+	spec.FirmwareConfig = nil
+	domainXML, err := spec.XML()
+	if err != nil {
+		return err
+	}
+	if _, err := s.connector.DefineAndCreateDomain(vm.HostID, domainXML); err != nil {
+		return err
+	}
+
+	tx := s.db.Begin()
+	if seed.Kind == SeedKindNoCloud {
+		var atts []storage.DiskAttachment
+		tx.Where("vm_uuid = ? AND device_name = ?", vm.ID, seed.DeviceName).Find(&atts)
+		for _, att := range atts {
+			tx.Unscoped().Where("device_type = ? AND attachment_id = ?", "disk", att.ID).Delete(&storage.AttachmentIndex{})
+			tx.Unscoped().Delete(&att)
+		}
+	}
+	tx.Unscoped().Delete(&seed)
+	if err := tx.Commit().Error; err != nil {
+		return fmt.Errorf("failed to remove first boot seed of vm %s: %w", vm.Name, err)
+	}
+	s.removeSeedVolume(vm.HostID, seed)
+	log.Infof("Released %s first boot seed of VM %s on host %s", seed.Kind, vm.Name, vm.HostID)
+	return nil
+}
+
+// discardProvisioningSeed deletes the seed volume of a VM that is going
+// away, whether or not the seed was used. Its row goes with the VM's
+// other records.
+func (s *HostService) discardProvisioningSeed(hostID, vmUUID string) {
+	var seeds []storage.ProvisioningSeed
+	s.db.Where("vm_uuid = ?", vmUUID).Find(&seeds)
+	for _, seed := range seeds {
+		s.removeSeedVolume(hostID, seed)
+	}
+}
+
+// removeSeedVolume deletes a seed's volume along with its Volume and Disk
+// rows.
+func (s *HostService) removeSeedVolume(hostID string, seed storage.ProvisioningSeed) {
+	var vol storage.Volume
+	if err := s.db.Where("id = ?", seed.VolumeID).First(&vol).Error; err != nil {
+		log.Warnf("Volume of first boot seed %s not found: %v", seed.Path, err)
+		return
+	}
+	var pool storage.StoragePool
+	if err := s.db.Where("id = ?", vol.StoragePoolID).First(&pool).Error; err != nil {
+		log.Warnf("Pool of first boot seed %s not found: %v", seed.Path, err)
+		return
+	}
+	if err := s.connector.DeleteStorageVolume(hostID, pool.Name, vol.Name); err != nil {
+		log.Warnf("Failed to delete first boot seed %s: %v", seed.Path, err)
+		return
+	}
+	s.db.Unscoped().Where("path = ?", vol.Path).Delete(&storage.Disk{})
+	s.db.Unscoped().Delete(&vol)
+}
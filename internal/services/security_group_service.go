@@ -0,0 +1,720 @@
+package services
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"sort"
+	"strings"
+
+	"github.com/capsali/virtumancer/internal/libvirt"
+	log "github.com/capsali/virtumancer/internal/logging"
+	"github.com/capsali/virtumancer/internal/storage"
+	"github.com/google/uuid"
+	"gorm.io/gorm"
+)
+
+// Security groups are enforced with two layers of nwfilters on each host
+// with bound NICs. Every group compiles into one filter of accept rules, and
+// every bound port gets its own filter that pulls in the port's groups
+// between a fixed set of rules and a final drop.
+const (
+	securityGroupFilterPrefix = "virtumancer-sg-"
+	portFilterPrefix          = "virtumancer-port-"
+)
+
+func securityGroupFilterName(groupID string) string { return securityGroupFilterPrefix + groupID }
+
+func portFilterName(portID string) string { return portFilterPrefix + portID }
+
+// SecurityGroupRuleRequest allows one kind of traffic. Direction is
+// "ingress" or "egress" and Protocol "any" (the default), "tcp", "udp" or
+// "icmp". The remote end is CIDR, the NICs bound to RemoteGroupID, or any
+// address when both are empty.
+type SecurityGroupRuleRequest struct {
+	Direction string `json:"direction"`
+	Protocol  string `json:"protocol,omitempty"`
+	// PortMin and PortMax bound the destination port of tcp and udp rules;
+	// PortMax defaults to PortMin and leaving both out allows every port.
+	PortMin       int    `json:"port_min,omitempty"`
+	PortMax       int    `json:"port_max,omitempty"`
+	CIDR          string `json:"cidr,omitempty"`
+	RemoteGroupID string `json:"remote_group_id,omitempty"`
+}
+
+// SecurityGroupRequest creates a security group or replaces its name,
+// description and rules.
+type SecurityGroupRequest struct {
+	Name        string                     `json:"name"`
+	Description string                     `json:"description,omitempty"`
+	Rules       []SecurityGroupRuleRequest `json:"rules"`
+}
+
+// NICSecurityGroupsRequest sets the security groups applied to a NIC. An
+// empty list removes the NIC's filtering.
+type NICSecurityGroupsRequest struct {
+	SecurityGroupIDs []string `json:"security_group_ids"`
+}
+
+// securityGroupRule validates a rule request and returns its normalized row.
+func securityGroupRule(r SecurityGroupRuleRequest) (storage.SecurityGroupRule, error) {
+	rule := storage.SecurityGroupRule{
+		Direction:     r.Direction,
+		Protocol:      strings.ToLower(r.Protocol),
+		PortMin:       r.PortMin,
+		PortMax:       r.PortMax,
+		RemoteGroupID: r.RemoteGroupID,
+	}
+	switch rule.Direction {
+	case "ingress", "egress":
+	default:
+		return rule, fmt.Errorf("invalid security group rule: direction must be ingress or egress")
+	}
+	switch rule.Protocol {
+	case "":
+		rule.Protocol = "any"
+	case "any", "tcp", "udp", "icmp":
+	default:
+		return rule, fmt.Errorf("invalid security group rule: unsupported protocol %q", r.Protocol)
+	}
+	if rule.PortMin != 0 || rule.PortMax != 0 {
+		if rule.Protocol != "tcp" && rule.Protocol != "udp" {
+			return rule, fmt.Errorf("invalid security group rule: ports only apply to tcp and udp rules")
+		}
+		if rule.PortMax == 0 {
+			rule.PortMax = rule.PortMin
+		}
+		if rule.PortMin < 1 || rule.PortMax > 65535 || rule.PortMax < rule.PortMin {
+			return rule, fmt.Errorf("invalid security group rule: bad port range %d-%d", r.PortMin, r.PortMax)
+		}
+	}
+	if r.CIDR != "" {
+		if r.RemoteGroupID != "" {
+			return rule, fmt.Errorf("invalid security group rule: cidr and remote_group_id cannot both be set")
+		}
+		_, ipNet, err := net.ParseCIDR(r.CIDR)
+		if err != nil {
+			return rule, fmt.Errorf("invalid security group rule: bad cidr %q", r.CIDR)
+		}
+		rule.CIDR = ipNet.String()
+	}
+	return rule, nil
+}
+
+// securityGroupRules validates the rules of a group request. Remote groups
+// must exist, except for groupID itself.
+func (s *HostService) securityGroupRules(groupID string, req SecurityGroupRequest) ([]storage.SecurityGroupRule, error) {
+	if strings.TrimSpace(req.Name) == "" {
+		return nil, fmt.Errorf("invalid security group: name is required")
+	}
+	rules := make([]storage.SecurityGroupRule, 0, len(req.Rules))
+	for _, r := range req.Rules {
+		rule, err := securityGroupRule(r)
+		if err != nil {
+			return nil, err
+		}
+		if rule.RemoteGroupID != "" && rule.RemoteGroupID != groupID {
+			var count int64
+			s.db.Model(&storage.SecurityGroup{}).Where("id = ?", rule.RemoteGroupID).Count(&count)
+			if count == 0 {
+				return nil, fmt.Errorf("invalid security group rule: remote group %s not found", rule.RemoteGroupID)
+			}
+		}
+		rule.SecurityGroupID = groupID
+		rules = append(rules, rule)
+	}
+	return rules, nil
+}
+
+// findSecurityGroup loads a group with its rules in the order they were given.
+func (s *HostService) findSecurityGroup(groupID string) (*storage.SecurityGroup, error) {
+	var group storage.SecurityGroup
+	err := s.db.Preload("Rules", func(db *gorm.DB) *gorm.DB { return db.Order("created_at, id") }).
+		Where("id = ?", groupID).First(&group).Error
+	if err != nil {
+		return nil, fmt.Errorf("security group %s not found: %w", groupID, err)
+	}
+	return &group, nil
+}
+
+// securityGroupAttachments selects the ids of the NIC attachments bound to
+// any of the groups.
+func (s *HostService) securityGroupAttachments(groupIDs ...string) *gorm.DB {
+	return s.db.Model(&storage.SecurityGroupBinding{}).Select("port_attachment_id").Where("security_group_id IN ?", groupIDs)
+}
+
+// securityGroupHosts returns the hosts with NICs bound to the group, which
+// are the hosts its filter must be defined on.
+func (s *HostService) securityGroupHosts(groupID string) ([]string, error) {
+	var hosts []string
+	err := s.db.Model(&storage.PortAttachment{}).Distinct("host_id").
+		Where("id IN (?)", s.securityGroupAttachments(groupID)).Order("host_id").Pluck("host_id", &hosts).Error
+	if err != nil {
+		return nil, fmt.Errorf("failed to load hosts of security group %s: %w", groupID, err)
+	}
+	return hosts, nil
+}
+
+// securityGroupMemberIPs returns the known addresses of the NICs bound to
+// the group. NICs whose address has not been learned yet match nothing.
+func (s *HostService) securityGroupMemberIPs(groupID string) ([]string, error) {
+	ports := s.db.Model(&storage.PortAttachment{}).Select("port_id").Where("id IN (?)", s.securityGroupAttachments(groupID))
+	var ips []string
+	err := s.db.Model(&storage.Port{}).Distinct("ip_address").
+		Where("id IN (?) AND ip_address <> ''", ports).Order("ip_address").Pluck("ip_address", &ips).Error
+	if err != nil {
+		return nil, fmt.Errorf("failed to load addresses of security group %s: %w", groupID, err)
+	}
+	return ips, nil
+}
+
+// nwfilterProtocol maps a rule protocol to the nwfilter protocol element of
+// an address family.
+func nwfilterProtocol(protocol string, ipv6 bool) string {
+	if protocol == "any" {
+		protocol = "all"
+	}
+	if !ipv6 {
+		return protocol
+	}
+	if protocol == "icmp" {
+		return "icmpv6"
+	}
+	return protocol + "-ipv6"
+}
+
+// compileSecurityGroup turns a group's rules into the accept rules of its
+// nwfilter. Rules with a remote group expand to one rule per member address.
+func (s *HostService) compileSecurityGroup(group storage.SecurityGroup) (libvirt.NWFilterSpec, error) {
+	spec := libvirt.NWFilterSpec{Name: securityGroupFilterName(group.ID)}
+	for _, rule := range group.Rules {
+		var remotes []*net.IPNet
+		switch {
+		case rule.CIDR != "":
+			_, ipNet, err := net.ParseCIDR(rule.CIDR)
+			if err != nil {
+				return spec, fmt.Errorf("invalid security group rule: bad cidr %q", rule.CIDR)
+			}
+			remotes = append(remotes, ipNet)
+		case rule.RemoteGroupID != "":
+			ips, err := s.securityGroupMemberIPs(rule.RemoteGroupID)
+			if err != nil {
+				return spec, err
+			}
+			for _, addr := range ips {
+				ip := net.ParseIP(addr)
+				if ip == nil {
+					continue
+				}
+				bits := 128
+				if ip.To4() != nil {
+					ip, bits = ip.To4(), 32
+				}
+				remotes = append(remotes, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			}
+		default:
+			remotes = []*net.IPNet{nil, nil}
+		}
+
+		direction := "in"
+		if rule.Direction == "egress" {
+			direction = "out"
+		}
+		for i, remote := range remotes {
+			r := libvirt.NWFilterRule{
+				Action:    "accept",
+				Direction: direction,
+				PortStart: rule.PortMin,
+				PortEnd:   rule.PortMax,
+				State:     "NEW",
+			}
+			// A rule without a remote end covers both address families.
+			ipv6 := i == 1
+			if remote != nil {
+				ones, _ := remote.Mask.Size()
+				r.RemoteIP, r.RemotePrefix = remote.IP.String(), ones
+				ipv6 = remote.IP.To4() == nil
+			}
+			r.Protocol = nwfilterProtocol(rule.Protocol, ipv6)
+			spec.Rules = append(spec.Rules, r)
+		}
+	}
+	return spec, nil
+}
+
+// portFilterSpec builds the filter of a NIC bound to groupIDs. Besides the
+// groups' rules it lets replies to allowed traffic, DHCP and ICMPv6, which
+// IPv6 neighbour discovery needs, through and drops everything else.
+func portFilterSpec(portID string, groupIDs []string) libvirt.NWFilterSpec {
+	spec := libvirt.NWFilterSpec{Name: portFilterName(portID)}
+	for _, id := range groupIDs {
+		spec.Filters = append(spec.Filters, securityGroupFilterName(id))
+	}
+	sort.Strings(spec.Filters)
+	spec.Rules = []libvirt.NWFilterRule{
+		{Action: "accept", Direction: "inout", Priority: -100, Protocol: "all", State: "ESTABLISHED,RELATED"},
+		{Action: "accept", Direction: "inout", Priority: -100, Protocol: "all-ipv6", State: "ESTABLISHED,RELATED"},
+		{Action: "accept", Direction: "out", Priority: -100, Protocol: "udp", PortStart: 67, PortEnd: 67},
+		{Action: "accept", Direction: "in", Priority: -100, Protocol: "udp", PortStart: 68, PortEnd: 68},
+		{Action: "accept", Direction: "out", Priority: -100, Protocol: "udp-ipv6", PortStart: 547, PortEnd: 547},
+		{Action: "accept", Direction: "in", Priority: -100, Protocol: "udp-ipv6", PortStart: 546, PortEnd: 546},
+		{Action: "accept", Direction: "inout", Priority: -100, Protocol: "icmpv6"},
+		{Action: "drop", Direction: "inout", Priority: 1000, Protocol: "all"},
+		{Action: "drop", Direction: "inout", Priority: 1000, Protocol: "all-ipv6"},
+	}
+	return spec
+}
+
+// defineSecurityGroupFilter defines a group's filter on hosts. When one host
+// fails, hosts already updated get the previous definition back.
+func (s *HostService) defineSecurityGroupFilter(spec libvirt.NWFilterSpec, previous *libvirt.NWFilterSpec, hosts []string) error {
+	for i, hostID := range hosts {
+		err := fmt.Errorf("host %s is disconnected", hostID)
+		if s.connector.IsConnected(hostID) {
+			err = s.connector.DefineNWFilter(hostID, spec)
+		}
+		if err == nil {
+			continue
+		}
+		if previous != nil {
+			for _, done := range hosts[:i] {
+				if rbErr := s.connector.DefineNWFilter(done, *previous); rbErr != nil {
+					log.Warnf("Failed to restore nwfilter %s on host %s: %v", spec.Name, done, rbErr)
+				}
+			}
+		}
+		return err
+	}
+	return nil
+}
+
+// refreshSecurityGroupFilters re-defines the filters of groups whose rules
+// take their remote end from one of groupIDs, after the NICs bound to those
+// groups or their addresses changed.
+func (s *HostService) refreshSecurityGroupFilters(groupIDs []string) {
+	var dependents []string
+	s.db.Model(&storage.SecurityGroupRule{}).Distinct("security_group_id").
+		Where("remote_group_id IN ?", groupIDs).Pluck("security_group_id", &dependents)
+	for _, id := range dependents {
+		group, err := s.findSecurityGroup(id)
+		if err != nil {
+			continue
+		}
+		hosts, err := s.securityGroupHosts(id)
+		if err != nil || len(hosts) == 0 {
+			continue
+		}
+		spec, err := s.compileSecurityGroup(*group)
+		if err == nil {
+			err = s.defineSecurityGroupFilter(spec, nil, hosts)
+		}
+		if err != nil {
+			log.Warnf("Failed to refresh nwfilter of security group %s: %v", group.Name, err)
+		}
+	}
+}
+
+// refreshVMSecurityGroupSources re-defines the filters of groups whose rules
+// take their remote end from groups a VM's NICs are bound to. Syncs call it
+// once they have committed, since the addresses those filters expand to may
+// have been learned or changed.
+func (s *HostService) refreshVMSecurityGroupSources(vmUUID string) {
+	var groupIDs []string
+	err := s.db.Model(&storage.SecurityGroupBinding{}).Distinct("security_group_id").
+		Where("port_attachment_id IN (?)", s.db.Model(&storage.PortAttachment{}).Select("id").Where("vm_uuid = ?", vmUUID)).
+		Pluck("security_group_id", &groupIDs).Error
+	if err != nil {
+		log.Warnf("Failed to load security groups of vm %s: %v", vmUUID, err)
+		return
+	}
+	if len(groupIDs) > 0 {
+		s.refreshSecurityGroupFilters(groupIDs)
+	}
+}
+
+// undefineUnusedSecurityGroupFilters removes the filters of groups that no
+// longer have NICs bound on a host.
+func (s *HostService) undefineUnusedSecurityGroupFilters(hostID string, groupIDs []string) {
+	for _, id := range groupIDs {
+		var count int64
+		s.db.Model(&storage.PortAttachment{}).Where("host_id = ? AND id IN (?)", hostID, s.securityGroupAttachments(id)).Count(&count)
+		if count > 0 {
+			continue
+		}
+		if err := s.connector.UndefineNWFilter(hostID, securityGroupFilterName(id)); err != nil {
+			log.Warnf("Failed to remove nwfilter of security group %s from host %s: %v", id, hostID, err)
+		}
+	}
+}
+
+// ListSecurityGroups returns all security groups with their rules.
+func (s *HostService) ListSecurityGroups() ([]storage.SecurityGroup, error) {
+	var groups []storage.SecurityGroup
+	err := s.db.Preload("Rules", func(db *gorm.DB) *gorm.DB { return db.Order("created_at, id") }).
+		Order("name").Find(&groups).Error
+	if err != nil {
+		return nil, fmt.Errorf("failed to load security groups: %w", err)
+	}
+	return groups, nil
+}
+
+// GetSecurityGroup returns a security group with its rules.
+func (s *HostService) GetSecurityGroup(groupID string) (*storage.SecurityGroup, error) {
+	return s.findSecurityGroup(groupID)
+}
+
+// CreateSecurityGroup stores a new security group. Its filter is defined on
+// a host once a NIC there is bound to it.
+func (s *HostService) CreateSecurityGroup(req SecurityGroupRequest) (*storage.SecurityGroup, error) {
+	group := storage.SecurityGroup{Base: storage.Base{ID: uuid.New().String()}, Name: strings.TrimSpace(req.Name), Description: req.Description}
+	rules, err := s.securityGroupRules(group.ID, req)
+	if err != nil {
+		return nil, err
+	}
+	var count int64
+	s.db.Model(&storage.SecurityGroup{}).Where("name = ?", group.Name).Count(&count)
+	if count > 0 {
+		return nil, fmt.Errorf("security group name %s is already in use", group.Name)
+	}
+
+	tx := s.db.Begin()
+	if err := tx.Create(&group).Error; err != nil {
+		tx.Rollback()
+		return nil, fmt.Errorf("failed to save security group %s: %w", group.Name, err)
+	}
+	for i := range rules {
+		if err := tx.Create(&rules[i]).Error; err != nil {
+			tx.Rollback()
+			return nil, fmt.Errorf("failed to save rules of security group %s: %w", group.Name, err)
+		}
+	}
+	if err := tx.Commit().Error; err != nil {
+		return nil, fmt.Errorf("failed to save security group %s: %w", group.Name, err)
+	}
+	log.Infof("Created security group %s with %d rules", group.Name, len(rules))
+	return s.findSecurityGroup(group.ID)
+}
+
+// UpdateSecurityGroup replaces a group's name, description and rules and
+// re-defines its filter on every host with NICs bound to it. Running guests
+// pick up the new rules without losing their network.
+func (s *HostService) UpdateSecurityGroup(groupID string, req SecurityGroupRequest) (*storage.SecurityGroup, error) {
+	group, err := s.findSecurityGroup(groupID)
+	if err != nil {
+		return nil, err
+	}
+	rules, err := s.securityGroupRules(group.ID, req)
+	if err != nil {
+		return nil, err
+	}
+	name := strings.TrimSpace(req.Name)
+	var count int64
+	s.db.Model(&storage.SecurityGroup{}).Where("name = ? AND id <> ?", name, group.ID).Count(&count)
+	if count > 0 {
+		return nil, fmt.Errorf("security group name %s is already in use", name)
+	}
+
+	hosts, err := s.securityGroupHosts(group.ID)
+	if err != nil {
+		return nil, err
+	}
+	if len(hosts) > 0 {
+		previous, err := s.compileSecurityGroup(*group)
+		if err != nil {
+			return nil, err
+		}
+		updated := *group
+		updated.Rules = rules
+		spec, err := s.compileSecurityGroup(updated)
+		if err != nil {
+			return nil, err
+		}
+		if err := s.defineSecurityGroupFilter(spec, &previous, hosts); err != nil {
+			return nil, err
+		}
+	}
+
+	tx := s.db.Begin()
+	if err := tx.Model(group).Updates(map[string]interface{}{"name": name, "description": req.Description}).Error; err != nil {
+		tx.Rollback()
+		return nil, fmt.Errorf("failed to update security group %s: %w", group.Name, err)
+	}
+	if err := tx.Unscoped().Where("security_group_id = ?", group.ID).Delete(&storage.SecurityGroupRule{}).Error; err != nil {
+		tx.Rollback()
+		return nil, fmt.Errorf("failed to replace rules of security group %s: %w", group.Name, err)
+	}
+	for i := range rules {
+		if err := tx.Create(&rules[i]).Error; err != nil {
+			tx.Rollback()
+			return nil, fmt.Errorf("failed to replace rules of security group %s: %w", group.Name, err)
+		}
+	}
+	if err := tx.Commit().Error; err != nil {
+		return nil, fmt.Errorf("failed to update security group %s: %w", group.Name, err)
+	}
+	log.Infof("Updated security group %s on %d hosts", name, len(hosts))
+	return s.findSecurityGroup(group.ID)
+}
+
+// DeleteSecurityGroup removes a group that no NIC is bound to and no other
+// group's rules refer to.
+func (s *HostService) DeleteSecurityGroup(groupID string) error {
+	group, err := s.findSecurityGroup(groupID)
+	if err != nil {
+		return err
+	}
+	var vms []storage.VirtualMachine
+	s.db.Where("id IN (?)", s.db.Model(&storage.PortAttachment{}).Select("vm_uuid").Where("id IN (?)", s.securityGroupAttachments(group.ID))).
+		Order("name").Limit(1).Find(&vms)
+	if len(vms) > 0 {
+		return fmt.Errorf("security group %s is in use by vm %s", group.Name, vms[0].Name)
+	}
+	var referrers []storage.SecurityGroup
+	s.db.Where("id <> ? AND id IN (?)", group.ID, s.db.Model(&storage.SecurityGroupRule{}).Select("security_group_id").Where("remote_group_id = ?", group.ID)).
+		Order("name").Limit(1).Find(&referrers)
+	if len(referrers) > 0 {
+		return fmt.Errorf("security group %s is in use by security group %s", group.Name, referrers[0].Name)
+	}
+
+	// Rows are removed outright so the name can be reused.
+	tx := s.db.Begin()
+	if err := tx.Unscoped().Where("security_group_id = ?", group.ID).Delete(&storage.SecurityGroupRule{}).Error; err != nil {
+		tx.Rollback()
+		return fmt.Errorf("failed to delete rules of security group %s: %w", group.Name, err)
+	}
+	if err := tx.Unscoped().Where("security_group_id = ?", group.ID).Delete(&storage.SecurityGroupBinding{}).Error; err != nil {
+		tx.Rollback()
+		return fmt.Errorf("failed to delete bindings of security group %s: %w", group.Name, err)
+	}
+	if err := tx.Unscoped().Delete(group).Error; err != nil {
+		tx.Rollback()
+		return fmt.Errorf("failed to delete security group %s: %w", group.Name, err)
+	}
+	if err := tx.Commit().Error; err != nil {
+		return fmt.Errorf("failed to delete security group %s: %w", group.Name, err)
+	}
+	log.Infof("Deleted security group %s", group.Name)
+	return nil
+}
+
+// nicSecurityGroupIDs returns the groups bound to a NIC attachment.
+func (s *HostService) nicSecurityGroupIDs(attachmentID string) ([]string, error) {
+	var ids []string
+	if err := s.db.Model(&storage.SecurityGroupBinding{}).Where("port_attachment_id = ?", attachmentID).
+		Order("security_group_id").Pluck("security_group_id", &ids).Error; err != nil {
+		return nil, fmt.Errorf("failed to load security groups of port attachment %s: %w", attachmentID, err)
+	}
+	return ids, nil
+}
+
+// GetVMNICSecurityGroups returns the security groups bound to a VM's NIC.
+func (s *HostService) GetVMNICSecurityGroups(hostID, vmName, mac string) ([]storage.SecurityGroup, error) {
+	mac, err := normalizeMAC(mac)
+	if err != nil {
+		return nil, err
+	}
+	vm, err := s.findVM(hostID, vmName)
+	if err != nil {
+		return nil, err
+	}
+	var att storage.PortAttachment
+	if err := s.db.Where("vm_uuid = ? AND LOWER(mac_address) = ?", vm.ID, mac).First(&att).Error; err != nil {
+		return nil, fmt.Errorf("port attachment %s not found on vm %s: %w", mac, vmName, err)
+	}
+	groups := []storage.SecurityGroup{}
+	err = s.db.Preload("Rules", func(db *gorm.DB) *gorm.DB { return db.Order("created_at, id") }).
+		Where("id IN (?)", s.db.Model(&storage.SecurityGroupBinding{}).Select("security_group_id").Where("port_attachment_id = ?", att.ID)).
+		Order("name").Find(&groups).Error
+	if err != nil {
+		return nil, fmt.Errorf("failed to load security groups of nic %s: %w", mac, err)
+	}
+	return groups, nil
+}
+
+// SetVMNICSecurityGroups binds a VM's NIC to exactly the given security
+// groups. The groups' filters and the NIC's own filter are defined on the
+// VM's host and the NIC is pointed at it; running guests are filtered
+// right away.
+func (s *HostService) SetVMNICSecurityGroups(hostID, vmName, mac string, req NICSecurityGroupsRequest) ([]storage.SecurityGroup, error) {
+	mac, err := normalizeMAC(mac)
+	if err != nil {
+		return nil, err
+	}
+	vm, err := s.findVM(hostID, vmName)
+	if err != nil {
+		return nil, err
+	}
+	if !s.connector.IsConnected(hostID) {
+		return nil, fmt.Errorf("host %s is disconnected", hostID)
+	}
+	current, err := s.findVMNIC(hostID, vmName, mac)
+	if err != nil {
+		return nil, err
+	}
+	var att storage.PortAttachment
+	if err := s.db.Where("vm_uuid = ? AND LOWER(mac_address) = ?", vm.ID, mac).First(&att).Error; err != nil {
+		return nil, fmt.Errorf("port attachment %s not found on vm %s: %w", mac, vmName, err)
+	}
+
+	var groups []storage.SecurityGroup
+	seen := map[string]bool{}
+	for _, id := range req.SecurityGroupIDs {
+		if seen[id] {
+			continue
+		}
+		seen[id] = true
+		group, err := s.findSecurityGroup(id)
+		if err != nil {
+			return nil, err
+		}
+		groups = append(groups, *group)
+	}
+	previous, err := s.nicSecurityGroupIDs(att.ID)
+	if err != nil {
+		return nil, err
+	}
+	var wanted, removed []string
+	for _, g := range groups {
+		wanted = append(wanted, g.ID)
+	}
+	for _, id := range previous {
+		if !seen[id] {
+			removed = append(removed, id)
+		}
+	}
+
+	nic := libvirt.InterfaceDeviceFromInfo(*current)
+	filter := portFilterName(att.PortID)
+	if len(groups) > 0 {
+		for _, g := range groups {
+			spec, err := s.compileSecurityGroup(g)
+			if err != nil {
+				return nil, err
+			}
+			if err := s.connector.DefineNWFilter(hostID, spec); err != nil {
+				return nil, err
+			}
+		}
+		if err := s.connector.DefineNWFilter(hostID, portFilterSpec(att.PortID, wanted)); err != nil {
+			return nil, err
+		}
+	}
+	// A filter the NIC had from elsewhere gives way to the groups, and is
+	// left alone when there are none.
+	switch {
+	case len(groups) > 0:
+		nic.FilterRef = filter
+	case nic.FilterRef == filter:
+		nic.FilterRef = ""
+	}
+	if nic.FilterRef != current.FilterRef.Filter {
+		deviceXML, err := nic.XML()
+		if err != nil {
+			return nil, err
+		}
+		if err := s.connector.UpdateDevice(hostID, vmName, deviceXML); err != nil {
+			return nil, err
+		}
+	}
+
+	tx := s.db.Begin()
+	if err := tx.Unscoped().Where("port_attachment_id = ?", att.ID).Delete(&storage.SecurityGroupBinding{}).Error; err != nil {
+		tx.Rollback()
+		return nil, fmt.Errorf("failed to update security groups of nic %s: %w", mac, err)
+	}
+	for _, id := range wanted {
+		if err := tx.Create(&storage.SecurityGroupBinding{SecurityGroupID: id, PortAttachmentID: att.ID}).Error; err != nil {
+			tx.Rollback()
+			return nil, fmt.Errorf("failed to update security groups of nic %s: %w", mac, err)
+		}
+	}
+	if err := s.recordPortFilter(tx, att.PortID, nic.FilterRef); err != nil {
+		tx.Rollback()
+		return nil, err
+	}
+	if err := tx.Commit().Error; err != nil {
+		return nil, fmt.Errorf("failed to update security groups of nic %s: %w", mac, err)
+	}
+
+	if len(groups) == 0 && len(previous) > 0 {
+		if err := s.connector.UndefineNWFilter(hostID, filter); err != nil {
+			log.Warnf("Failed to remove nwfilter of nic %s from host %s: %v", mac, hostID, err)
+		}
+	}
+	s.undefineUnusedSecurityGroupFilters(hostID, removed)
+	s.refreshSecurityGroupFilters(append(wanted, removed...))
+	log.Infof("Set %d security groups on NIC %s of VM %s on host %s", len(wanted), mac, vmName, hostID)
+	s.broadcastVMsChanged(hostID)
+	return s.GetVMNICSecurityGroups(hostID, vmName, mac)
+}
+
+// recordPortFilter mirrors the filter a NIC references into its port's
+// FilterRef rows.
+func (s *HostService) recordPortFilter(tx *gorm.DB, portID, filter string) error {
+	if err := tx.Unscoped().Where("port_id = ?", portID).Delete(&storage.FilterRef{}).Error; err != nil {
+		return fmt.Errorf("failed to update filters of port %s: %w", portID, err)
+	}
+	filterJSON := ""
+	if filter != "" {
+		if err := tx.Create(&storage.FilterRef{PortID: portID, Name: filter}).Error; err != nil {
+			return fmt.Errorf("failed to update filters of port %s: %w", portID, err)
+		}
+		out, _ := json.Marshal(map[string]string{"filter": filter})
+		filterJSON = string(out)
+	}
+	if err := tx.Model(&storage.Port{}).Where("id = ?", portID).Update("filter_ref_json", filterJSON).Error; err != nil {
+		return fmt.Errorf("failed to update filters of port %s: %w", portID, err)
+	}
+	return nil
+}
+
+// releaseNICSecurityGroups drops the bindings of a NIC being removed and
+// cleans up the filters only it needed. Callers remove the NIC first.
+func (s *HostService) releaseNICSecurityGroups(hostID string, att storage.PortAttachment) {
+	groupIDs, err := s.nicSecurityGroupIDs(att.ID)
+	if err != nil || len(groupIDs) == 0 {
+		return
+	}
+	if err := s.db.Unscoped().Where("port_attachment_id = ?", att.ID).Delete(&storage.SecurityGroupBinding{}).Error; err != nil {
+		log.Warnf("Failed to remove security group bindings of nic %s: %v", att.MACAddress, err)
+		return
+	}
+	if err := s.connector.UndefineNWFilter(hostID, portFilterName(att.PortID)); err != nil {
+		log.Warnf("Failed to remove nwfilter of nic %s from host %s: %v", att.MACAddress, hostID, err)
+	}
+	s.undefineUnusedSecurityGroupFilters(hostID, groupIDs)
+	s.refreshSecurityGroupFilters(groupIDs)
+}
+
+// defineVMSecurityFilters defines the filters of a VM's NICs on another
+// host, so the VM can run there.
+func (s *HostService) defineVMSecurityFilters(vmUUID, hostID string) error {
+	var atts []storage.PortAttachment
+	if err := s.db.Where("vm_uuid = ? AND id IN (?)", vmUUID, s.db.Model(&storage.SecurityGroupBinding{}).Select("port_attachment_id")).
+		Find(&atts).Error; err != nil {
+		return fmt.Errorf("failed to load security groups of vm %s: %w", vmUUID, err)
+	}
+	for _, att := range atts {
+		groupIDs, err := s.nicSecurityGroupIDs(att.ID)
+		if err != nil {
+			return err
+		}
+		for _, id := range groupIDs {
+			group, err := s.findSecurityGroup(id)
+			if err != nil {
+				return err
+			}
+			spec, err := s.compileSecurityGroup(*group)
+			if err != nil {
+				return err
+			}
+			if err := s.connector.DefineNWFilter(hostID, spec); err != nil {
+				return err
+			}
+		}
+		if err := s.connector.DefineNWFilter(hostID, portFilterSpec(att.PortID, groupIDs)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
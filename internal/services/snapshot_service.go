@@ -0,0 +1,228 @@
+package services
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/capsali/virtumancer/internal/libvirt"
+	log "github.com/capsali/virtumancer/internal/logging"
+	"github.com/capsali/virtumancer/internal/storage"
+	"github.com/capsali/virtumancer/internal/ws"
+	"gorm.io/gorm"
+)
+
+// SnapshotView is a snapshot as returned by the API. Parent and Children
+// link the snapshots of a VM into a tree.
+type SnapshotView struct {
+	Name        string    `json:"name"`
+	Description string    `json:"description,omitempty"`
+	Parent      string    `json:"parent,omitempty"`
+	Children    []string  `json:"children"`
+	State       string    `json:"state"`
+	CreatedAt   time.Time `json:"created_at"`
+	Current     bool      `json:"current"`
+	External    bool      `json:"external"`
+	HasMemory   bool      `json:"has_memory"`
+}
+
+// broadcastSnapshotProgress reports a snapshot operation moving through
+// "started", then "completed" or "failed".
+func (s *HostService) broadcastSnapshotProgress(hostID, vmName, snapshot, operation, status string, opErr error) {
+	payload := ws.MessagePayload{
+		"hostId":    hostID,
+		"vmName":    vmName,
+		"snapshot":  snapshot,
+		"operation": operation,
+		"status":    status,
+	}
+	if opErr != nil {
+		payload["error"] = opErr.Error()
+	}
+	s.hub.BroadcastMessage(ws.Message{Type: "vm-snapshot-progress", Payload: payload})
+}
+
+// runSnapshotOperation wraps a snapshot action in the VM task state and
+// progress messages, then reconciles the stored snapshot metadata.
+func (s *HostService) runSnapshotOperation(vm *storage.VirtualMachine, snapshot, operation string, taskState storage.VMTaskState, action func() error) error {
+	hostID, vmName := vm.HostID, vm.Name
+	// Internal snapshots are stored in the disk images themselves.
+	if err := s.ensureNotLinkedCloneBase(hostID, vmName, "changed"); err != nil {
+		return err
+	}
+	s.broadcastSnapshotProgress(hostID, vmName, snapshot, operation, "started", nil)
+	err := s.performVMAction(hostID, vmName, taskState, action)
+	if err == nil {
+		_, err = s.syncVMSnapshots(s.db, vm.ID, hostID, vmName)
+	}
+	if err != nil {
+		s.broadcastSnapshotProgress(hostID, vmName, snapshot, operation, "failed", err)
+		return err
+	}
+	s.broadcastSnapshotProgress(hostID, vmName, snapshot, operation, "completed", nil)
+	return nil
+}
+
+// ListVMSnapshots returns the snapshot tree of a VM, refreshed from libvirt
+// when the host is connected.
+func (s *HostService) ListVMSnapshots(hostID, vmName string) ([]SnapshotView, error) {
+	vm, err := s.findVM(hostID, vmName)
+	if err != nil {
+		return nil, err
+	}
+	if s.connector.IsConnected(hostID) {
+		if _, err := s.syncVMSnapshots(s.db, vm.ID, hostID, vmName); err != nil {
+			return nil, err
+		}
+	}
+	return s.snapshotViews(vm.ID)
+}
+
+// CreateVMSnapshot takes a snapshot of a VM and returns it once libvirt has
+// finished writing it.
+func (s *HostService) CreateVMSnapshot(hostID, vmName string, spec libvirt.SnapshotSpec) (*SnapshotView, error) {
+	vm, err := s.findVM(hostID, vmName)
+	if err != nil {
+		return nil, err
+	}
+	err = s.runSnapshotOperation(vm, spec.Name, "create", storage.TaskStateSnapshotting, func() error {
+		_, err := s.connector.CreateDomainSnapshot(hostID, vmName, spec)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	views, err := s.snapshotViews(vm.ID)
+	if err != nil {
+		return nil, err
+	}
+	for i := range views {
+		if views[i].Name == spec.Name {
+			return &views[i], nil
+		}
+	}
+	return nil, fmt.Errorf("snapshot %s not found after creation", spec.Name)
+}
+
+// RevertVMSnapshot returns a VM to the state captured by a snapshot.
+func (s *HostService) RevertVMSnapshot(hostID, vmName, snapshotName string) error {
+	vm, err := s.findVM(hostID, vmName)
+	if err != nil {
+		return err
+	}
+	return s.runSnapshotOperation(vm, snapshotName, "revert", storage.TaskStateReverting, func() error {
+		return s.connector.RevertDomainSnapshot(hostID, vmName, snapshotName)
+	})
+}
+
+// DeleteVMSnapshot removes a snapshot; its children move up to its parent.
+func (s *HostService) DeleteVMSnapshot(hostID, vmName, snapshotName string) error {
+	vm, err := s.findVM(hostID, vmName)
+	if err != nil {
+		return err
+	}
+	return s.runSnapshotOperation(vm, snapshotName, "delete", storage.TaskStateSnapshotting, func() error {
+		return s.connector.DeleteDomainSnapshot(hostID, vmName, snapshotName)
+	})
+}
+
+// snapshotViews builds the snapshot tree for a VM from the database.
+func (s *HostService) snapshotViews(vmUUID string) ([]SnapshotView, error) {
+	var rows []storage.VMSnapshot
+	if err := s.db.Where("vm_uuid = ?", vmUUID).Order("created_at, name").Find(&rows).Error; err != nil {
+		return nil, fmt.Errorf("failed to load snapshots: %w", err)
+	}
+	views := make([]SnapshotView, len(rows))
+	index := make(map[string]int, len(rows))
+	for i, row := range rows {
+		views[i] = SnapshotView{
+			Name:        row.Name,
+			Description: row.Description,
+			Parent:      row.ParentName,
+			Children:    []string{},
+			State:       row.State,
+			CreatedAt:   row.CreatedAt,
+			Current:     row.IsCurrent,
+			External:    row.External,
+			HasMemory:   row.HasMemory,
+		}
+		index[row.Name] = i
+	}
+	for _, view := range views {
+		if parent, ok := index[view.Parent]; ok {
+			views[parent].Children = append(views[parent].Children, view.Name)
+		}
+	}
+	return views, nil
+}
+
+// syncVMSnapshots makes the VMSnapshot rows for a VM match libvirt, only
+// writing rows that differ.
+func (s *HostService) syncVMSnapshots(tx *gorm.DB, vmUUID, hostID, vmName string) (bool, error) {
+	live, err := s.connector.ListDomainSnapshots(hostID, vmName)
+	if err != nil {
+		return false, err
+	}
+
+	var existing []storage.VMSnapshot
+	if err := tx.Where("vm_uuid = ?", vmUUID).Find(&existing).Error; err != nil {
+		return false, fmt.Errorf("failed to load snapshots for vm %s: %w", vmUUID, err)
+	}
+	byName := make(map[string]storage.VMSnapshot, len(existing))
+	for _, row := range existing {
+		byName[row.Name] = row
+	}
+
+	changed := false
+	for _, snap := range live {
+		want := storage.VMSnapshot{
+			VMUUID:      vmUUID,
+			Name:        snap.Name,
+			Description: snap.Description,
+			ParentName:  snap.Parent,
+			State:       snap.State,
+			ConfigXML:   snap.XML,
+			IsCurrent:   snap.Current,
+			External:    snap.External,
+			HasMemory:   snap.HasMemory,
+		}
+		if snap.CreationTime > 0 {
+			want.CreatedAt = time.Unix(snap.CreationTime, 0)
+		}
+
+		row, ok := byName[snap.Name]
+		delete(byName, snap.Name)
+		if !ok {
+			if err := tx.Create(&want).Error; err != nil {
+				return false, fmt.Errorf("failed to record snapshot %s: %w", snap.Name, err)
+			}
+			changed = true
+			continue
+		}
+		if row.Description == want.Description && row.ParentName == want.ParentName && row.State == want.State &&
+			row.ConfigXML == want.ConfigXML && row.IsCurrent == want.IsCurrent && row.External == want.External && row.HasMemory == want.HasMemory {
+			continue
+		}
+		if err := tx.Model(&row).Updates(map[string]interface{}{
+			"description": want.Description,
+			"parent_name": want.ParentName,
+			"state":       want.State,
+			"config_xml":  want.ConfigXML,
+			"is_current":  want.IsCurrent,
+			"external":    want.External,
+			"has_memory":  want.HasMemory,
+		}).Error; err != nil {
+			return false, fmt.Errorf("failed to update snapshot %s: %w", snap.Name, err)
+		}
+		changed = true
+	}
+
+	// Whatever is left was deleted outside Virtumancer.
+	for name, row := range byName {
+		if err := tx.Unscoped().Delete(&row).Error; err != nil {
+			return false, fmt.Errorf("failed to remove snapshot %s: %w", name, err)
+		}
+		log.Debugf("Removed stale snapshot %s of vm %s", name, vmUUID)
+		changed = true
+	}
+	return changed, nil
+}
@@ -0,0 +1,295 @@
+package services
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/capsali/virtumancer/internal/libvirt"
+	log "github.com/capsali/virtumancer/internal/logging"
+	"github.com/capsali/virtumancer/internal/storage"
+	golibvirt "github.com/digitalocean/go-libvirt"
+)
+
+const (
+	// instanceNumberPlaceholder is replaced by each instance's number in a
+	// name pattern.
+	instanceNumberPlaceholder = "{n}"
+	// maxTemplateInstances caps the VMs one instantiation creates.
+	maxTemplateInstances = 100
+)
+
+// TemplateInstantiateRequest describes the VMs to create from a template.
+type TemplateInstantiateRequest struct {
+	// NamePattern names the instances, with "{n}" standing for each
+	// instance's number. It may only leave "{n}" out when Count is 1.
+	NamePattern string `json:"name_pattern"`
+	Count       int    `json:"count"`
+	// FirstIndex is the number of the first instance; it defaults to 1.
+	FirstIndex int `json:"first_index,omitempty"`
+	// TargetPool receives the instances' volumes and seeds. Volumes default
+	// to the pool of the template volume they copy, seeds to "default".
+	TargetPool string `json:"target_pool,omitempty"`
+	// Linked gives each instance qcow2 overlays of the template's volumes
+	// instead of full copies.
+	Linked bool `json:"linked"`
+	// CloudInit seeds every instance's first boot. CloudInitOverrides
+	// replaces its fields per instance name; an instance with an override
+	// is seeded even when CloudInit is not set.
+	CloudInit          *storage.CloudInitConfig           `json:"cloud_init,omitempty"`
+	CloudInitOverrides map[string]storage.CloudInitConfig `json:"cloud_init_overrides,omitempty"`
+}
+
+// TemplateCopyRequest describes a copy of a template on another host.
+type TemplateCopyRequest struct {
+	TargetHostID string `json:"target_host_id"`
+	// TargetPool receives the copied volumes. By default each copy goes to
+	// a pool named like the one of the volume it was copied from.
+	TargetPool string `json:"target_pool,omitempty"`
+	// Name defaults to the template's name.
+	Name string `json:"name,omitempty"`
+}
+
+// instanceNames expands the name pattern of an instantiation.
+func instanceNames(req TemplateInstantiateRequest) ([]string, error) {
+	if req.NamePattern == "" {
+		return nil, fmt.Errorf("invalid instantiation: name_pattern is required")
+	}
+	if req.Count < 1 || req.Count > maxTemplateInstances {
+		return nil, fmt.Errorf("invalid instantiation: count must be 1 to %d", maxTemplateInstances)
+	}
+	if req.Count > 1 && !strings.Contains(req.NamePattern, instanceNumberPlaceholder) {
+		return nil, fmt.Errorf("invalid instantiation: name_pattern needs %s to name more than one instance", instanceNumberPlaceholder)
+	}
+	if req.FirstIndex < 0 {
+		return nil, fmt.Errorf("invalid instantiation: first_index cannot be negative")
+	}
+	first := req.FirstIndex
+	if first == 0 {
+		first = 1
+	}
+	names := make([]string, req.Count)
+	for i := range names {
+		names[i] = strings.ReplaceAll(req.NamePattern, instanceNumberPlaceholder, strconv.Itoa(first+i))
+	}
+	return names, nil
+}
+
+// instanceCloudInit is the cloud-init data of one instance, or nil when it
+// is not seeded.
+func instanceCloudInit(req TemplateInstantiateRequest, name string) *storage.CloudInitConfig {
+	override, ok := req.CloudInitOverrides[name]
+	if req.CloudInit == nil && !ok {
+		return nil
+	}
+	var cfg storage.CloudInitConfig
+	if req.CloudInit != nil {
+		cfg = *req.CloudInit
+	}
+	if override.UserData != "" {
+		cfg.UserData = override.UserData
+	}
+	if override.MetaData != "" {
+		cfg.MetaData = override.MetaData
+	}
+	if override.NetworkConfig != "" {
+		cfg.NetworkConfig = override.NetworkConfig
+	}
+	return &cfg
+}
+
+// findTemplate returns a VM that has been converted into a template.
+func (s *HostService) findTemplate(hostID, vmName string) (*storage.VirtualMachine, error) {
+	vm, err := s.findVM(hostID, vmName)
+	if err != nil {
+		return nil, err
+	}
+	if !vm.IsTemplate {
+		return nil, fmt.Errorf("invalid template: vm %s is not a template", vmName)
+	}
+	return vm, nil
+}
+
+// ensureNotTemplate refuses to power on or off a VM that has been
+// converted into a template.
+func (s *HostService) ensureNotTemplate(hostID, vmName string) error {
+	var vms []storage.VirtualMachine
+	if err := s.db.Where("host_id = ? AND name = ?", hostID, vmName).Limit(1).Find(&vms).Error; err != nil {
+		return fmt.Errorf("failed to load vm %s: %w", vmName, err)
+	}
+	if len(vms) > 0 && vms[0].IsTemplate {
+		return fmt.Errorf("vm %s is in use as a template and cannot be powered on or off", vmName)
+	}
+	return nil
+}
+
+// ListTemplates returns the templates of every host.
+func (s *HostService) ListTemplates() ([]storage.VirtualMachine, error) {
+	var templates []storage.VirtualMachine
+	if err := s.db.Where("is_template = ?", true).Order("host_id, name").Find(&templates).Error; err != nil {
+		return nil, fmt.Errorf("failed to list templates: %w", err)
+	}
+	return templates, nil
+}
+
+// ConvertVMToTemplate turns a shut-off VM into a template. Templates cannot
+// be powered on; they are copied into new VMs by InstantiateTemplate.
+func (s *HostService) ConvertVMToTemplate(hostID, vmName string) (*storage.VirtualMachine, error) {
+	vm, err := s.findVM(hostID, vmName)
+	if err != nil {
+		return nil, err
+	}
+	if vm.IsTemplate {
+		return vm, nil
+	}
+	if !s.connector.IsConnected(hostID) {
+		return nil, fmt.Errorf("host %s is disconnected", hostID)
+	}
+	info, err := s.connector.GetDomainInfo(hostID, vmName)
+	if err != nil {
+		return nil, err
+	}
+	if info.State != golibvirt.DomainShutoff {
+		return nil, fmt.Errorf("invalid template: vm %s must be shut off to become a template", vmName)
+	}
+	if info.HasManagedSave {
+		return nil, fmt.Errorf("invalid template: vm %s has a managed save image", vmName)
+	}
+	if err := s.db.Model(vm).Update("is_template", true).Error; err != nil {
+		return nil, fmt.Errorf("failed to convert vm %s to a template: %w", vmName, err)
+	}
+	log.Infof("Converted VM %s on host %s to a template", vmName, hostID)
+	s.broadcastVMsChanged(hostID)
+	return vm, nil
+}
+
+// ConvertTemplateToVM turns a template back into a VM that can be started.
+// Linked instances of the template still keep it from starting.
+func (s *HostService) ConvertTemplateToVM(hostID, vmName string) (*storage.VirtualMachine, error) {
+	vm, err := s.findTemplate(hostID, vmName)
+	if err != nil {
+		return nil, err
+	}
+	if err := s.db.Model(vm).Update("is_template", false).Error; err != nil {
+		return nil, fmt.Errorf("failed to convert template %s to a vm: %w", vmName, err)
+	}
+	log.Infof("Converted template %s on host %s back to a VM", vmName, hostID)
+	s.broadcastVMsChanged(hostID)
+	return vm, nil
+}
+
+// InstantiateTemplate creates VMs from a template on its host. Each
+// instance is a clone with its own UUID and MAC addresses; instances with
+// cloud-init data also get a NoCloud seed in a new CD-ROM drive. Either
+// every instance is created or none is.
+func (s *HostService) InstantiateTemplate(hostID, vmName string, req TemplateInstantiateRequest) ([]storage.VirtualMachine, error) {
+	names, err := instanceNames(req)
+	if err != nil {
+		return nil, err
+	}
+	known := make(map[string]bool, len(names))
+	for _, name := range names {
+		known[name] = true
+	}
+	for name := range req.CloudInitOverrides {
+		if !known[name] {
+			return nil, fmt.Errorf("invalid instantiation: cloud-init override %s matches no instance", name)
+		}
+	}
+	for _, name := range names {
+		if cfg := instanceCloudInit(req, name); cfg != nil {
+			if err := validateProvisioning(storage.CreateVMRequest{CloudInit: cfg}); err != nil {
+				return nil, err
+			}
+		}
+	}
+	if _, err := s.findTemplate(hostID, vmName); err != nil {
+		return nil, err
+	}
+
+	seedPool := req.TargetPool
+	if seedPool == "" {
+		seedPool = "default"
+	}
+	var instances []storage.VirtualMachine
+	rollback := func() {
+		for _, vm := range instances {
+			if err := s.DeleteVM(hostID, vm.Name, VMDeleteRequest{Force: true, DiskPolicy: DiskPolicyDelete}); err != nil {
+				log.Warnf("Failed to remove instance %s of template %s: %v", vm.Name, vmName, err)
+			}
+		}
+	}
+	for _, name := range names {
+		vm, err := s.CloneVM(hostID, vmName, CloneRequest{Name: name, TargetPool: req.TargetPool, Linked: req.Linked})
+		if err != nil {
+			rollback()
+			return nil, err
+		}
+		instances = append(instances, *vm)
+		if cfg := instanceCloudInit(req, name); cfg != nil {
+			if err := s.attachInstanceSeed(hostID, seedPool, vm, *cfg); err != nil {
+				rollback()
+				return nil, err
+			}
+		}
+	}
+	log.Infof("Instantiated %d VMs from template %s on host %s", len(instances), vmName, hostID)
+	s.broadcastVMsChanged(hostID)
+	return instances, nil
+}
+
+// attachInstanceSeed seeds the first boot of a new, shut-off instance from
+// a SATA CD-ROM drive. The drive is recorded like CreateVM records its seed,
+// and the instance's definition is rendered again from its records.
+func (s *HostService) attachInstanceSeed(hostID, poolName string, vm *storage.VirtualMachine, cfg storage.CloudInitConfig) error {
+	hardware, err := s.connector.GetDomainHardware(hostID, vm.Name)
+	if err != nil {
+		return err
+	}
+	used := make([]string, 0, len(hardware.Disks))
+	for _, disk := range hardware.Disks {
+		used = append(used, disk.Target.Dev)
+	}
+	target, err := libvirt.NextDiskTarget("sata", used)
+	if err != nil {
+		return err
+	}
+	if _, err := s.createProvisioningSeed(hostID, poolName, vm.ID, storage.CreateVMRequest{Name: vm.Name, CloudInit: &cfg}, target); err != nil {
+		return err
+	}
+	spec, err := s.definedDomainSpec(*vm)
+	if err != nil {
+		return err
+	}
+	domainXML, err := spec.XML()
+	if err != nil {
+		return err
+	}
+	_, err = s.connector.DefineAndCreateDomain(hostID, domainXML)
+	return err
+}
+
+// CopyTemplate copies a template's definition and volumes to another host,
+// or under another name on its own host. The copy is a template too.
+func (s *HostService) CopyTemplate(hostID, vmName string, req TemplateCopyRequest) (*storage.VirtualMachine, error) {
+	if req.TargetHostID == "" {
+		return nil, fmt.Errorf("invalid template copy: target_host_id is required")
+	}
+	name := req.Name
+	if name == "" {
+		name = vmName
+	}
+	if _, err := s.findTemplate(hostID, vmName); err != nil {
+		return nil, err
+	}
+	copied, err := s.CloneVM(hostID, vmName, CloneRequest{Name: name, TargetHostID: req.TargetHostID, TargetPool: req.TargetPool})
+	if err != nil {
+		return nil, err
+	}
+	if err := s.db.Model(copied).Update("is_template", true).Error; err != nil {
+		return nil, fmt.Errorf("failed to mark copy %s of template %s as a template: %w", name, vmName, err)
+	}
+	log.Infof("Copied template %s on host %s to %s on host %s", vmName, hostID, name, req.TargetHostID)
+	s.broadcastVMsChanged(req.TargetHostID)
+	return copied, nil
+}
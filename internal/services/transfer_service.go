@@ -0,0 +1,446 @@
+package services
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"hash"
+	"io"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/capsali/virtumancer/internal/logging"
+	"github.com/capsali/virtumancer/internal/storage"
+	"github.com/capsali/virtumancer/internal/ws"
+)
+
+const (
+	// transferBlockSize is the unit uploads are scanned in for empty
+	// ranges. Whole blocks of zeros are not sent to file-backed volumes.
+	transferBlockSize = 1 << 20
+	// transferRunSize bounds the data buffered before it is written.
+	transferRunSize = 32 << 20
+	// transferProgressInterval throttles progress events.
+	transferProgressInterval = 500 * time.Millisecond
+)
+
+// VolumeUploadRequest creates a volume to upload an image into.
+type VolumeUploadRequest struct {
+	// Pool defaults to "default".
+	Pool      string `json:"pool,omitempty"`
+	Name      string `json:"name"`
+	SizeBytes uint64 `json:"size_bytes"`
+	// SHA256 is the hex digest of the whole image. When set, an upload
+	// whose bytes do not match fails.
+	SHA256 string `json:"sha256,omitempty"`
+}
+
+// VolumeUploadStatus reports the progress of an upload. Offset is where the
+// next chunk has to start.
+type VolumeUploadStatus struct {
+	VolumeID  string `json:"volume_id"`
+	Offset    uint64 `json:"offset"`
+	SizeBytes uint64 `json:"size_bytes"`
+	Complete  bool   `json:"complete"`
+	// SHA256 is the digest of the received image, once complete.
+	SHA256 string `json:"sha256,omitempty"`
+}
+
+// UploadOffsetError rejects a chunk that does not continue an upload where
+// it left off.
+type UploadOffsetError struct {
+	Status VolumeUploadStatus
+	Got    uint64
+}
+
+func (e *UploadOffsetError) Error() string {
+	return fmt.Sprintf("upload of volume %s continues at offset %d, not %d", e.Status.VolumeID, e.Status.Offset, e.Got)
+}
+
+// VolumeDownload describes a volume about to be downloaded.
+type VolumeDownload struct {
+	VolumeID  string
+	Name      string
+	SizeBytes uint64
+	hostID    string
+	path      string
+}
+
+// volumeUpload is the state of an upload between chunks. It lives in
+// memory, so uploads cut short by a restart have to start over.
+type volumeUpload struct {
+	mu           sync.Mutex
+	hostID       string
+	path         string
+	size         uint64
+	offset       uint64
+	expected     string
+	hash         hash.Hash
+	busy         bool
+	lastProgress time.Time
+	// sparse is set when the volume is a new file, whose unwritten ranges
+	// read back as zeros. Block-backed volumes keep the old contents of
+	// their extents, so every block has to be written.
+	sparse bool
+}
+
+func (u *volumeUpload) status(volumeID string) VolumeUploadStatus {
+	return VolumeUploadStatus{VolumeID: volumeID, Offset: u.offset, SizeBytes: u.size}
+}
+
+func validateUploadName(name string) error {
+	if name == "" || name == "." || name == ".." || strings.ContainsAny(name, "/\x00") {
+		return fmt.Errorf("invalid upload: bad volume name %q", name)
+	}
+	return nil
+}
+
+// CreateVolumeUpload creates an empty raw volume and its Volume row, ready
+// for UploadVolumeData to fill. The pool refresh after the last chunk picks
+// up the image's real format, so qcow2 images need no special handling.
+func (s *HostService) CreateVolumeUpload(hostID string, req VolumeUploadRequest) (*storage.Volume, error) {
+	if err := validateUploadName(req.Name); err != nil {
+		return nil, err
+	}
+	if req.SizeBytes == 0 {
+		return nil, fmt.Errorf("invalid upload: size_bytes is required")
+	}
+	expected := strings.ToLower(req.SHA256)
+	if expected != "" {
+		if b, err := hex.DecodeString(expected); err != nil || len(b) != sha256.Size {
+			return nil, fmt.Errorf("invalid upload: bad sha256 digest %q", req.SHA256)
+		}
+	}
+	poolName := req.Pool
+	if poolName == "" {
+		poolName = "default"
+	}
+	if !s.connector.IsConnected(hostID) {
+		return nil, fmt.Errorf("host %s is disconnected", hostID)
+	}
+	pools, err := s.connector.ListAllStoragePools(hostID)
+	if err != nil {
+		return nil, err
+	}
+	found, sparse := false, false
+	for _, p := range pools {
+		if p.Name != poolName {
+			continue
+		}
+		found = true
+		sparse = poolVolumesAreFiles(p.Type)
+		if req.SizeBytes > p.AvailableBytes {
+			return nil, fmt.Errorf("invalid upload: pool %s has %d bytes free, %d needed", poolName, p.AvailableBytes, req.SizeBytes)
+		}
+	}
+	if !found {
+		return nil, fmt.Errorf("storage pool %s not found on host %s", poolName, hostID)
+	}
+
+	// The Volume row belongs to the pool's row, which a host sync creates.
+	var pool storage.StoragePool
+	if err := s.db.Where("host_id = ? AND name = ?", hostID, poolName).First(&pool).Error; err != nil {
+		if _, err := s.syncHostStoragePools(hostID); err != nil {
+			return nil, err
+		}
+		if err := s.db.Where("host_id = ? AND name = ?", hostID, poolName).First(&pool).Error; err != nil {
+			return nil, fmt.Errorf("storage pool %s not found on host %s: %w", poolName, hostID, err)
+		}
+	}
+
+	volPath, err := s.connector.CreateRawStorageVolume(hostID, poolName, req.Name, req.SizeBytes)
+	if err != nil {
+		return nil, err
+	}
+	volType := "DISK"
+	if strings.HasSuffix(strings.ToLower(req.Name), ".iso") {
+		volType = "ISO"
+	}
+	vol := storage.Volume{
+		StoragePoolID: pool.ID,
+		Name:          req.Name,
+		Path:          volPath,
+		Type:          volType,
+		Format:        "raw",
+		CapacityBytes: req.SizeBytes,
+		State:         string(storage.StorageStateUnknown),
+		TaskState:     string(storage.StorageTaskUploading),
+	}
+	if err := s.db.Create(&vol).Error; err != nil {
+		if delErr := s.connector.DeleteStorageVolume(hostID, poolName, req.Name); delErr != nil {
+			log.Warnf("Failed to remove volume %s after a failed upload setup: %v", req.Name, delErr)
+		}
+		return nil, fmt.Errorf("failed to save volume %s: %w", req.Name, err)
+	}
+	s.uploads.Store(vol.ID, &volumeUpload{
+		hostID:   hostID,
+		path:     volPath,
+		size:     req.SizeBytes,
+		expected: expected,
+		hash:     sha256.New(),
+		sparse:   sparse,
+	})
+	log.Infof("Created volume %s in pool %s on host %s for a %d byte upload", req.Name, poolName, hostID, req.SizeBytes)
+	return &vol, nil
+}
+
+func (s *HostService) volumeUpload(volumeID string) (*volumeUpload, error) {
+	u, ok := s.uploads.Load(volumeID)
+	if !ok {
+		return nil, fmt.Errorf("upload of volume %s not found", volumeID)
+	}
+	return u.(*volumeUpload), nil
+}
+
+// GetVolumeUploadStatus reports how much of an upload has been received, so
+// an interrupted client knows where to resume.
+func (s *HostService) GetVolumeUploadStatus(volumeID string) (*VolumeUploadStatus, error) {
+	u, err := s.volumeUpload(volumeID)
+	if err != nil {
+		return nil, err
+	}
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	status := u.status(volumeID)
+	return &status, nil
+}
+
+// UploadVolumeData writes the next chunk of an upload, which must start at
+// the upload's current offset. Data received before the client goes away
+// is kept, so the upload can resume from the returned offset. Blocks of
+// zeros are skipped for file-backed volumes; the file was created empty, so
+// they read back the same while taking no space.
+func (s *HostService) UploadVolumeData(volumeID string, offset uint64, r io.Reader) (*VolumeUploadStatus, error) {
+	u, err := s.volumeUpload(volumeID)
+	if err != nil {
+		return nil, err
+	}
+	u.mu.Lock()
+	if u.busy {
+		u.mu.Unlock()
+		return nil, fmt.Errorf("upload of volume %s is busy with another chunk", volumeID)
+	}
+	if offset != u.offset {
+		err := &UploadOffsetError{Status: u.status(volumeID), Got: offset}
+		u.mu.Unlock()
+		return nil, err
+	}
+	u.busy = true
+	u.mu.Unlock()
+	defer func() {
+		u.mu.Lock()
+		u.busy = false
+		u.mu.Unlock()
+	}()
+
+	block := make([]byte, transferBlockSize)
+	var run bytes.Buffer
+	runStart := u.offset
+	flush := func() error {
+		if run.Len() == 0 {
+			return nil
+		}
+		n := uint64(run.Len())
+		if err := s.connector.UploadStorageVolume(u.hostID, u.path, &run, runStart, n); err != nil {
+			return err
+		}
+		run.Reset()
+		return nil
+	}
+
+	var readErr error
+	for readErr == nil {
+		var n int
+		n, readErr = io.ReadFull(r, block)
+		if readErr == io.ErrUnexpectedEOF {
+			readErr = io.EOF
+		}
+		if n == 0 {
+			break
+		}
+		if u.offset+uint64(n) > u.size {
+			readErr = fmt.Errorf("invalid upload: data runs past the declared size of %d bytes", u.size)
+			break
+		}
+		chunk := block[:n]
+		u.hash.Write(chunk)
+		if u.sparse && isZero(chunk) {
+			if err := flush(); err != nil {
+				readErr = err
+				break
+			}
+			u.offset += uint64(n)
+			runStart = u.offset
+		} else {
+			run.Write(chunk)
+			u.offset += uint64(n)
+			if run.Len() >= transferRunSize {
+				if err := flush(); err != nil {
+					readErr = err
+					break
+				}
+				runStart = u.offset
+			}
+		}
+		s.uploadProgress(volumeID, u, false)
+	}
+	if err := flush(); err != nil && (readErr == nil || readErr == io.EOF) {
+		readErr = err
+	}
+	if readErr != nil && readErr != io.EOF {
+		// A failed write leaves the host behind our count; the client
+		// restarts the upload rather than resuming into a gap.
+		if run.Len() > 0 {
+			s.abortUpload(volumeID, u)
+		}
+		return nil, readErr
+	}
+
+	status := u.status(volumeID)
+	if u.offset < u.size {
+		return &status, nil
+	}
+	return s.finishUpload(volumeID, u)
+}
+
+// poolVolumesAreFiles reports whether new volumes of a pool type are sparse
+// files. Logical, disk, iSCSI and network block pools hand out extents that
+// may still hold a previous volume's data.
+func poolVolumesAreFiles(poolType string) bool {
+	switch poolType {
+	case "dir", "fs", "netfs":
+		return true
+	}
+	return false
+}
+
+// isZero reports whether b holds only zero bytes.
+func isZero(b []byte) bool {
+	for _, c := range b {
+		if c != 0 {
+			return false
+		}
+	}
+	return true
+}
+
+func (s *HostService) uploadProgress(volumeID string, u *volumeUpload, force bool) {
+	if !force && time.Since(u.lastProgress) < transferProgressInterval {
+		return
+	}
+	u.lastProgress = time.Now()
+	s.broadcastTransferProgress(volumeID, "upload", u.offset, u.size)
+}
+
+func (s *HostService) broadcastTransferProgress(volumeID, direction string, done, total uint64) {
+	s.hub.BroadcastMessage(ws.Message{
+		Type: "volume-transfer-progress",
+		Payload: ws.MessagePayload{
+			"volumeId":   volumeID,
+			"direction":  direction,
+			"bytes":      done,
+			"totalBytes": total,
+		},
+	})
+}
+
+// abortUpload marks an upload that cannot continue as failed.
+func (s *HostService) abortUpload(volumeID string, u *volumeUpload) {
+	s.uploads.Delete(volumeID)
+	s.db.Model(&storage.Volume{}).Where("id = ?", volumeID).Updates(map[string]interface{}{"state": string(storage.StorageStateError), "task_state": ""})
+	log.Warnf("Upload of volume %s failed at offset %d", volumeID, u.offset)
+}
+
+// finishUpload checks the digest of a complete upload and records what the
+// host now reports about the volume.
+func (s *HostService) finishUpload(volumeID string, u *volumeUpload) (*VolumeUploadStatus, error) {
+	digest := hex.EncodeToString(u.hash.Sum(nil))
+	if u.expected != "" && digest != u.expected {
+		s.abortUpload(volumeID, u)
+		return nil, fmt.Errorf("invalid upload: checksum mismatch, expected sha256 %s but received %s", u.expected, digest)
+	}
+	s.uploads.Delete(volumeID)
+	updates := map[string]interface{}{"state": string(storage.StorageStateAvailable), "task_state": ""}
+	if detail, err := s.connector.GetStorageVolume(u.hostID, u.path); err != nil {
+		log.Warnf("Failed to refresh volume %s after upload: %v", volumeID, err)
+	} else {
+		updates["format"] = detail.Format
+		updates["capacity_bytes"] = detail.Capacity
+		updates["allocation_bytes"] = detail.Allocation
+	}
+	if err := s.db.Model(&storage.Volume{}).Where("id = ?", volumeID).Updates(updates).Error; err != nil {
+		return nil, fmt.Errorf("failed to update volume %s: %w", volumeID, err)
+	}
+	s.uploadProgress(volumeID, u, true)
+	log.Infof("Finished upload of volume %s (sha256 %s)", volumeID, digest)
+	status := u.status(volumeID)
+	status.Complete = true
+	status.SHA256 = digest
+	return &status, nil
+}
+
+// StatVolumeDownload returns the size a download of the volume has.
+func (s *HostService) StatVolumeDownload(volumeID string) (*VolumeDownload, error) {
+	var vol storage.Volume
+	if err := s.db.Where("id = ?", volumeID).First(&vol).Error; err != nil {
+		return nil, fmt.Errorf("volume %s not found: %w", volumeID, err)
+	}
+	if vol.TaskState != "" {
+		return nil, fmt.Errorf("volume %s is busy (%s)", vol.Name, vol.TaskState)
+	}
+	if vol.Path == "" {
+		return nil, fmt.Errorf("invalid download: volume %s has no path", vol.Name)
+	}
+	users, err := s.volumeUsers(vol)
+	if err != nil {
+		return nil, err
+	}
+	hostID, _, err := s.locateVolume(vol, users)
+	if err != nil {
+		return nil, err
+	}
+	detail, err := s.connector.GetStorageVolume(hostID, vol.Path)
+	if err != nil {
+		return nil, err
+	}
+	return &VolumeDownload{
+		VolumeID:  vol.ID,
+		Name:      volumeFileName(vol),
+		SizeBytes: detail.Physical,
+		hostID:    hostID,
+		path:      vol.Path,
+	}, nil
+}
+
+// DownloadVolume streams length bytes of a volume from offset into w.
+func (s *HostService) DownloadVolume(dl *VolumeDownload, w io.Writer, offset, length uint64) error {
+	pw := &progressWriter{w: w, report: func(n uint64) {
+		s.broadcastTransferProgress(dl.VolumeID, "download", offset+n, dl.SizeBytes)
+	}}
+	if err := s.connector.DownloadStorageVolume(dl.hostID, dl.path, pw, offset, length); err != nil {
+		return err
+	}
+	pw.report(pw.n)
+	return nil
+}
+
+// progressWriter reports the bytes written through it at most every
+// transferProgressInterval.
+type progressWriter struct {
+	w      io.Writer
+	n      uint64
+	last   time.Time
+	report func(n uint64)
+}
+
+func (p *progressWriter) Write(b []byte) (int, error) {
+	n, err := p.w.Write(b)
+	p.n += uint64(n)
+	if time.Since(p.last) >= transferProgressInterval {
+		p.last = time.Now()
+		p.report(p.n)
+	}
+	return n, err
+}
@@ -0,0 +1,544 @@
+package services
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strconv"
+
+	"github.com/capsali/virtumancer/internal/libvirt"
+	log "github.com/capsali/virtumancer/internal/logging"
+	"github.com/capsali/virtumancer/internal/storage"
+)
+
+// cpuModes are the CPU models that name a libvirt CPU mode rather than a
+// named model of mode "custom".
+var cpuModes = map[string]bool{
+	"host-passthrough": true,
+	"host-model":       true,
+	"maximum":          true,
+}
+
+// cdromMetadata marks the disk attachments of CD-ROM drives, which are
+// otherwise indistinguishable from read-only disks.
+const cdromMetadata = `{"device":"cdrom"}`
+
+// renderVMDomain renders the domain XML of a VM from its database records.
+func (s *HostService) renderVMDomain(vm storage.VirtualMachine) (string, error) {
+	spec, err := s.domainSpecFromDB(vm)
+	if err != nil {
+		return "", err
+	}
+	return spec.XML()
+}
+
+// domainSpecFromDB assembles a VM's domain definition from the VM row and
+// the hardware recorded against it, which is what host syncs ingest from
+// libvirt and what Virtumancer's own device operations keep up to date.
+func (s *HostService) domainSpecFromDB(vm storage.VirtualMachine) (libvirt.DomainSpec, error) {
+	spec := libvirt.DomainSpec{
+		Name:            vm.Name,
+		UUID:            vm.DomainUUID,
+		Title:           vm.Title,
+		Description:     vm.Description,
+		Metadata:        vm.Metadata,
+		VCPUs:           vm.VCPUCount,
+		MemoryKB:        vm.MemoryBytes / 1024,
+		CurrentMemoryKB: vm.CurrentMemory / 1024,
+	}
+	if spec.UUID == "" {
+		spec.UUID = vm.ID
+	}
+	if vm.CPUModel != "" {
+		if cpuModes[vm.CPUModel] {
+			spec.CPU.Mode = vm.CPUModel
+		} else {
+			spec.CPU.Mode = "custom"
+			spec.CPU.Model = vm.CPUModel
+		}
+	}
+
+	loaders := []func(*libvirt.DomainSpec, storage.VirtualMachine) error{
+		s.loadDomainOS,
+		s.loadDomainCPU,
+		s.loadDomainMemory,
+		s.loadDomainPlatform,
+		s.loadDomainDisks,
+		s.loadDomainInterfaces,
+		s.loadDomainDevices,
+		s.loadDomainProvisioning,
+	}
+	for _, load := range loaders {
+		if err := load(&spec, vm); err != nil {
+			return libvirt.DomainSpec{}, err
+		}
+	}
+	return spec, nil
+}
+
+// loadDomainOS fills in the firmware, boot menu and boot order.
+func (s *HostService) loadDomainOS(spec *libvirt.DomainSpec, vm storage.VirtualMachine) error {
+	var osConfigs []storage.OSConfig
+	if err := s.db.Where("vm_uuid = ?", vm.ID).Limit(1).Find(&osConfigs).Error; err != nil {
+		return fmt.Errorf("failed to load OS config of vm %s: %w", vm.Name, err)
+	}
+	if len(osConfigs) > 0 {
+		cfg := osConfigs[0]
+		spec.OS.Firmware = cfg.Firmware
+		if cfg.LoaderPath != "" || cfg.LoaderType != "" || cfg.NVramPath != "" || cfg.NVramTemplate != "" {
+			spec.OS.Loader = &libvirt.OSLoaderConfig{
+				Type:          cfg.LoaderType,
+				Path:          cfg.LoaderPath,
+				ReadOnly:      cfg.LoaderReadonly,
+				Secure:        cfg.LoaderSecure,
+				NVRAM:         cfg.NVramPath,
+				NVRAMTemplate: cfg.NVramTemplate,
+			}
+		}
+		spec.OS.BootMenu = cfg.BootMenuEnable
+		spec.OS.BootMenuTimeout = cfg.BootMenuTimeout
+		spec.OS.SMBIOSMode = cfg.SMBIOSMode
+		spec.OS.BIOSUseSerial = cfg.BIOSUsesSerial
+		if cfg.BIOSRebootTimeout > 0 {
+			spec.OS.BIOSRebootTimeout = strconv.FormatUint(uint64(cfg.BIOSRebootTimeout), 10)
+		}
+	}
+
+	var bootConfigs []storage.BootConfig
+	if err := s.db.Where("vm_uuid = ?", vm.ID).Limit(1).Find(&bootConfigs).Error; err != nil {
+		return fmt.Errorf("failed to load boot order of vm %s: %w", vm.Name, err)
+	}
+	if len(bootConfigs) > 0 && bootConfigs[0].BootOrderJSON != "" {
+		var entries []libvirt.BootEntry
+		if err := json.Unmarshal([]byte(bootConfigs[0].BootOrderJSON), &entries); err != nil {
+			return fmt.Errorf("invalid boot order of vm %s: %w", vm.Name, err)
+		}
+		sort.SliceStable(entries, func(i, j int) bool { return entries[i].Order < entries[j].Order })
+		for _, entry := range entries {
+			spec.OS.Boot = append(spec.OS.Boot, entry.Dev)
+		}
+	}
+	return nil
+}
+
+// loadDomainCPU fills in the CPU topology, features and NUMA cells.
+func (s *HostService) loadDomainCPU(spec *libvirt.DomainSpec, vm storage.VirtualMachine) error {
+	var topologies []storage.CPUTopology
+	if err := s.db.Where("vm_uuid = ?", vm.ID).Limit(1).Find(&topologies).Error; err != nil {
+		return fmt.Errorf("failed to load CPU topology of vm %s: %w", vm.Name, err)
+	}
+	if len(topologies) > 0 {
+		spec.CPU.Sockets = topologies[0].Sockets
+		spec.CPU.Cores = topologies[0].Cores
+		spec.CPU.Threads = topologies[0].Threads
+	}
+
+	var features []storage.CPUFeature
+	if err := s.db.Where("vm_uuid = ?", vm.ID).Order("name").Find(&features).Error; err != nil {
+		return fmt.Errorf("failed to load CPU features of vm %s: %w", vm.Name, err)
+	}
+	for _, f := range features {
+		spec.CPU.Features = append(spec.CPU.Features, libvirt.CPUFeatureInfo{Name: f.Name, Policy: f.Policy})
+	}
+
+	var cells []storage.NUMANode
+	if err := s.db.Where("vm_uuid = ?", vm.ID).Order("node_id").Find(&cells).Error; err != nil {
+		return fmt.Errorf("failed to load NUMA cells of vm %s: %w", vm.Name, err)
+	}
+	for _, c := range cells {
+		spec.NUMACells = append(spec.NUMACells, libvirt.NUMANodeInfo{ID: c.NodeID, CPUs: c.CPUsJSON, MemoryKB: c.MemoryKB})
+	}
+	return nil
+}
+
+// loadDomainMemory fills in the memory backing.
+func (s *HostService) loadDomainMemory(spec *libvirt.DomainSpec, vm storage.VirtualMachine) error {
+	var backings []storage.MemoryConfig
+	if err := s.db.Where("vm_uuid = ? AND config_type = ?", vm.ID, "backing").Limit(1).Find(&backings).Error; err != nil {
+		return fmt.Errorf("failed to load memory backing of vm %s: %w", vm.Name, err)
+	}
+	if len(backings) == 0 {
+		return nil
+	}
+	b := backings[0]
+	spec.MemoryBacking = &libvirt.MemoryBackingInfo{
+		Source:       b.SourceType,
+		Access:       b.Mode,
+		NoSharePages: b.Nosharepages,
+		Locked:       b.Locked,
+	}
+	if b.ConfigJSON != "" {
+		var pages []libvirt.HugePageInfo
+		if err := json.Unmarshal([]byte(b.ConfigJSON), &pages); err != nil {
+			return fmt.Errorf("invalid hugepages of vm %s: %w", vm.Name, err)
+		}
+		if len(pages) > 0 {
+			spec.MemoryBacking.HugePages = &libvirt.HugePagesInfo{Page: pages}
+		}
+	}
+	return nil
+}
+
+// loadDomainPlatform fills in hypervisor features, lifecycle actions, the
+// clock, perf events and security settings.
+func (s *HostService) loadDomainPlatform(spec *libvirt.DomainSpec, vm storage.VirtualMachine) error {
+	var features []storage.HypervisorFeature
+	if err := s.db.Where("vm_uuid = ?", vm.ID).Order("id").Find(&features).Error; err != nil {
+		return fmt.Errorf("failed to load hypervisor features of vm %s: %w", vm.Name, err)
+	}
+	for _, f := range features {
+		spec.Features = append(spec.Features, libvirt.HypervisorFeatureInfo{Name: f.Name, State: f.State})
+	}
+
+	var lifecycles []storage.LifecycleAction
+	if err := s.db.Where("vm_uuid = ?", vm.ID).Limit(1).Find(&lifecycles).Error; err != nil {
+		return fmt.Errorf("failed to load lifecycle actions of vm %s: %w", vm.Name, err)
+	}
+	if len(lifecycles) > 0 {
+		spec.Lifecycle = libvirt.LifecycleActionInfo{
+			OnPoweroff:    lifecycles[0].OnPoweroff,
+			OnReboot:      lifecycles[0].OnReboot,
+			OnCrash:       lifecycles[0].OnCrash,
+			OnLockFailure: lifecycles[0].OnLockfailure,
+		}
+	}
+
+	var clocks []storage.Clock
+	if err := s.db.Where("vm_uuid = ?", vm.ID).Limit(1).Find(&clocks).Error; err != nil {
+		return fmt.Errorf("failed to load clock of vm %s: %w", vm.Name, err)
+	}
+	if len(clocks) > 0 {
+		spec.ClockOffset = clocks[0].Offset
+	}
+
+	var events []storage.PerfEvent
+	if err := s.db.Where("vm_uuid = ?", vm.ID).Order("name").Find(&events).Error; err != nil {
+		return fmt.Errorf("failed to load perf events of vm %s: %w", vm.Name, err)
+	}
+	for _, e := range events {
+		spec.PerfEvents = append(spec.PerfEvents, libvirt.PerfEventInfo{Name: e.Name, Event: e.State})
+	}
+
+	var labels []storage.SecurityLabel
+	if err := s.db.Where("vm_uuid = ?", vm.ID).Order("id").Find(&labels).Error; err != nil {
+		return fmt.Errorf("failed to load security labels of vm %s: %w", vm.Name, err)
+	}
+	for _, l := range labels {
+		label := libvirt.SecurityLabelInfo{Type: l.Type, Model: l.SecurityModel, Label: l.Label}
+		if l.Relabel {
+			label.Relabel = "yes"
+		}
+		spec.SecurityLabels = append(spec.SecurityLabels, label)
+	}
+
+	var launches []storage.LaunchSecurity
+	if err := s.db.Where("vm_uuid = ?", vm.ID).Limit(1).Find(&launches).Error; err != nil {
+		return fmt.Errorf("failed to load launch security of vm %s: %w", vm.Name, err)
+	}
+	if len(launches) > 0 {
+		ls := launches[0]
+		spec.LaunchSecurity = &libvirt.LaunchSecurityInfo{
+			Type:    ls.Type,
+			Policy:  fmt.Sprintf("0x%04x", ls.Policy),
+			DHCert:  ls.DHCert,
+			Session: ls.Session,
+		}
+		if ls.CBitPos > 0 {
+			spec.LaunchSecurity.CBitPos = strconv.FormatUint(uint64(ls.CBitPos), 10)
+		}
+		if ls.ReducedPhysBits > 0 {
+			spec.LaunchSecurity.ReducedPhysBits = strconv.FormatUint(uint64(ls.ReducedPhysBits), 10)
+		}
+	}
+	return nil
+}
+
+// loadDomainDisks fills in the disks and CD-ROM drives.
+func (s *HostService) loadDomainDisks(spec *libvirt.DomainSpec, vm storage.VirtualMachine) error {
+	var atts []storage.DiskAttachment
+	if err := s.db.Preload("Disk").Where("vm_uuid = ?", vm.ID).Order("device_name").Find(&atts).Error; err != nil {
+		return fmt.Errorf("failed to load disks of vm %s: %w", vm.Name, err)
+	}
+	for _, att := range atts {
+		var driver struct {
+			Type  string `json:"type"`
+			Cache string `json:"cache"`
+		}
+		if att.Disk.DriverJSON != "" {
+			json.Unmarshal([]byte(att.Disk.DriverJSON), &driver)
+		}
+		disk := libvirt.DiskDevice{
+			Path:      att.Disk.Path,
+			Format:    att.Disk.Format,
+			Bus:       att.BusType,
+			Target:    att.DeviceName,
+			Cache:     driver.Cache,
+			ReadOnly:  att.ReadOnly,
+			Shareable: att.Shareable,
+		}
+		if disk.Format == "" {
+			disk.Format = driver.Type
+		}
+		if att.Metadata == cdromMetadata {
+			disk.Device = "cdrom"
+		}
+		if att.Disk.IOTune != "" {
+			disk.IOTune = &libvirt.DiskIOTune{}
+			if err := json.Unmarshal([]byte(att.Disk.IOTune), disk.IOTune); err != nil {
+				return fmt.Errorf("invalid I/O limits on disk %s of vm %s: %w", att.DeviceName, vm.Name, err)
+			}
+		}
+		spec.Disks = append(spec.Disks, disk)
+	}
+	return nil
+}
+
+// loadDomainInterfaces fills in the NICs. Ports recorded before their
+// source was tracked fall back to the network they are bound to.
+func (s *HostService) loadDomainInterfaces(spec *libvirt.DomainSpec, vm storage.VirtualMachine) error {
+	var atts []storage.PortAttachment
+	if err := s.db.Preload("Port").Where("vm_uuid = ?", vm.ID).Order("ordinal").Order("created_at").Find(&atts).Error; err != nil {
+		return fmt.Errorf("failed to load NICs of vm %s: %w", vm.Name, err)
+	}
+	for _, att := range atts {
+		nic := libvirt.InterfaceDevice{
+			Type:      att.Port.SourceType,
+			Source:    att.Port.SourceRef,
+			PortGroup: att.Port.PortGroup,
+			Model:     att.ModelName,
+			MAC:       att.MACAddress,
+		}
+		if nic.Model == "" {
+			nic.Model = att.Port.ModelName
+		}
+		if nic.MAC == "" {
+			nic.MAC = att.Port.MACAddress
+		}
+		if nic.Type == "" || nic.Source == "" {
+			var bindings []storage.PortBinding
+			s.db.Preload("Network").Where("port_id = ?", att.PortID).Limit(1).Find(&bindings)
+			if len(bindings) == 0 {
+				return fmt.Errorf("invalid interface: port %s of vm %s has no network", nic.MAC, vm.Name)
+			}
+			network := bindings[0].Network
+			switch {
+			case network.Mode == "bridged" && network.BridgeName != "":
+				nic.Type, nic.Source = NICTypeBridge, network.BridgeName
+			case network.Mode == "direct":
+				nic.Type, nic.Source = NICTypeDirect, network.Name
+			default:
+				nic.Type, nic.Source = NICTypeNetwork, network.Name
+			}
+		}
+		if att.Port.VlanTagsJSON != "" {
+			if err := json.Unmarshal([]byte(att.Port.VlanTagsJSON), &nic.VLANs); err != nil {
+				return fmt.Errorf("invalid VLAN tags on port %s: %w", nic.MAC, err)
+			}
+		}
+		var filters []storage.FilterRef
+		s.db.Where("port_id = ?", att.PortID).Limit(1).Find(&filters)
+		if len(filters) > 0 {
+			nic.FilterRef = filters[0].Name
+		}
+		spec.Interfaces = append(spec.Interfaces, nic)
+	}
+	return nil
+}
+
+// loadDomainDevices fills in the remaining devices: consoles, video,
+// passthrough, controllers, input, sound, TPM, watchdog and balloon.
+func (s *HostService) loadDomainDevices(spec *libvirt.DomainSpec, vm storage.VirtualMachine) error {
+	var consoles []storage.Console
+	if err := s.db.Where("vm_uuid = ?", vm.ID).Order("created_at").Find(&consoles).Error; err != nil {
+		return fmt.Errorf("failed to load consoles of vm %s: %w", vm.Name, err)
+	}
+	for _, c := range consoles {
+		spec.Graphics = append(spec.Graphics, libvirt.DomainGraphics{Type: c.Type, Listen: c.ListenAddress, Port: c.Port})
+	}
+
+	var videos []storage.VideoAttachment
+	if err := s.db.Preload("VideoModel").Where("vm_uuid = ?", vm.ID).Order("monitor_index").Find(&videos).Error; err != nil {
+		return fmt.Errorf("failed to load video of vm %s: %w", vm.Name, err)
+	}
+	for _, v := range videos {
+		video := libvirt.VideoDevice{
+			Model:     v.VideoModel.ModelName,
+			VRAMBytes: uint64(v.VideoModel.VRAM) * 1024,
+			Heads:     v.VideoModel.Heads,
+			Primary:   v.Primary,
+		}
+		if v.VideoModel.Accel3D {
+			video.Acceleration = &libvirt.VideoAcceleration{Accel3D: true}
+		}
+		spec.Videos = append(spec.Videos, video)
+	}
+
+	var hostdevs []storage.HostDeviceAttachment
+	if err := s.db.Where("vm_uuid = ?", vm.ID).Order("created_at").Find(&hostdevs).Error; err != nil {
+		return fmt.Errorf("failed to load host devices of vm %s: %w", vm.Name, err)
+	}
+	for _, att := range hostdevs {
+		var dev storage.HostDevice
+		if err := s.db.Where("id = ?", att.HostDeviceID).First(&dev).Error; err != nil {
+			return fmt.Errorf("failed to load host device %s of vm %s: %w", att.HostDeviceID, vm.Name, err)
+		}
+		if dev.Type != "pci" {
+			return fmt.Errorf("invalid domain: %s host device %s cannot be rendered", dev.Type, dev.Address)
+		}
+		hd, err := libvirt.ParsePCIAddress(dev.Address)
+		if err != nil {
+			return err
+		}
+		spec.Hostdevs = append(spec.Hostdevs, hd)
+	}
+
+	var controllers []storage.ControllerAttachment
+	if err := s.db.Where("vm_uuid = ?", vm.ID).Order("created_at").Find(&controllers).Error; err != nil {
+		return fmt.Errorf("failed to load controllers of vm %s: %w", vm.Name, err)
+	}
+	for _, att := range controllers {
+		var c storage.Controller
+		if err := s.db.Where("id = ?", att.ControllerID).First(&c).Error; err != nil {
+			log.Warnf("Skipping missing controller %s of VM %s: %v", att.ControllerID, vm.Name, err)
+			continue
+		}
+		spec.Controllers = append(spec.Controllers, libvirt.DomainController{Type: c.Type, Model: c.ModelName, Index: c.Index})
+	}
+
+	var inputs []storage.InputDeviceAttachment
+	if err := s.db.Where("vm_uuid = ?", vm.ID).Order("created_at").Find(&inputs).Error; err != nil {
+		return fmt.Errorf("failed to load input devices of vm %s: %w", vm.Name, err)
+	}
+	for _, att := range inputs {
+		var in storage.InputDevice
+		if err := s.db.Where("id = ?", att.InputDeviceID).First(&in).Error; err != nil {
+			log.Warnf("Skipping missing input device %s of VM %s: %v", att.InputDeviceID, vm.Name, err)
+			continue
+		}
+		spec.Inputs = append(spec.Inputs, libvirt.InputDevice{Type: in.Type, Bus: in.Bus})
+	}
+
+	var sounds []storage.SoundCardAttachment
+	if err := s.db.Where("vm_uuid = ?", vm.ID).Order("created_at").Find(&sounds).Error; err != nil {
+		return fmt.Errorf("failed to load sound cards of vm %s: %w", vm.Name, err)
+	}
+	for _, att := range sounds {
+		var card storage.SoundCard
+		if err := s.db.Where("id = ?", att.SoundCardID).First(&card).Error; err != nil {
+			log.Warnf("Skipping missing sound card %s of VM %s: %v", att.SoundCardID, vm.Name, err)
+			continue
+		}
+		spec.Sounds = append(spec.Sounds, libvirt.SoundDevice{Model: card.ModelName})
+	}
+
+	var tpms []storage.TPMAttachment
+	if err := s.db.Where("vm_uuid = ?", vm.ID).Limit(1).Find(&tpms).Error; err != nil {
+		return fmt.Errorf("failed to load TPM of vm %s: %w", vm.Name, err)
+	}
+	if len(tpms) > 0 {
+		var tpm storage.TPM
+		if err := s.db.Where("id = ?", tpms[0].TPMID).First(&tpm).Error; err != nil {
+			return fmt.Errorf("failed to load TPM of vm %s: %w", vm.Name, err)
+		}
+		spec.TPM = &libvirt.DomainTPM{Model: tpm.ModelName, Backend: tpm.BackendType, Path: tpm.BackendPath}
+	}
+
+	var watchdogs []storage.WatchdogAttachment
+	if err := s.db.Where("vm_uuid = ?", vm.ID).Limit(1).Find(&watchdogs).Error; err != nil {
+		return fmt.Errorf("failed to load watchdog of vm %s: %w", vm.Name, err)
+	}
+	if len(watchdogs) > 0 {
+		var wd storage.Watchdog
+		if err := s.db.Where("id = ?", watchdogs[0].WatchdogID).First(&wd).Error; err != nil {
+			return fmt.Errorf("failed to load watchdog of vm %s: %w", vm.Name, err)
+		}
+		spec.Watchdog = &libvirt.DomainWatchdog{Model: wd.ModelName, Action: wd.Action}
+	}
+
+	var balloons []storage.MemoryBalloonAttachment
+	if err := s.db.Where("vm_uuid = ?", vm.ID).Limit(1).Find(&balloons).Error; err != nil {
+		return fmt.Errorf("failed to load memory balloon of vm %s: %w", vm.Name, err)
+	}
+	if len(balloons) > 0 {
+		var balloon storage.MemoryBalloon
+		if err := s.db.Where("id = ?", balloons[0].MemoryBalloonID).First(&balloon).Error; err != nil {
+			return fmt.Errorf("failed to load memory balloon of vm %s: %w", vm.Name, err)
+		}
+		dev := libvirt.MemBalloonDevice{Model: balloon.ModelName}
+		if balloon.ConfigJSON != "" {
+			json.Unmarshal([]byte(balloon.ConfigJSON), &dev)
+		}
+		spec.MemBalloon = &dev
+	}
+	return nil
+}
+
+// recordVMDefaults records the platform and devices every new VM gets
+// besides its disks and NICs: a VNC console, a VGA adapter, a USB tablet,
+// the usual x86 features, lifecycle actions, a UTC clock and the boot
+// order.
+func (s *HostService) recordVMDefaults(hostID, vmUUID string, boot []string) error {
+	tx := s.db.Begin()
+	fail := func(what string, err error) error {
+		tx.Rollback()
+		return fmt.Errorf("failed to record %s of vm %s: %w", what, vmUUID, err)
+	}
+
+	console := storage.Console{VMUUID: vmUUID, HostID: hostID, Type: "vnc", ModelName: "vnc"}
+	if err := tx.Create(&console).Error; err != nil {
+		return fail("console", err)
+	}
+	if err := s.ensureAttachmentIndex(tx, storage.AttachmentIndex{VMUUID: vmUUID, DeviceType: "console", AttachmentID: console.ID, DeviceID: &console.ID}); err != nil {
+		tx.Rollback()
+		return err
+	}
+
+	// Video models are shared by name, as host syncs record them.
+	var video storage.VideoModel
+	if err := tx.Where("model_name = ?", "vga").FirstOrCreate(&video, storage.VideoModel{ModelName: "vga", VRAM: 16384, Heads: 1}).Error; err != nil {
+		return fail("video model", err)
+	}
+	videoAtt := storage.VideoAttachment{VMUUID: vmUUID, VideoModelID: video.ID, MonitorIndex: 0, Primary: true}
+	if err := tx.Create(&videoAtt).Error; err != nil {
+		return fail("video", err)
+	}
+	if err := s.ensureAttachmentIndex(tx, storage.AttachmentIndex{VMUUID: vmUUID, DeviceType: "video", AttachmentID: strconv.Itoa(int(videoAtt.ID))}); err != nil {
+		tx.Rollback()
+		return err
+	}
+
+	// A tablet keeps the pointer in step with the VNC client's.
+	var tablet storage.InputDevice
+	if err := tx.Where("type = ? AND bus = ?", "tablet", "usb").FirstOrCreate(&tablet, storage.InputDevice{Type: "tablet", Bus: "usb"}).Error; err != nil {
+		return fail("tablet", err)
+	}
+	if err := tx.Create(&storage.InputDeviceAttachment{VMUUID: vmUUID, InputDeviceID: tablet.ID}).Error; err != nil {
+		return fail("tablet", err)
+	}
+
+	for _, name := range []string{"acpi", "apic", "pae"} {
+		if err := tx.Create(&storage.HypervisorFeature{VMUUID: vmUUID, Name: name, State: "on"}).Error; err != nil {
+			return fail("hypervisor features", err)
+		}
+	}
+	if err := tx.Create(&storage.LifecycleAction{VMUUID: vmUUID, OnPoweroff: "destroy", OnReboot: "restart", OnCrash: "restart"}).Error; err != nil {
+		return fail("lifecycle actions", err)
+	}
+	if err := tx.Create(&storage.Clock{VMUUID: vmUUID, Offset: "utc"}).Error; err != nil {
+		return fail("clock", err)
+	}
+
+	entries := make([]libvirt.BootEntry, 0, len(boot))
+	for i, dev := range boot {
+		entries = append(entries, libvirt.BootEntry{Dev: dev, Order: i + 1})
+	}
+	bootJSON, _ := json.Marshal(entries)
+	if err := tx.Create(&storage.BootConfig{VMUUID: vmUUID, BootOrderJSON: string(bootJSON)}).Error; err != nil {
+		return fail("boot order", err)
+	}
+
+	if err := tx.Commit().Error; err != nil {
+		return fmt.Errorf("failed to record defaults of vm %s: %w", vmUUID, err)
+	}
+	return nil
+}
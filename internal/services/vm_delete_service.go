@@ -0,0 +1,247 @@
+package services
+
+import (
+	"fmt"
+	"path/filepath"
+
+	"github.com/capsali/virtumancer/internal/libvirt"
+	log "github.com/capsali/virtumancer/internal/logging"
+	"github.com/capsali/virtumancer/internal/storage"
+	golibvirt "github.com/digitalocean/go-libvirt"
+)
+
+// Disk retention policies for DeleteVM. "keep" leaves the volume and
+// Virtumancer's disk record, so the disk can be attached elsewhere as it
+// was; "detach" keeps the volume in its pool but forgets the disk record;
+// "delete" removes the volume from its pool.
+const (
+	DiskPolicyKeep   = "keep"
+	DiskPolicyDetach = "detach"
+	DiskPolicyDelete = "delete"
+)
+
+// VMDeleteRequest controls what happens to a running VM and to its disks
+// when it is deleted.
+type VMDeleteRequest struct {
+	// Force destroys the VM first if it is running.
+	Force bool `json:"force"`
+	// DiskPolicy applies to every disk not listed in Disks and defaults
+	// to "keep".
+	DiskPolicy string `json:"disk_policy,omitempty"`
+	// Disks sets the policy of individual disks by target device.
+	Disks map[string]string `json:"disks,omitempty"`
+}
+
+// diskRetention is what DeleteVM does with one disk.
+type diskRetention struct {
+	device string
+	path   string
+	policy string
+	// vol and pool locate the volume of a disk being deleted.
+	vol  storage.Volume
+	pool string
+}
+
+func validDiskPolicy(policy string) bool {
+	switch policy {
+	case DiskPolicyKeep, DiskPolicyDetach, DiskPolicyDelete:
+		return true
+	}
+	return false
+}
+
+// planDiskRetention pairs each disk of a VM with its policy, and finds the
+// pools of the volumes to delete. CD-ROM and floppy media are never
+// deleted.
+func (s *HostService) planDiskRetention(vm *storage.VirtualMachine, disks []libvirt.DiskInfo, req VMDeleteRequest) ([]diskRetention, error) {
+	seen := make(map[string]bool)
+	var plans []diskRetention
+	for _, disk := range disks {
+		if disk.Device != "disk" {
+			continue
+		}
+		plan := diskRetention{device: disk.Target.Dev, path: disk.Source.File, policy: req.DiskPolicy}
+		if plan.path == "" {
+			plan.path = disk.Source.Dev
+		}
+		if policy, ok := req.Disks[plan.device]; ok {
+			plan.policy = policy
+			seen[plan.device] = true
+		}
+		if plan.policy == DiskPolicyDelete {
+			if plan.path == "" {
+				return nil, fmt.Errorf("invalid disk policy: disk %s of vm %s has no volume to delete", plan.device, vm.Name)
+			}
+			var vols []storage.Volume
+			s.db.Where("path = ?", plan.path).Limit(1).Find(&vols)
+			vol := storage.Volume{Name: filepath.Base(plan.path), Path: plan.path}
+			if len(vols) > 0 {
+				vol = vols[0]
+			}
+			users, err := s.volumeUsers(vol)
+			if err != nil {
+				return nil, err
+			}
+			for _, user := range users {
+				if user.VM.ID != vm.ID {
+					return nil, fmt.Errorf("volume %s of disk %s is in use by vm %s", vol.Name, plan.device, user.VM.Name)
+				}
+			}
+			if len(users) == 0 {
+				users = []volumeUser{{VM: *vm}}
+			}
+			_, pool, err := s.locateVolume(vol, users)
+			if err != nil {
+				return nil, err
+			}
+			plan.vol, plan.pool = vol, pool.Name
+		}
+		plans = append(plans, plan)
+	}
+	for device := range req.Disks {
+		if !seen[device] {
+			return nil, fmt.Errorf("disk %s not found on vm %s", device, vm.Name)
+		}
+	}
+	return plans, nil
+}
+
+// DeleteVM removes a VM from its host and from the database. A running VM
+// is only destroyed when req.Force is set. libvirt drops the VM's managed
+// save image, snapshot metadata and NVRAM with it, and each disk is kept,
+// forgotten or deleted according to its policy.
+func (s *HostService) DeleteVM(hostID, vmName string, req VMDeleteRequest) error {
+	if req.DiskPolicy == "" {
+		req.DiskPolicy = DiskPolicyKeep
+	}
+	if !validDiskPolicy(req.DiskPolicy) {
+		return fmt.Errorf("invalid disk policy %q", req.DiskPolicy)
+	}
+	for device, policy := range req.Disks {
+		if !validDiskPolicy(policy) {
+			return fmt.Errorf("invalid disk policy %q for disk %s", policy, device)
+		}
+	}
+	vm, err := s.findVM(hostID, vmName)
+	if err != nil {
+		return err
+	}
+	if err := s.ensureNotLinkedCloneBase(hostID, vmName, "deleted"); err != nil {
+		return err
+	}
+	if !s.connector.IsConnected(hostID) {
+		return fmt.Errorf("host %s is disconnected", hostID)
+	}
+	info, err := s.connector.GetDomainInfo(hostID, vmName)
+	if err != nil {
+		return err
+	}
+	// A crashed domain, or one shut off with a managed save image, has no
+	// guest to stop; DeleteDomain drops the image with the definition.
+	var running bool
+	switch info.State {
+	case golibvirt.DomainRunning, golibvirt.DomainPaused, golibvirt.DomainBlocked,
+		golibvirt.DomainPmsuspended, golibvirt.DomainShutdown:
+		running = true
+	}
+	if running && !req.Force {
+		return fmt.Errorf("invalid request: vm %s is running; shut it down first or delete it with force", vmName)
+	}
+	hardware, err := s.connector.GetDomainHardware(hostID, vmName)
+	if err != nil {
+		return err
+	}
+	plans, err := s.planDiskRetention(vm, hardware.Disks, req)
+	if err != nil {
+		return err
+	}
+
+	s.db.Model(&storage.VirtualMachine{}).Where("id = ?", vm.ID).Update("task_state", storage.TaskStateDeleting)
+	s.broadcastVMsChanged(hostID)
+	fail := func(err error) error {
+		s.db.Model(&storage.VirtualMachine{}).Where("id = ?", vm.ID).Update("task_state", "")
+		s.broadcastVMsChanged(hostID)
+		return err
+	}
+	if running {
+		if err := s.connector.DestroyDomain(hostID, vmName); err != nil {
+			return fail(err)
+		}
+	}
+	if err := s.connector.DeleteDomain(hostID, vmName); err != nil {
+		return fail(err)
+	}
+	s.discardProvisioningSeed(hostID, vm.ID)
+
+	// The domain is gone, so volumes that cannot be deleted are kept and
+	// reported rather than failing the whole deletion.
+	for i, plan := range plans {
+		if plan.policy != DiskPolicyDelete {
+			continue
+		}
+		if err := s.connector.DeleteStorageVolume(hostID, plan.pool, volumeFileName(plan.vol)); err != nil {
+			log.Warnf("Keeping volume %s of deleted VM %s: %v", plan.path, vmName, err)
+			plans[i].policy = DiskPolicyKeep
+		}
+	}
+
+	var ports []storage.PortAttachment
+	tx := s.db.Begin()
+	if err := tx.Where("vm_uuid = ?", vm.ID).Find(&ports).Error; err != nil {
+		tx.Rollback()
+		return fmt.Errorf("failed to load ports of vm %s: %w", vmName, err)
+	}
+	for _, att := range ports {
+		if err := tx.Unscoped().Where("port_id = ?", att.PortID).Delete(&storage.PortBinding{}).Error; err != nil {
+			tx.Rollback()
+			return fmt.Errorf("failed to remove bindings of port %s: %w", att.MACAddress, err)
+		}
+		if err := tx.Unscoped().Where("port_id = ?", att.PortID).Delete(&storage.FilterRef{}).Error; err != nil {
+			tx.Rollback()
+			return fmt.Errorf("failed to remove filters of port %s: %w", att.MACAddress, err)
+		}
+		if err := tx.Unscoped().Where("id = ?", att.PortID).Delete(&storage.Port{}).Error; err != nil {
+			tx.Rollback()
+			return fmt.Errorf("failed to remove port %s: %w", att.MACAddress, err)
+		}
+	}
+	for _, plan := range plans {
+		if plan.policy == DiskPolicyKeep || plan.path == "" {
+			continue
+		}
+		if err := tx.Unscoped().Where("path = ?", plan.path).Delete(&storage.Disk{}).Error; err != nil {
+			tx.Rollback()
+			return fmt.Errorf("failed to remove disk %s: %w", plan.device, err)
+		}
+		if plan.policy == DiskPolicyDelete && plan.vol.ID != "" {
+			if err := tx.Unscoped().Where("id = ?", plan.vol.ID).Delete(&storage.Volume{}).Error; err != nil {
+				tx.Rollback()
+				return fmt.Errorf("failed to remove volume %s: %w", plan.vol.Name, err)
+			}
+		}
+	}
+	if err := storage.DeleteVMRecords(tx, vm.ID); err != nil {
+		tx.Rollback()
+		return err
+	}
+	if err := tx.Unscoped().Where("host_id = ? AND domain_uuid = ?", hostID, vm.DomainUUID).Delete(&storage.DiscoveredVM{}).Error; err != nil {
+		tx.Rollback()
+		return fmt.Errorf("failed to remove discovered vm %s: %w", vmName, err)
+	}
+	// The row is removed outright so the name and domain UUID can be reused.
+	if err := tx.Unscoped().Delete(vm).Error; err != nil {
+		tx.Rollback()
+		return fmt.Errorf("failed to delete vm %s: %w", vmName, err)
+	}
+	if err := tx.Commit().Error; err != nil {
+		return fmt.Errorf("failed to delete vm %s: %w", vmName, err)
+	}
+
+	for _, att := range ports {
+		s.releaseNICSecurityGroups(hostID, att)
+	}
+	log.Infof("Deleted VM %s on host %s", vmName, hostID)
+	s.broadcastVMsChanged(hostID)
+	s.broadcastHostsChanged()
+	return nil
+}
@@ -0,0 +1,207 @@
+package services
+
+import (
+	"fmt"
+
+	log "github.com/capsali/virtumancer/internal/logging"
+	"github.com/capsali/virtumancer/internal/storage"
+	golibvirt "github.com/digitalocean/go-libvirt"
+)
+
+// VMResizeRequest changes a VM's vCPUs and memory. Fields left out keep
+// their value, except that lowering a maximum below the current amount
+// lowers the current amount too, and a VM whose memory was at its maximum
+// follows a new maximum.
+type VMResizeRequest struct {
+	VCPUCount    *uint `json:"vcpu_count,omitempty"`
+	MaxVCPUCount *uint `json:"max_vcpu_count,omitempty"`
+	// MemoryBytes is the maximum memory, like VirtualMachine.MemoryBytes.
+	MemoryBytes        *uint64 `json:"memory_bytes,omitempty"`
+	CurrentMemoryBytes *uint64 `json:"current_memory_bytes,omitempty"`
+}
+
+// vmResources are the vCPU and memory sizes of a domain.
+type vmResources struct {
+	maxVcpus uint
+	vcpus    uint
+	maxMemKB uint64
+	memKB    uint64
+}
+
+// resizeTarget applies req to the current sizes of a domain.
+func resizeTarget(current vmResources, req VMResizeRequest) vmResources {
+	target := current
+	if req.MaxVCPUCount != nil {
+		target.maxVcpus = *req.MaxVCPUCount
+		if target.vcpus > target.maxVcpus {
+			target.vcpus = target.maxVcpus
+		}
+	}
+	if req.VCPUCount != nil {
+		target.vcpus = *req.VCPUCount
+	}
+	if req.MemoryBytes != nil {
+		target.maxMemKB = *req.MemoryBytes / 1024
+		if current.memKB == current.maxMemKB || target.memKB > target.maxMemKB {
+			target.memKB = target.maxMemKB
+		}
+	}
+	if req.CurrentMemoryBytes != nil {
+		target.memKB = *req.CurrentMemoryBytes / 1024
+	}
+	return target
+}
+
+// ResizeVM changes a VM's vCPUs and memory in its persistent definition
+// and, for a running VM, live where the domain's maximums allow: vCPUs are
+// hotplugged and memory is ballooned. Maximums only change at the next
+// boot, as do increases beyond the running maximums; those set
+// NeedsRebuild.
+func (s *HostService) ResizeVM(hostID, vmName string, req VMResizeRequest) (*storage.VirtualMachine, error) {
+	if req.VCPUCount == nil && req.MaxVCPUCount == nil && req.MemoryBytes == nil && req.CurrentMemoryBytes == nil {
+		return nil, fmt.Errorf("invalid resize request: nothing to change")
+	}
+	vm, err := s.findVM(hostID, vmName)
+	if err != nil {
+		return nil, err
+	}
+	info, err := s.connector.GetDomainInfo(hostID, vmName)
+	if err != nil {
+		return nil, err
+	}
+	cpu, err := s.connector.GetDomainCPUDetails(hostID, vmName)
+	if err != nil {
+		return nil, err
+	}
+	host, err := s.connector.GetHostInfo(hostID)
+	if err != nil {
+		return nil, err
+	}
+
+	current := vmResources{maxVcpus: uint(cpu.MaxVcpus), vcpus: info.Vcpu, maxMemKB: info.MaxMem, memKB: info.Memory}
+	target := resizeTarget(current, req)
+	var active bool
+	switch info.State {
+	case golibvirt.DomainRunning, golibvirt.DomainPaused, golibvirt.DomainBlocked:
+		active = true
+	}
+
+	switch {
+	case target.vcpus == 0:
+		return nil, fmt.Errorf("invalid resize request: a VM needs at least one vCPU")
+	case target.memKB == 0:
+		return nil, fmt.Errorf("invalid resize request: memory must not be zero")
+	case target.vcpus > target.maxVcpus:
+		return nil, fmt.Errorf("invalid resize request: %d vCPUs exceeds the maximum of %d", target.vcpus, target.maxVcpus)
+	case target.memKB > target.maxMemKB:
+		return nil, fmt.Errorf("invalid resize request: %d bytes of memory exceeds the maximum of %d bytes", target.memKB*1024, target.maxMemKB*1024)
+	}
+	// Shrinking is always allowed, even for a VM that was sized beyond
+	// its host before.
+	if target.maxVcpus > current.maxVcpus && target.maxVcpus > host.CPU {
+		return nil, fmt.Errorf("invalid resize request: %d vCPUs exceeds the %d CPUs of host %s", target.maxVcpus, host.CPU, hostID)
+	}
+	if target.maxMemKB > current.maxMemKB && target.maxMemKB*1024 > host.Memory {
+		return nil, fmt.Errorf("invalid resize request: %d bytes of memory exceeds the %d bytes of host %s", target.maxMemKB*1024, host.Memory, hostID)
+	}
+	liveVcpus := active && target.vcpus <= current.maxVcpus
+	liveMemory := active && target.memKB <= current.maxMemKB
+	if liveMemory && target.memKB > current.memKB {
+		grow := (target.memKB - current.memKB) * 1024
+		if host.MemoryUsed+grow > host.Memory {
+			return nil, fmt.Errorf("invalid resize request: host %s has %d bytes of memory free, %d needed", hostID, host.Memory-host.MemoryUsed, grow)
+		}
+	}
+
+	needsRebuild := vm.NeedsRebuild
+	// applied tracks what the domain has, so a failed resize can put back
+	// the steps already taken or at least record them.
+	applied := current
+	setVcpus := func(to vmResources) error {
+		if to.vcpus == applied.vcpus && req.VCPUCount == nil {
+			return nil
+		}
+		if err := s.connector.SetDomainVcpus(hostID, vmName, to.vcpus, liveVcpus); err != nil {
+			return err
+		}
+		needsRebuild = needsRebuild || (active && !liveVcpus)
+		applied.vcpus = to.vcpus
+		return nil
+	}
+	setMaxVcpus := func(to vmResources) error {
+		if to.maxVcpus == applied.maxVcpus {
+			return nil
+		}
+		if err := s.connector.SetDomainMaxVcpus(hostID, vmName, to.maxVcpus); err != nil {
+			return err
+		}
+		needsRebuild = needsRebuild || active
+		applied.maxVcpus = to.maxVcpus
+		return nil
+	}
+	setMemory := func(to vmResources) error {
+		if to.memKB == applied.memKB && req.CurrentMemoryBytes == nil {
+			return nil
+		}
+		if err := s.connector.SetDomainMemory(hostID, vmName, to.memKB, liveMemory); err != nil {
+			return err
+		}
+		needsRebuild = needsRebuild || (active && !liveMemory)
+		applied.memKB = to.memKB
+		return nil
+	}
+	setMaxMemory := func(to vmResources) error {
+		if to.maxMemKB == applied.maxMemKB {
+			return nil
+		}
+		if err := s.connector.SetDomainMaxMemory(hostID, vmName, to.maxMemKB); err != nil {
+			return err
+		}
+		needsRebuild = needsRebuild || active
+		applied.maxMemKB = to.maxMemKB
+		return nil
+	}
+	// A maximum is raised before and lowered after the current amount, so
+	// the definition never has more in use than its maximum.
+	steps := []func(vmResources) error{setVcpus, setMaxVcpus, setMemory, setMaxMemory}
+	if target.maxVcpus > current.maxVcpus {
+		steps[0], steps[1] = setMaxVcpus, setVcpus
+	}
+	if target.maxMemKB > current.maxMemKB {
+		steps[2], steps[3] = setMaxMemory, setMemory
+	}
+	for i, step := range steps {
+		if err := step(target); err != nil {
+			// Undoing in reverse keeps the maximums ordering intact.
+			for j := i - 1; j >= 0; j-- {
+				if undoErr := steps[j](current); undoErr != nil {
+					log.Warnf("Failed to roll back resize of VM %s on host %s: %v", vmName, hostID, undoErr)
+				}
+			}
+			if applied != current {
+				if dbErr := s.recordVMResources(vm.ID, applied, needsRebuild); dbErr != nil {
+					log.Warnf("Failed to record partial resize of VM %s: %v", vmName, dbErr)
+				}
+			}
+			return nil, err
+		}
+	}
+
+	if err := s.recordVMResources(vm.ID, target, needsRebuild); err != nil {
+		return nil, fmt.Errorf("failed to update vm %s: %w", vmName, err)
+	}
+	log.Infof("Resized VM %s on host %s to %d/%d vCPUs and %d/%d KiB (needs rebuild: %t)", vmName, hostID, target.vcpus, target.maxVcpus, target.memKB, target.maxMemKB, needsRebuild)
+	s.broadcastVMsChanged(hostID)
+	return s.findVM(hostID, vmName)
+}
+
+// recordVMResources stores the sizes a domain was resized to.
+func (s *HostService) recordVMResources(vmID string, res vmResources, needsRebuild bool) error {
+	updates := map[string]interface{}{
+		"v_cpu_count":    res.vcpus,
+		"memory_bytes":   res.maxMemKB * 1024,
+		"current_memory": res.memKB * 1024,
+		"needs_rebuild":  needsRebuild,
+	}
+	return s.db.Model(&storage.VirtualMachine{}).Where("id = ?", vmID).Updates(updates).Error
+}
@@ -0,0 +1,207 @@
+package services
+
+import (
+	"fmt"
+	"path/filepath"
+
+	"github.com/capsali/virtumancer/internal/libvirt"
+	log "github.com/capsali/virtumancer/internal/logging"
+	"github.com/capsali/virtumancer/internal/storage"
+	"github.com/capsali/virtumancer/internal/ws"
+	golibvirt "github.com/digitalocean/go-libvirt"
+)
+
+// VolumeResizeRequest grows a volume to SizeBytes.
+type VolumeResizeRequest struct {
+	SizeBytes uint64 `json:"size_bytes"`
+	// GrowFilesystem asks clients with guest agent access to grow the
+	// guest's filesystem once a running VM's disk has been resized.
+	GrowFilesystem bool `json:"grow_filesystem"`
+}
+
+// volumeUser is a VM a volume is attached to.
+type volumeUser struct {
+	VM         storage.VirtualMachine
+	Attachment storage.DiskAttachment
+}
+
+// volumeUsers returns the VMs a volume is attached to, matching disks by
+// volume or, for disks found by host syncs, by path.
+func (s *HostService) volumeUsers(vol storage.Volume) ([]volumeUser, error) {
+	query := s.db.Where("volume_id = ?", vol.ID)
+	if vol.Path != "" {
+		query = query.Or("path = ?", vol.Path)
+	}
+	var disks []storage.Disk
+	if err := query.Find(&disks).Error; err != nil {
+		return nil, fmt.Errorf("failed to load disks of volume %s: %w", vol.Name, err)
+	}
+	if len(disks) == 0 {
+		return nil, nil
+	}
+	diskIDs := make([]string, 0, len(disks))
+	for _, disk := range disks {
+		diskIDs = append(diskIDs, disk.ID)
+	}
+	var atts []storage.DiskAttachment
+	if err := s.db.Where("disk_id IN ?", diskIDs).Find(&atts).Error; err != nil {
+		return nil, fmt.Errorf("failed to load attachments of volume %s: %w", vol.Name, err)
+	}
+	var users []volumeUser
+	for _, att := range atts {
+		var vm storage.VirtualMachine
+		if err := s.db.Where("id = ?", att.VMUUID).First(&vm).Error; err != nil {
+			log.Verbosef("Skipping attachment %s of volume %s: %v", att.ID, vol.Name, err)
+			continue
+		}
+		users = append(users, volumeUser{VM: vm, Attachment: att})
+	}
+	return users, nil
+}
+
+// locateVolume finds the host and pool a volume lives in. Volumes created
+// with a VM carry no pool, so the host of a VM using the volume and the
+// pool holding its directory stand in.
+func (s *HostService) locateVolume(vol storage.Volume, users []volumeUser) (string, *libvirt.StoragePoolInfo, error) {
+	var hostID, poolName string
+	var pool storage.StoragePool
+	if vol.StoragePoolID != "" && s.db.Where("id = ?", vol.StoragePoolID).First(&pool).Error == nil {
+		hostID, poolName = pool.HostID, pool.Name
+	} else if len(users) > 0 {
+		hostID = users[0].VM.HostID
+	} else {
+		return "", nil, fmt.Errorf("storage pool of volume %s not found", vol.Name)
+	}
+	if !s.connector.IsConnected(hostID) {
+		return "", nil, fmt.Errorf("host %s is disconnected", hostID)
+	}
+	pools, err := s.connector.ListAllStoragePools(hostID)
+	if err != nil {
+		return "", nil, err
+	}
+	for i := range pools {
+		if pools[i].Name == poolName || (poolName == "" && pools[i].Path != "" && pools[i].Path == filepath.Dir(vol.Path)) {
+			return hostID, &pools[i], nil
+		}
+	}
+	return "", nil, fmt.Errorf("storage pool of volume %s not found on host %s", vol.Name, hostID)
+}
+
+// volumeFileName is the name libvirt knows a volume by. Synced volumes
+// store a normalized name without the extension, so the path is preferred.
+func volumeFileName(vol storage.Volume) string {
+	if vol.Path != "" {
+		return filepath.Base(vol.Path)
+	}
+	return vol.Name
+}
+
+// ResizeVolume grows a volume. A disk of a running VM is resized through
+// the VM so the guest sees the new size; otherwise the volume is resized
+// in its pool.
+func (s *HostService) ResizeVolume(volumeID string, req VolumeResizeRequest) (*storage.Volume, error) {
+	var vol storage.Volume
+	if err := s.db.Where("id = ?", volumeID).First(&vol).Error; err != nil {
+		return nil, fmt.Errorf("volume %s not found: %w", volumeID, err)
+	}
+	if req.SizeBytes <= vol.CapacityBytes {
+		return nil, fmt.Errorf("invalid resize: %d bytes is not larger than the current %d bytes; volumes cannot shrink", req.SizeBytes, vol.CapacityBytes)
+	}
+	if vol.TaskState != "" {
+		return nil, fmt.Errorf("volume %s is busy (%s)", vol.Name, vol.TaskState)
+	}
+	clone, err := s.linkedCloneOf(s.db.Model(&storage.Disk{}).Select("id").Where("volume_id = ? OR path = ?", vol.ID, vol.Path))
+	if err != nil {
+		return nil, err
+	}
+	if clone != "" {
+		return nil, fmt.Errorf("volume %s is in use as the base of linked clone %s and cannot be resized", vol.Name, clone)
+	}
+	users, err := s.volumeUsers(vol)
+	if err != nil {
+		return nil, err
+	}
+	hostID, pool, err := s.locateVolume(vol, users)
+	if err != nil {
+		return nil, err
+	}
+	if growth := req.SizeBytes - vol.CapacityBytes; growth > pool.AvailableBytes {
+		return nil, fmt.Errorf("invalid resize: pool %s has %d bytes free, %d needed", pool.Name, pool.AvailableBytes, growth)
+	}
+
+	// A running VM holds the image open, so it has to do the resize.
+	var live *volumeUser
+	for i := range users {
+		info, err := s.connector.GetDomainInfo(hostID, users[i].VM.Name)
+		if err != nil {
+			continue
+		}
+		if info.State == golibvirt.DomainRunning || info.State == golibvirt.DomainPaused {
+			live = &users[i]
+			break
+		}
+	}
+
+	s.db.Model(&vol).Update("task_state", storage.StorageTaskResizing)
+	if live != nil {
+		err = s.connector.ResizeDomainDisk(hostID, live.VM.Name, live.Attachment.DeviceName, req.SizeBytes)
+	} else {
+		err = s.connector.ResizeStorageVolume(hostID, pool.Name, volumeFileName(vol), req.SizeBytes)
+	}
+	if err != nil {
+		s.db.Model(&vol).Update("task_state", "")
+		return nil, err
+	}
+
+	tx := s.db.Begin()
+	if err := tx.Model(&vol).Updates(map[string]interface{}{"capacity_bytes": req.SizeBytes, "task_state": ""}).Error; err != nil {
+		tx.Rollback()
+		return nil, fmt.Errorf("failed to update volume %s: %w", vol.Name, err)
+	}
+	diskQuery := tx.Model(&storage.Disk{}).Where("volume_id = ?", vol.ID)
+	if vol.Path != "" {
+		diskQuery = diskQuery.Or("path = ?", vol.Path)
+	}
+	if err := diskQuery.Update("capacity_bytes", req.SizeBytes).Error; err != nil {
+		tx.Rollback()
+		return nil, fmt.Errorf("failed to update disks of volume %s: %w", vol.Name, err)
+	}
+	if len(users) > 0 {
+		attIDs := make([]string, 0, len(users))
+		for _, u := range users {
+			attIDs = append(attIDs, u.Attachment.ID)
+		}
+		if err := tx.Model(&storage.BlockStatistics{}).Where("disk_attachment_id IN ?", attIDs).Update("capacity", req.SizeBytes).Error; err != nil {
+			tx.Rollback()
+			return nil, fmt.Errorf("failed to update block statistics of volume %s: %w", vol.Name, err)
+		}
+	}
+	if err := tx.Commit().Error; err != nil {
+		return nil, fmt.Errorf("failed to update volume %s: %w", vol.Name, err)
+	}
+
+	if live != nil {
+		log.Infof("Resized disk %s of running VM %s on host %s to %d bytes", live.Attachment.DeviceName, live.VM.Name, hostID, req.SizeBytes)
+		if req.GrowFilesystem {
+			s.hub.BroadcastMessage(ws.Message{
+				Type: "guest-filesystem-grow-hint",
+				Payload: ws.MessagePayload{
+					"hostId":        hostID,
+					"vmName":        live.VM.Name,
+					"device":        live.Attachment.DeviceName,
+					"volumeId":      vol.ID,
+					"capacityBytes": req.SizeBytes,
+				},
+			})
+		}
+	} else {
+		log.Infof("Resized volume %s in pool %s on host %s to %d bytes", vol.Name, pool.Name, hostID, req.SizeBytes)
+	}
+	if len(users) > 0 {
+		s.broadcastVMsChanged(hostID)
+	}
+	if err := s.db.Where("id = ?", vol.ID).First(&vol).Error; err != nil {
+		return nil, fmt.Errorf("failed to reload volume %s: %w", vol.Name, err)
+	}
+	return &vol, nil
+}
@@ -45,19 +45,22 @@ const (
 type VMTaskState string
 
 const (
-	TaskStateBuilding    VMTaskState = "BUILDING"
-	TaskStatePausing     VMTaskState = "PAUSING"
-	TaskStateUnpausing   VMTaskState = "UNPAUSING"
-	TaskStateSuspending  VMTaskState = "SUSPENDING"
-	TaskStateResuming    VMTaskState = "RESUMING"
-	TaskStateDeleting    VMTaskState = "DELETING"
-	TaskStateStopping    VMTaskState = "STOPPING"
-	TaskStateStarting    VMTaskState = "STARTING"
-	TaskStateRebooting   VMTaskState = "REBOOTING"
-	TaskStateRebuilding  VMTaskState = "REBUILDING"
-	TaskStatePoweringOn  VMTaskState = "POWERING_ON"
-	TaskStatePoweringOff VMTaskState = "POWERING_OFF"
-	TaskStateScheduling  VMTaskState = "SCHEDULING"
+	TaskStateBuilding     VMTaskState = "BUILDING"
+	TaskStatePausing      VMTaskState = "PAUSING"
+	TaskStateUnpausing    VMTaskState = "UNPAUSING"
+	TaskStateSuspending   VMTaskState = "SUSPENDING"
+	TaskStateResuming     VMTaskState = "RESUMING"
+	TaskStateDeleting     VMTaskState = "DELETING"
+	TaskStateStopping     VMTaskState = "STOPPING"
+	TaskStateStarting     VMTaskState = "STARTING"
+	TaskStateRebooting    VMTaskState = "REBOOTING"
+	TaskStateRebuilding   VMTaskState = "REBUILDING"
+	TaskStatePoweringOn   VMTaskState = "POWERING_ON"
+	TaskStatePoweringOff  VMTaskState = "POWERING_OFF"
+	TaskStateScheduling   VMTaskState = "SCHEDULING"
+	TaskStateSnapshotting VMTaskState = "SNAPSHOTTING"
+	TaskStateReverting    VMTaskState = "REVERTING"
+	TaskStateMigrating    VMTaskState = "MIGRATING"
 )
 
 // SyncStatus defines the sync state of a VM's configuration against libvirt.
@@ -88,6 +91,7 @@ const (
 	StorageTaskMigrating StorageTaskState = "MIGRATING"
 	StorageTaskResizing  StorageTaskState = "RESIZING"
 	StorageTaskCloning   StorageTaskState = "CLONING"
+	StorageTaskUploading StorageTaskState = "UPLOADING"
 )
 
 // --- Core Entities ---
@@ -104,6 +108,39 @@ type Host struct {
 	// AutoReconnectDisabled indicates if automatic reconnection is disabled for this host
 	// (e.g., because it was manually disconnected by the user)
 	AutoReconnectDisabled bool `gorm:"default:false" json:"auto_reconnect_disabled"`
+
+	// SSH transport settings, used for qemu+ssh URIs.
+	// SSHHostKeys holds the pinned host keys, in known_hosts format, for the
+	// target and every jump host. Keys are learned on first connect and must
+	// match afterwards until the host is explicitly re-trusted.
+	SSHHostKeys string `gorm:"type:text" json:"ssh_host_keys,omitempty"`
+	// SSHKnownHostsFile optionally names a known_hosts file that presented
+	// host keys must also be listed in.
+	SSHKnownHostsFile string `json:"ssh_known_hosts_file,omitempty"`
+	// SSHPrivateKey is a per-host private key encrypted with EncryptSecret.
+	// It is never serialized.
+	SSHPrivateKey string `gorm:"type:text" json:"-"`
+	// SSHUseAgent offers keys from the ssh-agent at $SSH_AUTH_SOCK.
+	SSHUseAgent bool `gorm:"default:false" json:"ssh_use_agent"`
+	// SSHJumpHosts is a comma-separated ProxyJump chain such as
+	// "admin@bastion:2222,jump2", dialled in order before the target.
+	SSHJumpHosts string `json:"ssh_jump_hosts,omitempty"`
+
+	// TLS credentials, used for qemu+tls URIs. Each may be uploaded as PEM
+	// or referenced by path on the Virtumancer server; uploaded values win.
+	// Unset values fall back to the URI's pkipath directory, then to
+	// libvirt's default locations under /etc/pki.
+	TLSCACert         string `gorm:"type:text" json:"tls_ca_cert,omitempty"`
+	TLSClientCert     string `gorm:"type:text" json:"tls_client_cert,omitempty"`
+	TLSClientKey      string `gorm:"type:text" json:"-"` // encrypted with EncryptSecret
+	TLSCACertPath     string `json:"tls_ca_cert_path,omitempty"`
+	TLSClientCertPath string `json:"tls_client_cert_path,omitempty"`
+	TLSClientKeyPath  string `json:"tls_client_key_path,omitempty"`
+}
+
+// HasSSHPrivateKey reports whether a per-host private key is stored.
+func (h Host) HasSSHPrivateKey() bool {
+	return h.SSHPrivateKey != ""
 }
 
 // HostState defines allowed host states to mirror VM state behavior.
@@ -149,6 +186,12 @@ type VirtualMachine struct {
 	SyncStatus      SyncStatus  `gorm:"default:'UNKNOWN'" json:"syncStatus"`
 	DriftDetails    string      `json:"driftDetails"` // JSON blob storing drift information
 	NeedsRebuild    bool        `gorm:"default:false" json:"needsRebuild"`
+	// HasManagedSave is set while libvirt holds a managed save image of the
+	// VM; starting the VM restores it.
+	HasManagedSave bool `gorm:"default:false" json:"hasManagedSave"`
+	// ResourceClassID is the flavor the VM was created or last resized
+	// from, if any.
+	ResourceClassID *string `gorm:"index" json:"resourceClassId,omitempty"`
 }
 
 // CreateVMRequest represents the data structure for creating a new VM
@@ -161,16 +204,32 @@ type CreateVMRequest struct {
 	VCPUCount   uint   `json:"vcpu_count" binding:"required,min=1"`
 	MemoryBytes uint64 `json:"memory_bytes" binding:"required,min=1"`
 	DiskSizeGB  uint   `json:"disk_size_gb,omitempty"`
+	// Pool is the storage pool the VM's disk is created in; "default"
+	// when empty.
+	Pool string `json:"pool,omitempty"`
 
 	// Network configuration
 	NetworkInterface string `json:"network_interface,omitempty"`
 
 	// Boot configuration
 	BootDevice string `json:"boot_device,omitempty"`
+	// ISOVolumeID names an ISO library image to install from. The VM gets
+	// a CD-ROM drive holding it and boots from it before the disk.
+	ISOVolumeID string `json:"iso_volume_id,omitempty"`
 
 	// CPU configuration
 	CPUModel string `json:"cpu_model,omitempty"`
 
+	// ResourceClass names a flavor that fills in the vCPUs, memory, disk
+	// size and CPU model left out above, and adds its extra specs.
+	ResourceClass string `json:"resource_class,omitempty"`
+
+	// First boot provisioning. CloudInit reaches the guest on a NoCloud
+	// seed ISO, Ignition through QEMU's firmware config; at most one of
+	// them may be set.
+	CloudInit *CloudInitConfig `json:"cloud_init,omitempty"`
+	Ignition  string           `json:"ignition,omitempty"`
+
 	// System settings
 	Source       string `json:"source,omitempty"`
 	SyncStatus   string `json:"sync_status,omitempty"`
@@ -180,6 +239,28 @@ type CreateVMRequest struct {
 	State        string `json:"state,omitempty"`
 }
 
+// CloudInitConfig is the cloud-init NoCloud data a VM's first boot is
+// seeded with. MetaData defaults to the VM's instance ID and hostname.
+type CloudInitConfig struct {
+	UserData      string `json:"user_data,omitempty"`
+	MetaData      string `json:"meta_data,omitempty"`
+	NetworkConfig string `json:"network_config,omitempty"`
+}
+
+// ProvisioningSeed is first boot data Virtumancer generated for a VM: a
+// NoCloud seed ISO in a CD-ROM drive, or an Ignition config handed over
+// through QEMU's firmware config. Once the guest agent answers, the seed is
+// detached and its volume deleted, and the row goes with it.
+type ProvisioningSeed struct {
+	Base
+	VMUUID   string `gorm:"uniqueIndex" json:"vm_uuid"`
+	Kind     string `json:"kind"` // 'nocloud' or 'ignition'
+	VolumeID string `json:"volume_id"`
+	Path     string `json:"path"`
+	// DeviceName is the CD-ROM drive holding a NoCloud seed.
+	DeviceName string `json:"device_name,omitempty"`
+}
+
 // --- Storage Management ---
 
 // StoragePool represents a libvirt storage pool (e.g., LVM, a directory).
@@ -194,6 +275,7 @@ type StoragePool struct {
 	State           string `json:"state"`
 	CapacityBytes   uint64 `json:"capacity_bytes"`
 	AllocationBytes uint64 `json:"allocation_bytes"`
+	Autostart       bool   `json:"autostart"`
 }
 
 // Volume represents a single storage volume, like a virtual disk or an ISO.
@@ -222,6 +304,10 @@ type Network struct {
 	UUID       string `json:"uuid"`
 	BridgeName string `json:"bridge_name"`
 	Mode       string `json:"mode"` // e.g., 'bridged', 'nat', 'isolated'
+	// State and Autostart are only set for libvirt virtual networks:
+	// 'active' or 'inactive'.
+	State     string `json:"state"`
+	Autostart bool   `json:"autostart"`
 }
 
 // Port represents a virtual Network Interface Card (vNIC) belonging to a VM.
@@ -278,6 +364,35 @@ type FilterRef struct {
 	ParametersJSON string `gorm:"type:text"`
 }
 
+// SecurityGroup is a named set of rules for the traffic allowed to and from
+// the ports it is bound to. Traffic no bound group allows is dropped.
+type SecurityGroup struct {
+	Base
+	Name        string              `gorm:"uniqueIndex" json:"name"`
+	Description string              `json:"description"`
+	Rules       []SecurityGroupRule `gorm:"foreignKey:SecurityGroupID" json:"rules"`
+}
+
+// SecurityGroupRule allows one kind of traffic. The remote end is a CIDR,
+// the ports bound to another group, or any address when both are empty.
+type SecurityGroupRule struct {
+	Base
+	SecurityGroupID string `gorm:"index" json:"security_group_id"`
+	Direction       string `gorm:"size:16" json:"direction"` // 'ingress'|'egress'
+	Protocol        string `gorm:"size:16" json:"protocol"`  // 'any'|'tcp'|'udp'|'icmp'
+	PortMin         int    `json:"port_min"`
+	PortMax         int    `json:"port_max"`
+	CIDR            string `json:"cidr"`
+	RemoteGroupID   string `gorm:"index" json:"remote_group_id"`
+}
+
+// SecurityGroupBinding applies a SecurityGroup to a VM's NIC.
+type SecurityGroupBinding struct {
+	Base
+	SecurityGroupID  string `gorm:"index" json:"security_group_id"`
+	PortAttachmentID string `gorm:"index" json:"port_attachment_id"`
+}
+
 // VirtualPort represents the <virtualport> subtree for advanced NICs (e.g., openvswitch).
 type VirtualPort struct {
 	Base
@@ -568,6 +683,9 @@ type Disk struct {
 	Serial        string  `json:"serial"`
 	DriverJSON    string  `gorm:"type:text" json:"driver_json"`  // driver options (cache/io/…) as JSON
 	BackingJSON   string  `gorm:"type:text" json:"backing_json"` // backingStore / layered info
+	// BackingDiskID is the disk a linked clone's overlay reads through to.
+	// A disk with overlays must not be written while they exist.
+	BackingDiskID *string `gorm:"index" json:"backing_disk_id,omitempty"`
 	// Enhanced API-sourced fields
 	VolumeType      string `json:"volume_type"`             // From StorageVolGetInfo
 	AllocationBytes uint64 `json:"allocation_bytes"`        // Actual space used
@@ -822,15 +940,16 @@ type GPUDevice struct {
 
 // --- Enhanced VM Configuration Models ---
 
-// ResourceClass defines resource allocation templates for VMs
+// ResourceClass defines resource allocation templates for VMs; the API
+// calls them flavors.
 type ResourceClass struct {
-	gorm.Model
-	Name        string `gorm:"unique"`
-	Description string
-	CPUCores    int
-	MemoryMB    int
-	StorageGB   int
-	ConfigJSON  string `gorm:"type:text"` // Additional resource specifications
+	Base
+	Name        string `gorm:"unique" json:"name"`
+	Description string `json:"description"`
+	CPUCores    int    `json:"cpu_cores"`
+	MemoryMB    int    `json:"memory_mb"`
+	StorageGB   int    `json:"storage_gb"`
+	ConfigJSON  string `gorm:"type:text" json:"config_json"` // Additional resource specifications
 }
 
 // HardwareTrait represents required hardware traits for VM placement
@@ -1077,6 +1196,11 @@ type VMSnapshot struct {
 	ParentName  string
 	State       string
 	ConfigXML   string
+	// IsCurrent, External and HasMemory mirror libvirt and are refreshed
+	// whenever snapshots are reconciled.
+	IsCurrent bool
+	External  bool
+	HasMemory bool
 }
 
 // User represents a Virtumancer user account.
@@ -1365,6 +1489,9 @@ func InitDB(dataSourceName string) (*gorm.DB, error) {
 		&IOMMUDeviceAttachment{},
 		&PortAttachment{},
 		&FilterRef{},
+		&SecurityGroup{},
+		&SecurityGroupRule{},
+		&SecurityGroupBinding{},
 		&VirtualPort{},
 		&DeviceAlias{},
 		&Disk{},
@@ -1384,6 +1511,7 @@ func InitDB(dataSourceName string) (*gorm.DB, error) {
 		&MediatedDevice{},
 		&MediatedDeviceAttachment{},
 		&VMSnapshot{},
+		&ProvisioningSeed{},
 		&AttachmentIndex{},
 		&Console{},
 		&DeviceAddress{},
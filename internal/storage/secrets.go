@@ -0,0 +1,118 @@
+package storage
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+)
+
+// secretKeySize is the AES-256 key length used for secrets at rest.
+const secretKeySize = 32
+
+// secretPrefix versions the ciphertext format stored in the database.
+const secretPrefix = "v1:"
+
+var (
+	secretKeyMu sync.RWMutex
+	secretKey   []byte
+)
+
+// ErrSecretKeyNotConfigured is returned when secrets are used before a key is loaded.
+var ErrSecretKeyNotConfigured = errors.New("secret key not configured")
+
+// SetSecretKey installs the key used by EncryptSecret and DecryptSecret.
+func SetSecretKey(key []byte) error {
+	if len(key) != secretKeySize {
+		return fmt.Errorf("secret key must be %d bytes, got %d", secretKeySize, len(key))
+	}
+	secretKeyMu.Lock()
+	defer secretKeyMu.Unlock()
+	secretKey = append([]byte(nil), key...)
+	return nil
+}
+
+// LoadOrCreateSecretKey reads the base64-encoded secret key from path,
+// generating a new random key and writing it with mode 0600 if the file does
+// not exist yet. The key file must be kept alongside backups of the database,
+// since stored secrets cannot be recovered without it.
+func LoadOrCreateSecretKey(path string) error {
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		key := make([]byte, secretKeySize)
+		if _, err := rand.Read(key); err != nil {
+			return fmt.Errorf("failed to generate secret key: %w", err)
+		}
+		encoded := base64.StdEncoding.EncodeToString(key) + "\n"
+		if err := os.WriteFile(path, []byte(encoded), 0600); err != nil {
+			return fmt.Errorf("failed to write secret key to %s: %w", path, err)
+		}
+		return SetSecretKey(key)
+	}
+	if err != nil {
+		return fmt.Errorf("failed to read secret key from %s: %w", path, err)
+	}
+	key, err := base64.StdEncoding.DecodeString(strings.TrimSpace(string(data)))
+	if err != nil {
+		return fmt.Errorf("invalid secret key in %s: %w", path, err)
+	}
+	return SetSecretKey(key)
+}
+
+func secretCipher() (cipher.AEAD, error) {
+	secretKeyMu.RLock()
+	key := secretKey
+	secretKeyMu.RUnlock()
+	if key == nil {
+		return nil, ErrSecretKeyNotConfigured
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// EncryptSecret seals plaintext with AES-256-GCM for storage in the database.
+func EncryptSecret(plaintext string) (string, error) {
+	aead, err := secretCipher()
+	if err != nil {
+		return "", err
+	}
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return "", fmt.Errorf("failed to generate nonce: %w", err)
+	}
+	sealed := aead.Seal(nonce, nonce, []byte(plaintext), nil)
+	return secretPrefix + base64.StdEncoding.EncodeToString(sealed), nil
+}
+
+// DecryptSecret opens a value produced by EncryptSecret.
+func DecryptSecret(ciphertext string) (string, error) {
+	aead, err := secretCipher()
+	if err != nil {
+		return "", err
+	}
+	encoded, ok := strings.CutPrefix(ciphertext, secretPrefix)
+	if !ok {
+		return "", fmt.Errorf("unrecognized secret format")
+	}
+	sealed, err := base64.StdEncoding.DecodeString(encoded)
+	if err != nil {
+		return "", fmt.Errorf("invalid secret encoding: %w", err)
+	}
+	if len(sealed) < aead.NonceSize() {
+		return "", fmt.Errorf("secret is too short")
+	}
+	nonce, body := sealed[:aead.NonceSize()], sealed[aead.NonceSize():]
+	plain, err := aead.Open(nil, nonce, body, nil)
+	if err != nil {
+		return "", fmt.Errorf("failed to decrypt secret (wrong key?): %w", err)
+	}
+	return string(plain), nil
+}
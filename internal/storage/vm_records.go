@@ -0,0 +1,76 @@
+package storage
+
+import (
+	"fmt"
+
+	"gorm.io/gorm"
+)
+
+// vmRecordModels are the tables whose rows belong to a single VM through
+// their vm_uuid column.
+var vmRecordModels = []interface{}{
+	&PortAttachment{},
+	&DiskAttachment{},
+	&AttachmentIndex{},
+	&Console{},
+	&VideoAttachment{},
+	&VideoDeviceAttachment{},
+	&ControllerAttachment{},
+	&SCSIControllerAttachment{},
+	&InputDeviceAttachment{},
+	&SoundCardAttachment{},
+	&HostDeviceAttachment{},
+	&MediatedDeviceAttachment{},
+	&TPMAttachment{},
+	&WatchdogAttachment{},
+	&SerialDeviceAttachment{},
+	&ChannelDeviceAttachment{},
+	&FilesystemAttachment{},
+	&SmartcardAttachment{},
+	&USBRedirectorAttachment{},
+	&RngDeviceAttachment{},
+	&PanicDeviceAttachment{},
+	&VsockAttachment{},
+	&MemoryBalloonAttachment{},
+	&ShmemDeviceAttachment{},
+	&IOMMUDeviceAttachment{},
+	&DeviceAlias{},
+	&VMSnapshot{},
+	&ProvisioningSeed{},
+	&BootConfig{},
+	&OSConfig{},
+	&SMBIOSSystemInfo{},
+	&CPUFeature{},
+	&CPUTopology{},
+	&CPUTune{},
+	&MemoryConfig{},
+	&MemoryBacking{},
+	&NUMANode{},
+	&SecurityLabel{},
+	&LaunchSecurity{},
+	&HypervisorFeature{},
+	&LifecycleAction{},
+	&Clock{},
+	&PerfEvent{},
+	&HardwareTrait{},
+	&PlacementPolicy{},
+	&QOSPolicy{},
+	&BlockStatistics{},
+	&NetworkStatistics{},
+	&CPUPerformance{},
+	&MemoryPerformance{},
+	&DevicePerformance{},
+}
+
+// DeleteVMRecords hard-deletes every row that belongs to a VM: its device
+// attachments and their indices, consoles, snapshot metadata, per-VM
+// configuration and statistics. Resources the attachments point at, such
+// as disks and ports, are left to the caller.
+func DeleteVMRecords(tx *gorm.DB, vmUUID string) error {
+	for _, model := range vmRecordModels {
+		if err := tx.Unscoped().Where("vm_uuid = ?", vmUUID).Delete(model).Error; err != nil {
+			return fmt.Errorf("failed to delete %T records of vm %s: %w", model, vmUUID, err)
+		}
+	}
+	return nil
+}
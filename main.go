@@ -41,6 +41,11 @@ func main() {
 		log.Fatalf("Failed to initialize database: %v", err)
 	}
 
+	// Load the key used to encrypt secrets (such as per-host SSH keys) at rest
+	if err := storage.LoadOrCreateSecretKey("virtumancer.key"); err != nil {
+		log.Fatalf("Failed to load secret key: %v", err)
+	}
+
 	// Initialize WebSocket Hub
 	hub := ws.NewHub()
 	go hub.Run()
@@ -68,84 +73,7 @@ func main() {
 	r.Use(middleware.Recoverer)
 
 	// API routes
-	r.Route("/api/v1", func(r chi.Router) {
-		r.Get("/health", apiHandler.HealthCheck)
-
-		// Host routes
-		r.Get("/hosts", apiHandler.GetHosts)
-		r.Post("/hosts", apiHandler.CreateHost)
-
-		// Global discovered VMs routes
-		r.Get("/discovered-vms", apiHandler.ListAllDiscoveredVMs)
-		r.Post("/discovered-vms/refresh", apiHandler.RefreshAllDiscoveredVMs)
-
-		r.Post("/hosts/{hostID}/connect", apiHandler.ConnectHost)
-		r.Post("/hosts/{hostID}/disconnect", apiHandler.DisconnectHost)
-		r.Get("/hosts/{hostID}/info", apiHandler.GetHostInfo)
-		r.Get("/hosts/{hostID}/stats", apiHandler.GetHostStats)
-		r.Get("/hosts/{hostID}/capabilities", apiHandler.GetHostCapabilities)
-		r.Post("/hosts/{hostID}/capabilities/refresh", apiHandler.RefreshHostCapabilities)
-		r.Patch("/hosts/{hostID}", apiHandler.UpdateHost)
-		r.Delete("/hosts/{hostID}", apiHandler.DeleteHost)
-
-		// VM routes
-		r.Get("/hosts/{hostID}/vms", apiHandler.ListVMsFromLibvirt)
-		r.Post("/hosts/{hostID}/vms", apiHandler.CreateVM)
-		// Discovered/Import routes
-		r.Get("/hosts/{hostID}/discovered-vms", apiHandler.ListDiscoveredVMs)
-		r.Post("/hosts/{hostID}/vms/{vmName}/import", apiHandler.ImportVM)
-		r.Post("/hosts/{hostID}/vms/import-all", apiHandler.ImportAllVMs)
-		r.Post("/hosts/{hostID}/vms/import-selected", apiHandler.ImportSelectedVMs)
-		r.Delete("/hosts/{hostID}/discovered-vms", apiHandler.DeleteSelectedDiscoveredVMs)
-		r.Post("/hosts/{hostID}/vms/{vmName}/start", apiHandler.StartVM)
-		r.Post("/hosts/{hostID}/vms/{vmName}/shutdown", apiHandler.ShutdownVM)
-		r.Post("/hosts/{hostID}/vms/{vmName}/reboot", apiHandler.RebootVM)
-		r.Post("/hosts/{hostID}/vms/{vmName}/forceoff", apiHandler.ForceOffVM)
-		r.Post("/hosts/{hostID}/vms/{vmName}/forcereset", apiHandler.ForceResetVM)
-		r.Post("/hosts/{hostID}/vms/{vmName}/sync-from-libvirt", apiHandler.SyncVMLive)
-		r.Post("/hosts/{hostID}/vms/{vmName}/rebuild-from-db", apiHandler.RebuildVM)
-		r.Put("/hosts/{hostID}/vms/{vmName}/state", apiHandler.UpdateVMState)
-		r.Get("/hosts/{hostID}/vms/{vmName}/stats", apiHandler.GetVMStats)
-		r.Get("/hosts/{hostID}/vms/{vmName}/hardware", apiHandler.GetVMHardware)
-		r.Get("/hosts/{hostID}/vms/{vmName}/hardware/extended", apiHandler.GetVMExtendedHardware)
-
-		// Port routes
-		r.Get("/hosts/{hostID}/ports", apiHandler.ListHostPorts)
-		r.Get("/hosts/{hostID}/vms/{vmName}/port-attachments", apiHandler.ListVMPortAttachments)
-
-		// Storage routes
-		r.Get("/storage/pools", apiHandler.ListStoragePools)
-		r.Get("/storage/volumes", apiHandler.ListStorageVolumes)
-		r.Delete("/storage/volumes/{id}", apiHandler.DeleteStorageVolume)
-		r.Get("/storage/disk-attachments", apiHandler.ListDiskAttachments)
-		r.Get("/hosts/{hostID}/storage/pools", apiHandler.ListHostStoragePools)
-		r.Get("/hosts/{hostID}/storage/volumes", apiHandler.ListHostStorageVolumes)
-
-		// Network routes
-		r.Get("/networks", apiHandler.ListNetworks)
-		r.Get("/ports", apiHandler.ListPorts)
-		r.Get("/port-attachments", apiHandler.ListPortAttachments)
-		r.Get("/hosts/{hostID}/networks", apiHandler.ListHostNetworks)
-
-		// Video / GPU routes
-		r.Get("/video/models", apiHandler.ListVideoModels)
-		r.Get("/hosts/{hostID}/video/devices", apiHandler.ListHostVideoDevices)
-		r.Get("/hosts/{hostID}/vms/{vmName}/video-attachments", apiHandler.ListVMVideoAttachments)
-
-		// Console routes
-		r.Get("/hosts/{hostID}/vms/{vmName}/console", apiHandler.HandleVMConsole)
-		r.Get("/hosts/{hostID}/vms/{vmName}/spice", apiHandler.HandleSpiceConsole)
-
-		// Dashboard routes
-		r.Get("/dashboard/stats", apiHandler.GetDashboardStats)
-		r.Get("/dashboard/activity", apiHandler.GetDashboardActivity)
-		r.Get("/dashboard/overview", apiHandler.GetDashboardOverview)
-
-		// Settings routes
-		r.Get("/settings/metrics", apiHandler.GetMetricsSettings)
-		r.Put("/settings/metrics", apiHandler.UpdateMetricsSettings)
-		r.Get("/settings/metrics/runtime", apiHandler.GetRuntimeMetricsSettings)
-	})
+	r.Mount("/api/v1", api.Routes(apiHandler))
 
 	// WebSocket route for UI updates
 	r.HandleFunc("/ws", apiHandler.HandleWebSocket)